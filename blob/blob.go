@@ -0,0 +1,30 @@
+// Package blob provides storage for binary objects, such as uploaded files.
+package blob
+
+import (
+	"context"
+	"io"
+
+	"github.com/go-surf/surf/errors"
+)
+
+// Store keeps binary objects under unique keys. Keys are slash separated
+// paths.
+type Store interface {
+	// Put writes the content of given reader under given key, replacing
+	// any previous value.
+	Put(ctx context.Context, key string, r io.Reader) error
+
+	// Get returns a reader for the content stored under given key. Reader
+	// must be closed by the caller.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// Delete removes the content stored under given key. Deleting a key
+	// that does not exist is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+var (
+	ErrNotFound   = errors.New("blob not found")
+	ErrInvalidKey = errors.New("invalid blob key")
+)
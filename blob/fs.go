@@ -0,0 +1,91 @@
+package blob
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-surf/surf/errors"
+)
+
+// NewFSStore returns a Store keeping all objects as files inside of given
+// directory.
+func NewFSStore(rootDir string) (Store, error) {
+	if err := os.MkdirAll(rootDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "cannot create root directory")
+	}
+	return &fsStore{root: rootDir}, nil
+}
+
+type fsStore struct {
+	root string
+}
+
+func (s *fsStore) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" || clean != "/"+key || strings.Contains(key, "\\") {
+		return "", errors.Wrap(ErrInvalidKey, "%q", key)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(clean)), nil
+}
+
+func (s *fsStore) Put(ctx context.Context, key string, r io.Reader) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return errors.Wrap(err, "cannot create directory")
+	}
+
+	// Write to a temporary file first, so that a partially written object
+	// is never visible.
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".upload-")
+	if err != nil {
+		return errors.Wrap(err, "cannot create temporary file")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "cannot write content")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "cannot close temporary file")
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return errors.Wrap(err, "cannot move temporary file")
+	}
+	return nil
+}
+
+func (s *fsStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := os.Open(p)
+	switch {
+	case err == nil:
+		return fd, nil
+	case os.IsNotExist(err):
+		return nil, ErrNotFound
+	default:
+		return nil, errors.Wrap(err, "cannot open file")
+	}
+}
+
+func (s *fsStore) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "cannot remove file")
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-surf/surf/errors"
+)
+
+// S3Config describes the connection to an S3 compatible service.
+type S3Config struct {
+	// Endpoint is the service URL, for example https://s3.amazonaws.com
+	// or http://localhost:9000 for a local MinIO instance.
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// NewS3Store returns a Store keeping all objects in a bucket of an S3
+// compatible service. Objects are addressed using the path style, which is
+// supported by all S3 implementations.
+func NewS3Store(conf S3Config, client *http.Client) (Store, error) {
+	endpoint, err := url.Parse(conf.Endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid endpoint")
+	}
+	if conf.Bucket == "" {
+		return nil, errors.New("bucket is required")
+	}
+	if conf.Region == "" {
+		conf.Region = "us-east-1"
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &s3Store{
+		conf:     conf,
+		endpoint: endpoint,
+		client:   client,
+		now:      time.Now,
+	}, nil
+}
+
+type s3Store struct {
+	conf     S3Config
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+}
+
+func (s *s3Store) objectURL(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") {
+		return "", errors.Wrap(ErrInvalidKey, "%q", key)
+	}
+	u := *s.endpoint
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + s.conf.Bucket + "/" + key
+	return u.String(), nil
+}
+
+func (s *s3Store) do(ctx context.Context, method, key string, body []byte) (*http.Response, error) {
+	rawurl, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, rawurl, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create request")
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = int64(len(body))
+
+	payloadHash := sha256.Sum256(body)
+	signV4(req, s.conf.AccessKey, s.conf.SecretKey, s.conf.Region, hex.EncodeToString(payloadHash[:]), s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot do request")
+	}
+	return resp, nil
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, r io.Reader) error {
+	// Payload must be signed, so the whole content is read into memory.
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, "cannot read content")
+	}
+	resp, err := s.do(ctx, "PUT", key, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return nil
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, "GET", key, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	default:
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+}
+
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, "DELETE", key, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	default:
+		return responseError(resp)
+	}
+}
+
+func responseError(resp *http.Response) error {
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("unexpected response %d: %s", resp.StatusCode, bytes.TrimSpace(b))
+}
+
+// signV4 signs given request using AWS Signature Version 4. Host header and
+// all headers set on the request are signed.
+//
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func signV4(req *http.Request, accessKey, secretKey, region, payloadHash string, now time.Time) {
+	const service = "s3"
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{
+		"host": req.URL.Host,
+	}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL.EscapedPath()),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalURI returns the path with each segment encoded as required by the
+// signature.
+func canonicalURI(escapedPath string) string {
+	if escapedPath == "" {
+		return "/"
+	}
+	segments := strings.Split(escapedPath, "/")
+	for i, seg := range segments {
+		raw, err := url.PathUnescape(seg)
+		if err != nil {
+			raw = seg
+		}
+		segments[i] = awsEscape(raw)
+	}
+	return strings.Join(segments, "/")
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes everything except the unreserved characters.
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,180 @@
+// Command gbbload measures how gbb performs with a large forum.
+//
+// The seed command fills the database with generated users, topics and
+// comments. Thread sizes and user activity have long tail distributions and
+// discussions come in bursts, like on a real forum:
+//
+//	gbbload seed -users 10000 -topics 100000 -comments 2000000
+//
+// The run command drives HTTP traffic of signed in users against a running
+// server and reports latency percentiles of every route. Users browse the
+// topic list, read topics, reply and search:
+//
+//	gbbload run -addr http://localhost:8000 -clients 50 -duration 5m
+//
+// Clients sign in as the seeded users, so both commands must use the same
+// password. The server must run with CSRF protection disabled, and with
+// comment rate limits that allow the replies, for example
+//
+//	NO_CSRF=true COMMENT_USER_LIMIT=0 COMMENT_IP_LIMIT=0 gbb
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"time"
+
+	"github.com/husio/gbb/gbb"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "Usage: gbbload <seed|run> [flags]")
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, os.Interrupt)
+		<-sigc
+		cancel()
+		signal.Stop(sigc)
+	}()
+
+	var err error
+	switch os.Args[1] {
+	case "seed":
+		err = runSeed(ctx, os.Args[2:])
+	case "run":
+		err = runWorkload(ctx, os.Args[2:])
+	default:
+		err = fmt.Errorf("unknown command %q", os.Args[1])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func runSeed(ctx context.Context, args []string) error {
+	var conf seedConfig
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	dbFl := fs.String("db", envDefault("DATABASE_URL", `host='localhost' port='5432' user='postgres' dbname='postgres' sslmode='disable'`), "PostgreSQL database connection details.")
+	fs.IntVar(&conf.Users, "users", 1000, "Number of users.")
+	fs.IntVar(&conf.Categories, "categories", 10, "Number of categories.")
+	fs.IntVar(&conf.Topics, "topics", 10000, "Number of topics.")
+	fs.IntVar(&conf.Comments, "comments", 200000, "Number of comments, including the first comment of every topic.")
+	fs.IntVar(&conf.MaxThread, "max-thread", 20000, "Maximum number of comments of a topic. Use 0 for no limit.")
+	fs.IntVar(&conf.Days, "days", 365, "Length of the period the content was written in, in days.")
+	fs.IntVar(&conf.ReadTopics, "read-topics", 50, "Average number of topics a user has read.")
+	fs.StringVar(&conf.Password, "password", "gbbload-password", "Password of the users.")
+	fs.Int64Var(&conf.Seed, "seed", 1, "Random generator seed. The same seed generates the same content.")
+	fs.IntVar(&conf.Workers, "workers", 8, "Number of comments written at the same time.")
+	fs.Parse(args)
+
+	db, err := sql.Open("postgres", *dbFl)
+	if err != nil {
+		return fmt.Errorf("cannot open SQL database: %s", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(conf.Workers + 2)
+
+	bbStore, err := gbb.NewPostgresBBStore(db)
+	if err != nil {
+		return fmt.Errorf("cannot create bb store: %s", err)
+	}
+	readTracker, err := gbb.NewPostgresReadProgressTracker(db)
+	if err != nil {
+		return fmt.Errorf("cannot create read tracker: %s", err)
+	}
+
+	start := time.Now()
+	if err := newSeeder(conf, bbStore, readTracker, os.Stderr).Seed(ctx); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "seeded in %s\n", time.Since(start).Round(time.Second))
+	return nil
+}
+
+func runWorkload(ctx context.Context, args []string) error {
+	var conf workloadConfig
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	dbFl := fs.String("db", envDefault("DATABASE_URL", `host='localhost' port='5432' user='postgres' dbname='postgres' sslmode='disable'`), "PostgreSQL database connection details, used to find the topics.")
+	fs.StringVar(&conf.Addr, "addr", "http://localhost:8000", "Address of the server.")
+	fs.IntVar(&conf.Clients, "clients", 20, "Number of users browsing at the same time.")
+	fs.IntVar(&conf.Users, "users", 1000, "Number of seeded users the clients sign in as.")
+	fs.StringVar(&conf.Password, "password", "gbbload-password", "Password of the seeded users.")
+	fs.DurationVar(&conf.Duration, "duration", time.Minute, "How long the workload runs.")
+	fs.DurationVar(&conf.Think, "think", 500*time.Millisecond, "Average pause between requests of a client.")
+	fs.Float64Var(&conf.ReplyRatio, "reply", 0.05, "Probability that a client replies to the topic it read.")
+	fs.Float64Var(&conf.SearchRatio, "search", 0.1, "Probability that a client searches after reading a topic.")
+	fs.Int64Var(&conf.Seed, "seed", 1, "Random generator seed.")
+	fs.Parse(args)
+
+	if conf.Clients < 1 || conf.Users < 1 {
+		return fmt.Errorf("at least one client and user is required")
+	}
+
+	topics, err := listTopics(ctx, *dbFl)
+	if err != nil {
+		return err
+	}
+
+	w := &workload{
+		conf:   conf,
+		topics: topics,
+		stats:  newLatencyStats(),
+	}
+	err = w.Run(ctx)
+	if reportErr := w.stats.WriteReport(os.Stdout); reportErr != nil && err == nil {
+		err = reportErr
+	}
+	return err
+}
+
+// listTopics returns IDs of all visible topics, the most recent first.
+// Recent topics are read more often.
+func listTopics(ctx context.Context, databaseURL string) ([]int64, error) {
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open SQL database: %s", err)
+	}
+	defer db.Close()
+	bbStore, err := gbb.NewPostgresBBStore(db)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create bb store: %s", err)
+	}
+
+	var ids []int64
+	var after int64
+	for {
+		topics, err := bbStore.ExportTopics(ctx, after, 1000)
+		if err != nil {
+			return nil, fmt.Errorf("cannot list topics: %s", err)
+		}
+		if len(topics) == 0 {
+			break
+		}
+		for _, t := range topics {
+			if !t.Hidden {
+				ids = append(ids, t.TopicID)
+			}
+		}
+		after = topics[len(topics)-1].TopicID
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+	return ids, nil
+}
+
+func envDefault(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/husio/gbb/gbb"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// seedConfig describes the generated data set.
+type seedConfig struct {
+	Users      int
+	Categories int
+	Topics     int
+	// Comments is the total number of comments, including the first
+	// comment of every topic.
+	Comments int
+	// MaxThread is the maximum number of comments of a single topic.
+	MaxThread int
+	// Days is the length of the period in which the content was
+	// written, ending now.
+	Days int
+	// ReadTopics is the average number of topics every user has read.
+	ReadTopics int
+	// Password of all users.
+	Password string
+	Seed     int64
+	Workers  int
+}
+
+// seeder fills the database with generated content. Given the same
+// configuration, the same content is generated, but database IDs depend on
+// what the database already contains.
+type seeder struct {
+	conf        seedConfig
+	bbStore     gbb.BBStore
+	readTracker gbb.ReadProgressTracker
+	progress    io.Writer
+	now         time.Time
+
+	rnd  *rand.Rand
+	text *textGenerator
+}
+
+func newSeeder(conf seedConfig, bbStore gbb.BBStore, readTracker gbb.ReadProgressTracker, progress io.Writer) *seeder {
+	rnd := rand.New(rand.NewSource(conf.Seed))
+	return &seeder{
+		conf:        conf,
+		bbStore:     bbStore,
+		readTracker: readTracker,
+		progress:    progress,
+		now:         time.Now().UTC().Truncate(time.Second),
+		rnd:         rnd,
+		text:        newTextGenerator(rnd, vocabulary(rnd, vocabularySize)),
+	}
+}
+
+// seededComment is a comment that was written to the database.
+type seededComment struct {
+	CommentID int64
+	Created   time.Time
+}
+
+func (s *seeder) Seed(ctx context.Context) error {
+	if s.conf.Users < 1 || s.conf.Categories < 1 || s.conf.Topics < 1 {
+		return fmt.Errorf("at least one user, category and topic is required")
+	}
+	if s.conf.Comments < s.conf.Topics {
+		return fmt.Errorf("every topic requires at least one comment")
+	}
+	if s.conf.MaxThread > 0 && s.conf.Comments > s.conf.Topics*s.conf.MaxThread {
+		return fmt.Errorf("%d topics cannot hold %d comments", s.conf.Topics, s.conf.Comments)
+	}
+
+	users, err := s.seedUsers(ctx)
+	if err != nil {
+		return err
+	}
+	categories, err := s.seedCategories(ctx)
+	if err != nil {
+		return err
+	}
+	threads, err := s.seedContent(ctx, users, categories)
+	if err != nil {
+		return err
+	}
+	return s.seedReadProgress(ctx, users, threads)
+}
+
+// seedUsers creates users named gbbload-1, gbbload-2 and so on, all with
+// the same password. Users that already exist are reused.
+func (s *seeder) seedUsers(ctx context.Context) ([]int64, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(s.conf.Password), bcrypt.MinCost)
+	if err != nil {
+		return nil, fmt.Errorf("cannot hash password: %s", err)
+	}
+	var scopes gbb.UserScope
+	for _, name := range []string{"createTopic", "createComment"} {
+		scope, err := gbb.ParseUserScope(name)
+		if err != nil {
+			return nil, err
+		}
+		scopes = scopes.Add(scope)
+	}
+
+	var ids []int64
+	for start := 1; start <= s.conf.Users; start += 1000 {
+		var names []string
+		for i := start; i < start+1000 && i <= s.conf.Users; i++ {
+			names = append(names, userName(i))
+		}
+		existing, err := s.bbStore.UsersByName(ctx, names)
+		if err != nil {
+			return nil, fmt.Errorf("cannot list users: %s", err)
+		}
+		byName := make(map[string]int64, len(existing))
+		for _, u := range existing {
+			byName[u.Name] = u.UserID
+		}
+		for _, name := range names {
+			id, ok := byName[name]
+			if !ok {
+				id, err = s.bbStore.ImportUser(ctx, gbb.ArchivedUser{
+					User:         gbb.User{Name: name, Scopes: scopes},
+					PasswordHash: string(hash),
+				})
+				if err != nil {
+					return nil, fmt.Errorf("cannot create user %s: %s", name, err)
+				}
+			}
+			ids = append(ids, id)
+		}
+	}
+	fmt.Fprintf(s.progress, "users: %d\n", len(ids))
+
+	// Few users write most of the content.
+	s.rnd.Shuffle(len(ids), func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	return ids, nil
+}
+
+func userName(n int) string {
+	return fmt.Sprintf("gbbload-%d", n)
+}
+
+func (s *seeder) seedCategories(ctx context.Context) ([]int64, error) {
+	var names []string
+	for i := 1; i <= s.conf.Categories; i++ {
+		names = append(names, fmt.Sprintf("Load %d", i))
+	}
+	existing, err := s.bbStore.ListCategories(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list categories: %s", err)
+	}
+	known := make(map[string]int64)
+	for _, c := range existing {
+		known[c.Name] = c.CategoryID
+	}
+	var missing []string
+	for _, name := range names {
+		if _, ok := known[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) != 0 {
+		if err := s.bbStore.AddCategories(ctx, missing); err != nil {
+			return nil, fmt.Errorf("cannot add categories: %s", err)
+		}
+		if existing, err = s.bbStore.ListCategories(ctx); err != nil {
+			return nil, fmt.Errorf("cannot list categories: %s", err)
+		}
+		for _, c := range existing {
+			known[c.Name] = c.CategoryID
+		}
+	}
+
+	ids := make([]int64, len(names))
+	for i, name := range names {
+		ids[i] = known[name]
+	}
+	fmt.Fprintf(s.progress, "categories: %d\n", len(ids))
+	return ids, nil
+}
+
+// threadSizes returns the number of comments of every topic. Sizes follow
+// the Pareto distribution, so most topics have a few comments and a few
+// topics have very many.
+func (s *seeder) threadSizes() []int {
+	const alpha = 1.2
+
+	n := s.conf.Topics
+	maxThread := s.conf.MaxThread
+	if maxThread < 1 {
+		maxThread = math.MaxInt32
+	}
+	weights := make([]float64, n)
+	for i := range weights {
+		weights[i] = math.Pow(1-s.rnd.Float64(), -1/alpha)
+	}
+
+	sizes := make([]int, n)
+	for i := range sizes {
+		sizes[i] = 1
+	}
+	extra := s.conf.Comments - n
+	if extra == 0 {
+		return sizes
+	}
+
+	cumulative := make([]float64, n)
+	for assigned := 0; assigned < extra; {
+		var total float64
+		for i, w := range weights {
+			total += w
+			cumulative[i] = total
+		}
+		if total == 0 {
+			break
+		}
+		for assigned < extra {
+			i := sort.SearchFloat64s(cumulative, s.rnd.Float64()*total)
+			if i >= n {
+				i = n - 1
+			}
+			if sizes[i] >= maxThread {
+				// Topic is full, so it is excluded from
+				// further rounds.
+				weights[i] = 0
+				break
+			}
+			sizes[i]++
+			assigned++
+		}
+	}
+	return sizes
+}
+
+// commentTimes returns creation times of the topic comments, starting with
+// created. Discussion comes in bursts of quick replies separated by long
+// pauses. All times are before now.
+func (s *seeder) commentTimes(created time.Time, count int) []time.Time {
+	times := make([]time.Time, count)
+	times[0] = created
+	var offsets []float64
+	var offset float64
+	for i := 1; i < count; i++ {
+		if s.rnd.Float64() < 0.9 {
+			offset += s.rnd.ExpFloat64() * float64(10*time.Minute)
+		} else {
+			offset += s.rnd.ExpFloat64() * float64(48*time.Hour)
+		}
+		offsets = append(offsets, offset)
+	}
+	scale := 1.0
+	if available := float64(s.now.Sub(created)); offset > available {
+		scale = available / offset
+	}
+	for i, o := range offsets {
+		times[i+1] = created.Add(time.Duration(o * scale)).Truncate(time.Millisecond)
+	}
+	return times
+}
+
+// topicCreated returns a random time of the seeded period. Fewer topics are
+// created at night.
+func (s *seeder) topicCreated() time.Time {
+	period := time.Duration(s.conf.Days) * 24 * time.Hour
+	for {
+		t := s.now.Add(-time.Duration(s.rnd.Int63n(int64(period) + 1)))
+		hour := float64(t.Hour()) + float64(t.Minute())/60
+		activity := (1 - math.Cos((hour-4)/24*2*math.Pi)) / 2
+		if s.rnd.Float64() < 0.1+0.9*activity {
+			return t.Truncate(time.Second)
+		}
+	}
+}
+
+// seedContent creates topics with their comments. Comments are written by
+// several workers at once.
+func (s *seeder) seedContent(ctx context.Context, users, categories []int64) (map[int64][]seededComment, error) {
+	sizes := s.threadSizes()
+	authors := rand.NewZipf(s.rnd, 1.1, 1, uint64(len(users)-1))
+	categoryOf := rand.NewZipf(s.rnd, 1.5, 1, uint64(len(categories)-1))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type job struct {
+		Comment gbb.Comment
+		Index   int
+	}
+	jobs := make(chan job, 1000)
+
+	var (
+		mu       sync.Mutex
+		threads  = make(map[int64][]seededComment)
+		firstErr error
+		written  int
+	)
+	workers := s.conf.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				id, err := s.bbStore.ImportComment(ctx, j.Comment)
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = fmt.Errorf("cannot create comment: %s", err)
+					}
+					cancel()
+				} else {
+					threads[j.Comment.TopicID][j.Index] = seededComment{CommentID: id, Created: j.Comment.Created}
+					written++
+					if written%100000 == 0 {
+						fmt.Fprintf(s.progress, "comments: %d/%d\n", written, s.conf.Comments)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	err := func() error {
+		defer close(jobs)
+		for i, size := range sizes {
+			created := s.topicCreated()
+			author := users[authors.Uint64()]
+			topicID, err := s.bbStore.ImportTopic(ctx, gbb.Topic{
+				Subject:    s.text.Subject(),
+				Created:    created,
+				Author:     gbb.User{UserID: author},
+				Category:   gbb.Category{CategoryID: categories[categoryOf.Uint64()]},
+				ViewsCount: int64(size) * int64(5+s.rnd.Intn(50)),
+			})
+			if err != nil {
+				return fmt.Errorf("cannot create topic: %s", err)
+			}
+			mu.Lock()
+			threads[topicID] = make([]seededComment, size)
+			mu.Unlock()
+
+			for n, t := range s.commentTimes(created, size) {
+				if n > 0 {
+					author = users[authors.Uint64()]
+				}
+				select {
+				case jobs <- job{
+					Index: n,
+					Comment: gbb.Comment{
+						TopicID: topicID,
+						Content: s.text.Comment(),
+						Created: t,
+						Author:  gbb.User{UserID: author},
+					},
+				}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			if (i+1)%10000 == 0 {
+				fmt.Fprintf(s.progress, "topics: %d/%d\n", i+1, len(sizes))
+			}
+		}
+		return nil
+	}()
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(s.progress, "topics: %d, comments: %d\n", len(sizes), written)
+	return threads, nil
+}
+
+// seedReadProgress marks topics as read. Users read popular topics more
+// often and do not always reach the end of the discussion.
+func (s *seeder) seedReadProgress(ctx context.Context, users []int64, threads map[int64][]seededComment) error {
+	if s.conf.ReadTopics < 1 {
+		return nil
+	}
+	topicIDs := make([]int64, 0, len(threads))
+	for id := range threads {
+		topicIDs = append(topicIDs, id)
+	}
+	sort.Slice(topicIDs, func(i, j int) bool {
+		return len(threads[topicIDs[i]]) > len(threads[topicIDs[j]])
+	})
+	popular := rand.NewZipf(s.rnd, 1.1, 1, uint64(len(topicIDs)-1))
+
+	var tracked int
+	for _, userID := range users {
+		for n := int(s.rnd.ExpFloat64() * float64(s.conf.ReadTopics)); n > 0; n-- {
+			topicID := topicIDs[popular.Uint64()]
+			comments := threads[topicID]
+			// Most readers are up to date.
+			last := len(comments) - 1
+			if s.rnd.Float64() < 0.3 {
+				last = s.rnd.Intn(len(comments))
+			}
+			if err := s.readTracker.Track(ctx, gbb.ReadProgress{
+				UserID:         userID,
+				TopicID:        topicID,
+				CommentID:      comments[last].CommentID,
+				CommentCreated: comments[last].Created,
+			}); err != nil {
+				return fmt.Errorf("cannot track read progress: %s", err)
+			}
+			tracked++
+		}
+	}
+	fmt.Fprintf(s.progress, "read progress: %d\n", tracked)
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/husio/gbb/gbb"
+)
+
+func TestSeed(t *testing.T) {
+	conf := seedConfig{
+		Users:      20,
+		Categories: 1,
+		Topics:     50,
+		Comments:   2000,
+		MaxThread:  300,
+		Days:       30,
+		ReadTopics: 5,
+		Password:   "password",
+		Seed:       42,
+		Workers:    4,
+	}
+	bbStore := &memSeedBBStore{}
+	readTracker := &memSeedReadTracker{}
+	s := newSeeder(conf, bbStore, readTracker, ioutil.Discard)
+	if err := s.Seed(context.Background()); err != nil {
+		t.Fatalf("cannot seed: %s", err)
+	}
+
+	if len(bbStore.users) != conf.Users {
+		t.Fatalf("want %d users, got %d", conf.Users, len(bbStore.users))
+	}
+	if len(bbStore.categories) != conf.Categories {
+		t.Fatalf("want %d categories, got %d", conf.Categories, len(bbStore.categories))
+	}
+	if len(bbStore.topics) != conf.Topics {
+		t.Fatalf("want %d topics, got %d", conf.Topics, len(bbStore.topics))
+	}
+	if len(bbStore.comments) != conf.Comments {
+		t.Fatalf("want %d comments, got %d", conf.Comments, len(bbStore.comments))
+	}
+
+	sizes := make(map[int64]int)
+	first := make(map[int64]time.Time)
+	for _, c := range bbStore.comments {
+		sizes[c.TopicID]++
+		if f, ok := first[c.TopicID]; !ok || c.Created.Before(f) {
+			first[c.TopicID] = c.Created
+		}
+		if c.Created.After(s.now) || c.Created.Before(s.now.AddDate(0, 0, -conf.Days)) {
+			t.Fatalf("comment created %s outside of the seeded period", c.Created)
+		}
+	}
+	var largest int
+	for _, topic := range bbStore.topics {
+		size := sizes[topic.TopicID]
+		if size > conf.MaxThread {
+			t.Fatalf("topic %d has %d comments", topic.TopicID, size)
+		}
+		if size > largest {
+			largest = size
+		}
+		if !first[topic.TopicID].Equal(topic.Created) {
+			t.Fatalf("topic %d created %s, but its first comment %s", topic.TopicID, topic.Created, first[topic.TopicID])
+		}
+	}
+	// Threads are long tailed, so the largest one is way bigger than
+	// the average.
+	if avg := conf.Comments / conf.Topics; largest < 3*avg {
+		t.Fatalf("largest topic has %d comments, average is %d", largest, avg)
+	}
+	if len(readTracker.progress) == 0 {
+		t.Fatal("no read progress seeded")
+	}
+
+	// The same seed generates the same content.
+	again := newSeeder(conf, &memSeedBBStore{}, &memSeedReadTracker{}, ioutil.Discard)
+	againStore := again.bbStore.(*memSeedBBStore)
+	if err := again.Seed(context.Background()); err != nil {
+		t.Fatalf("cannot seed again: %s", err)
+	}
+	for i := range bbStore.topics {
+		a, b := bbStore.topics[i], againStore.topics[i]
+		if a.Subject != b.Subject || a.Created.Sub(s.now) != b.Created.Sub(again.now) {
+			t.Fatalf("topic %d differs: %+v != %+v", i, a, b)
+		}
+	}
+}
+
+func TestSeedReusesUsers(t *testing.T) {
+	conf := seedConfig{Users: 3, Categories: 2, Topics: 2, Comments: 2, Password: "password", Workers: 1}
+	bbStore := &memSeedBBStore{}
+	for i := 0; i < 2; i++ {
+		if err := newSeeder(conf, bbStore, &memSeedReadTracker{}, ioutil.Discard).Seed(context.Background()); err != nil {
+			t.Fatalf("cannot seed: %s", err)
+		}
+	}
+	if len(bbStore.users) != 3 || len(bbStore.categories) != 2 {
+		t.Fatalf("want 3 users and 2 categories, got %d and %d", len(bbStore.users), len(bbStore.categories))
+	}
+	if len(bbStore.topics) != 4 {
+		t.Fatalf("want 4 topics, got %d", len(bbStore.topics))
+	}
+}
+
+func TestTextGenerator(t *testing.T) {
+	words := vocabulary(rand.New(rand.NewSource(1)), 1000)
+	a := newTextGenerator(rand.New(rand.NewSource(1)), words)
+	b := newTextGenerator(rand.New(rand.NewSource(1)), words)
+	for i := 0; i < 10; i++ {
+		if ca, cb := a.Comment(), b.Comment(); ca != cb {
+			t.Fatalf("the same seed generated %q and %q", ca, cb)
+		}
+	}
+	if len(words) != 1000 {
+		t.Fatalf("want 1000 words, got %d", len(words))
+	}
+	if !reflect.DeepEqual(vocabulary(rand.New(rand.NewSource(2)), 600), vocabulary(rand.New(rand.NewSource(2)), 600)) {
+		t.Fatal("vocabulary differs")
+	}
+}
+
+type memSeedBBStore struct {
+	gbb.BBStore
+
+	mu         sync.Mutex
+	users      []gbb.ArchivedUser
+	categories []*gbb.Category
+	topics     []gbb.Topic
+	comments   []gbb.Comment
+}
+
+func (s *memSeedBBStore) UsersByName(ctx context.Context, names []string) ([]*gbb.User, error) {
+	var users []*gbb.User
+	for _, name := range names {
+		for _, u := range s.users {
+			if u.Name == name {
+				user := u.User
+				users = append(users, &user)
+			}
+		}
+	}
+	return users, nil
+}
+
+func (s *memSeedBBStore) ImportUser(ctx context.Context, u gbb.ArchivedUser) (int64, error) {
+	u.UserID = int64(len(s.users) + 1)
+	s.users = append(s.users, u)
+	return u.UserID, nil
+}
+
+func (s *memSeedBBStore) ListCategories(ctx context.Context) ([]*gbb.Category, error) {
+	return s.categories, nil
+}
+
+func (s *memSeedBBStore) AddCategories(ctx context.Context, names []string) error {
+	for _, name := range names {
+		s.categories = append(s.categories, &gbb.Category{CategoryID: int64(len(s.categories) + 1), Name: name})
+	}
+	return nil
+}
+
+func (s *memSeedBBStore) ImportTopic(ctx context.Context, t gbb.Topic) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.TopicID = int64(len(s.topics) + 1)
+	s.topics = append(s.topics, t)
+	return t.TopicID, nil
+}
+
+func (s *memSeedBBStore) ImportComment(ctx context.Context, c gbb.Comment) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.CommentID = int64(len(s.comments) + 1)
+	s.comments = append(s.comments, c)
+	return c.CommentID, nil
+}
+
+type memSeedReadTracker struct {
+	gbb.ReadProgressTracker
+
+	progress []gbb.ReadProgress
+}
+
+func (t *memSeedReadTracker) Track(ctx context.Context, p gbb.ReadProgress) error {
+	if p.CommentID == 0 {
+		return gbb.ErrNotFound
+	}
+	t.progress = append(t.progress, p)
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+)
+
+// commonWords are the most frequent words of the generated text. The
+// vocabulary is extended with made up words, which are rare, so that
+// searches for them select only a few comments.
+var commonWords = strings.Fields(`
+	the of and to a in is it you that he was for on are with as I his they
+	be at one have this from or had by not word but what some we can out
+	other were all there when up use your how said an each she which do
+	their time if will way about many then them write would like so these
+	her long make thing see him two has look more day could go come did
+	number sound no most people my over know water than call first who may
+	down side been now find any new work part take get place made live where
+	after back little only round man year came show every good me give our
+	under name very through just form sentence great think say help low line
+	differ turn cause much mean before move right boy old too same tell does
+	set three want air well also play small end put home read hand port large
+	spell add even land here must big high such follow act why ask men change
+	went light kind off need house picture try us again animal point mother
+	world near build self earth father head stand own page should country
+	found answer school grow study still learn plant cover food sun four
+	between state keep eye never last let thought city tree cross farm hard
+	start might story saw far sea draw left late run while press close night
+	real life few north open seem together next white children begin got walk
+	example ease paper group always music those both mark often letter until
+	mile river car feet care second book carry took science eat room friend
+	began idea fish mountain stop once base hear horse cut sure watch color
+	face wood main enough plain girl usual young ready above ever red list
+	though feel talk bird soon body dog family direct pose leave song measure
+	door product black short numeral class wind question happen complete ship
+	area half rock order fire south problem piece told knew pass since top
+	whole king space heard best hour better true during hundred five remember
+	step early hold west ground interest reach fast verb sing listen six table
+	travel less morning ten simple several vowel toward war lay against
+	pattern slow center love person money serve appear road map rain rule
+	govern pull cold notice voice unit power town fine certain fly fall lead
+	cry dark machine note wait plan figure star box noun field rest correct
+	able pound done beauty drive stood contain front teach week final gave
+	green oh quick develop ocean warm free minute strong special mind behind
+	clear tail produce fact street inch multiply nothing course stay wheel
+	full force blue object decide surface deep moon island foot system busy
+	test record boat common gold possible plane stead dry wonder laugh
+	thousand ago ran check game shape equate hot miss brought heat snow tire
+	bring yes distant fill east paint language among`)
+
+// vocabularySize is the number of distinct words of the generated text.
+const vocabularySize = 20000
+
+// vocabulary returns size words ordered by their frequency.
+func vocabulary(rnd *rand.Rand, size int) []string {
+	syllables := strings.Fields("ka lo mi ne ru sa te vo zi bra che dri fle gro pla stu tor wen")
+	words := append([]string(nil), commonWords...)
+	seen := make(map[string]bool, size)
+	for _, w := range words {
+		seen[w] = true
+	}
+	for len(words) < size {
+		var b strings.Builder
+		for n := 2 + rnd.Intn(3); n > 0; n-- {
+			b.WriteString(syllables[rnd.Intn(len(syllables))])
+		}
+		if w := b.String(); !seen[w] {
+			seen[w] = true
+			words = append(words, w)
+		}
+	}
+	return words[:size]
+}
+
+// textGenerator writes text with the word frequencies following Zipf's law,
+// like a natural language does.
+type textGenerator struct {
+	rnd   *rand.Rand
+	words []string
+	zipf  *rand.Zipf
+}
+
+// newTextGenerator returns a generator using given vocabulary, ordered by
+// the word frequency.
+func newTextGenerator(rnd *rand.Rand, words []string) *textGenerator {
+	return &textGenerator{
+		rnd:   rnd,
+		words: words,
+		zipf:  rand.NewZipf(rnd, 1.07, 2, uint64(len(words)-1)),
+	}
+}
+
+// Word returns a random word.
+func (g *textGenerator) Word() string {
+	return g.words[g.zipf.Uint64()]
+}
+
+// Subject returns a topic subject.
+func (g *textGenerator) Subject() string {
+	s := g.sentence(3 + g.rnd.Intn(8))
+	return strings.TrimSuffix(s, ".")
+}
+
+// Comment returns a comment content. Most comments are short, but a few are
+// very long.
+func (g *textGenerator) Comment() string {
+	n := int(math.Exp(g.rnd.NormFloat64() + 3.4))
+	if n < 2 {
+		n = 2
+	} else if n > 2000 {
+		n = 2000
+	}
+
+	var paragraphs []string
+	for n > 0 {
+		var sentences []string
+		for p := 10 + g.rnd.Intn(60); p > 0 && n > 0; {
+			size := 3 + g.rnd.Intn(15)
+			if size > n {
+				size = n
+			}
+			sentences = append(sentences, g.sentence(size))
+			n -= size
+			p -= size
+		}
+		paragraphs = append(paragraphs, strings.Join(sentences, " "))
+	}
+	return strings.Join(paragraphs, "\n\n")
+}
+
+func (g *textGenerator) sentence(size int) string {
+	words := make([]string, size)
+	for i := range words {
+		words[i] = g.Word()
+	}
+	words[0] = strings.ToUpper(words[0][:1]) + words[0][1:]
+	return strings.Join(words, " ") + "."
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// workloadConfig describes the simulated traffic.
+type workloadConfig struct {
+	Addr string
+	// Clients is the number of users browsing at the same time.
+	Clients int
+	// Users is the number of seeded users the clients sign in as.
+	Users    int
+	Password string
+	Duration time.Duration
+	// Think is the average pause between requests of a client.
+	Think time.Duration
+	// ReplyRatio and SearchRatio are the probabilities that a client
+	// replies to the topic it read or searches.
+	ReplyRatio  float64
+	SearchRatio float64
+	Seed        int64
+}
+
+// Routes of the workload.
+const (
+	routeBrowse = "browse"
+	routeRead   = "read"
+	routeReply  = "reply"
+	routeSearch = "search"
+)
+
+// workload drives HTTP traffic of simulated users and measures how long the
+// server takes to respond.
+type workload struct {
+	conf   workloadConfig
+	topics []int64
+	stats  *latencyStats
+}
+
+// Run simulates clients until the configured duration passes or the context
+// is cancelled. Topics are ordered from the most popular.
+func (w *workload) Run(ctx context.Context) error {
+	if len(w.topics) == 0 {
+		return fmt.Errorf("no topics to read")
+	}
+	words := vocabulary(rand.New(rand.NewSource(w.conf.Seed)), vocabularySize)
+
+	ctx, cancel := context.WithTimeout(ctx, w.conf.Duration)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	for i := 0; i < w.conf.Clients; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			if err := w.client(ctx, n, words); err != nil && ctx.Err() == nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// client signs in and repeats the script: browse the topic list, read a
+// topic, sometimes reply to it and sometimes search.
+func (w *workload) client(ctx context.Context, n int, words []string) error {
+	rnd := rand.New(rand.NewSource(w.conf.Seed + int64(n)))
+	text := newTextGenerator(rnd, words)
+	popular := rand.NewZipf(rnd, 1.1, 1, uint64(len(w.topics)-1))
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Jar: jar,
+		// Following redirects would measure the next page as well.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	login := userName(n%w.conf.Users + 1)
+	req, err := http.NewRequest("POST", w.conf.Addr+"/login/", strings.NewReader(url.Values{
+		"login":    {login},
+		"password": {w.conf.Password},
+	}.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("cannot sign in as %s: %s", login, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		return fmt.Errorf("cannot sign in as %s: response %d", login, resp.StatusCode)
+	}
+
+	think := func() bool {
+		pause := time.Duration(rnd.ExpFloat64() * float64(w.conf.Think))
+		select {
+		case <-time.After(pause):
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for think() {
+		w.do(ctx, client, routeBrowse, "GET", "/t/", nil)
+
+		topicID := w.topics[popular.Uint64()]
+		path := fmt.Sprintf("/t/%d/", topicID)
+		if rnd.Float64() < 0.5 {
+			// Returning readers jump to the end.
+			path += "?page=last"
+		}
+		if !think() {
+			break
+		}
+		w.do(ctx, client, routeRead, "GET", path, nil)
+
+		if rnd.Float64() < w.conf.ReplyRatio {
+			if !think() {
+				break
+			}
+			w.do(ctx, client, routeReply, "POST", fmt.Sprintf("/t/%d/comment/", topicID), map[string]string{
+				"content": text.Comment(),
+			})
+		}
+		if rnd.Float64() < w.conf.SearchRatio {
+			if !think() {
+				break
+			}
+			w.do(ctx, client, routeSearch, "GET", "/t/search/?q="+url.QueryEscape(text.Word()), nil)
+		}
+	}
+	return nil
+}
+
+// do sends the request and records its latency. Responses with status 400
+// and above are counted as errors.
+func (w *workload) do(ctx context.Context, client *http.Client, route, method, path string, form map[string]string) {
+	var (
+		body        io.Reader
+		contentType string
+	)
+	if form != nil {
+		var b bytes.Buffer
+		mw := multipart.NewWriter(&b)
+		for name, value := range form {
+			mw.WriteField(name, value)
+		}
+		mw.Close()
+		body, contentType = &b, mw.FormDataContentType()
+	}
+	req, err := http.NewRequest(method, w.conf.Addr+path, body)
+	if err != nil {
+		w.stats.Record(route, 0, err)
+		return
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() == nil {
+			w.stats.Record(route, time.Since(start), err)
+		}
+		return
+	}
+	// Response is complete only when the whole body was sent.
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	took := time.Since(start)
+	if err == nil && resp.StatusCode >= 400 {
+		err = fmt.Errorf("response %d", resp.StatusCode)
+	}
+	if ctx.Err() == nil {
+		w.stats.Record(route, took, err)
+	}
+}
+
+// latencyStats collects response times of every route.
+type latencyStats struct {
+	mu     sync.Mutex
+	start  time.Time
+	routes map[string]*routeStats
+}
+
+type routeStats struct {
+	took   []time.Duration
+	errors int
+	// lastErr is an example of the failure.
+	lastErr error
+}
+
+func newLatencyStats() *latencyStats {
+	return &latencyStats{
+		start:  time.Now(),
+		routes: make(map[string]*routeStats),
+	}
+}
+
+func (s *latencyStats) Record(route string, took time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rs, ok := s.routes[route]
+	if !ok {
+		rs = &routeStats{}
+		s.routes[route] = rs
+	}
+	if err != nil {
+		rs.errors++
+		rs.lastErr = err
+		return
+	}
+	rs.took = append(rs.took, took)
+}
+
+// WriteReport writes the latency percentiles of successful requests of
+// every route.
+func (s *latencyStats) WriteReport(out io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elapsed := time.Since(s.start).Seconds()
+	routes := make([]string, 0, len(s.routes))
+	for route := range s.routes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "route\trequests\terrors\treq/s\tp50\tp90\tp99\tmax\t")
+	for _, route := range routes {
+		rs := s.routes[route]
+		took := append([]time.Duration(nil), rs.took...)
+		sort.Slice(took, func(i, j int) bool { return took[i] < took[j] })
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\t\n",
+			route,
+			len(took)+rs.errors,
+			rs.errors,
+			float64(len(took)+rs.errors)/elapsed,
+			percentile(took, 50),
+			percentile(took, 90),
+			percentile(took, 99),
+			percentile(took, 100),
+		)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if err := s.routes[route].lastErr; err != nil {
+			fmt.Fprintf(out, "%s failed: %s\n", route, err)
+		}
+	}
+	return nil
+}
+
+// percentile returns the duration that p percent of sorted durations do not
+// exceed.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i].Round(time.Microsecond)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkload(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		visited = make(map[string]int)
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login/" {
+			if r.FormValue("password") != "secret" || !strings.HasPrefix(r.FormValue("login"), "gbbload-") {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: "auth", Value: r.FormValue("login"), Path: "/"})
+			w.Header().Set("Location", "/")
+			w.WriteHeader(http.StatusSeeOther)
+			return
+		}
+		if _, err := r.Cookie("auth"); err != nil {
+			http.Error(w, "not signed in", http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		visited[r.Method+" "+r.URL.Path]++
+		mu.Unlock()
+		if r.URL.Path == "/t/search/" && r.URL.Query().Get("q") == "" {
+			http.Error(w, "no query", http.StatusBadRequest)
+			return
+		}
+		if r.Method == "POST" {
+			if r.FormValue("content") == "" {
+				http.Error(w, "no content", http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Location", "/t/1/")
+			w.WriteHeader(http.StatusSeeOther)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	w := &workload{
+		conf: workloadConfig{
+			Addr:        server.URL,
+			Clients:     4,
+			Users:       2,
+			Password:    "secret",
+			Duration:    time.Second,
+			Think:       time.Millisecond,
+			ReplyRatio:  0.5,
+			SearchRatio: 0.5,
+		},
+		topics: []int64{3, 2, 1},
+		stats:  newLatencyStats(),
+	}
+	if err := w.Run(context.Background()); err != nil {
+		t.Fatalf("workload failed: %s", err)
+	}
+
+	for _, route := range []string{routeBrowse, routeRead, routeReply, routeSearch} {
+		rs, ok := w.stats.routes[route]
+		if !ok || len(rs.took) == 0 {
+			t.Errorf("no %s requests", route)
+			continue
+		}
+		if rs.errors != 0 {
+			t.Errorf("%d %s requests failed: %s", rs.errors, route, rs.lastErr)
+		}
+	}
+	if visited["GET /t/"] == 0 || visited["POST /t/1/comment/"]+visited["POST /t/2/comment/"]+visited["POST /t/3/comment/"] == 0 {
+		t.Fatalf("unexpected requests %v", visited)
+	}
+
+	var report bytes.Buffer
+	if err := w.stats.WriteReport(&report); err != nil {
+		t.Fatalf("cannot write report: %s", err)
+	}
+	if !strings.Contains(report.String(), "p99") || !strings.Contains(report.String(), routeSearch) {
+		t.Fatalf("unexpected report\n%s", report.String())
+	}
+}
+
+func TestWorkloadSignInFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	w := &workload{
+		conf:   workloadConfig{Addr: server.URL, Clients: 1, Users: 1, Duration: time.Second},
+		topics: []int64{1},
+		stats:  newLatencyStats(),
+	}
+	if err := w.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "cannot sign in") {
+		t.Fatalf("want sign in error, got %v", err)
+	}
+}
+
+func TestLatencyStats(t *testing.T) {
+	stats := newLatencyStats()
+	for i := 1; i <= 100; i++ {
+		stats.Record("read", time.Duration(i)*time.Millisecond, nil)
+	}
+	stats.Record("read", 0, errors.New("response 500"))
+
+	took := stats.routes["read"].took
+	cases := map[int]time.Duration{
+		50:  50 * time.Millisecond,
+		90:  90 * time.Millisecond,
+		99:  99 * time.Millisecond,
+		100: 100 * time.Millisecond,
+	}
+	for p, want := range cases {
+		if got := percentile(took, p); got != want {
+			t.Errorf("p%d: want %s, got %s", p, want, got)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("want 0 for no requests, got %s", got)
+	}
+
+	var report bytes.Buffer
+	if err := stats.WriteReport(&report); err != nil {
+		t.Fatalf("cannot write report: %s", err)
+	}
+	if !strings.Contains(report.String(), "read failed: response 500") {
+		t.Fatalf("failure is not reported\n%s", report.String())
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	bbcodeCodeRx       = regexp.MustCompile(`(?is)\[code(?:=[^\]]*)?\](.*?)\[/code\]`)
+	bbcodeQuoteOpenRx  = regexp.MustCompile(`(?i)\[quote(?:=([^\]]*))?\]`)
+	bbcodeQuoteCloseRx = regexp.MustCompile(`(?i)\[/quote\]`)
+	bbcodeBoldRx       = regexp.MustCompile(`(?is)\[b\](.*?)\[/b\]`)
+	bbcodeItalicRx     = regexp.MustCompile(`(?is)\[i\](.*?)\[/i\]`)
+	bbcodeStrikeRx     = regexp.MustCompile(`(?is)\[s\](.*?)\[/s\]`)
+	bbcodeLinkRx       = regexp.MustCompile(`(?is)\[url=([^\]]+)\](.*?)\[/url\]`)
+	bbcodeImageRx      = regexp.MustCompile(`(?is)\[img\](.*?)\[/img\]`)
+	bbcodeListItemRx   = regexp.MustCompile(`(?i)\s*\[\*\]\s*`)
+	bbcodeTagRx        = regexp.MustCompile(`(?i)\[/?(?:u|color|size|font|center|left|right|url|email|list|\*|attachment|spoiler|youtube|flash)(?:=[^\]]*)?\]`)
+)
+
+// bbcodeToMarkdown converts BBCode markup into markdown. Tags without
+// markdown counterpart are removed, leaving their content.
+func bbcodeToMarkdown(s string) string {
+	// Code is copied verbatim, so it is converted separately from the
+	// rest of the text.
+	var b strings.Builder
+	for {
+		loc := bbcodeCodeRx.FindStringSubmatchIndex(s)
+		if loc == nil {
+			b.WriteString(bbcodeInline(s))
+			break
+		}
+		b.WriteString(bbcodeInline(s[:loc[0]]))
+		b.WriteString("\n```\n")
+		b.WriteString(strings.Trim(s[loc[2]:loc[3]], "\n"))
+		b.WriteString("\n```\n")
+		s = s[loc[1]:]
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func bbcodeInline(s string) string {
+	s = bbcodeQuotes(s)
+	s = bbcodeBoldRx.ReplaceAllString(s, "**$1**")
+	s = bbcodeItalicRx.ReplaceAllString(s, "*$1*")
+	s = bbcodeStrikeRx.ReplaceAllString(s, "~~$1~~")
+	s = bbcodeLinkRx.ReplaceAllString(s, "[$2]($1)")
+	s = bbcodeImageRx.ReplaceAllString(s, "![]($1)")
+	s = bbcodeListItemRx.ReplaceAllString(s, "\n- ")
+	return bbcodeTagRx.ReplaceAllString(s, "")
+}
+
+// bbcodeQuotes converts quotes into markdown block quotes, starting with the
+// innermost one.
+func bbcodeQuotes(s string) string {
+	for {
+		closing := bbcodeQuoteCloseRx.FindStringIndex(s)
+		if closing == nil {
+			return s
+		}
+		openings := bbcodeQuoteOpenRx.FindAllStringSubmatchIndex(s[:closing[0]], -1)
+		if len(openings) == 0 {
+			// Unbalanced closing tag.
+			s = s[:closing[0]] + s[closing[1]:]
+			continue
+		}
+		open := openings[len(openings)-1]
+
+		var quote strings.Builder
+		if open[2] >= 0 {
+			// Author can be followed by a reference to the quoted
+			// post, for example "bob, post:3, topic:12".
+			author := strings.Trim(s[open[2]:open[3]], `"' `)
+			if i := strings.IndexByte(author, ','); i >= 0 {
+				author = author[:i]
+			}
+			if author != "" {
+				quote.WriteString("> **" + author + "** wrote:\n>\n")
+			}
+		}
+		for _, line := range strings.Split(strings.Trim(s[open[1]:closing[0]], "\n"), "\n") {
+			if line == "" || strings.HasPrefix(line, ">") {
+				quote.WriteString(">" + line + "\n")
+			} else {
+				quote.WriteString("> " + line + "\n")
+			}
+		}
+		before, after := strings.TrimRight(s[:open[0]], "\n"), strings.TrimLeft(s[closing[1]:], "\n")
+		if before != "" {
+			before += "\n\n"
+		}
+		s = before + quote.String() + "\n" + after
+	}
+}
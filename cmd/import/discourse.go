@@ -0,0 +1,182 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/husio/gbb/gbb"
+)
+
+// readDiscourse imports users, categories, topics and posts of a Discourse
+// backup. Backup is either the complete archive or the database dump it
+// contains, optionally gzip compressed.
+//
+// Private messages, deleted content, read restricted categories and content
+// of system users are skipped. Posts are already written in markdown.
+//
+// Dump lists tables alphabetically, so posts come before users. All rows are
+// read into memory first.
+func readDiscourse(ctx context.Context, r io.Reader, im importer) error {
+	dump, err := discourseDump(r)
+	if err != nil {
+		return err
+	}
+
+	var users, categories, topics, posts []map[string]string
+	tables := map[string]bool{"users": true, "categories": true, "topics": true, "posts": true}
+	err = readPostgresDump(dump, tables, func(table string, row map[string]string) error {
+		switch table {
+		case "users":
+			users = append(users, row)
+		case "categories":
+			categories = append(categories, row)
+		case "topics":
+			topics = append(topics, row)
+		case "posts":
+			posts = append(posts, row)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot read dump: %s", err)
+	}
+
+	sortRows(users, "id")
+	sortRows(categories, "id")
+	sortRows(topics, "id")
+	sort.SliceStable(posts, func(i, j int) bool {
+		ti, tj := posts[i]["created_at"], posts[j]["created_at"]
+		if ti != tj {
+			return ti < tj
+		}
+		return rowInt(posts[i], "id") < rowInt(posts[j], "id")
+	})
+
+	// System users have IDs below 1.
+	authors := make(map[string]bool)
+	for _, u := range users {
+		if rowInt(u, "id") < 1 {
+			continue
+		}
+		if err := im.User(ctx, gbb.ForeignUser{ID: u["id"], Name: u["username"]}); err != nil {
+			return err
+		}
+		authors[u["id"]] = true
+	}
+
+	imported := make(map[string]bool)
+	for _, c := range categories {
+		if c["read_restricted"] == "t" {
+			continue
+		}
+		if err := im.Category(ctx, gbb.ForeignCategory{ID: c["id"], Name: c["name"]}); err != nil {
+			return err
+		}
+		imported["category:"+c["id"]] = true
+	}
+
+	for _, t := range topics {
+		if t["archetype"] != "regular" || t["deleted_at"] != "" || t["visible"] == "f" {
+			continue
+		}
+		if !authors[t["user_id"]] || !imported["category:"+t["category_id"]] {
+			continue
+		}
+		created, err := discourseTime(t["created_at"])
+		if err != nil {
+			return fmt.Errorf("topic %s: %s", t["id"], err)
+		}
+		if err := im.Topic(ctx, gbb.ForeignTopic{
+			ID:         t["id"],
+			Subject:    t["title"],
+			Created:    created,
+			AuthorID:   t["user_id"],
+			CategoryID: t["category_id"],
+			ViewsCount: rowInt(t, "views"),
+			Locked:     t["closed"] == "t",
+		}); err != nil {
+			return err
+		}
+		imported["topic:"+t["id"]] = true
+	}
+
+	// Other post types are moderator notes and whispers.
+	const regularPostType = "1"
+	for _, p := range posts {
+		if p["post_type"] != regularPostType || p["deleted_at"] != "" || p["hidden"] == "t" {
+			continue
+		}
+		if !authors[p["user_id"]] || !imported["topic:"+p["topic_id"]] {
+			continue
+		}
+		created, err := discourseTime(p["created_at"])
+		if err != nil {
+			return fmt.Errorf("post %s: %s", p["id"], err)
+		}
+		if err := im.Comment(ctx, gbb.ForeignComment{
+			ID:       p["id"],
+			TopicID:  p["topic_id"],
+			AuthorID: p["user_id"],
+			Content:  bbcodeQuotes(p["raw"]),
+			Created:  created,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discourseDump returns the database dump of the backup.
+func discourseDump(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read gzip: %s", err)
+		}
+		br = bufio.NewReader(gz)
+	}
+	// Archive is recognized by the magic value of the tar header.
+	if magic, err := br.Peek(262); err != nil || string(magic[257:]) != "ustar" {
+		return br, nil
+	}
+
+	archive := tar.NewReader(br)
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("backup does not contain the database dump")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read backup: %s", err)
+		}
+		switch path.Base(hdr.Name) {
+		case "dump.sql":
+			return archive, nil
+		case "dump.sql.gz":
+			gz, err := gzip.NewReader(archive)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read dump gzip: %s", err)
+			}
+			return gz, nil
+		}
+	}
+}
+
+// discourseTime parses timestamps, which Discourse keeps in UTC.
+func discourseTime(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999", "2006-01-02 15:04:05.999999999-07"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
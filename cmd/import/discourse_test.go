@@ -0,0 +1,105 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/husio/gbb/gbb"
+)
+
+const discourseSQL = `--
+-- PostgreSQL database dump
+--
+
+COPY public.categories (id, name, read_restricted) FROM stdin;
+1	General	f
+2	Staff	t
+\.
+
+
+COPY public.posts (id, user_id, topic_id, post_type, raw, hidden, created_at, deleted_at) FROM stdin;
+12	2	7	1	[quote="alice, post:1, topic:7"]\nfirst\n[/quote]\n\nagreed	f	2020-01-02 10:00:00.5	\N
+11	1	7	1	first\tpost	f	2020-01-02 09:00:00	\N
+13	2	7	4	whisper	f	2020-01-02 11:00:00	\N
+14	2	8	1	secret	f	2020-01-02 11:00:00	\N
+15	-1	7	1	system	f	2020-01-02 12:00:00	\N
+\.
+
+
+COPY public.topics (id, title, user_id, category_id, archetype, views, closed, visible, created_at, deleted_at) FROM stdin;
+7	Hello	1	1	regular	3	t	t	2020-01-02 09:00:00	\N
+8	Secret	1	2	regular	0	f	t	2020-01-02 09:00:00	\N
+9	Message	1	\N	private_message	0	f	t	2020-01-02 09:00:00	\N
+\.
+
+
+COPY public.users (id, username) FROM stdin;
+2	bob
+-1	system
+1	alice
+\.
+`
+
+func TestReadDiscourse(t *testing.T) {
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+	var dump bytes.Buffer
+	dumpGz := gzip.NewWriter(&dump)
+	dumpGz.Write([]byte(discourseSQL))
+	dumpGz.Close()
+	if err := tw.WriteHeader(&tar.Header{Name: "meta.json", Mode: 0600, Size: 2}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write([]byte("{}"))
+	if err := tw.WriteHeader(&tar.Header{Name: "dump.sql.gz", Mode: 0600, Size: int64(dump.Len())}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(dump.Bytes())
+	tw.Close()
+	gz.Close()
+
+	for name, data := range map[string][]byte{
+		"plain dump": []byte(discourseSQL),
+		"backup":     archive.Bytes(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			var im recordingImporter
+			if err := readDiscourse(context.Background(), bytes.NewReader(data), &im); err != nil {
+				t.Fatalf("cannot read backup: %s", err)
+			}
+
+			if len(im.users) != 2 || im.users[0].Name != "alice" || im.users[1].Name != "bob" {
+				t.Fatalf("unexpected users %+v", im.users)
+			}
+			if len(im.categories) != 1 || im.categories[0] != (gbb.ForeignCategory{ID: "1", Name: "General"}) {
+				t.Fatalf("unexpected categories %+v", im.categories)
+			}
+			want := gbb.ForeignTopic{
+				ID:         "7",
+				Subject:    "Hello",
+				Created:    time.Date(2020, 1, 2, 9, 0, 0, 0, time.UTC),
+				AuthorID:   "1",
+				CategoryID: "1",
+				ViewsCount: 3,
+				Locked:     true,
+			}
+			if len(im.topics) != 1 || im.topics[0] != want {
+				t.Fatalf("unexpected topics %+v", im.topics)
+			}
+			if len(im.comments) != 2 {
+				t.Fatalf("want two comments, got %+v", im.comments)
+			}
+			if c := im.comments[0]; c.ID != "11" || c.Content != "first\tpost" {
+				t.Fatalf("unexpected first comment %+v", c)
+			}
+			if c := im.comments[1]; c.ID != "12" || c.Content != "> **alice** wrote:\n>\n> first\n\nagreed" || c.Created.Nanosecond() != 5e8 {
+				t.Fatalf("unexpected second comment %+v", c)
+			}
+		})
+	}
+}
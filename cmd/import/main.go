@@ -0,0 +1,146 @@
+// Command import copies users, categories, topics and comments of another
+// forum into gbb, keeping the original authors and timestamps.
+//
+// Supported sources are phpBB MySQL dumps, Discourse backups and mbox mailing
+// list archives. Imported records are remembered, so running the import
+// again, for example after it was interrupted, creates only what is missing.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/husio/gbb/gbb"
+)
+
+// importer receives records read from the source forum.
+type importer interface {
+	User(context.Context, gbb.ForeignUser) error
+	Category(context.Context, gbb.ForeignCategory) error
+	Topic(context.Context, gbb.ForeignTopic) error
+	Comment(context.Context, gbb.ForeignComment) error
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: import [flags] <phpbb|discourse|mbox> <file>")
+		flag.PrintDefaults()
+	}
+	dbFl := flag.String("db", envDefault("DATABASE_URL", `host='localhost' port='5432' user='postgres' dbname='postgres' sslmode='disable'`), "PostgreSQL database connection details.")
+	sourceFl := flag.String("source", "", "Name identifying the imported forum. Import can be resumed only with the same name. Defaults to the format and the file name.")
+	mergeFl := flag.Bool("merge-users", false, "Attribute content of imported users to existing users of the same name, instead of creating them under a different name.")
+	prefixFl := flag.String("phpbb-prefix", "phpbb_", "Table name prefix of the phpBB database.")
+	categoryFl := flag.String("mbox-category", "Mailing list", "Category of topics imported from mbox.")
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	format, path := flag.Arg(0), flag.Arg(1)
+
+	var read func(context.Context, io.Reader, importer) error
+	switch format {
+	case "phpbb":
+		read = func(ctx context.Context, r io.Reader, im importer) error {
+			return readPHPBB(ctx, r, *prefixFl, im)
+		}
+	case "discourse":
+		read = readDiscourse
+	case "mbox":
+		read = func(ctx context.Context, r io.Reader, im importer) error {
+			return readMbox(ctx, r, *categoryFl, im)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", format)
+		os.Exit(2)
+	}
+
+	source := *sourceFl
+	if source == "" {
+		source = format + ":" + filepath.Base(path)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, os.Interrupt)
+		<-sigc
+		cancel()
+		signal.Stop(sigc)
+	}()
+
+	im, err := run(ctx, *dbFl, source, *mergeFl, path, read)
+	if im != nil {
+		fmt.Fprintln(os.Stderr, im.Summary())
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(
+	ctx context.Context,
+	databaseURL, source string,
+	mergeUsers bool,
+	path string,
+	read func(context.Context, io.Reader, importer) error,
+) (*gbb.Importer, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open source: %s", err)
+	}
+	defer fd.Close()
+
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open SQL database: %s", err)
+	}
+	defer db.Close()
+
+	bbStore, err := gbb.NewPostgresBBStore(db)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create bb store: %s", err)
+	}
+	imported, err := gbb.NewPostgresImportStore(db)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create import store: %s", err)
+	}
+
+	im := &gbb.Importer{
+		Source:     source,
+		BBStore:    bbStore,
+		Imported:   imported,
+		MergeUsers: mergeUsers,
+	}
+	return im, read(ctx, fd, im)
+}
+
+// sortRows orders dump rows by the numeric ID column.
+func sortRows(rows []map[string]string, idColumn string) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		return rowInt(rows[i], idColumn) < rowInt(rows[j], idColumn)
+	})
+}
+
+// rowInt returns the numeric value of the dump row column, or 0.
+func rowInt(row map[string]string, column string) int64 {
+	n, _ := strconv.ParseInt(row[column], 10, 64)
+	return n
+}
+
+func envDefault(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
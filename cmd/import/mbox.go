@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/husio/gbb/gbb"
+)
+
+// mboxMessage is a message of the mailing list archive.
+type mboxMessage struct {
+	ID         string
+	References []string
+	Subject    string
+	From       *mail.Address
+	Date       time.Time
+	Body       string
+}
+
+// readMbox imports messages of a mailing list archive into given category.
+// Every thread becomes a topic, with replies as its comments in the order
+// they were sent. Authors are identified by their email addresses.
+//
+// Messages are sorted by the date, so all of them are read into memory
+// first.
+func readMbox(ctx context.Context, r io.Reader, category string, im importer) error {
+	messages, err := parseMbox(r)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Date.Before(messages[j].Date)
+	})
+
+	if err := im.Category(ctx, gbb.ForeignCategory{ID: category, Name: category}); err != nil {
+		return err
+	}
+
+	authors := make(map[string]bool)
+	// threads maps message IDs to the ID of the first message of their
+	// thread.
+	threads := make(map[string]string)
+	for _, m := range messages {
+		if _, ok := threads[m.ID]; ok {
+			// The same message was archived twice.
+			continue
+		}
+		authorID := strings.ToLower(m.From.Address)
+		if !authors[authorID] {
+			name := m.From.Name
+			if name == "" {
+				name = strings.SplitN(m.From.Address, "@", 2)[0]
+			}
+			if err := im.User(ctx, gbb.ForeignUser{ID: authorID, Name: name}); err != nil {
+				return err
+			}
+			authors[authorID] = true
+		}
+
+		// The closest known message it refers to is the most reliable.
+		root := ""
+		for i := len(m.References) - 1; i >= 0 && root == ""; i-- {
+			root = threads[m.References[i]]
+		}
+		if root == "" {
+			root = m.ID
+			if err := im.Topic(ctx, gbb.ForeignTopic{
+				ID:         root,
+				Subject:    mboxSubject(m.Subject),
+				Created:    m.Date,
+				AuthorID:   authorID,
+				CategoryID: category,
+			}); err != nil {
+				return err
+			}
+		}
+		threads[m.ID] = root
+
+		if err := im.Comment(ctx, gbb.ForeignComment{
+			ID:       m.ID,
+			TopicID:  root,
+			AuthorID: authorID,
+			Content:  m.Body,
+			Created:  m.Date,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseMbox returns all messages of the archive. Messages without a sender
+// are skipped.
+func parseMbox(r io.Reader) ([]*mboxMessage, error) {
+	var (
+		messages []*mboxMessage
+		raw      bytes.Buffer
+		envelope string
+	)
+	flush := func() error {
+		if raw.Len() == 0 {
+			return nil
+		}
+		m, err := parseMboxMessage(raw.Bytes(), envelope)
+		raw.Reset()
+		if err != nil {
+			return err
+		}
+		if m != nil {
+			messages = append(messages, m)
+		}
+		return nil
+	}
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			switch {
+			case strings.HasPrefix(line, "From "):
+				if err := flush(); err != nil {
+					return nil, err
+				}
+				envelope = line
+			case mboxEscapedFromRx.MatchString(line):
+				// Lines starting with "From" are escaped in the
+				// body.
+				raw.WriteString(line[1:])
+			default:
+				raw.WriteString(line)
+			}
+		}
+		if err == io.EOF {
+			return messages, flush()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+var mboxEscapedFromRx = regexp.MustCompile(`^>+From `)
+
+func parseMboxMessage(raw []byte, envelope string) (*mboxMessage, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse message %q: %s", strings.TrimSpace(envelope), err)
+	}
+	var dec mime.WordDecoder
+	m := &mboxMessage{
+		ID:      strings.TrimSpace(msg.Header.Get("Message-Id")),
+		Subject: msg.Header.Get("Subject"),
+	}
+	if subject, err := dec.DecodeHeader(m.Subject); err == nil {
+		m.Subject = subject
+	}
+
+	from, err := (&mail.AddressParser{WordDecoder: &dec}).Parse(msg.Header.Get("From"))
+	if err != nil {
+		return nil, nil
+	}
+	m.From = from
+
+	if m.Date, err = msg.Header.Date(); err != nil {
+		// Envelope ends with the delivery time.
+		fields := strings.Fields(envelope)
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("message %q has no date", m.ID)
+		}
+		m.Date, err = time.Parse(time.ANSIC, strings.Join(fields[len(fields)-5:], " "))
+		if err != nil {
+			return nil, fmt.Errorf("message %q has no date", m.ID)
+		}
+	}
+	m.Date = m.Date.UTC()
+
+	if m.ID == "" {
+		sum := sha1.Sum(raw)
+		m.ID = "sha1:" + hex.EncodeToString(sum[:])
+	}
+	m.References = strings.Fields(msg.Header.Get("References"))
+	if parent := strings.TrimSpace(msg.Header.Get("In-Reply-To")); parent != "" {
+		m.References = append(m.References, strings.Fields(parent)[0])
+	}
+
+	body, err := mboxText(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), msg.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read body of %q: %s", m.ID, err)
+	}
+	m.Body = strings.TrimSpace(body)
+	if m.Body == "" {
+		m.Body = "(no content)"
+	}
+	return m, nil
+}
+
+// mboxText returns the first plain text part of the message body.
+func mboxText(contentType, encoding string, body io.Reader) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		parts := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := parts.NextRawPart()
+			if err == io.EOF {
+				return "", nil
+			}
+			if err != nil {
+				return "", err
+			}
+			text, err := mboxText(part.Header.Get("Content-Type"), part.Header.Get("Content-Transfer-Encoding"), part)
+			if err != nil {
+				return "", err
+			}
+			if text != "" {
+				return text, nil
+			}
+		}
+	}
+	if mediaType != "text/plain" {
+		return "", nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	raw, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	switch strings.ToLower(params["charset"]) {
+	case "iso-8859-1", "latin1":
+		runes := make([]rune, len(raw))
+		for i, b := range raw {
+			runes[i] = rune(b)
+		}
+		return string(runes), nil
+	}
+	return strings.ToValidUTF8(string(raw), "\uFFFD"), nil
+}
+
+var mboxSubjectPrefixRx = regexp.MustCompile(`(?i)^\s*(?:(?:re|fwd?|aw)\s*:|\[[^\]]*\])\s*`)
+
+// mboxSubject returns the subject without reply and mailing list prefixes.
+func mboxSubject(s string) string {
+	for {
+		trimmed := mboxSubjectPrefixRx.ReplaceAllString(s, "")
+		if trimmed == s {
+			return strings.TrimSpace(s)
+		}
+		s = trimmed
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+const mboxArchive = `From bob@example.com Thu Jan  2 10:00:00 2020
+From: Bob <bob@example.com>
+Subject: Re: [golang-nuts] Hello
+Date: Thu, 2 Jan 2020 10:00:00 +0000
+Message-Id: <2@example.com>
+In-Reply-To: <1@example.com>
+Content-Type: multipart/alternative; boundary="xyz"
+
+--xyz
+Content-Type: text/html
+
+<p>html</p>
+--xyz
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+Caf=C3=A9 is open.
+>From now on.
+--xyz--
+
+From alice@example.com Thu Jan  2 09:00:00 2020
+From: =?utf-8?q?Alic=C3=A9?= <Alice@Example.com>
+Subject: [golang-nuts] Hello
+Date: Thu, 2 Jan 2020 09:00:00 +0000
+Message-Id: <1@example.com>
+
+Hi all.
+
+From carol@example.com Thu Jan  2 11:00:00 2020
+From: carol@example.com
+Subject: Fwd: Other
+Message-Id: <3@example.com>
+References: <unknown@example.com>
+
+Unrelated.
+
+From alice@example.com Thu Jan  2 09:00:00 2020
+From: Alice <alice@example.com>
+Subject: [golang-nuts] Hello
+Date: Thu, 2 Jan 2020 09:00:00 +0000
+Message-Id: <1@example.com>
+
+Hi all, archived twice.
+`
+
+func TestReadMbox(t *testing.T) {
+	var im recordingImporter
+	if err := readMbox(context.Background(), strings.NewReader(mboxArchive), "Mailing list", &im); err != nil {
+		t.Fatalf("cannot read archive: %s", err)
+	}
+
+	if len(im.categories) != 1 || im.categories[0].ID != "Mailing list" {
+		t.Fatalf("unexpected categories %+v", im.categories)
+	}
+	if len(im.users) != 3 {
+		t.Fatalf("want three users, got %+v", im.users)
+	}
+	if u := im.users[0]; u.ID != "alice@example.com" || u.Name != "Alicé" {
+		t.Fatalf("unexpected first user %+v", u)
+	}
+	if u := im.users[2]; u.ID != "carol@example.com" || u.Name != "carol" {
+		t.Fatalf("unexpected third user %+v", u)
+	}
+
+	if len(im.topics) != 2 {
+		t.Fatalf("want two topics, got %+v", im.topics)
+	}
+	if topic := im.topics[0]; topic.ID != "<1@example.com>" || topic.Subject != "Hello" {
+		t.Fatalf("unexpected first topic %+v", topic)
+	}
+	if topic := im.topics[1]; topic.ID != "<3@example.com>" || topic.Subject != "Other" {
+		t.Fatalf("unexpected second topic %+v", topic)
+	}
+
+	if len(im.comments) != 3 {
+		t.Fatalf("want three comments, got %+v", im.comments)
+	}
+	if c := im.comments[0]; c.Content != "Hi all." {
+		t.Fatalf("unexpected first comment %+v", c)
+	}
+	if c := im.comments[1]; c.TopicID != "<1@example.com>" || c.Content != "Café is open.\nFrom now on." {
+		t.Fatalf("unexpected reply %+v", c)
+	}
+}
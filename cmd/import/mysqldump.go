@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// readMySQLDump calls fn for every row inserted into one of given tables by
+// a dump written by mysqldump. Row maps column names to values. NULL values
+// are missing from the row.
+func readMySQLDump(r io.Reader, tables map[string]bool, fn func(table string, row map[string]string) error) error {
+	br := bufio.NewReaderSize(r, 1<<20)
+	columns := make(map[string][]string)
+	for {
+		stmt, err := nextStatement(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		stmt = strings.TrimSpace(stmt)
+		upper := strings.ToUpper(prefix(stmt, 20))
+		switch {
+		case strings.HasPrefix(upper, "CREATE TABLE"):
+			table, cols := parseCreateTable(stmt)
+			columns[table] = cols
+		case strings.HasPrefix(upper, "INSERT"), strings.HasPrefix(upper, "REPLACE"):
+			p := &sqlParser{s: stmt}
+			table, err := p.insertTable()
+			if err != nil {
+				return err
+			}
+			if !tables[table] {
+				continue
+			}
+			if err := p.insertRows(columns[table], func(row map[string]string) error {
+				return fn(table, row)
+			}); err != nil {
+				return fmt.Errorf("table %s: %s", table, err)
+			}
+		}
+	}
+}
+
+func prefix(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// nextStatement returns the next SQL statement, without the terminating
+// semicolon. Comments between statements are skipped.
+func nextStatement(r *bufio.Reader) (string, error) {
+	var (
+		b       strings.Builder
+		quote   byte
+		escaped bool
+	)
+	for {
+		c, err := r.ReadByte()
+		if err == io.EOF && strings.TrimSpace(b.String()) != "" {
+			return b.String(), nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if quote != 0 {
+			b.WriteByte(c)
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\' && quote != '`':
+				escaped = true
+			case c == quote:
+				quote = 0
+			}
+			continue
+		}
+
+		switch c {
+		case '-', '#':
+			if strings.TrimSpace(b.String()) != "" {
+				break
+			}
+			if c == '-' {
+				if next, err := r.Peek(1); err != nil || next[0] != '-' {
+					break
+				}
+			}
+			if _, err := r.ReadString('\n'); err != nil && err != io.EOF {
+				return "", err
+			}
+			b.Reset()
+			continue
+		case '\'', '"', '`':
+			quote = c
+		case ';':
+			return b.String(), nil
+		}
+		b.WriteByte(c)
+	}
+}
+
+// parseCreateTable returns the table name and names of its columns, in the
+// order of definition.
+func parseCreateTable(stmt string) (string, []string) {
+	lines := strings.Split(stmt, "\n")
+	var table string
+	for _, f := range strings.Fields(lines[0])[2:] {
+		switch strings.ToUpper(f) {
+		case "IF", "NOT", "EXISTS":
+			continue
+		}
+		table = unquoteName(f)
+		break
+	}
+	var columns []string
+	for _, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "`") {
+			continue
+		}
+		if end := strings.IndexByte(line[1:], '`'); end >= 0 {
+			columns = append(columns, line[1:end+1])
+		}
+	}
+	return table, columns
+}
+
+func unquoteName(s string) string {
+	return strings.Trim(s, "`(")
+}
+
+// sqlParser reads INSERT statements.
+type sqlParser struct {
+	s   string
+	pos int
+}
+
+func (p *sqlParser) skipSpace() {
+	for p.pos < len(p.s) && strings.IndexByte(" \t\r\n", p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+func (p *sqlParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *sqlParser) expect(c byte) error {
+	if got := p.peek(); got != c {
+		return fmt.Errorf("want %q at %d, got %q", c, p.pos, got)
+	}
+	p.pos++
+	return nil
+}
+
+// word returns the next keyword or unquoted name.
+func (p *sqlParser) word() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.s) && strings.IndexByte(" \t\r\n(),", p.s[p.pos]) < 0 {
+		p.pos++
+	}
+	return p.s[start:p.pos]
+}
+
+// insertTable reads the statement up to the table name.
+func (p *sqlParser) insertTable() (string, error) {
+	for {
+		w := p.word()
+		if w == "" {
+			return "", fmt.Errorf("missing table name")
+		}
+		if strings.EqualFold(w, "INTO") {
+			return unquoteName(p.word()), nil
+		}
+	}
+}
+
+// insertRows reads the optional column list and all inserted rows.
+func (p *sqlParser) insertRows(columns []string, fn func(map[string]string) error) error {
+	if p.peek() == '(' {
+		p.pos++
+		columns = nil
+		for {
+			columns = append(columns, unquoteName(p.word()))
+			if p.peek() == ')' {
+				p.pos++
+				break
+			}
+			if err := p.expect(','); err != nil {
+				return err
+			}
+		}
+	}
+	if len(columns) == 0 {
+		return fmt.Errorf("unknown columns")
+	}
+	if w := p.word(); !strings.EqualFold(w, "VALUES") {
+		return fmt.Errorf("want VALUES, got %q", w)
+	}
+
+	for {
+		if err := p.expect('('); err != nil {
+			return err
+		}
+		row := make(map[string]string, len(columns))
+		for i := 0; ; i++ {
+			value, null, err := p.value()
+			if err != nil {
+				return err
+			}
+			if i >= len(columns) {
+				return fmt.Errorf("more values than %d columns", len(columns))
+			}
+			if !null {
+				row[columns[i]] = value
+			}
+			if p.peek() == ')' {
+				p.pos++
+				break
+			}
+			if err := p.expect(','); err != nil {
+				return err
+			}
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+		if p.peek() != ',' {
+			return nil
+		}
+		p.pos++
+	}
+}
+
+// value reads a single literal.
+func (p *sqlParser) value() (string, bool, error) {
+	c := p.peek()
+	if c != '\'' && c != '"' {
+		w := p.word()
+		switch {
+		case strings.EqualFold(w, "NULL"):
+			return "", true, nil
+		case strings.EqualFold(w, "_binary"):
+			return p.value()
+		case strings.HasPrefix(w, "0x"):
+			raw, err := hex.DecodeString(w[2:])
+			if err != nil {
+				return "", false, fmt.Errorf("invalid hex literal at %d", p.pos)
+			}
+			return string(raw), false, nil
+		case w == "":
+			return "", false, fmt.Errorf("missing value at %d", p.pos)
+		}
+		return w, false, nil
+	}
+
+	p.pos++
+	var b strings.Builder
+	for p.pos < len(p.s) {
+		ch := p.s[p.pos]
+		p.pos++
+		switch {
+		case ch == '\\' && p.pos < len(p.s):
+			esc := p.s[p.pos]
+			p.pos++
+			switch esc {
+			case '0':
+				b.WriteByte(0)
+			case 'b':
+				b.WriteByte('\b')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'Z':
+				b.WriteByte(0x1a)
+			default:
+				b.WriteByte(esc)
+			}
+		case ch == c:
+			// Quote is escaped by repeating it.
+			if p.pos < len(p.s) && p.s[p.pos] == c {
+				b.WriteByte(c)
+				p.pos++
+				continue
+			}
+			return b.String(), false, nil
+		default:
+			b.WriteByte(ch)
+		}
+	}
+	return "", false, fmt.Errorf("unterminated string")
+}
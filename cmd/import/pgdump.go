@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// readPostgresDump calls fn for every row copied into one of given tables by
+// a plain text dump written by pg_dump. Table names are without the schema.
+// Row maps column names to values. NULL values are missing from the row.
+func readPostgresDump(r io.Reader, tables map[string]bool, fn func(table string, row map[string]string) error) error {
+	br := bufio.NewReaderSize(r, 1<<20)
+	var (
+		table   string
+		columns []string
+	)
+	for lineNo := 1; ; lineNo++ {
+		line, err := br.ReadString('\n')
+		if err == io.EOF && line == "" {
+			if columns != nil {
+				return fmt.Errorf("table %s: unterminated data", table)
+			}
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		line = strings.TrimSuffix(line, "\n")
+
+		if columns == nil {
+			if strings.HasPrefix(line, "COPY ") && strings.HasSuffix(line, "FROM stdin;") {
+				table, columns = parseCopy(line)
+				if !tables[table] {
+					table = ""
+				}
+			}
+			continue
+		}
+		if line == `\.` {
+			columns = nil
+			continue
+		}
+		if table == "" {
+			continue
+		}
+
+		values := strings.Split(line, "\t")
+		if len(values) != len(columns) {
+			return fmt.Errorf("line %d: want %d values, got %d", lineNo, len(columns), len(values))
+		}
+		row := make(map[string]string, len(columns))
+		for i, v := range values {
+			if v == `\N` {
+				continue
+			}
+			row[columns[i]] = unescapeCopy(v)
+		}
+		if err := fn(table, row); err != nil {
+			return err
+		}
+	}
+}
+
+// parseCopy returns the table name and column names of a COPY statement,
+// for example
+//
+//	COPY public.users (id, username, created_at) FROM stdin;
+func parseCopy(line string) (string, []string) {
+	line = strings.TrimPrefix(line, "COPY ")
+	open, end := strings.IndexByte(line, '('), strings.LastIndexByte(line, ')')
+	if open < 0 || end < open {
+		return "", []string{}
+	}
+	table := strings.TrimSpace(line[:open])
+	if i := strings.LastIndexByte(table, '.'); i >= 0 {
+		table = table[i+1:]
+	}
+	var columns []string
+	for _, c := range strings.Split(line[open+1:end], ",") {
+		columns = append(columns, strings.Trim(strings.TrimSpace(c), `"`))
+	}
+	return strings.Trim(table, `"`), columns
+}
+
+// unescapeCopy decodes a value of the COPY text format.
+func unescapeCopy(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch c := s[i]; c {
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case 'x':
+			end := i + 1
+			for end < len(s) && end < i+3 && isHex(s[end]) {
+				end++
+			}
+			n, _ := strconv.ParseUint(s[i+1:end], 16, 8)
+			b.WriteByte(byte(n))
+			i = end - 1
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			end := i
+			for end < len(s) && end < i+3 && s[end] >= '0' && s[end] <= '7' {
+				end++
+			}
+			n, _ := strconv.ParseUint(s[i:end], 8, 8)
+			b.WriteByte(byte(n))
+			i = end - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/husio/gbb/gbb"
+)
+
+// readPHPBB imports users, forums, topics and posts of a phpBB 3 MySQL
+// database dump. Forums are imported as categories. Unapproved and deleted
+// content is skipped.
+//
+// Dump lists tables alphabetically, so posts come before users. All rows are
+// read into memory first.
+func readPHPBB(ctx context.Context, r io.Reader, tablePrefix string, im importer) error {
+	var (
+		users  []map[string]string
+		forums []map[string]string
+		topics []map[string]string
+		posts  []map[string]string
+	)
+	tables := map[string]bool{
+		tablePrefix + "users":  true,
+		tablePrefix + "forums": true,
+		tablePrefix + "topics": true,
+		tablePrefix + "posts":  true,
+	}
+	err := readMySQLDump(r, tables, func(table string, row map[string]string) error {
+		switch strings.TrimPrefix(table, tablePrefix) {
+		case "users":
+			users = append(users, row)
+		case "forums":
+			forums = append(forums, row)
+		case "topics":
+			topics = append(topics, row)
+		case "posts":
+			posts = append(posts, row)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot read dump: %s", err)
+	}
+
+	sortRows(users, "user_id")
+	sortRows(forums, "forum_id")
+	sortRows(topics, "topic_id")
+	sort.SliceStable(posts, func(i, j int) bool {
+		ti, tj := rowInt(posts[i], "post_time"), rowInt(posts[j], "post_time")
+		if ti != tj {
+			return ti < tj
+		}
+		return rowInt(posts[i], "post_id") < rowInt(posts[j], "post_id")
+	})
+
+	// Anonymous user and bots are of the ignored type.
+	const ignoredUserType = "2"
+	registered := make(map[string]bool)
+	for _, u := range users {
+		if u["user_type"] == ignoredUserType {
+			continue
+		}
+		if err := im.User(ctx, gbb.ForeignUser{
+			ID:           u["user_id"],
+			Name:         html.UnescapeString(u["username"]),
+			PasswordHash: u["user_password"],
+		}); err != nil {
+			return err
+		}
+		registered[u["user_id"]] = true
+	}
+
+	// Guests are identified only by the name they gave.
+	guests := make(map[string]bool)
+	author := func(userID, name string) (string, error) {
+		if registered[userID] {
+			return userID, nil
+		}
+		name = html.UnescapeString(name)
+		if name == "" {
+			name = "Guest"
+		}
+		id := "guest:" + name
+		if !guests[id] {
+			if err := im.User(ctx, gbb.ForeignUser{ID: id, Name: name}); err != nil {
+				return "", err
+			}
+			guests[id] = true
+		}
+		return id, nil
+	}
+
+	// Only forums of the post type contain topics.
+	const postForumType = "1"
+	categories := make(map[string]bool)
+	for _, f := range forums {
+		if f["forum_type"] != postForumType {
+			continue
+		}
+		if err := im.Category(ctx, gbb.ForeignCategory{
+			ID:   f["forum_id"],
+			Name: html.UnescapeString(f["forum_name"]),
+		}); err != nil {
+			return err
+		}
+		categories[f["forum_id"]] = true
+	}
+
+	imported := make(map[string]bool)
+	for _, t := range topics {
+		// Moved topics leave a shadow topic in the old forum.
+		if !categories[t["forum_id"]] || !phpbbVisible(t, "topic") || rowInt(t, "topic_moved_id") != 0 {
+			continue
+		}
+		authorID, err := author(t["topic_poster"], t["topic_first_poster_name"])
+		if err != nil {
+			return err
+		}
+		const lockedStatus = "1"
+		if err := im.Topic(ctx, gbb.ForeignTopic{
+			ID:         t["topic_id"],
+			Subject:    html.UnescapeString(t["topic_title"]),
+			Created:    time.Unix(rowInt(t, "topic_time"), 0).UTC(),
+			AuthorID:   authorID,
+			CategoryID: t["forum_id"],
+			ViewsCount: rowInt(t, "topic_views"),
+			Locked:     t["topic_status"] == lockedStatus,
+		}); err != nil {
+			return err
+		}
+		imported[t["topic_id"]] = true
+	}
+
+	for _, p := range posts {
+		if !imported[p["topic_id"]] || !phpbbVisible(p, "post") {
+			continue
+		}
+		authorID, err := author(p["poster_id"], p["post_username"])
+		if err != nil {
+			return err
+		}
+		if err := im.Comment(ctx, gbb.ForeignComment{
+			ID:       p["post_id"],
+			TopicID:  p["topic_id"],
+			AuthorID: authorID,
+			Content:  phpbbText(p["post_text"], p["bbcode_uid"]),
+			Created:  time.Unix(rowInt(p, "post_time"), 0).UTC(),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// phpbbVisible returns true if the topic or post is approved and not
+// deleted. phpBB 3.0 keeps only the approval flag.
+func phpbbVisible(row map[string]string, kind string) bool {
+	if v, ok := row[kind+"_visibility"]; ok {
+		return v == "1"
+	}
+	if v, ok := row[kind+"_approved"]; ok {
+		return v == "1"
+	}
+	return true
+}
+
+var (
+	phpbbXMLTagRx  = regexp.MustCompile(`<[^>]*>`)
+	phpbbSmileyRx  = regexp.MustCompile(`<!-- s(.*?) -->.*?<!-- s.*? -->`)
+	phpbbLinkRx    = regexp.MustCompile(`<!-- [mlwe] --><a [^>]*href="([^"]*)"[^>]*>.*?</a><!-- [mlwe] -->`)
+	phpbbNewlineRx = regexp.MustCompile(`<br\s*/?>\n?`)
+)
+
+// phpbbText returns the post text as markdown.
+//
+// Since phpBB 3.2, text is stored as XML that keeps the original markup
+// between formatting elements. Older versions store HTML escaped text with
+// the unique ID of the post appended to every BBCode tag, and smilies and
+// links as HTML.
+func phpbbText(text, bbcodeUID string) string {
+	if strings.HasPrefix(text, "<r>") || strings.HasPrefix(text, "<t>") {
+		text = phpbbNewlineRx.ReplaceAllString(text, "\n")
+		text = phpbbXMLTagRx.ReplaceAllString(text, "")
+	} else {
+		if bbcodeUID != "" {
+			text = strings.ReplaceAll(text, ":"+bbcodeUID, "")
+		}
+		text = phpbbSmileyRx.ReplaceAllString(text, "$1")
+		text = phpbbLinkRx.ReplaceAllString(text, "$1")
+		// List closing tags carry the list type.
+		text = strings.NewReplacer("[/*:m]", "", "[/list:u]", "[/list]", "[/list:o]", "[/list]").Replace(text)
+	}
+	return bbcodeToMarkdown(html.UnescapeString(text))
+}
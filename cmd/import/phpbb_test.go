@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/husio/gbb/gbb"
+)
+
+const phpbbDump = "-- MySQL dump 10.13\n" +
+	"/*!40101 SET NAMES utf8 */;\n" +
+	"CREATE TABLE `phpbb_forums` (\n" +
+	"  `forum_id` mediumint(8) unsigned NOT NULL AUTO_INCREMENT,\n" +
+	"  `forum_name` varchar(255) NOT NULL DEFAULT '',\n" +
+	"  `forum_type` tinyint(4) NOT NULL DEFAULT '0',\n" +
+	"  PRIMARY KEY (`forum_id`)\n" +
+	") ENGINE=InnoDB;\n" +
+	"INSERT INTO `phpbb_forums` VALUES (1,'Main',0),(2,'Tips &amp; tricks',1);\n" +
+	"CREATE TABLE `phpbb_posts` (\n" +
+	"  `post_id` int(10) unsigned NOT NULL AUTO_INCREMENT,\n" +
+	"  `topic_id` int(10) unsigned NOT NULL DEFAULT '0',\n" +
+	"  `poster_id` int(10) unsigned NOT NULL DEFAULT '0',\n" +
+	"  `post_time` int(11) unsigned NOT NULL DEFAULT '0',\n" +
+	"  `post_visibility` tinyint(3) NOT NULL DEFAULT '0',\n" +
+	"  `post_username` varchar(255) NOT NULL DEFAULT '',\n" +
+	"  `post_text` mediumtext NOT NULL,\n" +
+	"  `bbcode_uid` varchar(8) NOT NULL DEFAULT ''\n" +
+	");\n" +
+	"INSERT INTO `phpbb_posts` VALUES " +
+	"(11,5,1,1300000100,1,'Ghost','<r><B><s>[b]</s>Welcome<e>[/b]</e></B>, it\\'s <URL url=\"http://example.com\">http://example.com</URL></r>',''),\n" +
+	"(10,5,2,1300000000,1,'','Hi; see [quote=&quot;Ghost&quot;:x1]text[/quote:x1] <!-- s:) --><img src=\"{SMILIES_PATH}/icon_e_smile.gif\" alt=\":)\" /><!-- s:) -->','x1'),\n" +
+	"(12,5,2,1300000200,2,'','deleted','');\n" +
+	"CREATE TABLE `phpbb_topics` (\n" +
+	"  `topic_id` int(10) unsigned NOT NULL AUTO_INCREMENT,\n" +
+	"  `forum_id` mediumint(8) unsigned NOT NULL DEFAULT '0',\n" +
+	"  `topic_title` varchar(255) NOT NULL DEFAULT '',\n" +
+	"  `topic_poster` int(10) unsigned NOT NULL DEFAULT '0',\n" +
+	"  `topic_time` int(11) unsigned NOT NULL DEFAULT '0',\n" +
+	"  `topic_views` mediumint(8) unsigned NOT NULL DEFAULT '0',\n" +
+	"  `topic_status` tinyint(3) NOT NULL DEFAULT '0',\n" +
+	"  `topic_visibility` tinyint(3) NOT NULL DEFAULT '0',\n" +
+	"  `topic_moved_id` int(10) unsigned NOT NULL DEFAULT '0',\n" +
+	"  `topic_first_poster_name` varchar(255) NOT NULL DEFAULT ''\n" +
+	");\n" +
+	"INSERT INTO `phpbb_topics` VALUES (5,2,'Hello &quot;world&quot;',2,1300000000,17,1,1,0,'bob'),(6,1,'Moved',2,1300000000,0,0,1,5,'bob');\n" +
+	"CREATE TABLE `phpbb_users` (\n" +
+	"  `user_id` int(10) unsigned NOT NULL AUTO_INCREMENT,\n" +
+	"  `user_type` tinyint(2) NOT NULL DEFAULT '0',\n" +
+	"  `username` varchar(255) NOT NULL DEFAULT '',\n" +
+	"  `user_password` varchar(255) NOT NULL DEFAULT ''\n" +
+	");\n" +
+	"INSERT INTO `phpbb_users` (`user_id`, `user_type`, `username`, `user_password`) VALUES (1,2,'Anonymous',''),(2,0,'bob','$2y$10$hash');\n"
+
+func TestReadPHPBB(t *testing.T) {
+	var im recordingImporter
+	if err := readPHPBB(context.Background(), strings.NewReader(phpbbDump), "phpbb_", &im); err != nil {
+		t.Fatalf("cannot read dump: %s", err)
+	}
+
+	if len(im.users) != 2 || im.users[0] != (gbb.ForeignUser{ID: "2", Name: "bob", PasswordHash: "$2y$10$hash"}) || im.users[1].ID != "guest:Ghost" {
+		t.Fatalf("unexpected users %+v", im.users)
+	}
+	if len(im.categories) != 1 || im.categories[0] != (gbb.ForeignCategory{ID: "2", Name: "Tips & tricks"}) {
+		t.Fatalf("unexpected categories %+v", im.categories)
+	}
+	want := gbb.ForeignTopic{
+		ID:         "5",
+		Subject:    `Hello "world"`,
+		Created:    time.Unix(1300000000, 0).UTC(),
+		AuthorID:   "2",
+		CategoryID: "2",
+		ViewsCount: 17,
+		Locked:     true,
+	}
+	if len(im.topics) != 1 || im.topics[0] != want {
+		t.Fatalf("unexpected topics %+v", im.topics)
+	}
+	if len(im.comments) != 2 {
+		t.Fatalf("want two comments, got %+v", im.comments)
+	}
+	if c := im.comments[0]; c.ID != "10" || c.Content != "Hi; see \n\n> **Ghost** wrote:\n>\n> text\n\n :)" {
+		t.Fatalf("unexpected first comment %+v", c)
+	}
+	if c := im.comments[1]; c.ID != "11" || c.AuthorID != "guest:Ghost" || c.Content != "**Welcome**, it's http://example.com" {
+		t.Fatalf("unexpected second comment %+v", c)
+	}
+}
+
+func TestBBCodeToMarkdown(t *testing.T) {
+	cases := map[string]struct {
+		bbcode string
+		want   string
+	}{
+		"formatting": {
+			bbcode: "[b]bold[/b] [i]italic[/i] [u]under[/u] [color=red]red[/color]",
+			want:   "**bold** *italic* under red",
+		},
+		"links": {
+			bbcode: "[url=http://example.com]site[/url] [url]http://example.org[/url] [img]http://example.com/a.png[/img]",
+			want:   "[site](http://example.com) http://example.org ![](http://example.com/a.png)",
+		},
+		"nested quotes": {
+			bbcode: "[quote=alice][quote]first[/quote]second[/quote]reply",
+			want:   "> **alice** wrote:\n>\n>> first\n>\n> second\n\nreply",
+		},
+		"code is verbatim": {
+			bbcode: "look:[code][b]not bold[/b][/code]",
+			want:   "look:\n```\n[b]not bold[/b]\n```",
+		},
+		"lists": {
+			bbcode: "[list][*]one[*]two[/list]",
+			want:   "- one\n- two",
+		},
+		"unknown tags are kept": {
+			bbcode: "[x] done [1]",
+			want:   "[x] done [1]",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if got := bbcodeToMarkdown(tc.bbcode); got != tc.want {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+type recordingImporter struct {
+	users      []gbb.ForeignUser
+	categories []gbb.ForeignCategory
+	topics     []gbb.ForeignTopic
+	comments   []gbb.ForeignComment
+}
+
+func (im *recordingImporter) User(ctx context.Context, u gbb.ForeignUser) error {
+	im.users = append(im.users, u)
+	return nil
+}
+
+func (im *recordingImporter) Category(ctx context.Context, c gbb.ForeignCategory) error {
+	im.categories = append(im.categories, c)
+	return nil
+}
+
+func (im *recordingImporter) Topic(ctx context.Context, t gbb.ForeignTopic) error {
+	im.topics = append(im.topics, t)
+	return nil
+}
+
+func (im *recordingImporter) Comment(ctx context.Context, c gbb.ForeignComment) error {
+	im.comments = append(im.comments, c)
+	return nil
+}
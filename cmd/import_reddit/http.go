@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"strconv"
+
+	"github.com/husio/gbb/gbb"
+)
+
+// httpImporter posts content through the HTTP interface, as a user of the
+// forum would. Every author is registered with the same password.
+type httpImporter struct {
+	addr       string
+	password   string
+	categoryID int64
+
+	clients map[string]*http.Client
+	// pending holds topics, which are created together with their first
+	// comment.
+	pending map[string]gbb.ForeignTopic
+	topics  map[string]int64
+}
+
+func newHTTPImporter(addr, password string, categoryID int64) *httpImporter {
+	return &httpImporter{
+		addr:       addr,
+		password:   password,
+		categoryID: categoryID,
+		clients:    make(map[string]*http.Client),
+		pending:    make(map[string]gbb.ForeignTopic),
+		topics:     make(map[string]int64),
+	}
+}
+
+func (im *httpImporter) User(ctx context.Context, u gbb.ForeignUser) error {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Jar: jar,
+		// Redirect points to the created content.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	form := url.Values{
+		"login":     {u.Name},
+		"password":  {im.password},
+		"password2": {im.password},
+	}
+	_, err = do(ctx, client, urlencodedRequest(im.addr+"/register/", form))
+	if err != nil {
+		// User registered by the previous import can sign in.
+		form.Del("password2")
+		if _, loginErr := do(ctx, client, urlencodedRequest(im.addr+"/login/", form)); loginErr != nil {
+			return fmt.Errorf("cannot register %q: %s", u.Name, err)
+		}
+	}
+	im.clients[u.ID] = client
+	return nil
+}
+
+// Category is ignored, all topics are created in the same category.
+func (im *httpImporter) Category(ctx context.Context, c gbb.ForeignCategory) error {
+	return nil
+}
+
+func (im *httpImporter) Topic(ctx context.Context, t gbb.ForeignTopic) error {
+	im.pending[t.ID] = t
+	return nil
+}
+
+func (im *httpImporter) Comment(ctx context.Context, c gbb.ForeignComment) error {
+	client, ok := im.clients[c.AuthorID]
+	if !ok {
+		return fmt.Errorf("comment %q: author %q is not registered", c.ID, c.AuthorID)
+	}
+
+	if t, ok := im.pending[c.TopicID]; ok {
+		req, err := formRequest(im.addr+"/t/new/", map[string]string{
+			"subject":  t.Subject,
+			"category": strconv.FormatInt(im.categoryID, 10),
+			"content":  c.Content,
+		})
+		if err != nil {
+			return err
+		}
+		location, err := do(ctx, client, req)
+		if err != nil {
+			return fmt.Errorf("cannot create topic %q: %s", t.ID, err)
+		}
+		m := topicLocationRx.FindStringSubmatch(location)
+		if m == nil {
+			return fmt.Errorf("cannot create topic %q: unexpected redirect to %q", t.ID, location)
+		}
+		im.topics[t.ID], _ = strconv.ParseInt(m[1], 10, 64)
+		delete(im.pending, t.ID)
+		return nil
+	}
+
+	topicID, ok := im.topics[c.TopicID]
+	if !ok {
+		return fmt.Errorf("comment %q: topic %q was not created", c.ID, c.TopicID)
+	}
+	req, err := formRequest(fmt.Sprintf("%s/t/%d/comment/", im.addr, topicID), map[string]string{
+		"content": c.Content,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := do(ctx, client, req); err != nil {
+		return fmt.Errorf("cannot create comment %q: %s", c.ID, err)
+	}
+	return nil
+}
+
+var topicLocationRx = regexp.MustCompile(`^/t/(\d+)/`)
+
+func urlencodedRequest(url string, form url.Values) *http.Request {
+	req, err := http.NewRequest("POST", url, bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func formRequest(url string, fields map[string]string) (*http.Request, error) {
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	for name, value := range fields {
+		if err := w.WriteField(name, value); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", url, &b)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req, nil
+}
+
+// do sends the request and returns the location the successful response
+// redirects to.
+func do(ctx context.Context, client *http.Client, req *http.Request) (string, error) {
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1e5))
+		return "", fmt.Errorf("%d: %s", resp.StatusCode, b)
+	}
+	return resp.Header.Get("Location"), nil
+}
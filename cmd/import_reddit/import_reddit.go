@@ -1,187 +1,119 @@
+// Command import_reddit fills gbb with Reddit content saved on disk, so that
+// a development instance can be populated with realistic discussions without
+// network access.
+//
+// Dumps are saved Reddit API responses, for example
+// https://www.reddit.com/r/golang/comments/<id>.json, or Pushshift dumps
+// with one submission or comment per line. Every submission becomes a topic,
+// with its comments following in the order they were written.
+//
+// By default content is posted through the HTTP interface of a running
+// server, which must allow registration and have CSRF protection disabled.
+// Authors are registered under their Reddit names, but comments get the
+// current time. With -direct the content is written to the database instead,
+// keeping the authors and the original time of every comment. Direct import
+// remembers what was imported, so running it again with the same dumps does
+// not change anything.
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"database/sql"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
-	"math/rand"
-	"mime/multipart"
-	"net/http"
-	"net/http/cookiejar"
-	"net/url"
-	"time"
-)
+	"os"
+	"os/signal"
 
-const commentsUrl = "https://www.reddit.com/r/%s/comments.json"
+	"github.com/husio/gbb/gbb"
+)
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: import_reddit [flags] <dump>...")
+		flag.PrintDefaults()
+	}
 	bbAddrFl := flag.String("bbaddr", "http://localhost:8000", "Address of BB")
-	repeatFl := flag.Int("repeat", 1, "Repeat each entry")
-	sectionFl := flag.String("section", "news", "Reddit that comments should be uploaded")
+	passwordFl := flag.String("password", "qwertyuiop", "Password of registered users.")
+	categoryFl := flag.Int64("category", 1, "ID of the category of created topics.")
+	directFl := flag.Bool("direct", false, "Write directly to the database instead of using the HTTP interface.")
+	dbFl := flag.String("db", envDefault("DATABASE_URL", `host='localhost' port='5432' user='postgres' dbname='postgres' sslmode='disable'`), "PostgreSQL database connection details, used with -direct.")
+	sourceFl := flag.String("source", "reddit", "Name identifying imported content, used with -direct.")
+	mergeFl := flag.Bool("merge-users", false, "Attribute content to existing users of the same name, used with -direct.")
 	flag.Parse()
 
-	req, err := http.NewRequest("GET", fmt.Sprintf(commentsUrl, *sectionFl), nil)
-	if err != nil {
-		log.Fatal(err)
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
 	}
-	req.Header.Set("User-Agent", "hi")
 
-	users := []*http.Client{
-		registerUser(*bbAddrFl, "Andreas von Strucker"),
-		registerUser(*bbAddrFl, "Antiphon the Overseer"),
-		registerUser(*bbAddrFl, "Paul Norbert Ebersol"),
-		registerUser(*bbAddrFl, "Jacqueline Falsworth"),
-		registerUser(*bbAddrFl, "Trevor Fitzroy"),
-		registerUser(*bbAddrFl, "Fortune, Dominic"),
-		registerUser(*bbAddrFl, "Frankie and Victoria"),
-		registerUser(*bbAddrFl, "Gabriel the Air-Walker"),
-		registerUser(*bbAddrFl, "Georgianna Castleberry"),
-		registerUser(*bbAddrFl, "Negasonic Teenage Warhead"),
-		registerUser(*bbAddrFl, "Nicholas maunder"),
-		registerUser(*bbAddrFl, "Red Claw"),
-		registerUser(*bbAddrFl, "Nick Fury"),
-		registerUser(*bbAddrFl, "Nighthawk"),
-		registerUser(*bbAddrFl, "Ozymandias"),
-		registerUser(*bbAddrFl, "Phantom Rider"),
-		registerUser(*bbAddrFl, "Torgo the Vampire"),
-		registerUser(*bbAddrFl, "Tuc"),
+	dump := newRedditDump()
+	for _, path := range flag.Args() {
+		if err := readDump(dump, path); err != nil {
+			fmt.Fprintf(os.Stderr, "import_reddit: %s: %s\n", path, err)
+			os.Exit(1)
+		}
 	}
 
-	rand.Seed(time.Now().UnixNano())
-	randomUser := func() *http.Client {
-		return users[rand.Intn(len(users))]
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sigc := make(chan os.Signal, 1)
+		signal.Notify(sigc, os.Interrupt)
+		<-sigc
+		cancel()
+		signal.Stop(sigc)
+	}()
+
+	var err error
+	if *directFl {
+		err = importDirect(ctx, dump, *dbFl, *sourceFl, *mergeFl)
+	} else {
+		err = dump.Import(ctx, newHTTPImporter(*bbAddrFl, *passwordFl, *categoryFl))
 	}
-
-	resp, err := randomUser().Do(req)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintf(os.Stderr, "import_reddit: %s\n", err)
+		os.Exit(1)
 	}
-	defer resp.Body.Close()
+}
 
-	var body struct {
-		Data struct {
-			Children []struct {
-				Data *RedditComment
-			}
-		}
+func readDump(dump *redditDump, path string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
 	}
+	defer fd.Close()
+	return dump.Read(fd)
+}
 
-	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
-		log.Fatal(err)
+func importDirect(ctx context.Context, dump *redditDump, databaseURL, source string, mergeUsers bool) error {
+	db, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		return fmt.Errorf("cannot open SQL database: %s", err)
 	}
+	defer db.Close()
 
-	for repStep := 0; repStep < *repeatFl; repStep++ {
-		// post as topics
-		for _, c := range body.Data.Children {
-			var b bytes.Buffer
-			w := multipart.NewWriter(&b)
-			if f, err := w.CreateFormField("subject"); err != nil {
-				log.Fatal(err)
-			} else {
-				if _, err := io.WriteString(f, c.Data.LinkTitle); err != nil {
-					log.Fatal(err)
-				}
-			}
-			if f, err := w.CreateFormField("category"); err != nil {
-				log.Fatal(err)
-			} else {
-				if _, err := io.WriteString(f, "1"); err != nil {
-					log.Fatal(err)
-				}
-			}
-			if f, err := w.CreateFormField("content"); err != nil {
-				log.Fatal(err)
-			} else {
-				if _, err := io.WriteString(f, c.Data.Body); err != nil {
-					log.Fatal(err)
-				}
-			}
-			if err := w.Close(); err != nil {
-				log.Fatal(err)
-			}
-
-			req, err := http.NewRequest("POST", *bbAddrFl+"/t/new/", &b)
-			if err != nil {
-				log.Fatal(err)
-			}
-			req.Header.Set("Content-Type", w.FormDataContentType())
-
-			if resp, err := randomUser().Do(req); err != nil {
-				log.Fatal(err)
-			} else {
-				if resp.StatusCode > 299 {
-					b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1e5))
-					log.Fatalf("%d: %s", resp.StatusCode, b)
-				}
-				resp.Body.Close()
-			}
-		}
-
-		// post as comments
-		for _, c := range body.Data.Children {
-			var b bytes.Buffer
-			w := multipart.NewWriter(&b)
-			if f, err := w.CreateFormField("content"); err != nil {
-				log.Fatal(err)
-			} else {
-				if _, err := io.WriteString(f, c.Data.Body); err != nil {
-					log.Fatal(err)
-				}
-			}
-			if err := w.Close(); err != nil {
-				log.Fatal(err)
-			}
-
-			req, err := http.NewRequest("POST", *bbAddrFl+"/t/3/comment/", &b)
-			if err != nil {
-				log.Fatal(err)
-			}
-			req.Header.Set("Content-Type", w.FormDataContentType())
-
-			if resp, err := randomUser().Do(req); err != nil {
-				log.Fatal(err)
-			} else {
-				if resp.StatusCode > 299 {
-					b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1e5))
-					log.Fatalf("%d: %s", resp.StatusCode, b)
-				}
-				resp.Body.Close()
-			}
-		}
+	bbStore, err := gbb.NewPostgresBBStore(db)
+	if err != nil {
+		return fmt.Errorf("cannot create bb store: %s", err)
 	}
-}
-
-type RedditComment struct {
-	Body      string `json:"body"`
-	LinkTitle string `json:"link_title"`
-	Author    string `json:"author"`
-}
-
-func registerUser(addr string, name string) *http.Client {
-	jar, err := cookiejar.New(nil)
+	imported, err := gbb.NewPostgresImportStore(db)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("cannot create import store: %s", err)
 	}
 
-	client := &http.Client{
-		Jar: jar,
+	im := &gbb.Importer{
+		Source:     source,
+		BBStore:    bbStore,
+		Imported:   imported,
+		MergeUsers: mergeUsers,
 	}
+	err = dump.Import(ctx, im)
+	fmt.Fprintln(os.Stderr, im.Summary())
+	return err
+}
 
-	resp, err := client.PostForm(addr+"/register/", url.Values{
-		"login":     []string{name},
-		"password":  []string{"qwertyuiop"},
-		"password2": []string{"qwertyuiop"},
-	})
-	if err != nil {
-		log.Fatal(err)
-	}
-	if resp.StatusCode > 299 {
-		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1e5))
-		log.Fatalf("%d: %s", resp.StatusCode, string(b))
+func envDefault(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
 	}
-	return client
+	return fallback
 }
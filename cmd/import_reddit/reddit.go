@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/husio/gbb/gbb"
+)
+
+// redditPost is a submission or a comment, as returned by the Reddit API and
+// as stored in Pushshift dumps.
+type redditPost struct {
+	ID        string          `json:"id"`
+	Subreddit string          `json:"subreddit"`
+	Author    string          `json:"author"`
+	Created   redditTime      `json:"created_utc"`
+	Title     string          `json:"title"`
+	Selftext  string          `json:"selftext"`
+	URL       string          `json:"url"`
+	IsSelf    bool            `json:"is_self"`
+	Body      string          `json:"body"`
+	LinkID    string          `json:"link_id"`
+	LinkTitle string          `json:"link_title"`
+	ParentID  string          `json:"parent_id"`
+	Replies   json.RawMessage `json:"replies"`
+}
+
+// redditTime is a unix timestamp. Dumps use an integer, a float or a string.
+type redditTime struct {
+	time.Time
+}
+
+func (t *redditTime) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "null" || s == "" {
+		return nil
+	}
+	sec, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %s", b)
+	}
+	t.Time = time.Unix(int64(sec), 0).UTC()
+	return nil
+}
+
+// redditDump collects submissions and comments of one or more dumps.
+type redditDump struct {
+	submissions map[string]*redditPost
+	comments    map[string]*redditPost
+}
+
+func newRedditDump() *redditDump {
+	return &redditDump{
+		submissions: make(map[string]*redditPost),
+		comments:    make(map[string]*redditPost),
+	}
+}
+
+// Read adds content of the dump. Dump is either a saved Reddit API response,
+// a listing or a comment thread, or a Pushshift dump with one submission or
+// comment per line. Gzip and bzip2 compressed dumps are decompressed.
+func (d *redditDump) Read(r io.Reader) error {
+	br := bufio.NewReader(r)
+	switch magic, _ := br.Peek(4); {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("cannot read gzip: %s", err)
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		br = bufio.NewReader(bzip2.NewReader(br))
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return fmt.Errorf("zstandard compression is not supported, decompress the dump with zstd -d first")
+	}
+
+	dec := json.NewDecoder(br)
+	for {
+		var value json.RawMessage
+		switch err := dec.Decode(&value); err {
+		case nil:
+		case io.EOF:
+			return nil
+		default:
+			return fmt.Errorf("cannot decode: %s", err)
+		}
+		if err := d.add(value); err != nil {
+			return err
+		}
+	}
+}
+
+// add collects posts of the JSON value, which is a list of values, a thing
+// of the Reddit API or a bare Pushshift post.
+func (d *redditDump) add(value json.RawMessage) error {
+	value = bytes.TrimSpace(value)
+	if len(value) == 0 || value[0] == '"' || bytes.Equal(value, []byte("null")) {
+		// Comments without replies have an empty string instead.
+		return nil
+	}
+	if value[0] == '[' {
+		var values []json.RawMessage
+		if err := json.Unmarshal(value, &values); err != nil {
+			return err
+		}
+		for _, v := range values {
+			if err := d.add(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var thing struct {
+		Kind string          `json:"kind"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(value, &thing); err != nil {
+		return err
+	}
+	switch thing.Kind {
+	case "":
+		var p redditPost
+		if err := json.Unmarshal(value, &p); err != nil {
+			return err
+		}
+		// Pushshift posts are not wrapped.
+		switch {
+		case p.LinkID != "":
+			d.addComment(&p)
+		case p.Title != "":
+			d.addSubmission(&p)
+		}
+	case "Listing":
+		var listing struct {
+			Children []json.RawMessage `json:"children"`
+		}
+		if err := json.Unmarshal(thing.Data, &listing); err != nil {
+			return err
+		}
+		for _, child := range listing.Children {
+			if err := d.add(child); err != nil {
+				return err
+			}
+		}
+	case "t3":
+		var p redditPost
+		if err := json.Unmarshal(thing.Data, &p); err != nil {
+			return err
+		}
+		d.addSubmission(&p)
+	case "t1":
+		var p redditPost
+		if err := json.Unmarshal(thing.Data, &p); err != nil {
+			return err
+		}
+		replies := p.Replies
+		d.addComment(&p)
+		return d.add(replies)
+	}
+	// Other kinds, like "more" placeholders of collapsed comments, have
+	// no content.
+	return nil
+}
+
+func (d *redditDump) addSubmission(p *redditPost) {
+	p.Replies = nil
+	d.submissions["t3_"+p.ID] = p
+}
+
+func (d *redditDump) addComment(p *redditPost) {
+	p.Replies = nil
+	d.comments["t1_"+p.ID] = p
+}
+
+// importer receives records read from the dump.
+type importer interface {
+	User(context.Context, gbb.ForeignUser) error
+	Category(context.Context, gbb.ForeignCategory) error
+	Topic(context.Context, gbb.ForeignTopic) error
+	Comment(context.Context, gbb.ForeignComment) error
+}
+
+// Import passes the collected content to the importer. Every submission
+// becomes a topic of the category named after its subreddit, with the
+// submission text as the first comment and all comments following in the
+// order they were written. Replies quote the comment they respond to.
+//
+// Comments of submissions that are missing from the dump are grouped into a
+// topic started by the earliest of them, if they carry the submission title.
+// Otherwise they are skipped, just like removed and deleted comments.
+//
+// Records are passed in a stable order, so importing the same dump always
+// produces the same content.
+func (d *redditDump) Import(ctx context.Context, im importer) error {
+	threads := make(map[string][]*redditPost)
+	for _, c := range d.comments {
+		if removed(c.Body) {
+			continue
+		}
+		threads[c.LinkID] = append(threads[c.LinkID], c)
+	}
+
+	type topic struct {
+		ID       string
+		Subject  string
+		Author   string
+		Category string
+		Created  time.Time
+		Content  string
+	}
+	var topics []topic
+	for id, s := range d.submissions {
+		topics = append(topics, topic{
+			ID:       id,
+			Subject:  s.Title,
+			Author:   s.Author,
+			Category: s.Subreddit,
+			Created:  s.Created.Time,
+			Content:  submissionContent(s),
+		})
+	}
+	for id, comments := range threads {
+		if _, ok := d.submissions[id]; ok {
+			continue
+		}
+		sortPosts(comments)
+		first := comments[0]
+		if first.LinkTitle == "" {
+			continue
+		}
+		topics = append(topics, topic{
+			ID:       id,
+			Subject:  first.LinkTitle,
+			Author:   first.Author,
+			Category: first.Subreddit,
+			Created:  first.Created.Time,
+		})
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		if !topics[i].Created.Equal(topics[j].Created) {
+			return topics[i].Created.Before(topics[j].Created)
+		}
+		return topics[i].ID < topics[j].ID
+	})
+
+	users := make(map[string]bool)
+	user := func(name string) error {
+		if users[name] {
+			return nil
+		}
+		users[name] = true
+		return im.User(ctx, gbb.ForeignUser{ID: name, Name: name})
+	}
+	categories := make(map[string]bool)
+
+	for _, t := range topics {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := user(t.Author); err != nil {
+			return err
+		}
+		categoryID := strings.ToLower(t.Category)
+		if !categories[categoryID] {
+			if err := im.Category(ctx, gbb.ForeignCategory{ID: categoryID, Name: "r/" + t.Category}); err != nil {
+				return err
+			}
+			categories[categoryID] = true
+		}
+		if err := im.Topic(ctx, gbb.ForeignTopic{
+			ID:         t.ID,
+			Subject:    html.UnescapeString(t.Subject),
+			Created:    t.Created,
+			AuthorID:   t.Author,
+			CategoryID: categoryID,
+		}); err != nil {
+			return err
+		}
+		// Topic created from the comments starts with the first of
+		// them instead.
+		if t.Content != "" {
+			if err := im.Comment(ctx, gbb.ForeignComment{
+				ID:       t.ID,
+				TopicID:  t.ID,
+				AuthorID: t.Author,
+				Content:  t.Content,
+				Created:  t.Created,
+			}); err != nil {
+				return err
+			}
+		}
+
+		comments := threads[t.ID]
+		sortPosts(comments)
+		for _, c := range comments {
+			if err := user(c.Author); err != nil {
+				return err
+			}
+			content := html.UnescapeString(strings.TrimSpace(c.Body))
+			if parent, ok := d.comments[c.ParentID]; ok && !removed(parent.Body) {
+				content = replyQuote(parent) + content
+			}
+			if err := im.Comment(ctx, gbb.ForeignComment{
+				ID:       "t1_" + c.ID,
+				TopicID:  t.ID,
+				AuthorID: c.Author,
+				Content:  content,
+				Created:  c.Created.Time,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sortPosts orders posts by their creation time.
+func sortPosts(posts []*redditPost) {
+	sort.Slice(posts, func(i, j int) bool {
+		if !posts[i].Created.Equal(posts[j].Created.Time) {
+			return posts[i].Created.Before(posts[j].Created.Time)
+		}
+		return posts[i].ID < posts[j].ID
+	})
+}
+
+// submissionContent returns the text of the submission, with the link it
+// points to.
+func submissionContent(s *redditPost) string {
+	var parts []string
+	if !s.IsSelf && s.URL != "" {
+		parts = append(parts, s.URL)
+	}
+	if text := strings.TrimSpace(s.Selftext); text != "" && !removed(text) {
+		parts = append(parts, html.UnescapeString(text))
+	}
+	if len(parts) == 0 {
+		return "(no content)"
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// removed returns true if the text was removed by the author or a moderator.
+func removed(text string) bool {
+	return text == "[deleted]" || text == "[removed]"
+}
+
+// replyQuote returns the beginning of the parent comment, quoted.
+func replyQuote(parent *redditPost) string {
+	const maxExcerpt = 200
+
+	excerpt := html.UnescapeString(strings.TrimSpace(parent.Body))
+	if i := strings.Index(excerpt, "\n"); i >= 0 {
+		excerpt = strings.TrimSpace(excerpt[:i]) + " …"
+	}
+	if len(excerpt) > maxExcerpt {
+		cut := maxExcerpt
+		for cut > 0 && !utf8.RuneStart(excerpt[cut]) {
+			cut--
+		}
+		excerpt = excerpt[:cut] + "…"
+	}
+	return fmt.Sprintf("> **%s** wrote:\n>\n> %s\n\n", parent.Author, excerpt)
+}
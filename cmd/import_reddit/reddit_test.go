@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/husio/gbb/gbb"
+)
+
+// threadJSON is a saved response of the comments page of a submission.
+const threadJSON = `[
+  {"kind": "Listing", "data": {"children": [
+    {"kind": "t3", "data": {"id": "abc", "subreddit": "golang", "author": "alice", "created_utc": 1577955600.0,
+      "title": "Generics &amp; you", "selftext": "What do you think?", "url": "https://www.reddit.com/r/golang/comments/abc/", "is_self": true}}
+  ]}},
+  {"kind": "Listing", "data": {"children": [
+    {"kind": "t1", "data": {"id": "c2", "subreddit": "golang", "author": "bob", "created_utc": 1577959200, "body": "Finally &gt; never.\n\nSecond paragraph.",
+      "link_id": "t3_abc", "parent_id": "t3_abc",
+      "replies": {"kind": "Listing", "data": {"children": [
+        {"kind": "t1", "data": {"id": "c3", "subreddit": "golang", "author": "alice", "created_utc": 1577962800, "body": "Agreed.",
+          "link_id": "t3_abc", "parent_id": "t1_c2", "replies": ""}},
+        {"kind": "more", "data": {"count": 12, "children": ["c9"]}}
+      ]}}}},
+    {"kind": "t1", "data": {"id": "c1", "subreddit": "golang", "author": "[deleted]", "created_utc": 1577956000, "body": "[removed]",
+      "link_id": "t3_abc", "parent_id": "t3_abc", "replies": ""}}
+  ]}}
+]`
+
+// pushshiftDump has one post per line. Its submission is not in the dump.
+const pushshiftDump = `{"id": "p2", "subreddit": "News", "author": "carol", "created_utc": "1577959200", "body": "Reply", "link_id": "t3_xyz", "link_title": "Big news", "parent_id": "t1_p1"}
+{"id": "p1", "subreddit": "News", "author": "dave", "created_utc": 1577955600, "body": "First!", "link_id": "t3_xyz", "link_title": "Big news", "parent_id": "t3_xyz"}
+{"id": "q1", "subreddit": "News", "author": "dave", "created_utc": 1577955600, "body": "Orphan", "link_id": "t3_unknown", "parent_id": "t3_unknown"}
+{"id": "lnk", "subreddit": "News", "author": "erin", "created_utc": 1577962800, "title": "Link", "selftext": "", "url": "https://example.com/", "is_self": false}
+`
+
+func TestRedditDumpImport(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(pushshiftDump))
+	w.Close()
+
+	dump := newRedditDump()
+	for _, data := range [][]byte{[]byte(threadJSON), gz.Bytes(), []byte(threadJSON)} {
+		if err := dump.Read(bytes.NewReader(data)); err != nil {
+			t.Fatalf("cannot read dump: %s", err)
+		}
+	}
+
+	var im recordingImporter
+	if err := dump.Import(context.Background(), &im); err != nil {
+		t.Fatalf("cannot import: %s", err)
+	}
+
+	want := []string{
+		"user alice",
+		"category golang r/golang",
+		"topic t3_abc golang alice 2020-01-02T09:00:00Z Generics & you",
+		"comment t3_abc t3_abc alice 2020-01-02T09:00:00Z What do you think?",
+		"user bob",
+		"comment t1_c2 t3_abc bob 2020-01-02T10:00:00Z Finally > never.\n\nSecond paragraph.",
+		"comment t1_c3 t3_abc alice 2020-01-02T11:00:00Z > **bob** wrote:\n>\n> Finally > never. …\n\nAgreed.",
+		"user dave",
+		"category news r/News",
+		"topic t3_xyz news dave 2020-01-02T09:00:00Z Big news",
+		"comment t1_p1 t3_xyz dave 2020-01-02T09:00:00Z First!",
+		"user carol",
+		"comment t1_p2 t3_xyz carol 2020-01-02T10:00:00Z > **dave** wrote:\n>\n> First!\n\nReply",
+		"user erin",
+		"topic t3_lnk news erin 2020-01-02T11:00:00Z Link",
+		"comment t3_lnk t3_lnk erin 2020-01-02T11:00:00Z https://example.com/",
+	}
+	if len(im.records) != len(want) {
+		t.Fatalf("want %d records, got %d: %q", len(want), len(im.records), im.records)
+	}
+	for i := range want {
+		if im.records[i] != want[i] {
+			t.Errorf("record %d: want %q, got %q", i, want[i], im.records[i])
+		}
+	}
+}
+
+func TestHTTPImporter(t *testing.T) {
+	var posted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/register/":
+			if r.FormValue("login") == "bob" {
+				http.Error(w, "Login already in use", http.StatusBadRequest)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: "auth", Value: r.FormValue("login"), Path: "/"})
+		case "/login/":
+			http.SetCookie(w, &http.Cookie{Name: "auth", Value: r.FormValue("login"), Path: "/"})
+		case "/t/new/":
+			posted = append(posted, "topic "+r.FormValue("category")+" "+r.FormValue("subject")+" "+r.FormValue("content"))
+			w.Header().Set("Location", "/t/42/hello/#comment-1")
+		case "/t/42/comment/":
+			c, _ := r.Cookie("auth")
+			posted = append(posted, "comment "+c.Value+" "+r.FormValue("content"))
+			w.Header().Set("Location", "/t/42/hello/#comment-2")
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusSeeOther)
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	im := newHTTPImporter(server.URL, "secret-password", 3)
+	now := time.Now()
+	steps := []error{
+		im.User(ctx, gbb.ForeignUser{ID: "alice", Name: "alice"}),
+		im.User(ctx, gbb.ForeignUser{ID: "bob", Name: "bob"}),
+		im.Category(ctx, gbb.ForeignCategory{ID: "golang", Name: "r/golang"}),
+		im.Topic(ctx, gbb.ForeignTopic{ID: "t3_a", Subject: "Hello", AuthorID: "alice", CategoryID: "golang", Created: now}),
+		im.Comment(ctx, gbb.ForeignComment{ID: "t3_a", TopicID: "t3_a", AuthorID: "alice", Content: "First", Created: now}),
+		im.Comment(ctx, gbb.ForeignComment{ID: "t1_b", TopicID: "t3_a", AuthorID: "bob", Content: "Second", Created: now}),
+	}
+	for i, err := range steps {
+		if err != nil {
+			t.Fatalf("step %d: %s", i, err)
+		}
+	}
+	want := "topic 3 Hello First|comment bob Second"
+	if got := strings.Join(posted, "|"); got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+type recordingImporter struct {
+	records []string
+}
+
+func (im *recordingImporter) User(ctx context.Context, u gbb.ForeignUser) error {
+	im.records = append(im.records, "user "+u.ID)
+	return nil
+}
+
+func (im *recordingImporter) Category(ctx context.Context, c gbb.ForeignCategory) error {
+	im.records = append(im.records, "category "+c.ID+" "+c.Name)
+	return nil
+}
+
+func (im *recordingImporter) Topic(ctx context.Context, t gbb.ForeignTopic) error {
+	im.records = append(im.records, "topic "+t.ID+" "+t.CategoryID+" "+t.AuthorID+" "+t.Created.Format(time.RFC3339)+" "+t.Subject)
+	return nil
+}
+
+func (im *recordingImporter) Comment(ctx context.Context, c gbb.ForeignComment) error {
+	im.records = append(im.records, "comment "+c.ID+" "+c.TopicID+" "+c.AuthorID+" "+c.Created.Format(time.RFC3339)+" "+c.Content)
+	return nil
+}
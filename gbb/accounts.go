@@ -0,0 +1,197 @@
+package gbb
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/go-surf/surf/errors"
+)
+
+// WriteAccountExport writes the personal data as a zip archive. Every kind of
+// data is written as JSON. Profile and comments, grouped by topic, are
+// additionally written as markdown, so that they can be read without any
+// tools.
+func WriteAccountExport(w io.Writer, exp *AccountExport) error {
+	type profile struct {
+		UserID        int64    `json:"user_id"`
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		Reputation    int64    `json:"reputation"`
+		TopicsCount   int64    `json:"topics_count"`
+		CommentsCount int64    `json:"comments_count"`
+		Banned        bool     `json:"banned"`
+	}
+	type topic struct {
+		TopicID       int64     `json:"topic_id"`
+		Subject       string    `json:"subject"`
+		Category      string    `json:"category"`
+		Created       time.Time `json:"created"`
+		Updated       time.Time `json:"updated"`
+		CommentsCount int64     `json:"comments_count"`
+		ViewsCount    int64     `json:"views_count"`
+		Locked        bool      `json:"locked"`
+		Hidden        bool      `json:"hidden"`
+	}
+	type comment struct {
+		CommentID    int64     `json:"comment_id"`
+		TopicID      int64     `json:"topic_id"`
+		TopicSubject string    `json:"topic_subject"`
+		Content      string    `json:"content"`
+		Revision     int64     `json:"revision"`
+		Created      time.Time `json:"created"`
+		Hidden       bool      `json:"hidden"`
+	}
+	type readProgress struct {
+		TopicID        int64     `json:"topic_id"`
+		CommentID      int64     `json:"comment_id"`
+		CommentCreated time.Time `json:"comment_created"`
+	}
+
+	z := zip.NewWriter(w)
+
+	writeJSON := func(name string, v interface{}) error {
+		f, err := z.Create(name)
+		if err != nil {
+			return errors.Wrap(err, "cannot create %s", name)
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(v); err != nil {
+			return errors.Wrap(err, "cannot write %s", name)
+		}
+		return nil
+	}
+
+	u := exp.User
+	if err := writeJSON("profile.json", profile{
+		UserID:        u.UserID,
+		Name:          u.Name,
+		Scopes:        u.Scopes.Names(),
+		Reputation:    u.Reputation,
+		TopicsCount:   u.TopicsCount,
+		CommentsCount: u.CommentsCount,
+		Banned:        u.Banned,
+	}); err != nil {
+		return err
+	}
+
+	topics := make([]topic, 0, len(exp.Topics))
+	for _, t := range exp.Topics {
+		topics = append(topics, topic{
+			TopicID:       t.TopicID,
+			Subject:       t.Subject,
+			Category:      t.Category.Name,
+			Created:       t.Created,
+			Updated:       t.Updated,
+			CommentsCount: t.CommentsCount,
+			ViewsCount:    t.ViewsCount,
+			Locked:        t.Locked,
+			Hidden:        t.Hidden,
+		})
+	}
+	if err := writeJSON("topics.json", topics); err != nil {
+		return err
+	}
+
+	comments := make([]comment, 0, len(exp.Comments))
+	for _, c := range exp.Comments {
+		comments = append(comments, comment{
+			CommentID:    c.CommentID,
+			TopicID:      c.TopicID,
+			TopicSubject: exp.TopicSubjects[c.TopicID],
+			Content:      c.Content,
+			Revision:     c.Revision,
+			Created:      c.Created,
+			Hidden:       c.Hidden,
+		})
+	}
+	if err := writeJSON("comments.json", comments); err != nil {
+		return err
+	}
+
+	progress := struct {
+		ReadAll *time.Time     `json:"read_all"`
+		Topics  []readProgress `json:"topics"`
+	}{
+		Topics: make([]readProgress, 0, len(exp.ReadProgress)),
+	}
+	if !exp.ReadAll.IsZero() {
+		progress.ReadAll = &exp.ReadAll
+	}
+	for _, rp := range exp.ReadProgress {
+		progress.Topics = append(progress.Topics, readProgress{
+			TopicID:        rp.TopicID,
+			CommentID:      rp.CommentID,
+			CommentCreated: rp.CommentCreated,
+		})
+	}
+	if err := writeJSON("read_progress.json", progress); err != nil {
+		return err
+	}
+
+	f, err := z.Create("profile.md")
+	if err != nil {
+		return errors.Wrap(err, "cannot create profile.md")
+	}
+	fmt.Fprintf(f, "# %s\n\n", u.Name)
+	fmt.Fprintf(f, "- Reputation: %d\n", u.Reputation)
+	fmt.Fprintf(f, "- Topics created: %d\n", u.TopicsCount)
+	fmt.Fprintf(f, "- Comments written: %d\n", u.CommentsCount)
+	for _, t := range exp.Topics {
+		fmt.Fprintf(f, "\n## %s\n\nCreated %s in %s.\n", t.Subject, t.Created.Format(time.RFC3339), t.Category.Name)
+	}
+
+	byTopic := make(map[int64][]*Comment)
+	for _, c := range exp.Comments {
+		byTopic[c.TopicID] = append(byTopic[c.TopicID], c)
+	}
+	topicIDs := make([]int64, 0, len(byTopic))
+	for id := range byTopic {
+		topicIDs = append(topicIDs, id)
+	}
+	sort.Slice(topicIDs, func(i, j int) bool { return topicIDs[i] < topicIDs[j] })
+	for _, id := range topicIDs {
+		name := fmt.Sprintf("comments/topic-%d.md", id)
+		f, err := z.Create(name)
+		if err != nil {
+			return errors.Wrap(err, "cannot create %s", name)
+		}
+		fmt.Fprintf(f, "# %s\n", exp.TopicSubjects[id])
+		for _, c := range byTopic[id] {
+			fmt.Fprintf(f, "\n## %s\n\n%s\n", c.Created.Format(time.RFC3339), c.Content)
+		}
+	}
+
+	if err := z.Close(); err != nil {
+		return errors.Wrap(err, "cannot close archive")
+	}
+	return nil
+}
+
+// DeleteDueAccounts deletes all accounts whose deletion grace period ended
+// before now. It returns the number of deleted accounts.
+func DeleteDueAccounts(ctx context.Context, accounts AccountStore, now time.Time) (int, error) {
+	const batchSize = 20
+
+	var deleted int
+	for {
+		due, err := accounts.ListDueDeletions(ctx, now, batchSize)
+		if err != nil {
+			return deleted, errors.Wrap(err, "cannot list due deletions")
+		}
+		for _, d := range due {
+			if err := accounts.DeleteAccount(ctx, d.UserID, d.Mode); err != nil {
+				return deleted, errors.Wrap(err, "cannot delete account %d", d.UserID)
+			}
+			deleted++
+		}
+		if len(due) < batchSize {
+			return deleted, nil
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package gbb
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteAccountExport(t *testing.T) {
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	bob := User{UserID: 999, Name: "Bobby", Scopes: createTopicScope}
+	exp := &AccountExport{
+		User: UserInfo{User: bob, TopicsCount: 1, CommentsCount: 3},
+		Topics: []*Topic{
+			{TopicID: 1, Subject: "Hello", Created: created, Author: bob, Category: Category{Name: "General"}},
+		},
+		Comments: []*Comment{
+			{CommentID: 10, TopicID: 1, Content: "first **post**", Created: created, Author: bob},
+			{CommentID: 20, TopicID: 2, Content: "a reply", Created: created.Add(time.Hour), Author: bob},
+			{CommentID: 11, TopicID: 1, Content: "follow up", Created: created.Add(2 * time.Hour), Author: bob},
+		},
+		TopicSubjects: map[int64]string{1: "Hello", 2: "Other topic"},
+		ReadProgress: []*ReadProgress{
+			{UserID: 999, TopicID: 2, CommentID: 20, CommentCreated: created},
+		},
+	}
+
+	var b bytes.Buffer
+	if err := WriteAccountExport(&b, exp); err != nil {
+		t.Fatalf("cannot write export: %s", err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("cannot read archive: %s", err)
+	}
+	files := make(map[string]string)
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("cannot open %s: %s", f.Name, err)
+		}
+		raw, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("cannot read %s: %s", f.Name, err)
+		}
+		files[f.Name] = string(raw)
+	}
+
+	for _, name := range []string{
+		"profile.json",
+		"topics.json",
+		"comments.json",
+		"read_progress.json",
+		"profile.md",
+		"comments/topic-1.md",
+		"comments/topic-2.md",
+	} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("missing %s", name)
+		}
+	}
+
+	var profile struct {
+		Name   string
+		Scopes []string
+	}
+	if err := json.Unmarshal([]byte(files["profile.json"]), &profile); err != nil {
+		t.Fatalf("cannot decode profile: %s", err)
+	}
+	if profile.Name != "Bobby" || len(profile.Scopes) != 1 || profile.Scopes[0] != "createTopic" {
+		t.Errorf("unexpected profile %+v", profile)
+	}
+
+	var comments []struct {
+		CommentID    int64  `json:"comment_id"`
+		TopicSubject string `json:"topic_subject"`
+	}
+	if err := json.Unmarshal([]byte(files["comments.json"]), &comments); err != nil {
+		t.Fatalf("cannot decode comments: %s", err)
+	}
+	if len(comments) != 3 || comments[1].TopicSubject != "Other topic" {
+		t.Errorf("unexpected comments %+v", comments)
+	}
+
+	var progress struct {
+		ReadAll *time.Time `json:"read_all"`
+		Topics  []struct {
+			TopicID int64 `json:"topic_id"`
+		} `json:"topics"`
+	}
+	if err := json.Unmarshal([]byte(files["read_progress.json"]), &progress); err != nil {
+		t.Fatalf("cannot decode read progress: %s", err)
+	}
+	if progress.ReadAll != nil || len(progress.Topics) != 1 || progress.Topics[0].TopicID != 2 {
+		t.Errorf("unexpected read progress %+v", progress)
+	}
+
+	md := files["comments/topic-1.md"]
+	if !strings.HasPrefix(md, "# Hello\n") || strings.Index(md, "first **post**") > strings.Index(md, "follow up") {
+		t.Errorf("unexpected markdown:\n%s", md)
+	}
+}
@@ -0,0 +1,588 @@
+package gbb
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/go-surf/surf/errors"
+	"github.com/husio/gbb/blob"
+)
+
+// ArchiveVersion is the version of the archive format written by
+// ExportArchive. ImportArchive reads only archives of the same version.
+const ArchiveVersion = 1
+
+// Archive is a stream of JSON lines, each being a single record:
+//
+//	{"kind": "user", "data": {"user_id": 1, ...}}
+//
+// The first record is the header and the last one is the end record, which
+// lists the number of records of each kind, so that truncated archives are
+// detected. Records are ordered so that every record refers only to records
+// written before it. Attachment content is embedded in its record.
+type archiveRecord struct {
+	Kind string          `json:"kind"`
+	Data json.RawMessage `json:"data"`
+}
+
+const (
+	archiveHeaderKind      = "header"
+	archiveCategoryKind    = "category"
+	archiveUserKind        = "user"
+	archivePlaceholderKind = "deleted_user_placeholder"
+	archiveTopicKind       = "topic"
+	archiveCommentKind     = "comment"
+	archiveAttachmentKind  = "attachment"
+	archiveReadAllKind     = "read_all"
+	archiveReadKind        = "read_progress"
+	archiveEndKind         = "end"
+)
+
+type archiveHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+}
+
+type archiveCategory struct {
+	CategoryID int64  `json:"category_id"`
+	Name       string `json:"name"`
+}
+
+type archiveUser struct {
+	UserID       int64    `json:"user_id"`
+	Name         string   `json:"name"`
+	PasswordHash string   `json:"password_hash"`
+	Scopes       []string `json:"scopes"`
+	Reputation   int64    `json:"reputation"`
+	Banned       bool     `json:"banned"`
+	Hidden       bool     `json:"hidden"`
+}
+
+type archivePlaceholder struct {
+	UserID int64 `json:"user_id"`
+}
+
+type archiveTopic struct {
+	TopicID           int64     `json:"topic_id"`
+	Subject           string    `json:"subject"`
+	Created           time.Time `json:"created"`
+	AuthorID          int64     `json:"author_id"`
+	CategoryID        int64     `json:"category_id"`
+	ViewsCount        int64     `json:"views_count"`
+	AcceptedCommentID int64     `json:"accepted_comment_id,omitempty"`
+	Locked            bool      `json:"locked"`
+	Hidden            bool      `json:"hidden"`
+}
+
+type archiveComment struct {
+	CommentID int64     `json:"comment_id"`
+	TopicID   int64     `json:"topic_id"`
+	AuthorID  int64     `json:"author_id"`
+	Content   string    `json:"content"`
+	Revision  int64     `json:"revision"`
+	Created   time.Time `json:"created"`
+	Hidden    bool      `json:"hidden"`
+}
+
+type archiveAttachment struct {
+	AttachmentID int64     `json:"attachment_id"`
+	CommentID    int64     `json:"comment_id"`
+	UserID       int64     `json:"user_id"`
+	Name         string    `json:"name"`
+	ContentType  string    `json:"content_type"`
+	Created      time.Time `json:"created"`
+	BlobKey      string    `json:"blob_key"`
+	Content      []byte    `json:"content"`
+	ThumbnailKey string    `json:"thumbnail_key,omitempty"`
+	Thumbnail    []byte    `json:"thumbnail,omitempty"`
+}
+
+type archiveReadAll struct {
+	UserID  int64     `json:"user_id"`
+	Created time.Time `json:"created"`
+}
+
+type archiveReadProgress struct {
+	UserID         int64     `json:"user_id"`
+	TopicID        int64     `json:"topic_id"`
+	CommentID      int64     `json:"comment_id"`
+	CommentCreated time.Time `json:"comment_created"`
+}
+
+type archiveEnd struct {
+	Counts map[string]int64 `json:"counts"`
+}
+
+// archiveBatchSize is the number of records read from a store at once.
+const archiveBatchSize = 500
+
+// ExportArchive writes all users, categories, topics, comments with their
+// attachments and read progress to given writer. It returns the number of
+// records written of each kind.
+func ExportArchive(
+	ctx context.Context,
+	w io.Writer,
+	bbStore BBStore,
+	readTracker ReadProgressTracker,
+	attachments AttachmentStore,
+	accounts AccountStore,
+	blobs blob.Store,
+) (map[string]int64, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	counts := make(map[string]int64)
+	write := func(kind string, data interface{}) error {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return errors.Wrap(err, "cannot serialize %s", kind)
+		}
+		if err := enc.Encode(archiveRecord{Kind: kind, Data: raw}); err != nil {
+			return errors.Wrap(err, "cannot write %s", kind)
+		}
+		counts[kind]++
+		return nil
+	}
+
+	if err := write(archiveHeaderKind, archiveHeader{
+		Format:  "gbb",
+		Version: ArchiveVersion,
+		Created: time.Now().UTC(),
+	}); err != nil {
+		return counts, err
+	}
+
+	categories, err := bbStore.ListCategories(ctx)
+	if err != nil {
+		return counts, errors.Wrap(err, "cannot list categories")
+	}
+	for _, c := range categories {
+		if err := write(archiveCategoryKind, archiveCategory{CategoryID: c.CategoryID, Name: c.Name}); err != nil {
+			return counts, err
+		}
+	}
+
+	for afterID := int64(0); ; {
+		users, err := bbStore.ExportUsers(ctx, afterID, archiveBatchSize)
+		if err != nil {
+			return counts, errors.Wrap(err, "cannot export users")
+		}
+		for _, u := range users {
+			if err := write(archiveUserKind, archiveUser{
+				UserID:       u.UserID,
+				Name:         u.Name,
+				PasswordHash: u.PasswordHash,
+				Scopes:       u.Scopes.Names(),
+				Reputation:   u.Reputation,
+				Banned:       u.Banned,
+				Hidden:       u.Hidden,
+			}); err != nil {
+				return counts, err
+			}
+			afterID = u.UserID
+		}
+		if len(users) < archiveBatchSize {
+			break
+		}
+	}
+
+	switch placeholderID, err := accounts.DeletedUserPlaceholder(ctx); {
+	case err == nil:
+		if err := write(archivePlaceholderKind, archivePlaceholder{UserID: placeholderID}); err != nil {
+			return counts, err
+		}
+	case ErrUserNotFound.Is(err):
+		// Nothing to link.
+	default:
+		return counts, errors.Wrap(err, "cannot get deleted user placeholder")
+	}
+
+	for afterID := int64(0); ; {
+		topics, err := bbStore.ExportTopics(ctx, afterID, archiveBatchSize)
+		if err != nil {
+			return counts, errors.Wrap(err, "cannot export topics")
+		}
+		for _, t := range topics {
+			if err := write(archiveTopicKind, archiveTopic{
+				TopicID:           t.TopicID,
+				Subject:           t.Subject,
+				Created:           t.Created,
+				AuthorID:          t.Author.UserID,
+				CategoryID:        t.Category.CategoryID,
+				ViewsCount:        t.ViewsCount,
+				AcceptedCommentID: t.AcceptedCommentID,
+				Locked:            t.Locked,
+				Hidden:            t.Hidden,
+			}); err != nil {
+				return counts, err
+			}
+			afterID = t.TopicID
+		}
+		if len(topics) < archiveBatchSize {
+			break
+		}
+	}
+
+	for afterID := int64(0); ; {
+		comments, err := bbStore.ExportComments(ctx, afterID, archiveBatchSize)
+		if err != nil {
+			return counts, errors.Wrap(err, "cannot export comments")
+		}
+		for _, c := range comments {
+			if err := write(archiveCommentKind, archiveComment{
+				CommentID: c.CommentID,
+				TopicID:   c.TopicID,
+				AuthorID:  c.Author.UserID,
+				Content:   c.Content,
+				Revision:  c.Revision,
+				Created:   c.Created,
+				Hidden:    c.Hidden,
+			}); err != nil {
+				return counts, err
+			}
+			afterID = c.CommentID
+		}
+		if len(comments) < archiveBatchSize {
+			break
+		}
+	}
+
+	for afterID := int64(0); ; {
+		batch, err := attachments.ExportAttachments(ctx, afterID, archiveBatchSize)
+		if err != nil {
+			return counts, errors.Wrap(err, "cannot export attachments")
+		}
+		for _, a := range batch {
+			rec := archiveAttachment{
+				AttachmentID: a.AttachmentID,
+				CommentID:    a.CommentID,
+				UserID:       a.UserID,
+				Name:         a.Name,
+				ContentType:  a.ContentType,
+				Created:      a.Created,
+				BlobKey:      a.BlobKey,
+				ThumbnailKey: a.ThumbnailKey,
+			}
+			if rec.Content, err = readBlob(ctx, blobs, a.BlobKey); err != nil {
+				return counts, err
+			}
+			if a.ThumbnailKey != "" {
+				if rec.Thumbnail, err = readBlob(ctx, blobs, a.ThumbnailKey); err != nil {
+					return counts, err
+				}
+			}
+			if err := write(archiveAttachmentKind, rec); err != nil {
+				return counts, err
+			}
+			afterID = a.AttachmentID
+		}
+		if len(batch) < archiveBatchSize {
+			break
+		}
+	}
+
+	for after := (ReadProgress{}); ; {
+		progress, err := readTracker.ExportReadProgress(ctx, after, archiveBatchSize)
+		if err != nil {
+			return counts, errors.Wrap(err, "cannot export read progress")
+		}
+		for _, p := range progress {
+			if p.TopicID == 0 {
+				err = write(archiveReadAllKind, archiveReadAll{UserID: p.UserID, Created: p.CommentCreated})
+			} else {
+				err = write(archiveReadKind, archiveReadProgress{
+					UserID:         p.UserID,
+					TopicID:        p.TopicID,
+					CommentID:      p.CommentID,
+					CommentCreated: p.CommentCreated,
+				})
+			}
+			if err != nil {
+				return counts, err
+			}
+			after = *p
+		}
+		if len(progress) < archiveBatchSize {
+			break
+		}
+	}
+
+	// End record counts all records but itself.
+	end := archiveEnd{Counts: make(map[string]int64, len(counts))}
+	for kind, n := range counts {
+		end.Counts[kind] = n
+	}
+	if err := write(archiveEndKind, end); err != nil {
+		return counts, err
+	}
+	if err := bw.Flush(); err != nil {
+		return counts, errors.Wrap(err, "cannot flush")
+	}
+	return counts, nil
+}
+
+func readBlob(ctx context.Context, blobs blob.Store, key string) ([]byte, error) {
+	r, err := blobs.Get(ctx, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get blob %q", key)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read blob %q", key)
+	}
+	return b, nil
+}
+
+// ImportArchive reads an archive written by ExportArchive, optionally gzip
+// compressed, and creates all its records with IDs and timestamps preserved.
+// Stores must be empty, apart from the deleted user placeholder, which is
+// replaced by the archived one. It returns the number of records read of each
+// kind.
+//
+// Records are created as they are read, so a failed import leaves the
+// stores partially filled.
+func ImportArchive(
+	ctx context.Context,
+	r io.Reader,
+	bbStore BBStore,
+	readTracker ReadProgressTracker,
+	attachments AttachmentStore,
+	accounts AccountStore,
+	blobs blob.Store,
+) (map[string]int64, error) {
+	counts := make(map[string]int64)
+
+	// Placeholder is created when the account store is first used, so
+	// it exists even if nothing else was written yet.
+	placeholderID, err := accounts.DeletedUserPlaceholder(ctx)
+	if err != nil && !ErrUserNotFound.Is(err) {
+		return counts, errors.Wrap(err, "cannot get deleted user placeholder")
+	}
+	users, err := bbStore.ExportUsers(ctx, 0, 2)
+	if err != nil {
+		return counts, errors.Wrap(err, "cannot check users")
+	}
+	for _, u := range users {
+		if u.UserID != placeholderID {
+			return counts, errors.Wrap(ErrConstraint, "store already contains users")
+		}
+	}
+	if placeholderID != 0 {
+		if err := accounts.RemoveDeletedUserPlaceholder(ctx); err != nil {
+			return counts, errors.Wrap(err, "cannot remove deleted user placeholder")
+		}
+	}
+
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return counts, errors.Wrap(err, "cannot read gzip")
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+	dec := json.NewDecoder(br)
+
+	// Accepted comments can be marked only once all comments exist.
+	type accepted struct{ topicID, commentID int64 }
+	var acceptedComments []accepted
+
+	for line := 1; ; line++ {
+		var rec archiveRecord
+		if err := dec.Decode(&rec); err != nil {
+			if err == io.EOF {
+				return counts, errors.Wrap(ErrMalformed, "archive is truncated")
+			}
+			return counts, errors.Wrap(ErrMalformed, "record %d: %s", line, err)
+		}
+		if line == 1 && rec.Kind != archiveHeaderKind {
+			return counts, errors.Wrap(ErrMalformed, "missing header")
+		}
+		counts[rec.Kind]++
+
+		var err error
+		switch rec.Kind {
+		case archiveHeaderKind:
+			var h archiveHeader
+			if err = json.Unmarshal(rec.Data, &h); err != nil {
+				break
+			}
+			if line != 1 || h.Format != "gbb" {
+				return counts, errors.Wrap(ErrMalformed, "unexpected header")
+			}
+			if h.Version != ArchiveVersion {
+				return counts, errors.Wrap(ErrMalformed, "unsupported version %d", h.Version)
+			}
+		case archiveCategoryKind:
+			var c archiveCategory
+			if err = json.Unmarshal(rec.Data, &c); err != nil {
+				break
+			}
+			err = bbStore.ImportCategory(ctx, Category{CategoryID: c.CategoryID, Name: c.Name})
+		case archiveUserKind:
+			var u archiveUser
+			if err = json.Unmarshal(rec.Data, &u); err != nil {
+				break
+			}
+			var scopes UserScope
+			for _, name := range u.Scopes {
+				scope, err := ParseUserScope(name)
+				if err != nil {
+					return counts, errors.Wrap(err, "record %d", line)
+				}
+				scopes = scopes.Add(scope)
+			}
+			_, err = bbStore.ImportUser(ctx, ArchivedUser{
+				User: User{
+					UserID:     u.UserID,
+					Name:       u.Name,
+					Scopes:     scopes,
+					Reputation: u.Reputation,
+				},
+				PasswordHash: u.PasswordHash,
+				Banned:       u.Banned,
+				Hidden:       u.Hidden,
+			})
+		case archivePlaceholderKind:
+			var p archivePlaceholder
+			if err = json.Unmarshal(rec.Data, &p); err != nil {
+				break
+			}
+			err = accounts.ImportDeletedUserPlaceholder(ctx, p.UserID)
+		case archiveTopicKind:
+			var t archiveTopic
+			if err = json.Unmarshal(rec.Data, &t); err != nil {
+				break
+			}
+			_, err = bbStore.ImportTopic(ctx, Topic{
+				TopicID:    t.TopicID,
+				Subject:    t.Subject,
+				Created:    t.Created,
+				Author:     User{UserID: t.AuthorID},
+				Category:   Category{CategoryID: t.CategoryID},
+				ViewsCount: t.ViewsCount,
+				Locked:     t.Locked,
+				Hidden:     t.Hidden,
+			})
+			if t.AcceptedCommentID != 0 {
+				acceptedComments = append(acceptedComments, accepted{t.TopicID, t.AcceptedCommentID})
+			}
+		case archiveCommentKind:
+			var c archiveComment
+			if err = json.Unmarshal(rec.Data, &c); err != nil {
+				break
+			}
+			_, err = bbStore.ImportComment(ctx, Comment{
+				CommentID: c.CommentID,
+				TopicID:   c.TopicID,
+				Author:    User{UserID: c.AuthorID},
+				Content:   c.Content,
+				Revision:  c.Revision,
+				Created:   c.Created,
+				Hidden:    c.Hidden,
+			})
+		case archiveAttachmentKind:
+			var a archiveAttachment
+			if err = json.Unmarshal(rec.Data, &a); err != nil {
+				break
+			}
+			if err = blobs.Put(ctx, a.BlobKey, bytes.NewReader(a.Content)); err != nil {
+				break
+			}
+			if a.ThumbnailKey != "" {
+				if err = blobs.Put(ctx, a.ThumbnailKey, bytes.NewReader(a.Thumbnail)); err != nil {
+					break
+				}
+			}
+			err = attachments.ImportAttachment(ctx, Attachment{
+				AttachmentID: a.AttachmentID,
+				CommentID:    a.CommentID,
+				UserID:       a.UserID,
+				Name:         a.Name,
+				ContentType:  a.ContentType,
+				Size:         int64(len(a.Content)),
+				BlobKey:      a.BlobKey,
+				ThumbnailKey: a.ThumbnailKey,
+				Created:      a.Created,
+			})
+		case archiveReadAllKind:
+			var p archiveReadAll
+			if err = json.Unmarshal(rec.Data, &p); err != nil {
+				break
+			}
+			// Marking all read drops the progress of the user, which
+			// is why it is written before the progress of topics.
+			err = readTracker.MarkAllRead(ctx, p.UserID, p.Created)
+		case archiveReadKind:
+			var p archiveReadProgress
+			if err = json.Unmarshal(rec.Data, &p); err != nil {
+				break
+			}
+			err = readTracker.Track(ctx, ReadProgress{
+				UserID:         p.UserID,
+				TopicID:        p.TopicID,
+				CommentID:      p.CommentID,
+				CommentCreated: p.CommentCreated,
+			})
+		case archiveEndKind:
+			counts[rec.Kind]--
+			var end archiveEnd
+			if err = json.Unmarshal(rec.Data, &end); err != nil {
+				break
+			}
+			for kind, n := range end.Counts {
+				if counts[kind] != n {
+					return counts, errors.Wrap(ErrMalformed, "want %d %s records, got %d", n, kind, counts[kind])
+				}
+			}
+			for _, a := range acceptedComments {
+				if err := bbStore.ImportAcceptedComment(ctx, a.topicID, a.commentID); err != nil {
+					return counts, errors.Wrap(err, "cannot mark comment %d accepted", a.commentID)
+				}
+			}
+			// Archives without the placeholder get a new one, as the
+			// removed one could have a clashing ID.
+			if counts[archivePlaceholderKind] == 0 {
+				if err := accounts.ImportDeletedUserPlaceholder(ctx, 0); err != nil {
+					return counts, errors.Wrap(err, "cannot create deleted user placeholder")
+				}
+			}
+			return counts, nil
+		default:
+			return counts, errors.Wrap(ErrMalformed, "record %d: unknown kind %q", line, rec.Kind)
+		}
+		if err != nil {
+			return counts, errors.Wrap(err, "record %d: cannot import %s", line, rec.Kind)
+		}
+	}
+}
+
+// FormatArchiveCounts returns a human readable summary of archive records.
+func FormatArchiveCounts(counts map[string]int64) string {
+	kinds := []string{
+		archiveCategoryKind,
+		archiveUserKind,
+		archiveTopicKind,
+		archiveCommentKind,
+		archiveAttachmentKind,
+		archiveReadAllKind,
+		archiveReadKind,
+	}
+	var b bytes.Buffer
+	for i, kind := range kinds {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%d %s", counts[kind], kind)
+	}
+	return b.String()
+}
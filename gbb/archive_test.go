@@ -0,0 +1,300 @@
+package gbb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/husio/gbb/blob"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	src := &memArchiveBBStore{
+		categories: []*Category{{CategoryID: 1, Name: "General"}, {CategoryID: 4, Name: "News"}},
+		users: []*ArchivedUser{
+			{User: User{UserID: 3, Name: "Bobby", Scopes: createTopicScope.Add(inviteScope), Reputation: 12}, PasswordHash: "$2a$hash"},
+			{User: User{UserID: 7, Name: "Rick"}, PasswordHash: "$2a$other", Banned: true},
+			{User: User{UserID: 9, Name: deletedUserName}, PasswordHash: "$2a$nobody", Banned: true},
+		},
+		topics: []*Topic{
+			{TopicID: 10, Subject: "Hello", Created: created, Author: User{UserID: 3}, Category: Category{CategoryID: 4}, ViewsCount: 42, AcceptedCommentID: 21},
+		},
+		comments: []*Comment{
+			{CommentID: 20, TopicID: 10, Author: User{UserID: 3}, Content: "first", Revision: 2, Created: created},
+			{CommentID: 21, TopicID: 10, Author: User{UserID: 7}, Content: "answer", Created: created.Add(time.Hour), Hidden: true},
+		},
+	}
+	srcAccounts := &memArchiveAccountStore{bbStore: src, placeholderID: 9}
+	srcProgress := &memArchiveReadTracker{progress: []*ReadProgress{
+		{UserID: 3, TopicID: 10, CommentID: 21, CommentCreated: created.Add(time.Hour)},
+		{UserID: 7, CommentCreated: created},
+	}}
+	srcAttachments := &memArchiveAttachmentStore{attachments: []*Attachment{
+		{AttachmentID: 5, CommentID: 20, UserID: 3, Name: "cat.png", ContentType: "image/png", Size: 4, BlobKey: "a/cat", ThumbnailKey: "a/cat-thumb", Created: created},
+	}}
+	srcBlobs := createArchiveBlobStore(t)
+	for key, content := range map[string]string{"a/cat": "meow", "a/cat-thumb": "m"} {
+		if err := srcBlobs.Put(ctx, key, strings.NewReader(content)); err != nil {
+			t.Fatalf("cannot put blob: %s", err)
+		}
+	}
+
+	var archive bytes.Buffer
+	counts, err := ExportArchive(ctx, &archive, src, srcProgress, srcAttachments, srcAccounts, srcBlobs)
+	if err != nil {
+		t.Fatalf("cannot export: %s", err)
+	}
+	if counts[archiveUserKind] != 3 || counts[archivePlaceholderKind] != 1 || counts[archiveCommentKind] != 2 || counts[archiveReadAllKind] != 1 {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+
+	// Started instance already has its own placeholder, which is replaced.
+	dst := &memArchiveBBStore{users: []*ArchivedUser{
+		{User: User{UserID: 1, Name: deletedUserName}, PasswordHash: "$2a$local", Banned: true},
+	}}
+	dstAccounts := &memArchiveAccountStore{bbStore: dst, placeholderID: 1}
+	dstProgress := &memArchiveReadTracker{}
+	dstAttachments := &memArchiveAttachmentStore{}
+	dstBlobs := createArchiveBlobStore(t)
+
+	// Compressed archives are read as well.
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(archive.Bytes())
+	gz.Close()
+	if _, err := ImportArchive(ctx, &compressed, dst, dstProgress, dstAttachments, dstAccounts, dstBlobs); err != nil {
+		t.Fatalf("cannot import: %s", err)
+	}
+	if dstAccounts.placeholderID != 9 {
+		t.Fatalf("want archived placeholder linked, got %d", dstAccounts.placeholderID)
+	}
+	if dst.topics[0].AcceptedCommentID != 0 || dst.accepted[10] != 21 {
+		t.Fatalf("want accepted comment imported separately, got %v", dst.accepted)
+	}
+	dst.topics[0].AcceptedCommentID = dst.accepted[10]
+
+	// Archive of the restored forum is the same, apart from the header.
+	var again bytes.Buffer
+	if _, err := ExportArchive(ctx, &again, dst, dstProgress, dstAttachments, dstAccounts, dstBlobs); err != nil {
+		t.Fatalf("cannot export again: %s", err)
+	}
+	want := strings.SplitN(archive.String(), "\n", 2)[1]
+	got := strings.SplitN(again.String(), "\n", 2)[1]
+	if want != got {
+		t.Fatalf("archives differ\nwant %s\n got %s", want, got)
+	}
+
+	if _, err := ImportArchive(ctx, bytes.NewReader(archive.Bytes()), dst, dstProgress, dstAttachments, dstAccounts, dstBlobs); !ErrConstraint.Is(err) {
+		t.Fatalf("want import into non empty store rejected, got %+v", err)
+	}
+
+	// Last line is the end record.
+	truncated := archive.Bytes()[:bytes.LastIndexByte(archive.Bytes()[:archive.Len()-1], '\n')+1]
+	empty := &memArchiveBBStore{}
+	if _, err := ImportArchive(ctx, bytes.NewReader(truncated), empty, &memArchiveReadTracker{}, &memArchiveAttachmentStore{}, &memArchiveAccountStore{bbStore: empty}, createArchiveBlobStore(t)); !ErrMalformed.Is(err) {
+		t.Fatalf("want truncated archive rejected, got %+v", err)
+	}
+}
+
+func TestImportArchiveVersion(t *testing.T) {
+	ctx := context.Background()
+	archive := `{"kind":"header","data":{"format":"gbb","version":999}}` + "\n"
+	bbStore := &memArchiveBBStore{}
+	_, err := ImportArchive(ctx, strings.NewReader(archive), bbStore, &memArchiveReadTracker{}, &memArchiveAttachmentStore{}, &memArchiveAccountStore{bbStore: bbStore}, createArchiveBlobStore(t))
+	if !ErrMalformed.Is(err) || !strings.Contains(err.Error(), "unsupported version") {
+		t.Fatalf("want unsupported version, got %+v", err)
+	}
+}
+
+func createArchiveBlobStore(t *testing.T) blob.Store {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "gbb-archive-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	store, err := blob.NewFSStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+type memArchiveBBStore struct {
+	BBStore
+
+	categories []*Category
+	users      []*ArchivedUser
+	topics     []*Topic
+	comments   []*Comment
+	accepted   map[int64]int64
+}
+
+func (s *memArchiveBBStore) ListCategories(ctx context.Context) ([]*Category, error) {
+	return s.categories, nil
+}
+
+func (s *memArchiveBBStore) ExportUsers(ctx context.Context, afterID int64, limit int) ([]*ArchivedUser, error) {
+	var res []*ArchivedUser
+	for _, u := range s.users {
+		if u.UserID > afterID && len(res) < limit {
+			res = append(res, u)
+		}
+	}
+	return res, nil
+}
+
+func (s *memArchiveBBStore) ExportTopics(ctx context.Context, afterID int64, limit int) ([]*Topic, error) {
+	var res []*Topic
+	for _, t := range s.topics {
+		if t.TopicID > afterID && len(res) < limit {
+			res = append(res, t)
+		}
+	}
+	return res, nil
+}
+
+func (s *memArchiveBBStore) ExportComments(ctx context.Context, afterID int64, limit int) ([]*Comment, error) {
+	var res []*Comment
+	for _, c := range s.comments {
+		if c.CommentID > afterID && len(res) < limit {
+			res = append(res, c)
+		}
+	}
+	return res, nil
+}
+
+func (s *memArchiveBBStore) ImportCategory(ctx context.Context, c Category) error {
+	s.categories = append(s.categories, &c)
+	return nil
+}
+
+func (s *memArchiveBBStore) ImportUser(ctx context.Context, u ArchivedUser) (int64, error) {
+	s.users = append(s.users, &u)
+	return u.UserID, nil
+}
+
+func (s *memArchiveBBStore) ImportTopic(ctx context.Context, t Topic) (int64, error) {
+	s.topics = append(s.topics, &t)
+	return t.TopicID, nil
+}
+
+func (s *memArchiveBBStore) ImportComment(ctx context.Context, c Comment) (int64, error) {
+	s.comments = append(s.comments, &c)
+	return c.CommentID, nil
+}
+
+func (s *memArchiveBBStore) ImportAcceptedComment(ctx context.Context, topicID, commentID int64) error {
+	if s.accepted == nil {
+		s.accepted = make(map[int64]int64)
+	}
+	s.accepted[topicID] = commentID
+	return nil
+}
+
+type memArchiveReadTracker struct {
+	ReadProgressTracker
+
+	progress []*ReadProgress
+}
+
+func (rt *memArchiveReadTracker) ExportReadProgress(ctx context.Context, after ReadProgress, limit int) ([]*ReadProgress, error) {
+	sort.Slice(rt.progress, func(i, j int) bool {
+		a, b := rt.progress[i], rt.progress[j]
+		return a.UserID < b.UserID || (a.UserID == b.UserID && a.TopicID < b.TopicID)
+	})
+	var res []*ReadProgress
+	for _, p := range rt.progress {
+		if p.UserID < after.UserID || (p.UserID == after.UserID && p.TopicID <= after.TopicID) {
+			continue
+		}
+		if len(res) < limit {
+			res = append(res, p)
+		}
+	}
+	return res, nil
+}
+
+func (rt *memArchiveReadTracker) Track(ctx context.Context, p ReadProgress) error {
+	rt.progress = append(rt.progress, &p)
+	return nil
+}
+
+func (rt *memArchiveReadTracker) MarkAllRead(ctx context.Context, userID int64, now time.Time) error {
+	rt.progress = append(rt.progress, &ReadProgress{UserID: userID, CommentCreated: now})
+	return nil
+}
+
+type memArchiveAttachmentStore struct {
+	AttachmentStore
+
+	attachments []*Attachment
+}
+
+func (s *memArchiveAttachmentStore) ExportAttachments(ctx context.Context, afterID int64, limit int) ([]*Attachment, error) {
+	var res []*Attachment
+	for _, a := range s.attachments {
+		if a.AttachmentID > afterID && len(res) < limit {
+			res = append(res, a)
+		}
+	}
+	return res, nil
+}
+
+func (s *memArchiveAttachmentStore) ImportAttachment(ctx context.Context, a Attachment) error {
+	s.attachments = append(s.attachments, &a)
+	return nil
+}
+
+type memArchiveAccountStore struct {
+	AccountStore
+
+	bbStore       *memArchiveBBStore
+	placeholderID int64
+}
+
+func (s *memArchiveAccountStore) DeletedUserPlaceholder(ctx context.Context) (int64, error) {
+	if s.placeholderID == 0 {
+		return 0, ErrUserNotFound
+	}
+	return s.placeholderID, nil
+}
+
+func (s *memArchiveAccountStore) RemoveDeletedUserPlaceholder(ctx context.Context) error {
+	var users []*ArchivedUser
+	for _, u := range s.bbStore.users {
+		if u.UserID != s.placeholderID {
+			users = append(users, u)
+		}
+	}
+	s.bbStore.users = users
+	s.placeholderID = 0
+	return nil
+}
+
+func (s *memArchiveAccountStore) ImportDeletedUserPlaceholder(ctx context.Context, userID int64) error {
+	if s.placeholderID != 0 {
+		return ErrConstraint
+	}
+	if userID == 0 {
+		userID = 1
+		for _, u := range s.bbStore.users {
+			if u.UserID >= userID {
+				userID = u.UserID + 1
+			}
+		}
+		s.bbStore.users = append(s.bbStore.users, &ArchivedUser{User: User{UserID: userID, Name: deletedUserName}, Banned: true})
+	}
+	s.placeholderID = userID
+	return nil
+}
@@ -0,0 +1,375 @@
+package gbb
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-surf/surf/errors"
+	"github.com/husio/gbb/blob"
+)
+
+// AttachmentLimits restricts files that can be attached to a single comment.
+type AttachmentLimits struct {
+	// MaxSize is the maximum size of a single file in bytes.
+	MaxSize int64
+	// MaxCount is the maximum number of files attached to a comment.
+	MaxCount int
+}
+
+// attachmentContentTypes is the list of accepted content types, as detected
+// by http.DetectContentType. Content type declared by the client is ignored.
+var attachmentContentTypes = []string{
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"application/pdf",
+	"text/plain; charset=utf-8",
+}
+
+const (
+	thumbnailSize = 200
+
+	// maxImagePixels protects from decoding images that are small in
+	// size but would require huge amount of memory once decoded.
+	maxImagePixels = 40e6
+)
+
+// requestSize returns the maximum size of a request body that carries
+// attachments.
+func (l AttachmentLimits) requestSize() int64 {
+	return l.MaxSize*int64(l.MaxCount) + 1<<20
+}
+
+// attachmentRejectedError is returned when an uploaded file does not fit the
+// limits. Its message is meant to be displayed to the user.
+type attachmentRejectedError string
+
+func (e attachmentRejectedError) Error() string {
+	return string(e)
+}
+
+// attachmentFiles returns all files uploaded as attachments in the form,
+// ignoring empty file inputs.
+func attachmentFiles(form *multipart.Form, limits AttachmentLimits) ([]*multipart.FileHeader, error) {
+	if form == nil {
+		return nil, nil
+	}
+	var files []*multipart.FileHeader
+	for _, fh := range form.File["attachment"] {
+		if fh.Filename == "" && fh.Size == 0 {
+			continue
+		}
+		if fh.Size > limits.MaxSize {
+			return nil, attachmentRejectedError(fmt.Sprintf(
+				"%s is too big. Maximum file size is %s.", attachmentName(fh.Filename), humanSize(limits.MaxSize)))
+		}
+		files = append(files, fh)
+	}
+	if len(files) > limits.MaxCount {
+		return nil, attachmentRejectedError(fmt.Sprintf(
+			"Too many files. At most %d can be attached.", limits.MaxCount))
+	}
+	return files, nil
+}
+
+// storeAttachment validates uploaded file, writes its content and thumbnail
+// to the blob store and registers a new, not attached yet, attachment.
+func storeAttachment(
+	ctx context.Context,
+	attachments AttachmentStore,
+	blobs blob.Store,
+	limits AttachmentLimits,
+	userID int64,
+	fh *multipart.FileHeader,
+) (*Attachment, error) {
+	name := attachmentName(fh.Filename)
+
+	fd, err := fh.Open()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open uploaded file")
+	}
+	defer fd.Close()
+
+	content, err := ioutil.ReadAll(io.LimitReader(fd, limits.MaxSize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read uploaded file")
+	}
+	if int64(len(content)) > limits.MaxSize {
+		return nil, attachmentRejectedError(fmt.Sprintf(
+			"%s is too big. Maximum file size is %s.", name, humanSize(limits.MaxSize)))
+	}
+
+	contentType := http.DetectContentType(content)
+	if !containsString(attachmentContentTypes, contentType) {
+		return nil, attachmentRejectedError(fmt.Sprintf(
+			"%s is not an accepted file type. Only images, PDF and plain text files can be attached.", name))
+	}
+
+	a := Attachment{
+		UserID:      userID,
+		Name:        name,
+		ContentType: contentType,
+		Size:        int64(len(content)),
+		BlobKey:     newBlobKey(),
+	}
+
+	var thumbnail []byte
+	if a.IsImage() {
+		thumbnail, err = makeThumbnail(bytes.NewReader(content), thumbnailSize)
+		if err != nil {
+			return nil, attachmentRejectedError(fmt.Sprintf(
+				"%s is not a valid image.", name))
+		}
+		a.ThumbnailKey = a.BlobKey + ".thumbnail.jpg"
+	}
+
+	if err := blobs.Put(ctx, a.BlobKey, bytes.NewReader(content)); err != nil {
+		return nil, errors.Wrap(err, "cannot store attachment content")
+	}
+	if thumbnail != nil {
+		if err := blobs.Put(ctx, a.ThumbnailKey, bytes.NewReader(thumbnail)); err != nil {
+			blobs.Delete(ctx, a.BlobKey)
+			return nil, errors.Wrap(err, "cannot store attachment thumbnail")
+		}
+	}
+
+	created, err := attachments.CreateAttachment(ctx, a)
+	if err != nil {
+		deleteAttachmentBlobs(ctx, blobs, &a)
+		return nil, errors.Wrap(err, "cannot create attachment")
+	}
+	return created, nil
+}
+
+// IsImage returns true if the attachment is an image that can be displayed
+// inline.
+func (a *Attachment) IsImage() bool {
+	return strings.HasPrefix(a.ContentType, "image/")
+}
+
+// HumanSize returns the attachment size in a human readable form.
+func (a *Attachment) HumanSize() string {
+	return humanSize(a.Size)
+}
+
+func humanSize(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f kB", float64(size)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", size)
+	}
+}
+
+// attachmentName returns a file name safe to be displayed and used in the
+// URL.
+func attachmentName(filename string) string {
+	// Some browsers send the full path of the file.
+	filename = path.Base(strings.Replace(filename, `\`, "/", -1))
+	filename = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '/' {
+			return -1
+		}
+		return r
+	}, filename)
+	filename = strings.TrimSpace(filename)
+	if filename == "" || filename == "." {
+		return "attachment"
+	}
+	if runes := []rune(filename); len(runes) > 120 {
+		filename = string(runes[len(runes)-120:])
+	}
+	return filename
+}
+
+func newBlobKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return time.Now().UTC().Format("2006/01/") + hex.EncodeToString(b)
+}
+
+// makeThumbnail returns JPEG encoded image scaled down to fit within the
+// square of given size. Images smaller than the size are not scaled up.
+func makeThumbnail(r io.ReadSeeker, size int) ([]byte, error) {
+	conf, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decode image config")
+	}
+	if conf.Width <= 0 || conf.Height <= 0 || conf.Width*conf.Height > maxImagePixels {
+		return nil, fmt.Errorf("invalid image dimensions %dx%d", conf.Width, conf.Height)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "cannot seek")
+	}
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decode image")
+	}
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w > h {
+			w, h = size, max1(h*size/w)
+		} else {
+			w, h = max1(w*size/h), size
+		}
+	}
+
+	// Transparent images are put on a white background, because JPEG
+	// does not support the alpha channel.
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	scaleDown(dst, src)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, errors.Wrap(err, "cannot encode thumbnail")
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleDown draws src over dst, averaging all source pixels that fall into
+// each destination pixel.
+func scaleDown(dst *image.RGBA, src image.Image) {
+	sb := src.Bounds()
+	db := dst.Bounds()
+	for y := 0; y < db.Dy(); y++ {
+		y0 := sb.Min.Y + y*sb.Dy()/db.Dy()
+		y1 := sb.Min.Y + (y+1)*sb.Dy()/db.Dy()
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < db.Dx(); x++ {
+			x0 := sb.Min.X + x*sb.Dx()/db.Dx()
+			x1 := sb.Min.X + (x+1)*sb.Dx()/db.Dx()
+			if x1 == x0 {
+				x1++
+			}
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+			// Colors are alpha premultiplied, so compositing over
+			// the white background is dst = src + (1 - alpha).
+			const m = 0xffff
+			bg := m - a/n
+			dst.SetRGBA(db.Min.X+x, db.Min.Y+y, color.RGBA{
+				R: uint8((r/n + bg) >> 8),
+				G: uint8((g/n + bg) >> 8),
+				B: uint8((b/n + bg) >> 8),
+				A: 0xff,
+			})
+		}
+	}
+}
+
+func max1(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+func deleteAttachmentBlobs(ctx context.Context, blobs blob.Store, a *Attachment) error {
+	if err := blobs.Delete(ctx, a.BlobKey); err != nil {
+		return errors.Wrap(err, "cannot delete %q blob", a.BlobKey)
+	}
+	if a.ThumbnailKey != "" {
+		if err := blobs.Delete(ctx, a.ThumbnailKey); err != nil {
+			return errors.Wrap(err, "cannot delete %q blob", a.ThumbnailKey)
+		}
+	}
+	return nil
+}
+
+// DeleteAttachments removes content of given attachments from the blob
+// store and then the attachments themselves.
+func DeleteAttachments(
+	ctx context.Context,
+	attachments AttachmentStore,
+	blobs blob.Store,
+	list []*Attachment,
+) error {
+	for _, a := range list {
+		if err := deleteAttachmentBlobs(ctx, blobs, a); err != nil {
+			return err
+		}
+		switch err := attachments.DeleteAttachment(ctx, a.AttachmentID); {
+		case err == nil, ErrAttachmentNotFound.Is(err):
+			// All good.
+		default:
+			return errors.Wrap(err, "cannot delete attachment %d", a.AttachmentID)
+		}
+	}
+	return nil
+}
+
+// CleanupOrphanedAttachments deletes all attachments that do not belong to
+// any comment and are older than given age. Attachment is orphaned when its
+// comment or topic was deleted, or when the comment creation failed after the
+// upload.
+//
+// Age must be long enough to not remove attachments of comments that are
+// being created. Attachments of posts held for approval are kept.
+func CleanupOrphanedAttachments(
+	ctx context.Context,
+	attachments AttachmentStore,
+	pending PendingPostStore,
+	blobs blob.Store,
+	age time.Duration,
+) (int, error) {
+	const batchSize = 100
+
+	// Attachments of posts held after this point are too recent to be
+	// listed.
+	createdLte := time.Now().Add(-age)
+	heldIDs, err := pending.ListHeldAttachmentIDs(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot list held attachments")
+	}
+
+	var deleted int
+	for {
+		orphans, err := attachments.ListOrphanedAttachments(ctx, createdLte, heldIDs, batchSize)
+		if err != nil {
+			return deleted, errors.Wrap(err, "cannot list orphaned attachments")
+		}
+		if err := DeleteAttachments(ctx, attachments, blobs, orphans); err != nil {
+			return deleted, err
+		}
+		deleted += len(orphans)
+		if len(orphans) < batchSize {
+			return deleted, nil
+		}
+	}
+}
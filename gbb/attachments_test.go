@@ -0,0 +1,74 @@
+package gbb
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestMakeThumbnail(t *testing.T) {
+	cases := map[string]struct {
+		width, height int
+		wantW, wantH  int
+	}{
+		"landscape": {width: 800, height: 400, wantW: 200, wantH: 100},
+		"portrait":  {width: 300, height: 600, wantW: 100, wantH: 200},
+		"small":     {width: 50, height: 20, wantW: 50, wantH: 20},
+		"thin":      {width: 2000, height: 3, wantW: 200, wantH: 1},
+	}
+
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			img := image.NewNRGBA(image.Rect(0, 0, tc.width, tc.height))
+			for x := 0; x < tc.width; x++ {
+				for y := 0; y < tc.height; y++ {
+					img.Set(x, y, color.NRGBA{R: 255, A: 255})
+				}
+			}
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, img); err != nil {
+				t.Fatal(err)
+			}
+
+			thumb, err := makeThumbnail(bytes.NewReader(buf.Bytes()), 200)
+			if err != nil {
+				t.Fatalf("cannot make thumbnail: %s", err)
+			}
+			res, err := jpeg.Decode(bytes.NewReader(thumb))
+			if err != nil {
+				t.Fatalf("thumbnail is not a JPEG image: %s", err)
+			}
+			if b := res.Bounds(); b.Dx() != tc.wantW || b.Dy() != tc.wantH {
+				t.Fatalf("want %dx%d thumbnail, got %dx%d", tc.wantW, tc.wantH, b.Dx(), b.Dy())
+			}
+			if r, g, _, _ := res.At(0, 0).RGBA(); r>>8 < 240 || g>>8 > 15 {
+				t.Fatalf("want red thumbnail, got %v", res.At(0, 0))
+			}
+		})
+	}
+}
+
+func TestMakeThumbnailInvalidImage(t *testing.T) {
+	if _, err := makeThumbnail(bytes.NewReader([]byte("\x89PNG\r\n\x1a\nnot really")), 200); err == nil {
+		t.Fatal("want error")
+	}
+}
+
+func TestAttachmentName(t *testing.T) {
+	cases := map[string]string{
+		"photo.png":              "photo.png",
+		`C:\Users\bob\photo.png`: "photo.png",
+		"../../etc/passwd":       "passwd",
+		"a\x00b\nc.txt":          "abc.txt",
+		"":                       "attachment",
+		"  ":                     "attachment",
+	}
+	for input, want := range cases {
+		if got := attachmentName(input); got != want {
+			t.Errorf("%q: want %q, got %q", input, want, got)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package gbb
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/go-surf/surf"
@@ -41,3 +42,37 @@ func Login(ctx context.Context, boundCache surf.CacheService, u User) error {
 func Logout(ctx context.Context, boundCache surf.CacheService) error {
 	return boundCache.Del(ctx, "user")
 }
+
+// DeletedAccountMiddleware ends the session of a user whose account no longer
+// exists. Sessions are kept in cookies, so they cannot be removed when the
+// account is deleted and must be checked instead.
+func DeletedAccountMiddleware(bbStore BBStore, authStore surf.UnboundCacheService) surf.Middleware {
+	return func(handler interface{}) surf.Handler {
+		h := surf.AsHandler(handler)
+		return surf.HandlerFunc(func(w http.ResponseWriter, r *http.Request) surf.Response {
+			ctx := r.Context()
+
+			boundCache := authStore.Bind(w, r)
+			user, err := CurrentUser(ctx, boundCache)
+			if err != nil {
+				return h.HandleHTTPRequest(w, r)
+			}
+			switch _, err := bbStore.UserInfo(ctx, user.UserID, 0); {
+			case err == nil:
+				// All good.
+			case ErrUserNotFound.Is(err):
+				if err := Logout(ctx, boundCache); err != nil {
+					surf.LogError(ctx, err, "cannot end session of deleted user",
+						"user", fmt.Sprint(user.UserID))
+				}
+				surf.LogInfo(ctx, "session of deleted user ended",
+					"user", fmt.Sprint(user.UserID))
+				return surf.Redirect("/", http.StatusSeeOther)
+			default:
+				surf.LogError(ctx, err, "cannot check if user exists",
+					"user", fmt.Sprint(user.UserID))
+			}
+			return h.HandleHTTPRequest(w, r)
+		})
+	}
+}
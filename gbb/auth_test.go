@@ -0,0 +1,61 @@
+package gbb
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-surf/surf"
+)
+
+func TestDeletedAccountMiddleware(t *testing.T) {
+	authStore, err := surf.NewCookieCache("auth", []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := DeletedAccountMiddleware(&existingUsersBBStore{existing: 1}, authStore)(
+		func(w http.ResponseWriter, r *http.Request) surf.Response {
+			return statusResponse(http.StatusOK)
+		})
+
+	serve := func(userID int64) *httptest.ResponseRecorder {
+		login := httptest.NewRecorder()
+		if err := Login(context.Background(), authStore.Bind(login, httptest.NewRequest("GET", "/", nil)), User{UserID: userID, Name: "bob"}); err != nil {
+			t.Fatalf("cannot login: %s", err)
+		}
+		r := httptest.NewRequest("POST", "/t/1/comment/", nil)
+		for _, c := range login.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		if resp := handler.HandleHTTPRequest(w, r); resp != nil {
+			resp.ServeHTTP(w, r)
+		}
+		return w
+	}
+
+	if w := serve(1); w.Code != http.StatusOK {
+		t.Fatalf("want existing user served, got %d", w.Code)
+	}
+	w := serve(2)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("want deleted user redirected, got %d", w.Code)
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Fatalf("want session cookie removed, got %+v", cookies)
+	}
+}
+
+type existingUsersBBStore struct {
+	BBStore
+
+	existing int64
+}
+
+func (s *existingUsersBBStore) UserInfo(ctx context.Context, userID, viewerID int64) (*UserInfo, error) {
+	if userID != s.existing {
+		return nil, ErrUserNotFound
+	}
+	return &UserInfo{User: User{UserID: userID}}, nil
+}
@@ -0,0 +1,344 @@
+package gbb
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/husio/gbb/ldap"
+)
+
+// Authenticator verifies the login and password of a user. BBStore is an
+// Authenticator of the local users.
+type Authenticator interface {
+	// AuthenticateUser returns the user with given credentials.
+	// ErrNotFound is returned if the login is not known and
+	// ErrPermission if the password is not valid. ErrUserBanned is
+	// returned only if the password is valid.
+	AuthenticateUser(ctx context.Context, login, password string) (*User, error)
+}
+
+// AuthenticatorChain is an Authenticator that asks all authenticators in order
+// and returns the first user authenticated. Authentication stops if the user
+// is banned. Failing authenticators are skipped, so that users of the others
+// can still sign in.
+type AuthenticatorChain []Authenticator
+
+func (chain AuthenticatorChain) AuthenticateUser(ctx context.Context, login, password string) (*User, error) {
+	var (
+		rejected error = ErrUserNotFound
+		firstErr error
+	)
+	for _, a := range chain {
+		user, err := a.AuthenticateUser(ctx, login, password)
+		switch {
+		case err == nil:
+			return user, nil
+		case ErrUserBanned.Is(err):
+			return nil, err
+		case ErrPermission.Is(err):
+			rejected = err
+		case ErrNotFound.Is(err):
+			// Not known by this authenticator.
+		default:
+			surf.LogError(ctx, err, "authenticator failed",
+				"login", login)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, rejected
+}
+
+// LDAPAuthenticator authenticates users by binding to the LDAP server as
+// them. A local user is created on the first successful login and linked to
+// the LDAP entry.
+type LDAPAuthenticator struct {
+	// URL of the server, using the ldap or ldaps scheme.
+	URL string
+	// UserDN is the template of the user entry DN, in which %s is
+	// replaced with the login, for example
+	// "uid=%s,ou=people,dc=example,dc=com".
+	UserDN string
+	// GroupAttribute is the user entry attribute listing DNs of groups
+	// the user belongs to. Defaults to "memberOf".
+	GroupAttribute string
+	// GroupScopes maps groups to scopes. A group is matched either by
+	// its DN or by the value of its first DN component, for example
+	// "staff" for "cn=staff,ou=groups,dc=example,dc=com". Mapped scopes
+	// are synchronized on every login.
+	GroupScopes map[string]UserScope
+	TLSConfig   *tls.Config
+	// Timeout limits the whole conversation with the server.
+	Timeout time.Duration
+
+	// Registration decides if a local user is created for an entry that
+	// signs in for the first time. Only the open mode allows it.
+	Registration RegistrationMode
+
+	Store           BBStore
+	Identities      IdentityStore
+	ScopeThresholds []ScopeThreshold
+}
+
+func (a *LDAPAuthenticator) AuthenticateUser(ctx context.Context, login, password string) (*User, error) {
+	// Empty password is an anonymous bind that always succeeds.
+	if password == "" {
+		return nil, errors.Wrap(ErrPermission, "empty password")
+	}
+	login = strings.TrimSpace(login)
+	if login == "" {
+		return nil, ErrUserNotFound
+	}
+
+	if a.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, a.Timeout)
+		defer cancel()
+	}
+
+	conn, err := ldap.Dial(ctx, a.URL, a.TLSConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot connect to LDAP server")
+	}
+	defer conn.Close()
+
+	dn := strings.Replace(a.UserDN, "%s", ldap.EscapeDN(login), -1)
+	switch err := conn.Bind(dn, password); err {
+	case nil:
+		// All good.
+	case ldap.ErrInvalidCredentials:
+		// Unknown login and invalid password cannot be told apart.
+		return nil, errors.Wrap(ErrPermission, "invalid LDAP credentials")
+	default:
+		return nil, errors.Wrap(err, "cannot bind")
+	}
+
+	groupAttr := a.GroupAttribute
+	if groupAttr == "" {
+		groupAttr = "memberOf"
+	}
+	entry, err := conn.Entry(dn, []string{groupAttr})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read user entry")
+	}
+
+	var groups []string
+	for _, g := range entry.Values(groupAttr) {
+		groups = append(groups, g)
+		if name := firstRDNValue(g); name != "" {
+			groups = append(groups, name)
+		}
+	}
+
+	// Entry DN is used as the subject, because it is spelled the same
+	// regardless of how the login was typed.
+	return externalUser(ctx, a.Store, a.Identities, "ldap", entry.DN, login, a.GroupScopes, groups, a.Registration, a.ScopeThresholds)
+}
+
+// firstRDNValue returns the value of the first component of the DN, for
+// example "staff" for "cn=staff,ou=groups,dc=example,dc=com".
+func firstRDNValue(dn string) string {
+	i := strings.IndexByte(dn, '=')
+	if i < 0 {
+		return ""
+	}
+	var (
+		b       strings.Builder
+		escaped bool
+	)
+	for _, c := range dn[i+1:] {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+			continue
+		case c == ',' || c == '+':
+			return b.String()
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// ParseGroupScopes returns the mapping of groups to scopes, described as a
+// comma separated list of group:scope pairs, for example
+// "staff:moderator,wheel:admin". A group can be listed more than once.
+func ParseGroupScopes(s string) (map[string]UserScope, error) {
+	mapping := make(map[string]UserScope)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid group scope %q", pair)
+		}
+		scope, err := ParseUserScope(strings.TrimSpace(pair[i+1:]))
+		if err != nil {
+			return nil, err
+		}
+		group := strings.TrimSpace(pair[:i])
+		mapping[group] = mapping[group].Add(scope)
+	}
+	return mapping, nil
+}
+
+// groupScopes returns the scopes granted by given groups and all scopes that
+// are managed by the mapping.
+func groupScopes(mapping map[string]UserScope, groups []string) (granted, managed UserScope) {
+	for _, scopes := range mapping {
+		managed = managed.Add(scopes)
+	}
+	for _, g := range groups {
+		granted = granted.Add(mapping[g])
+	}
+	return granted, managed
+}
+
+// externalUser returns the local user linked to the subject of the external
+// identity provider, creating it if needed. Scopes managed by the group
+// mapping are updated to match given groups. ErrUserBanned is returned if
+// the user is banned and ErrRegistrationClosed if the user does not exist and
+// the registration mode is not open.
+func externalUser(
+	ctx context.Context,
+	bbStore BBStore,
+	identities IdentityStore,
+	provider, subject, name string,
+	mapping map[string]UserScope,
+	groups []string,
+	registration RegistrationMode,
+	scopeThresholds []ScopeThreshold,
+) (*User, error) {
+	userID, err := identities.UserByIdentity(ctx, provider, subject)
+	switch {
+	case err == nil:
+		// All good.
+	case ErrIdentityNotFound.Is(err):
+		if registration != RegistrationOpen {
+			return nil, ErrRegistrationClosed
+		}
+		user, err := registerExternalUser(ctx, bbStore, identities, provider, subject, name, scopeThresholds)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot register external user")
+		}
+		userID = user.UserID
+	default:
+		return nil, errors.Wrap(err, "cannot get user by identity")
+	}
+
+	info, err := bbStore.UserInfo(ctx, userID, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get user info")
+	}
+	if info.Banned {
+		return nil, ErrUserBanned
+	}
+	user := &info.User
+
+	granted, managed := groupScopes(mapping, groups)
+	if grant := granted.Remove(user.Scopes); grant != 0 {
+		if err := bbStore.GrantScopes(ctx, userID, grant); err != nil {
+			return nil, errors.Wrap(err, "cannot grant group scopes")
+		}
+		user.Scopes = user.Scopes.Add(grant)
+	}
+	if revoke := managed.Remove(granted) & user.Scopes; revoke != 0 {
+		if err := bbStore.RevokeScopes(ctx, userID, revoke); err != nil {
+			return nil, errors.Wrap(err, "cannot revoke group scopes")
+		}
+		user.Scopes = user.Scopes.Remove(revoke)
+	}
+	return user, nil
+}
+
+// registerExternalUser creates a local user for the external identity. The
+// user gets the same scopes as one registered using the form and a password
+// nobody knows.
+func registerExternalUser(
+	ctx context.Context,
+	bbStore BBStore,
+	identities IdentityStore,
+	provider, subject, name string,
+	scopeThresholds []ScopeThreshold,
+) (*User, error) {
+	name, err := availableUserName(ctx, bbStore, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot choose user name")
+	}
+	password, err := randomPassword()
+	if err != nil {
+		return nil, err
+	}
+	baseScopes := createCommentScope.Add((&UserInfo{}).EarnedScopes(scopeThresholds))
+	user, err := bbStore.RegisterUser(ctx, password, User{Name: name, Scopes: baseScopes})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot register user")
+	}
+	if err := identities.LinkIdentity(ctx, user.UserID, provider, subject); err != nil {
+		return nil, errors.Wrap(err, "cannot link identity")
+	}
+	surf.LogInfo(ctx, "new external user registered",
+		"name", user.Name,
+		"id", fmt.Sprint(user.UserID),
+		"provider", provider,
+		"subject", subject)
+	return user, nil
+}
+
+// truncateName returns the longest prefix of the name that is at most max
+// bytes long, without splitting characters.
+func truncateName(name string, max int) string {
+	for len(name) > max {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+// availableUserName returns a name based on given one that no user has yet.
+func availableUserName(ctx context.Context, bbStore BBStore, base string) (string, error) {
+	candidates := []string{base}
+	for i := 2; i < 20; i++ {
+		suffix := fmt.Sprint(i)
+		candidates = append(candidates, truncateName(base, 30-len(suffix))+suffix)
+	}
+	users, err := bbStore.UsersByName(ctx, candidates)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot list users")
+	}
+	taken := make(map[string]struct{}, len(users))
+	for _, u := range users {
+		taken[u.Name] = struct{}{}
+	}
+	for _, name := range candidates {
+		if _, ok := taken[name]; !ok {
+			return name, nil
+		}
+	}
+	return "", errors.Wrap(ErrConstraint, "all names taken")
+}
+
+// randomPassword returns a password nobody knows, for users that sign in
+// only using the identity provider.
+func randomPassword() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", errors.Wrap(err, "cannot read random")
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
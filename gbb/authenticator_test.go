@@ -0,0 +1,226 @@
+package gbb
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-surf/surf/errors"
+	"github.com/husio/gbb/ldap/ldaptest"
+)
+
+type authenticatorFunc func(ctx context.Context, login, password string) (*User, error)
+
+func (fn authenticatorFunc) AuthenticateUser(ctx context.Context, login, password string) (*User, error) {
+	return fn(ctx, login, password)
+}
+
+func TestAuthenticatorChain(t *testing.T) {
+	unknown := authenticatorFunc(func(context.Context, string, string) (*User, error) {
+		return nil, ErrUserNotFound
+	})
+	rejecting := authenticatorFunc(func(context.Context, string, string) (*User, error) {
+		return nil, errors.Wrap(ErrPermission, "invalid password")
+	})
+	banned := authenticatorFunc(func(context.Context, string, string) (*User, error) {
+		return nil, ErrUserBanned
+	})
+	failing := authenticatorFunc(func(context.Context, string, string) (*User, error) {
+		return nil, errors.New("connection refused")
+	})
+	accepting := authenticatorFunc(func(_ context.Context, login, _ string) (*User, error) {
+		return &User{UserID: 1, Name: login}, nil
+	})
+
+	connectionRefused := func(err error) bool {
+		return err != nil && err.Error() == "connection refused"
+	}
+
+	cases := map[string]struct {
+		chain   AuthenticatorChain
+		wantErr func(error) bool
+	}{
+		"empty": {
+			chain:   AuthenticatorChain{},
+			wantErr: ErrNotFound.Is,
+		},
+		"unknown": {
+			chain:   AuthenticatorChain{unknown, unknown},
+			wantErr: ErrNotFound.Is,
+		},
+		"rejected": {
+			chain:   AuthenticatorChain{rejecting, unknown},
+			wantErr: ErrPermission.Is,
+		},
+		"accepted by the second": {
+			chain: AuthenticatorChain{rejecting, accepting},
+		},
+		"failing is skipped": {
+			chain: AuthenticatorChain{failing, accepting},
+		},
+		"failure is reported": {
+			chain:   AuthenticatorChain{rejecting, failing},
+			wantErr: connectionRefused,
+		},
+		"banned stops the chain": {
+			chain:   AuthenticatorChain{banned, accepting},
+			wantErr: ErrUserBanned.Is,
+		},
+	}
+	for name, tc := range cases {
+		user, err := tc.chain.AuthenticateUser(context.Background(), "bob", "secret")
+		switch {
+		case tc.wantErr == nil && err != nil:
+			t.Errorf("%s: want user, got %+v", name, err)
+		case tc.wantErr == nil && user.Name != "bob":
+			t.Errorf("%s: unexpected user %+v", name, user)
+		case tc.wantErr != nil && !tc.wantErr(err):
+			t.Errorf("%s: unexpected result %+v, %+v", name, user, err)
+		}
+	}
+}
+
+func TestParseGroupScopes(t *testing.T) {
+	got, err := ParseGroupScopes(" staff:moderator, wheel:admin,wheel:moderator,,team:core:createTopic ")
+	if err != nil {
+		t.Fatalf("cannot parse: %s", err)
+	}
+	want := map[string]UserScope{
+		"staff":     moderatorScope,
+		"wheel":     adminScope | moderatorScope,
+		"team:core": createTopicScope,
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	for _, invalid := range []string{"staff", ":admin", "staff:root"} {
+		if _, err := ParseGroupScopes(invalid); err == nil {
+			t.Errorf("want %q rejected", invalid)
+		}
+	}
+}
+
+func TestGroupScopes(t *testing.T) {
+	mapping := map[string]UserScope{
+		"staff": moderatorScope,
+		"wheel": adminScope | moderatorScope,
+	}
+	granted, managed := groupScopes(mapping, []string{"staff", "users"})
+	if granted != moderatorScope {
+		t.Errorf("want moderator scope granted, got %v", granted.Names())
+	}
+	if managed != adminScope|moderatorScope {
+		t.Errorf("want admin and moderator scopes managed, got %v", managed.Names())
+	}
+}
+
+func TestFirstRDNValue(t *testing.T) {
+	cases := map[string]string{
+		"cn=staff,ou=groups,dc=example,dc=com": "staff",
+		`cn=Smith\, John,ou=people`:            "Smith, John",
+		"cn=admins+gid=10,ou=groups":           "admins",
+		"cn=all":                               "all",
+		"invalid":                              "",
+	}
+	for dn, want := range cases {
+		if got := firstRDNValue(dn); got != want {
+			t.Errorf("%q: want %q, got %q", dn, want, got)
+		}
+	}
+}
+
+func TestLDAPAuthenticator(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	store, err := NewPostgresBBStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities, err := NewPostgresIdentityStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := ldaptest.NewServer(map[string]ldaptest.Entry{
+		"uid=bob,ou=people,dc=example,dc=com": {
+			Password: "secret",
+			Attributes: map[string][]string{
+				"memberOf": {"cn=staff,ou=groups,dc=example,dc=com"},
+			},
+		},
+	})
+	defer func() { srv.Close() }()
+
+	auth := &LDAPAuthenticator{
+		URL:    srv.URL,
+		UserDN: "uid=%s,ou=people,dc=example,dc=com",
+		GroupScopes: map[string]UserScope{
+			"staff": moderatorScope,
+		},
+		Registration: RegistrationOpen,
+		Store:        store,
+		Identities:   identities,
+	}
+
+	if _, err := auth.AuthenticateUser(ctx, "bob", "invalid"); !ErrPermission.Is(err) {
+		t.Fatalf("want ErrPermission, got %+v", err)
+	}
+	if _, err := auth.AuthenticateUser(ctx, "bob", ""); !ErrPermission.Is(err) {
+		t.Fatalf("want ErrPermission for empty password, got %+v", err)
+	}
+
+	// Local user with the same name is a different person.
+	ensureUser(t, db, 999, "bob")
+
+	auth.Registration = RegistrationInvite
+	if _, err := auth.AuthenticateUser(ctx, "bob", "secret"); !ErrRegistrationClosed.Is(err) {
+		t.Fatalf("want ErrRegistrationClosed, got %+v", err)
+	}
+	auth.Registration = RegistrationOpen
+
+	bob, err := auth.AuthenticateUser(ctx, "bob", "secret")
+	if err != nil {
+		t.Fatalf("cannot authenticate: %s", err)
+	}
+	if bob.UserID == 999 || bob.Name != "bob2" {
+		t.Fatalf("want new user, got %+v", bob)
+	}
+	if !bob.Scopes.HasAny(moderatorScope) || !bob.Scopes.HasAny(createCommentScope) {
+		t.Fatalf("want moderator and base scopes, got %v", bob.Scopes.Names())
+	}
+
+	// Existing users sign in regardless of the registration mode.
+	auth.Registration = RegistrationClosed
+	if again, err := auth.AuthenticateUser(ctx, "bob", "secret"); err != nil || again.UserID != bob.UserID {
+		t.Fatalf("want user %d, got %+v, %v", bob.UserID, again, err)
+	}
+	auth.Registration = RegistrationOpen
+
+	// The same entry is found regardless of the login case.
+	if again, err := auth.AuthenticateUser(ctx, "BOB", "secret"); err != nil || again.UserID != bob.UserID {
+		t.Fatalf("want user %d, got %+v, %v", bob.UserID, again, err)
+	}
+
+	// Leaving the group revokes the scope.
+	srv.Close()
+	srv = ldaptest.NewServer(map[string]ldaptest.Entry{
+		"uid=bob,ou=people,dc=example,dc=com": {Password: "secret"},
+	})
+	auth.URL = srv.URL
+	if again, err := auth.AuthenticateUser(ctx, "bob", "secret"); err != nil || again.Scopes.HasAny(moderatorScope) {
+		t.Fatalf("want moderator scope revoked, got %+v, %v", again, err)
+	}
+
+	if err := store.SetUserBanned(ctx, bob.UserID, true); err != nil {
+		t.Fatalf("cannot ban user: %s", err)
+	}
+	if _, err := auth.AuthenticateUser(ctx, "bob", "secret"); !ErrUserBanned.Is(err) {
+		t.Fatalf("want ErrUserBanned, got %+v", err)
+	}
+}
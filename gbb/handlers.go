@@ -1,6 +1,7 @@
 package gbb
 
 import (
+	"context"
 	"fmt"
 	"html/template"
 	"net/http"
@@ -10,10 +11,13 @@ import (
 	"time"
 
 	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/husio/gbb/blob"
 )
 
 func UserDetailsHandler(
 	bbStore BBStore,
+	messages MessageStore,
 	authStore surf.UnboundCacheService,
 	rend surf.HTMLRenderer,
 ) surf.HandlerFunc {
@@ -27,14 +31,37 @@ func UserDetailsHandler(
 			surf.LogError(ctx, err, "cannot authenticate user")
 		}
 
-		switch browsedUser, err := bbStore.UserInfo(ctx, userID); {
+		var blocked bool
+		if currentUser.Authenticated() && currentUser.UserID != userID {
+			if list, err := messages.ListBlockedUsers(ctx, currentUser.UserID); err != nil {
+				surf.LogError(ctx, err, "cannot list blocked users",
+					"user", fmt.Sprint(currentUser.UserID))
+			} else {
+				for _, u := range list {
+					if u.UserID == userID {
+						blocked = true
+						break
+					}
+				}
+			}
+		}
+
+		switch browsedUser, err := bbStore.UserInfo(ctx, userID, currentUser.ViewerID()); {
 		case err == nil:
 			return rend.Response(ctx, http.StatusOK, "user_details.tmpl", struct {
 				User        *UserInfo
 				CurrentUser *User
+				CsrfField   template.HTML
+				CanPenalize bool
+				CanMessage  bool
+				Blocked     bool
 			}{
 				User:        browsedUser,
 				CurrentUser: currentUser,
+				CsrfField:   surf.CsrfField(ctx),
+				CanPenalize: currentUser.Authenticated() && currentUser.Scopes.HasAny(adminScope, moderatorScope),
+				CanMessage:  currentUser.Authenticated() && currentUser.UserID != userID,
+				Blocked:     blocked,
 			})
 		case ErrNotFound.Is(err):
 			return surf.StdResponse(ctx, rend, http.StatusNotFound)
@@ -49,6 +76,8 @@ func UserDetailsHandler(
 func TopicListHandler(
 	bbStore BBStore,
 	readTracker ReadProgressTracker,
+	messages MessageStore,
+	moderation ModerationStore,
 	authStore surf.UnboundCacheService,
 	rend surf.HTMLRenderer,
 ) surf.HandlerFunc {
@@ -59,12 +88,7 @@ func TopicListHandler(
 		*Topic
 		NewContent bool
 		Progress   *ReadProgress
-		Pages      []int
-	}
-
-	lotsOfPages := make([]int, 75)
-	for i := range lotsOfPages {
-		lotsOfPages[i] = i + 1
+		HasPages   bool
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) surf.Response {
@@ -75,27 +99,70 @@ func TopicListHandler(
 			surf.LogError(ctx, err, "cannot authenticate user")
 		}
 
-		createdLte, ok := timeFromParam(r.URL.Query(), "after")
-		if !ok {
-			createdLte = time.Now()
-		}
+		query := r.URL.Query()
+		ranking := TopicRanking(query.Get("order"))
+		period := query.Get("period")
+
+		var (
+			topics        []*Topic
+			nextPageAfter string
+			nextPage      int
+		)
+		switch ranking {
+		case "":
+			createdLte, ok := timeFromParam(query, "after")
+			if !ok {
+				createdLte = time.Now()
+			}
 
-		topics, err := bbStore.ListTopics(ctx, createdLte, postsPerPage)
-		if err != nil {
-			surf.LogError(ctx, err, "cannot fetch topics")
-			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
-		}
+			topics, err = bbStore.ListTopics(ctx, user.ViewerID(), createdLte, postsPerPage)
+			if err != nil {
+				surf.LogError(ctx, err, "cannot fetch topics")
+				return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+			}
 
-		nextPageAfter := ""
-		if len(topics) == postsPerPage {
-			nextPageAfter = topics[len(topics)-1].Created.Format(time.RFC3339)
+			if len(topics) == postsPerPage {
+				nextPageAfter = topics[len(topics)-1].Created.Format(time.RFC3339)
+			}
+		case RankHot, RankTop, RankNew:
+			page, _ := strconv.Atoi(query.Get("page"))
+			if page < 1 {
+				page = 1
+			}
+
+			var activeGte time.Time
+			if ranking == RankTop {
+				switch period {
+				case "day":
+					activeGte = time.Now().Add(-24 * time.Hour)
+				case "week":
+					activeGte = time.Now().Add(-7 * 24 * time.Hour)
+				case "month":
+					activeGte = time.Now().AddDate(0, -1, 0)
+				default:
+					period = "all"
+				}
+			}
+
+			topics, err = bbStore.ListRankedTopics(ctx, user.ViewerID(), ranking, activeGte, (page-1)*postsPerPage, postsPerPage)
+			if err != nil {
+				surf.LogError(ctx, err, "cannot fetch ranked topics",
+					"order", string(ranking))
+				return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+			}
+
+			if len(topics) == postsPerPage {
+				nextPage = page + 1
+			}
+		default:
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
 		}
 
 		trackedTopics := make([]*TrackedTopic, len(topics))
 		for i, t := range topics {
 			trackedTopics[i] = &TrackedTopic{
-				Topic: t,
-				Pages: lotsOfPages[:t.CommentsCount/commentsPerPage+1],
+				Topic:    t,
+				HasPages: t.CommentsCount >= commentsPerPage,
 			}
 		}
 
@@ -119,15 +186,39 @@ func TopicListHandler(
 			}
 		}
 
+		var unreadMessages, resolvedReports int64
+		if user.Authenticated() {
+			if unreadMessages, err = messages.CountUnread(ctx, user.UserID); err != nil {
+				surf.LogError(ctx, err, "cannot count unread messages",
+					"user", fmt.Sprint(user.UserID))
+			}
+			if resolvedReports, err = moderation.CountUnseenResolved(ctx, user.UserID); err != nil {
+				surf.LogError(ctx, err, "cannot count resolved reports",
+					"user", fmt.Sprint(user.UserID))
+			}
+		}
+
 		return rend.Response(ctx, http.StatusOK, "topic_list.tmpl", struct {
 			CurrentUser       *User
+			UnreadMessages    int64
+			ResolvedReports   int64
+			CanModerate       bool
 			Topics            []*TrackedTopic
+			Order             string
+			Period            string
 			NextPageAfter     string
+			NextPage          int
 			CanChangeSettings func(*User) bool
 		}{
-			CurrentUser:   user,
-			Topics:        trackedTopics,
-			NextPageAfter: nextPageAfter,
+			CurrentUser:     user,
+			UnreadMessages:  unreadMessages,
+			ResolvedReports: resolvedReports,
+			CanModerate:     user.Authenticated() && user.Scopes.HasAny(adminScope, moderatorScope),
+			Topics:          trackedTopics,
+			Order:           string(ranking),
+			Period:          period,
+			NextPageAfter:   nextPageAfter,
+			NextPage:        nextPage,
 			CanChangeSettings: func(u *User) bool {
 				return u != nil && u.Scopes.HasAny(adminScope, changeSettingsScope)
 			},
@@ -137,6 +228,12 @@ func TopicListHandler(
 
 func TopicCreateHandler(
 	bbStore BBStore,
+	polls PollStore,
+	references CommentReferenceStore,
+	drafts DraftStore,
+	pending PendingPostStore,
+	guard *PostingGuard,
+	scopeThresholds []ScopeThreshold,
 	authStore surf.UnboundCacheService,
 	rend surf.HTMLRenderer,
 ) surf.HandlerFunc {
@@ -145,15 +242,18 @@ func TopicCreateHandler(
 			Subject  string
 			Content  string
 			Category int64
+			Poll     pollInput
 		}
-		Errors     map[string]string
-		CsrfField  template.HTML
-		Categories []*Category
+		Errors      map[string]string
+		CurrentUser *User
+		CsrfField   template.HTML
+		Categories  []*Category
 	}
 	return func(w http.ResponseWriter, r *http.Request) surf.Response {
 		ctx := r.Context()
 
-		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		boundCache := authStore.Bind(w, r)
+		user, err := CurrentUser(ctx, boundCache)
 		switch {
 		case err == nil:
 			// All good.
@@ -164,6 +264,11 @@ func TopicCreateHandler(
 			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
 		}
 
+		if !user.Scopes.HasAny(adminScope, createTopicScope) {
+			// Scope might have been earned since the user
+			// authenticated.
+			user = refreshUserScopes(ctx, bbStore, scopeThresholds, boundCache, user)
+		}
 		if !user.Scopes.HasAny(adminScope, createTopicScope) {
 			surf.LogInfo(ctx, "user action rejected due to missing topic creation scope",
 				"scopes", user.Scopes.String(),
@@ -181,8 +286,9 @@ func TopicCreateHandler(
 		}
 
 		content := Content{
-			CsrfField:  surf.CsrfField(ctx),
-			Categories: categories,
+			CurrentUser: user,
+			CsrfField:   surf.CsrfField(ctx),
+			Categories:  categories,
 		}
 
 		if r.Method == "POST" {
@@ -215,16 +321,79 @@ func TopicCreateHandler(
 				content.Errors["Categories"] = "Invalid value."
 			}
 
+			content.Input.Poll = readPollInput(r.Form)
+			poll := content.Input.Poll.Poll(content.Errors)
+
 			if len(content.Errors) != 0 {
 				return rend.Response(ctx, http.StatusBadRequest, "topic_create.tmpl", content)
 			}
 
+			if !guard.Allow(r, user) {
+				surf.LogInfo(ctx, "topic creation rate limited",
+					"user", fmt.Sprint(user.UserID))
+				return rend.Response(ctx, http.StatusTooManyRequests, "error_4xx.tmpl",
+					"You are creating topics too fast. Try again later.")
+			}
+
+			if reason := guard.HoldReason(ctx, bbStore, user, content.Input.Subject+"\n"+content.Input.Content); reason != "" {
+				post := PendingPost{
+					Subject:  content.Input.Subject,
+					Category: content.Input.Category,
+					Poll:     poll,
+					Content:  content.Input.Content,
+					Author:   *user,
+					Reason:   reason,
+				}
+				if _, err := pending.HoldPost(ctx, post); err != nil {
+					surf.LogError(ctx, err, "cannot hold topic")
+					return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+				}
+				surf.LogInfo(ctx, "topic held for approval",
+					"user", fmt.Sprint(user.UserID),
+					"reason", reason)
+				discardDraft(r, drafts, user.UserID, 0)
+				return rend.Response(ctx, http.StatusAccepted, "post_pending.tmpl", struct {
+					Topic *Topic
+				}{})
+			}
+
 			topic, comment, err := bbStore.CreateTopic(ctx, content.Input.Subject, content.Input.Content, content.Input.Category, user.UserID)
-			if err != nil {
+			switch {
+			case err == nil:
+				// All good.
+			case ErrUserBanned.Is(err):
+				return rend.Response(ctx, http.StatusOK, "error_scope.tmpl", struct {
+					Message string
+				}{
+					Message: "Your account is banned.",
+				})
+			default:
 				surf.LogError(ctx, err, "cannot create topic")
 				return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
 			}
 
+			if poll != nil {
+				poll.TopicID = topic.TopicID
+				if _, err := polls.CreatePoll(ctx, *poll); err != nil {
+					surf.LogError(ctx, err, "cannot create poll",
+						"topic", fmt.Sprint(topic.TopicID))
+					// Do not leave the topic without the poll
+					// it was created with.
+					if err := bbStore.DeleteTopic(ctx, topic.TopicID); err != nil {
+						surf.LogError(ctx, err, "cannot delete topic",
+							"topic", fmt.Sprint(topic.TopicID))
+					}
+					return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+				}
+			}
+
+			if err := references.SetReferences(ctx, comment.CommentID, commentReferences(comment.Content)); err != nil {
+				surf.LogError(ctx, err, "cannot set comment references",
+					"comment", fmt.Sprint(comment.CommentID))
+			}
+
+			discardDraft(r, drafts, user.UserID, 0)
+
 			url := fmt.Sprintf("/t/%d/%s/#comment-%d",
 				topic.TopicID,
 				topic.SlugInfo(),
@@ -233,6 +402,17 @@ func TopicCreateHandler(
 			return surf.Redirect(url, http.StatusSeeOther)
 		}
 
+		switch draft, err := drafts.Draft(ctx, user.UserID, 0); {
+		case err == nil:
+			content.Input.Subject = draft.Subject
+			content.Input.Content = draft.Content
+		case ErrDraftNotFound.Is(err):
+			// Nothing to restore.
+		default:
+			surf.LogError(ctx, err, "cannot get topic draft",
+				"user", fmt.Sprint(user.UserID))
+		}
+
 		return rend.Response(ctx, http.StatusOK, "topic_create.tmpl", content)
 	}
 }
@@ -249,6 +429,13 @@ func containsCategory(categories []*Category, categoryID int64) bool {
 func CommentListHandler(
 	bbStore BBStore,
 	readTracker ReadProgressTracker,
+	views *ViewCounter,
+	polls PollStore,
+	reactions ReactionStore,
+	reactionKinds []string,
+	attachments AttachmentStore,
+	references CommentReferenceStore,
+	drafts DraftStore,
 	authStore surf.UnboundCacheService,
 	rend surf.HTMLRenderer,
 ) surf.HandlerFunc {
@@ -258,8 +445,19 @@ func CommentListHandler(
 		CsrfField   template.HTML
 		Topic       *Topic
 		Comments    []*Comment
-		Pagination  *surf.Paginator
+		Pagination  *commentsPagination
 		CanModify   func(*Comment) bool
+		CanAccept   func(*Comment) bool
+		Reactions   func(*Comment) []*reactionButton
+		Attachments func(*Comment) []*Attachment
+		Replies     func(*Comment) []*Reply
+		Poll        *Poll
+		// Draft is the initial content of the comment form. It is
+		// the restored draft followed by the quoted comment.
+		Draft string
+		// CanModerate is true if the current user can lock the topic
+		// and comment in a locked topic.
+		CanModerate bool
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) surf.Response {
@@ -274,11 +472,10 @@ func CommentListHandler(
 		surf.LogInfo(ctx, "current user fetched",
 			"user", fmt.Sprint(user))
 
-		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
-		if page < 1 {
-			page = 1
+		cursor, ok := cursorFromQuery(r.URL.Query())
+		if !ok {
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
 		}
-		offset := (page - 1) * commentsPerPage
 
 		topic, err := bbStore.TopicByID(ctx, topicID)
 		switch {
@@ -292,22 +489,51 @@ func CommentListHandler(
 				"topicID", fmt.Sprint(topicID))
 			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
 		}
+		// Hidden topic does not exist for anyone but its author and
+		// moderators.
+		if topic.Hidden && topic.Author.UserID != user.ViewerID() {
+			if !user.Authenticated() || !user.Scopes.HasAny(adminScope, moderatorScope) {
+				return surf.StdResponse(ctx, rend, http.StatusNotFound)
+			}
+		}
 
-		comments, err := bbStore.ListComments(ctx, topicID, offset, commentsPerPage)
+		// Fetch one more comment than displayed to know if there is
+		// another page in the direction of the cursor.
+		comments, err := bbStore.ListComments(ctx, topicID, user.ViewerID(), cursor, commentsPerPage+1)
 		if err != nil {
 			surf.LogError(ctx, err, "cannot fetch comments",
 				"topicID", fmt.Sprint(topicID))
 			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
 		}
 
+		pagination := commentsPagination{
+			Current: cursor,
+		}
+		if cursor.Backward {
+			if len(comments) > commentsPerPage {
+				comments = comments[1:]
+				pagination.HasPrev = true
+			}
+			// Next page begins with the comment cursor is pointing to.
+			pagination.HasNext = !cursor.IsZero()
+			pagination.Next = CommentCursor{Created: cursor.Created, CommentID: cursor.CommentID}
+		} else {
+			if len(comments) > commentsPerPage {
+				pagination.HasNext = true
+				pagination.Next = comments[commentsPerPage].Cursor()
+				comments = comments[:commentsPerPage]
+			}
+			pagination.HasPrev = !cursor.IsZero()
+		}
+		if len(comments) > 0 {
+			pagination.Prev = comments[0].Cursor()
+		}
+
 		surf.LogInfo(ctx, "listing comments",
 			"topic.id", fmt.Sprint(topic.TopicID),
 			"topic.subject", topic.Subject)
 
-		if err := bbStore.IncrementTopicView(ctx, topicID); err != nil {
-			surf.LogError(ctx, err, "cannot increment view counter",
-				"topicID", fmt.Sprint(topic.TopicID))
-		}
+		views.View(r, topic, user)
 
 		if user.Authenticated() && len(comments) > 0 {
 			lastComment := comments[len(comments)-1]
@@ -325,6 +551,83 @@ func CommentListHandler(
 			}
 		}
 
+		// The first comment is the topic content and cannot be an
+		// answer.
+		var firstCommentID int64
+		if !pagination.HasPrev && len(comments) > 0 {
+			firstCommentID = comments[0].CommentID
+		}
+
+		// Poll is displayed above the first comment.
+		var poll *Poll
+		if firstCommentID != 0 {
+			var userID int64
+			if user.Authenticated() {
+				userID = user.UserID
+			}
+			switch p, err := polls.PollByTopic(ctx, topic.TopicID, userID); {
+			case err == nil:
+				poll = p
+			case ErrNotFound.Is(err):
+				// Most topics have no poll.
+			default:
+				surf.LogError(ctx, err, "cannot fetch poll",
+					"topic", fmt.Sprint(topic.TopicID))
+			}
+		}
+
+		commentIDs := make([]int64, len(comments))
+		for i, c := range comments {
+			commentIDs[i] = c.CommentID
+		}
+		commentReactions, err := reactions.ListReactions(ctx, commentIDs)
+		if err != nil {
+			// Reactions are not essential, display the comments anyway.
+			surf.LogError(ctx, err, "cannot fetch reactions",
+				"topic", fmt.Sprint(topic.TopicID))
+		}
+		commentAttachments, err := attachments.ListAttachments(ctx, commentIDs)
+		if err != nil {
+			surf.LogError(ctx, err, "cannot fetch attachments",
+				"topic", fmt.Sprint(topic.TopicID))
+		}
+		replies, err := references.ListReplies(ctx, user.ViewerID(), commentIDs)
+		if err != nil {
+			surf.LogError(ctx, err, "cannot fetch replies",
+				"topic", fmt.Sprint(topic.TopicID))
+		}
+
+		var draft string
+		if user.Authenticated() && !pagination.HasNext {
+			switch d, err := drafts.Draft(ctx, user.UserID, topic.TopicID); {
+			case err == nil:
+				draft = d.Content
+			case ErrDraftNotFound.Is(err):
+				// Nothing to restore.
+			default:
+				surf.LogError(ctx, err, "cannot get comment draft",
+					"user", fmt.Sprint(user.UserID),
+					"topic", fmt.Sprint(topic.TopicID))
+			}
+		}
+
+		if quoteID, _ := strconv.ParseInt(r.URL.Query().Get("quote"), 10, 64); quoteID > 0 && user.Authenticated() {
+			switch _, quoted, _, err := bbStore.CommentByID(ctx, quoteID); {
+			case err == nil:
+				if quoted.TopicID == topic.TopicID && canViewComment(user, quoted) {
+					if draft != "" {
+						draft += "\n\n"
+					}
+					draft += quoteComment(quoted)
+				}
+			case ErrNotFound.Is(err):
+				// Comment was deleted in the meantime.
+			default:
+				surf.LogError(ctx, err, "cannot fetch quoted comment",
+					"comment", fmt.Sprint(quoteID))
+			}
+		}
+
 		return rend.Response(ctx, http.StatusOK, "comment_list.tmpl", Content{
 			CurrentUser: user,
 			CsrfField:   surf.CsrfField(ctx),
@@ -339,17 +642,75 @@ func CommentListHandler(
 				}
 				return user.Scopes.HasAny(adminScope, moderatorScope)
 			},
-			Pagination: &surf.Paginator{
-				Total:    topic.CommentsCount,
-				PageSize: commentsPerPage,
-				Page:     page,
+			CanAccept: func(comment *Comment) bool {
+				if comment.CommentID == firstCommentID {
+					return false
+				}
+				return canAcceptComment(user, topic)
+			},
+			Reactions: func(comment *Comment) []*reactionButton {
+				return reactionButtons(reactionKinds, commentReactions[comment.CommentID], user)
+			},
+			Attachments: func(comment *Comment) []*Attachment {
+				return commentAttachments[comment.CommentID]
+			},
+			Replies: func(comment *Comment) []*Reply {
+				return replies[comment.CommentID]
 			},
+			Pagination:  &pagination,
+			Poll:        poll,
+			Draft:       draft,
+			CanModerate: user.Authenticated() && user.Scopes.HasAny(adminScope, moderatorScope),
 		})
 	}
 }
 
 const commentsPerPage = 100
 
+// commentsPagination provides cursors for the pages surrounding the current
+// one. Previous page ends right before the first displayed comment and the
+// next page begins right after the last displayed comment.
+type commentsPagination struct {
+	Current CommentCursor
+	Prev    CommentCursor
+	Next    CommentCursor
+	HasPrev bool
+	HasNext bool
+}
+
+// cursorFromQuery returns comment cursor as described by the URL query. False
+// is returned if the query contains an invalid cursor.
+func cursorFromQuery(query url.Values) (CommentCursor, bool) {
+	if raw := query.Get("from"); raw != "" {
+		c, err := ParseCommentCursor(raw)
+		return c, err == nil
+	}
+	if raw := query.Get("before"); raw != "" {
+		c, err := ParseCommentCursor(raw)
+		c.Backward = true
+		return c, err == nil
+	}
+	if query.Get("page") == "last" {
+		return CommentCursor{Backward: true}, true
+	}
+	return CommentCursor{}, true
+}
+
+// commentURL returns URL of the topic page that begins with given comment.
+func commentURL(topic *Topic, comment *Comment) string {
+	return fmt.Sprintf("/t/%d/%s/?from=%s#comment-%d",
+		topic.TopicID,
+		topic.SlugInfo(),
+		comment.Cursor(),
+		comment.CommentID)
+}
+
+// lastCommentURL returns URL of the last page of the topic, pointing to given
+// anchor.
+func lastCommentURL(topic *Topic, anchor string) string {
+	return fmt.Sprintf("/t/%d/%s/?page=last#%s", topic.TopicID, topic.SlugInfo(), anchor)
+}
+
 func LastCommentHandler(
 	bbStore BBStore,
 	readTracker ReadProgressTracker,
@@ -372,13 +733,7 @@ func LastCommentHandler(
 			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
 		}
 
-		var url string
-		if page := int(topic.CommentsCount / commentsPerPage); page < 2 {
-			url = fmt.Sprintf("/t/%d/%s/#bottom", topic.TopicID, topic.SlugInfo())
-		} else {
-			url = fmt.Sprintf("/t/%d/%s/?page=%d#bottom", topic.TopicID, topic.SlugInfo(), page+1)
-		}
-		return surf.Redirect(url, http.StatusSeeOther)
+		return surf.Redirect(lastCommentURL(topic, "bottom"), http.StatusSeeOther)
 	}
 }
 
@@ -414,23 +769,13 @@ func LastSeenCommentHandler(
 				surf.LogError(ctx, err, "cannot get last reads",
 					"topic", fmt.Sprint(topic.TopicID),
 					"user", fmt.Sprint(user.UserID))
-			} else if len(results) == 1 {
-				p := results[topic.TopicID]
-
-				_, _, position, err := bbStore.CommentByID(ctx, p.CommentID)
-				if err != nil {
-					surf.LogError(ctx, err, "cannot fetch comment",
-						"comment", fmt.Sprint(p.CommentID))
-					url := fmt.Sprintf("/t/%d/%s/", topic.TopicID, topic.SlugInfo())
-					return surf.Redirect(url, http.StatusSeeOther)
-				}
-
-				var url string
-				if position < commentsPerPage {
-					url = fmt.Sprintf("/t/%d/%s/#comment-%d", topic.TopicID, topic.SlugInfo(), p.CommentID)
-				} else {
-					page := (position / commentsPerPage) + 1
-					url = fmt.Sprintf("/t/%d/%s/?page=%d#comment-%d", topic.TopicID, topic.SlugInfo(), page, p.CommentID)
+			} else if p, ok := results[topic.TopicID]; ok {
+				// Progress is pointing at the last read comment,
+				// so no lookup is necessary to find the right page.
+				cursor := CommentCursor{Created: p.CommentCreated, CommentID: p.CommentID}
+				url := fmt.Sprintf("/t/%d/%s/?from=%s", topic.TopicID, topic.SlugInfo(), cursor)
+				if p.CommentID != 0 {
+					url += fmt.Sprintf("#comment-%d", p.CommentID)
 				}
 				return surf.Redirect(url, http.StatusSeeOther)
 			} else {
@@ -440,28 +785,30 @@ func LastSeenCommentHandler(
 			}
 		}
 
-		var url string
-		if page := int(topic.CommentsCount / commentsPerPage); page < 2 {
-			url = fmt.Sprintf("/t/%d/%s/#bottom", topic.TopicID, topic.SlugInfo())
-		} else {
-			url = fmt.Sprintf("/t/%d/%s/?page=%d#bottom", topic.TopicID, topic.SlugInfo(), page+1)
-		}
-		return surf.Redirect(url, http.StatusSeeOther)
+		return surf.Redirect(lastCommentURL(topic, "bottom"), http.StatusSeeOther)
 	}
 }
 
 func GotoCommentHandler(
 	bbStore BBStore,
+	authStore surf.UnboundCacheService,
 	rend surf.HTMLRenderer,
 ) surf.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) surf.Response {
 		ctx := r.Context()
 		commentID := surf.PathArgInt64(r, 0)
 
-		topic, comment, position, err := bbStore.CommentByID(ctx, commentID)
+		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		if err != nil && !ErrUnauthenticated.Is(err) {
+			surf.LogError(ctx, err, "cannot authenticate user")
+		}
+
+		topic, comment, _, err := bbStore.CommentByID(ctx, commentID)
 		switch {
 		case err == nil:
-			// All good.
+			if !canViewComment(user, comment) {
+				return surf.StdResponse(ctx, rend, http.StatusNotFound)
+			}
 		case ErrNotFound.Is(err):
 			return surf.StdResponse(ctx, rend, http.StatusNotFound)
 		default:
@@ -470,33 +817,50 @@ func GotoCommentHandler(
 			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
 		}
 
-		var url string
-		if position < commentsPerPage {
-			url = fmt.Sprintf("/t/%d/%s/#comment-%d", topic.TopicID, topic.SlugInfo(), comment.CommentID)
-		} else {
-			page := (position / commentsPerPage) + 1
-			url = fmt.Sprintf("/t/%d/%s/?page=%d#comment-%d", topic.TopicID, topic.SlugInfo(), page+1, comment.CommentID)
-		}
-		return surf.Redirect(url, http.StatusSeeOther)
+		return surf.Redirect(commentURL(topic, comment), http.StatusSeeOther)
+	}
+}
+
+// canViewComment returns true if given user can see the comment. Hidden
+// comments are visible only to their author and to moderators.
+func canViewComment(user *User, comment *Comment) bool {
+	if !comment.Hidden {
+		return true
+	}
+	if !user.Authenticated() {
+		return false
 	}
+	return comment.Author.UserID == user.UserID || user.Scopes.HasAny(adminScope, moderatorScope)
 }
 
 func CommentCreateHandler(
 	bbStore BBStore,
+	attachments AttachmentStore,
+	blobs blob.Store,
+	attachmentLimits AttachmentLimits,
+	references CommentReferenceStore,
+	drafts DraftStore,
+	pending PendingPostStore,
+	guard *PostingGuard,
+	scopeThresholds []ScopeThreshold,
 	authStore surf.UnboundCacheService,
 	rend surf.HTMLRenderer,
 ) surf.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) surf.Response {
 		ctx := r.Context()
 
+		r.Body = http.MaxBytesReader(w, r.Body, attachmentLimits.requestSize())
 		if err := r.ParseMultipartForm(1e6); err != nil {
-			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+			return rend.Response(ctx, http.StatusBadRequest, "error_4xx.tmpl",
+				"Cannot read the comment. Attached files might be too big.")
 		}
+		defer r.MultipartForm.RemoveAll()
 
 		topicID := surf.PathArgInt64(r, 0)
 		content := strings.TrimSpace(r.Form.Get("content"))
 
-		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		boundCache := authStore.Bind(w, r)
+		user, err := CurrentUser(ctx, boundCache)
 		switch {
 		case err == nil:
 			// All good.
@@ -507,19 +871,24 @@ func CommentCreateHandler(
 			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
 		}
 
-		if !user.Scopes.HasAny(adminScope, createCommentScope) {
-			surf.LogInfo(ctx, "user action rejected due to missing comment creation scope",
-				"scopes", user.Scopes.String(),
+		if resp := rejectUnlessCanComment(ctx, bbStore, rend, user, "Not allowed to comment."); resp != nil {
+			return resp
+		}
+
+		if !guard.Allow(r, user) {
+			surf.LogInfo(ctx, "comment rate limited",
 				"user", fmt.Sprint(user.UserID))
-			return rend.Response(ctx, http.StatusOK, "error_scope.tmpl", struct {
-				Message string
-			}{
-				Message: "Not allowed to comment.",
-			})
+			return rend.Response(ctx, http.StatusTooManyRequests, "error_4xx.tmpl",
+				"You are posting too fast. Try again later.")
 		}
 
 		// TODO: validate input
 
+		files, err := attachmentFiles(r.MultipartForm, attachmentLimits)
+		if msg, ok := err.(attachmentRejectedError); ok {
+			return rend.Response(ctx, http.StatusBadRequest, "error_4xx.tmpl", string(msg))
+		}
+
 		topic, err := bbStore.TopicByID(ctx, topicID)
 		switch {
 		case err == nil:
@@ -532,12 +901,67 @@ func CommentCreateHandler(
 			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
 		}
 
+		if topic.Locked && !user.Scopes.HasAny(adminScope, moderatorScope) {
+			return rend.Response(ctx, http.StatusOK, "error_scope.tmpl", struct {
+				Message string
+			}{
+				Message: "Topic is locked.",
+			})
+		}
+
+		// Attachments are stored before the comment is created. If
+		// anything fails later, they are orphaned and removed by the
+		// cleanup process.
+		var attachmentIDs []int64
+		for _, fh := range files {
+			a, err := storeAttachment(ctx, attachments, blobs, attachmentLimits, user.UserID, fh)
+			if msg, ok := err.(attachmentRejectedError); ok {
+				return rend.Response(ctx, http.StatusBadRequest, "error_4xx.tmpl", string(msg))
+			} else if err != nil {
+				surf.LogError(ctx, err, "cannot store attachment",
+					"topic", fmt.Sprint(topicID))
+				return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+			}
+			attachmentIDs = append(attachmentIDs, a.AttachmentID)
+		}
+
+		if reason := guard.HoldReason(ctx, bbStore, user, content); reason != "" {
+			post := PendingPost{
+				TopicID:       topicID,
+				Content:       content,
+				AttachmentIDs: attachmentIDs,
+				Author:        *user,
+				Reason:        reason,
+			}
+			if _, err := pending.HoldPost(ctx, post); err != nil {
+				surf.LogError(ctx, err, "cannot hold comment",
+					"topic", fmt.Sprint(topicID))
+				return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+			}
+			surf.LogInfo(ctx, "comment held for approval",
+				"topic", fmt.Sprint(topicID),
+				"user", fmt.Sprint(user.UserID),
+				"reason", reason)
+			discardDraft(r, drafts, user.UserID, topicID)
+			return rend.Response(ctx, http.StatusAccepted, "post_pending.tmpl", struct {
+				Topic *Topic
+			}{
+				Topic: topic,
+			})
+		}
+
 		comment, err := bbStore.CreateComment(ctx, topicID, content, user.UserID)
 		switch {
 		case err == nil:
 			// All good.
 		case ErrNotFound.Is(err):
 			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		case ErrUserBanned.Is(err):
+			return rend.Response(ctx, http.StatusOK, "error_scope.tmpl", struct {
+				Message string
+			}{
+				Message: "Your account is banned.",
+			})
 		default:
 			surf.LogError(ctx, err, "cannot create comment",
 				"content", content,
@@ -545,27 +969,78 @@ func CommentCreateHandler(
 			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
 		}
 
-		var url string
-		if page := int(topic.CommentsCount / commentsPerPage); page < 2 {
-			url = fmt.Sprintf("/t/%d/%s/#comment-%d",
-				topic.TopicID,
-				topic.SlugInfo(),
-				comment.CommentID)
-		} else {
-			url = fmt.Sprintf("/t/%d/%s/?page=%d#comment-%d",
-				topic.TopicID,
-				topic.SlugInfo(),
-				page+1,
-				comment.CommentID)
+		if err := attachments.AttachToComment(ctx, comment.CommentID, attachmentIDs); err != nil {
+			surf.LogError(ctx, err, "cannot attach files to comment",
+				"comment", fmt.Sprint(comment.CommentID))
+		}
+		if err := references.SetReferences(ctx, comment.CommentID, commentReferences(content)); err != nil {
+			surf.LogError(ctx, err, "cannot set comment references",
+				"comment", fmt.Sprint(comment.CommentID))
 		}
+		discardDraft(r, drafts, user.UserID, topicID)
+
+		refreshUserScopes(ctx, bbStore, scopeThresholds, boundCache, user)
 
+		url := lastCommentURL(topic, fmt.Sprintf("comment-%d", comment.CommentID))
 		return surf.Redirect(url, http.StatusSeeOther)
 	}
 }
 
+// checkCanComment returns ErrPermission if given user is not allowed to
+// comment and ErrUserBanned if the user account is banned. The same check
+// applies to editing, reacting and voting, which all add user content.
+func checkCanComment(ctx context.Context, bbStore BBStore, user *User) error {
+	if !user.Scopes.HasAny(adminScope, createCommentScope) {
+		return errors.Wrap(ErrPermission, "missing comment creation scope")
+	}
+	// Ban is not part of the session, so that it is effective immediately.
+	info, err := bbStore.UserInfo(ctx, user.UserID, 0)
+	if err != nil {
+		return errors.Wrap(err, "cannot get user")
+	}
+	if info.Banned {
+		return ErrUserBanned
+	}
+	return nil
+}
+
+// rejectUnlessCanComment returns the response explaining why given user
+// cannot add content, or nil if the user can. Message describes the rejected
+// action.
+func rejectUnlessCanComment(ctx context.Context, bbStore BBStore, rend surf.HTMLRenderer, user *User, message string) surf.Response {
+	switch err := checkCanComment(ctx, bbStore, user); {
+	case err == nil:
+		return nil
+	case ErrUserBanned.Is(err):
+		return rend.Response(ctx, http.StatusOK, "error_scope.tmpl", struct {
+			Message string
+		}{
+			Message: "Your account is banned.",
+		})
+	case ErrPermission.Is(err):
+		surf.LogInfo(ctx, "user action rejected due to missing comment creation scope",
+			"scopes", user.Scopes.String(),
+			"user", fmt.Sprint(user.UserID))
+		return rend.Response(ctx, http.StatusOK, "error_scope.tmpl", struct {
+			Message string
+		}{
+			Message: message,
+		})
+	default:
+		surf.LogError(ctx, err, "cannot check comment permission",
+			"user", fmt.Sprint(user.UserID))
+		return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+	}
+}
+
 func LoginHandler(
 	authStore surf.UnboundCacheService,
 	bbStore BBStore,
+	authenticator Authenticator,
+	twoFactor TwoFactorStore,
+	identities IdentityStore,
+	sso *SingleSignOn,
+	scopeThresholds []ScopeThreshold,
 	rend surf.HTMLRenderer,
 ) surf.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) surf.Response {
@@ -575,23 +1050,42 @@ func LoginHandler(
 
 		var errors []string
 
-		if r.Method == "POST" {
+		localDisabled := localLoginDisabled(ctx, sso, identities)
+
+		if r.Method == "POST" && localDisabled {
+			errors = append(errors, "Password login is disabled.")
+		} else if r.Method == "POST" {
 			login := r.FormValue("login")
 			passwd := r.FormValue("password")
 
-			switch user, err := bbStore.AuthenticateUser(ctx, login, passwd); {
+			switch user, err := authenticator.AuthenticateUser(ctx, login, passwd); {
 			case err == nil:
-				if err := Login(ctx, boundCache, *user); err != nil {
-					surf.LogError(ctx, err, "cannot login user",
+				if unlocked, err := unlockScopes(ctx, bbStore, scopeThresholds, user); err != nil {
+					surf.LogError(ctx, err, "cannot unlock scopes",
+						"login", login)
+				} else {
+					user = unlocked
+				}
+				next := r.FormValue("next")
+				if next == "" {
+					next = "/"
+				}
+
+				if next, err := beginSession(ctx, boundCache, twoFactor, *user, next); err != nil {
+					surf.LogError(ctx, err, "cannot begin session",
 						"login", login)
 					errors = append(errors, "Temporary issues. Please try again later.")
 				} else {
-					next := r.FormValue("next")
-					if next == "" {
-						next = "/"
-					}
 					return surf.Redirect(next, http.StatusSeeOther)
 				}
+			case ErrUserBanned.Is(err):
+				surf.LogInfo(ctx, "banned user authentication attempt",
+					"login", login)
+				errors = append(errors, "This account is banned.")
+			case ErrRegistrationClosed.Is(err):
+				surf.LogInfo(ctx, "sign in of unknown external user rejected by registration mode",
+					"login", login)
+				errors = append(errors, "There is no account for this login and registration is closed.")
 			case ErrNotFound.Is(err), ErrPermission.Is(err):
 				surf.LogInfo(ctx, "failed authentication attempt",
 					"login", login)
@@ -615,16 +1109,25 @@ func LoginHandler(
 			code = http.StatusBadRequest
 		}
 
+		var ssoName string
+		if sso != nil {
+			ssoName = sso.Name
+		}
+
 		return rend.Response(ctx, code, "login.tmpl", struct {
-			Errors    []string
-			User      *User
-			Next      string
-			CsrfField template.HTML
+			Errors             []string
+			User               *User
+			Next               string
+			CsrfField          template.HTML
+			SingleSignOn       string
+			LocalLoginDisabled bool
 		}{
-			Errors:    errors,
-			User:      user,
-			Next:      r.URL.Query().Get("next"),
-			CsrfField: surf.CsrfField(ctx),
+			Errors:             errors,
+			User:               user,
+			Next:               r.URL.Query().Get("next"),
+			CsrfField:          surf.CsrfField(ctx),
+			SingleSignOn:       ssoName,
+			LocalLoginDisabled: localDisabled,
 		})
 	}
 }
@@ -663,11 +1166,20 @@ func LogoutHandler(
 func RegisterHandler(
 	authStore surf.UnboundCacheService,
 	bbStore BBStore,
+	identities IdentityStore,
+	invites InviteStore,
+	accounts AccountStore,
+	twoFactor TwoFactorStore,
+	sso *SingleSignOn,
+	registration RegistrationMode,
+	registrationLimit *RateLimiter,
+	scopeThresholds []ScopeThreshold,
 	rend surf.HTMLRenderer,
 ) surf.HandlerFunc {
 	type Context struct {
 		Next      string
 		Login     string
+		Invite    string
 		CsrfField template.HTML
 		Errors    map[string]string
 	}
@@ -681,15 +1193,45 @@ func RegisterHandler(
 			return rend.Response(ctx, http.StatusBadRequest, "error_4xx.tmpl", "Already logged in")
 		}
 
+		// Accounts are created on the first sign in with the
+		// identity provider instead.
+		if localLoginDisabled(ctx, sso, identities) {
+			return surf.Redirect(loginURL(r.FormValue("next")), http.StatusSeeOther)
+		}
+
+		if registration == RegistrationClosed {
+			return rend.Response(ctx, http.StatusForbidden, "error_4xx.tmpl", "Registration is closed.")
+		}
+
+		// Invite is optional in the open mode, but it still grants
+		// its scopes.
+		token := r.FormValue("invite")
+		var invite *Invite
+		if token != "" || registration == RegistrationInvite {
+			switch inv, err := invites.InviteByToken(ctx, token); {
+			case err == nil && inv.Usable(time.Now()):
+				invite = inv
+			case token == "":
+				return rend.Response(ctx, http.StatusForbidden, "error_4xx.tmpl", "Registration is by invitation only.")
+			case err == nil, ErrInviteNotFound.Is(err):
+				return rend.Response(ctx, http.StatusForbidden, "error_4xx.tmpl", "This invitation is not valid or has expired.")
+			default:
+				surf.LogError(ctx, err, "cannot get invite")
+				return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+			}
+		}
+
 		if r.Method == "GET" {
 			return rend.Response(ctx, http.StatusOK, "register.tmpl", Context{
 				CsrfField: surf.CsrfField(ctx),
 				Next:      r.URL.Query().Get("next"),
+				Invite:    token,
 			})
 		}
 
 		context := Context{
 			Next:      r.FormValue("next"),
+			Invite:    token,
 			CsrfField: surf.CsrfField(ctx),
 			Errors:    make(map[string]string),
 		}
@@ -716,24 +1258,58 @@ func RegisterHandler(
 			return rend.Response(ctx, http.StatusBadRequest, "register.tmpl", context)
 		}
 
-		baseScopes := createTopicScope.Add(createCommentScope)
-		switch user, err := bbStore.RegisterUser(ctx, password, User{Name: context.Login, Scopes: baseScopes}); {
+		if !registrationLimit.Allow("ip:" + remoteIP(r)) {
+			surf.LogInfo(ctx, "registration rate limited",
+				"ip", remoteIP(r))
+			context.Errors["Login"] = "Too many accounts were registered from your network. Try again later."
+			return rend.Response(ctx, http.StatusTooManyRequests, "register.tmpl", context)
+		}
+
+		// Scopes that do not require any activity are granted right
+		// away.
+		scopes := createCommentScope.Add((&UserInfo{}).EarnedScopes(scopeThresholds))
+		baseScopes := scopes
+		if invite != nil {
+			scopes = scopes.Add(invite.Scopes)
+		}
+
+		switch user, err := bbStore.RegisterUser(ctx, password, User{Name: context.Login, Scopes: scopes}); {
 		case err == nil:
 			surf.LogInfo(ctx, "new user registered",
 				"name", user.Name,
 				"id", fmt.Sprint(user.UserID))
-			if err := Login(ctx, boundCache, *user); err != nil {
-				surf.LogError(ctx, err, "cannot login user",
+			// Invite is redeemed only once the account exists, so
+			// that a failed registration does not use it up.
+			if invite != nil {
+				if err := redeemInvite(ctx, bbStore, invites, token, user, baseScopes); err != nil && registration == RegistrationInvite {
+					// Concurrent registrations can pass the
+					// invite check, but only the one that
+					// redeemed it keeps the account.
+					if err := accounts.DeleteAccount(ctx, user.UserID, DeletionRemove); err != nil {
+						surf.LogError(ctx, err, "cannot delete user registered without invite",
+							"id", fmt.Sprint(user.UserID))
+						return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+					}
+					if ErrInviteNotFound.Is(err) {
+						return rend.Response(ctx, http.StatusForbidden, "error_4xx.tmpl", "This invitation is not valid or has expired.")
+					}
+					return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+				}
+			}
+			next := context.Next
+			if next == "" {
+				next = "/"
+			}
+			// Privileged scopes granted by the invite may require
+			// two-factor authentication.
+			next, err = beginSession(ctx, boundCache, twoFactor, *user, next)
+			if err != nil {
+				surf.LogError(ctx, err, "cannot begin session",
 					"id", fmt.Sprint(user.UserID),
 					"name", user.Name)
 				return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
-			} else {
-				next := context.Next
-				if next == "" {
-					next = "/"
-				}
-				return surf.Redirect(next, http.StatusSeeOther)
 			}
+			return surf.Redirect(next, http.StatusSeeOther)
 		case ErrConstraint.Is(err):
 			context.Errors["Login"] = "Login already in use"
 			return rend.Response(ctx, http.StatusBadRequest, "register.tmpl", context)
@@ -744,6 +1320,43 @@ func RegisterHandler(
 	}
 }
 
+// redeemInvite uses the invite the user registered with. If the invite cannot
+// be redeemed, for example because it was used up by a concurrent
+// registration, the scopes granted by it are revoked and the error is
+// returned.
+func redeemInvite(
+	ctx context.Context,
+	bbStore BBStore,
+	invites InviteStore,
+	token string,
+	user *User,
+	baseScopes UserScope,
+) error {
+	inv, err := invites.RedeemInvite(ctx, token)
+	switch {
+	case err == nil:
+		if err := invites.AddInvitee(ctx, inv.InviteID, user.UserID); err != nil {
+			surf.LogError(ctx, err, "cannot add invitee",
+				"invite", fmt.Sprint(inv.InviteID),
+				"id", fmt.Sprint(user.UserID))
+		}
+		return nil
+	case ErrInviteNotFound.Is(err):
+		surf.LogInfo(ctx, "invite used up during registration",
+			"id", fmt.Sprint(user.UserID))
+	default:
+		surf.LogError(ctx, err, "cannot redeem invite",
+			"id", fmt.Sprint(user.UserID))
+	}
+	granted := user.Scopes.Remove(baseScopes)
+	user.Scopes = baseScopes
+	if err := bbStore.RevokeScopes(ctx, user.UserID, granted); err != nil {
+		surf.LogError(ctx, err, "cannot revoke invite scopes",
+			"id", fmt.Sprint(user.UserID))
+	}
+	return err
+}
+
 func timeFromParam(query url.Values, name string) (time.Time, bool) {
 	val := query.Get(name)
 	if val == "" {
@@ -767,6 +1380,7 @@ var timeFormats = []string{
 
 func SearchHandler(
 	bbstore BBStore,
+	authStore surf.UnboundCacheService,
 	rend surf.HTMLRenderer,
 ) surf.HandlerFunc {
 	const searchResultLimit = 30
@@ -775,6 +1389,11 @@ func SearchHandler(
 		ctx := r.Context()
 		query := r.URL.Query()
 
+		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		if err != nil && !ErrUnauthenticated.Is(err) {
+			surf.LogError(ctx, err, "cannot authenticate user")
+		}
+
 		categories, err := bbstore.ListCategories(ctx)
 		if err != nil {
 			surf.LogError(ctx, err, "cannot list categories")
@@ -808,7 +1427,7 @@ func SearchHandler(
 			}
 			content.SearchCategories = searchCategories
 
-			results, err := bbstore.Search(ctx, content.SearchTerm, categories, searchResultLimit*(page-1), searchResultLimit)
+			results, err := bbstore.Search(ctx, user.ViewerID(), content.SearchTerm, categories, searchResultLimit*(page-1), searchResultLimit)
 			if err != nil && err != ErrNotFound {
 				surf.LogError(ctx, err, "database failure, cannot search",
 					"q", content.SearchTerm)
@@ -823,9 +1442,14 @@ func SearchHandler(
 	}
 }
 
+// CommentEditHandler allows the author or a moderator to edit the comment.
+// Moderator edit started from the moderation queue resolves reports of the
+// comment once the edited comment is saved.
 func CommentEditHandler(
 	authStore surf.UnboundCacheService,
 	bbstore BBStore,
+	references CommentReferenceStore,
+	moderation ModerationStore,
 	rend surf.HTMLRenderer,
 ) surf.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) surf.Response {
@@ -842,7 +1466,7 @@ func CommentEditHandler(
 			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
 		}
 
-		topic, comment, commentPos, err := bbstore.CommentByID(ctx, surf.PathArgInt64(r, 0))
+		topic, comment, isFirst, err := bbstore.CommentByID(ctx, surf.PathArgInt64(r, 0))
 		switch {
 		case err == nil:
 			// All good.
@@ -866,6 +1490,10 @@ func CommentEditHandler(
 			})
 		}
 
+		if resp := rejectUnlessCanComment(ctx, bbstore, rend, user, "Not allowed to edit."); resp != nil {
+			return resp
+		}
+
 		content := struct {
 			Errors struct {
 				Subject string
@@ -874,9 +1502,13 @@ func CommentEditHandler(
 			CurrentUser *User
 			Topic       *Topic
 			Comment     *Comment
-			CommentPos  int
+			IsFirst     bool
 			CsrfField   template.HTML
-			Input       struct {
+			// Resolve and Note are set when the edit resolves
+			// reports of the comment.
+			Resolve bool
+			Note    string
+			Input   struct {
 				Subject string
 				Content string
 			}
@@ -884,7 +1516,7 @@ func CommentEditHandler(
 			CurrentUser: user,
 			Topic:       topic,
 			Comment:     comment,
-			CommentPos:  commentPos,
+			IsFirst:     isFirst,
 			CsrfField:   surf.CsrfField(ctx),
 			Input: struct {
 				Subject string
@@ -894,6 +1526,10 @@ func CommentEditHandler(
 				Content: comment.Content,
 			},
 		}
+		if user.Scopes.HasAny(adminScope, moderatorScope) {
+			content.Resolve = r.URL.Query().Get("resolve") != ""
+			content.Note = r.URL.Query().Get("note")
+		}
 
 		if r.Method == "GET" {
 			return rend.Response(ctx, http.StatusOK, "comment_edit.tmpl", content)
@@ -905,6 +1541,10 @@ func CommentEditHandler(
 			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
 		}
 
+		if user.Scopes.HasAny(adminScope, moderatorScope) {
+			content.Resolve = r.Form.Get("resolve") != ""
+			content.Note = strings.TrimSpace(r.Form.Get("note"))
+		}
 		content.Input.Content = strings.TrimSpace(r.Form.Get("content"))
 		if cLen := len(content.Input.Content); cLen == 0 {
 			content.Errors.Content = "Required."
@@ -912,7 +1552,7 @@ func CommentEditHandler(
 			content.Errors.Content = "Too short. Must be at least 2 characters."
 		}
 
-		if commentPos == 0 {
+		if isFirst {
 			content.Input.Subject = strings.TrimSpace(r.Form.Get("subject"))
 			if sLen := len(content.Input.Subject); sLen == 0 {
 				content.Errors.Subject = "Required."
@@ -922,7 +1562,7 @@ func CommentEditHandler(
 		}
 
 		if content.Errors.Subject == "" && content.Errors.Content == "" {
-			if commentPos == 0 && topic.Subject != content.Input.Subject {
+			if isFirst && topic.Subject != content.Input.Subject {
 				switch err := bbstore.UpdateTopic(ctx, topic.TopicID, content.Input.Subject); {
 				case err == nil:
 					// All good.
@@ -937,20 +1577,38 @@ func CommentEditHandler(
 			}
 			switch err := bbstore.UpdateComment(ctx, comment.CommentID, content.Input.Content); {
 			case err == nil:
-				var url string
-				if page := int(commentPos / commentsPerPage); page < 2 {
-					url = fmt.Sprintf("/t/%d/%s/#comment-%d",
-						topic.TopicID,
-						topic.SlugInfo(),
-						comment.CommentID)
-				} else {
-					url = fmt.Sprintf("/t/%d/%s/?page=%d#comment-%d",
-						topic.TopicID,
-						topic.SlugInfo(),
-						page+1,
-						comment.CommentID)
+				if isFirst {
+					topic.Subject = content.Input.Subject
 				}
-				return surf.Redirect(url, http.StatusSeeOther)
+				if err := references.SetReferences(ctx, comment.CommentID, commentReferences(content.Input.Content)); err != nil {
+					surf.LogError(ctx, err, "cannot set comment references",
+						"comment", fmt.Sprint(comment.CommentID))
+				}
+				if content.Resolve {
+					// The resolution keeps the reported content.
+					switch _, err := moderation.ResolveReports(ctx, Resolution{
+						CommentID:      comment.CommentID,
+						TopicID:        topic.TopicID,
+						Moderator:      *user,
+						Action:         ActionEdit,
+						Note:           content.Note,
+						CommentAuthor:  comment.Author,
+						CommentContent: comment.Content,
+					}); {
+					case err == nil:
+						surf.LogInfo(ctx, "reports resolved",
+							"action", string(ActionEdit),
+							"comment", fmt.Sprint(comment.CommentID),
+							"moderator", fmt.Sprint(user.UserID))
+					case ErrNotFound.Is(err):
+						// Another moderator was faster.
+					default:
+						surf.LogError(ctx, err, "cannot resolve reports",
+							"comment", fmt.Sprint(comment.CommentID))
+					}
+					return surf.Redirect("/mod/queue/", http.StatusSeeOther)
+				}
+				return surf.Redirect(commentURL(topic, comment), http.StatusSeeOther)
 			case ErrNotFound.Is(err):
 				return surf.StdResponse(ctx, rend, http.StatusNotFound)
 			default:
@@ -968,6 +1626,9 @@ func CommentEditHandler(
 func CommentDeleteHandler(
 	authStore surf.UnboundCacheService,
 	bbstore BBStore,
+	attachments AttachmentStore,
+	blobs blob.Store,
+	spamFilter SpamFilter,
 	rend surf.HTMLRenderer,
 ) surf.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) surf.Response {
@@ -986,7 +1647,7 @@ func CommentDeleteHandler(
 			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
 		}
 
-		topic, comment, pos, err := bbstore.CommentByID(ctx, commentID)
+		topic, comment, isFirst, err := bbstore.CommentByID(ctx, commentID)
 		switch {
 		case err == nil:
 			if comment.Author.UserID != user.UserID && !user.Scopes.HasAny(adminScope, moderatorScope) {
@@ -1012,20 +1673,29 @@ func CommentDeleteHandler(
 
 		if r.Method == "GET" {
 			return rend.Response(ctx, http.StatusOK, "comment_delete.tmpl", struct {
-				CsrfField  template.HTML
-				Topic      *Topic
-				Comment    *Comment
-				CommentPos int
+				CsrfField template.HTML
+				Topic     *Topic
+				Comment   *Comment
+				IsFirst   bool
 			}{
-				CsrfField:  surf.CsrfField(ctx),
-				Topic:      topic,
-				Comment:    comment,
-				CommentPos: pos,
+				CsrfField: surf.CsrfField(ctx),
+				Topic:     topic,
+				Comment:   comment,
+				IsFirst:   isFirst,
 			})
 		}
 
+		// Content removed by a moderator teaches the spam filter.
+		if comment.Author.UserID != user.UserID {
+			if isFirst {
+				trainSpamFilter(ctx, spamFilter, topic.Subject+"\n"+comment.Content, true)
+			} else {
+				trainSpamFilter(ctx, spamFilter, comment.Content, true)
+			}
+		}
+
 		// if it's the first comment, the entire topic is being deleted
-		if pos == 0 {
+		if isFirst {
 			switch err := bbstore.DeleteTopic(ctx, topic.TopicID); {
 			case err == nil:
 				// All good.
@@ -1041,6 +1711,13 @@ func CommentDeleteHandler(
 			return surf.Redirect("/t/", http.StatusSeeOther)
 		}
 
+		commentAttachments, err := attachments.ListAttachments(ctx, []int64{commentID})
+		if err != nil {
+			surf.LogError(ctx, err, "cannot list comment attachments",
+				"comment", fmt.Sprint(commentID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
 		switch err := bbstore.DeleteComment(ctx, commentID); {
 		case err == nil:
 			// All good.
@@ -1053,6 +1730,13 @@ func CommentDeleteHandler(
 				"comment", fmt.Sprint(commentID))
 			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
 		}
+
+		// Attachments not removed here are orphaned and deleted later by
+		// the cleanup process.
+		if err := DeleteAttachments(ctx, attachments, blobs, commentAttachments[commentID]); err != nil {
+			surf.LogError(ctx, err, "cannot delete comment attachments",
+				"comment", fmt.Sprint(commentID))
+		}
 		return surf.Redirect(fmt.Sprintf("/t/%d/%s/", topic.TopicID, topic.SlugInfo()), http.StatusSeeOther)
 
 	}
@@ -1083,6 +1767,9 @@ func MarkAllReadHandler(
 func SettingsHandler(
 	authStore surf.UnboundCacheService,
 	bbstore BBStore,
+	twoFactor TwoFactorStore,
+	identities IdentityStore,
+	sso *SingleSignOn,
 	rend surf.HTMLRenderer,
 ) surf.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) surf.Response {
@@ -1099,12 +1786,25 @@ func SettingsHandler(
 			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
 		}
 
+		required, err := twoFactor.TwoFactorRequired(ctx)
+		if err != nil {
+			surf.LogError(ctx, err, "cannot get two factor policy")
+		}
+
 		return rend.Response(ctx, http.StatusOK, "settings.tmpl", struct {
-			CsrfField  template.HTML
-			Categories []*Category
+			CsrfField          template.HTML
+			Categories         []*Category
+			CanChangePolicy    bool
+			TwoFactorRequired  bool
+			SingleSignOn       bool
+			LocalLoginDisabled bool
 		}{
-			CsrfField:  surf.CsrfField(ctx),
-			Categories: categories,
+			CsrfField:          surf.CsrfField(ctx),
+			Categories:         categories,
+			CanChangePolicy:    user.Scopes.HasAny(adminScope),
+			TwoFactorRequired:  required,
+			SingleSignOn:       sso != nil,
+			LocalLoginDisabled: localLoginDisabled(ctx, sso, identities),
 		})
 	}
 }
@@ -1112,6 +1812,9 @@ func SettingsHandler(
 func SaveSettingsHandler(
 	authStore surf.UnboundCacheService,
 	bbstore BBStore,
+	twoFactor TwoFactorStore,
+	identities IdentityStore,
+	sso *SingleSignOn,
 	rend surf.HTMLRenderer,
 ) surf.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) surf.Response {
@@ -1178,6 +1881,26 @@ func SaveSettingsHandler(
 			"tocreate", fmt.Sprint(tocreate),
 			"toremove", fmt.Sprint(toremove))
 
+		if user.Scopes.HasAny(adminScope) {
+			required := r.Form.Get("require_2fa") == "1"
+			if err := twoFactor.SetTwoFactorRequired(ctx, required); err != nil {
+				surf.LogError(ctx, err, "cannot update two factor policy")
+				return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+			}
+			surf.LogInfo(ctx, "two factor policy",
+				"required", fmt.Sprint(required))
+
+			if sso != nil {
+				disabled := r.Form.Get("disable_local_login") == "1"
+				if err := identities.SetLocalLoginDisabled(ctx, disabled); err != nil {
+					surf.LogError(ctx, err, "cannot update login policy")
+					return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+				}
+				surf.LogInfo(ctx, "login policy",
+					"localDisabled", fmt.Sprint(disabled))
+			}
+		}
+
 		return surf.Redirect(r.URL.Path, http.StatusSeeOther)
 	}
 }
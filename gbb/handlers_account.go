@@ -0,0 +1,212 @@
+package gbb
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-surf/surf"
+)
+
+// AccountHandler displays the account page, which allows exporting personal
+// data and requesting or cancelling the account deletion. Account is deleted
+// once the grace period has passed.
+//
+// Deletion must be confirmed with the password or, if the user enabled
+// two-factor authentication, with the second factor code. Users signing in
+// with an external identity may not know any local password, so they confirm
+// by typing their user name instead.
+func AccountHandler(
+	accounts AccountStore,
+	authenticator Authenticator,
+	twoFactor TwoFactorStore,
+	identities IdentityStore,
+	deletionGrace time.Duration,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	type Content struct {
+		CurrentUser *User
+		CsrfField   template.HTML
+		Deletion    *AccountDeletion
+		GraceDays   int
+		TwoFactor   bool
+		Identity    bool
+		Error       string
+	}
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUnauthenticated.Is(err):
+			return surf.Redirect("/login/?next="+url.QueryEscape(r.URL.String()), http.StatusTemporaryRedirect)
+		default:
+			surf.LogError(ctx, err, "cannot get current user")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		content := Content{
+			CurrentUser: user,
+			CsrfField:   surf.CsrfField(ctx),
+			GraceDays:   int(deletionGrace / (24 * time.Hour)),
+		}
+		secret, err := twoFactor.TwoFactorSecret(ctx, user.UserID)
+		switch {
+		case err == nil:
+			content.TwoFactor = true
+		case ErrTwoFactorNotFound.Is(err):
+			// Password or name is used for the confirmation.
+			if content.Identity, err = identities.HasIdentity(ctx, user.UserID); err != nil {
+				surf.LogError(ctx, err, "cannot check external identity",
+					"user", fmt.Sprint(user.UserID))
+				return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+			}
+		default:
+			surf.LogError(ctx, err, "cannot get two factor secret",
+				"user", fmt.Sprint(user.UserID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		switch d, err := accounts.PendingDeletion(ctx, user.UserID); {
+		case err == nil:
+			content.Deletion = d
+		case ErrDeletionNotFound.Is(err):
+			// Deletion was not requested.
+		default:
+			surf.LogError(ctx, err, "cannot get pending deletion",
+				"user", fmt.Sprint(user.UserID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		if r.Method != "POST" {
+			return rend.Response(ctx, http.StatusOK, "account.tmpl", content)
+		}
+
+		if err := r.ParseMultipartForm(1e6); err != nil {
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+
+		switch r.Form.Get("action") {
+		case "delete":
+			mode, err := ParseDeletionMode(r.Form.Get("mode"))
+			if err != nil {
+				content.Error = "Choose what should happen to your topics and comments."
+				return rend.Response(ctx, http.StatusBadRequest, "account.tmpl", content)
+			}
+			switch {
+			case content.TwoFactor:
+				switch err := verifySecondFactor(ctx, twoFactor, user.UserID, secret, strings.TrimSpace(r.Form.Get("code"))); {
+				case err == nil:
+					// All good.
+				case ErrPermission.Is(err):
+					content.Error = "Invalid code."
+					return rend.Response(ctx, http.StatusBadRequest, "account.tmpl", content)
+				default:
+					surf.LogError(ctx, err, "cannot verify second factor",
+						"user", fmt.Sprint(user.UserID))
+					return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+				}
+			case content.Identity:
+				if strings.TrimSpace(r.Form.Get("name")) != user.Name {
+					content.Error = "Type your user name to confirm."
+					return rend.Response(ctx, http.StatusBadRequest, "account.tmpl", content)
+				}
+			default:
+				switch u, err := authenticator.AuthenticateUser(ctx, user.Name, r.Form.Get("password")); {
+				case err == nil && u.UserID == user.UserID, ErrUserBanned.Is(err):
+					// Password is valid. Banned users can delete
+					// their accounts too.
+				case err == nil, ErrPermission.Is(err), ErrNotFound.Is(err):
+					content.Error = "Invalid password."
+					return rend.Response(ctx, http.StatusBadRequest, "account.tmpl", content)
+				default:
+					surf.LogError(ctx, err, "cannot authenticate user",
+						"user", fmt.Sprint(user.UserID))
+					return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+				}
+			}
+			if _, err := accounts.ScheduleDeletion(ctx, user.UserID, mode, time.Now().Add(deletionGrace)); err != nil {
+				surf.LogError(ctx, err, "cannot schedule account deletion",
+					"user", fmt.Sprint(user.UserID))
+				return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+			}
+			surf.LogInfo(ctx, "account deletion requested",
+				"user", fmt.Sprint(user.UserID),
+				"mode", string(mode))
+		case "cancel":
+			switch err := accounts.CancelDeletion(ctx, user.UserID); {
+			case err == nil:
+				surf.LogInfo(ctx, "account deletion cancelled",
+					"user", fmt.Sprint(user.UserID))
+			case ErrDeletionNotFound.Is(err):
+				// Already cancelled.
+			default:
+				surf.LogError(ctx, err, "cannot cancel account deletion",
+					"user", fmt.Sprint(user.UserID))
+				return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+			}
+		default:
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+		return surf.Redirect(r.URL.Path, http.StatusSeeOther)
+	}
+}
+
+// AccountExportHandler serves a zip archive with the personal data of the
+// current user.
+func AccountExportHandler(
+	accounts AccountStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUnauthenticated.Is(err):
+			return surf.Redirect("/login/?next="+url.QueryEscape(r.URL.String()), http.StatusTemporaryRedirect)
+		default:
+			surf.LogError(ctx, err, "cannot get current user")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		exp, err := accounts.ExportAccount(ctx, user.UserID)
+		if err != nil {
+			surf.LogError(ctx, err, "cannot export account",
+				"user", fmt.Sprint(user.UserID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+		// Archive is built in memory, so that a failure can still be
+		// reported with a proper response.
+		var b bytes.Buffer
+		if err := WriteAccountExport(&b, exp); err != nil {
+			surf.LogError(ctx, err, "cannot write account export",
+				"user", fmt.Sprint(user.UserID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		name := fmt.Sprintf("gbb-account-%d-%s.zip", user.UserID, time.Now().Format("2006-01-02"))
+		header := w.Header()
+		header.Set("content-type", "application/zip")
+		header.Set("content-disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+		header.Set("content-length", fmt.Sprint(b.Len()))
+		header.Set("cache-control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		if _, err := b.WriteTo(w); err != nil {
+			surf.LogError(ctx, err, "cannot write account export response",
+				"user", fmt.Sprint(user.UserID))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,99 @@
+package gbb
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+
+	"github.com/go-surf/surf"
+	"github.com/husio/gbb/blob"
+)
+
+// AttachmentHandler serves content of the attachment. When thumbnail is true,
+// the thumbnail of an image attachment is served instead.
+//
+// Attachment content never changes, but it stops being available once its
+// comment is deleted. Shared caches must not keep it and browsers revalidate
+// it after a short time, using the etag.
+func AttachmentHandler(
+	attachments AttachmentStore,
+	blobs blob.Store,
+	thumbnail bool,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		attachmentID := surf.PathArgInt64(r, 0)
+		a, err := attachments.AttachmentByID(ctx, attachmentID)
+		switch {
+		case err == nil:
+			// All good.
+		case ErrNotFound.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusNotFound)
+		default:
+			surf.LogError(ctx, err, "cannot fetch attachment",
+				"attachment", fmt.Sprint(attachmentID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		// Attachments of deleted comments are waiting to be removed and
+		// must not be accessible anymore.
+		if a.CommentID == 0 {
+			return surf.StdResponse(ctx, rend, http.StatusNotFound)
+		}
+
+		key, contentType, disposition := a.BlobKey, a.ContentType, "attachment"
+		if a.IsImage() {
+			disposition = "inline"
+		}
+		if thumbnail {
+			if a.ThumbnailKey == "" {
+				return surf.StdResponse(ctx, rend, http.StatusNotFound)
+			}
+			key, contentType, disposition = a.ThumbnailKey, "image/jpeg", "inline"
+		}
+
+		etag := fmt.Sprintf(`"%s"`, path.Base(key))
+		header := w.Header()
+		header.Set("etag", etag)
+		header.Set("cache-control", "private, max-age=300")
+		if r.Header.Get("if-none-match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+
+		content, err := blobs.Get(ctx, key)
+		switch {
+		case err == nil:
+			// All good.
+		case blob.ErrNotFound.Is(err):
+			surf.LogError(ctx, err, "attachment blob missing",
+				"attachment", fmt.Sprint(attachmentID),
+				"key", key)
+			return surf.StdResponse(ctx, rend, http.StatusNotFound)
+		default:
+			surf.LogError(ctx, err, "cannot read attachment blob",
+				"attachment", fmt.Sprint(attachmentID),
+				"key", key)
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+		defer content.Close()
+
+		header.Set("content-type", contentType)
+		header.Set("content-disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Name}))
+		header.Set("x-content-type-options", "nosniff")
+		header.Set("content-security-policy", "default-src 'none'; sandbox")
+		if !thumbnail {
+			header.Set("content-length", fmt.Sprint(a.Size))
+		}
+		w.WriteHeader(http.StatusOK)
+		if _, err := io.Copy(w, content); err != nil {
+			surf.LogError(ctx, err, "cannot write attachment",
+				"attachment", fmt.Sprint(attachmentID))
+		}
+		return nil
+	}
+}
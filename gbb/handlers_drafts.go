@@ -0,0 +1,159 @@
+package gbb
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-surf/surf"
+)
+
+// maxDraftSize limits the size of the autosave request.
+const maxDraftSize = 1 << 20
+
+// DraftSaveHandler stores the content of the topic or comment form that is
+// being written. It is called periodically by the form while the user is
+// typing. Draft without any content is removed.
+func DraftSaveHandler(
+	drafts DraftStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUnauthenticated.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusUnauthorized)
+		default:
+			surf.LogError(ctx, err, "cannot get current user")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxDraftSize)
+		if err := r.ParseMultipartForm(maxDraftSize); err != nil {
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+
+		draft := Draft{
+			UserID:  user.UserID,
+			Subject: strings.TrimSpace(r.Form.Get("subject")),
+			Content: strings.TrimSpace(r.Form.Get("content")),
+		}
+		if raw := r.Form.Get("topic"); raw != "" {
+			if draft.TopicID, err = strconv.ParseInt(raw, 10, 64); err != nil || draft.TopicID < 0 {
+				return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+			}
+		}
+
+		if draft.Subject == "" && draft.Content == "" {
+			err = drafts.DeleteDraft(ctx, user.UserID, draft.TopicID)
+		} else {
+			err = drafts.SaveDraft(ctx, draft)
+		}
+		switch {
+		case err == nil:
+			// All good.
+		case ErrNotFound.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusNotFound)
+		default:
+			surf.LogError(ctx, err, "cannot save draft",
+				"user", fmt.Sprint(user.UserID),
+				"topic", fmt.Sprint(draft.TopicID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// DraftListHandler displays all drafts of the current user.
+func DraftListHandler(
+	drafts DraftStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUnauthenticated.Is(err):
+			return surf.Redirect("/login/?next="+url.QueryEscape(r.URL.String()), http.StatusTemporaryRedirect)
+		default:
+			surf.LogError(ctx, err, "cannot get current user")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		list, err := drafts.ListDrafts(ctx, user.UserID)
+		if err != nil {
+			surf.LogError(ctx, err, "cannot list drafts",
+				"user", fmt.Sprint(user.UserID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		return rend.Response(ctx, http.StatusOK, "draft_list.tmpl", struct {
+			CurrentUser *User
+			CsrfField   template.HTML
+			Drafts      []*Draft
+		}{
+			CurrentUser: user,
+			CsrfField:   surf.CsrfField(ctx),
+			Drafts:      list,
+		})
+	}
+}
+
+// DraftDeleteHandler discards a draft of the current user.
+func DraftDeleteHandler(
+	drafts DraftStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUnauthenticated.Is(err):
+			return surf.Redirect("/login/?next=/drafts/", http.StatusSeeOther)
+		default:
+			surf.LogError(ctx, err, "cannot get current user")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		if err := r.ParseMultipartForm(1e6); err != nil {
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+		topicID, _ := strconv.ParseInt(r.Form.Get("topic"), 10, 64)
+
+		if err := drafts.DeleteDraft(ctx, user.UserID, topicID); err != nil {
+			surf.LogError(ctx, err, "cannot delete draft",
+				"user", fmt.Sprint(user.UserID),
+				"topic", fmt.Sprint(topicID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+		return surf.Redirect("/drafts/", http.StatusSeeOther)
+	}
+}
+
+// discardDraft removes the draft once the topic or comment it was written
+// for is created.
+func discardDraft(r *http.Request, drafts DraftStore, userID, topicID int64) {
+	if err := drafts.DeleteDraft(r.Context(), userID, topicID); err != nil {
+		surf.LogError(r.Context(), err, "cannot discard draft",
+			"user", fmt.Sprint(userID),
+			"topic", fmt.Sprint(topicID))
+	}
+}
@@ -0,0 +1,240 @@
+package gbb
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+)
+
+// Limits of a single invite.
+const (
+	inviteMaxUses = 100
+	inviteMaxDays = 90
+)
+
+// generateInviteToken returns a new random invite token, safe to use in
+// URLs.
+func generateInviteToken() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", errors.Wrap(err, "cannot read random")
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// inviteScopes returns the scopes that given user can grant using an invite.
+// Admins can grant any scope, others only the scopes they have, except
+// privileged ones.
+func inviteScopes(user *User) UserScope {
+	all := adminScope | moderatorScope | createTopicScope | createCommentScope |
+		changeSettingsScope | startConversationScope | inviteScope
+	if user.Scopes.HasAny(adminScope) {
+		return all
+	}
+	return user.Scopes.Remove(privilegedScopes) & all
+}
+
+// scopeOption is a scope that can be chosen in a form.
+type scopeOption struct {
+	Name    string
+	Checked bool
+}
+
+func scopeOptions(available, checked UserScope) []scopeOption {
+	var options []scopeOption
+	for _, name := range available.Names() {
+		scope, _ := ParseUserScope(name)
+		options = append(options, scopeOption{Name: name, Checked: checked.HasAny(scope)})
+	}
+	return options
+}
+
+// requestBaseURL returns the scheme and the host the request was sent to.
+func requestBaseURL(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+// InviteListHandler lists invites created by the current user, or by anyone
+// if the user is an admin, and allows creating new ones.
+func InviteListHandler(
+	bbStore BBStore,
+	invites InviteStore,
+	scopeThresholds []ScopeThreshold,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	type Content struct {
+		CurrentUser *User
+		CsrfField   template.HTML
+		BaseURL     string
+		Invites     []*Invite
+		Scopes      []scopeOption
+		Input       struct {
+			MaxUses string
+			Days    string
+		}
+		Errors map[string]string
+	}
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		boundCache := authStore.Bind(w, r)
+		user, err := CurrentUser(ctx, boundCache)
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUnauthenticated.Is(err):
+			return surf.Redirect("/login/?next="+url.QueryEscape(r.URL.String()), http.StatusTemporaryRedirect)
+		default:
+			surf.LogError(ctx, err, "cannot get current user")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		if !user.Scopes.HasAny(adminScope, inviteScope) {
+			user = refreshUserScopes(ctx, bbStore, scopeThresholds, boundCache, user)
+		}
+		if !user.Scopes.HasAny(adminScope, inviteScope) {
+			surf.LogInfo(ctx, "user action rejected due to missing invite scope",
+				"scopes", user.Scopes.String(),
+				"user", fmt.Sprint(user.UserID))
+			return rend.Response(ctx, http.StatusOK, "error_scope.tmpl", struct {
+				Message string
+			}{
+				Message: "Not allowed to invite users yet.",
+			})
+		}
+
+		content := Content{
+			CurrentUser: user,
+			CsrfField:   surf.CsrfField(ctx),
+			BaseURL:     requestBaseURL(r),
+			Errors:      make(map[string]string),
+		}
+		content.Input.MaxUses = "1"
+		content.Input.Days = "7"
+		available := inviteScopes(user)
+		var scopes UserScope
+
+		if r.Method == "POST" {
+			if err := r.ParseMultipartForm(1e6); err != nil {
+				return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+			}
+			content.Input.MaxUses = r.Form.Get("max_uses")
+			content.Input.Days = r.Form.Get("days")
+
+			maxUses, err := strconv.ParseInt(content.Input.MaxUses, 10, 64)
+			if err != nil || maxUses < 1 || maxUses > inviteMaxUses {
+				content.Errors["MaxUses"] = fmt.Sprintf("Must be a number between 1 and %d.", inviteMaxUses)
+			}
+			days, err := strconv.ParseInt(content.Input.Days, 10, 64)
+			if err != nil || days < 1 || days > inviteMaxDays {
+				content.Errors["Days"] = fmt.Sprintf("Must be a number between 1 and %d.", inviteMaxDays)
+			}
+			for _, name := range r.Form["scope"] {
+				scope, err := ParseUserScope(name)
+				if err != nil || !available.HasAny(scope) {
+					content.Errors["Scopes"] = "Cannot grant " + name + "."
+					continue
+				}
+				scopes = scopes.Add(scope)
+			}
+
+			if len(content.Errors) == 0 {
+				token, err := generateInviteToken()
+				if err != nil {
+					surf.LogError(ctx, err, "cannot generate invite token")
+					return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+				}
+				inv, err := invites.CreateInvite(ctx, Invite{
+					Token:     token,
+					CreatedBy: *user,
+					Scopes:    scopes,
+					MaxUses:   maxUses,
+					Expires:   time.Now().Add(time.Duration(days) * 24 * time.Hour),
+				})
+				if err != nil {
+					surf.LogError(ctx, err, "cannot create invite",
+						"user", fmt.Sprint(user.UserID))
+					return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+				}
+				surf.LogInfo(ctx, "invite created",
+					"invite", fmt.Sprint(inv.InviteID),
+					"user", fmt.Sprint(user.UserID),
+					"scopes", scopes.String())
+				return surf.Redirect(r.URL.Path, http.StatusSeeOther)
+			}
+		}
+
+		// Admins see invites of everyone.
+		var createdBy int64
+		if !user.Scopes.HasAny(adminScope) {
+			createdBy = user.UserID
+		}
+		content.Invites, err = invites.ListInvites(ctx, createdBy, 200)
+		if err != nil {
+			surf.LogError(ctx, err, "cannot list invites",
+				"user", fmt.Sprint(user.UserID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+		content.Scopes = scopeOptions(available, scopes)
+
+		code := http.StatusOK
+		if len(content.Errors) != 0 {
+			code = http.StatusBadRequest
+		}
+		return rend.Response(ctx, code, "invite_list.tmpl", content)
+	}
+}
+
+// InviteRevokeHandler makes the invite unusable. Users can revoke their own
+// invites, admins any invite.
+func InviteRevokeHandler(
+	invites InviteStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUnauthenticated.Is(err):
+			return surf.Redirect("/login/", http.StatusTemporaryRedirect)
+		default:
+			surf.LogError(ctx, err, "cannot get current user")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		var createdBy int64
+		if !user.Scopes.HasAny(adminScope) {
+			createdBy = user.UserID
+		}
+		inviteID := surf.PathArgInt64(r, 0)
+		switch err := invites.RevokeInvite(ctx, inviteID, createdBy); {
+		case err == nil:
+			surf.LogInfo(ctx, "invite revoked",
+				"invite", fmt.Sprint(inviteID),
+				"user", fmt.Sprint(user.UserID))
+		case ErrInviteNotFound.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusNotFound)
+		default:
+			surf.LogError(ctx, err, "cannot revoke invite",
+				"invite", fmt.Sprint(inviteID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+		return surf.Redirect("/invites/", http.StatusSeeOther)
+	}
+}
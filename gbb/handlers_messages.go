@@ -0,0 +1,539 @@
+package gbb
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-surf/surf"
+)
+
+// MessageLimits restricts starting private conversations. Who can start a
+// conversation at all is controlled by the scope unlocked with
+// ConversationThreshold.
+type MessageLimits struct {
+	// MaxRecipients is the maximum number of users a conversation can be
+	// started with.
+	MaxRecipients int
+	// MaxDaily is the maximum number of conversations a user can start
+	// within 24 hours. Zero means no limit.
+	MaxDaily int
+}
+
+const conversationsPerPage = 50
+
+// MessageInboxHandler lists conversations of the current user.
+func MessageInboxHandler(
+	messages MessageStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUnauthenticated.Is(err):
+			return surf.Redirect("/login/?next="+url.QueryEscape(r.URL.String()), http.StatusTemporaryRedirect)
+		default:
+			surf.LogError(ctx, err, "cannot get current user")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		updatedLte, ok := timeFromParam(r.URL.Query(), "before")
+		if !ok {
+			updatedLte = time.Now()
+		}
+		conversations, err := messages.ListConversations(ctx, user.UserID, updatedLte, conversationsPerPage)
+		if err != nil {
+			surf.LogError(ctx, err, "cannot list conversations",
+				"user", fmt.Sprint(user.UserID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		var nextPageBefore string
+		if len(conversations) == conversationsPerPage {
+			nextPageBefore = conversations[len(conversations)-1].Updated.Format(time.RFC3339Nano)
+		}
+
+		return rend.Response(ctx, http.StatusOK, "message_inbox.tmpl", struct {
+			CurrentUser    *User
+			Conversations  []*Conversation
+			NextPageBefore string
+		}{
+			CurrentUser:    user,
+			Conversations:  conversations,
+			NextPageBefore: nextPageBefore,
+		})
+	}
+}
+
+// ConversationCreateHandler starts a new private conversation with one or
+// more users.
+func ConversationCreateHandler(
+	bbStore BBStore,
+	messages MessageStore,
+	limits MessageLimits,
+	scopeThresholds []ScopeThreshold,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	type Content struct {
+		Input struct {
+			To      string
+			Subject string
+			Content string
+		}
+		Errors    map[string]string
+		CsrfField template.HTML
+	}
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		boundCache := authStore.Bind(w, r)
+		user, err := CurrentUser(ctx, boundCache)
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUnauthenticated.Is(err):
+			return surf.Redirect("/login/?next="+url.QueryEscape(r.URL.String()), http.StatusTemporaryRedirect)
+		default:
+			surf.LogError(ctx, err, "cannot get current user")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		if !user.Scopes.HasAny(adminScope, moderatorScope, startConversationScope) {
+			user = refreshUserScopes(ctx, bbStore, scopeThresholds, boundCache, user)
+		}
+		if !user.Scopes.HasAny(adminScope, moderatorScope, startConversationScope) {
+			surf.LogInfo(ctx, "user action rejected due to missing conversation scope",
+				"scopes", user.Scopes.String(),
+				"user", fmt.Sprint(user.UserID))
+			return rend.Response(ctx, http.StatusOK, "error_scope.tmpl", struct {
+				Message string
+			}{
+				Message: "Not allowed to start private conversations yet.",
+			})
+		}
+
+		content := Content{
+			CsrfField: surf.CsrfField(ctx),
+		}
+
+		if r.Method != "POST" {
+			content.Input.To = r.URL.Query().Get("to")
+			return rend.Response(ctx, http.StatusOK, "conversation_create.tmpl", content)
+		}
+
+		if err := r.ParseMultipartForm(1e6); err != nil {
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+
+		content.Errors = make(map[string]string)
+		content.Input.To = strings.TrimSpace(r.Form.Get("to"))
+		content.Input.Subject = strings.TrimSpace(r.Form.Get("subject"))
+		content.Input.Content = strings.TrimSpace(r.Form.Get("content"))
+
+		if len(content.Input.Subject) < 2 {
+			content.Errors["Subject"] = "Too short. Must be at least 2 characters"
+		}
+		if len(content.Input.Content) < 2 {
+			content.Errors["Content"] = "Too short. Must be at least 2 characters"
+		}
+
+		names := recipientNames(content.Input.To)
+		var recipients []*User
+		switch {
+		case len(names) == 0:
+			content.Errors["To"] = "At least one recipient is required."
+		case len(names) > limits.MaxRecipients:
+			content.Errors["To"] = fmt.Sprintf("Too many recipients. At most %d are allowed.", limits.MaxRecipients)
+		default:
+			recipients, err = bbStore.UsersByName(ctx, names)
+			if err != nil {
+				surf.LogError(ctx, err, "cannot find recipients")
+				return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+			}
+			if missing := missingNames(names, recipients); len(missing) != 0 {
+				content.Errors["To"] = "Unknown users: " + strings.Join(missing, ", ")
+			}
+		}
+
+		if len(content.Errors) != 0 {
+			return rend.Response(ctx, http.StatusBadRequest, "conversation_create.tmpl", content)
+		}
+
+		if limits.MaxDaily > 0 && !user.Scopes.HasAny(adminScope, moderatorScope) {
+			started, err := messages.CountStartedConversations(ctx, user.UserID, time.Now().Add(-24*time.Hour))
+			if err != nil {
+				surf.LogError(ctx, err, "cannot count started conversations",
+					"user", fmt.Sprint(user.UserID))
+				return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+			}
+			if started >= int64(limits.MaxDaily) {
+				return rend.Response(ctx, http.StatusOK, "error_scope.tmpl", struct {
+					Message string
+				}{
+					Message: "You have started too many conversations today. Try again later.",
+				})
+			}
+		}
+
+		participantIDs := make([]int64, len(recipients))
+		for i, u := range recipients {
+			participantIDs[i] = u.UserID
+		}
+		conversation, _, err := messages.CreateConversation(ctx, content.Input.Subject, content.Input.Content, user.UserID, participantIDs)
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUserBanned.Is(err):
+			return rend.Response(ctx, http.StatusOK, "error_scope.tmpl", struct {
+				Message string
+			}{
+				Message: "Your account is banned.",
+			})
+		case ErrPermission.Is(err):
+			content.Errors["To"] = "Some of the recipients do not accept your messages."
+			return rend.Response(ctx, http.StatusBadRequest, "conversation_create.tmpl", content)
+		case ErrMalformed.Is(err):
+			content.Errors["To"] = "You cannot start a conversation with yourself."
+			return rend.Response(ctx, http.StatusBadRequest, "conversation_create.tmpl", content)
+		default:
+			surf.LogError(ctx, err, "cannot create conversation",
+				"user", fmt.Sprint(user.UserID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		return surf.Redirect(fmt.Sprintf("/messages/%d/", conversation.ConversationID), http.StatusSeeOther)
+	}
+}
+
+// isLocalPath returns true if given redirect target is a path on this site.
+// Browsers treat backslash as slash, so targets containing it are rejected.
+func isLocalPath(target string) bool {
+	if strings.Contains(target, `\`) || strings.HasPrefix(target, "//") {
+		return false
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "" && u.Host == "" && strings.HasPrefix(u.Path, "/")
+}
+
+// recipientNames returns unique user names from a comma or space separated
+// list.
+func recipientNames(raw string) []string {
+	fields := strings.FieldsFunc(raw, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	names := make([]string, 0, len(fields))
+	for _, name := range fields {
+		if !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// missingNames returns names that do not belong to any of given users.
+func missingNames(names []string, users []*User) []string {
+	var missing []string
+	for _, name := range names {
+		found := false
+		for _, u := range users {
+			if u.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// ConversationHandler displays messages of the conversation and allows to
+// reply.
+func ConversationHandler(
+	messages MessageStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUnauthenticated.Is(err):
+			return surf.Redirect("/login/?next="+url.QueryEscape(r.URL.String()), http.StatusTemporaryRedirect)
+		default:
+			surf.LogError(ctx, err, "cannot get current user")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		cursor, ok := cursorFromQuery(r.URL.Query())
+		if !ok {
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+
+		conversationID := surf.PathArgInt64(r, 0)
+		conversation, err := messages.ConversationByID(ctx, conversationID, user.UserID)
+		switch {
+		case err == nil:
+			// All good.
+		case ErrNotFound.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusNotFound)
+		default:
+			surf.LogError(ctx, err, "cannot fetch conversation",
+				"conversation", fmt.Sprint(conversationID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		list, err := messages.ListMessages(ctx, conversationID, cursor, commentsPerPage+1)
+		if err != nil {
+			surf.LogError(ctx, err, "cannot fetch messages",
+				"conversation", fmt.Sprint(conversationID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		pagination := commentsPagination{
+			Current: cursor,
+		}
+		if cursor.Backward {
+			if len(list) > commentsPerPage {
+				list = list[1:]
+				pagination.HasPrev = true
+			}
+			pagination.HasNext = !cursor.IsZero()
+			pagination.Next = CommentCursor{Created: cursor.Created, CommentID: cursor.CommentID}
+		} else {
+			if len(list) > commentsPerPage {
+				pagination.HasNext = true
+				pagination.Next = list[commentsPerPage].Cursor()
+				list = list[:commentsPerPage]
+			}
+			pagination.HasPrev = !cursor.IsZero()
+		}
+		if len(list) > 0 {
+			pagination.Prev = list[0].Cursor()
+
+			last := list[len(list)-1]
+			err := messages.TrackRead(ctx, ReadProgress{
+				UserID:         user.UserID,
+				TopicID:        conversationID,
+				CommentID:      last.MessageID,
+				CommentCreated: last.Created,
+			})
+			if err != nil {
+				surf.LogError(ctx, err, "cannot track message",
+					"user", fmt.Sprint(user.UserID),
+					"conversation", fmt.Sprint(conversationID))
+			}
+		}
+
+		return rend.Response(ctx, http.StatusOK, "conversation.tmpl", struct {
+			CurrentUser  *User
+			CsrfField    template.HTML
+			Conversation *Conversation
+			Messages     []*Message
+			Pagination   *commentsPagination
+		}{
+			CurrentUser:  user,
+			CsrfField:    surf.CsrfField(ctx),
+			Conversation: conversation,
+			Messages:     list,
+			Pagination:   &pagination,
+		})
+	}
+}
+
+// MessageCreateHandler adds a reply to the conversation.
+func MessageCreateHandler(
+	messages MessageStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUnauthenticated.Is(err):
+			return surf.Redirect("/login/?next="+url.QueryEscape(r.URL.String()), http.StatusTemporaryRedirect)
+		default:
+			surf.LogError(ctx, err, "cannot get current user")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		if err := r.ParseMultipartForm(1e6); err != nil {
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+		content := strings.TrimSpace(r.Form.Get("content"))
+		if content == "" {
+			return rend.Response(ctx, http.StatusBadRequest, "error_4xx.tmpl", "Message cannot be empty.")
+		}
+
+		conversationID := surf.PathArgInt64(r, 0)
+		message, err := messages.CreateMessage(ctx, conversationID, content, user.UserID)
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUserBanned.Is(err):
+			return rend.Response(ctx, http.StatusOK, "error_scope.tmpl", struct {
+				Message string
+			}{
+				Message: "Your account is banned.",
+			})
+		case ErrPermission.Is(err):
+			return rend.Response(ctx, http.StatusOK, "error_scope.tmpl", struct {
+				Message string
+			}{
+				Message: "You cannot write to this conversation.",
+			})
+		default:
+			surf.LogError(ctx, err, "cannot create message",
+				"conversation", fmt.Sprint(conversationID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		return surf.Redirect(fmt.Sprintf("/messages/%d/?page=last#message-%d", conversationID, message.MessageID), http.StatusSeeOther)
+	}
+}
+
+// ConversationLeaveHandler removes the current user from the conversation.
+func ConversationLeaveHandler(
+	messages MessageStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUnauthenticated.Is(err):
+			return surf.Redirect("/login/?next=/messages/", http.StatusSeeOther)
+		default:
+			surf.LogError(ctx, err, "cannot get current user")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		conversationID := surf.PathArgInt64(r, 0)
+		switch err := messages.LeaveConversation(ctx, conversationID, user.UserID); {
+		case err == nil:
+			return surf.Redirect("/messages/", http.StatusSeeOther)
+		case ErrNotFound.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusNotFound)
+		default:
+			surf.LogError(ctx, err, "cannot leave conversation",
+				"user", fmt.Sprint(user.UserID),
+				"conversation", fmt.Sprint(conversationID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+	}
+}
+
+// BlockedUsersHandler lists users blocked by the current user.
+func BlockedUsersHandler(
+	messages MessageStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUnauthenticated.Is(err):
+			return surf.Redirect("/login/?next="+url.QueryEscape(r.URL.String()), http.StatusTemporaryRedirect)
+		default:
+			surf.LogError(ctx, err, "cannot get current user")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		blocked, err := messages.ListBlockedUsers(ctx, user.UserID)
+		if err != nil {
+			surf.LogError(ctx, err, "cannot list blocked users",
+				"user", fmt.Sprint(user.UserID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		return rend.Response(ctx, http.StatusOK, "message_blocked.tmpl", struct {
+			CurrentUser *User
+			CsrfField   template.HTML
+			Blocked     []*User
+		}{
+			CurrentUser: user,
+			CsrfField:   surf.CsrfField(ctx),
+			Blocked:     blocked,
+		})
+	}
+}
+
+// UserBlockHandler blocks or unblocks private messages from the user.
+func UserBlockHandler(
+	messages MessageStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUnauthenticated.Is(err):
+			return surf.Redirect("/login/", http.StatusSeeOther)
+		default:
+			surf.LogError(ctx, err, "cannot get current user")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		if err := r.ParseMultipartForm(1e6); err != nil {
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+
+		blockedID := surf.PathArgInt64(r, 0)
+		if r.Form.Get("block") == "1" {
+			err = messages.BlockUser(ctx, user.UserID, blockedID)
+		} else {
+			err = messages.UnblockUser(ctx, user.UserID, blockedID)
+		}
+		switch {
+		case err == nil:
+			// All good.
+		case ErrNotFound.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusNotFound)
+		case ErrMalformed.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		default:
+			surf.LogError(ctx, err, "cannot change user block",
+				"user", fmt.Sprint(user.UserID),
+				"blocked", fmt.Sprint(blockedID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		next := r.Form.Get("next")
+		if !isLocalPath(next) {
+			next = fmt.Sprintf("/u/%d/", blockedID)
+		}
+		return surf.Redirect(next, http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,23 @@
+package gbb
+
+import "testing"
+
+func TestIsLocalPath(t *testing.T) {
+	cases := map[string]bool{
+		"/u/12/":             true,
+		"/t/1/?page=2#c3":    true,
+		"":                   false,
+		"u/12/":              false,
+		"//evil.com":         false,
+		"///evil.com":        false,
+		`/\evil.com`:         false,
+		"/\t/evil.com":       false,
+		"https://evil.com/":  false,
+		"javascript:alert()": false,
+	}
+	for target, want := range cases {
+		if got := isLocalPath(target); got != want {
+			t.Errorf("%q: want %v, got %v", target, want, got)
+		}
+	}
+}
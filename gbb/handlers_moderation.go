@@ -0,0 +1,816 @@
+package gbb
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+)
+
+// reportReasons are the reasons a user can choose from when reporting a
+// comment.
+var reportReasons = []string{
+	"Spam",
+	"Abusive or harassing",
+	"Off-topic",
+	"Other",
+}
+
+// CommentReportHandler allows users to report a comment to the moderators.
+func CommentReportHandler(
+	bbStore BBStore,
+	moderation ModerationStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	type Content struct {
+		CsrfField template.HTML
+		Topic     *Topic
+		Comment   *Comment
+		Reasons   []string
+		Error     string
+		Reported  bool
+	}
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUnauthenticated.Is(err):
+			return surf.Redirect("/login/?next="+url.QueryEscape(r.URL.String()), http.StatusTemporaryRedirect)
+		default:
+			surf.LogError(ctx, err, "cannot get current user")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		commentID := surf.PathArgInt64(r, 0)
+		topic, comment, _, err := bbStore.CommentByID(ctx, commentID)
+		switch {
+		case err == nil:
+			// All good.
+		case ErrNotFound.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusNotFound)
+		default:
+			surf.LogError(ctx, err, "cannot fetch comment",
+				"comment", fmt.Sprint(commentID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+		if comment.Author.UserID == user.UserID {
+			return rend.Response(ctx, http.StatusBadRequest, "error_4xx.tmpl", "You cannot report your own comment.")
+		}
+
+		content := Content{
+			CsrfField: surf.CsrfField(ctx),
+			Topic:     topic,
+			Comment:   comment,
+			Reasons:   reportReasons,
+		}
+
+		if r.Method != "POST" {
+			return rend.Response(ctx, http.StatusOK, "comment_report.tmpl", content)
+		}
+
+		if err := r.ParseMultipartForm(1e6); err != nil {
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+		reason := r.Form.Get("reason")
+		if !containsString(reportReasons, reason) {
+			content.Error = "Choose the reason of the report."
+			return rend.Response(ctx, http.StatusBadRequest, "comment_report.tmpl", content)
+		}
+		if details := strings.TrimSpace(r.Form.Get("details")); details != "" {
+			reason += ": " + details
+		}
+
+		switch err := moderation.CreateReport(ctx, commentID, user.UserID, reason); {
+		case err == nil:
+			// All good.
+		case ErrNotFound.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusNotFound)
+		default:
+			surf.LogError(ctx, err, "cannot create report",
+				"comment", fmt.Sprint(commentID),
+				"user", fmt.Sprint(user.UserID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		surf.LogInfo(ctx, "comment reported",
+			"comment", fmt.Sprint(commentID),
+			"user", fmt.Sprint(user.UserID))
+		content.Reported = true
+		return rend.Response(ctx, http.StatusOK, "comment_report.tmpl", content)
+	}
+}
+
+// currentModerator returns the current user if it is allowed to moderate.
+// Response is not nil if the user is not allowed.
+func currentModerator(
+	w http.ResponseWriter,
+	r *http.Request,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) (*User, surf.Response) {
+	ctx := r.Context()
+
+	user, err := CurrentUser(ctx, authStore.Bind(w, r))
+	switch {
+	case err == nil:
+		// All good.
+	case ErrUnauthenticated.Is(err):
+		return nil, surf.Redirect("/login/?next="+url.QueryEscape(r.URL.String()), http.StatusTemporaryRedirect)
+	default:
+		surf.LogError(ctx, err, "cannot get current user")
+		return nil, surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+	}
+
+	if !user.Scopes.HasAny(adminScope, moderatorScope) {
+		return nil, rend.Response(ctx, http.StatusOK, "error_scope.tmpl", struct {
+			Message string
+		}{
+			Message: "Only moderators can access this page.",
+		})
+	}
+	return user, nil
+}
+
+// ModerationQueueHandler lists comments with open reports.
+func ModerationQueueHandler(
+	moderation ModerationStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, resp := currentModerator(w, r, authStore, rend)
+		if resp != nil {
+			return resp
+		}
+
+		reported, err := moderation.ListReportedComments(ctx, 100)
+		if err != nil {
+			surf.LogError(ctx, err, "cannot list reported comments")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		return rend.Response(ctx, http.StatusOK, "moderation_queue.tmpl", struct {
+			CurrentUser *User
+			CsrfField   template.HTML
+			Reported    []*ReportedComment
+		}{
+			CurrentUser: user,
+			CsrfField:   surf.CsrfField(ctx),
+			Reported:    reported,
+		})
+	}
+}
+
+// ModerationResolveHandler takes the moderator action on the reported comment
+// and resolves all its open reports. Edit is only started here, its reports
+// are resolved by CommentEditHandler once the edited comment is saved.
+func ModerationResolveHandler(
+	bbStore BBStore,
+	moderation ModerationStore,
+	spamFilter SpamFilter,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, resp := currentModerator(w, r, authStore, rend)
+		if resp != nil {
+			return resp
+		}
+
+		if err := r.ParseMultipartForm(1e6); err != nil {
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+
+		resolution := Resolution{
+			CommentID: surf.PathArgInt64(r, 0),
+			Moderator: *user,
+			Action:    ModerationAction(r.Form.Get("action")),
+			Note:      strings.TrimSpace(r.Form.Get("note")),
+		}
+
+		topic, comment, isFirst, err := bbStore.CommentByID(ctx, resolution.CommentID)
+		switch {
+		case err == nil:
+			resolution.TopicID = topic.TopicID
+			resolution.CommentAuthor = comment.Author
+			resolution.CommentContent = comment.Content
+		case ErrNotFound.Is(err):
+			// Deleted comment reports can only be dismissed.
+			if resolution.Action != ActionDismiss {
+				return surf.StdResponse(ctx, rend, http.StatusNotFound)
+			}
+		default:
+			surf.LogError(ctx, err, "cannot fetch comment",
+				"comment", fmt.Sprint(resolution.CommentID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		switch resolution.Action {
+		case ActionDismiss, ActionEdit, ActionDelete, ActionLockTopic:
+			// All good.
+		case ActionBanAuthor:
+			switch err := checkCanBan(ctx, bbStore, comment.Author.UserID); {
+			case err == nil:
+				// All good.
+			case ErrPermission.Is(err):
+				return rend.Response(ctx, http.StatusOK, "error_scope.tmpl", struct {
+					Message string
+				}{
+					Message: "Administrators and moderators cannot be banned.",
+				})
+			case ErrNotFound.Is(err):
+				return surf.StdResponse(ctx, rend, http.StatusNotFound)
+			default:
+				surf.LogError(ctx, err, "cannot check ban permission",
+					"user", fmt.Sprint(comment.Author.UserID))
+				return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+			}
+		default:
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+
+		if resolution.Action == ActionEdit {
+			q := url.Values{"resolve": {"1"}, "note": {resolution.Note}}
+			return surf.Redirect(fmt.Sprintf("/c/%d/edit/?%s", resolution.CommentID, q.Encode()), http.StatusSeeOther)
+		}
+
+		// Reports are resolved before the action is taken, so that
+		// only one of moderators acting at the same time takes it and
+		// every action taken is recorded. If the action fails, the
+		// reports are reopened.
+		resolved, err := moderation.ResolveReports(ctx, resolution)
+		switch {
+		case err == nil:
+			surf.LogInfo(ctx, "reports resolved",
+				"action", string(resolution.Action),
+				"comment", fmt.Sprint(resolution.CommentID),
+				"moderator", fmt.Sprint(user.UserID))
+		case ErrNotFound.Is(err):
+			// Another moderator was faster.
+			return surf.Redirect("/mod/queue/", http.StatusSeeOther)
+		default:
+			surf.LogError(ctx, err, "cannot resolve reports",
+				"comment", fmt.Sprint(resolution.CommentID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		switch resolution.Action {
+		case ActionDismiss:
+			if comment != nil {
+				trainSpamFilter(ctx, spamFilter, comment.Content, false)
+			}
+		case ActionDelete:
+			trainSpamFilter(ctx, spamFilter, comment.Content, true)
+			if isFirst {
+				err = bbStore.DeleteTopic(ctx, topic.TopicID)
+			} else {
+				// Attachments are orphaned and removed by the
+				// cleanup process.
+				err = bbStore.DeleteComment(ctx, comment.CommentID)
+			}
+		case ActionLockTopic:
+			err = bbStore.SetTopicLocked(ctx, topic.TopicID, true)
+		case ActionBanAuthor:
+			err = bbStore.SetUserBanned(ctx, comment.Author.UserID, true)
+		}
+		if err != nil && !ErrNotFound.Is(err) {
+			surf.LogError(ctx, err, "cannot take moderation action",
+				"action", string(resolution.Action),
+				"comment", fmt.Sprint(resolution.CommentID))
+			if err := moderation.ReopenReports(ctx, resolved.ResolutionID); err != nil {
+				surf.LogError(ctx, err, "cannot reopen reports",
+					"resolution", fmt.Sprint(resolved.ResolutionID))
+			}
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		return surf.Redirect("/mod/queue/", http.StatusSeeOther)
+	}
+}
+
+// ModerationLogHandler lists all recorded resolutions.
+func ModerationLogHandler(
+	moderation ModerationStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	const resolutionsPerPage = 100
+
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, resp := currentModerator(w, r, authStore, rend)
+		if resp != nil {
+			return resp
+		}
+
+		createdLte, ok := timeFromParam(r.URL.Query(), "before")
+		if !ok {
+			createdLte = time.Now()
+		}
+		resolutions, err := moderation.ListResolutions(ctx, createdLte, resolutionsPerPage)
+		if err != nil {
+			surf.LogError(ctx, err, "cannot list resolutions")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		var nextPageBefore string
+		if len(resolutions) == resolutionsPerPage {
+			nextPageBefore = resolutions[len(resolutions)-1].Created.Format(time.RFC3339Nano)
+		}
+
+		return rend.Response(ctx, http.StatusOK, "moderation_log.tmpl", struct {
+			CurrentUser    *User
+			Resolutions    []*Resolution
+			NextPageBefore string
+		}{
+			CurrentUser:    user,
+			Resolutions:    resolutions,
+			NextPageBefore: nextPageBefore,
+		})
+	}
+}
+
+// UserReportsHandler lists reports created by the current user together
+// with their resolutions. Displaying the list acknowledges the notification
+// about resolved reports.
+func UserReportsHandler(
+	moderation ModerationStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUnauthenticated.Is(err):
+			return surf.Redirect("/login/?next="+url.QueryEscape(r.URL.String()), http.StatusTemporaryRedirect)
+		default:
+			surf.LogError(ctx, err, "cannot get current user")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		reports, err := moderation.ListUserReports(ctx, user.UserID, 100)
+		if err != nil {
+			surf.LogError(ctx, err, "cannot list reports",
+				"user", fmt.Sprint(user.UserID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+		if err := moderation.MarkResolvedSeen(ctx, user.UserID); err != nil {
+			surf.LogError(ctx, err, "cannot mark reports seen",
+				"user", fmt.Sprint(user.UserID))
+		}
+
+		return rend.Response(ctx, http.StatusOK, "report_list.tmpl", struct {
+			CurrentUser *User
+			Reports     []*Report
+		}{
+			CurrentUser: user,
+			Reports:     reports,
+		})
+	}
+}
+
+// TopicLockHandler allows moderators to lock or unlock the topic.
+func TopicLockHandler(
+	bbStore BBStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		if _, resp := currentModerator(w, r, authStore, rend); resp != nil {
+			return resp
+		}
+
+		topicID := surf.PathArgInt64(r, 0)
+		topic, err := bbStore.TopicByID(ctx, topicID)
+		switch {
+		case err == nil:
+			// All good.
+		case ErrNotFound.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusNotFound)
+		default:
+			surf.LogError(ctx, err, "cannot fetch topic",
+				"topic", fmt.Sprint(topicID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		if err := bbStore.SetTopicLocked(ctx, topicID, !topic.Locked); err != nil {
+			surf.LogError(ctx, err, "cannot lock topic",
+				"topic", fmt.Sprint(topicID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+		return surf.Redirect(lastCommentURL(topic, "bottom"), http.StatusSeeOther)
+	}
+}
+
+// UserBanHandler allows moderators to ban or unban the user.
+func UserBanHandler(
+	bbStore BBStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		moderator, resp := currentModerator(w, r, authStore, rend)
+		if resp != nil {
+			return resp
+		}
+
+		if err := r.ParseMultipartForm(1e6); err != nil {
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+
+		userID := surf.PathArgInt64(r, 0)
+		if userID == moderator.UserID {
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+		banned := r.Form.Get("ban") == "1"
+		if banned {
+			switch err := checkCanBan(ctx, bbStore, userID); {
+			case err == nil:
+				// All good.
+			case ErrPermission.Is(err):
+				return rend.Response(ctx, http.StatusOK, "error_scope.tmpl", struct {
+					Message string
+				}{
+					Message: "Administrators and moderators cannot be banned.",
+				})
+			case ErrNotFound.Is(err):
+				return surf.StdResponse(ctx, rend, http.StatusNotFound)
+			default:
+				surf.LogError(ctx, err, "cannot check ban permission",
+					"user", fmt.Sprint(userID))
+				return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+			}
+		}
+		switch err := bbStore.SetUserBanned(ctx, userID, banned); {
+		case err == nil:
+			surf.LogInfo(ctx, "user ban changed",
+				"user", fmt.Sprint(userID),
+				"banned", fmt.Sprint(banned),
+				"moderator", fmt.Sprint(moderator.UserID))
+		case ErrNotFound.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusNotFound)
+		default:
+			surf.LogError(ctx, err, "cannot ban user",
+				"user", fmt.Sprint(userID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+		return surf.Redirect(fmt.Sprintf("/u/%d/", userID), http.StatusSeeOther)
+	}
+}
+
+// checkCanBan returns ErrPermission if given user is an administrator or a
+// moderator. Staff scopes must be revoked before the ban.
+func checkCanBan(ctx context.Context, bbStore BBStore, userID int64) error {
+	info, err := bbStore.UserInfo(ctx, userID, 0)
+	if err != nil {
+		return errors.Wrap(err, "cannot get user")
+	}
+	if info.Scopes.HasAny(adminScope, moderatorScope) {
+		return errors.Wrap(ErrPermission, "user is a staff member")
+	}
+	return nil
+}
+
+// UserHideHandler allows moderators to hide or reveal the user. Content that
+// a hidden user creates is visible only to that user until approved.
+func UserHideHandler(
+	bbStore BBStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		moderator, resp := currentModerator(w, r, authStore, rend)
+		if resp != nil {
+			return resp
+		}
+
+		if err := r.ParseMultipartForm(1e6); err != nil {
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+
+		userID := surf.PathArgInt64(r, 0)
+		if userID == moderator.UserID {
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+		hidden := r.Form.Get("hide") == "1"
+		switch err := bbStore.SetUserHidden(ctx, userID, hidden); {
+		case err == nil:
+			surf.LogInfo(ctx, "user visibility changed",
+				"user", fmt.Sprint(userID),
+				"hidden", fmt.Sprint(hidden),
+				"moderator", fmt.Sprint(moderator.UserID))
+		case ErrNotFound.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusNotFound)
+		default:
+			surf.LogError(ctx, err, "cannot hide user",
+				"user", fmt.Sprint(userID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+		return surf.Redirect(fmt.Sprintf("/u/%d/", userID), http.StatusSeeOther)
+	}
+}
+
+// HiddenCommentListHandler lists comments of hidden users waiting for
+// moderator approval.
+func HiddenCommentListHandler(
+	bbStore BBStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, resp := currentModerator(w, r, authStore, rend)
+		if resp != nil {
+			return resp
+		}
+
+		comments, err := bbStore.ListHiddenComments(ctx, 100)
+		if err != nil {
+			surf.LogError(ctx, err, "cannot list hidden comments")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		return rend.Response(ctx, http.StatusOK, "hidden_comment_list.tmpl", struct {
+			CurrentUser *User
+			CsrfField   template.HTML
+			Comments    []*HiddenComment
+		}{
+			CurrentUser: user,
+			CsrfField:   surf.CsrfField(ctx),
+			Comments:    comments,
+		})
+	}
+}
+
+// HiddenCommentResolveHandler approves or deletes a hidden comment. Deleting
+// the first comment deletes the whole topic. Every decision trains the spam
+// filter.
+func HiddenCommentResolveHandler(
+	bbStore BBStore,
+	spamFilter SpamFilter,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		moderator, resp := currentModerator(w, r, authStore, rend)
+		if resp != nil {
+			return resp
+		}
+
+		if err := r.ParseMultipartForm(1e6); err != nil {
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+
+		commentID := surf.PathArgInt64(r, 0)
+		topic, comment, isFirst, err := bbStore.CommentByID(ctx, commentID)
+		switch {
+		case err == nil && comment.Hidden:
+			// All good.
+		case err == nil, ErrNotFound.Is(err):
+			// Another moderator was faster.
+			return surf.Redirect("/mod/hidden/", http.StatusSeeOther)
+		default:
+			surf.LogError(ctx, err, "cannot fetch comment",
+				"comment", fmt.Sprint(commentID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		text := comment.Content
+		if isFirst {
+			text = topic.Subject + "\n" + comment.Content
+		}
+
+		action := r.Form.Get("action")
+		switch action {
+		case "approve":
+			err = bbStore.ApproveComment(ctx, commentID)
+		case "delete":
+			if isFirst {
+				err = bbStore.DeleteTopic(ctx, topic.TopicID)
+			} else {
+				// Attachments are orphaned and removed by the
+				// cleanup process.
+				err = bbStore.DeleteComment(ctx, commentID)
+			}
+		default:
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+		switch {
+		case err == nil:
+			trainSpamFilter(ctx, spamFilter, text, action == "delete")
+		case ErrNotFound.Is(err):
+			// Another moderator was faster.
+		default:
+			surf.LogError(ctx, err, "cannot resolve hidden comment",
+				"comment", fmt.Sprint(commentID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		surf.LogInfo(ctx, "hidden comment resolved",
+			"comment", fmt.Sprint(commentID),
+			"action", action,
+			"moderator", fmt.Sprint(moderator.UserID))
+		return surf.Redirect("/mod/hidden/", http.StatusSeeOther)
+	}
+}
+
+// PendingPostListHandler lists topics and comments waiting for moderator
+// approval.
+func PendingPostListHandler(
+	pending PendingPostStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, resp := currentModerator(w, r, authStore, rend)
+		if resp != nil {
+			return resp
+		}
+
+		posts, err := pending.ListPendingPosts(ctx, 100)
+		if err != nil {
+			surf.LogError(ctx, err, "cannot list pending posts")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		return rend.Response(ctx, http.StatusOK, "pending_post_list.tmpl", struct {
+			CurrentUser *User
+			CsrfField   template.HTML
+			Posts       []*PendingPost
+		}{
+			CurrentUser: user,
+			CsrfField:   surf.CsrfField(ctx),
+			Posts:       posts,
+		})
+	}
+}
+
+// PendingPostResolveHandler publishes or rejects a post held for approval.
+// Every decision trains the spam filter.
+func PendingPostResolveHandler(
+	bbStore BBStore,
+	pending PendingPostStore,
+	polls PollStore,
+	attachments AttachmentStore,
+	references CommentReferenceStore,
+	spamFilter SpamFilter,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		moderator, resp := currentModerator(w, r, authStore, rend)
+		if resp != nil {
+			return resp
+		}
+
+		if err := r.ParseMultipartForm(1e6); err != nil {
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+
+		pendingID := surf.PathArgInt64(r, 0)
+		post, err := pending.PendingPostByID(ctx, pendingID)
+		switch {
+		case err == nil:
+			// All good.
+		case ErrNotFound.Is(err):
+			// Another moderator was faster.
+			return surf.Redirect("/mod/pending/", http.StatusSeeOther)
+		default:
+			surf.LogError(ctx, err, "cannot fetch pending post",
+				"pending", fmt.Sprint(pendingID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		text := post.Content
+		if post.TopicID == 0 {
+			text = post.Subject + "\n" + post.Content
+		}
+
+		switch action := r.Form.Get("action"); action {
+		case "approve":
+			switch err := publishPendingPost(ctx, bbStore, polls, attachments, references, post); {
+			case err == nil:
+				// All good.
+			case ErrUserBanned.Is(err):
+				return rend.Response(ctx, http.StatusBadRequest, "error_4xx.tmpl",
+					"The author is banned. The post can only be rejected.")
+			case ErrAttachmentNotFound.Is(err):
+				return rend.Response(ctx, http.StatusBadRequest, "error_4xx.tmpl",
+					"Attached files no longer exist. The post can only be rejected.")
+			case ErrNotFound.Is(err):
+				return rend.Response(ctx, http.StatusBadRequest, "error_4xx.tmpl",
+					"The topic no longer exists. The post can only be rejected.")
+			default:
+				surf.LogError(ctx, err, "cannot publish pending post",
+					"pending", fmt.Sprint(pendingID))
+				return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+			}
+			trainSpamFilter(ctx, spamFilter, text, false)
+		case "reject":
+			// Attachments are orphaned and removed by the cleanup
+			// process.
+			trainSpamFilter(ctx, spamFilter, text, true)
+		default:
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+
+		if err := pending.DeletePendingPost(ctx, pendingID); err != nil && !ErrNotFound.Is(err) {
+			surf.LogError(ctx, err, "cannot delete pending post",
+				"pending", fmt.Sprint(pendingID))
+		}
+		surf.LogInfo(ctx, "pending post resolved",
+			"pending", fmt.Sprint(pendingID),
+			"action", r.Form.Get("action"),
+			"moderator", fmt.Sprint(moderator.UserID))
+		return surf.Redirect("/mod/pending/", http.StatusSeeOther)
+	}
+}
+
+// publishPendingPost creates the topic or the comment that was held for
+// approval.
+func publishPendingPost(
+	ctx context.Context,
+	bbStore BBStore,
+	polls PollStore,
+	attachments AttachmentStore,
+	references CommentReferenceStore,
+	post *PendingPost,
+) error {
+	var (
+		comment  *Comment
+		newTopic *Topic
+	)
+	if post.TopicID == 0 {
+		topic, first, err := bbStore.CreateTopic(ctx, post.Subject, post.Content, post.Category, post.Author.UserID)
+		if err != nil {
+			return errors.Wrap(err, "cannot create topic")
+		}
+		if post.Poll != nil {
+			post.Poll.TopicID = topic.TopicID
+			if _, err := polls.CreatePoll(ctx, *post.Poll); err != nil {
+				surf.LogError(ctx, err, "cannot create poll",
+					"topic", fmt.Sprint(topic.TopicID))
+			}
+		}
+		comment, newTopic = first, topic
+	} else {
+		c, err := bbStore.CreateComment(ctx, post.TopicID, post.Content, post.Author.UserID)
+		if err != nil {
+			return errors.Wrap(err, "cannot create comment")
+		}
+		comment = c
+	}
+
+	// Post must not be published without its attachments. It stays
+	// pending, so that the moderator can try again or reject it.
+	if err := attachments.AttachToComment(ctx, comment.CommentID, post.AttachmentIDs); err != nil {
+		var derr error
+		if newTopic != nil {
+			derr = bbStore.DeleteTopic(ctx, newTopic.TopicID)
+		} else {
+			derr = bbStore.DeleteComment(ctx, comment.CommentID)
+		}
+		if derr != nil {
+			surf.LogError(ctx, derr, "cannot delete post published without attachments",
+				"comment", fmt.Sprint(comment.CommentID))
+		}
+		return errors.Wrap(err, "cannot attach files to comment")
+	}
+	if err := references.SetReferences(ctx, comment.CommentID, commentReferences(comment.Content)); err != nil {
+		surf.LogError(ctx, err, "cannot set comment references",
+			"comment", fmt.Sprint(comment.CommentID))
+	}
+	return nil
+}
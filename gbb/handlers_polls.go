@@ -0,0 +1,157 @@
+package gbb
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-surf/surf"
+)
+
+// pollInput is the poll definition submitted together with a new topic.
+type pollInput struct {
+	Question  string
+	Options   string
+	Multiple  bool
+	Anonymous bool
+	Closes    string
+}
+
+// pollCloseFormat is the format of the datetime-local input.
+const pollCloseFormat = "2006-01-02T15:04"
+
+// readPollInput reads poll definition from given form.
+func readPollInput(form url.Values) pollInput {
+	return pollInput{
+		Question:  strings.TrimSpace(form.Get("poll_question")),
+		Options:   strings.TrimSpace(form.Get("poll_options")),
+		Multiple:  form.Get("poll_multiple") != "",
+		Anonymous: form.Get("poll_anonymous") != "",
+		Closes:    strings.TrimSpace(form.Get("poll_closes")),
+	}
+}
+
+// Poll returns the poll described by the input or nil if no poll was
+// defined. Validation errors are written to given map.
+func (in pollInput) Poll(errs map[string]string) *Poll {
+	if in.Question == "" && in.Options == "" {
+		return nil
+	}
+
+	poll := Poll{
+		Question:  in.Question,
+		Multiple:  in.Multiple,
+		Anonymous: in.Anonymous,
+	}
+	if poll.Question == "" {
+		errs["Poll"] = "Poll question is required."
+	}
+	for _, label := range strings.Split(in.Options, "\n") {
+		if label = strings.TrimSpace(label); label != "" {
+			poll.Options = append(poll.Options, &PollOption{Label: label})
+		}
+	}
+	if n := len(poll.Options); n < 2 {
+		errs["Poll"] = "At least 2 poll options are required."
+	} else if n > maxPollOptions {
+		errs["Poll"] = fmt.Sprintf("At most %d poll options are allowed.", maxPollOptions)
+	}
+	if in.Closes != "" {
+		closes, err := time.ParseInLocation(pollCloseFormat, in.Closes, time.UTC)
+		if err != nil {
+			errs["Poll"] = "Invalid poll close date."
+		} else if closes.Before(time.Now()) {
+			errs["Poll"] = "Poll close date must be in the future."
+		}
+		poll.Closes = closes
+	}
+	return &poll
+}
+
+const maxPollOptions = 20
+
+// PollVoteHandler returns a HTTP handler that replaces the current user votes
+// in the topic poll.
+func PollVoteHandler(
+	bbStore BBStore,
+	polls PollStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUnauthenticated.Is(err):
+			return surf.Redirect("/login/?next="+url.QueryEscape(r.URL.String()), http.StatusTemporaryRedirect)
+		default:
+			surf.LogError(ctx, err, "cannot get current user")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		if resp := rejectUnlessCanComment(ctx, bbStore, rend, user, "Not allowed to vote."); resp != nil {
+			return resp
+		}
+
+		if err := r.ParseForm(); err != nil {
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+		var optionIDs []int64
+		for _, raw := range r.PostForm["option"] {
+			id, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil {
+				return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+			}
+			optionIDs = append(optionIDs, id)
+		}
+
+		topicID := surf.PathArgInt64(r, 0)
+		topic, err := bbStore.TopicByID(ctx, topicID)
+		switch {
+		case err == nil:
+			// All good.
+		case ErrNotFound.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusNotFound)
+		default:
+			surf.LogError(ctx, err, "cannot fetch topic",
+				"topic", fmt.Sprint(topicID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		poll, err := polls.PollByTopic(ctx, topic.TopicID, user.UserID)
+		switch {
+		case err == nil:
+			// All good.
+		case ErrNotFound.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusNotFound)
+		default:
+			surf.LogError(ctx, err, "cannot fetch poll",
+				"topic", fmt.Sprint(topic.TopicID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		switch err := polls.Vote(ctx, poll.PollID, user.UserID, optionIDs); {
+		case err == nil:
+			// All good.
+		case ErrMalformed.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		case ErrPermission.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusForbidden)
+		case ErrNotFound.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusNotFound)
+		default:
+			surf.LogError(ctx, err, "cannot vote",
+				"poll", fmt.Sprint(poll.PollID),
+				"user", fmt.Sprint(user.UserID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		return surf.Redirect(fmt.Sprintf("/t/%d/%s/#poll", topic.TopicID, topic.SlugInfo()), http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,114 @@
+package gbb
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/go-surf/surf"
+)
+
+// CommentReactHandler returns a HTTP handler that toggles the reaction of the
+// current user to a comment. Only reactions from the given set are accepted.
+func CommentReactHandler(
+	bbStore BBStore,
+	reactions ReactionStore,
+	reactionKinds []string,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUnauthenticated.Is(err):
+			return surf.Redirect("/login/?next="+url.QueryEscape(r.URL.String()), http.StatusTemporaryRedirect)
+		default:
+			surf.LogError(ctx, err, "cannot get current user")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		if resp := rejectUnlessCanComment(ctx, bbStore, rend, user, "Not allowed to react."); resp != nil {
+			return resp
+		}
+
+		reaction := r.PostFormValue("reaction")
+		if !containsString(reactionKinds, reaction) {
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+
+		commentID := surf.PathArgInt64(r, 0)
+		topic, comment, _, err := bbStore.CommentByID(ctx, commentID)
+		switch {
+		case err == nil:
+			// All good.
+		case ErrNotFound.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusNotFound)
+		default:
+			surf.LogError(ctx, err, "cannot fetch comment",
+				"comment", fmt.Sprint(commentID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		switch _, err := reactions.ToggleReaction(ctx, comment.CommentID, user.UserID, reaction); {
+		case err == nil:
+			// All good.
+		case ErrNotFound.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusNotFound)
+		default:
+			surf.LogError(ctx, err, "cannot toggle reaction",
+				"comment", fmt.Sprint(comment.CommentID),
+				"user", fmt.Sprint(user.UserID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		return surf.Redirect(commentURL(topic, comment), http.StatusSeeOther)
+	}
+}
+
+// reactionButton describes a single reaction that can be toggled on a
+// comment.
+type reactionButton struct {
+	Reaction string
+	Users    []User
+	// Reacted is true if the current user is one of the users.
+	Reacted bool
+}
+
+func (b *reactionButton) Count() int {
+	return len(b.Users)
+}
+
+// reactionButtons returns a button for each of given reaction kinds, filled
+// with the reactions of a single comment. Reactions that are not of any of
+// given kinds are ignored.
+func reactionButtons(kinds []string, reactions []*Reaction, user *User) []*reactionButton {
+	buttons := make([]*reactionButton, len(kinds))
+	for i, kind := range kinds {
+		buttons[i] = &reactionButton{Reaction: kind}
+		for _, r := range reactions {
+			if r.Reaction != kind {
+				continue
+			}
+			buttons[i].Users = r.Users
+			for _, u := range r.Users {
+				if user.Authenticated() && u.UserID == user.UserID {
+					buttons[i].Reacted = true
+				}
+			}
+		}
+	}
+	return buttons
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+package gbb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-surf/surf"
+)
+
+// unlockScopes grants the user all scopes earned by reaching given
+// thresholds. Returned user contains updated scopes.
+func unlockScopes(ctx context.Context, bbStore BBStore, thresholds []ScopeThreshold, user *User) (*User, error) {
+	// Only content visible to everyone counts.
+	info, err := bbStore.UserInfo(ctx, user.UserID, 0)
+	if err != nil {
+		return user, err
+	}
+	missing := info.EarnedScopes(thresholds).Remove(user.Scopes)
+	if missing == 0 {
+		return user, nil
+	}
+	if err := bbStore.GrantScopes(ctx, user.UserID, missing); err != nil {
+		return user, err
+	}
+	surf.LogInfo(ctx, "user scopes unlocked",
+		"user", fmt.Sprint(user.UserID),
+		"scopes", missing.String())
+	unlocked := *user
+	unlocked.Scopes = user.Scopes.Add(missing)
+	return &unlocked, nil
+}
+
+// refreshUserScopes unlocks earned scopes of the current user and updates the
+// authentication cache if anything has changed.
+func refreshUserScopes(
+	ctx context.Context,
+	bbStore BBStore,
+	thresholds []ScopeThreshold,
+	boundCache surf.CacheService,
+	user *User,
+) *User {
+	unlocked, err := unlockScopes(ctx, bbStore, thresholds, user)
+	if err != nil {
+		surf.LogError(ctx, err, "cannot unlock scopes",
+			"user", fmt.Sprint(user.UserID))
+		return user
+	}
+	if unlocked.Scopes == user.Scopes {
+		return user
+	}
+	if err := Login(ctx, boundCache, *unlocked); err != nil {
+		surf.LogError(ctx, err, "cannot update authenticated user",
+			"user", fmt.Sprint(user.UserID))
+	}
+	return unlocked
+}
+
+// CommentAcceptHandler returns a HTTP handler that marks a comment as the
+// accepted answer of its topic. Accepting already accepted comment removes
+// the mark. Only the topic author and moderators can accept comments.
+func CommentAcceptHandler(
+	bbStore BBStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUnauthenticated.Is(err):
+			return surf.Redirect("/login/?next="+url.QueryEscape(r.URL.String()), http.StatusTemporaryRedirect)
+		default:
+			surf.LogError(ctx, err, "cannot get current user")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		commentID := surf.PathArgInt64(r, 0)
+		topic, comment, isFirst, err := bbStore.CommentByID(ctx, commentID)
+		switch {
+		case err == nil:
+			// All good.
+		case ErrNotFound.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusNotFound)
+		default:
+			surf.LogError(ctx, err, "cannot fetch comment",
+				"comment", fmt.Sprint(commentID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		if !canAcceptComment(user, topic) {
+			return rend.Response(ctx, http.StatusOK, "error_scope.tmpl", struct {
+				Message string
+			}{
+				Message: "Only the topic author can accept an answer.",
+			})
+		}
+		if isFirst {
+			// The first comment is the topic itself.
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+
+		accepted := comment.CommentID
+		if topic.AcceptedCommentID == comment.CommentID {
+			accepted = 0
+		}
+		switch err := bbStore.AcceptComment(ctx, topic.TopicID, accepted); {
+		case err == nil:
+			// All good.
+		case ErrNotFound.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusNotFound)
+		default:
+			surf.LogError(ctx, err, "cannot accept comment",
+				"topic", fmt.Sprint(topic.TopicID),
+				"comment", fmt.Sprint(comment.CommentID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		return surf.Redirect(commentURL(topic, comment), http.StatusSeeOther)
+	}
+}
+
+// UserPenalizeHandler returns a HTTP handler that allows moderators to take
+// reputation points away from a user.
+func UserPenalizeHandler(
+	bbStore BBStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUnauthenticated.Is(err):
+			return surf.Redirect("/login/?next="+url.QueryEscape(r.URL.String()), http.StatusTemporaryRedirect)
+		default:
+			surf.LogError(ctx, err, "cannot get current user")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		if !user.Scopes.HasAny(adminScope, moderatorScope) {
+			surf.LogInfo(ctx, "user action rejected due to missing moderator scope",
+				"scopes", user.Scopes.String(),
+				"user", fmt.Sprint(user.UserID))
+			return rend.Response(ctx, http.StatusOK, "error_scope.tmpl", struct {
+				Message string
+			}{
+				Message: "Not allowed to penalize users.",
+			})
+		}
+
+		points, err := strconv.ParseInt(r.PostFormValue("points"), 10, 64)
+		if err != nil || points < 1 || points > maxPenaltyPoints {
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+		reason := strings.TrimSpace(r.PostFormValue("reason"))
+		if reason == "" {
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+
+		userID := surf.PathArgInt64(r, 0)
+		switch err := bbStore.PenalizeUser(ctx, userID, user.UserID, points, reason); {
+		case err == nil:
+			surf.LogInfo(ctx, "user penalized",
+				"user", fmt.Sprint(userID),
+				"moderator", fmt.Sprint(user.UserID),
+				"points", fmt.Sprint(points))
+		case ErrNotFound.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusNotFound)
+		default:
+			surf.LogError(ctx, err, "cannot penalize user",
+				"user", fmt.Sprint(userID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		return surf.Redirect(fmt.Sprintf("/u/%d/", userID), http.StatusSeeOther)
+	}
+}
+
+const maxPenaltyPoints = 1000
+
+// canAcceptComment returns true if given user can mark comments of the topic
+// as the accepted answer.
+func canAcceptComment(user *User, topic *Topic) bool {
+	if !user.Authenticated() {
+		return false
+	}
+	return user.UserID == topic.Author.UserID || user.Scopes.HasAny(adminScope, moderatorScope)
+}
@@ -0,0 +1,189 @@
+package gbb
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/husio/gbb/oidc"
+)
+
+// SingleSignOn configures signing in with an external OpenID Connect
+// provider.
+type SingleSignOn struct {
+	Provider *oidc.Provider
+	// Name of the provider, displayed on the login page.
+	Name string
+	// GroupScopes maps the provider groups to scopes. Mapped scopes are
+	// synchronized on every sign in, so that leaving a group revokes its
+	// scopes.
+	GroupScopes map[string]UserScope
+	// Registration decides if a local user is created for a subject that
+	// signs in for the first time. Only the open mode allows it.
+	Registration RegistrationMode
+}
+
+// localLoginDisabled returns true if users must sign in using the identity
+// provider. Password login cannot be disabled without single sign-on.
+func localLoginDisabled(ctx context.Context, sso *SingleSignOn, identities IdentityStore) bool {
+	if sso == nil {
+		return false
+	}
+	disabled, err := identities.LocalLoginDisabled(ctx)
+	if err != nil {
+		surf.LogError(ctx, err, "cannot get login policy")
+		return true
+	}
+	return disabled
+}
+
+// signOnUserName returns the name for the user created on the first sign in.
+// Claims are tried in order of preference until one fits the limits of the
+// registration form.
+func signOnUserName(claims *oidc.Claims) string {
+	email := claims.Email
+	if i := strings.Index(email, "@"); i >= 0 {
+		email = email[:i]
+	}
+	for _, name := range []string{claims.PreferredUsername, claims.Name, email} {
+		name = strings.TrimSpace(truncateName(strings.Join(strings.Fields(name), " "), 30))
+		if len(name) >= 3 {
+			return name
+		}
+	}
+	return "user"
+}
+
+// pendingSignOn is kept in the session between redirecting the user to the
+// provider and the provider redirecting back.
+type pendingSignOn struct {
+	Request oidc.AuthRequest
+	Next    string
+}
+
+// SingleSignOnHandler starts signing in by redirecting the user to the
+// identity provider.
+func SingleSignOnHandler(
+	authStore surf.UnboundCacheService,
+	sso *SingleSignOn,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		authReq, err := oidc.NewAuthRequest()
+		if err != nil {
+			surf.LogError(ctx, err, "cannot create authorization request")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+		pending := pendingSignOn{
+			Request: *authReq,
+			Next:    r.URL.Query().Get("next"),
+		}
+		if err := authStore.Bind(w, r).Set(ctx, "sso-request", pending, 10*time.Minute); err != nil {
+			surf.LogError(ctx, err, "cannot store authorization request in cache")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+		return surf.Redirect(sso.Provider.AuthCodeURL(authReq), http.StatusSeeOther)
+	}
+}
+
+// SingleSignOnCallbackHandler completes signing in when the identity
+// provider redirects the user back. A local user is created on the first
+// sign in and linked to the external identity.
+func SingleSignOnCallbackHandler(
+	authStore surf.UnboundCacheService,
+	bbStore BBStore,
+	identities IdentityStore,
+	twoFactor TwoFactorStore,
+	sso *SingleSignOn,
+	scopeThresholds []ScopeThreshold,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		boundCache := authStore.Bind(w, r)
+
+		var pending pendingSignOn
+		switch err := boundCache.Get(ctx, "sso-request", &pending); {
+		case err == nil:
+			if err := boundCache.Del(ctx, "sso-request"); err != nil {
+				surf.LogError(ctx, err, "cannot delete authorization request from cache")
+			}
+		case surf.ErrNotFound.Is(err):
+			return rend.Response(ctx, http.StatusBadRequest, "error_4xx.tmpl", "Sign in expired. Please try again.")
+		default:
+			surf.LogError(ctx, err, "cannot get authorization request from cache")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		query := r.URL.Query()
+		if e := query.Get("error"); e != "" {
+			surf.LogInfo(ctx, "sign in rejected by provider",
+				"error", e,
+				"description", query.Get("error_description"))
+			return rend.Response(ctx, http.StatusForbidden, "error_4xx.tmpl", "Sign in was rejected by the identity provider.")
+		}
+		if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(pending.Request.State)) != 1 {
+			surf.LogInfo(ctx, "sign in state mismatch")
+			return rend.Response(ctx, http.StatusBadRequest, "error_4xx.tmpl", "Sign in expired. Please try again.")
+		}
+
+		claims, err := sso.Provider.Exchange(ctx, &pending.Request, query.Get("code"))
+		if err != nil {
+			surf.LogError(ctx, err, "cannot exchange authorization code")
+			return rend.Response(ctx, http.StatusBadGateway, "error_4xx.tmpl", "Cannot sign in with the identity provider.")
+		}
+
+		user, err := externalUser(ctx, bbStore, identities, sso.Provider.Issuer, claims.Subject, signOnUserName(claims), sso.GroupScopes, claims.Groups, sso.Registration, scopeThresholds)
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUserBanned.Is(err):
+			surf.LogInfo(ctx, "banned user authentication attempt",
+				"subject", claims.Subject)
+			return rend.Response(ctx, http.StatusForbidden, "error_4xx.tmpl", "This account is banned.")
+		case ErrRegistrationClosed.Is(err):
+			surf.LogInfo(ctx, "sign in of unknown user rejected by registration mode",
+				"subject", claims.Subject)
+			return rend.Response(ctx, http.StatusForbidden, "error_4xx.tmpl", "There is no account for this identity and registration is closed.")
+		default:
+			surf.LogError(ctx, err, "cannot get external user",
+				"subject", claims.Subject)
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		if unlocked, err := unlockScopes(ctx, bbStore, scopeThresholds, user); err != nil {
+			surf.LogError(ctx, err, "cannot unlock scopes",
+				"user", fmt.Sprint(user.UserID))
+		} else {
+			user = unlocked
+		}
+
+		next := pending.Next
+		if !isLocalPath(next) {
+			next = "/"
+		}
+		next, err = beginSession(ctx, boundCache, twoFactor, *user, next)
+		if err != nil {
+			surf.LogError(ctx, err, "cannot begin session",
+				"user", fmt.Sprint(user.UserID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+		return surf.Redirect(next, http.StatusSeeOther)
+	}
+}
+
+// loginURL returns the login page address that redirects to next afterwards.
+func loginURL(next string) string {
+	if next == "" {
+		return "/login/"
+	}
+	return "/login/?next=" + url.QueryEscape(next)
+}
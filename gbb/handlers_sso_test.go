@@ -0,0 +1,40 @@
+package gbb
+
+import (
+	"testing"
+
+	"github.com/husio/gbb/oidc"
+)
+
+func TestSignOnUserName(t *testing.T) {
+	cases := map[string]struct {
+		claims oidc.Claims
+		want   string
+	}{
+		"preferred username": {
+			claims: oidc.Claims{PreferredUsername: "bob", Name: "Bob Bobby", Email: "b@example.com"},
+			want:   "bob",
+		},
+		"too short username": {
+			claims: oidc.Claims{PreferredUsername: "b", Name: "  Bob   Bobby ", Email: "b@example.com"},
+			want:   "Bob Bobby",
+		},
+		"email": {
+			claims: oidc.Claims{Email: "bobby@example.com"},
+			want:   "bobby",
+		},
+		"too long": {
+			claims: oidc.Claims{Name: "Łukasz Łukaszewicz-Łukaszewski Junior"},
+			want:   "Łukasz Łukaszewicz-Łukaszew",
+		},
+		"nothing": {
+			claims: oidc.Claims{Subject: "1234"},
+			want:   "user",
+		},
+	}
+	for name, tc := range cases {
+		if got := signOnUserName(&tc.claims); got != tc.want {
+			t.Errorf("%s: want %q, got %q", name, tc.want, got)
+		}
+	}
+}
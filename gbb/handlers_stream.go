@@ -0,0 +1,366 @@
+package gbb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-surf/surf"
+)
+
+// CommentStreamHandler returns a HTTP handler that streams newly created
+// comments of a single topic using Server-Sent Events. Each comment is
+// rendered using the same template as the comment list.
+func CommentStreamHandler(
+	bbStore BBStore,
+	readTracker ReadProgressTracker,
+	events TopicEventBroker,
+	reactionKinds []string,
+	attachments AttachmentStore,
+	authStore surf.UnboundCacheService,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		topicID := surf.PathArgInt64(r, 0)
+
+		user, err := CurrentUser(ctx, authStore.Bind(w, r))
+		if err != nil && !ErrUnauthenticated.Is(err) {
+			surf.LogError(ctx, err, "cannot authenticate user")
+		}
+
+		topic, err := bbStore.TopicByID(ctx, topicID)
+		switch {
+		case err == nil:
+			// All good.
+		case ErrNotFound.Is(err):
+			return surf.StdResponse(ctx, rend, http.StatusNotFound)
+		default:
+			surf.LogError(ctx, err, "cannot fetch topic",
+				"topic", fmt.Sprint(topicID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		// Subscribe before looking for missed comments, so that nothing
+		// created in between is lost.
+		stream, err := events.Subscribe(ctx, topic.TopicID)
+		if err != nil {
+			surf.LogError(ctx, err, "cannot subscribe to topic events",
+				"topic", fmt.Sprint(topic.TopicID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		canModify := func(comment *Comment) bool {
+			if !user.Authenticated() {
+				return false
+			}
+			if user.UserID == comment.Author.UserID {
+				return true
+			}
+			return user.Scopes.HasAny(adminScope, moderatorScope)
+		}
+
+		// Render given comments and mark them as read.
+		render := func(comments []*Comment) (string, error) {
+			if len(comments) == 0 {
+				return "", nil
+			}
+			commentIDs := make([]int64, len(comments))
+			for i, c := range comments {
+				commentIDs[i] = c.CommentID
+			}
+			commentAttachments, err := attachments.ListAttachments(ctx, commentIDs)
+			if err != nil {
+				surf.LogError(ctx, err, "cannot fetch attachments",
+					"topic", fmt.Sprint(topic.TopicID))
+			}
+			html, err := renderFragment(ctx, rend, "comment-list-entries", struct {
+				CurrentUser *User
+				CsrfField   template.HTML
+				Topic       *Topic
+				Comments    []*Comment
+				CanModify   func(*Comment) bool
+				CanAccept   func(*Comment) bool
+				Reactions   func(*Comment) []*reactionButton
+				Attachments func(*Comment) []*Attachment
+				Replies     func(*Comment) []*Reply
+			}{
+				CurrentUser: user,
+				CsrfField:   surf.CsrfField(ctx),
+				Topic:       topic,
+				Comments:    comments,
+				CanModify:   canModify,
+				CanAccept: func(*Comment) bool {
+					return canAcceptComment(user, topic)
+				},
+				Reactions: func(*Comment) []*reactionButton {
+					// Comments are pushed right after they are
+					// created, so nobody reacted to them yet.
+					return reactionButtons(reactionKinds, nil, user)
+				},
+				Attachments: func(comment *Comment) []*Attachment {
+					return commentAttachments[comment.CommentID]
+				},
+				Replies: func(*Comment) []*Reply {
+					// Streamed comments are new, so replies
+					// are displayed after the page reload.
+					return nil
+				},
+			})
+			if err != nil {
+				return "", err
+			}
+
+			if user.Authenticated() {
+				last := comments[len(comments)-1]
+				err := readTracker.Track(ctx, ReadProgress{
+					UserID:         user.UserID,
+					TopicID:        topic.TopicID,
+					CommentID:      last.CommentID,
+					CommentCreated: last.Created,
+				})
+				if err != nil {
+					surf.LogError(ctx, err, "cannot track comment",
+						"user", fmt.Sprint(user.UserID),
+						"topic", fmt.Sprint(topic.TopicID),
+						"comment", fmt.Sprint(last.CommentID))
+				}
+			}
+			return html, nil
+		}
+
+		var missed []*Comment
+		if lastID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64); lastID > 0 {
+			// Client is reconnecting. Send everything it did not
+			// receive so far.
+			if _, last, _, err := bbStore.CommentByID(ctx, lastID); err != nil {
+				surf.LogError(ctx, err, "cannot fetch last seen comment",
+					"comment", fmt.Sprint(lastID))
+			} else if missed, err = bbStore.ListComments(ctx, topic.TopicID, user.ViewerID(), last.Cursor(), commentsPerPage); err != nil {
+				surf.LogError(ctx, err, "cannot fetch missed comments",
+					"topic", fmt.Sprint(topic.TopicID))
+			} else if len(missed) > 0 && missed[0].CommentID == last.CommentID {
+				// Cursor is inclusive, but the client already
+				// has this comment.
+				missed = missed[1:]
+			}
+		}
+
+		return &eventStreamResponse{
+			ctx: ctx,
+			stream: func(send func(sseEvent) error) error {
+				if html, err := render(missed); err != nil {
+					return err
+				} else if html != "" {
+					last := missed[len(missed)-1]
+					if err := send(sseEvent{Name: "comment", ID: last.CommentID, Data: html}); err != nil {
+						return err
+					}
+				}
+
+				for ev := range stream {
+					_, comment, _, err := bbStore.CommentByID(ctx, ev.CommentID)
+					switch {
+					case err == nil:
+						// All good.
+					case ErrNotFound.Is(err):
+						// Comment was deleted in the meantime.
+						continue
+					default:
+						return err
+					}
+					html, err := render([]*Comment{comment})
+					if err != nil {
+						return err
+					}
+					if err := send(sseEvent{Name: "comment", ID: comment.CommentID, Data: html}); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		}
+	}
+}
+
+// TopicStreamHandler returns a HTTP handler that streams topic activity of
+// all topics using Server-Sent Events.
+func TopicStreamHandler(
+	events TopicEventBroker,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	type topicBump struct {
+		TopicID       int64  `json:"topic_id"`
+		CommentID     int64  `json:"comment_id"`
+		Subject       string `json:"subject"`
+		CommentsCount int64  `json:"comments_count"`
+		URL           string `json:"url"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		stream, err := events.Subscribe(ctx, 0)
+		if err != nil {
+			surf.LogError(ctx, err, "cannot subscribe to topic events")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		return &eventStreamResponse{
+			ctx: ctx,
+			stream: func(send func(sseEvent) error) error {
+				for ev := range stream {
+					// Event describes the topic, so that it does
+					// not have to be fetched for every subscriber.
+					topic := &Topic{
+						TopicID:       ev.TopicID,
+						Subject:       ev.Subject,
+						Created:       ev.TopicCreated,
+						CommentsCount: ev.CommentsCount,
+					}
+					data, err := json.Marshal(topicBump{
+						TopicID:       topic.TopicID,
+						CommentID:     ev.CommentID,
+						Subject:       topic.Subject,
+						CommentsCount: topic.CommentsCount,
+						URL:           fmt.Sprintf("/t/%d/last-seen-comment/%s/", topic.TopicID, topic.SlugInfo()),
+					})
+					if err != nil {
+						return err
+					}
+					if err := send(sseEvent{Name: "topic", Data: string(data)}); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		}
+	}
+}
+
+type sseEvent struct {
+	Name string
+	ID   int64
+	Data string
+}
+
+// eventStreamResponse is a Response that keeps the connection open and
+// writes events in the text/event-stream format until the stream function
+// returns.
+type eventStreamResponse struct {
+	// Handler's context must be used, because the one attached to the
+	// request passed to ServeHTTP is missing the logger.
+	ctx    context.Context
+	stream func(send func(sseEvent) error) error
+}
+
+func (resp *eventStreamResponse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := resp.ctx
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusNotImplemented)
+		return
+	}
+
+	header := w.Header()
+	header.Set("content-type", "text/event-stream")
+	header.Set("cache-control", "no-cache")
+	header.Set("x-accel-buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	events := make(chan sseEvent)
+	failed := make(chan error, 1)
+	go func() {
+		failed <- resp.stream(func(ev sseEvent) error {
+			select {
+			case events <- ev:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-failed:
+			if err != nil && err != context.Canceled {
+				surf.LogError(ctx, err, "event stream failed")
+			}
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case ev := <-events:
+			if err := writeSSEEvent(w, ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeSSEEvent(w io.Writer, ev sseEvent) error {
+	var b bytes.Buffer
+	if ev.Name != "" {
+		fmt.Fprintf(&b, "event: %s\n", ev.Name)
+	}
+	if ev.ID != 0 {
+		fmt.Fprintf(&b, "id: %d\n", ev.ID)
+	}
+	for _, line := range strings.Split(ev.Data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", strings.TrimRight(line, "\r"))
+	}
+	b.WriteString("\n")
+	_, err := b.WriteTo(w)
+	return err
+}
+
+// renderFragment executes given template and returns the result as a string.
+func renderFragment(ctx context.Context, rend surf.HTMLRenderer, templateName string, data interface{}) (string, error) {
+	var w fragmentWriter
+	w.code = http.StatusOK
+	rend.Response(ctx, http.StatusOK, templateName, data).ServeHTTP(&w, nil)
+	if w.code != http.StatusOK {
+		return "", fmt.Errorf("cannot render %s template: response code %d", templateName, w.code)
+	}
+	return w.body.String(), nil
+}
+
+type fragmentWriter struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *fragmentWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = make(http.Header)
+	}
+	return w.header
+}
+
+func (w *fragmentWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *fragmentWriter) WriteHeader(code int) {
+	w.code = code
+}
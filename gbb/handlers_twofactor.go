@@ -0,0 +1,380 @@
+package gbb
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/husio/gbb/totp"
+	"rsc.io/qr"
+)
+
+// privilegedScopes are the scopes that require two-factor authentication when
+// it is mandatory.
+const privilegedScopes = adminScope | moderatorScope
+
+const recoveryCodesCount = 10
+
+// generateRecoveryCodes returns new random recovery codes, formatted as two
+// groups of five characters.
+func generateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	raw := make([]byte, 10*n)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, errors.Wrap(err, "cannot read random")
+	}
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for i := range codes {
+		code := strings.ToLower(enc.EncodeToString(raw[i*10 : (i+1)*10]))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode returns the recovery code in the format it was
+// generated in, so that users can type it without the separator or with a
+// different case.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	if len(code) != 10 {
+		return code
+	}
+	return code[:5] + "-" + code[5:]
+}
+
+// verifySecondFactor returns nil if given code is a valid TOTP code or an
+// unused recovery code of the user. Both kinds of codes can be used only once.
+func verifySecondFactor(ctx context.Context, twoFactor TwoFactorStore, userID int64, secret, code string) error {
+	if step, ok := totp.Validate(secret, code, time.Now()); ok {
+		return twoFactor.UseTimeStep(ctx, userID, step)
+	}
+	return twoFactor.UseRecoveryCode(ctx, userID, normalizeRecoveryCode(code))
+}
+
+// qrCodeImage returns given text encoded as a QR code PNG image, ready to be
+// used as a src value of an image tag.
+func qrCodeImage(text string) (template.URL, error) {
+	code, err := qr.Encode(text, qr.M)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot encode QR code")
+	}
+	code.Scale = 4
+	var b bytes.Buffer
+	b.WriteString("data:image/png;base64,")
+	b.WriteString(base64.StdEncoding.EncodeToString(code.PNG()))
+	return template.URL(b.String()), nil
+}
+
+// beginSession logs the authenticated user in and returns the address the
+// user should be redirected to. Next is used only if it is a local path. User
+// that enabled two-factor authentication is only kept aside until a valid
+// code is provided. Privileged scopes are withheld if two-factor
+// authentication is required but not enabled.
+func beginSession(ctx context.Context, boundCache surf.CacheService, twoFactor TwoFactorStore, user User, next string) (string, error) {
+	if !isLocalPath(next) {
+		next = "/"
+	}
+	switch _, err := twoFactor.TwoFactorSecret(ctx, user.UserID); {
+	case err == nil:
+		if err := boundCache.Set(ctx, "2fa-user", user, 5*time.Minute); err != nil {
+			return "", errors.Wrap(err, "cannot store pending user in cache")
+		}
+		return "/login/2fa/?next=" + url.QueryEscape(next), nil
+	case ErrTwoFactorNotFound.Is(err):
+		if !user.Scopes.HasAny(privilegedScopes) {
+			break
+		}
+		if required, err := twoFactor.TwoFactorRequired(ctx); err != nil {
+			surf.LogError(ctx, err, "cannot get two factor policy")
+			user.Scopes = user.Scopes.Remove(privilegedScopes)
+		} else if required {
+			user.Scopes = user.Scopes.Remove(privilegedScopes)
+		}
+		if !user.Scopes.HasAny(privilegedScopes) {
+			next = "/account/2fa/"
+		}
+	default:
+		return "", errors.Wrap(err, "cannot get two factor secret")
+	}
+
+	if err := Login(ctx, boundCache, user); err != nil {
+		return "", errors.Wrap(err, "cannot login user")
+	}
+	return next, nil
+}
+
+// LoginTwoFactorHandler is the second step of the login, for users that
+// enabled two-factor authentication. User that provided a valid password is
+// kept aside until a valid code is provided.
+func LoginTwoFactorHandler(
+	authStore surf.UnboundCacheService,
+	twoFactor TwoFactorStore,
+	attemptsLimit *RateLimiter,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		boundCache := authStore.Bind(w, r)
+
+		next := r.FormValue("next")
+		if !isLocalPath(next) {
+			next = "/"
+		}
+
+		var user User
+		switch err := boundCache.Get(ctx, "2fa-user", &user); {
+		case err == nil:
+			// All good.
+		case surf.ErrNotFound.Is(err):
+			// Password step was not done or it expired.
+			return surf.Redirect("/login/?next="+url.QueryEscape(next), http.StatusSeeOther)
+		default:
+			surf.LogError(ctx, err, "cannot get pending user from cache")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		var errors []string
+
+		if r.Method == "POST" {
+			code := strings.TrimSpace(r.FormValue("code"))
+			if !attemptsLimit.Allow(fmt.Sprint(user.UserID)) {
+				surf.LogInfo(ctx, "too many two factor attempts",
+					"user", fmt.Sprint(user.UserID))
+				errors = append(errors, "Too many attempts. Please try again later.")
+			} else if secret, err := twoFactor.TwoFactorSecret(ctx, user.UserID); err != nil {
+				surf.LogError(ctx, err, "cannot get two factor secret",
+					"user", fmt.Sprint(user.UserID))
+				errors = append(errors, "Temporary issues. Please try again later.")
+			} else {
+				switch err := verifySecondFactor(ctx, twoFactor, user.UserID, secret, code); {
+				case err == nil:
+					if err := boundCache.Del(ctx, "2fa-user"); err != nil {
+						surf.LogError(ctx, err, "cannot delete pending user from cache")
+					}
+					if err := Login(ctx, boundCache, user); err != nil {
+						surf.LogError(ctx, err, "cannot login user",
+							"user", fmt.Sprint(user.UserID))
+						errors = append(errors, "Temporary issues. Please try again later.")
+					} else {
+						return surf.Redirect(next, http.StatusSeeOther)
+					}
+				case ErrPermission.Is(err):
+					surf.LogInfo(ctx, "invalid two factor code",
+						"user", fmt.Sprint(user.UserID))
+					errors = append(errors, "Invalid code.")
+				default:
+					surf.LogError(ctx, err, "cannot verify two factor code",
+						"user", fmt.Sprint(user.UserID))
+					errors = append(errors, "Temporary issues. Please try again later.")
+				}
+			}
+		}
+
+		code := http.StatusOK
+		if len(errors) != 0 {
+			code = http.StatusBadRequest
+		}
+		return rend.Response(ctx, code, "login_twofactor.tmpl", struct {
+			Errors    []string
+			Next      string
+			CsrfField template.HTML
+		}{
+			Errors:    errors,
+			Next:      next,
+			CsrfField: surf.CsrfField(ctx),
+		})
+	}
+}
+
+// TwoFactorSettingsHandler allows the current user to enable or disable
+// two-factor authentication. Enabling it displays recovery codes, that are
+// never shown again.
+func TwoFactorSettingsHandler(
+	authStore surf.UnboundCacheService,
+	bbStore BBStore,
+	twoFactor TwoFactorStore,
+	rend surf.HTMLRenderer,
+) surf.HandlerFunc {
+	type Content struct {
+		CurrentUser   *User
+		CsrfField     template.HTML
+		Enabled       bool
+		Required      bool
+		RecoveryLeft  int64
+		RecoveryCodes []string
+		Secret        string
+		QRCode        template.URL
+		Error         string
+	}
+	return func(w http.ResponseWriter, r *http.Request) surf.Response {
+		ctx := r.Context()
+
+		boundCache := authStore.Bind(w, r)
+
+		user, err := CurrentUser(ctx, boundCache)
+		switch {
+		case err == nil:
+			// All good.
+		case ErrUnauthenticated.Is(err):
+			return surf.Redirect("/login/?next="+url.QueryEscape(r.URL.String()), http.StatusTemporaryRedirect)
+		default:
+			surf.LogError(ctx, err, "cannot get current user")
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		// User scopes might be reduced until two-factor authentication
+		// is enabled, so the stored ones must be checked.
+		info, err := bbStore.UserInfo(ctx, user.UserID, user.UserID)
+		if err != nil {
+			surf.LogError(ctx, err, "cannot get user info",
+				"user", fmt.Sprint(user.UserID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+		required, err := twoFactor.TwoFactorRequired(ctx)
+		if err != nil {
+			surf.LogError(ctx, err, "cannot get two factor policy")
+		}
+
+		content := Content{
+			CurrentUser: user,
+			CsrfField:   surf.CsrfField(ctx),
+			Required:    required && info.Scopes.HasAny(privilegedScopes),
+		}
+
+		secret, err := twoFactor.TwoFactorSecret(ctx, user.UserID)
+		switch {
+		case err == nil:
+			content.Enabled = true
+		case ErrTwoFactorNotFound.Is(err):
+			// Enrolment secret is kept in the session until the
+			// user confirms it with a valid code.
+			if err := boundCache.Get(ctx, "2fa-secret", &secret); err != nil {
+				if !surf.ErrNotFound.Is(err) {
+					surf.LogError(ctx, err, "cannot get enrolment secret from cache")
+				}
+				if secret, err = totp.GenerateSecret(); err != nil {
+					surf.LogError(ctx, err, "cannot generate secret")
+					return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+				}
+				if err := boundCache.Set(ctx, "2fa-secret", secret, time.Hour); err != nil {
+					surf.LogError(ctx, err, "cannot store enrolment secret in cache")
+					return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+				}
+			}
+		default:
+			surf.LogError(ctx, err, "cannot get two factor secret",
+				"user", fmt.Sprint(user.UserID))
+			return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+		}
+
+		render := func(code int) surf.Response {
+			if content.Enabled {
+				if n, err := twoFactor.CountRecoveryCodes(ctx, user.UserID); err != nil {
+					surf.LogError(ctx, err, "cannot count recovery codes",
+						"user", fmt.Sprint(user.UserID))
+				} else {
+					content.RecoveryLeft = n
+				}
+			} else {
+				img, err := qrCodeImage(totp.URL("gbb", user.Name, secret))
+				if err != nil {
+					surf.LogError(ctx, err, "cannot render QR code")
+				}
+				content.Secret = secret
+				content.QRCode = img
+			}
+			return rend.Response(ctx, code, "twofactor_settings.tmpl", content)
+		}
+
+		if r.Method != "POST" {
+			return render(http.StatusOK)
+		}
+
+		if err := r.ParseMultipartForm(1e6); err != nil {
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+		code := strings.TrimSpace(r.Form.Get("code"))
+
+		switch r.Form.Get("action") {
+		case "enable":
+			if content.Enabled {
+				return surf.Redirect(r.URL.Path, http.StatusSeeOther)
+			}
+			step, ok := totp.Validate(secret, code, time.Now())
+			if !ok {
+				content.Error = "Invalid code. Make sure the clock of your device is correct."
+				return render(http.StatusBadRequest)
+			}
+			codes, err := generateRecoveryCodes(recoveryCodesCount)
+			if err != nil {
+				surf.LogError(ctx, err, "cannot generate recovery codes")
+				return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+			}
+			if err := twoFactor.EnableTwoFactor(ctx, user.UserID, secret, codes); err != nil {
+				surf.LogError(ctx, err, "cannot enable two factor",
+					"user", fmt.Sprint(user.UserID))
+				return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+			}
+			if err := twoFactor.UseTimeStep(ctx, user.UserID, step); err != nil {
+				surf.LogError(ctx, err, "cannot mark time step used",
+					"user", fmt.Sprint(user.UserID))
+			}
+			if err := boundCache.Del(ctx, "2fa-secret"); err != nil {
+				surf.LogError(ctx, err, "cannot delete enrolment secret from cache")
+			}
+			// Restore scopes that were withheld until now.
+			if info.Scopes != user.Scopes {
+				if err := Login(ctx, boundCache, info.User); err != nil {
+					surf.LogError(ctx, err, "cannot update authenticated user",
+						"user", fmt.Sprint(user.UserID))
+				}
+				content.CurrentUser = &info.User
+			}
+			surf.LogInfo(ctx, "two factor enabled",
+				"user", fmt.Sprint(user.UserID))
+			content.Enabled = true
+			content.RecoveryCodes = codes
+			return render(http.StatusOK)
+		case "disable":
+			if !content.Enabled {
+				return surf.Redirect(r.URL.Path, http.StatusSeeOther)
+			}
+			if content.Required {
+				content.Error = "Two-factor authentication is mandatory for your account."
+				return render(http.StatusBadRequest)
+			}
+			switch err := verifySecondFactor(ctx, twoFactor, user.UserID, secret, code); {
+			case err == nil:
+				// All good.
+			case ErrPermission.Is(err):
+				content.Error = "Invalid code."
+				return render(http.StatusBadRequest)
+			default:
+				surf.LogError(ctx, err, "cannot verify two factor code",
+					"user", fmt.Sprint(user.UserID))
+				return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+			}
+			if err := twoFactor.DisableTwoFactor(ctx, user.UserID); err != nil {
+				surf.LogError(ctx, err, "cannot disable two factor",
+					"user", fmt.Sprint(user.UserID))
+				return surf.StdResponse(ctx, rend, http.StatusInternalServerError)
+			}
+			surf.LogInfo(ctx, "two factor disabled",
+				"user", fmt.Sprint(user.UserID))
+			return surf.Redirect(r.URL.Path, http.StatusSeeOther)
+		default:
+			return surf.StdResponse(ctx, rend, http.StatusBadRequest)
+		}
+	}
+}
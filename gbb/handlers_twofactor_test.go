@@ -0,0 +1,55 @@
+package gbb
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-surf/surf"
+)
+
+func TestBeginSessionNext(t *testing.T) {
+	authStore, err := surf.NewCookieCache("auth", []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]struct {
+		twoFactor bool
+		next      string
+		want      string
+	}{
+		"local path":            {next: "/t/1/", want: "/t/1/"},
+		"empty":                 {next: "", want: "/"},
+		"other site":            {next: "https://example.com/", want: "/"},
+		"protocol relative":     {next: "//example.com/", want: "/"},
+		"two factor local path": {twoFactor: true, next: "/t/1/", want: "/login/2fa/?next=%2Ft%2F1%2F"},
+		"two factor other site": {twoFactor: true, next: "https://example.com/", want: "/login/2fa/?next=%2F"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/login/", nil)
+			twoFactor := &sessionTwoFactorStore{enabled: tc.twoFactor}
+			got, err := beginSession(context.Background(), authStore.Bind(w, r), twoFactor, User{UserID: 1, Name: "bob"}, tc.next)
+			if err != nil {
+				t.Fatalf("cannot begin session: %s", err)
+			}
+			if got != tc.want {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+type sessionTwoFactorStore struct {
+	TwoFactorStore
+
+	enabled bool
+}
+
+func (s *sessionTwoFactorStore) TwoFactorSecret(ctx context.Context, userID int64) (string, error) {
+	if !s.enabled {
+		return "", ErrTwoFactorNotFound
+	}
+	return "secret", nil
+}
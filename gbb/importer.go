@@ -0,0 +1,304 @@
+package gbb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-surf/surf/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ForeignUser is a user of another forum.
+type ForeignUser struct {
+	ID   string
+	Name string
+	// PasswordHash is the bcrypt hash of the user password. Users with
+	// no or other kind of hash cannot sign in with a password.
+	PasswordHash string
+}
+
+// ForeignCategory is a category of another forum. Categories are matched with
+// existing ones by their names.
+type ForeignCategory struct {
+	ID   string
+	Name string
+}
+
+// ForeignTopic is a topic of another forum. Content of the topic is its
+// earliest comment.
+type ForeignTopic struct {
+	ID         string
+	Subject    string
+	Created    time.Time
+	AuthorID   string
+	CategoryID string
+	ViewsCount int64
+	Locked     bool
+}
+
+// ForeignComment is a comment of another forum.
+type ForeignComment struct {
+	ID       string
+	TopicID  string
+	AuthorID string
+	Content  string
+	Created  time.Time
+}
+
+// Importer creates content of another forum, with the authors and
+// timestamps preserved. Records must be passed after the records that they
+// refer to. Records that were already imported from the same source are
+// skipped, so an interrupted import can be run again.
+//
+// Record is created and remembered as imported in one transaction, so an
+// interrupted import never creates a record twice.
+type Importer struct {
+	// Source identifies the imported forum, for example
+	// "phpbb:forum.example.com".
+	Source   string
+	BBStore  BBStore
+	Imported ImportStore
+	// MergeUsers makes content of the foreign user attributed to the
+	// existing user of the same name. Otherwise the foreign user is
+	// created with a name that is not taken.
+	MergeUsers bool
+
+	// ids caches local IDs of users, categories and topics.
+	ids     map[string]int64
+	created map[string]int64
+	skipped map[string]int64
+}
+
+const (
+	importUserKind     = "user"
+	importCategoryKind = "category"
+	importTopicKind    = "topic"
+	importCommentKind  = "comment"
+)
+
+// User creates the foreign user.
+func (im *Importer) User(ctx context.Context, u ForeignUser) error {
+	if done, err := im.done(ctx, importUserKind, u.ID); err != nil || done {
+		return err
+	}
+
+	name := truncateName(strings.TrimSpace(u.Name), 30)
+	if name == "" {
+		name = "anonymous"
+	}
+	if im.MergeUsers {
+		users, err := im.BBStore.UsersByName(ctx, []string{name})
+		if err != nil {
+			return errors.Wrap(err, "cannot list users")
+		}
+		if len(users) != 0 {
+			return im.mark(ctx, importUserKind, u.ID, users[0].UserID)
+		}
+	}
+	name, err := availableUserName(ctx, im.BBStore, name)
+	if err != nil {
+		return errors.Wrap(err, "cannot choose name of user %q", u.ID)
+	}
+
+	passhash := u.PasswordHash
+	if _, err := bcrypt.Cost([]byte(passhash)); err != nil {
+		// Nobody knows the password, so the cost does not matter.
+		password, err := randomPassword()
+		if err != nil {
+			return err
+		}
+		raw, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			return errors.Wrap(err, "cannot hash password")
+		}
+		passhash = string(raw)
+	}
+
+	return im.create(ctx, importUserKind, u.ID, func(bbStore BBStore) (int64, error) {
+		return bbStore.ImportUser(ctx, ArchivedUser{
+			User:         User{Name: name, Scopes: createCommentScope},
+			PasswordHash: passhash,
+		})
+	})
+}
+
+// Category creates the foreign category, unless a category with the same
+// name exists.
+func (im *Importer) Category(ctx context.Context, c ForeignCategory) error {
+	if done, err := im.done(ctx, importCategoryKind, c.ID); err != nil || done {
+		return err
+	}
+
+	name := strings.TrimSpace(c.Name)
+	id, err := categoryByName(ctx, im.BBStore, name)
+	switch {
+	case err == nil:
+		return im.mark(ctx, importCategoryKind, c.ID, id)
+	case ErrNotFound.Is(err):
+		// Category must be created.
+	default:
+		return err
+	}
+	return im.create(ctx, importCategoryKind, c.ID, func(bbStore BBStore) (int64, error) {
+		if err := bbStore.AddCategories(ctx, []string{name}); err != nil {
+			return 0, err
+		}
+		return categoryByName(ctx, bbStore, name)
+	})
+}
+
+// categoryByName returns the ID of the latest category with given name.
+func categoryByName(ctx context.Context, bbStore BBStore, name string) (int64, error) {
+	categories, err := bbStore.ListCategories(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot list categories")
+	}
+	var id int64
+	for _, c := range categories {
+		if c.Name == name && c.CategoryID > id {
+			id = c.CategoryID
+		}
+	}
+	if id == 0 {
+		return 0, ErrNotFound
+	}
+	return id, nil
+}
+
+// Topic creates the foreign topic. Its author and category must be imported
+// first.
+func (im *Importer) Topic(ctx context.Context, t ForeignTopic) error {
+	if done, err := im.done(ctx, importTopicKind, t.ID); err != nil || done {
+		return err
+	}
+	authorID, err := im.localID(ctx, importUserKind, t.AuthorID)
+	if err != nil {
+		return errors.Wrap(err, "topic %q", t.ID)
+	}
+	categoryID, err := im.localID(ctx, importCategoryKind, t.CategoryID)
+	if err != nil {
+		return errors.Wrap(err, "topic %q", t.ID)
+	}
+
+	subject := strings.TrimSpace(t.Subject)
+	if subject == "" {
+		subject = "(no subject)"
+	}
+	return im.create(ctx, importTopicKind, t.ID, func(bbStore BBStore) (int64, error) {
+		return bbStore.ImportTopic(ctx, Topic{
+			Subject:    subject,
+			Created:    t.Created,
+			Author:     User{UserID: authorID},
+			Category:   Category{CategoryID: categoryID},
+			ViewsCount: t.ViewsCount,
+			Locked:     t.Locked,
+		})
+	})
+}
+
+// Comment creates the foreign comment. Its author and topic must be imported
+// first.
+func (im *Importer) Comment(ctx context.Context, c ForeignComment) error {
+	if done, err := im.done(ctx, importCommentKind, c.ID); err != nil || done {
+		return err
+	}
+	authorID, err := im.localID(ctx, importUserKind, c.AuthorID)
+	if err != nil {
+		return errors.Wrap(err, "comment %q", c.ID)
+	}
+	topicID, err := im.localID(ctx, importTopicKind, c.TopicID)
+	if err != nil {
+		return errors.Wrap(err, "comment %q", c.ID)
+	}
+
+	return im.create(ctx, importCommentKind, c.ID, func(bbStore BBStore) (int64, error) {
+		return bbStore.ImportComment(ctx, Comment{
+			TopicID: topicID,
+			Author:  User{UserID: authorID},
+			Content: c.Content,
+			Created: c.Created,
+		})
+	})
+}
+
+// done returns true if the foreign record was already imported.
+func (im *Importer) done(ctx context.Context, kind, foreignID string) (bool, error) {
+	switch _, err := im.localID(ctx, kind, foreignID); {
+	case err == nil:
+		if im.skipped == nil {
+			im.skipped = make(map[string]int64)
+		}
+		im.skipped[kind]++
+		return true, nil
+	case ErrImportNotFound.Is(err):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// localID returns the ID of the record created for the foreign record.
+func (im *Importer) localID(ctx context.Context, kind, foreignID string) (int64, error) {
+	key := kind + ":" + foreignID
+	if id, ok := im.ids[key]; ok {
+		return id, nil
+	}
+	id, err := im.Imported.ImportedID(ctx, im.Source, kind, foreignID)
+	if err != nil {
+		return 0, errors.Wrap(err, "%s %q", kind, foreignID)
+	}
+	im.cache(kind, key, id)
+	return id, nil
+}
+
+// mark remembers that the foreign record was imported as an existing record.
+func (im *Importer) mark(ctx context.Context, kind, foreignID string, id int64) error {
+	if err := im.Imported.MarkImported(ctx, im.Source, kind, foreignID, id); err != nil {
+		return errors.Wrap(err, "cannot mark %s %q imported", kind, foreignID)
+	}
+	im.imported(kind, foreignID, id)
+	return nil
+}
+
+// create creates the record for the foreign record and remembers that it was
+// imported.
+func (im *Importer) create(ctx context.Context, kind, foreignID string, fn func(BBStore) (int64, error)) error {
+	id, err := im.Imported.ImportRecord(ctx, im.BBStore, im.Source, kind, foreignID, fn)
+	if err != nil {
+		return errors.Wrap(err, "cannot import %s %q", kind, foreignID)
+	}
+	im.imported(kind, foreignID, id)
+	return nil
+}
+
+func (im *Importer) imported(kind, foreignID string, id int64) {
+	im.cache(kind, kind+":"+foreignID, id)
+	if im.created == nil {
+		im.created = make(map[string]int64)
+	}
+	im.created[kind]++
+}
+
+func (im *Importer) cache(kind, key string, id int64) {
+	// Comments are never referred to.
+	if kind == importCommentKind {
+		return
+	}
+	if im.ids == nil {
+		im.ids = make(map[string]int64)
+	}
+	im.ids[key] = id
+}
+
+// Summary returns a human readable number of imported and skipped records.
+func (im *Importer) Summary() string {
+	kinds := []string{importUserKind, importCategoryKind, importTopicKind, importCommentKind}
+	parts := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		parts = append(parts, fmt.Sprintf("%s: %d created, %d already imported",
+			kind, im.created[kind], im.skipped[kind]))
+	}
+	return strings.Join(parts, "; ")
+}
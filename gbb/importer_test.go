@@ -0,0 +1,180 @@
+package gbb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestImporter(t *testing.T) {
+	ctx := context.Background()
+	created := time.Date(2011, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	bbStore := &memImportBBStore{
+		users:      []*ArchivedUser{{User: User{UserID: 1, Name: "bob"}}},
+		categories: []*Category{{CategoryID: 1, Name: "General discussion"}},
+	}
+	imported := &memImportStore{ids: make(map[string]int64)}
+
+	run := func(im *Importer) {
+		t.Helper()
+
+		steps := []error{
+			im.User(ctx, ForeignUser{ID: "2", Name: "bob", PasswordHash: "$2y$10$4fJ8aJQ1uTGzIkFnSIbyxuJ5b3V0tUs5EcSF5xoP8tSJR4pS8vWWq"}),
+			im.User(ctx, ForeignUser{ID: "3", Name: "alice", PasswordHash: "$H$9Ik3Ma"}),
+			im.Category(ctx, ForeignCategory{ID: "1", Name: "General discussion"}),
+			im.Category(ctx, ForeignCategory{ID: "2", Name: "Off topic"}),
+			im.Topic(ctx, ForeignTopic{ID: "10", Subject: "Hello", Created: created, AuthorID: "2", CategoryID: "2", ViewsCount: 7}),
+			im.Comment(ctx, ForeignComment{ID: "100", TopicID: "10", AuthorID: "2", Content: "first", Created: created}),
+			im.Comment(ctx, ForeignComment{ID: "101", TopicID: "10", AuthorID: "3", Content: "reply", Created: created.Add(time.Hour)}),
+		}
+		for i, err := range steps {
+			if err != nil {
+				t.Fatalf("step %d: %s", i, err)
+			}
+		}
+	}
+
+	im := &Importer{Source: "phpbb:test", BBStore: bbStore, Imported: imported}
+	run(im)
+	if im.created[importCommentKind] != 2 || im.skipped[importCommentKind] != 0 {
+		t.Fatalf("unexpected summary: %s", im.Summary())
+	}
+
+	if len(bbStore.users) != 3 || bbStore.users[1].Name != "bob2" || bbStore.users[2].Name != "alice" {
+		t.Fatalf("unexpected users %+v %+v", bbStore.users[1], bbStore.users[2])
+	}
+	if bbStore.users[1].PasswordHash[:4] != "$2y$" {
+		t.Fatalf("want bcrypt password hash kept, got %q", bbStore.users[1].PasswordHash)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(bbStore.users[2].PasswordHash), []byte("")); err != bcrypt.ErrMismatchedHashAndPassword {
+		t.Fatalf("want unknown password, got %v", err)
+	}
+	if len(bbStore.categories) != 2 {
+		t.Fatalf("want category matched by name, got %+v", bbStore.categories)
+	}
+	topic := bbStore.topics[0]
+	if topic.Subject != "Hello" || !topic.Created.Equal(created) || topic.Author.UserID != 2 || topic.Category.CategoryID != 2 || topic.ViewsCount != 7 {
+		t.Fatalf("unexpected topic %+v", topic)
+	}
+	if reply := bbStore.comments[1]; reply.TopicID != topic.TopicID || reply.Author.UserID != 3 || reply.Content != "reply" {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+
+	// Running import again does not create anything.
+	again := &Importer{Source: "phpbb:test", BBStore: bbStore, Imported: imported}
+	run(again)
+	if len(bbStore.users) != 3 || len(bbStore.topics) != 1 || len(bbStore.comments) != 2 {
+		t.Fatalf("want no duplicates, got %s", again.Summary())
+	}
+	if again.skipped[importCommentKind] != 2 || again.created[importCommentKind] != 0 {
+		t.Fatalf("unexpected summary: %s", again.Summary())
+	}
+
+	// Another source is imported separately.
+	merging := &Importer{Source: "mbox:test", BBStore: bbStore, Imported: imported, MergeUsers: true}
+	if err := merging.User(ctx, ForeignUser{ID: "bob@example.com", Name: "bob"}); err != nil {
+		t.Fatalf("cannot import user: %s", err)
+	}
+	if id, _ := imported.ImportedID(ctx, "mbox:test", importUserKind, "bob@example.com"); id != 1 || len(bbStore.users) != 3 {
+		t.Fatalf("want user merged with bob, got %d", id)
+	}
+	err := merging.Comment(ctx, ForeignComment{ID: "<x@example.com>", TopicID: "<y@example.com>", AuthorID: "bob@example.com"})
+	if !ErrImportNotFound.Is(err) {
+		t.Fatalf("want ErrImportNotFound for a missing topic, got %+v", err)
+	}
+}
+
+type memImportBBStore struct {
+	BBStore
+
+	users      []*ArchivedUser
+	categories []*Category
+	topics     []*Topic
+	comments   []*Comment
+}
+
+func (s *memImportBBStore) UsersByName(ctx context.Context, names []string) ([]*User, error) {
+	var res []*User
+	for _, u := range s.users {
+		for _, name := range names {
+			if u.Name == name {
+				user := u.User
+				res = append(res, &user)
+			}
+		}
+	}
+	return res, nil
+}
+
+func (s *memImportBBStore) ImportUser(ctx context.Context, u ArchivedUser) (int64, error) {
+	u.UserID = int64(len(s.users) + 1)
+	s.users = append(s.users, &u)
+	return u.UserID, nil
+}
+
+func (s *memImportBBStore) ListCategories(ctx context.Context) ([]*Category, error) {
+	return s.categories, nil
+}
+
+func (s *memImportBBStore) AddCategories(ctx context.Context, names []string) error {
+	for _, name := range names {
+		s.categories = append(s.categories, &Category{CategoryID: int64(len(s.categories) + 1), Name: name})
+	}
+	return nil
+}
+
+func (s *memImportBBStore) ImportTopic(ctx context.Context, t Topic) (int64, error) {
+	t.TopicID = int64(len(s.topics) + 1)
+	s.topics = append(s.topics, &t)
+	return t.TopicID, nil
+}
+
+func (s *memImportBBStore) WithTx(ctx context.Context, fn func(BBStore) error) error {
+	return fn(s)
+}
+
+func (s *memImportBBStore) ImportComment(ctx context.Context, c Comment) (int64, error) {
+	c.CommentID = int64(len(s.comments) + 1)
+	s.comments = append(s.comments, &c)
+	return c.CommentID, nil
+}
+
+type memImportStore struct {
+	ids map[string]int64
+}
+
+func (s *memImportStore) ImportedID(ctx context.Context, source, kind, foreignID string) (int64, error) {
+	id, ok := s.ids[source+" "+kind+" "+foreignID]
+	if !ok {
+		return 0, ErrImportNotFound
+	}
+	return id, nil
+}
+
+func (s *memImportStore) MarkImported(ctx context.Context, source, kind, foreignID string, id int64) error {
+	key := source + " " + kind + " " + foreignID
+	if _, ok := s.ids[key]; ok {
+		return ErrConstraint
+	}
+	s.ids[key] = id
+	return nil
+}
+
+func (s *memImportStore) ImportRecord(ctx context.Context, bbStore BBStore, source, kind, foreignID string, create func(BBStore) (int64, error)) (int64, error) {
+	if _, ok := s.ids[source+" "+kind+" "+foreignID]; ok {
+		return 0, ErrConstraint
+	}
+	var id int64
+	err := bbStore.WithTx(ctx, func(tx BBStore) error {
+		var err error
+		id, err = create(tx)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, s.MarkImported(ctx, source, kind, foreignID, id)
+}
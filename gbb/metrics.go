@@ -0,0 +1,377 @@
+package gbb
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/husio/gbb/metrics"
+)
+
+// Metrics measures requests, store calls and the board activity.
+type Metrics struct {
+	requests        *metrics.CounterVec
+	requestDuration *metrics.HistogramVec
+	storeDuration   *metrics.HistogramVec
+	storeErrors     *metrics.CounterVec
+	registrations   *metrics.CounterVec
+	topics          *metrics.GaugeVec
+	comments        *metrics.GaugeVec
+	users           *metrics.GaugeVec
+
+	sessions *activeUsers
+}
+
+// sessionWindow is how long after their last request a signed in user is
+// counted as having an active session.
+const sessionWindow = 15 * time.Minute
+
+// NewMetrics registers the application metrics within given registry.
+func NewMetrics(reg *metrics.Registry) *Metrics {
+	m := &Metrics{
+		requests: reg.Counter("gbb_http_requests_total",
+			"Number of handled HTTP requests.", "route", "method", "code"),
+		requestDuration: reg.Histogram("gbb_http_request_duration_seconds",
+			"Time it took to handle HTTP requests, including writing the response.", metrics.DefaultBuckets, "route", "method"),
+		storeDuration: reg.Histogram("gbb_store_call_duration_seconds",
+			"Time it took to complete store method calls.", metrics.DefaultBuckets, "store", "method"),
+		storeErrors: reg.Counter("gbb_store_errors_total",
+			"Number of store method calls that failed. Missing records, denied permissions and invalid input are not counted.", "store", "method"),
+		registrations: reg.Counter("gbb_registrations_total",
+			"Number of users registered since the server started."),
+		topics: reg.Gauge("gbb_topics",
+			"Number of topics, including hidden ones."),
+		comments: reg.Gauge("gbb_comments",
+			"Number of comments, including hidden ones."),
+		users: reg.Gauge("gbb_users",
+			"Number of registered users."),
+		sessions: &activeUsers{
+			seen:   make(map[int64]time.Time),
+			window: sessionWindow,
+		},
+	}
+	active := reg.Gauge("gbb_active_sessions",
+		"Number of signed in users that made a request to this server within the last 15 minutes.")
+	reg.OnCollect(func() {
+		active.With().Set(float64(m.sessions.Count(time.Now())))
+	})
+	// Counters are always present, even before anything happened.
+	m.registrations.With()
+	return m
+}
+
+// CollectDBStats exposes the connection pool statistics of given database.
+// They are read every time the metrics are collected.
+func CollectDBStats(reg *metrics.Registry, db *sql.DB) {
+	var (
+		maxOpen   = reg.Gauge("gbb_db_max_open_connections", "Maximum number of open database connections.")
+		open      = reg.Gauge("gbb_db_open_connections", "Number of established database connections, both in use and idle.")
+		inUse     = reg.Gauge("gbb_db_in_use_connections", "Number of database connections currently in use.")
+		idle      = reg.Gauge("gbb_db_idle_connections", "Number of idle database connections.")
+		waits     = reg.Counter("gbb_db_wait_count_total", "Number of times a database connection was waited for.")
+		waited    = reg.Counter("gbb_db_wait_duration_seconds_total", "Total time spent waiting for a database connection.")
+		idleClose = reg.Counter("gbb_db_max_idle_closed_total", "Number of database connections closed because of the idle connection limit.")
+		lifeClose = reg.Counter("gbb_db_max_lifetime_closed_total", "Number of database connections closed because of their maximum lifetime.")
+	)
+
+	var (
+		mu   sync.Mutex
+		last sql.DBStats
+	)
+	reg.OnCollect(func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		s := db.Stats()
+		maxOpen.With().Set(float64(s.MaxOpenConnections))
+		open.With().Set(float64(s.OpenConnections))
+		inUse.With().Set(float64(s.InUse))
+		idle.With().Set(float64(s.Idle))
+		// Pool statistics are cumulative, while counters are
+		// increased by the change since the last collection.
+		waits.With().Add(float64(s.WaitCount - last.WaitCount))
+		waited.With().Add((s.WaitDuration - last.WaitDuration).Seconds())
+		idleClose.With().Add(float64(s.MaxIdleClosed - last.MaxIdleClosed))
+		lifeClose.With().Add(float64(s.MaxLifetimeClosed - last.MaxLifetimeClosed))
+		last = s
+	})
+}
+
+// RefreshForumStats updates the board activity gauges. Counting all topics
+// and comments is expensive, so it is meant to be called periodically
+// instead of every time the metrics are collected.
+func (m *Metrics) RefreshForumStats(ctx context.Context, store StatsStore) error {
+	stats, err := store.ForumStats(ctx)
+	if err != nil {
+		return err
+	}
+	m.topics.With().Set(float64(stats.Topics))
+	m.comments.With().Set(float64(stats.Comments))
+	m.users.With().Set(float64(stats.Users))
+	return nil
+}
+
+// MetricsHandler returns a handler writing metrics of given registry. If the
+// token is not empty, requests must provide it as the bearer token.
+func MetricsHandler(reg *metrics.Registry, token string) http.Handler {
+	return RequireMetricsToken(reg, token)
+}
+
+// RequireMetricsToken returns a handler that serves the request only if it
+// provides given bearer token. Requests are not checked if the token is
+// empty.
+func RequireMetricsToken(h http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" {
+			const prefix = "Bearer "
+			auth := r.Header.Get("Authorization")
+			if len(auth) <= len(prefix) || auth[:len(prefix)] != prefix ||
+				subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// surfRouter is the part of the surf router that is instrumented.
+type surfRouter interface {
+	R(path string) surf.Route
+	surf.Handler
+}
+
+// InstrumentRouter returns a router that measures requests of every route
+// registered with it, labelled with the route path. Requests that do not
+// match any route are labelled as unmatched.
+//
+// If the auth store is not nil, it is used to count active sessions.
+func (m *Metrics) InstrumentRouter(rt surfRouter, authStore surf.UnboundCacheService) *InstrumentedRouter {
+	return &InstrumentedRouter{
+		router:    rt,
+		metrics:   m,
+		authStore: authStore,
+	}
+}
+
+// InstrumentedRouter is a surf router that measures handled requests.
+type InstrumentedRouter struct {
+	router    surfRouter
+	metrics   *Metrics
+	authStore surf.UnboundCacheService
+}
+
+// R returns the route of given path, as the surf router does.
+func (rt *InstrumentedRouter) R(path string) surf.Route {
+	return &instrumentedRoute{
+		route: rt.router.R(path),
+		path:  path,
+	}
+}
+
+func (rt *InstrumentedRouter) HandleHTTPRequest(w http.ResponseWriter, r *http.Request) surf.Response {
+	start := time.Now()
+	matched := &matchedRoute{path: "unmatched"}
+	r = r.WithContext(context.WithValue(r.Context(), matchedRouteKey, matched))
+	rec := &statusRecorder{ResponseWriter: w}
+
+	if rt.authStore != nil {
+		var u User
+		if err := rt.authStore.Bind(rec, r).Get(r.Context(), "user", &u); err == nil {
+			rt.metrics.sessions.Seen(u.UserID, start)
+		}
+	}
+
+	resp := rt.router.HandleHTTPRequest(rec, r)
+	if resp == nil {
+		rt.metrics.observeRequest(matched.path, r.Method, rec.Status(), start)
+		return nil
+	}
+	// The response is written after the handler returns, outside of
+	// the router.
+	return &measuredResponse{
+		resp: resp,
+		rec:  rec,
+		done: func(code int) {
+			rt.metrics.observeRequest(matched.path, r.Method, code, start)
+		},
+	}
+}
+
+func (rt *InstrumentedRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if resp := rt.HandleHTTPRequest(w, r); resp != nil {
+		resp.ServeHTTP(w, r)
+	}
+}
+
+func (m *Metrics) observeRequest(route, method string, code int, start time.Time) {
+	// Method is chosen by the client, so only the standard ones are
+	// labelled by name.
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+	default:
+		method = "other"
+	}
+	m.requests.With(route, method, strconv.Itoa(code)).Inc()
+	m.requestDuration.With(route, method).Observe(time.Since(start).Seconds())
+}
+
+type matchedRoute struct {
+	path string
+}
+
+type matchedRouteKeyType struct{}
+
+var matchedRouteKey = matchedRouteKeyType{}
+
+// instrumentedRoute applies route middlewares itself, so that the request is
+// labelled with the route even if a middleware responds without calling the
+// handler.
+type instrumentedRoute struct {
+	route       surf.Route
+	path        string
+	middlewares []surf.Middleware
+}
+
+func (r *instrumentedRoute) Use(middlewares ...surf.Middleware) surf.Route {
+	r.middlewares = append(r.middlewares, middlewares...)
+	return r
+}
+
+func (r *instrumentedRoute) Add(method string, handler interface{}) surf.Route {
+	h := surf.WithMiddlewares(handler, r.middlewares)
+	path := r.path
+	r.route.Add(method, surf.HandlerFunc(func(w http.ResponseWriter, req *http.Request) surf.Response {
+		if matched, ok := req.Context().Value(matchedRouteKey).(*matchedRoute); ok {
+			matched.path = path
+		}
+		return h.HandleHTTPRequest(w, req)
+	}))
+	return r
+}
+
+func (r *instrumentedRoute) Get(handler interface{}) surf.Route {
+	return r.Add("GET", handler)
+}
+
+func (r *instrumentedRoute) Post(handler interface{}) surf.Route {
+	return r.Add("POST", handler)
+}
+
+func (r *instrumentedRoute) Put(handler interface{}) surf.Route {
+	return r.Add("PUT", handler)
+}
+
+func (r *instrumentedRoute) Delete(handler interface{}) surf.Route {
+	return r.Add("DELETE", handler)
+}
+
+func (r *instrumentedRoute) Head(handler interface{}) surf.Route {
+	return r.Add("HEAD", handler)
+}
+
+func (r *instrumentedRoute) Options(handler interface{}) surf.Route {
+	return r.Add("OPTIONS", handler)
+}
+
+func (r *instrumentedRoute) Trace(handler interface{}) surf.Route {
+	return r.Add("TRACE", handler)
+}
+
+func (r *instrumentedRoute) Patch(handler interface{}) surf.Route {
+	return r.Add("PATCH", handler)
+}
+
+// measuredResponse finishes the request measurement once the response is
+// written.
+type measuredResponse struct {
+	resp surf.Response
+	rec  *statusRecorder
+	done func(code int)
+}
+
+func (mr *measuredResponse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mr.rec.ResponseWriter = w
+	mr.resp.ServeHTTP(mr.rec, r)
+	mr.done(mr.rec.Status())
+}
+
+// statusRecorder remembers the response status code.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.code == 0 {
+		s.code = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.code == 0 {
+		s.code = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush is required by the event stream handlers.
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Status returns the written status code. Nothing written means the
+// default 200.
+func (s *statusRecorder) Status() int {
+	if s.code == 0 {
+		return http.StatusOK
+	}
+	return s.code
+}
+
+// activeUsers remembers when users made their last request. Sessions are
+// kept in cookies, so recent activity is the only way to tell how many are
+// in use.
+type activeUsers struct {
+	mu     sync.Mutex
+	seen   map[int64]time.Time
+	window time.Duration
+}
+
+func (a *activeUsers) Seen(userID int64, now time.Time) {
+	a.mu.Lock()
+	a.seen[userID] = now
+	a.mu.Unlock()
+}
+
+// Count returns the number of users seen within the window and forgets the
+// others.
+func (a *activeUsers) Count(now time.Time) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id, seen := range a.seen {
+		if now.Sub(seen) > a.window {
+			delete(a.seen, id)
+		}
+	}
+	return len(a.seen)
+}
+
+// observeStore records the store method call that started at given time.
+// It is meant to be deferred, with the error pointing to the named result.
+func (m *Metrics) observeStore(store, method string, start time.Time, err *error) {
+	m.storeDuration.With(store, method).Observe(time.Since(start).Seconds())
+	if e := *err; e != nil && !ErrNotFound.Is(e) && !ErrPermission.Is(e) && !ErrConstraint.Is(e) && !ErrMalformed.Is(e) {
+		m.storeErrors.With(store, method).Inc()
+	}
+}
@@ -0,0 +1,254 @@
+package gbb
+
+import (
+	"context"
+	"time"
+)
+
+// InstrumentBBStore returns a BBStore that measures calls of given store.
+func (m *Metrics) InstrumentBBStore(s BBStore) BBStore {
+	return &instrumentedBBStore{store: s, m: m}
+}
+
+// instrumentedBBStore does not embed the store, so that a method added to
+// the interface cannot be left unmeasured.
+type instrumentedBBStore struct {
+	store BBStore
+	m     *Metrics
+}
+
+const bbStoreLabel = "BBStore"
+
+func (s *instrumentedBBStore) ListTopics(ctx context.Context, viewerID int64, createdLte time.Time, limit int) (topics []*Topic, err error) {
+	defer s.m.observeStore(bbStoreLabel, "ListTopics", time.Now(), &err)
+	return s.store.ListTopics(ctx, viewerID, createdLte, limit)
+}
+
+func (s *instrumentedBBStore) ListRankedTopics(ctx context.Context, viewerID int64, ranking TopicRanking, activeGte time.Time, offset, limit int) (topics []*Topic, err error) {
+	defer s.m.observeStore(bbStoreLabel, "ListRankedTopics", time.Now(), &err)
+	return s.store.ListRankedTopics(ctx, viewerID, ranking, activeGte, offset, limit)
+}
+
+func (s *instrumentedBBStore) RefreshTopicScores(ctx context.Context) (err error) {
+	defer s.m.observeStore(bbStoreLabel, "RefreshTopicScores", time.Now(), &err)
+	return s.store.RefreshTopicScores(ctx)
+}
+
+func (s *instrumentedBBStore) CreateTopic(ctx context.Context, subject, content string, categoryID int64, userID int64) (topic *Topic, comment *Comment, err error) {
+	defer s.m.observeStore(bbStoreLabel, "CreateTopic", time.Now(), &err)
+	return s.store.CreateTopic(ctx, subject, content, categoryID, userID)
+}
+
+func (s *instrumentedBBStore) TopicByID(ctx context.Context, topicID int64) (topic *Topic, err error) {
+	defer s.m.observeStore(bbStoreLabel, "TopicByID", time.Now(), &err)
+	return s.store.TopicByID(ctx, topicID)
+}
+
+func (s *instrumentedBBStore) UpdateTopic(ctx context.Context, topicID int64, subject string) (err error) {
+	defer s.m.observeStore(bbStoreLabel, "UpdateTopic", time.Now(), &err)
+	return s.store.UpdateTopic(ctx, topicID, subject)
+}
+
+func (s *instrumentedBBStore) SetTopicLocked(ctx context.Context, topicID int64, locked bool) (err error) {
+	defer s.m.observeStore(bbStoreLabel, "SetTopicLocked", time.Now(), &err)
+	return s.store.SetTopicLocked(ctx, topicID, locked)
+}
+
+func (s *instrumentedBBStore) IncrementTopicViews(ctx context.Context, views map[int64]int64) (err error) {
+	defer s.m.observeStore(bbStoreLabel, "IncrementTopicViews", time.Now(), &err)
+	return s.store.IncrementTopicViews(ctx, views)
+}
+
+func (s *instrumentedBBStore) DeleteTopic(ctx context.Context, topicID int64) (err error) {
+	defer s.m.observeStore(bbStoreLabel, "DeleteTopic", time.Now(), &err)
+	return s.store.DeleteTopic(ctx, topicID)
+}
+
+func (s *instrumentedBBStore) ListComments(ctx context.Context, topicID, viewerID int64, cursor CommentCursor, limit int) (comments []*Comment, err error) {
+	defer s.m.observeStore(bbStoreLabel, "ListComments", time.Now(), &err)
+	return s.store.ListComments(ctx, topicID, viewerID, cursor, limit)
+}
+
+func (s *instrumentedBBStore) CommentByID(ctx context.Context, commentID int64) (topic *Topic, comment *Comment, isFirst bool, err error) {
+	defer s.m.observeStore(bbStoreLabel, "CommentByID", time.Now(), &err)
+	return s.store.CommentByID(ctx, commentID)
+}
+
+func (s *instrumentedBBStore) CreateComment(ctx context.Context, postID int64, content string, userID int64) (comment *Comment, err error) {
+	defer s.m.observeStore(bbStoreLabel, "CreateComment", time.Now(), &err)
+	return s.store.CreateComment(ctx, postID, content, userID)
+}
+
+func (s *instrumentedBBStore) UpdateComment(ctx context.Context, commentID int64, content string) (err error) {
+	defer s.m.observeStore(bbStoreLabel, "UpdateComment", time.Now(), &err)
+	return s.store.UpdateComment(ctx, commentID, content)
+}
+
+func (s *instrumentedBBStore) DeleteComment(ctx context.Context, commentID int64) (err error) {
+	defer s.m.observeStore(bbStoreLabel, "DeleteComment", time.Now(), &err)
+	return s.store.DeleteComment(ctx, commentID)
+}
+
+func (s *instrumentedBBStore) ListHiddenComments(ctx context.Context, limit int) (comments []*HiddenComment, err error) {
+	defer s.m.observeStore(bbStoreLabel, "ListHiddenComments", time.Now(), &err)
+	return s.store.ListHiddenComments(ctx, limit)
+}
+
+func (s *instrumentedBBStore) ApproveComment(ctx context.Context, commentID int64) (err error) {
+	defer s.m.observeStore(bbStoreLabel, "ApproveComment", time.Now(), &err)
+	return s.store.ApproveComment(ctx, commentID)
+}
+
+func (s *instrumentedBBStore) Search(ctx context.Context, viewerID int64, searchText string, categories []int64, offset, limit int64) (results []*SearchResult, err error) {
+	defer s.m.observeStore(bbStoreLabel, "Search", time.Now(), &err)
+	return s.store.Search(ctx, viewerID, searchText, categories, offset, limit)
+}
+
+func (s *instrumentedBBStore) ListCategories(ctx context.Context) (categories []*Category, err error) {
+	defer s.m.observeStore(bbStoreLabel, "ListCategories", time.Now(), &err)
+	return s.store.ListCategories(ctx)
+}
+
+func (s *instrumentedBBStore) AddCategories(ctx context.Context, name []string) (err error) {
+	defer s.m.observeStore(bbStoreLabel, "AddCategories", time.Now(), &err)
+	return s.store.AddCategories(ctx, name)
+}
+
+func (s *instrumentedBBStore) RemoveCategories(ctx context.Context, categoryID []int64) (err error) {
+	defer s.m.observeStore(bbStoreLabel, "RemoveCategories", time.Now(), &err)
+	return s.store.RemoveCategories(ctx, categoryID)
+}
+
+func (s *instrumentedBBStore) RegisterUser(ctx context.Context, password string, u User) (user *User, err error) {
+	defer s.m.observeStore(bbStoreLabel, "RegisterUser", time.Now(), &err)
+	user, err = s.store.RegisterUser(ctx, password, u)
+	if err == nil {
+		s.m.registrations.With().Inc()
+	}
+	return user, err
+}
+
+func (s *instrumentedBBStore) AuthenticateUser(ctx context.Context, login, password string) (user *User, err error) {
+	defer s.m.observeStore(bbStoreLabel, "AuthenticateUser", time.Now(), &err)
+	return s.store.AuthenticateUser(ctx, login, password)
+}
+
+func (s *instrumentedBBStore) UserInfo(ctx context.Context, userID, viewerID int64) (info *UserInfo, err error) {
+	defer s.m.observeStore(bbStoreLabel, "UserInfo", time.Now(), &err)
+	return s.store.UserInfo(ctx, userID, viewerID)
+}
+
+func (s *instrumentedBBStore) UsersByName(ctx context.Context, names []string) (users []*User, err error) {
+	defer s.m.observeStore(bbStoreLabel, "UsersByName", time.Now(), &err)
+	return s.store.UsersByName(ctx, names)
+}
+
+func (s *instrumentedBBStore) GrantScopes(ctx context.Context, userID int64, scopes UserScope) (err error) {
+	defer s.m.observeStore(bbStoreLabel, "GrantScopes", time.Now(), &err)
+	return s.store.GrantScopes(ctx, userID, scopes)
+}
+
+func (s *instrumentedBBStore) RevokeScopes(ctx context.Context, userID int64, scopes UserScope) (err error) {
+	defer s.m.observeStore(bbStoreLabel, "RevokeScopes", time.Now(), &err)
+	return s.store.RevokeScopes(ctx, userID, scopes)
+}
+
+func (s *instrumentedBBStore) SetUserBanned(ctx context.Context, userID int64, banned bool) (err error) {
+	defer s.m.observeStore(bbStoreLabel, "SetUserBanned", time.Now(), &err)
+	return s.store.SetUserBanned(ctx, userID, banned)
+}
+
+func (s *instrumentedBBStore) SetUserHidden(ctx context.Context, userID int64, hidden bool) (err error) {
+	defer s.m.observeStore(bbStoreLabel, "SetUserHidden", time.Now(), &err)
+	return s.store.SetUserHidden(ctx, userID, hidden)
+}
+
+func (s *instrumentedBBStore) AcceptComment(ctx context.Context, topicID, commentID int64) (err error) {
+	defer s.m.observeStore(bbStoreLabel, "AcceptComment", time.Now(), &err)
+	return s.store.AcceptComment(ctx, topicID, commentID)
+}
+
+func (s *instrumentedBBStore) PenalizeUser(ctx context.Context, userID, moderatorID int64, points int64, reason string) (err error) {
+	defer s.m.observeStore(bbStoreLabel, "PenalizeUser", time.Now(), &err)
+	return s.store.PenalizeUser(ctx, userID, moderatorID, points, reason)
+}
+
+func (s *instrumentedBBStore) ExportUsers(ctx context.Context, afterID int64, limit int) (users []*ArchivedUser, err error) {
+	defer s.m.observeStore(bbStoreLabel, "ExportUsers", time.Now(), &err)
+	return s.store.ExportUsers(ctx, afterID, limit)
+}
+
+func (s *instrumentedBBStore) ExportTopics(ctx context.Context, afterID int64, limit int) (topics []*Topic, err error) {
+	defer s.m.observeStore(bbStoreLabel, "ExportTopics", time.Now(), &err)
+	return s.store.ExportTopics(ctx, afterID, limit)
+}
+
+func (s *instrumentedBBStore) ExportComments(ctx context.Context, afterID int64, limit int) (comments []*Comment, err error) {
+	defer s.m.observeStore(bbStoreLabel, "ExportComments", time.Now(), &err)
+	return s.store.ExportComments(ctx, afterID, limit)
+}
+
+func (s *instrumentedBBStore) ImportUser(ctx context.Context, u ArchivedUser) (id int64, err error) {
+	defer s.m.observeStore(bbStoreLabel, "ImportUser", time.Now(), &err)
+	return s.store.ImportUser(ctx, u)
+}
+
+func (s *instrumentedBBStore) ImportTopic(ctx context.Context, t Topic) (id int64, err error) {
+	defer s.m.observeStore(bbStoreLabel, "ImportTopic", time.Now(), &err)
+	return s.store.ImportTopic(ctx, t)
+}
+
+func (s *instrumentedBBStore) ImportComment(ctx context.Context, c Comment) (id int64, err error) {
+	defer s.m.observeStore(bbStoreLabel, "ImportComment", time.Now(), &err)
+	return s.store.ImportComment(ctx, c)
+}
+
+func (s *instrumentedBBStore) ImportCategory(ctx context.Context, c Category) (err error) {
+	defer s.m.observeStore(bbStoreLabel, "ImportCategory", time.Now(), &err)
+	return s.store.ImportCategory(ctx, c)
+}
+
+func (s *instrumentedBBStore) ImportAcceptedComment(ctx context.Context, topicID, commentID int64) (err error) {
+	defer s.m.observeStore(bbStoreLabel, "ImportAcceptedComment", time.Now(), &err)
+	return s.store.ImportAcceptedComment(ctx, topicID, commentID)
+}
+
+// WithTx measures the whole transaction. Calls within it are not measured
+// separately.
+func (s *instrumentedBBStore) WithTx(ctx context.Context, fn func(BBStore) error) (err error) {
+	defer s.m.observeStore(bbStoreLabel, "WithTx", time.Now(), &err)
+	return s.store.WithTx(ctx, fn)
+}
+
+// InstrumentReadProgressTracker returns a ReadProgressTracker that measures
+// calls of given tracker.
+func (m *Metrics) InstrumentReadProgressTracker(t ReadProgressTracker) ReadProgressTracker {
+	return &instrumentedReadProgressTracker{tracker: t, m: m}
+}
+
+type instrumentedReadProgressTracker struct {
+	tracker ReadProgressTracker
+	m       *Metrics
+}
+
+const readTrackerLabel = "ReadProgressTracker"
+
+func (t *instrumentedReadProgressTracker) LastReads(ctx context.Context, userID int64, topicIDs []int64) (reads map[int64]*ReadProgress, err error) {
+	defer t.m.observeStore(readTrackerLabel, "LastReads", time.Now(), &err)
+	return t.tracker.LastReads(ctx, userID, topicIDs)
+}
+
+func (t *instrumentedReadProgressTracker) Track(ctx context.Context, p ReadProgress) (err error) {
+	defer t.m.observeStore(readTrackerLabel, "Track", time.Now(), &err)
+	return t.tracker.Track(ctx, p)
+}
+
+func (t *instrumentedReadProgressTracker) MarkAllRead(ctx context.Context, userID int64, now time.Time) (err error) {
+	defer t.m.observeStore(readTrackerLabel, "MarkAllRead", time.Now(), &err)
+	return t.tracker.MarkAllRead(ctx, userID, now)
+}
+
+func (t *instrumentedReadProgressTracker) ExportReadProgress(ctx context.Context, after ReadProgress, limit int) (progress []*ReadProgress, err error) {
+	defer t.m.observeStore(readTrackerLabel, "ExportReadProgress", time.Now(), &err)
+	return t.tracker.ExportReadProgress(ctx, after, limit)
+}
@@ -0,0 +1,281 @@
+package gbb
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/husio/gbb/metrics"
+)
+
+func TestInstrumentedRouter(t *testing.T) {
+	reg := metrics.NewRegistry()
+	m := NewMetrics(reg)
+	authStore, err := surf.NewCookieCache("auth", []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny := func(handler interface{}) surf.Handler {
+		h := surf.AsHandler(handler)
+		return surf.HandlerFunc(func(w http.ResponseWriter, r *http.Request) surf.Response {
+			if r.URL.Query().Get("deny") != "" {
+				return statusResponse(http.StatusForbidden)
+			}
+			return h.HandleHTTPRequest(w, r)
+		})
+	}
+
+	rt := m.InstrumentRouter(surf.NewRouter(), authStore)
+	rt.R(`/t/<post-id>/`).
+		Use(deny).
+		Get(func(w http.ResponseWriter, r *http.Request) surf.Response {
+			return statusResponse(http.StatusOK)
+		})
+	rt.R(`/login/`).
+		Post(func(w http.ResponseWriter, r *http.Request) surf.Response {
+			if err := Login(r.Context(), authStore.Bind(w, r), User{UserID: 7, Name: "bob"}); err != nil {
+				t.Errorf("cannot login: %s", err)
+			}
+			// Written directly, without a response.
+			w.WriteHeader(http.StatusSeeOther)
+			return nil
+		})
+
+	server := httptest.NewServer(rt)
+	defer server.Close()
+
+	get := func(path string, cookies []*http.Cookie) *http.Response {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("GET %s: %s", path, err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	login, err := http.DefaultTransport.RoundTrip(mustRequest(t, "POST", server.URL+"/login/"))
+	if err != nil {
+		t.Fatalf("cannot login: %s", err)
+	}
+	login.Body.Close()
+
+	get("/t/1/", login.Cookies())
+	get("/t/2/", nil)
+	get("/t/3/?deny=1", nil)
+	get("/nothing/", nil)
+	if brew, err := http.DefaultTransport.RoundTrip(mustRequest(t, "BREW", server.URL+"/nothing/")); err != nil {
+		t.Fatalf("BREW /nothing/: %s", err)
+	} else {
+		brew.Body.Close()
+	}
+
+	out := writeMetrics(t, reg)
+	for _, line := range []string{
+		`gbb_http_requests_total{route="/login/",method="POST",code="303"} 1`,
+		`gbb_http_requests_total{route="/t/<post-id>/",method="GET",code="200"} 2`,
+		`gbb_http_requests_total{route="/t/<post-id>/",method="GET",code="403"} 1`,
+		`gbb_http_requests_total{route="unmatched",method="GET",code="404"} 1`,
+		`gbb_http_requests_total{route="unmatched",method="other",code="404"} 1`,
+		`gbb_http_request_duration_seconds_count{route="/t/<post-id>/",method="GET"} 3`,
+		`gbb_active_sessions 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %s", line)
+		}
+	}
+	if t.Failed() {
+		t.Logf("metrics\n%s", out)
+	}
+}
+
+func statusResponse(code int) surf.Response {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	})
+}
+
+func mustRequest(t *testing.T, method, url string) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func writeMetrics(t *testing.T, reg *metrics.Registry) string {
+	t.Helper()
+	var b bytes.Buffer
+	if _, err := reg.WriteTo(&b); err != nil {
+		t.Fatalf("cannot write metrics: %s", err)
+	}
+	return b.String()
+}
+
+func TestInstrumentedStores(t *testing.T) {
+	reg := metrics.NewRegistry()
+	m := NewMetrics(reg)
+	store := m.InstrumentBBStore(&metricsBBStore{})
+	tracker := m.InstrumentReadProgressTracker(&metricsReadTracker{})
+	ctx := context.Background()
+
+	if _, err := store.TopicByID(ctx, 1); err != nil {
+		t.Fatalf("cannot get topic: %s", err)
+	}
+	if _, err := store.TopicByID(ctx, 2); !ErrTopicNotFound.Is(err) {
+		t.Fatalf("want ErrTopicNotFound, got %+v", err)
+	}
+	if _, err := store.TopicByID(ctx, 3); err == nil {
+		t.Fatal("want error")
+	}
+	if _, err := store.RegisterUser(ctx, "password", User{Name: "bob"}); err != nil {
+		t.Fatalf("cannot register: %s", err)
+	}
+	if err := tracker.Track(ctx, ReadProgress{}); err == nil {
+		t.Fatal("want error")
+	}
+
+	out := writeMetrics(t, reg)
+	for _, line := range []string{
+		`gbb_store_call_duration_seconds_count{store="BBStore",method="TopicByID"} 3`,
+		`gbb_store_errors_total{store="BBStore",method="TopicByID"} 1`,
+		`gbb_store_call_duration_seconds_count{store="ReadProgressTracker",method="Track"} 1`,
+		`gbb_store_errors_total{store="ReadProgressTracker",method="Track"} 1`,
+		`gbb_registrations_total 1`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %s", line)
+		}
+	}
+	if t.Failed() {
+		t.Logf("metrics\n%s", out)
+	}
+}
+
+type metricsBBStore struct {
+	BBStore
+}
+
+func (s *metricsBBStore) TopicByID(ctx context.Context, topicID int64) (*Topic, error) {
+	switch topicID {
+	case 1:
+		return &Topic{TopicID: 1}, nil
+	case 2:
+		return nil, ErrTopicNotFound
+	default:
+		return nil, errors.New("connection lost")
+	}
+}
+
+func (s *metricsBBStore) RegisterUser(ctx context.Context, password string, u User) (*User, error) {
+	u.UserID = 1
+	return &u, nil
+}
+
+type metricsReadTracker struct {
+	ReadProgressTracker
+}
+
+func (t *metricsReadTracker) Track(ctx context.Context, p ReadProgress) error {
+	return errors.New("connection lost")
+}
+
+func TestForumStatsAndDBStats(t *testing.T) {
+	reg := metrics.NewRegistry()
+	m := NewMetrics(reg)
+	if err := m.RefreshForumStats(context.Background(), &metricsStatsStore{}); err != nil {
+		t.Fatalf("cannot refresh stats: %s", err)
+	}
+	// Opening does not connect, which is enough to read pool statistics.
+	db, err := sql.Open("postgres", "host=localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(7)
+	CollectDBStats(reg, db)
+
+	out := writeMetrics(t, reg)
+	for _, line := range []string{
+		`gbb_topics 3`,
+		`gbb_comments 40`,
+		`gbb_users 5`,
+		`gbb_db_max_open_connections 7`,
+		`gbb_db_wait_count_total 0`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %s", line)
+		}
+	}
+	if t.Failed() {
+		t.Logf("metrics\n%s", out)
+	}
+}
+
+type metricsStatsStore struct{}
+
+func (metricsStatsStore) ForumStats(ctx context.Context) (*ForumStats, error) {
+	return &ForumStats{Topics: 3, Comments: 40, Users: 5}, nil
+}
+
+func TestMetricsHandler(t *testing.T) {
+	reg := metrics.NewRegistry()
+	NewMetrics(reg)
+
+	cases := map[string]struct {
+		token  string
+		header string
+		want   int
+	}{
+		"no token required": {token: "", header: "", want: http.StatusOK},
+		"valid token":       {token: "s3cret", header: "Bearer s3cret", want: http.StatusOK},
+		"missing token":     {token: "s3cret", header: "", want: http.StatusUnauthorized},
+		"invalid token":     {token: "s3cret", header: "Bearer s3cre", want: http.StatusUnauthorized},
+		"not a bearer":      {token: "s3cret", header: "Basic s3cret", want: http.StatusUnauthorized},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/metrics", nil)
+			if tc.header != "" {
+				r.Header.Set("Authorization", tc.header)
+			}
+			w := httptest.NewRecorder()
+			MetricsHandler(reg, tc.token).ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Fatalf("want %d, got %d: %s", tc.want, w.Code, w.Body)
+			}
+			if w.Code == http.StatusOK && !strings.Contains(w.Body.String(), "# TYPE gbb_http_requests_total counter") {
+				t.Fatalf("unexpected body\n%s", w.Body)
+			}
+		})
+	}
+}
+
+func TestActiveUsers(t *testing.T) {
+	now := time.Now()
+	a := &activeUsers{seen: make(map[int64]time.Time), window: time.Minute}
+	for i := int64(1); i <= 3; i++ {
+		a.Seen(i, now.Add(-time.Duration(i)*25*time.Second))
+	}
+	a.Seen(1, now)
+	if got := a.Count(now); got != 2 {
+		t.Fatalf("want 2 active users, got %d", got)
+	}
+	if got := a.Count(now.Add(2 * time.Minute)); got != 0 {
+		t.Fatalf("want no active users, got %d", got)
+	}
+	if len(a.seen) != 0 {
+		t.Fatalf("inactive users are remembered: %v", a.seen)
+	}
+}
@@ -0,0 +1,528 @@
+package gbb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/go-surf/surf/sqldb"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// deletedUserName is the name of the user that content of deleted accounts
+// is reassigned to.
+const deletedUserName = "deleted user"
+
+// NewPostgresAccountStore returns an AccountStore using given database. Tables
+// of all other stores must already exist, because deleting an account
+// touches them.
+func NewPostgresAccountStore(db *sql.DB) (AccountStore, error) {
+	store := &pgAccountStore{
+		db: sqldb.PostgresDatabase(db),
+	}
+	return store, store.ensureSchema(context.Background())
+}
+
+type pgAccountStore struct {
+	db sqldb.Database
+}
+
+func (as *pgAccountStore) ensureSchema(ctx context.Context) error {
+	// Placeholder table always contains at most one row.
+	const schema = `
+CREATE TABLE IF NOT EXISTS account_deletions (
+	user_id INTEGER PRIMARY KEY REFERENCES users(user_id) ON DELETE CASCADE,
+	mode TEXT NOT NULL CHECK (mode IN ('anonymize', 'remove')),
+	requested TIMESTAMPTZ NOT NULL,
+	due TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS account_deletions_due_idx ON account_deletions(due);
+
+CREATE TABLE IF NOT EXISTS deleted_user_placeholder (
+	placeholder_id INTEGER PRIMARY KEY CHECK (placeholder_id = 1),
+	user_id INTEGER NOT NULL REFERENCES users(user_id)
+);
+`
+	for i, migration := range strings.Split(schema, `;\n\n`) {
+		_, err := as.db.ExecContext(ctx, migration)
+		if err != nil {
+			if max := 30; len(migration) > max {
+				migration = migration[max:]
+			}
+			return fmt.Errorf("migration %d (%s): %s", i, migration, err)
+		}
+	}
+
+	if _, err := as.createPlaceholder(ctx); err != nil {
+		return errors.Wrap(err, "cannot create deleted user placeholder")
+	}
+	return nil
+}
+
+// createPlaceholder creates the deleted user placeholder, unless one already
+// exists. It returns false if no placeholder was created.
+func (as *pgAccountStore) createPlaceholder(ctx context.Context) (bool, error) {
+	// Nobody knows the placeholder password and the account is banned,
+	// so it cannot be used to sign in.
+	password, err := randomPassword()
+	if err != nil {
+		return false, err
+	}
+	passhash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return false, errors.Wrap(err, "cannot hash password")
+	}
+	res, err := as.db.ExecContext(ctx, `
+		WITH created AS (
+			INSERT INTO users (name, password, banned)
+			SELECT $1, $2, true
+			WHERE NOT EXISTS (SELECT 1 FROM deleted_user_placeholder)
+			RETURNING user_id
+		)
+		INSERT INTO deleted_user_placeholder (placeholder_id, user_id)
+		SELECT 1, user_id FROM created
+	`, deletedUserName, passhash)
+	if err != nil {
+		return false, errors.Wrap(err, "cannot insert placeholder")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "cannot get affected rows")
+	}
+	return n == 1, nil
+}
+
+func (as *pgAccountStore) DeletedUserPlaceholder(ctx context.Context) (int64, error) {
+	var placeholderID int64
+	err := as.db.QueryRowContext(ctx, `
+		SELECT user_id FROM deleted_user_placeholder WHERE placeholder_id = 1
+	`).Scan(&placeholderID)
+	switch {
+	case err == nil:
+		return placeholderID, nil
+	case surf.ErrNotFound.Is(err):
+		return 0, ErrUserNotFound
+	default:
+		return 0, errors.Wrap(err, "cannot get deleted user placeholder")
+	}
+}
+
+func (as *pgAccountStore) RemoveDeletedUserPlaceholder(ctx context.Context) error {
+	tx, err := as.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "cannot begin the transaction")
+	}
+	defer tx.Rollback()
+
+	var placeholderID int64
+	switch err := tx.QueryRowContext(ctx, `
+		DELETE FROM deleted_user_placeholder WHERE placeholder_id = 1
+		RETURNING user_id
+	`).Scan(&placeholderID); {
+	case err == nil:
+		// All good.
+	case surf.ErrNotFound.Is(err):
+		return ErrUserNotFound
+	default:
+		return errors.Wrap(err, "cannot unlink deleted user placeholder")
+	}
+	switch _, err := tx.ExecContext(ctx, `DELETE FROM users WHERE user_id = $1`, placeholderID); {
+	case err == nil:
+		// All good.
+	case surf.ErrConstraint.Is(err):
+		return errors.Wrap(ErrConstraint, "content is attributed to the placeholder")
+	default:
+		return errors.Wrap(err, "cannot delete placeholder")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "cannot commit the transaction")
+	}
+	return nil
+}
+
+func (as *pgAccountStore) ImportDeletedUserPlaceholder(ctx context.Context, userID int64) error {
+	if userID == 0 {
+		switch created, err := as.createPlaceholder(ctx); {
+		case err != nil:
+			return err
+		case !created:
+			return errors.Wrap(ErrConstraint, "placeholder already exists")
+		}
+		return nil
+	}
+	switch _, err := as.db.ExecContext(ctx, `
+		INSERT INTO deleted_user_placeholder (placeholder_id, user_id)
+		VALUES (1, $1)
+	`, userID); {
+	case err == nil:
+		return nil
+	case surf.ErrConstraint.Is(err):
+		return errors.Wrap(ErrConstraint, "placeholder already exists or user %d does not exist", userID)
+	default:
+		return errors.Wrap(err, "cannot link deleted user placeholder")
+	}
+}
+
+func (as *pgAccountStore) ExportAccount(ctx context.Context, userID int64) (*AccountExport, error) {
+	// Repeatable read provides a consistent snapshot for all queries.
+	tx, err := as.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot begin the transaction")
+	}
+	defer tx.Rollback()
+
+	exp := AccountExport{
+		User:          UserInfo{User: User{UserID: userID}},
+		TopicSubjects: make(map[int64]string),
+	}
+	err = tx.QueryRowContext(ctx, `
+		SELECT
+			name,
+			scopes,
+			reputation,
+			(SELECT COUNT(*) FROM topics WHERE author_id = u.user_id),
+			(SELECT COUNT(*) FROM comments WHERE author_id = u.user_id),
+			banned
+		FROM users u
+		WHERE user_id = $1
+		LIMIT 1
+	`, userID).Scan(
+		&exp.User.Name,
+		&exp.User.Scopes,
+		&exp.User.Reputation,
+		&exp.User.TopicsCount,
+		&exp.User.CommentsCount,
+		&exp.User.Banned)
+	switch {
+	case err == nil:
+		// All good.
+	case surf.ErrNotFound.Is(err):
+		return nil, ErrUserNotFound
+	default:
+		return nil, errors.Wrap(err, "cannot get user")
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT
+			t.topic_id,
+			t.subject,
+			t.created,
+			t.latest_comment,
+			t.views_count,
+			t.comments_count,
+			c.category_id,
+			c.name,
+			COALESCE(t.accepted_comment_id, 0),
+			t.locked,
+			t.hidden
+		FROM topics t INNER JOIN categories c ON t.category_id = c.category_id
+		WHERE t.author_id = $1
+		ORDER BY t.created, t.topic_id
+	`, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query topics")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t := Topic{Author: exp.User.User}
+		if err := rows.Scan(
+			&t.TopicID,
+			&t.Subject,
+			&t.Created,
+			&t.Updated,
+			&t.ViewsCount,
+			&t.CommentsCount,
+			&t.Category.CategoryID,
+			&t.Category.Name,
+			&t.AcceptedCommentID,
+			&t.Locked,
+			&t.Hidden,
+		); err != nil {
+			return nil, errors.Wrap(err, "cannot scan topic")
+		}
+		exp.Topics = append(exp.Topics, &t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "topics scanner")
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		SELECT comment_id, topic_id, content, revision, created, hidden
+		FROM comments
+		WHERE author_id = $1
+		ORDER BY created, comment_id
+	`, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query comments")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		c := Comment{Author: exp.User.User}
+		if err := rows.Scan(&c.CommentID, &c.TopicID, &c.Content, &c.Revision, &c.Created, &c.Hidden); err != nil {
+			return nil, errors.Wrap(err, "cannot scan comment")
+		}
+		exp.Comments = append(exp.Comments, &c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "comments scanner")
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		SELECT DISTINCT t.topic_id, t.subject
+		FROM topics t INNER JOIN comments c ON c.topic_id = t.topic_id
+		WHERE c.author_id = $1
+	`, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query commented topics")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			topicID int64
+			subject string
+		)
+		if err := rows.Scan(&topicID, &subject); err != nil {
+			return nil, errors.Wrap(err, "cannot scan commented topic")
+		}
+		exp.TopicSubjects[topicID] = subject
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "commented topics scanner")
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		SELECT topic_id, comment_id, comment_created
+		FROM readprogress
+		WHERE user_id = $1
+		ORDER BY topic_id
+	`, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query read progress")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		rp := ReadProgress{UserID: userID}
+		if err := rows.Scan(&rp.TopicID, &rp.CommentID, &rp.CommentCreated); err != nil {
+			return nil, errors.Wrap(err, "cannot scan read progress")
+		}
+		exp.ReadProgress = append(exp.ReadProgress, &rp)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "read progress scanner")
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		SELECT created FROM readprogressall WHERE user_id = $1 LIMIT 1
+	`, userID).Scan(&exp.ReadAll)
+	if err != nil && !surf.ErrNotFound.Is(err) {
+		return nil, errors.Wrap(err, "cannot get read all progress")
+	}
+	return &exp, nil
+}
+
+func (as *pgAccountStore) ScheduleDeletion(ctx context.Context, userID int64, mode DeletionMode, due time.Time) (*AccountDeletion, error) {
+	d := AccountDeletion{
+		UserID:    userID,
+		Mode:      mode,
+		Requested: time.Now().UTC().Truncate(time.Microsecond),
+		Due:       due.UTC().Truncate(time.Microsecond),
+	}
+	_, err := as.db.ExecContext(ctx, `
+		INSERT INTO account_deletions (user_id, mode, requested, due)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE
+		SET mode = EXCLUDED.mode, requested = EXCLUDED.requested, due = EXCLUDED.due
+	`, d.UserID, d.Mode, d.Requested, d.Due)
+	switch {
+	case err == nil:
+		return &d, nil
+	case surf.ErrConstraint.Is(err):
+		return nil, errors.Wrap(ErrConstraint, "user does not exist or invalid mode")
+	default:
+		return nil, errors.Wrap(err, "cannot upsert account deletion")
+	}
+}
+
+func (as *pgAccountStore) PendingDeletion(ctx context.Context, userID int64) (*AccountDeletion, error) {
+	d := AccountDeletion{UserID: userID}
+	err := as.db.QueryRowContext(ctx, `
+		SELECT mode, requested, due FROM account_deletions WHERE user_id = $1 LIMIT 1
+	`, userID).Scan(&d.Mode, &d.Requested, &d.Due)
+	switch {
+	case err == nil:
+		return &d, nil
+	case surf.ErrNotFound.Is(err):
+		return nil, ErrDeletionNotFound
+	default:
+		return nil, errors.Wrap(err, "cannot query account deletion")
+	}
+}
+
+func (as *pgAccountStore) CancelDeletion(ctx context.Context, userID int64) error {
+	res, err := as.db.ExecContext(ctx, `
+		DELETE FROM account_deletions WHERE user_id = $1
+	`, userID)
+	if err != nil {
+		return errors.Wrap(err, "cannot delete account deletion")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "cannot get affected rows")
+	} else if n == 0 {
+		return ErrDeletionNotFound
+	}
+	return nil
+}
+
+func (as *pgAccountStore) ListDueDeletions(ctx context.Context, now time.Time, limit int) ([]*AccountDeletion, error) {
+	rows, err := as.db.QueryContext(ctx, `
+		SELECT user_id, mode, requested, due
+		FROM account_deletions
+		WHERE due <= $1
+		ORDER BY due
+		LIMIT $2
+	`, now, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query account deletions")
+	}
+	defer rows.Close()
+
+	var deletions []*AccountDeletion
+	for rows.Next() {
+		var d AccountDeletion
+		if err := rows.Scan(&d.UserID, &d.Mode, &d.Requested, &d.Due); err != nil {
+			return nil, errors.Wrap(err, "cannot scan account deletion")
+		}
+		deletions = append(deletions, &d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner")
+	}
+	return deletions, nil
+}
+
+func (as *pgAccountStore) DeleteAccount(ctx context.Context, userID int64, mode DeletionMode) error {
+	tx, err := as.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "cannot begin the transaction")
+	}
+	defer tx.Rollback()
+
+	var placeholderID int64
+	if err := tx.QueryRowContext(ctx, `
+		SELECT user_id FROM deleted_user_placeholder WHERE placeholder_id = 1
+	`).Scan(&placeholderID); err != nil {
+		return errors.Wrap(err, "cannot get deleted user placeholder")
+	}
+	if userID == placeholderID {
+		return errors.Wrap(ErrPermission, "placeholder cannot be deleted")
+	}
+
+	if mode == DeletionRemove {
+		// Topics that nobody else commented are deleted together with
+		// their comments. The first comment of the remaining topics is
+		// kept, because the discussion would not make sense without it.
+		if _, err := tx.ExecContext(ctx, `
+			DELETE FROM comments
+			WHERE topic_id IN (
+				SELECT t.topic_id FROM topics t
+				WHERE t.author_id = $1 AND NOT EXISTS (
+					SELECT 1 FROM comments c
+					WHERE c.topic_id = t.topic_id AND c.author_id <> $1
+				)
+			)
+		`, userID); err != nil {
+			return errors.Wrap(err, "cannot delete comments of own topics")
+		}
+		if _, err := tx.ExecContext(ctx, `
+			DELETE FROM topics t
+			WHERE t.author_id = $1 AND NOT EXISTS (
+				SELECT 1 FROM comments c WHERE c.topic_id = t.topic_id
+			)
+		`, userID); err != nil {
+			return errors.Wrap(err, "cannot delete topics")
+		}
+		if _, err := tx.ExecContext(ctx, `
+			DELETE FROM comments c
+			WHERE c.author_id = $1 AND EXISTS (
+				SELECT 1 FROM comments prev
+				WHERE prev.topic_id = c.topic_id
+					AND (prev.created, prev.comment_id) < (c.created, c.comment_id)
+			)
+		`, userID); err != nil {
+			return errors.Wrap(err, "cannot delete comments")
+		}
+	}
+
+	if mode == DeletionRemove {
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE conversations c SET messages_count = messages_count - (
+				SELECT COUNT(*) FROM messages m
+				WHERE m.conversation_id = c.conversation_id AND m.author_id = $1
+			)
+			WHERE conversation_id IN (SELECT conversation_id FROM messages WHERE author_id = $1)
+		`, userID); err != nil {
+			return errors.Wrap(err, "cannot update conversation counters")
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM messages WHERE author_id = $1`, userID); err != nil {
+			return errors.Wrap(err, "cannot delete messages")
+		}
+	}
+
+	// Conversations are reassigned in both modes, because they belong to
+	// the other participants as well.
+	for _, query := range []string{
+		`UPDATE topics SET author_id = $2 WHERE author_id = $1`,
+		`UPDATE comments SET author_id = $2 WHERE author_id = $1`,
+		`UPDATE attachments SET user_id = $2 WHERE user_id = $1`,
+		`UPDATE conversations SET author_id = $2 WHERE author_id = $1`,
+		`UPDATE messages SET author_id = $2 WHERE author_id = $1`,
+		`UPDATE moderation_resolutions SET moderator_id = $2 WHERE moderator_id = $1`,
+		`UPDATE moderation_resolutions SET comment_author_id = $2 WHERE comment_author_id = $1`,
+		`UPDATE reputation_penalties SET moderator_id = $2 WHERE moderator_id = $1`,
+	} {
+		if _, err := tx.ExecContext(ctx, query, userID, placeholderID); err != nil {
+			return errors.Wrap(err, "cannot reassign to placeholder")
+		}
+	}
+	for _, query := range []string{
+		`DELETE FROM reputation_penalties WHERE user_id = $1`,
+		`DELETE FROM readprogress WHERE user_id = $1`,
+		`DELETE FROM readprogressall WHERE user_id = $1`,
+	} {
+		if _, err := tx.ExecContext(ctx, query, userID); err != nil {
+			return errors.Wrap(err, "cannot delete user data")
+		}
+	}
+	// Counters are maintained by triggers only when content is created or
+	// deleted, so reassigned content must be counted again.
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE users SET
+			topics_count = (SELECT COUNT(*) FROM topics WHERE author_id = $1 AND NOT hidden),
+			comments_count = (SELECT COUNT(*) FROM comments WHERE author_id = $1 AND NOT hidden)
+		WHERE user_id = $1
+	`, placeholderID); err != nil {
+		return errors.Wrap(err, "cannot update placeholder counters")
+	}
+
+	// Everything else belonging to the user is removed by the cascade.
+	res, err := tx.ExecContext(ctx, `DELETE FROM users WHERE user_id = $1`, userID)
+	if err != nil {
+		return errors.Wrap(err, "cannot delete user")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "cannot get affected rows")
+	} else if n == 0 {
+		return ErrUserNotFound
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "cannot commit the transaction")
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package gbb
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func createAccountStore(t *testing.T, db *sql.DB) (BBStore, AccountStore) {
+	t.Helper()
+
+	bbStore, err := NewPostgresBBStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPostgresReadProgressTracker(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPostgresAttachmentStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPostgresMessageStore(db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPostgresModerationStore(db); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewPostgresAccountStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Placeholder must be created only once.
+	if _, err := NewPostgresAccountStore(db); err != nil {
+		t.Fatal(err)
+	}
+	return bbStore, store
+}
+
+func TestAccountDeletionSchedule(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	_, store := createAccountStore(t, db)
+
+	ensureUser(t, db, 999, "Bobby")
+	ensureUser(t, db, 1000, "Rick")
+
+	if _, err := store.PendingDeletion(ctx, 999); !ErrDeletionNotFound.Is(err) {
+		t.Fatalf("want ErrDeletionNotFound, got %+v", err)
+	}
+	if err := store.CancelDeletion(ctx, 999); !ErrDeletionNotFound.Is(err) {
+		t.Fatalf("want ErrDeletionNotFound, got %+v", err)
+	}
+
+	now := time.Now()
+	if _, err := store.ScheduleDeletion(ctx, 999, DeletionAnonymize, now.Add(time.Hour)); err != nil {
+		t.Fatalf("cannot schedule deletion: %s", err)
+	}
+	// Scheduling again replaces the previous request.
+	if _, err := store.ScheduleDeletion(ctx, 999, DeletionRemove, now.Add(2*time.Hour)); err != nil {
+		t.Fatalf("cannot schedule deletion: %s", err)
+	}
+	if _, err := store.ScheduleDeletion(ctx, 1000, DeletionAnonymize, now.Add(3*time.Hour)); err != nil {
+		t.Fatalf("cannot schedule deletion: %s", err)
+	}
+	if _, err := store.ScheduleDeletion(ctx, 123456, DeletionAnonymize, now); !ErrConstraint.Is(err) {
+		t.Fatalf("want ErrConstraint, got %+v", err)
+	}
+
+	if d, err := store.PendingDeletion(ctx, 999); err != nil || d.Mode != DeletionRemove {
+		t.Fatalf("want remove deletion, got %+v, %v", d, err)
+	}
+
+	if due, err := store.ListDueDeletions(ctx, now.Add(90*time.Minute), 10); err != nil || len(due) != 0 {
+		t.Fatalf("want no due deletions, got %d, %v", len(due), err)
+	}
+	due, err := store.ListDueDeletions(ctx, now.Add(4*time.Hour), 10)
+	if err != nil {
+		t.Fatalf("cannot list due deletions: %s", err)
+	}
+	if len(due) != 2 || due[0].UserID != 999 || due[1].UserID != 1000 {
+		t.Fatalf("unexpected due deletions %+v", due)
+	}
+
+	if err := store.CancelDeletion(ctx, 1000); err != nil {
+		t.Fatalf("cannot cancel deletion: %s", err)
+	}
+	if n, err := DeleteDueAccounts(ctx, store, now.Add(4*time.Hour)); err != nil || n != 1 {
+		t.Fatalf("want one account deleted, got %d, %v", n, err)
+	}
+	if _, err := store.ExportAccount(ctx, 999); !ErrUserNotFound.Is(err) {
+		t.Fatalf("want ErrUserNotFound, got %+v", err)
+	}
+	if _, err := store.ExportAccount(ctx, 1000); err != nil {
+		t.Fatalf("cannot export account: %s", err)
+	}
+}
+
+func TestAccountExport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	bbStore, store := createAccountStore(t, db)
+
+	ensureUser(t, db, 999, "Bobby")
+	ensureUser(t, db, 1000, "Rick")
+
+	topic, _, err := bbStore.CreateTopic(ctx, "Bobby's", "hello", 1, 999)
+	if err != nil {
+		t.Fatalf("cannot create topic: %s", err)
+	}
+	other, _, err := bbStore.CreateTopic(ctx, "Rick's", "hi", 1, 1000)
+	if err != nil {
+		t.Fatalf("cannot create topic: %s", err)
+	}
+	reply, err := bbStore.CreateComment(ctx, other.TopicID, "reply", 999)
+	if err != nil {
+		t.Fatalf("cannot create comment: %s", err)
+	}
+	if _, err := db.Exec(`
+		INSERT INTO readprogress (user_id, topic_id, comment_id, comment_created)
+		VALUES (999, $1, $2, $3)
+	`, other.TopicID, reply.CommentID, reply.Created); err != nil {
+		t.Fatalf("cannot track read progress: %s", err)
+	}
+
+	exp, err := store.ExportAccount(ctx, 999)
+	if err != nil {
+		t.Fatalf("cannot export account: %s", err)
+	}
+	if exp.User.Name != "Bobby" || exp.User.TopicsCount != 1 || exp.User.CommentsCount != 2 {
+		t.Fatalf("unexpected user %+v", exp.User)
+	}
+	if len(exp.Topics) != 1 || exp.Topics[0].TopicID != topic.TopicID || exp.Topics[0].Category.Name == "" {
+		t.Fatalf("unexpected topics %+v", exp.Topics)
+	}
+	if len(exp.Comments) != 2 || exp.Comments[1].Content != "reply" {
+		t.Fatalf("unexpected comments %+v", exp.Comments)
+	}
+	if exp.TopicSubjects[other.TopicID] != "Rick's" || exp.TopicSubjects[topic.TopicID] != "Bobby's" {
+		t.Fatalf("unexpected topic subjects %+v", exp.TopicSubjects)
+	}
+	if len(exp.ReadProgress) != 1 || exp.ReadProgress[0].CommentID != reply.CommentID || !exp.ReadAll.IsZero() {
+		t.Fatalf("unexpected read progress %+v, %s", exp.ReadProgress, exp.ReadAll)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	bbStore, store := createAccountStore(t, db)
+
+	var placeholderID int64
+	if err := db.QueryRow(`SELECT user_id FROM deleted_user_placeholder`).Scan(&placeholderID); err != nil {
+		t.Fatalf("cannot get placeholder: %s", err)
+	}
+	if err := store.DeleteAccount(ctx, placeholderID, DeletionRemove); !ErrPermission.Is(err) {
+		t.Fatalf("want placeholder deletion rejected, got %+v", err)
+	}
+
+	ensureUser(t, db, 999, "Bobby")
+	ensureUser(t, db, 1000, "Rick")
+	ensureUser(t, db, 1001, "Morty")
+
+	// Bobby and Rick each write a topic nobody commented, a topic that
+	// the other commented and a comment in the topic of Morty.
+	type content struct {
+		lonely, commented *Topic
+		reply, elsewhere  *Comment
+	}
+	write := func(author, other int64) content {
+		var c content
+		var err error
+		if c.lonely, _, err = bbStore.CreateTopic(ctx, "lonely", "first", 1, author); err != nil {
+			t.Fatalf("cannot create topic: %s", err)
+		}
+		if _, err = bbStore.CreateComment(ctx, c.lonely.TopicID, "second", author); err != nil {
+			t.Fatalf("cannot create comment: %s", err)
+		}
+		if c.commented, _, err = bbStore.CreateTopic(ctx, "commented", "first", 1, author); err != nil {
+			t.Fatalf("cannot create topic: %s", err)
+		}
+		if _, err = bbStore.CreateComment(ctx, c.commented.TopicID, "answer", other); err != nil {
+			t.Fatalf("cannot create comment: %s", err)
+		}
+		if c.reply, err = bbStore.CreateComment(ctx, c.commented.TopicID, "thanks", author); err != nil {
+			t.Fatalf("cannot create comment: %s", err)
+		}
+		mortys, _, err := bbStore.CreateTopic(ctx, "Morty's", "hi", 1, 1001)
+		if err != nil {
+			t.Fatalf("cannot create topic: %s", err)
+		}
+		if c.elsewhere, err = bbStore.CreateComment(ctx, mortys.TopicID, "hello", author); err != nil {
+			t.Fatalf("cannot create comment: %s", err)
+		}
+		return c
+	}
+	bobby := write(999, 1001)
+	rick := write(1000, 1001)
+
+	if err := store.DeleteAccount(ctx, 999, DeletionAnonymize); err != nil {
+		t.Fatalf("cannot delete account: %s", err)
+	}
+	for _, id := range []int64{bobby.lonely.TopicID, bobby.commented.TopicID} {
+		topic, err := bbStore.TopicByID(ctx, id)
+		if err != nil {
+			t.Fatalf("cannot get topic %d: %s", id, err)
+		}
+		if topic.Author.UserID != placeholderID || topic.Author.Name != deletedUserName {
+			t.Fatalf("want topic reassigned, got %+v", topic.Author)
+		}
+	}
+	if _, c, _, err := bbStore.CommentByID(ctx, bobby.elsewhere.CommentID); err != nil || c.Author.UserID != placeholderID {
+		t.Fatalf("want comment reassigned, got %+v, %v", c, err)
+	}
+
+	if err := store.DeleteAccount(ctx, 1000, DeletionRemove); err != nil {
+		t.Fatalf("cannot delete account: %s", err)
+	}
+	if _, err := bbStore.TopicByID(ctx, rick.lonely.TopicID); !ErrTopicNotFound.Is(err) {
+		t.Fatalf("want lonely topic removed, got %+v", err)
+	}
+	topic, err := bbStore.TopicByID(ctx, rick.commented.TopicID)
+	if err != nil {
+		t.Fatalf("cannot get commented topic: %s", err)
+	}
+	if topic.Author.UserID != placeholderID {
+		t.Fatalf("want commented topic reassigned, got %+v", topic.Author)
+	}
+	comments, err := bbStore.ListComments(ctx, topic.TopicID, 0, CommentCursor{}, 10)
+	if err != nil {
+		t.Fatalf("cannot list comments: %s", err)
+	}
+	if len(comments) != 2 || comments[0].Content != "first" || comments[0].Author.UserID != placeholderID || comments[1].Content != "answer" {
+		t.Fatalf("unexpected comments %+v", comments)
+	}
+	if _, _, _, err := bbStore.CommentByID(ctx, rick.elsewhere.CommentID); !ErrCommentNotFound.Is(err) {
+		t.Fatalf("want comment removed, got %+v", err)
+	}
+	if _, _, _, err := bbStore.CommentByID(ctx, rick.reply.CommentID); !ErrCommentNotFound.Is(err) {
+		t.Fatalf("want reply removed, got %+v", err)
+	}
+
+	if err := store.DeleteAccount(ctx, 1000, DeletionRemove); !ErrUserNotFound.Is(err) {
+		t.Fatalf("want ErrUserNotFound, got %+v", err)
+	}
+	info, err := bbStore.UserInfo(ctx, placeholderID, 0)
+	if err != nil {
+		t.Fatalf("cannot get placeholder info: %s", err)
+	}
+	// Bobby's two topics and Rick's commented topic.
+	if info.TopicsCount != 3 {
+		t.Fatalf("want placeholder counters updated, got %+v", info)
+	}
+}
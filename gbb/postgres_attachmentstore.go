@@ -0,0 +1,265 @@
+package gbb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/go-surf/surf/sqldb"
+	"github.com/lib/pq"
+)
+
+// NewPostgresAttachmentStore returns an AttachmentStore using given database.
+// The comments and users tables must already exist.
+func NewPostgresAttachmentStore(db *sql.DB) (AttachmentStore, error) {
+	store := &pgAttachmentStore{
+		db: sqldb.PostgresDatabase(db),
+	}
+	return store, store.ensureSchema(context.Background())
+}
+
+type pgAttachmentStore struct {
+	db sqldb.Database
+}
+
+func (as *pgAttachmentStore) ensureSchema(ctx context.Context) error {
+	const schema = `
+CREATE TABLE IF NOT EXISTS attachments (
+	attachment_id SERIAL PRIMARY KEY,
+	comment_id INTEGER REFERENCES comments(comment_id) ON DELETE SET NULL,
+	user_id INTEGER NOT NULL REFERENCES users(user_id),
+	name TEXT NOT NULL,
+	content_type TEXT NOT NULL,
+	size BIGINT NOT NULL,
+	blob_key TEXT NOT NULL UNIQUE,
+	thumbnail_key TEXT NOT NULL,
+	created TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS attachments_comment_idx ON attachments(comment_id);
+
+CREATE INDEX IF NOT EXISTS attachments_orphaned_idx ON attachments(created) WHERE comment_id IS NULL;
+`
+	for i, migration := range strings.Split(schema, `;\n\n`) {
+		_, err := as.db.ExecContext(ctx, migration)
+		if err != nil {
+			if max := 30; len(migration) > max {
+				migration = migration[max:]
+			}
+			return fmt.Errorf("migration %d (%s): %s", i, migration, err)
+		}
+	}
+	return nil
+}
+
+func (as *pgAttachmentStore) CreateAttachment(ctx context.Context, a Attachment) (*Attachment, error) {
+	defer surf.CurrentTrace(ctx).Begin("create attachment").Finish()
+
+	a.CommentID = 0
+	a.Created = time.Now()
+	err := as.db.QueryRowContext(ctx, `
+		INSERT INTO attachments (user_id, name, content_type, size, blob_key, thumbnail_key, created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING attachment_id
+	`, a.UserID, a.Name, a.ContentType, a.Size, a.BlobKey, a.ThumbnailKey, a.Created).Scan(&a.AttachmentID)
+	switch {
+	case err == nil:
+		return &a, nil
+	case surf.ErrConstraint.Is(err):
+		return nil, errors.Wrap(ErrConstraint, "user does not exist or blob key is not unique")
+	default:
+		return nil, errors.Wrap(err, "cannot insert attachment")
+	}
+}
+
+func (as *pgAttachmentStore) AttachToComment(ctx context.Context, commentID int64, attachmentIDs []int64) error {
+	defer surf.CurrentTrace(ctx).Begin("attach to comment").Finish()
+
+	attachmentIDs = uniqueInt64s(attachmentIDs)
+	if len(attachmentIDs) == 0 {
+		return nil
+	}
+
+	res, err := as.db.ExecContext(ctx, `
+		UPDATE attachments SET comment_id = $1
+		WHERE attachment_id = ANY($2) AND comment_id IS NULL
+	`, commentID, pq.Array(attachmentIDs))
+	switch {
+	case err == nil:
+		// All good.
+	case surf.ErrConstraint.Is(err):
+		return ErrCommentNotFound
+	default:
+		return errors.Wrap(err, "cannot update attachments")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "cannot get rows affected")
+	} else if n != int64(len(attachmentIDs)) {
+		return errors.Wrap(ErrAttachmentNotFound, "attachment does not exist or is already attached")
+	}
+	return nil
+}
+
+func (as *pgAttachmentStore) AttachmentByID(ctx context.Context, attachmentID int64) (*Attachment, error) {
+	rows, err := as.db.QueryContext(ctx, `
+		SELECT `+attachmentColumns+`
+		FROM attachments
+		WHERE attachment_id = $1
+		LIMIT 1
+	`, attachmentID)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query attachment")
+	}
+	attachments, err := scanAttachments(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(attachments) == 0 {
+		return nil, ErrAttachmentNotFound
+	}
+	return attachments[0], nil
+}
+
+func (as *pgAttachmentStore) ListAttachments(ctx context.Context, commentIDs []int64) (map[int64][]*Attachment, error) {
+	defer surf.CurrentTrace(ctx).Begin("list attachments").Finish()
+
+	grouped := make(map[int64][]*Attachment)
+	if len(commentIDs) == 0 {
+		return grouped, nil
+	}
+
+	rows, err := as.db.QueryContext(ctx, `
+		SELECT `+attachmentColumns+`
+		FROM attachments
+		WHERE comment_id = ANY($1)
+		ORDER BY attachment_id ASC
+	`, pq.Array(commentIDs))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query attachments")
+	}
+	attachments, err := scanAttachments(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range attachments {
+		grouped[a.CommentID] = append(grouped[a.CommentID], a)
+	}
+	return grouped, nil
+}
+
+func (as *pgAttachmentStore) ListOrphanedAttachments(ctx context.Context, createdLte time.Time, heldIDs []int64, limit int) ([]*Attachment, error) {
+	defer surf.CurrentTrace(ctx).Begin("list orphaned attachments").Finish()
+
+	if heldIDs == nil {
+		// NULL array would exclude all attachments.
+		heldIDs = []int64{}
+	}
+
+	rows, err := as.db.QueryContext(ctx, `
+		SELECT `+attachmentColumns+`
+		FROM attachments a
+		WHERE
+			a.comment_id IS NULL
+			AND a.created <= $1
+			AND NOT a.attachment_id = ANY($2)
+		ORDER BY a.created ASC
+		LIMIT $3
+	`, createdLte, pq.Array(heldIDs), limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query attachments")
+	}
+	return scanAttachments(rows)
+}
+
+func (as *pgAttachmentStore) DeleteAttachment(ctx context.Context, attachmentID int64) error {
+	res, err := as.db.ExecContext(ctx, `
+		DELETE FROM attachments WHERE attachment_id = $1
+	`, attachmentID)
+	if err != nil {
+		return errors.Wrap(err, "cannot delete attachment")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "cannot get rows affected")
+	} else if n == 0 {
+		return ErrAttachmentNotFound
+	}
+	return nil
+}
+
+func (as *pgAttachmentStore) ExportAttachments(ctx context.Context, afterID int64, limit int) ([]*Attachment, error) {
+	rows, err := as.db.QueryContext(ctx, `
+		SELECT `+attachmentColumns+`
+		FROM attachments
+		WHERE attachment_id > $1 AND comment_id IS NOT NULL
+		ORDER BY attachment_id ASC
+		LIMIT $2
+	`, afterID, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query attachments")
+	}
+	return scanAttachments(rows)
+}
+
+func (as *pgAttachmentStore) ImportAttachment(ctx context.Context, a Attachment) error {
+	commentID := sql.NullInt64{Int64: a.CommentID, Valid: a.CommentID != 0}
+	_, err := as.db.ExecContext(ctx, `
+		INSERT INTO attachments (attachment_id, comment_id, user_id, name, content_type, size, blob_key, thumbnail_key, created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`, a.AttachmentID, commentID, a.UserID, a.Name, a.ContentType, a.Size, a.BlobKey, a.ThumbnailKey, a.Created)
+	switch {
+	case err == nil:
+		return advanceSequence(ctx, as.db, "attachments", "attachment_id")
+	case surf.ErrConstraint.Is(err):
+		return errors.Wrap(ErrConstraint, "attachment %d already exists or its comment or user does not", a.AttachmentID)
+	default:
+		return errors.Wrap(err, "cannot insert attachment")
+	}
+}
+
+const attachmentColumns = `
+	attachment_id,
+	comment_id,
+	user_id,
+	name,
+	content_type,
+	size,
+	blob_key,
+	thumbnail_key,
+	created
+`
+
+func scanAttachments(rows *sql.Rows) ([]*Attachment, error) {
+	defer rows.Close()
+
+	var attachments []*Attachment
+	for rows.Next() {
+		var (
+			a         Attachment
+			commentID sql.NullInt64
+		)
+		err := rows.Scan(
+			&a.AttachmentID,
+			&commentID,
+			&a.UserID,
+			&a.Name,
+			&a.ContentType,
+			&a.Size,
+			&a.BlobKey,
+			&a.ThumbnailKey,
+			&a.Created,
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot scan attachment")
+		}
+		a.CommentID = commentID.Int64
+		attachments = append(attachments, &a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+	return attachments, nil
+}
@@ -0,0 +1,112 @@
+package gbb
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAttachments(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	bbStore, err := NewPostgresBBStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewPostgresAttachmentStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ensureUser(t, db, 999, "Bobby")
+
+	_, first, err := bbStore.CreateTopic(ctx, "first", "IMO", 1, 999)
+	if err != nil {
+		t.Fatalf("cannot create topic: %s", err)
+	}
+	second, err := bbStore.CreateComment(ctx, first.TopicID, "second", 999)
+	if err != nil {
+		t.Fatalf("cannot create comment: %s", err)
+	}
+
+	create := func(key string) *Attachment {
+		t.Helper()
+		a, err := store.CreateAttachment(ctx, Attachment{
+			UserID:      999,
+			Name:        key + ".txt",
+			ContentType: "text/plain; charset=utf-8",
+			Size:        42,
+			BlobKey:     key,
+		})
+		if err != nil {
+			t.Fatalf("cannot create attachment: %s", err)
+		}
+		return a
+	}
+
+	a1 := create("a1")
+	a2 := create("a2")
+	a3 := create("a3")
+
+	orphans, err := store.ListOrphanedAttachments(ctx, time.Now(), nil, 10)
+	if err != nil {
+		t.Fatalf("cannot list orphaned attachments: %s", err)
+	}
+	if len(orphans) != 3 {
+		t.Fatalf("want 3 orphaned attachments, got %d", len(orphans))
+	}
+	orphans, err = store.ListOrphanedAttachments(ctx, time.Now(), []int64{a2.AttachmentID}, 10)
+	if err != nil {
+		t.Fatalf("cannot list orphaned attachments: %s", err)
+	}
+	if len(orphans) != 2 || orphans[0].AttachmentID != a1.AttachmentID || orphans[1].AttachmentID != a3.AttachmentID {
+		t.Fatalf("want a1 and a3 orphaned, got %+v", orphans)
+	}
+
+	if err := store.AttachToComment(ctx, first.CommentID, []int64{a1.AttachmentID, a2.AttachmentID}); err != nil {
+		t.Fatalf("cannot attach to comment: %s", err)
+	}
+	if err := store.AttachToComment(ctx, second.CommentID, []int64{a3.AttachmentID}); err != nil {
+		t.Fatalf("cannot attach to comment: %s", err)
+	}
+	if err := store.AttachToComment(ctx, second.CommentID, []int64{a1.AttachmentID}); !ErrAttachmentNotFound.Is(err) {
+		t.Fatalf("want ErrAttachmentNotFound when attaching twice, got %+v", err)
+	}
+
+	grouped, err := store.ListAttachments(ctx, []int64{first.CommentID, second.CommentID})
+	if err != nil {
+		t.Fatalf("cannot list attachments: %s", err)
+	}
+	if got := grouped[first.CommentID]; len(got) != 2 || got[0].BlobKey != "a1" || got[1].BlobKey != "a2" {
+		t.Fatalf("unexpected first comment attachments: %+v", got)
+	}
+	if got := grouped[second.CommentID]; len(got) != 1 || got[0].BlobKey != "a3" {
+		t.Fatalf("unexpected second comment attachments: %+v", got)
+	}
+
+	// Deleting a comment orphans its attachments.
+	if err := bbStore.DeleteComment(ctx, second.CommentID); err != nil {
+		t.Fatalf("cannot delete comment: %s", err)
+	}
+	orphans, err = store.ListOrphanedAttachments(ctx, time.Now(), nil, 10)
+	if err != nil {
+		t.Fatalf("cannot list orphaned attachments: %s", err)
+	}
+	if len(orphans) != 1 || orphans[0].AttachmentID != a3.AttachmentID {
+		t.Fatalf("want a3 orphaned, got %+v", orphans)
+	}
+
+	if err := store.DeleteAttachment(ctx, a3.AttachmentID); err != nil {
+		t.Fatalf("cannot delete attachment: %s", err)
+	}
+	if _, err := store.AttachmentByID(ctx, a3.AttachmentID); !ErrAttachmentNotFound.Is(err) {
+		t.Fatalf("want ErrAttachmentNotFound, got %+v", err)
+	}
+	if err := store.DeleteAttachment(ctx, a3.AttachmentID); !ErrAttachmentNotFound.Is(err) {
+		t.Fatalf("want ErrAttachmentNotFound, got %+v", err)
+	}
+}
@@ -3,6 +3,7 @@ package gbb
 import (
 	"context"
 	"database/sql"
+	"sort"
 	"strings"
 	"time"
 
@@ -82,7 +83,7 @@ func (s *pgBBStore) RemoveCategories(ctx context.Context, categoryIDs []int64) e
 	return err
 }
 
-func (s *pgBBStore) ListTopics(ctx context.Context, createdLte time.Time, limit int) ([]*Topic, error) {
+func (s *pgBBStore) ListTopics(ctx context.Context, viewerID int64, createdLte time.Time, limit int) ([]*Topic, error) {
 	var topics []*Topic
 	rows, err := s.db.QueryContext(ctx, `
 		SELECT
@@ -95,17 +96,19 @@ func (s *pgBBStore) ListTopics(ctx context.Context, createdLte time.Time, limit
 			u.user_id,
 			u.name,
 			cc.category_id,
-			cc.name
+			cc.name,
+			t.hidden
 		FROM
 			topics t
 			INNER JOIN users u ON t.author_id = u.user_id
 			INNER JOIN categories cc ON t.category_id = cc.category_id
 		WHERE
 			t.latest_comment <= $1
+			AND (NOT t.hidden OR t.author_id = $3)
 		ORDER BY
 			t.latest_comment DESC
 		LIMIT $2
-	`, createdLte, limit)
+	`, createdLte, limit, viewerID)
 	if err != nil {
 		return topics, errors.Wrap(err, "cannot query topics")
 	}
@@ -124,6 +127,7 @@ func (s *pgBBStore) ListTopics(ctx context.Context, createdLte time.Time, limit
 			&t.Author.Name,
 			&t.Category.CategoryID,
 			&t.Category.Name,
+			&t.Hidden,
 		); err != nil {
 			return topics, errors.Wrap(err, "cannot scan topic row")
 		}
@@ -136,25 +140,225 @@ func (s *pgBBStore) ListTopics(ctx context.Context, createdLte time.Time, limit
 	return topics, nil
 }
 
-func (s *pgBBStore) ListComments(ctx context.Context, topicID int64, offset, limit int) ([]*Comment, error) {
-	var comments []*Comment
+func (s *pgBBStore) ListRankedTopics(
+	ctx context.Context,
+	viewerID int64,
+	ranking TopicRanking,
+	activeGte time.Time,
+	offset, limit int,
+) ([]*Topic, error) {
+	var (
+		join    string
+		orderBy string
+		args    = []interface{}{limit, offset, viewerID}
+	)
+	switch {
+	case ranking == RankHot:
+		join = `LEFT JOIN topic_scores s ON s.topic_id = t.topic_id`
+		orderBy = `COALESCE(s.hot_score, 0) DESC, t.latest_comment DESC`
+	case ranking == RankTop && activeGte.IsZero():
+		orderBy = `t.comments_count DESC, t.views_count DESC, t.created DESC`
+	case ranking == RankTop:
+		// Only comments written within the period count, so that
+		// topics that were busy long ago do not stay on top.
+		join = `INNER JOIN (
+			SELECT topic_id, COUNT(*) AS cnt
+			FROM comments
+			WHERE created >= $4 AND NOT hidden
+			GROUP BY topic_id
+		) a ON a.topic_id = t.topic_id`
+		orderBy = `a.cnt DESC, t.views_count DESC, t.latest_comment DESC`
+		args = append(args, activeGte)
+	case ranking == RankNew:
+		orderBy = `t.created DESC`
+	default:
+		return nil, errors.Wrap(ErrMalformed, "unknown ranking %q", ranking)
+	}
+
+	var topics []*Topic
 	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			t.topic_id,
+			t.subject,
+			t.created,
+			t.views_count,
+			t.comments_count,
+			t.latest_comment,
+			u.user_id,
+			u.name,
+			cc.category_id,
+			cc.name,
+			t.hidden
+		FROM
+			topics t
+			INNER JOIN users u ON t.author_id = u.user_id
+			INNER JOIN categories cc ON t.category_id = cc.category_id
+			`+join+`
+		WHERE
+			NOT t.hidden OR t.author_id = $3
+		ORDER BY
+			`+orderBy+`
+		LIMIT $1
+		OFFSET $2
+	`, args...)
+	if err != nil {
+		return topics, errors.Wrap(err, "cannot query topics")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t Topic
+		if err := rows.Scan(
+			&t.TopicID,
+			&t.Subject,
+			&t.Created,
+			&t.ViewsCount,
+			&t.CommentsCount,
+			&t.Updated,
+			&t.Author.UserID,
+			&t.Author.Name,
+			&t.Category.CategoryID,
+			&t.Category.Name,
+			&t.Hidden,
+		); err != nil {
+			return topics, errors.Wrap(err, "cannot scan topic row")
+		}
+
+		topics = append(topics, &t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+	return topics, nil
+}
+
+// RefreshTopicScores computes the "hot" score of all recently active topics.
+//
+// Score is growing with the number of comments written during the last day and
+// with the number of views, and decays with the time since the last comment.
+// Topics that were not active for a long time have no score.
+//
+// Scores are kept in a separate table, so that refreshing them does not lock
+// the topic rows that comments and view counts are updating.
+func (s *pgBBStore) RefreshTopicScores(ctx context.Context) error {
+	defer surf.CurrentTrace(ctx).Begin("refresh topic scores").Finish()
+
+	_, err := s.db.ExecContext(ctx, `
+		WITH scores AS (
+			SELECT
+				t.topic_id,
+				(COALESCE(rc.cnt, 0) * 10 + t.views_count / 10.0 + 1)
+					/ power(EXTRACT(EPOCH FROM now() - t.latest_comment) / 3600 + 2, 1.5) AS score
+			FROM
+				topics t
+				LEFT JOIN (
+					SELECT topic_id, COUNT(*) AS cnt
+					FROM comments
+					WHERE created > now() - INTERVAL '1 day' AND NOT hidden
+					GROUP BY topic_id
+				) rc ON rc.topic_id = t.topic_id
+			WHERE
+				t.latest_comment >= now() - INTERVAL '30 days'
+		), stale AS (
+			DELETE FROM topic_scores
+			WHERE topic_id NOT IN (SELECT topic_id FROM scores)
+		)
+		INSERT INTO topic_scores (topic_id, hot_score)
+		SELECT topic_id, score FROM scores
+		ON CONFLICT (topic_id) DO UPDATE SET hot_score = EXCLUDED.hot_score
+	`)
+	if err != nil {
+		return errors.Wrap(err, "cannot update topic scores")
+	}
+	return nil
+}
+
+func (s *pgBBStore) ListComments(ctx context.Context, topicID, viewerID int64, cursor CommentCursor, limit int) ([]*Comment, error) {
+	// Comments are always selected using (created, comment_id) as the key,
+	// so that the index can be used instead of skipping rows.
+	var (
+		query string
+		args  = []interface{}{topicID, limit, viewerID, cursor.Created, cursor.CommentID}
+	)
+	switch {
+	case !cursor.Backward:
+		query = `
 		SELECT
 			c.comment_id,
 			c.content,
+			c.revision,
 			c.created,
 			c.author_id,
-			u.name
+			u.name,
+			u.reputation,
+			c.hidden
 		FROM
 			comments c
 			INNER JOIN users u ON c.author_id = u.user_id
 		WHERE
 			c.topic_id = $1
+			AND (NOT c.hidden OR c.author_id = $3)
+			AND (c.created, c.comment_id) >= ($4, $5)
 		ORDER BY
-			c.created ASC
+			c.created ASC, c.comment_id ASC
 		LIMIT $2
-		OFFSET $3
-	`, topicID, limit, offset)
+		`
+	case cursor.IsZero():
+		args = args[:3]
+		query = `
+		SELECT * FROM (
+			SELECT
+				c.comment_id,
+				c.content,
+				c.revision,
+				c.created,
+				c.author_id,
+				u.name,
+				u.reputation,
+				c.hidden
+			FROM
+				comments c
+				INNER JOIN users u ON c.author_id = u.user_id
+			WHERE
+				c.topic_id = $1
+				AND (NOT c.hidden OR c.author_id = $3)
+			ORDER BY
+				c.created DESC, c.comment_id DESC
+			LIMIT $2
+		) page
+		ORDER BY
+			page.created ASC, page.comment_id ASC
+		`
+	default:
+		query = `
+		SELECT * FROM (
+			SELECT
+				c.comment_id,
+				c.content,
+				c.revision,
+				c.created,
+				c.author_id,
+				u.name,
+				u.reputation,
+				c.hidden
+			FROM
+				comments c
+				INNER JOIN users u ON c.author_id = u.user_id
+			WHERE
+				c.topic_id = $1
+				AND (NOT c.hidden OR c.author_id = $3)
+				AND (c.created, c.comment_id) < ($4, $5)
+			ORDER BY
+				c.created DESC, c.comment_id DESC
+			LIMIT $2
+		) page
+		ORDER BY
+			page.created ASC, page.comment_id ASC
+		`
+	}
+
+	var comments []*Comment
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot query comments")
 	}
@@ -164,9 +368,12 @@ func (s *pgBBStore) ListComments(ctx context.Context, topicID int64, offset, lim
 		if err := rows.Scan(
 			&c.CommentID,
 			&c.Content,
+			&c.Revision,
 			&c.Created,
 			&c.Author.UserID,
 			&c.Author.Name,
+			&c.Author.Reputation,
+			&c.Hidden,
 		); err != nil {
 			return comments, errors.Wrap(err, "cannot scan comment")
 		}
@@ -179,7 +386,7 @@ func (s *pgBBStore) ListComments(ctx context.Context, topicID int64, offset, lim
 	return comments, nil
 }
 
-func (s *pgBBStore) Search(ctx context.Context, text string, categories []int64, offset, limit int64) ([]*SearchResult, error) {
+func (s *pgBBStore) Search(ctx context.Context, viewerID int64, text string, categories []int64, offset, limit int64) ([]*SearchResult, error) {
 	var results []*SearchResult
 
 	rows, err := s.db.QueryContext(ctx, `
@@ -193,6 +400,7 @@ func (s *pgBBStore) Search(ctx context.Context, text string, categories []int64,
 			t.latest_comment,
 			c.comment_id,
 			c.content,
+			c.revision,
 			c.created,
 			c.author_id,
 			u.name,
@@ -206,11 +414,13 @@ func (s *pgBBStore) Search(ctx context.Context, text string, categories []int64,
 		WHERE
 			(char_length($1) = 0 OR c.content ILIKE '%' || $1 || '%')
 			AND ($2::INTEGER[] IS NULL OR t.category_id = ANY($2::INTEGER[]))
+			AND (NOT c.hidden OR c.author_id = $5)
+			AND (NOT t.hidden OR t.author_id = $5)
 		ORDER BY
 			c.created ASC
 		LIMIT $3
 		OFFSET $4
-	`, text, pq.Array(categories), limit, offset)
+	`, text, pq.Array(categories), limit, offset, viewerID)
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot execute query")
 	}
@@ -227,6 +437,7 @@ func (s *pgBBStore) Search(ctx context.Context, text string, categories []int64,
 			&r.Topic.Updated,
 			&r.Comment.CommentID,
 			&r.Comment.Content,
+			&r.Comment.Revision,
 			&r.Comment.Created,
 			&r.Comment.Author.UserID,
 			&r.Comment.Author.Name,
@@ -257,7 +468,10 @@ func (s *pgBBStore) TopicByID(ctx context.Context, topicID int64) (*Topic, error
 			u.user_id,
 			u.name,
 			cc.category_id,
-			cc.name
+			cc.name,
+			t.accepted_comment_id,
+			t.locked,
+			t.hidden
 		FROM
 			topics t
 			INNER JOIN users u ON t.author_id = u.user_id
@@ -266,6 +480,7 @@ func (s *pgBBStore) TopicByID(ctx context.Context, topicID int64) (*Topic, error
 			t.topic_id = $1
 		LIMIT 1
 	`, topicID)
+	var acceptedID sql.NullInt64
 	err := row.Scan(
 		&t.TopicID,
 		&t.Subject,
@@ -277,9 +492,13 @@ func (s *pgBBStore) TopicByID(ctx context.Context, topicID int64) (*Topic, error
 		&t.Author.Name,
 		&t.Category.CategoryID,
 		&t.Category.Name,
+		&acceptedID,
+		&t.Locked,
+		&t.Hidden,
 	)
 	switch {
 	case err == nil:
+		t.AcceptedCommentID = acceptedID.Int64
 		return &t, nil
 	case surf.ErrNotFound.Is(err):
 		return nil, ErrTopicNotFound
@@ -306,9 +525,10 @@ func (s *pgBBStore) CreateTopic(
 	user := User{
 		UserID: userID,
 	}
+	var banned, hidden bool
 	err = tx.QueryRowContext(ctx, `
-		SELECT name FROM users WHERE user_id = $1 LIMIT 1
-	`, userID).Scan(&user.Name)
+		SELECT name, banned, hidden FROM users WHERE user_id = $1 LIMIT 1
+	`, userID).Scan(&user.Name, &banned, &hidden)
 	switch {
 	case err == nil:
 		// All good
@@ -317,8 +537,13 @@ func (s *pgBBStore) CreateTopic(
 	default:
 		return nil, nil, errors.Wrap(err, "cannot fetch the user")
 	}
+	if banned {
+		return nil, nil, ErrUserBanned
+	}
 
-	now := time.Now().UTC()
+	// PostgreSQL keeps microsecond precision. Returned value must be
+	// usable as a comment cursor.
+	now := time.Now().UTC().Truncate(time.Microsecond)
 	topic := Topic{
 		Subject: subject,
 		Author:  user,
@@ -327,27 +552,30 @@ func (s *pgBBStore) CreateTopic(
 		Category: Category{
 			CategoryID: categoryID,
 		},
+		Hidden: hidden,
 	}
 	err = tx.QueryRowContext(ctx, `
-		INSERT INTO topics (subject, created, author_id, category_id, views_count, comments_count)
-		VALUES ($1, $2, $3, $4, 0, 0)
+		INSERT INTO topics (subject, created, author_id, category_id, views_count, comments_count, hidden)
+		VALUES ($1, $2, $3, $4, 0, 0, $5)
 		RETURNING topic_id
-	`, topic.Subject, topic.Created, user.UserID, topic.Category.CategoryID).Scan(&topic.TopicID)
+	`, topic.Subject, topic.Created, user.UserID, topic.Category.CategoryID, topic.Hidden).Scan(&topic.TopicID)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "cannot create a topic")
 	}
 
 	comment := Comment{
-		TopicID: topic.TopicID,
-		Content: content,
-		Created: now,
-		Author:  user,
+		TopicID:  topic.TopicID,
+		Content:  content,
+		Revision: 1,
+		Created:  now,
+		Author:   user,
+		Hidden:   hidden,
 	}
 	err = tx.QueryRowContext(ctx, `
-		INSERT INTO comments (topic_id, content, created, author_id)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO comments (topic_id, content, created, author_id, hidden)
+		VALUES ($1, $2, $3, $4, $5)
 		RETURNING comment_id
-	`, comment.TopicID, comment.Content, comment.Created, user.UserID).Scan(&comment.CommentID)
+	`, comment.TopicID, comment.Content, comment.Created, user.UserID, comment.Hidden).Scan(&comment.CommentID)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "cannot create a comment")
 	}
@@ -370,9 +598,10 @@ func (s *pgBBStore) CreateComment(ctx context.Context, topicID int64, content st
 	user := User{
 		UserID: userID,
 	}
+	var banned, hidden bool
 	err = tx.QueryRowContext(ctx, `
-		SELECT name FROM users WHERE user_id = $1 LIMIT 1
-	`, userID).Scan(&user.Name)
+		SELECT name, banned, hidden FROM users WHERE user_id = $1 LIMIT 1
+	`, userID).Scan(&user.Name, &banned, &hidden)
 	switch {
 	case err == nil:
 		// All good.
@@ -381,19 +610,24 @@ func (s *pgBBStore) CreateComment(ctx context.Context, topicID int64, content st
 	default:
 		return nil, errors.Wrap(err, "cannot fetch the user")
 	}
+	if banned {
+		return nil, ErrUserBanned
+	}
 
 	comment := Comment{
-		TopicID: topicID,
-		Content: content,
-		Created: time.Now().UTC(),
-		Author:  user,
+		TopicID:  topicID,
+		Content:  content,
+		Revision: 1,
+		Created:  time.Now().UTC().Truncate(time.Microsecond),
+		Author:   user,
+		Hidden:   hidden,
 	}
 
 	err = tx.QueryRowContext(ctx, `
-		INSERT INTO comments (topic_id, content, created, author_id)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO comments (topic_id, content, created, author_id, hidden)
+		VALUES ($1, $2, $3, $4, $5)
 		RETURNING comment_id
-	`, comment.TopicID, comment.Content, comment.Created, user.UserID).Scan(&comment.CommentID)
+	`, comment.TopicID, comment.Content, comment.Created, user.UserID, comment.Hidden).Scan(&comment.CommentID)
 	switch {
 	case err == nil:
 		// All good.
@@ -409,15 +643,34 @@ func (s *pgBBStore) CreateComment(ctx context.Context, topicID int64, content st
 	return &comment, nil
 }
 
-func (s *pgBBStore) IncrementTopicView(ctx context.Context, topicID int64) error {
-	defer surf.CurrentTrace(ctx).Begin("increment topic view").Finish()
+func (s *pgBBStore) IncrementTopicViews(ctx context.Context, views map[int64]int64) error {
+	defer surf.CurrentTrace(ctx).Begin("increment topic views").Finish()
+
+	if len(views) == 0 {
+		return nil
+	}
+
+	// Always update rows in the same order to avoid deadlocks between
+	// concurrent updates.
+	topicIDs := make([]int64, 0, len(views))
+	for id := range views {
+		topicIDs = append(topicIDs, id)
+	}
+	sort.Slice(topicIDs, func(i, j int) bool { return topicIDs[i] < topicIDs[j] })
+	counts := make([]int64, len(topicIDs))
+	for i, id := range topicIDs {
+		counts[i] = views[id]
+	}
 
 	_, err := s.db.ExecContext(ctx, `
-		UPDATE topics SET views_count = views_count + 1
-		WHERE topic_id = $1
-	`, topicID)
+		UPDATE topics t SET views_count = t.views_count + v.views
+		FROM (
+			SELECT unnest($1::INTEGER[]) AS topic_id, unnest($2::INTEGER[]) AS views
+		) v
+		WHERE t.topic_id = v.topic_id
+	`, pq.Array(topicIDs), pq.Array(counts))
 	if err != nil {
-		return errors.Wrap(err, "cannot increament the topic view counter")
+		return errors.Wrap(err, "cannot increment the topic view counters")
 	}
 	// it does not matter that if counter was incremented or not -
 	// successfult query execution is good enough for this use case
@@ -427,7 +680,7 @@ func (s *pgBBStore) IncrementTopicView(ctx context.Context, topicID int64) error
 func (s *pgBBStore) UpdateComment(ctx context.Context, commentID int64, content string) error {
 	res, err := s.db.ExecContext(ctx, `
 		UPDATE comments
-		SET content = $2
+		SET content = $2, revision = revision + 1
 		WHERE comment_id = $1
 	`, commentID, content)
 	if err != nil {
@@ -499,11 +752,133 @@ func (s *pgBBStore) DeleteComment(ctx context.Context, commentID int64) error {
 	return nil
 }
 
-func (s *pgBBStore) CommentByID(ctx context.Context, commentID int64) (*Topic, *Comment, int, error) {
+func (s *pgBBStore) ListHiddenComments(ctx context.Context, limit int) ([]*HiddenComment, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			t.topic_id,
+			t.subject,
+			t.hidden,
+			c.comment_id,
+			c.content,
+			c.revision,
+			c.created,
+			u.user_id,
+			u.name,
+			u.reputation,
+			NOT EXISTS (
+				SELECT 1 FROM comments
+				WHERE topic_id = c.topic_id AND (created, comment_id) < (c.created, c.comment_id)
+			) AS is_first
+		FROM
+			comments c
+			INNER JOIN topics t ON c.topic_id = t.topic_id
+			INNER JOIN users u ON c.author_id = u.user_id
+		WHERE
+			c.hidden
+		ORDER BY
+			c.created ASC
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query hidden comments")
+	}
+	defer rows.Close()
+
+	var comments []*HiddenComment
+	for rows.Next() {
+		hc := HiddenComment{
+			Comment: Comment{Hidden: true},
+		}
+		if err := rows.Scan(
+			&hc.Topic.TopicID,
+			&hc.Topic.Subject,
+			&hc.Topic.Hidden,
+			&hc.Comment.CommentID,
+			&hc.Comment.Content,
+			&hc.Comment.Revision,
+			&hc.Comment.Created,
+			&hc.Comment.Author.UserID,
+			&hc.Comment.Author.Name,
+			&hc.Comment.Author.Reputation,
+			&hc.IsFirst,
+		); err != nil {
+			return nil, errors.Wrap(err, "cannot scan hidden comment")
+		}
+		hc.Comment.TopicID = hc.Topic.TopicID
+		comments = append(comments, &hc)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+	return comments, nil
+}
+
+func (s *pgBBStore) ApproveComment(ctx context.Context, commentID int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "cannot begin the transaction")
+	}
+	defer tx.Rollback()
+
+	// Topic counters are updated by the triggers.
+	var (
+		topicID int64
+		created time.Time
+	)
+	err = tx.QueryRowContext(ctx, `
+		UPDATE comments SET hidden = false
+		WHERE comment_id = $1 AND hidden
+		RETURNING topic_id, created
+	`, commentID).Scan(&topicID, &created)
+	switch {
+	case err == nil:
+		// All good.
+	case surf.ErrNotFound.Is(err):
+		return ErrCommentNotFound
+	default:
+		return errors.Wrap(err, "cannot update comment")
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE topics SET hidden = false
+		WHERE
+			topic_id = $1
+			AND hidden
+			AND NOT EXISTS (
+				SELECT 1 FROM comments
+				WHERE topic_id = $1 AND (created, comment_id) < ($2, $3)
+			)
+	`, topicID, created, commentID); err != nil {
+		return errors.Wrap(err, "cannot update topic")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "cannot commit the transaction")
+	}
+	return nil
+}
+
+func (s *pgBBStore) SetTopicLocked(ctx context.Context, topicID int64, locked bool) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE topics SET locked = $2 WHERE topic_id = $1
+	`, topicID, locked)
+	if err != nil {
+		return errors.Wrap(err, "cannot update topic")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "cannot get affected rows")
+	} else if n == 0 {
+		return ErrTopicNotFound
+	}
+	return nil
+}
+
+func (s *pgBBStore) CommentByID(ctx context.Context, commentID int64) (*Topic, *Comment, bool, error) {
 	var (
 		t          Topic
 		c          Comment
-		commentPos int
+		acceptedID sql.NullInt64
+		isFirst    bool
 	)
 	row := s.db.QueryRowContext(ctx, `
 		SELECT
@@ -516,12 +891,21 @@ func (s *pgBBStore) CommentByID(ctx context.Context, commentID int64) (*Topic, *
 			tu.name AS topic_user_name,
 			c.comment_id,
 			c.content,
+			c.revision,
 			c.created,
 			cc.category_id,
 			cc.name,
 			cu.user_id AS comment_user_id,
 			cu.name AS comment_user_name,
-			(SELECT COUNT(*) FROM comments WHERE topic_id = c.topic_id AND created < c.created) AS comment_pos
+			cu.reputation AS comment_user_reputation,
+			t.accepted_comment_id,
+			t.locked,
+			t.hidden,
+			c.hidden,
+			NOT EXISTS (
+				SELECT 1 FROM comments
+				WHERE topic_id = c.topic_id AND (created, comment_id) < (c.created, c.comment_id)
+			) AS is_first
 		FROM
 			comments c
 			INNER JOIN users cu ON c.author_id = cu.user_id
@@ -542,20 +926,28 @@ func (s *pgBBStore) CommentByID(ctx context.Context, commentID int64) (*Topic, *
 		&t.Author.Name,
 		&c.CommentID,
 		&c.Content,
+		&c.Revision,
 		&c.Created,
 		&t.Category.CategoryID,
 		&t.Category.Name,
 		&c.Author.UserID,
 		&c.Author.Name,
-		&commentPos,
+		&c.Author.Reputation,
+		&acceptedID,
+		&t.Locked,
+		&t.Hidden,
+		&c.Hidden,
+		&isFirst,
 	)
 	switch {
 	case err == nil:
-		return &t, &c, commentPos, nil
+		c.TopicID = t.TopicID
+		t.AcceptedCommentID = acceptedID.Int64
+		return &t, &c, isFirst, nil
 	case surf.ErrNotFound.Is(err):
-		return nil, nil, 0, ErrCommentNotFound
+		return nil, nil, false, ErrCommentNotFound
 	default:
-		return nil, nil, 0, errors.Wrap(err, "cannot query comment")
+		return nil, nil, false, errors.Wrap(err, "cannot query comment")
 	}
 }
 
@@ -566,13 +958,16 @@ func (s *pgBBStore) AuthenticateUser(ctx context.Context, login, password string
 	}
 	defer tx.Rollback()
 
-	var passhash string
+	var (
+		passhash string
+		banned   bool
+	)
 	err = tx.QueryRowContext(ctx, `
-		SELECT password
+		SELECT password, banned
 		FROM users
 		WHERE name = $1
 		LIMIT 1
-	`, login).Scan(&passhash)
+	`, login).Scan(&passhash, &banned)
 	switch {
 	case err == nil:
 		// All good.
@@ -590,6 +985,10 @@ func (s *pgBBStore) AuthenticateUser(ctx context.Context, login, password string
 	default:
 		return nil, errors.Wrap(err, "bcrypt")
 	}
+	// Ban is revealed only to those who know the password.
+	if banned {
+		return nil, ErrUserBanned
+	}
 
 	var u User
 	err = tx.QueryRowContext(ctx, `
@@ -621,24 +1020,35 @@ func (s *pgBBStore) RegisterUser(ctx context.Context, password string, u User) (
 	return &u, nil
 }
 
-func (s *pgBBStore) UserInfo(ctx context.Context, userID int64) (*UserInfo, error) {
+func (s *pgBBStore) UserInfo(ctx context.Context, userID, viewerID int64) (*UserInfo, error) {
 	u := UserInfo{
 		User: User{UserID: userID},
 	}
+	// Counters maintained by the triggers include only visible content.
 	err := s.db.QueryRowContext(ctx, `
 		SELECT
 			u.name,
 			u.scopes,
-			(SELECT COUNT(*) FROM topics t WHERE t.author_id = u.user_id) AS topics_count,
-			(SELECT COUNT(*) FROM comments c WHERE c.author_id = u.user_id) AS comments_count
+			u.reputation,
+			u.topics_count + CASE WHEN u.user_id = $2
+				THEN (SELECT COUNT(*) FROM topics WHERE author_id = u.user_id AND hidden)
+				ELSE 0 END,
+			u.comments_count + CASE WHEN u.user_id = $2
+				THEN (SELECT COUNT(*) FROM comments WHERE author_id = u.user_id AND hidden)
+				ELSE 0 END,
+			u.banned,
+			u.hidden
 		FROM users u
 		WHERE u.user_id = $1
 		LIMIT 1
-	`, userID).Scan(
+	`, userID, viewerID).Scan(
 		&u.Name,
 		&u.Scopes,
+		&u.Reputation,
 		&u.TopicsCount,
-		&u.CommentsCount)
+		&u.CommentsCount,
+		&u.Banned,
+		&u.Hidden)
 	switch {
 	case err == nil:
 		return &u, nil
@@ -649,6 +1059,408 @@ func (s *pgBBStore) UserInfo(ctx context.Context, userID int64) (*UserInfo, erro
 	}
 }
 
+func (s *pgBBStore) SetUserBanned(ctx context.Context, userID int64, banned bool) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE users SET banned = $2 WHERE user_id = $1
+	`, userID, banned)
+	if err != nil {
+		return errors.Wrap(err, "cannot update user")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "cannot get affected rows")
+	} else if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *pgBBStore) SetUserHidden(ctx context.Context, userID int64, hidden bool) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE users SET hidden = $2 WHERE user_id = $1
+	`, userID, hidden)
+	if err != nil {
+		return errors.Wrap(err, "cannot update user")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "cannot get affected rows")
+	} else if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *pgBBStore) UsersByName(ctx context.Context, names []string) ([]*User, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT user_id, name, scopes, reputation
+		FROM users
+		WHERE name = ANY($1)
+		ORDER BY name
+		LIMIT 1000
+	`, pq.Array(names))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query users")
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.UserID, &u.Name, &u.Scopes, &u.Reputation); err != nil {
+			return nil, errors.Wrap(err, "cannot scan user")
+		}
+		users = append(users, &u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+	return users, nil
+}
+
+func (s *pgBBStore) GrantScopes(ctx context.Context, userID int64, scopes UserScope) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE users
+		SET scopes = scopes | $2
+		WHERE user_id = $1
+	`, userID, scopes)
+	if err != nil {
+		return errors.Wrap(err, "cannot update user scopes")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "cannot get rows affected by the scopes change")
+	} else if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *pgBBStore) RevokeScopes(ctx context.Context, userID int64, scopes UserScope) error {
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE users
+		SET scopes = scopes & ~$2::SMALLINT
+		WHERE user_id = $1
+	`, userID, scopes)
+	if err != nil {
+		return errors.Wrap(err, "cannot update user scopes")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "cannot get rows affected by the scopes change")
+	} else if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+func (s *pgBBStore) AcceptComment(ctx context.Context, topicID, commentID int64) error {
+	accepted := sql.NullInt64{Int64: commentID, Valid: commentID != 0}
+	// Reputation of the comment authors is updated by the trigger.
+	res, err := s.db.ExecContext(ctx, `
+		UPDATE topics
+		SET accepted_comment_id = $2
+		WHERE
+			topic_id = $1
+			AND (
+				$2::INTEGER IS NULL
+				OR EXISTS (SELECT 1 FROM comments WHERE comment_id = $2 AND topic_id = $1)
+			)
+	`, topicID, accepted)
+	if err != nil {
+		return errors.Wrap(err, "cannot update accepted comment")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "cannot get rows affected by the accepted comment change")
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *pgBBStore) PenalizeUser(ctx context.Context, userID, moderatorID int64, points int64, reason string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "cannot begin the transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO reputation_penalties (user_id, moderator_id, points, reason, created)
+		VALUES ($1, $2, $3, $4, $5)
+	`, userID, moderatorID, points, reason, time.Now())
+	switch {
+	case err == nil:
+		// All good.
+	case surf.ErrConstraint.Is(err):
+		return ErrUserNotFound
+	default:
+		return errors.Wrap(err, "cannot insert penalty")
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE users SET reputation = reputation - $2 WHERE user_id = $1
+	`, userID, points); err != nil {
+		return errors.Wrap(err, "cannot update user reputation")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "cannot commit the transaction")
+	}
+	return nil
+}
+
+func (s *pgBBStore) ExportUsers(ctx context.Context, afterID int64, limit int) ([]*ArchivedUser, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT user_id, name, password, scopes, reputation, banned, hidden
+		FROM users
+		WHERE user_id > $1
+		ORDER BY user_id
+		LIMIT $2
+	`, afterID, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query users")
+	}
+	defer rows.Close()
+
+	var users []*ArchivedUser
+	for rows.Next() {
+		var u ArchivedUser
+		if err := rows.Scan(&u.UserID, &u.Name, &u.PasswordHash, &u.Scopes, &u.Reputation, &u.Banned, &u.Hidden); err != nil {
+			return nil, errors.Wrap(err, "cannot scan user")
+		}
+		users = append(users, &u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+	return users, nil
+}
+
+func (s *pgBBStore) ExportTopics(ctx context.Context, afterID int64, limit int) ([]*Topic, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			t.topic_id,
+			t.subject,
+			t.created,
+			t.views_count,
+			t.comments_count,
+			t.latest_comment,
+			u.user_id,
+			u.name,
+			cc.category_id,
+			cc.name,
+			t.accepted_comment_id,
+			t.locked,
+			t.hidden
+		FROM
+			topics t
+			INNER JOIN users u ON t.author_id = u.user_id
+			INNER JOIN categories cc ON t.category_id = cc.category_id
+		WHERE
+			t.topic_id > $1
+		ORDER BY
+			t.topic_id
+		LIMIT $2
+	`, afterID, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query topics")
+	}
+	defer rows.Close()
+
+	var topics []*Topic
+	for rows.Next() {
+		var (
+			t          Topic
+			acceptedID sql.NullInt64
+		)
+		if err := rows.Scan(
+			&t.TopicID,
+			&t.Subject,
+			&t.Created,
+			&t.ViewsCount,
+			&t.CommentsCount,
+			&t.Updated,
+			&t.Author.UserID,
+			&t.Author.Name,
+			&t.Category.CategoryID,
+			&t.Category.Name,
+			&acceptedID,
+			&t.Locked,
+			&t.Hidden,
+		); err != nil {
+			return nil, errors.Wrap(err, "cannot scan topic row")
+		}
+		t.AcceptedCommentID = acceptedID.Int64
+		topics = append(topics, &t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+	return topics, nil
+}
+
+func (s *pgBBStore) ExportComments(ctx context.Context, afterID int64, limit int) ([]*Comment, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			c.comment_id,
+			c.topic_id,
+			c.content,
+			c.revision,
+			c.created,
+			u.user_id,
+			u.name,
+			c.hidden
+		FROM
+			comments c
+			INNER JOIN users u ON c.author_id = u.user_id
+		WHERE
+			c.comment_id > $1
+		ORDER BY
+			c.comment_id
+		LIMIT $2
+	`, afterID, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query comments")
+	}
+	defer rows.Close()
+
+	var comments []*Comment
+	for rows.Next() {
+		var c Comment
+		if err := rows.Scan(
+			&c.CommentID,
+			&c.TopicID,
+			&c.Content,
+			&c.Revision,
+			&c.Created,
+			&c.Author.UserID,
+			&c.Author.Name,
+			&c.Hidden,
+		); err != nil {
+			return nil, errors.Wrap(err, "cannot scan comment row")
+		}
+		comments = append(comments, &c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+	return comments, nil
+}
+
+// advanceSequence moves the ID sequence of the table past all existing rows,
+// so that records created after an import do not collide with imported ones.
+func advanceSequence(ctx context.Context, db sqldb.Database, table, column string) error {
+	_, err := db.ExecContext(ctx, `
+		SELECT setval(pg_get_serial_sequence($1, $2), MAX(`+column+`)) FROM `+table,
+		table, column)
+	if err != nil {
+		return errors.Wrap(err, "cannot advance %s sequence", table)
+	}
+	return nil
+}
+
+func (s *pgBBStore) ImportUser(ctx context.Context, u ArchivedUser) (int64, error) {
+	var id int64
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO users (user_id, name, password, scopes, reputation, banned, hidden)
+		VALUES (COALESCE(NULLIF($1::INTEGER, 0), nextval(pg_get_serial_sequence('users', 'user_id'))), $2, $3, $4, $5, $6, $7)
+		RETURNING user_id
+	`, u.UserID, u.Name, u.PasswordHash, u.Scopes, u.Reputation, u.Banned, u.Hidden).Scan(&id)
+	switch {
+	case err == nil:
+		if u.UserID == 0 {
+			return id, nil
+		}
+		return id, advanceSequence(ctx, s.db, "users", "user_id")
+	case surf.ErrConstraint.Is(err):
+		return 0, errors.Wrap(ErrConstraint, "user %d already exists", u.UserID)
+	default:
+		return 0, errors.Wrap(err, "cannot insert user")
+	}
+}
+
+func (s *pgBBStore) ImportCategory(ctx context.Context, c Category) error {
+	if _, err := s.db.ExecContext(ctx, `
+		INSERT INTO categories (category_id, name)
+		VALUES ($1, $2)
+		ON CONFLICT (category_id) DO UPDATE SET name = EXCLUDED.name
+	`, c.CategoryID, c.Name); err != nil {
+		return errors.Wrap(err, "cannot upsert category")
+	}
+	return advanceSequence(ctx, s.db, "categories", "category_id")
+}
+
+func (s *pgBBStore) ImportTopic(ctx context.Context, t Topic) (int64, error) {
+	// Latest comment time and the comments counter are updated by the
+	// trigger when comments are imported.
+	var id int64
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO topics (topic_id, subject, created, author_id, category_id, views_count, comments_count, latest_comment, locked, hidden)
+		VALUES (COALESCE(NULLIF($1::INTEGER, 0), nextval(pg_get_serial_sequence('topics', 'topic_id'))), $2, $3, $4, $5, $6, 0, $3, $7, $8)
+		RETURNING topic_id
+	`, t.TopicID, t.Subject, t.Created, t.Author.UserID, t.Category.CategoryID, t.ViewsCount, t.Locked, t.Hidden).Scan(&id)
+	switch {
+	case err == nil:
+		if t.TopicID == 0 {
+			return id, nil
+		}
+		return id, advanceSequence(ctx, s.db, "topics", "topic_id")
+	case surf.ErrConstraint.Is(err):
+		return 0, errors.Wrap(ErrConstraint, "topic %d already exists or its author or category does not", t.TopicID)
+	default:
+		return 0, errors.Wrap(err, "cannot insert topic")
+	}
+}
+
+func (s *pgBBStore) ImportComment(ctx context.Context, c Comment) (int64, error) {
+	var id int64
+	err := s.db.QueryRowContext(ctx, `
+		INSERT INTO comments (comment_id, topic_id, content, revision, created, author_id, hidden)
+		VALUES (COALESCE(NULLIF($1::INTEGER, 0), nextval(pg_get_serial_sequence('comments', 'comment_id'))), $2, $3, $4, $5, $6, $7)
+		RETURNING comment_id
+	`, c.CommentID, c.TopicID, c.Content, c.Revision, c.Created, c.Author.UserID, c.Hidden).Scan(&id)
+	switch {
+	case err == nil:
+		if c.CommentID == 0 {
+			return id, nil
+		}
+		return id, advanceSequence(ctx, s.db, "comments", "comment_id")
+	case surf.ErrConstraint.Is(err):
+		return 0, errors.Wrap(ErrConstraint, "comment %d already exists or its topic or author does not", c.CommentID)
+	default:
+		return 0, errors.Wrap(err, "cannot insert comment")
+	}
+}
+
+func (s *pgBBStore) ImportAcceptedComment(ctx context.Context, topicID, commentID int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "cannot begin the transaction")
+	}
+	defer tx.Rollback()
+
+	// Reputation trigger is skipped while importing.
+	if _, err := tx.ExecContext(ctx, `SET LOCAL gbb.import = 'on'`); err != nil {
+		return errors.Wrap(err, "cannot mark the transaction as import")
+	}
+	res, err := tx.ExecContext(ctx, `
+		UPDATE topics
+		SET accepted_comment_id = $2
+		WHERE
+			topic_id = $1
+			AND EXISTS (SELECT 1 FROM comments WHERE comment_id = $2 AND topic_id = $1)
+	`, topicID, commentID)
+	if err != nil {
+		return errors.Wrap(err, "cannot update accepted comment")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "cannot get rows affected by the accepted comment change")
+	} else if n == 0 {
+		return ErrCommentNotFound
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "cannot commit the transaction")
+	}
+	return nil
+}
+
 func (s *pgBBStore) ensureSchema(ctx context.Context) error {
 	const schema = `
 CREATE TABLE IF NOT EXISTS
@@ -703,17 +1515,36 @@ comments (
 	topic_id INTEGER NOT NULL REFERENCES topics(topic_id),
 	content TEXT NOT NULL,
 	created TIMESTAMPTZ NOT NULL,
-	author_id INTEGER NOT NULL REFERENCES users(user_id)
+	author_id INTEGER NOT NULL REFERENCES users(user_id),
+	revision INTEGER NOT NULL DEFAULT 1
 );
 
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS
+	revision INTEGER NOT NULL DEFAULT 1;
+
 
+-- Topic counters include only visible comments. Hidden comment is announced
+-- once it is approved. The event carries what listeners display, so that
+-- they do not have to fetch the topic. Notification payload is limited, so
+-- the subject is shortened.
 CREATE OR REPLACE FUNCTION update_topic_on_comment_insert()
 RETURNS trigger AS $$
+DECLARE
+	topic RECORD;
 BEGIN
 	UPDATE topics SET
-		latest_comment = (SELECT created FROM comments WHERE topic_id = NEW.topic_id ORDER BY created DESC LIMIT 1),
-		comments_count = (SELECT COUNT(*) - 1 FROM comments WHERE topic_id = NEW.topic_id)
-		WHERE topic_id = NEW.topic_id;
+		latest_comment = COALESCE((SELECT created FROM comments WHERE topic_id = NEW.topic_id AND NOT hidden ORDER BY created DESC LIMIT 1), latest_comment),
+		comments_count = GREATEST((SELECT COUNT(*) - 1 FROM comments WHERE topic_id = NEW.topic_id AND NOT hidden), 0)
+		WHERE topic_id = NEW.topic_id
+		RETURNING subject, created, comments_count INTO topic;
+	IF NOT NEW.hidden THEN
+		PERFORM pg_notify('topic_events', json_build_object(
+			'topic_id', NEW.topic_id,
+			'comment_id', NEW.comment_id,
+			'subject', left(topic.subject, 1000),
+			'topic_created', topic.created,
+			'comments_count', topic.comments_count)::TEXT);
+	END IF;
 	RETURN NEW;
 END;
 $$ LANGUAGE plpgsql;
@@ -727,12 +1558,12 @@ RETURNS trigger AS $$
 DECLARE
 	comments_cnt INT;
 BEGIN
-	comments_cnt := (SELECT COUNT(*) - 1 FROM comments WHERE topic_id = OLD.topic_id);
+	comments_cnt := (SELECT COUNT(*) - 1 FROM comments WHERE topic_id = OLD.topic_id AND NOT hidden);
 	IF comments_cnt < 0 THEN
 		comments_cnt = 0;
 	END IF;
 	UPDATE topics SET
-		latest_comment = COALESCE((SELECT created FROM comments WHERE topic_id = OLD.topic_id ORDER BY created DESC LIMIT 1), now()),
+		latest_comment = COALESCE((SELECT created FROM comments WHERE topic_id = OLD.topic_id AND NOT hidden ORDER BY created DESC LIMIT 1), now()),
 		comments_count = comments_cnt
 		WHERE topic_id = OLD.topic_id;
 	RETURN OLD;
@@ -755,7 +1586,187 @@ CREATE TRIGGER update_topic_on_comment_delete
 
 CREATE INDEX IF NOT EXISTS comments_created_idx ON comments(created);
 
+CREATE INDEX IF NOT EXISTS comments_topic_created_idx ON comments(topic_id, created, comment_id);
+
 CREATE INDEX IF NOT EXISTS topics_created_idx ON topics(latest_comment);
+
+CREATE TABLE IF NOT EXISTS topic_scores (
+	topic_id INTEGER PRIMARY KEY REFERENCES topics(topic_id) ON DELETE CASCADE,
+	hot_score DOUBLE PRECISION NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS topic_scores_hot_score_idx ON topic_scores(hot_score DESC);
+
+CREATE INDEX IF NOT EXISTS topics_real_created_idx ON topics(created);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS
+	reputation INTEGER NOT NULL DEFAULT 0;
+
+DO $$
+BEGIN
+	IF NOT EXISTS (
+		SELECT 1 FROM information_schema.columns
+		WHERE table_name = 'users' AND column_name = 'comments_count'
+	) THEN
+		ALTER TABLE users
+			ADD COLUMN topics_count INTEGER NOT NULL DEFAULT 0,
+			ADD COLUMN comments_count INTEGER NOT NULL DEFAULT 0;
+		UPDATE users u SET
+			topics_count = (SELECT COUNT(*) FROM topics t WHERE t.author_id = u.user_id),
+			comments_count = (SELECT COUNT(*) FROM comments c WHERE c.author_id = u.user_id);
+	END IF;
+END
+$$;
+
+-- Hidden topics and comments are not counted until they are approved.
+CREATE OR REPLACE FUNCTION update_user_counters()
+RETURNS trigger AS $$
+DECLARE
+	delta INT;
+	author INT;
+BEGIN
+	IF TG_OP = 'INSERT' THEN
+		IF NEW.hidden THEN
+			RETURN NULL;
+		END IF;
+		delta := 1;
+		author := NEW.author_id;
+	ELSIF TG_OP = 'DELETE' THEN
+		IF OLD.hidden THEN
+			RETURN NULL;
+		END IF;
+		delta := -1;
+		author := OLD.author_id;
+	ELSIF NEW.hidden THEN
+		delta := -1;
+		author := NEW.author_id;
+	ELSE
+		delta := 1;
+		author := NEW.author_id;
+	END IF;
+
+	IF TG_TABLE_NAME = 'comments' THEN
+		UPDATE users SET comments_count = comments_count + delta WHERE user_id = author;
+	ELSE
+		UPDATE users SET topics_count = topics_count + delta WHERE user_id = author;
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS update_user_counters ON comments;
+
+CREATE TRIGGER update_user_counters
+	AFTER INSERT OR DELETE ON comments
+	FOR EACH ROW EXECUTE PROCEDURE update_user_counters();
+
+DROP TRIGGER IF EXISTS update_user_counters ON topics;
+
+CREATE TRIGGER update_user_counters
+	AFTER INSERT OR DELETE ON topics
+	FOR EACH ROW EXECUTE PROCEDURE update_user_counters();
+
+ALTER TABLE topics ADD COLUMN IF NOT EXISTS
+	accepted_comment_id INTEGER REFERENCES comments(comment_id) ON DELETE SET NULL;
+
+CREATE OR REPLACE FUNCTION update_reputation_on_accepted_comment()
+RETURNS trigger AS $$
+BEGIN
+	-- Accepting own comment does not change the reputation. Comment
+	-- that is being deleted is no longer visible here, which is
+	-- handled by update_reputation_on_accepted_comment_delete.
+	UPDATE users SET reputation = reputation - 15
+		FROM comments c
+		WHERE c.comment_id = OLD.accepted_comment_id
+			AND c.author_id <> OLD.author_id
+			AND users.user_id = c.author_id;
+	UPDATE users SET reputation = reputation + 15
+		FROM comments c
+		WHERE c.comment_id = NEW.accepted_comment_id
+			AND c.author_id <> NEW.author_id
+			AND users.user_id = c.author_id;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS update_reputation_on_accepted_comment ON topics;
+
+-- Imported reputation already includes accepted comments.
+CREATE TRIGGER update_reputation_on_accepted_comment
+	AFTER UPDATE OF accepted_comment_id ON topics
+	FOR EACH ROW
+	WHEN (OLD.accepted_comment_id IS DISTINCT FROM NEW.accepted_comment_id
+		AND current_setting('gbb.import', true) IS DISTINCT FROM 'on')
+	EXECUTE PROCEDURE update_reputation_on_accepted_comment();
+
+CREATE OR REPLACE FUNCTION update_reputation_on_accepted_comment_delete()
+RETURNS trigger AS $$
+BEGIN
+	UPDATE users SET reputation = reputation - 15
+		FROM topics t
+		WHERE t.accepted_comment_id = OLD.comment_id
+			AND t.author_id <> OLD.author_id
+			AND users.user_id = OLD.author_id;
+	RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS update_reputation_on_accepted_comment_delete ON comments;
+
+CREATE TRIGGER update_reputation_on_accepted_comment_delete
+	BEFORE DELETE ON comments
+	FOR EACH ROW EXECUTE PROCEDURE update_reputation_on_accepted_comment_delete();
+
+CREATE TABLE IF NOT EXISTS
+reputation_penalties (
+	penalty_id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(user_id),
+	moderator_id INTEGER NOT NULL REFERENCES users(user_id),
+	points INTEGER NOT NULL CHECK (points > 0),
+	reason TEXT NOT NULL,
+	created TIMESTAMPTZ NOT NULL
+);
+
+ALTER TABLE topics ADD COLUMN IF NOT EXISTS
+	locked BOOLEAN NOT NULL DEFAULT false;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS
+	banned BOOLEAN NOT NULL DEFAULT false;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS
+	hidden BOOLEAN NOT NULL DEFAULT false;
+
+ALTER TABLE topics ADD COLUMN IF NOT EXISTS
+	hidden BOOLEAN NOT NULL DEFAULT false;
+
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS
+	hidden BOOLEAN NOT NULL DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS comments_hidden_idx ON comments(created) WHERE hidden;
+
+DROP TRIGGER IF EXISTS update_topic_on_comment_approve ON comments;
+
+CREATE TRIGGER update_topic_on_comment_approve
+	AFTER UPDATE OF hidden ON comments
+	FOR EACH ROW
+	WHEN (OLD.hidden IS DISTINCT FROM NEW.hidden)
+	EXECUTE PROCEDURE update_topic_on_comment_insert();
+
+DROP TRIGGER IF EXISTS update_user_counters_on_approve ON comments;
+
+CREATE TRIGGER update_user_counters_on_approve
+	AFTER UPDATE OF hidden ON comments
+	FOR EACH ROW
+	WHEN (OLD.hidden IS DISTINCT FROM NEW.hidden)
+	EXECUTE PROCEDURE update_user_counters();
+
+DROP TRIGGER IF EXISTS update_user_counters_on_approve ON topics;
+
+CREATE TRIGGER update_user_counters_on_approve
+	AFTER UPDATE OF hidden ON topics
+	FOR EACH ROW
+	WHEN (OLD.hidden IS DISTINCT FROM NEW.hidden)
+	EXECUTE PROCEDURE update_user_counters();
 `
 	for i, migration := range strings.Split(schema, `;\n\n`) {
 		_, err := s.db.ExecContext(ctx, migration)
@@ -768,3 +1779,61 @@ CREATE INDEX IF NOT EXISTS topics_created_idx ON topics(latest_comment);
 	}
 	return nil
 }
+
+func (s *pgBBStore) WithTx(ctx context.Context, fn func(BBStore) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "cannot begin the transaction")
+	}
+	defer tx.Rollback()
+
+	if err := fn(&pgBBStore{db: txDatabase{Transaction: tx}}); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "cannot commit the transaction")
+	}
+	return nil
+}
+
+// txDatabase makes stores write within the transaction. Transactions begun
+// by the store are savepoints of the outer transaction.
+type txDatabase struct {
+	sqldb.Transaction
+}
+
+func (db txDatabase) BeginTx(ctx context.Context, opts *sql.TxOptions) (sqldb.Transaction, error) {
+	if _, err := db.ExecContext(ctx, `SAVEPOINT nested`); err != nil {
+		return nil, errors.Wrap(err, "cannot create savepoint")
+	}
+	return &txSavepoint{Transaction: db.Transaction, ctx: ctx}, nil
+}
+
+// Close does nothing, the transaction is ended by its owner.
+func (db txDatabase) Close() error {
+	return nil
+}
+
+type txSavepoint struct {
+	sqldb.Transaction
+	ctx  context.Context
+	done bool
+}
+
+func (sp *txSavepoint) Commit() error {
+	return sp.end(`RELEASE SAVEPOINT nested`)
+}
+
+func (sp *txSavepoint) Rollback() error {
+	return sp.end(`ROLLBACK TO SAVEPOINT nested`)
+}
+
+func (sp *txSavepoint) end(query string) error {
+	if sp.done {
+		return sql.ErrTxDone
+	}
+	sp.done = true
+	_, err := sp.ExecContext(sp.ctx, query)
+	return err
+}
@@ -1,6 +1,7 @@
 package gbb
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"fmt"
@@ -20,7 +21,7 @@ func TestListTopicsEmpty(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if _, err := store.ListTopics(ctx, time.Now(), 100); err != nil {
+	if _, err := store.ListTopics(ctx, 0, time.Now(), 100); err != nil {
 		t.Fatalf("cannot list posts: %s", err)
 	}
 }
@@ -45,7 +46,7 @@ func TestCreateTopic(t *testing.T) {
 	}
 
 	if comment.TopicID != topic.TopicID {
-		t.Errorf("comment.TopicID != topic.TopicID: %q != %q", comment.TopicID, topic.TopicID)
+		t.Errorf("comment.TopicID != topic.TopicID: %d != %d", comment.TopicID, topic.TopicID)
 	}
 	if topic.Subject != "first" {
 		t.Errorf("invalid subject: %q", topic.Subject)
@@ -86,7 +87,7 @@ func TestCreateComment(t *testing.T) {
 	}
 
 	if comment.TopicID != topic.TopicID {
-		t.Errorf("comment.TopicID != topic.TopicID: %q != %q", comment.TopicID, topic.TopicID)
+		t.Errorf("comment.TopicID != topic.TopicID: %d != %d", comment.TopicID, topic.TopicID)
 	}
 	if comment.Content != "IMO 2" {
 		t.Errorf("invalid title: %q", topic.Subject)
@@ -181,3 +182,515 @@ func ensureUser(t *testing.T, db *sql.DB, userID int, name string) {
 		t.Fatalf("cannot create user %d %q: %s", userID, name, err)
 	}
 }
+
+func TestListCommentsCursor(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	store, err := NewPostgresBBStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ensureUser(t, db, 999, "Bobby")
+
+	topic, first, err := store.CreateTopic(ctx, "first", "0", 1, 999)
+	if err != nil {
+		t.Fatalf("cannot create topic: %s", err)
+	}
+	all := []*Comment{first}
+	for i := 1; i < 7; i++ {
+		c, err := store.CreateComment(ctx, topic.TopicID, fmt.Sprint(i), 999)
+		if err != nil {
+			t.Fatalf("cannot create comment: %s", err)
+		}
+		all = append(all, c)
+	}
+
+	assertComments := func(t *testing.T, got []*Comment, want ...*Comment) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("want %d comments, got %d", len(want), len(got))
+		}
+		for i := range want {
+			if got[i].CommentID != want[i].CommentID {
+				t.Fatalf("want comment %d at %d, got %d", want[i].CommentID, i, got[i].CommentID)
+			}
+		}
+	}
+
+	page, err := store.ListComments(ctx, topic.TopicID, 0, CommentCursor{}, 3)
+	if err != nil {
+		t.Fatalf("cannot list comments: %s", err)
+	}
+	assertComments(t, page, all[0], all[1], all[2])
+
+	page, err = store.ListComments(ctx, topic.TopicID, 0, all[3].Cursor(), 3)
+	if err != nil {
+		t.Fatalf("cannot list comments: %s", err)
+	}
+	assertComments(t, page, all[3], all[4], all[5])
+
+	before := all[3].Cursor()
+	before.Backward = true
+	page, err = store.ListComments(ctx, topic.TopicID, 0, before, 2)
+	if err != nil {
+		t.Fatalf("cannot list comments: %s", err)
+	}
+	assertComments(t, page, all[1], all[2])
+
+	page, err = store.ListComments(ctx, topic.TopicID, 0, CommentCursor{Backward: true}, 2)
+	if err != nil {
+		t.Fatalf("cannot list comments: %s", err)
+	}
+	assertComments(t, page, all[5], all[6])
+
+	// Deleting a comment does not shift the page content.
+	if err := store.DeleteComment(ctx, all[1].CommentID); err != nil {
+		t.Fatalf("cannot delete comment: %s", err)
+	}
+	page, err = store.ListComments(ctx, topic.TopicID, 0, all[3].Cursor(), 3)
+	if err != nil {
+		t.Fatalf("cannot list comments: %s", err)
+	}
+	assertComments(t, page, all[3], all[4], all[5])
+
+	if _, _, isFirst, err := store.CommentByID(ctx, all[0].CommentID); err != nil || !isFirst {
+		t.Fatalf("want first comment, got %v, %v", isFirst, err)
+	}
+	if _, _, isFirst, err := store.CommentByID(ctx, all[3].CommentID); err != nil || isFirst {
+		t.Fatalf("want not first comment, got %v, %v", isFirst, err)
+	}
+}
+
+func TestListRankedTopics(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	store, err := NewPostgresBBStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ensureUser(t, db, 999, "Bobby")
+
+	quiet, _, err := store.CreateTopic(ctx, "quiet", "IMO", 1, 999)
+	if err != nil {
+		t.Fatalf("cannot create topic: %s", err)
+	}
+	busy, _, err := store.CreateTopic(ctx, "busy", "IMO", 1, 999)
+	if err != nil {
+		t.Fatalf("cannot create topic: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := store.CreateComment(ctx, busy.TopicID, "me too", 999); err != nil {
+			t.Fatalf("cannot create comment: %s", err)
+		}
+	}
+	latest, _, err := store.CreateTopic(ctx, "latest", "IMO", 1, 999)
+	if err != nil {
+		t.Fatalf("cannot create topic: %s", err)
+	}
+
+	if err := store.RefreshTopicScores(ctx); err != nil {
+		t.Fatalf("cannot refresh scores: %s", err)
+	}
+
+	cases := map[TopicRanking][]int64{
+		RankHot: {busy.TopicID, latest.TopicID, quiet.TopicID},
+		RankTop: {busy.TopicID, latest.TopicID, quiet.TopicID},
+		RankNew: {latest.TopicID, busy.TopicID, quiet.TopicID},
+	}
+	for ranking, want := range cases {
+		topics, err := store.ListRankedTopics(ctx, 0, ranking, time.Time{}, 0, 10)
+		if err != nil {
+			t.Fatalf("%s: cannot list topics: %s", ranking, err)
+		}
+		if len(topics) != len(want) {
+			t.Fatalf("%s: want %d topics, got %d", ranking, len(want), len(topics))
+		}
+		for i, topic := range topics {
+			if topic.TopicID != want[i] {
+				t.Errorf("%s: want topic %d at %d, got %d", ranking, want[i], i, topic.TopicID)
+			}
+		}
+	}
+
+	topics, err := store.ListRankedTopics(ctx, 0, RankNew, time.Time{}, 1, 1)
+	if err != nil {
+		t.Fatalf("cannot list topics: %s", err)
+	}
+	if len(topics) != 1 || topics[0].TopicID != busy.TopicID {
+		t.Fatalf("want second page to contain topic %d, got %+v", busy.TopicID, topics)
+	}
+
+	// Within a period, only the activity in that period counts.
+	if _, err := db.Exec(`UPDATE comments SET created = now() - INTERVAL '2 days' WHERE topic_id = $1`, busy.TopicID); err != nil {
+		t.Fatalf("cannot backdate comments: %s", err)
+	}
+	if _, err := store.CreateComment(ctx, quiet.TopicID, "not anymore", 999); err != nil {
+		t.Fatalf("cannot create comment: %s", err)
+	}
+	topics, err = store.ListRankedTopics(ctx, 0, RankTop, time.Now().Add(-24*time.Hour), 0, 10)
+	if err != nil {
+		t.Fatalf("cannot list topics: %s", err)
+	}
+	if len(topics) != 2 || topics[0].TopicID != quiet.TopicID || topics[1].TopicID != latest.TopicID {
+		t.Fatalf("want topics %d and %d active today, got %+v", quiet.TopicID, latest.TopicID, topics)
+	}
+
+	if _, err := store.ListRankedTopics(ctx, 0, "random", time.Time{}, 0, 10); !ErrMalformed.Is(err) {
+		t.Fatalf("want ErrMalformed for unknown ranking, got %+v", err)
+	}
+}
+
+func TestUserReputation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	store, err := NewPostgresBBStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reactions, err := NewPostgresReactionStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ensureUser(t, db, 999, "Bobby")
+	ensureUser(t, db, 998, "Alice")
+
+	assertUser := func(t *testing.T, userID int64, wantReputation, wantTopics, wantComments int64) {
+		t.Helper()
+		info, err := store.UserInfo(ctx, userID, 0)
+		if err != nil {
+			t.Fatalf("cannot get user info: %s", err)
+		}
+		if info.Reputation != wantReputation {
+			t.Errorf("want reputation %d, got %d", wantReputation, info.Reputation)
+		}
+		if info.TopicsCount != wantTopics {
+			t.Errorf("want %d topics, got %d", wantTopics, info.TopicsCount)
+		}
+		if info.CommentsCount != wantComments {
+			t.Errorf("want %d comments, got %d", wantComments, info.CommentsCount)
+		}
+	}
+
+	topic, first, err := store.CreateTopic(ctx, "question", "?", 1, 999)
+	if err != nil {
+		t.Fatalf("cannot create topic: %s", err)
+	}
+	answer, err := store.CreateComment(ctx, topic.TopicID, "!", 998)
+	if err != nil {
+		t.Fatalf("cannot create comment: %s", err)
+	}
+	assertUser(t, 998, 0, 0, 1)
+	assertUser(t, 999, 0, 1, 1)
+
+	// Reacting to own comment does not count.
+	if _, err := reactions.ToggleReaction(ctx, first.CommentID, 999, "+1"); err != nil {
+		t.Fatalf("cannot react: %s", err)
+	}
+	if _, err := reactions.ToggleReaction(ctx, answer.CommentID, 999, "+1"); err != nil {
+		t.Fatalf("cannot react: %s", err)
+	}
+	if err := store.AcceptComment(ctx, topic.TopicID, answer.CommentID); err != nil {
+		t.Fatalf("cannot accept comment: %s", err)
+	}
+	assertUser(t, 998, 16, 0, 1)
+	assertUser(t, 999, 0, 1, 1)
+
+	if err := store.AcceptComment(ctx, topic.TopicID+1, answer.CommentID); !ErrNotFound.Is(err) {
+		t.Fatalf("want ErrNotFound when accepting comment of another topic, got %+v", err)
+	}
+
+	if err := store.PenalizeUser(ctx, 998, 999, 10, "spam"); err != nil {
+		t.Fatalf("cannot penalize user: %s", err)
+	}
+	assertUser(t, 998, 6, 0, 1)
+
+	if err := store.DeleteComment(ctx, answer.CommentID); err != nil {
+		t.Fatalf("cannot delete comment: %s", err)
+	}
+	assertUser(t, 998, -10, 0, 0)
+
+	if topic, err := store.TopicByID(ctx, topic.TopicID); err != nil {
+		t.Fatalf("cannot get topic: %s", err)
+	} else if topic.AcceptedCommentID != 0 {
+		t.Fatalf("want accepted comment to be removed, got %d", topic.AcceptedCommentID)
+	}
+}
+
+func TestLockAndBan(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	store, err := NewPostgresBBStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ensureUser(t, db, 999, "Bobby")
+
+	topic, _, err := store.CreateTopic(ctx, "first", "IMO", 1, 999)
+	if err != nil {
+		t.Fatalf("cannot create topic: %s", err)
+	}
+	if err := store.SetTopicLocked(ctx, topic.TopicID, true); err != nil {
+		t.Fatalf("cannot lock topic: %s", err)
+	}
+	if topic, err := store.TopicByID(ctx, topic.TopicID); err != nil || !topic.Locked {
+		t.Fatalf("want locked topic, got %+v, %v", topic, err)
+	}
+	if err := store.SetTopicLocked(ctx, topic.TopicID+1, true); !ErrNotFound.Is(err) {
+		t.Fatalf("want ErrNotFound, got %+v", err)
+	}
+
+	if err := store.SetUserBanned(ctx, 999, true); err != nil {
+		t.Fatalf("cannot ban user: %s", err)
+	}
+	if _, err := store.CreateComment(ctx, topic.TopicID, "more", 999); !ErrUserBanned.Is(err) {
+		t.Fatalf("want ErrUserBanned, got %+v", err)
+	}
+	if _, _, err := store.CreateTopic(ctx, "second", "IMO", 1, 999); !ErrUserBanned.Is(err) {
+		t.Fatalf("want ErrUserBanned, got %+v", err)
+	}
+	if info, err := store.UserInfo(ctx, 999, 0); err != nil || !info.Banned {
+		t.Fatalf("want banned user, got %+v, %v", info, err)
+	}
+
+	if err := store.SetUserBanned(ctx, 999, false); err != nil {
+		t.Fatalf("cannot unban user: %s", err)
+	}
+	if _, err := store.CreateComment(ctx, topic.TopicID, "more", 999); err != nil {
+		t.Fatalf("cannot create comment: %s", err)
+	}
+}
+
+func TestHiddenUser(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	store, err := NewPostgresBBStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ensureUser(t, db, 999, "Bobby")
+	ensureUser(t, db, 998, "Alice")
+
+	if err := store.SetUserHidden(ctx, 998, true); err != nil {
+		t.Fatalf("cannot hide user: %s", err)
+	}
+	if err := store.SetUserHidden(ctx, 1234, true); !ErrNotFound.Is(err) {
+		t.Fatalf("want ErrNotFound, got %+v", err)
+	}
+
+	topic, _, err := store.CreateTopic(ctx, "visible", "hello", 1, 999)
+	if err != nil {
+		t.Fatalf("cannot create topic: %s", err)
+	}
+	spam, err := store.CreateComment(ctx, topic.TopicID, "buy now", 998)
+	if err != nil {
+		t.Fatalf("cannot create comment: %s", err)
+	}
+	if !spam.Hidden {
+		t.Fatal("want comment of a hidden user to be hidden")
+	}
+	spamTopic, spamFirst, err := store.CreateTopic(ctx, "hidden", "buy now", 1, 998)
+	if err != nil {
+		t.Fatalf("cannot create topic: %s", err)
+	}
+	if !spamTopic.Hidden || !spamFirst.Hidden {
+		t.Fatal("want topic of a hidden user to be hidden")
+	}
+
+	assertVisible := func(t *testing.T, viewerID int64, wantComments, wantTopics int) {
+		t.Helper()
+		comments, err := store.ListComments(ctx, topic.TopicID, viewerID, CommentCursor{}, 10)
+		if err != nil {
+			t.Fatalf("cannot list comments: %s", err)
+		}
+		if len(comments) != wantComments {
+			t.Errorf("viewer %d: want %d comments, got %d", viewerID, wantComments, len(comments))
+		}
+		topics, err := store.ListTopics(ctx, viewerID, time.Now(), 10)
+		if err != nil {
+			t.Fatalf("cannot list topics: %s", err)
+		}
+		if len(topics) != wantTopics {
+			t.Errorf("viewer %d: want %d topics, got %d", viewerID, wantTopics, len(topics))
+		}
+		results, err := store.Search(ctx, viewerID, "buy", nil, 0, 10)
+		if err != nil {
+			t.Fatalf("cannot search: %s", err)
+		}
+		if want := 2 * (wantComments - 1); len(results) != want {
+			t.Errorf("viewer %d: want %d search results, got %d", viewerID, want, len(results))
+		}
+	}
+	assertVisible(t, 0, 1, 1)
+	assertVisible(t, 999, 1, 1)
+	assertVisible(t, 998, 2, 2)
+
+	if topic, err := store.TopicByID(ctx, topic.TopicID); err != nil || topic.CommentsCount != 0 {
+		t.Fatalf("want hidden comment not counted, got %+v, %v", topic, err)
+	}
+	if info, err := store.UserInfo(ctx, 998, 999); err != nil || info.CommentsCount != 0 || info.TopicsCount != 0 {
+		t.Fatalf("want hidden content not counted, got %+v, %v", info, err)
+	}
+	if info, err := store.UserInfo(ctx, 998, 998); err != nil || info.CommentsCount != 2 || info.TopicsCount != 1 {
+		t.Fatalf("want hidden content counted for the author, got %+v, %v", info, err)
+	}
+
+	hidden, err := store.ListHiddenComments(ctx, 10)
+	if err != nil {
+		t.Fatalf("cannot list hidden comments: %s", err)
+	}
+	if len(hidden) != 2 || hidden[0].IsFirst || !hidden[1].IsFirst {
+		t.Fatalf("unexpected hidden comments: %+v", hidden)
+	}
+
+	if err := store.ApproveComment(ctx, spam.CommentID); err != nil {
+		t.Fatalf("cannot approve comment: %s", err)
+	}
+	if err := store.ApproveComment(ctx, spam.CommentID); !ErrNotFound.Is(err) {
+		t.Fatalf("want ErrNotFound, got %+v", err)
+	}
+	if err := store.ApproveComment(ctx, spamFirst.CommentID); err != nil {
+		t.Fatalf("cannot approve comment: %s", err)
+	}
+	assertVisible(t, 0, 2, 2)
+
+	if topic, err := store.TopicByID(ctx, topic.TopicID); err != nil || topic.CommentsCount != 1 {
+		t.Fatalf("want approved comment counted, got %+v, %v", topic, err)
+	}
+	if info, err := store.UserInfo(ctx, 998, 0); err != nil || info.CommentsCount != 2 || info.TopicsCount != 1 || !info.Hidden {
+		t.Fatalf("want approved content counted, got %+v, %v", info, err)
+	}
+}
+
+func TestArchiveRoundTripPostgres(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Account store creates the deleted user placeholder in both
+	// databases, as it happens when the server is started.
+	createStores := func(db *sql.DB) (BBStore, ReadProgressTracker, AttachmentStore, AccountStore) {
+		bbStore, err := NewPostgresBBStore(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readTracker, err := NewPostgresReadProgressTracker(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attachments, err := NewPostgresAttachmentStore(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accounts, err := NewPostgresAccountStore(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bbStore, readTracker, attachments, accounts
+	}
+
+	srcDB := createDatabase(t)
+	defer srcDB.Close()
+	src, srcProgress, srcAttachments, srcAccounts := createStores(srcDB)
+
+	ensureUser(t, srcDB, 999, "Bobby")
+	ensureUser(t, srcDB, 1000, "Rick")
+	topic, _, err := src.CreateTopic(ctx, "hello", "first", 1, 999)
+	if err != nil {
+		t.Fatalf("cannot create topic: %s", err)
+	}
+	answer, err := src.CreateComment(ctx, topic.TopicID, "answer", 1000)
+	if err != nil {
+		t.Fatalf("cannot create comment: %s", err)
+	}
+	if err := src.AcceptComment(ctx, topic.TopicID, answer.CommentID); err != nil {
+		t.Fatalf("cannot accept comment: %s", err)
+	}
+	if err := srcProgress.Track(ctx, ReadProgress{UserID: 999, TopicID: topic.TopicID, CommentID: answer.CommentID, CommentCreated: answer.Created}); err != nil {
+		t.Fatalf("cannot track progress: %s", err)
+	}
+	if err := srcProgress.MarkAllRead(ctx, 1000, time.Now()); err != nil {
+		t.Fatalf("cannot mark all read: %s", err)
+	}
+	srcRick, err := src.UserInfo(ctx, 1000, 0)
+	if err != nil {
+		t.Fatalf("cannot get user info: %s", err)
+	}
+
+	var archive bytes.Buffer
+	if _, err := ExportArchive(ctx, &archive, src, srcProgress, srcAttachments, srcAccounts, createArchiveBlobStore(t)); err != nil {
+		t.Fatalf("cannot export: %s", err)
+	}
+
+	dstDB := createDatabase(t)
+	defer dstDB.Close()
+	dst, dstProgress, dstAttachments, dstAccounts := createStores(dstDB)
+	if _, err := ImportArchive(ctx, &archive, dst, dstProgress, dstAttachments, dstAccounts, createArchiveBlobStore(t)); err != nil {
+		t.Fatalf("cannot import: %s", err)
+	}
+
+	srcPlaceholderID, err := srcAccounts.DeletedUserPlaceholder(ctx)
+	if err != nil {
+		t.Fatalf("cannot get placeholder: %s", err)
+	}
+	if id, err := dstAccounts.DeletedUserPlaceholder(ctx); err != nil || id != srcPlaceholderID {
+		t.Fatalf("want placeholder %d, got %d, %v", srcPlaceholderID, id, err)
+	}
+	var placeholders int
+	if err := dstDB.QueryRow(`SELECT COUNT(*) FROM users WHERE name = $1`, deletedUserName).Scan(&placeholders); err != nil {
+		t.Fatalf("cannot count placeholders: %s", err)
+	}
+	if placeholders != 1 {
+		t.Fatalf("want one placeholder, got %d", placeholders)
+	}
+	// Restarting the server does not create another one.
+	if _, err := NewPostgresAccountStore(dstDB); err != nil {
+		t.Fatalf("cannot create account store: %s", err)
+	}
+	if id, err := dstAccounts.DeletedUserPlaceholder(ctx); err != nil || id != srcPlaceholderID {
+		t.Fatalf("want placeholder %d kept, got %d, %v", srcPlaceholderID, id, err)
+	}
+
+	restored, err := dst.TopicByID(ctx, topic.TopicID)
+	if err != nil {
+		t.Fatalf("cannot get topic: %s", err)
+	}
+	if restored.AcceptedCommentID != answer.CommentID || restored.CommentsCount != 2 || !restored.Created.Equal(topic.Created) {
+		t.Fatalf("unexpected topic %+v", restored)
+	}
+	rick, err := dst.UserInfo(ctx, 1000, 0)
+	if err != nil {
+		t.Fatalf("cannot get user info: %s", err)
+	}
+	if rick.Reputation != srcRick.Reputation || rick.CommentsCount != srcRick.CommentsCount {
+		t.Fatalf("want %+v, got %+v", srcRick, rick)
+	}
+
+	// Sequences continue after imported records.
+	if _, err := dst.CreateComment(ctx, topic.TopicID, "more", 999); err != nil {
+		t.Fatalf("cannot create comment: %s", err)
+	}
+}
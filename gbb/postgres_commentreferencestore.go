@@ -0,0 +1,134 @@
+package gbb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/go-surf/surf/sqldb"
+	"github.com/lib/pq"
+)
+
+// NewPostgresCommentReferenceStore returns a CommentReferenceStore using given
+// database. The comments and users tables must already exist.
+func NewPostgresCommentReferenceStore(db *sql.DB) (CommentReferenceStore, error) {
+	store := &pgCommentReferenceStore{
+		db: sqldb.PostgresDatabase(db),
+	}
+	return store, store.ensureSchema(context.Background())
+}
+
+type pgCommentReferenceStore struct {
+	db sqldb.Database
+}
+
+func (rs *pgCommentReferenceStore) ensureSchema(ctx context.Context) error {
+	const schema = `
+CREATE TABLE IF NOT EXISTS comment_references (
+	referenced_id INTEGER NOT NULL REFERENCES comments(comment_id) ON DELETE CASCADE,
+	comment_id INTEGER NOT NULL REFERENCES comments(comment_id) ON DELETE CASCADE,
+
+	PRIMARY KEY (referenced_id, comment_id)
+);
+
+CREATE INDEX IF NOT EXISTS comment_references_comment_idx ON comment_references(comment_id);
+`
+	for i, migration := range strings.Split(schema, `;\n\n`) {
+		_, err := rs.db.ExecContext(ctx, migration)
+		if err != nil {
+			if max := 30; len(migration) > max {
+				migration = migration[max:]
+			}
+			return fmt.Errorf("migration %d (%s): %s", i, migration, err)
+		}
+	}
+	return nil
+}
+
+func (rs *pgCommentReferenceStore) SetReferences(ctx context.Context, commentID int64, referencedIDs []int64) error {
+	defer surf.CurrentTrace(ctx).Begin("set comment references").Finish()
+
+	tx, err := rs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "cannot begin a transaction")
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM comment_references WHERE comment_id = $1
+	`, commentID); err != nil {
+		return errors.Wrap(err, "cannot delete previous references")
+	}
+
+	if len(referencedIDs) > 0 {
+		// Comment cannot reply to itself and only existing comments
+		// can be referenced.
+		_, err := tx.ExecContext(ctx, `
+			INSERT INTO comment_references (referenced_id, comment_id)
+			SELECT comment_id, $1
+			FROM comments
+			WHERE comment_id = ANY($2) AND comment_id <> $1
+		`, commentID, pq.Array(uniqueInt64s(referencedIDs)))
+		switch {
+		case err == nil:
+			// All good.
+		case surf.ErrConstraint.Is(err):
+			return ErrCommentNotFound
+		default:
+			return errors.Wrap(err, "cannot insert references")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "cannot commit the transaction")
+	}
+	return nil
+}
+
+func (rs *pgCommentReferenceStore) ListReplies(ctx context.Context, viewerID int64, commentIDs []int64) (map[int64][]*Reply, error) {
+	defer surf.CurrentTrace(ctx).Begin("list replies").Finish()
+
+	replies := make(map[int64][]*Reply)
+	if len(commentIDs) == 0 {
+		return replies, nil
+	}
+
+	rows, err := rs.db.QueryContext(ctx, `
+		SELECT
+			r.referenced_id,
+			c.comment_id,
+			u.user_id,
+			u.name
+		FROM
+			comment_references r
+			INNER JOIN comments c ON r.comment_id = c.comment_id
+			INNER JOIN users u ON c.author_id = u.user_id
+		WHERE
+			r.referenced_id = ANY($1)
+			AND (NOT c.hidden OR c.author_id = $2)
+		ORDER BY
+			c.created ASC, c.comment_id ASC
+	`, pq.Array(commentIDs), viewerID)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query replies")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			referencedID int64
+			r            Reply
+		)
+		if err := rows.Scan(&referencedID, &r.CommentID, &r.Author.UserID, &r.Author.Name); err != nil {
+			return nil, errors.Wrap(err, "cannot scan reply")
+		}
+		replies[referencedID] = append(replies[referencedID], &r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+	return replies, nil
+}
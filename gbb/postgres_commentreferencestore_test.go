@@ -0,0 +1,100 @@
+package gbb
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCommentReferenceStore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	bbStore, err := NewPostgresBBStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewPostgresCommentReferenceStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ensureUser(t, db, 999, "Bobby")
+	ensureUser(t, db, 998, "Alice")
+	ensureUser(t, db, 997, "Eve")
+
+	_, first, err := bbStore.CreateTopic(ctx, "first", "IMO", 1, 999)
+	if err != nil {
+		t.Fatalf("cannot create topic: %s", err)
+	}
+	second, err := bbStore.CreateComment(ctx, first.TopicID, "second", 998)
+	if err != nil {
+		t.Fatalf("cannot create comment: %s", err)
+	}
+	third, err := bbStore.CreateComment(ctx, first.TopicID, "third", 999)
+	if err != nil {
+		t.Fatalf("cannot create comment: %s", err)
+	}
+
+	// References to itself and to comments that do not exist are
+	// ignored.
+	if err := store.SetReferences(ctx, second.CommentID, []int64{first.CommentID, second.CommentID, 123456789}); err != nil {
+		t.Fatalf("cannot set references: %s", err)
+	}
+	if err := store.SetReferences(ctx, third.CommentID, []int64{first.CommentID, second.CommentID}); err != nil {
+		t.Fatalf("cannot set references: %s", err)
+	}
+
+	replies, err := store.ListReplies(ctx, 0, []int64{first.CommentID, second.CommentID, third.CommentID})
+	if err != nil {
+		t.Fatalf("cannot list replies: %s", err)
+	}
+	if got := replies[first.CommentID]; len(got) != 2 || got[0].CommentID != second.CommentID || got[0].Author.Name != "Alice" || got[1].CommentID != third.CommentID {
+		t.Fatalf("unexpected replies to the first comment: %+v", got)
+	}
+	if got := replies[second.CommentID]; len(got) != 1 || got[0].CommentID != third.CommentID {
+		t.Fatalf("unexpected replies to the second comment: %+v", got)
+	}
+	if got := replies[third.CommentID]; len(got) != 0 {
+		t.Fatalf("want no replies to the third comment, got %+v", got)
+	}
+
+	// Replies of hidden users are visible only to them.
+	if err := bbStore.SetUserHidden(ctx, 997, true); err != nil {
+		t.Fatalf("cannot hide user: %s", err)
+	}
+	hidden, err := bbStore.CreateComment(ctx, first.TopicID, "spam", 997)
+	if err != nil {
+		t.Fatalf("cannot create comment: %s", err)
+	}
+	if err := store.SetReferences(ctx, hidden.CommentID, []int64{third.CommentID}); err != nil {
+		t.Fatalf("cannot set references: %s", err)
+	}
+	for viewerID, want := range map[int64]int{0: 0, 999: 0, 997: 1} {
+		replies, err := store.ListReplies(ctx, viewerID, []int64{third.CommentID})
+		if err != nil {
+			t.Fatalf("cannot list replies: %s", err)
+		}
+		if got := replies[third.CommentID]; len(got) != want {
+			t.Fatalf("viewer %d: want %d replies, got %+v", viewerID, want, got)
+		}
+	}
+
+	// Edited comment no longer references the first one.
+	if err := store.SetReferences(ctx, third.CommentID, []int64{second.CommentID}); err != nil {
+		t.Fatalf("cannot set references: %s", err)
+	}
+	if err := bbStore.DeleteComment(ctx, second.CommentID); err != nil {
+		t.Fatalf("cannot delete comment: %s", err)
+	}
+	replies, err = store.ListReplies(ctx, 0, []int64{first.CommentID, second.CommentID})
+	if err != nil {
+		t.Fatalf("cannot list replies: %s", err)
+	}
+	if len(replies) != 0 {
+		t.Fatalf("want no replies, got %+v", replies)
+	}
+}
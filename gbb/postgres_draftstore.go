@@ -0,0 +1,137 @@
+package gbb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/go-surf/surf/sqldb"
+)
+
+// NewPostgresDraftStore returns a DraftStore using given database. The topics
+// and users tables must already exist.
+func NewPostgresDraftStore(db *sql.DB) (DraftStore, error) {
+	store := &pgDraftStore{
+		db: sqldb.PostgresDatabase(db),
+	}
+	return store, store.ensureSchema(context.Background())
+}
+
+type pgDraftStore struct {
+	db sqldb.Database
+}
+
+func (ds *pgDraftStore) ensureSchema(ctx context.Context) error {
+	// Draft of a new topic has no topic_id. To allow only one such draft
+	// per user, unique index is using 0 instead of NULL.
+	const schema = `
+CREATE TABLE IF NOT EXISTS drafts (
+	user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+	topic_id INTEGER REFERENCES topics(topic_id) ON DELETE CASCADE,
+	subject TEXT NOT NULL,
+	content TEXT NOT NULL,
+	updated TIMESTAMPTZ NOT NULL
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS drafts_user_topic_idx ON drafts(user_id, (COALESCE(topic_id, 0)));
+`
+	for i, migration := range strings.Split(schema, `;\n\n`) {
+		_, err := ds.db.ExecContext(ctx, migration)
+		if err != nil {
+			if max := 30; len(migration) > max {
+				migration = migration[max:]
+			}
+			return fmt.Errorf("migration %d (%s): %s", i, migration, err)
+		}
+	}
+	return nil
+}
+
+func (ds *pgDraftStore) SaveDraft(ctx context.Context, d Draft) error {
+	defer surf.CurrentTrace(ctx).Begin("save draft").Finish()
+
+	topicID := sql.NullInt64{Int64: d.TopicID, Valid: d.TopicID != 0}
+	_, err := ds.db.ExecContext(ctx, `
+		INSERT INTO drafts (user_id, topic_id, subject, content, updated)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, (COALESCE(topic_id, 0))) DO UPDATE
+		SET subject = EXCLUDED.subject, content = EXCLUDED.content, updated = EXCLUDED.updated
+	`, d.UserID, topicID, d.Subject, d.Content, time.Now())
+	switch {
+	case err == nil:
+		return nil
+	case surf.ErrConstraint.Is(err):
+		return errors.Wrap(ErrTopicNotFound, "user or topic does not exist")
+	default:
+		return errors.Wrap(err, "cannot upsert draft")
+	}
+}
+
+func (ds *pgDraftStore) Draft(ctx context.Context, userID, topicID int64) (*Draft, error) {
+	d := Draft{UserID: userID, TopicID: topicID}
+	err := ds.db.QueryRowContext(ctx, `
+		SELECT subject, content, updated
+		FROM drafts
+		WHERE user_id = $1 AND COALESCE(topic_id, 0) = $2
+		LIMIT 1
+	`, userID, topicID).Scan(&d.Subject, &d.Content, &d.Updated)
+	switch {
+	case err == nil:
+		return &d, nil
+	case surf.ErrNotFound.Is(err):
+		return nil, ErrDraftNotFound
+	default:
+		return nil, errors.Wrap(err, "cannot query draft")
+	}
+}
+
+func (ds *pgDraftStore) DeleteDraft(ctx context.Context, userID, topicID int64) error {
+	_, err := ds.db.ExecContext(ctx, `
+		DELETE FROM drafts
+		WHERE user_id = $1 AND COALESCE(topic_id, 0) = $2
+	`, userID, topicID)
+	if err != nil {
+		return errors.Wrap(err, "cannot delete draft")
+	}
+	return nil
+}
+
+func (ds *pgDraftStore) ListDrafts(ctx context.Context, userID int64) ([]*Draft, error) {
+	rows, err := ds.db.QueryContext(ctx, `
+		SELECT
+			COALESCE(d.topic_id, 0),
+			COALESCE(t.subject, ''),
+			d.subject,
+			d.content,
+			d.updated
+		FROM
+			drafts d
+			LEFT JOIN topics t ON d.topic_id = t.topic_id
+		WHERE
+			d.user_id = $1
+		ORDER BY
+			d.updated DESC
+		LIMIT 1000
+	`, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query drafts")
+	}
+	defer rows.Close()
+
+	var drafts []*Draft
+	for rows.Next() {
+		d := Draft{UserID: userID}
+		if err := rows.Scan(&d.TopicID, &d.TopicSubject, &d.Subject, &d.Content, &d.Updated); err != nil {
+			return nil, errors.Wrap(err, "cannot scan draft")
+		}
+		drafts = append(drafts, &d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+	return drafts, nil
+}
@@ -0,0 +1,83 @@
+package gbb
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDraftStore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	bbStore, err := NewPostgresBBStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewPostgresDraftStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ensureUser(t, db, 999, "Bobby")
+	ensureUser(t, db, 998, "Alice")
+
+	topic, _, err := bbStore.CreateTopic(ctx, "first", "IMO", 1, 999)
+	if err != nil {
+		t.Fatalf("cannot create topic: %s", err)
+	}
+
+	if _, err := store.Draft(ctx, 999, 0); !ErrDraftNotFound.Is(err) {
+		t.Fatalf("want ErrDraftNotFound, got %+v", err)
+	}
+
+	if err := store.SaveDraft(ctx, Draft{UserID: 999, Subject: "new", Content: "first"}); err != nil {
+		t.Fatalf("cannot save topic draft: %s", err)
+	}
+	// Saving again replaces the previous draft.
+	if err := store.SaveDraft(ctx, Draft{UserID: 999, Subject: "new", Content: "second"}); err != nil {
+		t.Fatalf("cannot save topic draft: %s", err)
+	}
+	if err := store.SaveDraft(ctx, Draft{UserID: 999, TopicID: topic.TopicID, Content: "comment"}); err != nil {
+		t.Fatalf("cannot save comment draft: %s", err)
+	}
+	if err := store.SaveDraft(ctx, Draft{UserID: 998, Content: "alice"}); err != nil {
+		t.Fatalf("cannot save topic draft: %s", err)
+	}
+	if err := store.SaveDraft(ctx, Draft{UserID: 999, TopicID: 123456789, Content: "x"}); !ErrNotFound.Is(err) {
+		t.Fatalf("want ErrNotFound for missing topic, got %+v", err)
+	}
+
+	if d, err := store.Draft(ctx, 999, 0); err != nil {
+		t.Fatalf("cannot get topic draft: %s", err)
+	} else if d.Subject != "new" || d.Content != "second" {
+		t.Fatalf("unexpected topic draft: %+v", d)
+	}
+
+	drafts, err := store.ListDrafts(ctx, 999)
+	if err != nil {
+		t.Fatalf("cannot list drafts: %s", err)
+	}
+	if len(drafts) != 2 {
+		t.Fatalf("want 2 drafts, got %d", len(drafts))
+	}
+	if d := drafts[0]; d.TopicID != topic.TopicID || d.TopicSubject != "first" || d.Content != "comment" {
+		t.Fatalf("unexpected most recent draft: %+v", d)
+	}
+
+	if err := store.DeleteDraft(ctx, 999, topic.TopicID); err != nil {
+		t.Fatalf("cannot delete draft: %s", err)
+	}
+	if err := store.DeleteDraft(ctx, 999, topic.TopicID); err != nil {
+		t.Fatalf("deleting missing draft must not fail: %s", err)
+	}
+	if _, err := store.Draft(ctx, 999, topic.TopicID); !ErrDraftNotFound.Is(err) {
+		t.Fatalf("want ErrDraftNotFound, got %+v", err)
+	}
+	if _, err := store.Draft(ctx, 998, 0); err != nil {
+		t.Fatalf("other user draft must not be affected: %s", err)
+	}
+}
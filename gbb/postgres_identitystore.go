@@ -0,0 +1,120 @@
+package gbb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/go-surf/surf/sqldb"
+)
+
+// NewPostgresIdentityStore returns an IdentityStore using given database.
+// The users table must already exist.
+func NewPostgresIdentityStore(db *sql.DB) (IdentityStore, error) {
+	store := &pgIdentityStore{
+		db: sqldb.PostgresDatabase(db),
+	}
+	return store, store.ensureSchema(context.Background())
+}
+
+type pgIdentityStore struct {
+	db sqldb.Database
+}
+
+func (is *pgIdentityStore) ensureSchema(ctx context.Context) error {
+	// Policy table always contains exactly one row.
+	const schema = `
+CREATE TABLE IF NOT EXISTS external_identities (
+	provider TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+	created TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (provider, subject)
+);
+
+CREATE INDEX IF NOT EXISTS external_identities_user_idx ON external_identities(user_id);
+
+CREATE TABLE IF NOT EXISTS login_policy (
+	policy_id INTEGER PRIMARY KEY CHECK (policy_id = 1),
+	local_disabled BOOLEAN NOT NULL
+);
+
+INSERT INTO login_policy (policy_id, local_disabled) VALUES (1, false)
+	ON CONFLICT DO NOTHING;
+`
+	for i, migration := range strings.Split(schema, `;\n\n`) {
+		_, err := is.db.ExecContext(ctx, migration)
+		if err != nil {
+			if max := 30; len(migration) > max {
+				migration = migration[max:]
+			}
+			return fmt.Errorf("migration %d (%s): %s", i, migration, err)
+		}
+	}
+	return nil
+}
+
+func (is *pgIdentityStore) UserByIdentity(ctx context.Context, provider, subject string) (int64, error) {
+	var userID int64
+	err := is.db.QueryRowContext(ctx, `
+		SELECT user_id FROM external_identities
+		WHERE provider = $1 AND subject = $2
+		LIMIT 1
+	`, provider, subject).Scan(&userID)
+	switch {
+	case err == nil:
+		return userID, nil
+	case surf.ErrNotFound.Is(err):
+		return 0, ErrIdentityNotFound
+	default:
+		return 0, errors.Wrap(err, "cannot fetch identity")
+	}
+}
+
+func (is *pgIdentityStore) LinkIdentity(ctx context.Context, userID int64, provider, subject string) error {
+	_, err := is.db.ExecContext(ctx, `
+		INSERT INTO external_identities (provider, subject, user_id, created)
+		VALUES ($1, $2, $3, $4)
+	`, provider, subject, userID, time.Now())
+	switch {
+	case err == nil:
+		return nil
+	case surf.ErrConstraint.Is(err):
+		return ErrConstraint
+	default:
+		return errors.Wrap(err, "cannot insert identity")
+	}
+}
+
+func (is *pgIdentityStore) HasIdentity(ctx context.Context, userID int64) (bool, error) {
+	var linked bool
+	if err := is.db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM external_identities WHERE user_id = $1)
+	`, userID).Scan(&linked); err != nil {
+		return false, errors.Wrap(err, "cannot fetch identity")
+	}
+	return linked, nil
+}
+
+func (is *pgIdentityStore) LocalLoginDisabled(ctx context.Context) (bool, error) {
+	var disabled bool
+	if err := is.db.QueryRowContext(ctx, `
+		SELECT local_disabled FROM login_policy WHERE policy_id = 1
+	`).Scan(&disabled); err != nil {
+		return false, errors.Wrap(err, "cannot fetch policy")
+	}
+	return disabled, nil
+}
+
+func (is *pgIdentityStore) SetLocalLoginDisabled(ctx context.Context, disabled bool) error {
+	if _, err := is.db.ExecContext(ctx, `
+		UPDATE login_policy SET local_disabled = $1 WHERE policy_id = 1
+	`, disabled); err != nil {
+		return errors.Wrap(err, "cannot update policy")
+	}
+	return nil
+}
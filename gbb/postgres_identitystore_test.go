@@ -0,0 +1,65 @@
+package gbb
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestIdentityStore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	if _, err := NewPostgresBBStore(db); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewPostgresIdentityStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ensureUser(t, db, 999, "Bobby")
+	ensureUser(t, db, 1000, "Rick")
+
+	if _, err := store.UserByIdentity(ctx, "https://id.example.com", "bob"); !ErrIdentityNotFound.Is(err) {
+		t.Fatalf("want ErrIdentityNotFound, got %+v", err)
+	}
+
+	if err := store.LinkIdentity(ctx, 999, "https://id.example.com", "bob"); err != nil {
+		t.Fatalf("cannot link identity: %s", err)
+	}
+	if err := store.LinkIdentity(ctx, 1000, "https://id.example.com", "bob"); !ErrConstraint.Is(err) {
+		t.Fatalf("want ErrConstraint, got %+v", err)
+	}
+	// The same subject of another provider is a different identity.
+	if err := store.LinkIdentity(ctx, 1000, "https://other.example.com", "bob"); err != nil {
+		t.Fatalf("cannot link identity: %s", err)
+	}
+
+	if id, err := store.UserByIdentity(ctx, "https://id.example.com", "bob"); err != nil || id != 999 {
+		t.Fatalf("want user 999, got %d, %v", id, err)
+	}
+	if id, err := store.UserByIdentity(ctx, "https://other.example.com", "bob"); err != nil || id != 1000 {
+		t.Fatalf("want user 1000, got %d, %v", id, err)
+	}
+	if linked, err := store.HasIdentity(ctx, 999); err != nil || !linked {
+		t.Fatalf("want identity of user 999, got %v, %v", linked, err)
+	}
+	ensureUser(t, db, 1001, "Morty")
+	if linked, err := store.HasIdentity(ctx, 1001); err != nil || linked {
+		t.Fatalf("want no identity of user 1001, got %v, %v", linked, err)
+	}
+
+	if disabled, err := store.LocalLoginDisabled(ctx); err != nil || disabled {
+		t.Fatalf("want local login enabled by default, got %v, %v", disabled, err)
+	}
+	if err := store.SetLocalLoginDisabled(ctx, true); err != nil {
+		t.Fatalf("cannot change policy: %s", err)
+	}
+	if disabled, err := store.LocalLoginDisabled(ctx); err != nil || !disabled {
+		t.Fatalf("want local login disabled, got %v, %v", disabled, err)
+	}
+}
@@ -0,0 +1,107 @@
+package gbb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/go-surf/surf/sqldb"
+)
+
+// NewPostgresImportStore returns an ImportStore using given database.
+func NewPostgresImportStore(db *sql.DB) (ImportStore, error) {
+	store := &pgImportStore{
+		db: sqldb.PostgresDatabase(db),
+	}
+	return store, store.ensureSchema(context.Background())
+}
+
+type pgImportStore struct {
+	db sqldb.Database
+}
+
+func (is *pgImportStore) ensureSchema(ctx context.Context) error {
+	// Imported records are not referenced, because they can be of any
+	// kind. Deleting imported content does not make it imported again.
+	const schema = `
+CREATE TABLE IF NOT EXISTS imported_records (
+	source TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	foreign_id TEXT NOT NULL,
+	local_id INTEGER NOT NULL,
+	created TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (source, kind, foreign_id)
+);
+`
+	for i, migration := range strings.Split(schema, `;\n\n`) {
+		_, err := is.db.ExecContext(ctx, migration)
+		if err != nil {
+			if max := 30; len(migration) > max {
+				migration = migration[max:]
+			}
+			return fmt.Errorf("migration %d (%s): %s", i, migration, err)
+		}
+	}
+	return nil
+}
+
+func (is *pgImportStore) ImportedID(ctx context.Context, source, kind, foreignID string) (int64, error) {
+	var id int64
+	err := is.db.QueryRowContext(ctx, `
+		SELECT local_id FROM imported_records
+		WHERE source = $1 AND kind = $2 AND foreign_id = $3
+		LIMIT 1
+	`, source, kind, foreignID).Scan(&id)
+	switch {
+	case err == nil:
+		return id, nil
+	case surf.ErrNotFound.Is(err):
+		return 0, ErrImportNotFound
+	default:
+		return 0, errors.Wrap(err, "cannot fetch imported record")
+	}
+}
+
+func (is *pgImportStore) MarkImported(ctx context.Context, source, kind, foreignID string, id int64) error {
+	return markImported(ctx, is.db, source, kind, foreignID, id)
+}
+
+func (is *pgImportStore) ImportRecord(ctx context.Context, bbStore BBStore, source, kind, foreignID string, create func(BBStore) (int64, error)) (int64, error) {
+	var id int64
+	err := bbStore.WithTx(ctx, func(tx BBStore) error {
+		// The record is remembered using the transaction of the
+		// store, which must be kept in the same database.
+		pg, ok := tx.(*pgBBStore)
+		if !ok {
+			return errors.New("store does not use the database")
+		}
+		var err error
+		if id, err = create(tx); err != nil {
+			return err
+		}
+		return markImported(ctx, pg.db, source, kind, foreignID, id)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func markImported(ctx context.Context, db sqldb.Database, source, kind, foreignID string, id int64) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO imported_records (source, kind, foreign_id, local_id, created)
+		VALUES ($1, $2, $3, $4, $5)
+	`, source, kind, foreignID, id, time.Now())
+	switch {
+	case err == nil:
+		return nil
+	case surf.ErrConstraint.Is(err):
+		return ErrConstraint
+	default:
+		return errors.Wrap(err, "cannot insert imported record")
+	}
+}
@@ -0,0 +1,92 @@
+package gbb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-surf/surf/errors"
+)
+
+func TestImportStore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	store, err := NewPostgresImportStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Schema can be ensured many times.
+	if _, err := NewPostgresImportStore(db); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.ImportedID(ctx, "phpbb", "topic", "12"); !ErrImportNotFound.Is(err) {
+		t.Fatalf("want ErrImportNotFound, got %+v", err)
+	}
+	if err := store.MarkImported(ctx, "phpbb", "topic", "12", 3); err != nil {
+		t.Fatalf("cannot mark imported: %s", err)
+	}
+	if err := store.MarkImported(ctx, "phpbb", "topic", "12", 4); !ErrConstraint.Is(err) {
+		t.Fatalf("want ErrConstraint, got %+v", err)
+	}
+	// The same ID of another kind or source is a different record.
+	if err := store.MarkImported(ctx, "phpbb", "comment", "12", 5); err != nil {
+		t.Fatalf("cannot mark imported: %s", err)
+	}
+	if err := store.MarkImported(ctx, "mbox", "topic", "12", 6); err != nil {
+		t.Fatalf("cannot mark imported: %s", err)
+	}
+
+	if id, err := store.ImportedID(ctx, "phpbb", "topic", "12"); err != nil || id != 3 {
+		t.Fatalf("want 3, got %d, %v", id, err)
+	}
+	if id, err := store.ImportedID(ctx, "mbox", "topic", "12"); err != nil || id != 6 {
+		t.Fatalf("want 6, got %d, %v", id, err)
+	}
+
+	// Record is created and remembered in one transaction.
+	bbStore, err := NewPostgresBBStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addCategory := func(name string) func(BBStore) (int64, error) {
+		return func(bbStore BBStore) (int64, error) {
+			if err := bbStore.AddCategories(ctx, []string{name}); err != nil {
+				return 0, err
+			}
+			return categoryByName(ctx, bbStore, name)
+		}
+	}
+	id, err := store.ImportRecord(ctx, bbStore, "phpbb", "category", "1", addCategory("Imported"))
+	if err != nil {
+		t.Fatalf("cannot import record: %s", err)
+	}
+	if got, err := store.ImportedID(ctx, "phpbb", "category", "1"); err != nil || got != id {
+		t.Fatalf("want %d, got %d, %v", id, got, err)
+	}
+	if _, err := store.ImportRecord(ctx, bbStore, "phpbb", "category", "1", addCategory("Duplicate")); !ErrConstraint.Is(err) {
+		t.Fatalf("want ErrConstraint, got %+v", err)
+	}
+	if _, err := categoryByName(ctx, bbStore, "Duplicate"); !ErrNotFound.Is(err) {
+		t.Fatalf("want duplicate category rolled back, got %+v", err)
+	}
+	failing := func(bbStore BBStore) (int64, error) {
+		if _, err := addCategory("Failed")(bbStore); err != nil {
+			return 0, err
+		}
+		return 0, errors.New("connection lost")
+	}
+	if _, err := store.ImportRecord(ctx, bbStore, "phpbb", "category", "2", failing); err == nil {
+		t.Fatal("want error")
+	}
+	if _, err := categoryByName(ctx, bbStore, "Failed"); !ErrNotFound.Is(err) {
+		t.Fatalf("want failed category rolled back, got %+v", err)
+	}
+	if _, err := store.ImportedID(ctx, "phpbb", "category", "2"); !ErrImportNotFound.Is(err) {
+		t.Fatalf("want ErrImportNotFound, got %+v", err)
+	}
+}
@@ -0,0 +1,252 @@
+package gbb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/go-surf/surf/sqldb"
+	"github.com/lib/pq"
+)
+
+// NewPostgresInviteStore returns an InviteStore using given database. The
+// users table must already exist.
+func NewPostgresInviteStore(db *sql.DB) (InviteStore, error) {
+	store := &pgInviteStore{
+		db: sqldb.PostgresDatabase(db),
+	}
+	return store, store.ensureSchema(context.Background())
+}
+
+type pgInviteStore struct {
+	db sqldb.Database
+}
+
+func (is *pgInviteStore) ensureSchema(ctx context.Context) error {
+	const schema = `
+CREATE TABLE IF NOT EXISTS invites (
+	invite_id SERIAL PRIMARY KEY,
+	token TEXT NOT NULL UNIQUE,
+	created_by INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+	scopes SMALLINT NOT NULL DEFAULT 0,
+	max_uses INTEGER NOT NULL CHECK (max_uses > 0),
+	uses INTEGER NOT NULL DEFAULT 0,
+	created TIMESTAMPTZ NOT NULL,
+	expires TIMESTAMPTZ NOT NULL,
+	revoked BOOLEAN NOT NULL DEFAULT false
+);
+
+CREATE INDEX IF NOT EXISTS invites_created_by_idx ON invites(created_by, created);
+
+CREATE TABLE IF NOT EXISTS invitees (
+	invite_id INTEGER NOT NULL REFERENCES invites(invite_id) ON DELETE CASCADE,
+	user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+	created TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (invite_id, user_id)
+);
+`
+	for i, migration := range strings.Split(schema, `;\n\n`) {
+		_, err := is.db.ExecContext(ctx, migration)
+		if err != nil {
+			if max := 30; len(migration) > max {
+				migration = migration[max:]
+			}
+			return fmt.Errorf("migration %d (%s): %s", i, migration, err)
+		}
+	}
+	return nil
+}
+
+func (is *pgInviteStore) CreateInvite(ctx context.Context, inv Invite) (*Invite, error) {
+	inv.Created = time.Now().UTC().Truncate(time.Microsecond)
+	inv.Expires = inv.Expires.UTC().Truncate(time.Microsecond)
+	inv.Uses = 0
+	inv.Revoked = false
+	inv.Invitees = nil
+	err := is.db.QueryRowContext(ctx, `
+		INSERT INTO invites (token, created_by, scopes, max_uses, created, expires)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING invite_id
+	`, inv.Token, inv.CreatedBy.UserID, inv.Scopes, inv.MaxUses, inv.Created, inv.Expires).Scan(&inv.InviteID)
+	switch {
+	case err == nil:
+		return &inv, nil
+	case surf.ErrConstraint.Is(err):
+		return nil, errors.Wrap(ErrConstraint, "user does not exist or token is not unique")
+	default:
+		return nil, errors.Wrap(err, "cannot insert invite")
+	}
+}
+
+const inviteColumns = `
+	i.invite_id,
+	i.token,
+	i.scopes,
+	i.max_uses,
+	i.uses,
+	i.created,
+	i.expires,
+	i.revoked,
+	u.user_id,
+	u.name
+`
+
+func scanInvite(scan func(...interface{}) error) (*Invite, error) {
+	var inv Invite
+	if err := scan(
+		&inv.InviteID,
+		&inv.Token,
+		&inv.Scopes,
+		&inv.MaxUses,
+		&inv.Uses,
+		&inv.Created,
+		&inv.Expires,
+		&inv.Revoked,
+		&inv.CreatedBy.UserID,
+		&inv.CreatedBy.Name,
+	); err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+func (is *pgInviteStore) InviteByToken(ctx context.Context, token string) (*Invite, error) {
+	inv, err := scanInvite(is.db.QueryRowContext(ctx, `
+		SELECT `+inviteColumns+`
+		FROM invites i INNER JOIN users u ON i.created_by = u.user_id
+		WHERE i.token = $1
+		LIMIT 1
+	`, token).Scan)
+	switch {
+	case err == nil:
+		return inv, nil
+	case surf.ErrNotFound.Is(err):
+		return nil, ErrInviteNotFound
+	default:
+		return nil, errors.Wrap(err, "cannot fetch invite")
+	}
+}
+
+func (is *pgInviteStore) RedeemInvite(ctx context.Context, token string) (*Invite, error) {
+	// Invite is used in the same statement it is checked, so that
+	// concurrent registrations cannot use it more times than allowed.
+	inv, err := scanInvite(is.db.QueryRowContext(ctx, `
+		WITH i AS (
+			UPDATE invites
+			SET uses = uses + 1
+			WHERE
+				token = $1
+				AND NOT revoked
+				AND uses < max_uses
+				AND expires > $2
+			RETURNING *
+		)
+		SELECT `+inviteColumns+`
+		FROM i INNER JOIN users u ON i.created_by = u.user_id
+	`, token, time.Now()).Scan)
+	switch {
+	case err == nil:
+		return inv, nil
+	case surf.ErrNotFound.Is(err):
+		return nil, ErrInviteNotFound
+	default:
+		return nil, errors.Wrap(err, "cannot redeem invite")
+	}
+}
+
+func (is *pgInviteStore) AddInvitee(ctx context.Context, inviteID, userID int64) error {
+	_, err := is.db.ExecContext(ctx, `
+		INSERT INTO invitees (invite_id, user_id, created)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING
+	`, inviteID, userID, time.Now())
+	switch {
+	case err == nil:
+		return nil
+	case surf.ErrConstraint.Is(err):
+		return errors.Wrap(ErrNotFound, "invite or user does not exist")
+	default:
+		return errors.Wrap(err, "cannot insert invitee")
+	}
+}
+
+func (is *pgInviteStore) ListInvites(ctx context.Context, createdBy int64, limit int) ([]*Invite, error) {
+	rows, err := is.db.QueryContext(ctx, `
+		SELECT `+inviteColumns+`
+		FROM invites i INNER JOIN users u ON i.created_by = u.user_id
+		WHERE $1 = 0 OR i.created_by = $1
+		ORDER BY i.created DESC
+		LIMIT $2
+	`, createdBy, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query invites")
+	}
+	defer rows.Close()
+
+	var (
+		invites []*Invite
+		ids     []int64
+		byID    = make(map[int64]*Invite)
+	)
+	for rows.Next() {
+		inv, err := scanInvite(rows.Scan)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot scan invite")
+		}
+		invites = append(invites, inv)
+		ids = append(ids, inv.InviteID)
+		byID[inv.InviteID] = inv
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+	if len(invites) == 0 {
+		return invites, nil
+	}
+
+	rows, err = is.db.QueryContext(ctx, `
+		SELECT iu.invite_id, u.user_id, u.name
+		FROM invitees iu INNER JOIN users u ON iu.user_id = u.user_id
+		WHERE iu.invite_id = ANY($1)
+		ORDER BY iu.created ASC
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query invitees")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			inviteID int64
+			u        User
+		)
+		if err := rows.Scan(&inviteID, &u.UserID, &u.Name); err != nil {
+			return nil, errors.Wrap(err, "cannot scan invitee")
+		}
+		inv := byID[inviteID]
+		inv.Invitees = append(inv.Invitees, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+	return invites, nil
+}
+
+func (is *pgInviteStore) RevokeInvite(ctx context.Context, inviteID, createdBy int64) error {
+	res, err := is.db.ExecContext(ctx, `
+		UPDATE invites SET revoked = true
+		WHERE invite_id = $1 AND ($2 = 0 OR created_by = $2)
+	`, inviteID, createdBy)
+	if err != nil {
+		return errors.Wrap(err, "cannot revoke invite")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "cannot get affected rows")
+	} else if n == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package gbb
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestInviteStore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	if _, err := NewPostgresBBStore(db); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewPostgresInviteStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ensureUser(t, db, 999, "Bobby")
+	ensureUser(t, db, 1000, "Rick")
+	ensureUser(t, db, 1001, "Morty")
+	ensureUser(t, db, 1002, "Summer")
+
+	if _, err := store.InviteByToken(ctx, "nope"); !ErrInviteNotFound.Is(err) {
+		t.Fatalf("want ErrInviteNotFound, got %+v", err)
+	}
+
+	multi, err := store.CreateInvite(ctx, Invite{
+		Token:     "multi",
+		CreatedBy: User{UserID: 999},
+		Scopes:    createTopicScope,
+		MaxUses:   2,
+		Expires:   time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("cannot create invite: %s", err)
+	}
+	expired, err := store.CreateInvite(ctx, Invite{
+		Token:     "expired",
+		CreatedBy: User{UserID: 1000},
+		MaxUses:   1,
+		Expires:   time.Now().Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("cannot create invite: %s", err)
+	}
+
+	for _, invitee := range []int64{1001, 1002} {
+		inv, err := store.RedeemInvite(ctx, "multi")
+		if err != nil {
+			t.Fatalf("cannot redeem invite: %s", err)
+		}
+		if inv.InviteID != multi.InviteID || inv.Scopes != createTopicScope || inv.CreatedBy.Name != "Bobby" {
+			t.Fatalf("unexpected invite %+v", inv)
+		}
+		if err := store.AddInvitee(ctx, inv.InviteID, invitee); err != nil {
+			t.Fatalf("cannot add invitee: %s", err)
+		}
+	}
+	if _, err := store.RedeemInvite(ctx, "multi"); !ErrInviteNotFound.Is(err) {
+		t.Fatalf("want used up invite rejected, got %+v", err)
+	}
+	if _, err := store.RedeemInvite(ctx, "expired"); !ErrInviteNotFound.Is(err) {
+		t.Fatalf("want expired invite rejected, got %+v", err)
+	}
+
+	if inv, err := store.InviteByToken(ctx, "multi"); err != nil || inv.Uses != 2 || inv.Usable(time.Now()) || inv.Status() != "redeemed" {
+		t.Fatalf("want redeemed invite, got %+v, %v", inv, err)
+	}
+
+	invites, err := store.ListInvites(ctx, 999, 10)
+	if err != nil {
+		t.Fatalf("cannot list invites: %s", err)
+	}
+	if len(invites) != 1 || len(invites[0].Invitees) != 2 || invites[0].Invitees[0].Name != "Morty" {
+		t.Fatalf("unexpected invites %+v", invites)
+	}
+	if invites, err := store.ListInvites(ctx, 0, 10); err != nil || len(invites) != 2 {
+		t.Fatalf("want all invites, got %d, %v", len(invites), err)
+	}
+
+	if err := store.RevokeInvite(ctx, expired.InviteID, 999); !ErrInviteNotFound.Is(err) {
+		t.Fatalf("want only own invites revoked, got %+v", err)
+	}
+	if err := store.RevokeInvite(ctx, expired.InviteID, 1000); err != nil {
+		t.Fatalf("cannot revoke invite: %s", err)
+	}
+	if inv, err := store.InviteByToken(ctx, "expired"); err != nil || inv.Status() != "revoked" {
+		t.Fatalf("want revoked invite, got %+v, %v", inv, err)
+	}
+}
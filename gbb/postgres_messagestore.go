@@ -0,0 +1,655 @@
+package gbb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/go-surf/surf/sqldb"
+	"github.com/lib/pq"
+)
+
+// NewPostgresMessageStore returns a MessageStore using given database. The
+// users table must already exist.
+func NewPostgresMessageStore(db *sql.DB) (MessageStore, error) {
+	store := &pgMessageStore{
+		db: sqldb.PostgresDatabase(db),
+	}
+	return store, store.ensureSchema(context.Background())
+}
+
+type pgMessageStore struct {
+	db sqldb.Database
+}
+
+func (ms *pgMessageStore) ensureSchema(ctx context.Context) error {
+	// Read progress of each participant is kept together with the
+	// participation, the same way readprogress is kept for topics.
+	const schema = `
+CREATE TABLE IF NOT EXISTS conversations (
+	conversation_id SERIAL PRIMARY KEY,
+	subject TEXT NOT NULL,
+	created TIMESTAMPTZ NOT NULL,
+	updated TIMESTAMPTZ NOT NULL,
+	author_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+	messages_count INTEGER NOT NULL DEFAULT 0 CHECK (messages_count >= 0)
+);
+
+CREATE INDEX IF NOT EXISTS conversations_author_created_idx ON conversations(author_id, created);
+
+CREATE TABLE IF NOT EXISTS conversation_participants (
+	conversation_id INTEGER NOT NULL REFERENCES conversations(conversation_id) ON DELETE CASCADE,
+	user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+	read_message_id INTEGER NOT NULL DEFAULT 0,
+	read_message_created TIMESTAMPTZ NOT NULL DEFAULT '-infinity',
+
+	PRIMARY KEY (conversation_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS conversation_participants_user_idx ON conversation_participants(user_id);
+
+CREATE TABLE IF NOT EXISTS messages (
+	message_id SERIAL PRIMARY KEY,
+	conversation_id INTEGER NOT NULL REFERENCES conversations(conversation_id) ON DELETE CASCADE,
+	content TEXT NOT NULL,
+	created TIMESTAMPTZ NOT NULL,
+	author_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS messages_conversation_created_idx ON messages(conversation_id, created, message_id);
+
+CREATE TABLE IF NOT EXISTS user_blocks (
+	user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+	blocked_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+	created TIMESTAMPTZ NOT NULL DEFAULT now(),
+
+	PRIMARY KEY (user_id, blocked_id)
+);
+`
+	for i, migration := range strings.Split(schema, `;\n\n`) {
+		_, err := ms.db.ExecContext(ctx, migration)
+		if err != nil {
+			if max := 30; len(migration) > max {
+				migration = migration[max:]
+			}
+			return fmt.Errorf("migration %d (%s): %s", i, migration, err)
+		}
+	}
+	return nil
+}
+
+func (ms *pgMessageStore) CreateConversation(ctx context.Context, subject, content string, authorID int64, participantIDs []int64) (*Conversation, *Message, error) {
+	defer surf.CurrentTrace(ctx).Begin("create conversation").Finish()
+
+	tx, err := ms.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot open the transaction")
+	}
+	defer tx.Rollback()
+
+	var participants []int64
+	for _, id := range uniqueInt64s(participantIDs) {
+		if id != authorID {
+			participants = append(participants, id)
+		}
+	}
+	if len(participants) == 0 {
+		return nil, nil, errors.Wrap(ErrMalformed, "no participants")
+	}
+
+	var banned, blocked bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT
+			u.banned,
+			EXISTS (
+				SELECT 1 FROM user_blocks
+				WHERE user_id = ANY($1) AND blocked_id = $2
+			)
+		FROM users u
+		WHERE u.user_id = $2
+		LIMIT 1
+	`, pq.Array(participants), authorID).Scan(&banned, &blocked)
+	switch {
+	case err == nil:
+		// All good.
+	case surf.ErrNotFound.Is(err):
+		return nil, nil, ErrUserNotFound
+	default:
+		return nil, nil, errors.Wrap(err, "cannot check blocks")
+	}
+	if banned {
+		return nil, nil, ErrUserBanned
+	}
+	if blocked {
+		return nil, nil, errors.Wrap(ErrPermission, "blocked by participant")
+	}
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	c := Conversation{
+		Subject:       subject,
+		Created:       now,
+		Updated:       now,
+		Author:        User{UserID: authorID},
+		MessagesCount: 1,
+	}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO conversations (subject, created, updated, author_id, messages_count)
+		VALUES ($1, $2, $2, $3, 1)
+		RETURNING conversation_id
+	`, c.Subject, c.Created, authorID).Scan(&c.ConversationID)
+	switch {
+	case err == nil:
+		// All good.
+	case surf.ErrConstraint.Is(err):
+		return nil, nil, ErrUserNotFound
+	default:
+		return nil, nil, errors.Wrap(err, "cannot create the conversation")
+	}
+
+	m := Message{
+		ConversationID: c.ConversationID,
+		Content:        content,
+		Created:        now,
+		Author:         c.Author,
+	}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO messages (conversation_id, content, created, author_id)
+		VALUES ($1, $2, $3, $4)
+		RETURNING message_id
+	`, m.ConversationID, m.Content, m.Created, authorID).Scan(&m.MessageID)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot create the message")
+	}
+
+	// Author has read the first message.
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO conversation_participants (conversation_id, user_id, read_message_id, read_message_created)
+		SELECT $1, user_id, CASE WHEN user_id = $3 THEN $4 ELSE 0 END, CASE WHEN user_id = $3 THEN $5 ELSE '-infinity'::timestamptz END
+		FROM unnest($2::integer[]) AS user_id
+	`, c.ConversationID, pq.Array(append(participants, authorID)), authorID, m.MessageID, m.Created)
+	switch {
+	case err == nil:
+		// All good.
+	case surf.ErrConstraint.Is(err):
+		return nil, nil, ErrUserNotFound
+	default:
+		return nil, nil, errors.Wrap(err, "cannot add participants")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, errors.Wrap(err, "cannot commit the transaction")
+	}
+
+	// Fetch names and complete participant list.
+	full, err := ms.ConversationByID(ctx, c.ConversationID, authorID)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot fetch created conversation")
+	}
+	m.Author = full.Author
+	return full, &m, nil
+}
+
+func (ms *pgMessageStore) ConversationByID(ctx context.Context, conversationID, userID int64) (*Conversation, error) {
+	c := Conversation{ConversationID: conversationID}
+	err := ms.db.QueryRowContext(ctx, `
+		SELECT
+			c.subject,
+			c.created,
+			c.updated,
+			c.messages_count,
+			c.updated > p.read_message_created,
+			u.user_id,
+			u.name,
+			u.reputation
+		FROM
+			conversations c
+			INNER JOIN conversation_participants p ON p.conversation_id = c.conversation_id AND p.user_id = $2
+			INNER JOIN users u ON c.author_id = u.user_id
+		WHERE
+			c.conversation_id = $1
+		LIMIT 1
+	`, conversationID, userID).Scan(
+		&c.Subject,
+		&c.Created,
+		&c.Updated,
+		&c.MessagesCount,
+		&c.Unread,
+		&c.Author.UserID,
+		&c.Author.Name,
+		&c.Author.Reputation,
+	)
+	switch {
+	case err == nil:
+		// All good.
+	case surf.ErrNotFound.Is(err):
+		return nil, ErrConversationNotFound
+	default:
+		return nil, errors.Wrap(err, "cannot query conversation")
+	}
+
+	participants, err := ms.participants(ctx, []int64{conversationID})
+	if err != nil {
+		return nil, err
+	}
+	c.Participants = participants[conversationID]
+	return &c, nil
+}
+
+// participants returns users participating in given conversations, grouped
+// by the conversation ID.
+func (ms *pgMessageStore) participants(ctx context.Context, conversationIDs []int64) (map[int64][]User, error) {
+	rows, err := ms.db.QueryContext(ctx, `
+		SELECT p.conversation_id, u.user_id, u.name, u.reputation
+		FROM
+			conversation_participants p
+			INNER JOIN users u ON p.user_id = u.user_id
+		WHERE
+			p.conversation_id = ANY($1)
+		ORDER BY
+			u.name
+	`, pq.Array(conversationIDs))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query participants")
+	}
+	defer rows.Close()
+
+	participants := make(map[int64][]User, len(conversationIDs))
+	for rows.Next() {
+		var (
+			conversationID int64
+			u              User
+		)
+		if err := rows.Scan(&conversationID, &u.UserID, &u.Name, &u.Reputation); err != nil {
+			return nil, errors.Wrap(err, "cannot scan participant")
+		}
+		participants[conversationID] = append(participants[conversationID], u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+	return participants, nil
+}
+
+func (ms *pgMessageStore) ListConversations(ctx context.Context, userID int64, updatedLte time.Time, limit int) ([]*Conversation, error) {
+	rows, err := ms.db.QueryContext(ctx, `
+		SELECT
+			c.conversation_id,
+			c.subject,
+			c.created,
+			c.updated,
+			c.messages_count,
+			c.updated > p.read_message_created,
+			u.user_id,
+			u.name,
+			u.reputation
+		FROM
+			conversation_participants p
+			INNER JOIN conversations c ON p.conversation_id = c.conversation_id
+			INNER JOIN users u ON c.author_id = u.user_id
+		WHERE
+			p.user_id = $1
+			AND c.updated <= $2
+		ORDER BY
+			c.updated DESC
+		LIMIT $3
+	`, userID, updatedLte, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query conversations")
+	}
+	defer rows.Close()
+
+	var (
+		conversations []*Conversation
+		ids           []int64
+	)
+	for rows.Next() {
+		var c Conversation
+		if err := rows.Scan(
+			&c.ConversationID,
+			&c.Subject,
+			&c.Created,
+			&c.Updated,
+			&c.MessagesCount,
+			&c.Unread,
+			&c.Author.UserID,
+			&c.Author.Name,
+			&c.Author.Reputation,
+		); err != nil {
+			return nil, errors.Wrap(err, "cannot scan conversation")
+		}
+		conversations = append(conversations, &c)
+		ids = append(ids, c.ConversationID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+
+	if len(conversations) == 0 {
+		return conversations, nil
+	}
+	participants, err := ms.participants(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range conversations {
+		c.Participants = participants[c.ConversationID]
+	}
+	return conversations, nil
+}
+
+func (ms *pgMessageStore) CountStartedConversations(ctx context.Context, userID int64, createdGte time.Time) (int64, error) {
+	var count int64
+	err := ms.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM conversations
+		WHERE author_id = $1 AND created >= $2
+	`, userID, createdGte).Scan(&count)
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot count conversations")
+	}
+	return count, nil
+}
+
+func (ms *pgMessageStore) LeaveConversation(ctx context.Context, conversationID, userID int64) error {
+	tx, err := ms.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "cannot open the transaction")
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		DELETE FROM conversation_participants
+		WHERE conversation_id = $1 AND user_id = $2
+	`, conversationID, userID)
+	if err != nil {
+		return errors.Wrap(err, "cannot delete participant")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "cannot get affected rows")
+	} else if n == 0 {
+		return ErrConversationNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM conversations c
+		WHERE c.conversation_id = $1 AND NOT EXISTS (
+			SELECT 1 FROM conversation_participants p
+			WHERE p.conversation_id = c.conversation_id
+		)
+	`, conversationID)
+	if err != nil {
+		return errors.Wrap(err, "cannot delete abandoned conversation")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "cannot commit the transaction")
+	}
+	return nil
+}
+
+func (ms *pgMessageStore) ListMessages(ctx context.Context, conversationID int64, cursor CommentCursor, limit int) ([]*Message, error) {
+	// Messages are selected the same way as comments, using (created,
+	// message_id) as the key.
+	var (
+		query string
+		args  = []interface{}{conversationID, limit, cursor.Created, cursor.CommentID}
+	)
+	switch {
+	case !cursor.Backward:
+		query = `
+		SELECT m.message_id, m.content, m.created, m.author_id, u.name, u.reputation
+		FROM
+			messages m
+			INNER JOIN users u ON m.author_id = u.user_id
+		WHERE
+			m.conversation_id = $1
+			AND (m.created, m.message_id) >= ($3, $4)
+		ORDER BY
+			m.created ASC, m.message_id ASC
+		LIMIT $2
+		`
+	case cursor.IsZero():
+		args = args[:2]
+		query = `
+		SELECT * FROM (
+			SELECT m.message_id, m.content, m.created, m.author_id, u.name, u.reputation
+			FROM
+				messages m
+				INNER JOIN users u ON m.author_id = u.user_id
+			WHERE
+				m.conversation_id = $1
+			ORDER BY
+				m.created DESC, m.message_id DESC
+			LIMIT $2
+		) page
+		ORDER BY
+			page.created ASC, page.message_id ASC
+		`
+	default:
+		query = `
+		SELECT * FROM (
+			SELECT m.message_id, m.content, m.created, m.author_id, u.name, u.reputation
+			FROM
+				messages m
+				INNER JOIN users u ON m.author_id = u.user_id
+			WHERE
+				m.conversation_id = $1
+				AND (m.created, m.message_id) < ($3, $4)
+			ORDER BY
+				m.created DESC, m.message_id DESC
+			LIMIT $2
+		) page
+		ORDER BY
+			page.created ASC, page.message_id ASC
+		`
+	}
+
+	rows, err := ms.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query messages")
+	}
+	defer rows.Close()
+
+	var messages []*Message
+	for rows.Next() {
+		m := Message{ConversationID: conversationID}
+		if err := rows.Scan(
+			&m.MessageID,
+			&m.Content,
+			&m.Created,
+			&m.Author.UserID,
+			&m.Author.Name,
+			&m.Author.Reputation,
+		); err != nil {
+			return nil, errors.Wrap(err, "cannot scan message")
+		}
+		messages = append(messages, &m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+	return messages, nil
+}
+
+func (ms *pgMessageStore) CreateMessage(ctx context.Context, conversationID int64, content string, userID int64) (*Message, error) {
+	defer surf.CurrentTrace(ctx).Begin("create message").Finish()
+
+	tx, err := ms.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open the transaction")
+	}
+	defer tx.Rollback()
+
+	m := Message{
+		ConversationID: conversationID,
+		Content:        content,
+		Created:        time.Now().UTC().Truncate(time.Microsecond),
+		Author:         User{UserID: userID},
+	}
+
+	var participant, blocked bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT
+			EXISTS (
+				SELECT 1 FROM conversation_participants
+				WHERE conversation_id = $1 AND user_id = $2
+			),
+			EXISTS (
+				SELECT 1
+				FROM conversation_participants p
+					INNER JOIN user_blocks b ON b.user_id = p.user_id
+				WHERE p.conversation_id = $1 AND b.blocked_id = $2
+			)
+	`, conversationID, userID).Scan(&participant, &blocked)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot check participation")
+	}
+	if !participant {
+		return nil, errors.Wrap(ErrPermission, "not a participant")
+	}
+	if blocked {
+		return nil, errors.Wrap(ErrPermission, "blocked by participant")
+	}
+
+	var banned bool
+	err = tx.QueryRowContext(ctx, `
+		SELECT name, reputation, banned FROM users WHERE user_id = $1 LIMIT 1
+	`, userID).Scan(&m.Author.Name, &m.Author.Reputation, &banned)
+	switch {
+	case err == nil:
+		// All good.
+	case surf.ErrNotFound.Is(err):
+		return nil, ErrUserNotFound
+	default:
+		return nil, errors.Wrap(err, "cannot fetch the user")
+	}
+	if banned {
+		return nil, ErrUserBanned
+	}
+
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO messages (conversation_id, content, created, author_id)
+		VALUES ($1, $2, $3, $4)
+		RETURNING message_id
+	`, m.ConversationID, m.Content, m.Created, userID).Scan(&m.MessageID)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create the message")
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE conversations
+		SET updated = $2, messages_count = messages_count + 1
+		WHERE conversation_id = $1
+	`, conversationID, m.Created); err != nil {
+		return nil, errors.Wrap(err, "cannot update the conversation")
+	}
+
+	// Author has read own message.
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE conversation_participants
+		SET read_message_id = $3, read_message_created = $4
+		WHERE conversation_id = $1 AND user_id = $2
+	`, conversationID, userID, m.MessageID, m.Created); err != nil {
+		return nil, errors.Wrap(err, "cannot track read progress")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "cannot commit the transaction")
+	}
+	return &m, nil
+}
+
+func (ms *pgMessageStore) TrackRead(ctx context.Context, p ReadProgress) error {
+	// Progress is never moved back, so that reading an older page does
+	// not mark newer messages as unread.
+	_, err := ms.db.ExecContext(ctx, `
+		UPDATE conversation_participants
+		SET read_message_id = $3, read_message_created = $4
+		WHERE conversation_id = $1 AND user_id = $2 AND read_message_created < $4
+	`, p.TopicID, p.UserID, p.CommentID, p.CommentCreated)
+	if err != nil {
+		return errors.Wrap(err, "cannot update read progress")
+	}
+	return nil
+}
+
+func (ms *pgMessageStore) CountUnread(ctx context.Context, userID int64) (int64, error) {
+	var count int64
+	err := ms.db.QueryRowContext(ctx, `
+		SELECT COUNT(*)
+		FROM
+			conversation_participants p
+			INNER JOIN conversations c ON p.conversation_id = c.conversation_id
+		WHERE
+			p.user_id = $1
+			AND c.updated > p.read_message_created
+	`, userID).Scan(&count)
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot count unread conversations")
+	}
+	return count, nil
+}
+
+func (ms *pgMessageStore) BlockUser(ctx context.Context, userID, blockedID int64) error {
+	if userID == blockedID {
+		return errors.Wrap(ErrMalformed, "cannot block self")
+	}
+	_, err := ms.db.ExecContext(ctx, `
+		INSERT INTO user_blocks (user_id, blocked_id)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING
+	`, userID, blockedID)
+	switch {
+	case err == nil:
+		return nil
+	case surf.ErrConstraint.Is(err):
+		return ErrUserNotFound
+	default:
+		return errors.Wrap(err, "cannot block user")
+	}
+}
+
+func (ms *pgMessageStore) UnblockUser(ctx context.Context, userID, blockedID int64) error {
+	_, err := ms.db.ExecContext(ctx, `
+		DELETE FROM user_blocks
+		WHERE user_id = $1 AND blocked_id = $2
+	`, userID, blockedID)
+	if err != nil {
+		return errors.Wrap(err, "cannot unblock user")
+	}
+	return nil
+}
+
+func (ms *pgMessageStore) ListBlockedUsers(ctx context.Context, userID int64) ([]*User, error) {
+	rows, err := ms.db.QueryContext(ctx, `
+		SELECT u.user_id, u.name, u.reputation
+		FROM
+			user_blocks b
+			INNER JOIN users u ON b.blocked_id = u.user_id
+		WHERE
+			b.user_id = $1
+		ORDER BY
+			u.name
+		LIMIT 1000
+	`, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query blocked users")
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.UserID, &u.Name, &u.Reputation); err != nil {
+			return nil, errors.Wrap(err, "cannot scan user")
+		}
+		users = append(users, &u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+	return users, nil
+}
@@ -0,0 +1,115 @@
+package gbb
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMessageStore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	if _, err := NewPostgresBBStore(db); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewPostgresMessageStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ensureUser(t, db, 999, "Bobby")
+	ensureUser(t, db, 998, "Alice")
+	ensureUser(t, db, 997, "Charlie")
+
+	conv, first, err := store.CreateConversation(ctx, "hello", "first", 999, []int64{998, 999})
+	if err != nil {
+		t.Fatalf("cannot create conversation: %s", err)
+	}
+	if len(conv.Participants) != 2 || conv.Author.Name != "Bobby" || conv.Unread {
+		t.Fatalf("unexpected conversation: %+v", conv)
+	}
+
+	// Only participants can access the conversation.
+	if _, err := store.ConversationByID(ctx, conv.ConversationID, 997); !ErrConversationNotFound.Is(err) {
+		t.Fatalf("want ErrConversationNotFound, got %+v", err)
+	}
+	if _, err := store.CreateMessage(ctx, conv.ConversationID, "intruder", 997); !ErrPermission.Is(err) {
+		t.Fatalf("want ErrPermission, got %+v", err)
+	}
+
+	if n, err := store.CountUnread(ctx, 998); err != nil || n != 1 {
+		t.Fatalf("want one unread conversation, got %d, %v", n, err)
+	}
+	if n, err := store.CountUnread(ctx, 999); err != nil || n != 0 {
+		t.Fatalf("author must have read own conversation, got %d, %v", n, err)
+	}
+
+	if err := store.TrackRead(ctx, ReadProgress{UserID: 998, TopicID: conv.ConversationID, CommentID: first.MessageID, CommentCreated: first.Created}); err != nil {
+		t.Fatalf("cannot track read: %s", err)
+	}
+	reply, err := store.CreateMessage(ctx, conv.ConversationID, "second", 998)
+	if err != nil {
+		t.Fatalf("cannot create message: %s", err)
+	}
+	if n, err := store.CountUnread(ctx, 998); err != nil || n != 0 {
+		t.Fatalf("want no unread conversations, got %d, %v", n, err)
+	}
+
+	list, err := store.ListConversations(ctx, 999, time.Now(), 10)
+	if err != nil {
+		t.Fatalf("cannot list conversations: %s", err)
+	}
+	if len(list) != 1 || !list[0].Unread || list[0].MessagesCount != 2 || len(list[0].Participants) != 2 {
+		t.Fatalf("unexpected conversations: %+v", list)
+	}
+
+	messages, err := store.ListMessages(ctx, conv.ConversationID, CommentCursor{}, 10)
+	if err != nil {
+		t.Fatalf("cannot list messages: %s", err)
+	}
+	if len(messages) != 2 || messages[0].MessageID != first.MessageID || messages[1].MessageID != reply.MessageID || messages[1].Author.Name != "Alice" {
+		t.Fatalf("unexpected messages: %+v", messages)
+	}
+
+	if n, err := store.CountStartedConversations(ctx, 999, time.Now().Add(-time.Hour)); err != nil || n != 1 {
+		t.Fatalf("want one started conversation, got %d, %v", n, err)
+	}
+
+	// Blocked user can neither start a conversation nor reply.
+	if err := store.BlockUser(ctx, 998, 999); err != nil {
+		t.Fatalf("cannot block user: %s", err)
+	}
+	if _, _, err := store.CreateConversation(ctx, "again", "hi", 999, []int64{998, 997}); !ErrPermission.Is(err) {
+		t.Fatalf("want ErrPermission, got %+v", err)
+	}
+	if _, err := store.CreateMessage(ctx, conv.ConversationID, "third", 999); !ErrPermission.Is(err) {
+		t.Fatalf("want ErrPermission, got %+v", err)
+	}
+	if blocked, err := store.ListBlockedUsers(ctx, 998); err != nil || len(blocked) != 1 || blocked[0].UserID != 999 {
+		t.Fatalf("unexpected blocked users: %+v, %v", blocked, err)
+	}
+	if err := store.UnblockUser(ctx, 998, 999); err != nil {
+		t.Fatalf("cannot unblock user: %s", err)
+	}
+	if _, err := store.CreateMessage(ctx, conv.ConversationID, "third", 999); err != nil {
+		t.Fatalf("cannot create message: %s", err)
+	}
+
+	// Conversation is deleted once everyone leaves.
+	if err := store.LeaveConversation(ctx, conv.ConversationID, 999); err != nil {
+		t.Fatalf("cannot leave conversation: %s", err)
+	}
+	if _, err := store.ConversationByID(ctx, conv.ConversationID, 998); err != nil {
+		t.Fatalf("conversation must remain for other participants: %s", err)
+	}
+	if err := store.LeaveConversation(ctx, conv.ConversationID, 998); err != nil {
+		t.Fatalf("cannot leave conversation: %s", err)
+	}
+	if err := store.LeaveConversation(ctx, conv.ConversationID, 998); !ErrConversationNotFound.Is(err) {
+		t.Fatalf("want ErrConversationNotFound, got %+v", err)
+	}
+}
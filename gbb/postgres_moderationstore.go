@@ -0,0 +1,433 @@
+package gbb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/go-surf/surf/sqldb"
+	"github.com/lib/pq"
+)
+
+// NewPostgresModerationStore returns a ModerationStore using given database.
+// The comments and users tables must already exist.
+func NewPostgresModerationStore(db *sql.DB) (ModerationStore, error) {
+	store := &pgModerationStore{
+		db: sqldb.PostgresDatabase(db),
+	}
+	return store, store.ensureSchema(context.Background())
+}
+
+type pgModerationStore struct {
+	db sqldb.Database
+}
+
+func (ms *pgModerationStore) ensureSchema(ctx context.Context) error {
+	// Reports and resolutions do not reference comments and topics, so
+	// that the history is kept after the reported comment is deleted.
+	const schema = `
+CREATE TABLE IF NOT EXISTS moderation_resolutions (
+	resolution_id SERIAL PRIMARY KEY,
+	comment_id INTEGER NOT NULL,
+	topic_id INTEGER NOT NULL,
+	moderator_id INTEGER NOT NULL REFERENCES users(user_id),
+	action TEXT NOT NULL,
+	note TEXT NOT NULL,
+	comment_author_id INTEGER NOT NULL,
+	comment_content TEXT NOT NULL,
+	created TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS moderation_resolutions_created_idx ON moderation_resolutions(created);
+
+CREATE TABLE IF NOT EXISTS reports (
+	report_id SERIAL PRIMARY KEY,
+	comment_id INTEGER NOT NULL,
+	topic_id INTEGER NOT NULL,
+	reporter_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+	reason TEXT NOT NULL,
+	created TIMESTAMPTZ NOT NULL,
+	resolution_id INTEGER REFERENCES moderation_resolutions(resolution_id),
+	seen BOOLEAN NOT NULL DEFAULT false
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS reports_open_idx ON reports(comment_id, reporter_id) WHERE resolution_id IS NULL;
+
+CREATE INDEX IF NOT EXISTS reports_reporter_idx ON reports(reporter_id, created);
+`
+	for i, migration := range strings.Split(schema, `;\n\n`) {
+		_, err := ms.db.ExecContext(ctx, migration)
+		if err != nil {
+			if max := 30; len(migration) > max {
+				migration = migration[max:]
+			}
+			return fmt.Errorf("migration %d (%s): %s", i, migration, err)
+		}
+	}
+	return nil
+}
+
+func (ms *pgModerationStore) CreateReport(ctx context.Context, commentID, reporterID int64, reason string) error {
+	res, err := ms.db.ExecContext(ctx, `
+		INSERT INTO reports (comment_id, topic_id, reporter_id, reason, created)
+		SELECT c.comment_id, c.topic_id, $2, $3, $4
+		FROM comments c
+		WHERE c.comment_id = $1
+		ON CONFLICT (comment_id, reporter_id) WHERE resolution_id IS NULL
+		DO UPDATE SET reason = EXCLUDED.reason
+	`, commentID, reporterID, reason, time.Now())
+	switch {
+	case err == nil:
+		// All good.
+	case surf.ErrConstraint.Is(err):
+		return ErrUserNotFound
+	default:
+		return errors.Wrap(err, "cannot create report")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "cannot get affected rows")
+	} else if n == 0 {
+		return ErrCommentNotFound
+	}
+	return nil
+}
+
+func (ms *pgModerationStore) ListReportedComments(ctx context.Context, limit int) ([]*ReportedComment, error) {
+	rows, err := ms.db.QueryContext(ctx, `
+		SELECT
+			r.comment_id,
+			r.topic_id,
+			c.comment_id IS NULL,
+			COALESCE(c.content, ''),
+			COALESCE(c.revision, 0),
+			COALESCE(c.created, MIN(r.created)),
+			COALESCE(cu.user_id, 0),
+			COALESCE(cu.name, ''),
+			COALESCE(cu.reputation, 0),
+			COALESCE(cu.banned, false),
+			COALESCE(t.subject, ''),
+			COALESCE(t.created, MIN(r.created)),
+			COALESCE(t.comments_count, 0),
+			COALESCE(t.locked, false)
+		FROM
+			reports r
+			LEFT JOIN comments c ON r.comment_id = c.comment_id
+			LEFT JOIN users cu ON c.author_id = cu.user_id
+			LEFT JOIN topics t ON r.topic_id = t.topic_id
+		WHERE
+			r.resolution_id IS NULL
+		GROUP BY
+			r.comment_id, r.topic_id, c.comment_id, cu.user_id, t.topic_id
+		ORDER BY
+			MIN(r.created) ASC
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query reported comments")
+	}
+	defer rows.Close()
+
+	var (
+		reported   []*ReportedComment
+		commentIDs []int64
+		byComment  = make(map[int64]*ReportedComment)
+	)
+	for rows.Next() {
+		var rc ReportedComment
+		if err := rows.Scan(
+			&rc.Comment.CommentID,
+			&rc.Topic.TopicID,
+			&rc.Deleted,
+			&rc.Comment.Content,
+			&rc.Comment.Revision,
+			&rc.Comment.Created,
+			&rc.Comment.Author.UserID,
+			&rc.Comment.Author.Name,
+			&rc.Comment.Author.Reputation,
+			&rc.AuthorBanned,
+			&rc.Topic.Subject,
+			&rc.Topic.Created,
+			&rc.Topic.CommentsCount,
+			&rc.Topic.Locked,
+		); err != nil {
+			return nil, errors.Wrap(err, "cannot scan reported comment")
+		}
+		rc.Comment.TopicID = rc.Topic.TopicID
+		reported = append(reported, &rc)
+		commentIDs = append(commentIDs, rc.Comment.CommentID)
+		byComment[rc.Comment.CommentID] = &rc
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+	if len(reported) == 0 {
+		return reported, nil
+	}
+
+	rows, err = ms.db.QueryContext(ctx, `
+		SELECT r.report_id, r.comment_id, r.topic_id, r.reason, r.created, u.user_id, u.name
+		FROM
+			reports r
+			INNER JOIN users u ON r.reporter_id = u.user_id
+		WHERE
+			r.resolution_id IS NULL
+			AND r.comment_id = ANY($1)
+		ORDER BY
+			r.created ASC
+	`, pq.Array(commentIDs))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query reports")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Report
+		if err := rows.Scan(&r.ReportID, &r.CommentID, &r.TopicID, &r.Reason, &r.Created, &r.Reporter.UserID, &r.Reporter.Name); err != nil {
+			return nil, errors.Wrap(err, "cannot scan report")
+		}
+		if rc, ok := byComment[r.CommentID]; ok {
+			rc.Reports = append(rc.Reports, &r)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+	return reported, nil
+}
+
+func (ms *pgModerationStore) ResolveReports(ctx context.Context, r Resolution) (*Resolution, error) {
+	tx, err := ms.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open the transaction")
+	}
+	defer tx.Rollback()
+
+	r.Created = time.Now().UTC().Truncate(time.Microsecond)
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO moderation_resolutions (comment_id, topic_id, moderator_id, action, note, comment_author_id, comment_content, created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING resolution_id
+	`, r.CommentID, r.TopicID, r.Moderator.UserID, string(r.Action), r.Note, r.CommentAuthor.UserID, r.CommentContent, r.Created).Scan(&r.ResolutionID)
+	switch {
+	case err == nil:
+		// All good.
+	case surf.ErrConstraint.Is(err):
+		return nil, ErrUserNotFound
+	default:
+		return nil, errors.Wrap(err, "cannot create resolution")
+	}
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE reports SET resolution_id = $2
+		WHERE comment_id = $1 AND resolution_id IS NULL
+	`, r.CommentID, r.ResolutionID)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot resolve reports")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, errors.Wrap(err, "cannot get affected rows")
+	} else if n == 0 {
+		return nil, ErrReportNotFound
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "cannot commit the transaction")
+	}
+	return &r, nil
+}
+
+func (ms *pgModerationStore) ReopenReports(ctx context.Context, resolutionID int64) error {
+	tx, err := ms.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "cannot open the transaction")
+	}
+	defer tx.Rollback()
+
+	// Reporter could report the comment again in the meantime and only
+	// one open report per reporter is allowed.
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM reports r
+		WHERE r.resolution_id = $1 AND EXISTS (
+			SELECT 1 FROM reports o
+			WHERE o.comment_id = r.comment_id
+				AND o.reporter_id = r.reporter_id
+				AND o.resolution_id IS NULL
+		)
+	`, resolutionID); err != nil {
+		return errors.Wrap(err, "cannot delete reported again")
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE reports SET resolution_id = NULL, seen = false
+		WHERE resolution_id = $1
+	`, resolutionID); err != nil {
+		return errors.Wrap(err, "cannot reopen reports")
+	}
+	res, err := tx.ExecContext(ctx, `
+		DELETE FROM moderation_resolutions WHERE resolution_id = $1
+	`, resolutionID)
+	if err != nil {
+		return errors.Wrap(err, "cannot delete resolution")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "cannot get affected rows")
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "cannot commit the transaction")
+	}
+	return nil
+}
+
+func (ms *pgModerationStore) ListResolutions(ctx context.Context, createdLte time.Time, limit int) ([]*Resolution, error) {
+	rows, err := ms.db.QueryContext(ctx, `
+		SELECT
+			r.resolution_id,
+			r.comment_id,
+			r.topic_id,
+			r.action,
+			r.note,
+			r.comment_content,
+			r.created,
+			m.user_id,
+			m.name,
+			r.comment_author_id,
+			COALESCE(a.name, '')
+		FROM
+			moderation_resolutions r
+			INNER JOIN users m ON r.moderator_id = m.user_id
+			LEFT JOIN users a ON r.comment_author_id = a.user_id
+		WHERE
+			r.created <= $1
+		ORDER BY
+			r.created DESC
+		LIMIT $2
+	`, createdLte, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query resolutions")
+	}
+	defer rows.Close()
+
+	var resolutions []*Resolution
+	for rows.Next() {
+		var r Resolution
+		if err := rows.Scan(
+			&r.ResolutionID,
+			&r.CommentID,
+			&r.TopicID,
+			&r.Action,
+			&r.Note,
+			&r.CommentContent,
+			&r.Created,
+			&r.Moderator.UserID,
+			&r.Moderator.Name,
+			&r.CommentAuthor.UserID,
+			&r.CommentAuthor.Name,
+		); err != nil {
+			return nil, errors.Wrap(err, "cannot scan resolution")
+		}
+		resolutions = append(resolutions, &r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+	return resolutions, nil
+}
+
+func (ms *pgModerationStore) ListUserReports(ctx context.Context, userID int64, limit int) ([]*Report, error) {
+	rows, err := ms.db.QueryContext(ctx, `
+		SELECT
+			r.report_id,
+			r.comment_id,
+			r.topic_id,
+			r.reason,
+			r.created,
+			u.name,
+			s.resolution_id,
+			s.action,
+			s.note,
+			s.created
+		FROM
+			reports r
+			INNER JOIN users u ON r.reporter_id = u.user_id
+			LEFT JOIN moderation_resolutions s ON r.resolution_id = s.resolution_id
+		WHERE
+			r.reporter_id = $1
+		ORDER BY
+			r.created DESC
+		LIMIT $2
+	`, userID, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query reports")
+	}
+	defer rows.Close()
+
+	var reports []*Report
+	for rows.Next() {
+		var (
+			r            Report
+			resolutionID sql.NullInt64
+			action       sql.NullString
+			note         sql.NullString
+			resolved     pq.NullTime
+		)
+		if err := rows.Scan(
+			&r.ReportID,
+			&r.CommentID,
+			&r.TopicID,
+			&r.Reason,
+			&r.Created,
+			&r.Reporter.Name,
+			&resolutionID,
+			&action,
+			&note,
+			&resolved,
+		); err != nil {
+			return nil, errors.Wrap(err, "cannot scan report")
+		}
+		r.Reporter.UserID = userID
+		if resolutionID.Valid {
+			r.Resolution = &Resolution{
+				ResolutionID: resolutionID.Int64,
+				CommentID:    r.CommentID,
+				TopicID:      r.TopicID,
+				Action:       ModerationAction(action.String),
+				Note:         note.String,
+				Created:      resolved.Time,
+			}
+		}
+		reports = append(reports, &r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+	return reports, nil
+}
+
+func (ms *pgModerationStore) CountUnseenResolved(ctx context.Context, userID int64) (int64, error) {
+	var count int64
+	err := ms.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM reports
+		WHERE reporter_id = $1 AND resolution_id IS NOT NULL AND NOT seen
+	`, userID).Scan(&count)
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot count reports")
+	}
+	return count, nil
+}
+
+func (ms *pgModerationStore) MarkResolvedSeen(ctx context.Context, userID int64) error {
+	_, err := ms.db.ExecContext(ctx, `
+		UPDATE reports SET seen = true
+		WHERE reporter_id = $1 AND resolution_id IS NOT NULL AND NOT seen
+	`, userID)
+	if err != nil {
+		return errors.Wrap(err, "cannot mark reports seen")
+	}
+	return nil
+}
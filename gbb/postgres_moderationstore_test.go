@@ -0,0 +1,142 @@
+package gbb
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestModerationStore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	bbStore, err := NewPostgresBBStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewPostgresModerationStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ensureUser(t, db, 999, "Bobby")
+	ensureUser(t, db, 998, "Alice")
+	ensureUser(t, db, 997, "Moderator")
+
+	topic, first, err := bbStore.CreateTopic(ctx, "first", "IMO", 1, 999)
+	if err != nil {
+		t.Fatalf("cannot create topic: %s", err)
+	}
+	spam, err := bbStore.CreateComment(ctx, topic.TopicID, "buy now", 999)
+	if err != nil {
+		t.Fatalf("cannot create comment: %s", err)
+	}
+
+	if err := store.CreateReport(ctx, 123456, 998, "Spam"); !ErrCommentNotFound.Is(err) {
+		t.Fatalf("want ErrCommentNotFound, got %+v", err)
+	}
+	if err := store.CreateReport(ctx, first.CommentID, 998, "Other"); err != nil {
+		t.Fatalf("cannot report comment: %s", err)
+	}
+	if err := store.CreateReport(ctx, spam.CommentID, 998, "Off-topic"); err != nil {
+		t.Fatalf("cannot report comment: %s", err)
+	}
+	// Reporting the same comment again updates the open report.
+	if err := store.CreateReport(ctx, spam.CommentID, 998, "Spam"); err != nil {
+		t.Fatalf("cannot report comment: %s", err)
+	}
+	if err := store.CreateReport(ctx, spam.CommentID, 997, "Spam"); err != nil {
+		t.Fatalf("cannot report comment: %s", err)
+	}
+
+	reported, err := store.ListReportedComments(ctx, 10)
+	if err != nil {
+		t.Fatalf("cannot list reported comments: %s", err)
+	}
+	if len(reported) != 2 {
+		t.Fatalf("want 2 reported comments, got %d", len(reported))
+	}
+	if reported[1].Comment.CommentID != spam.CommentID || len(reported[1].Reports) != 2 || reported[1].Reports[0].Reason != "Spam" {
+		t.Fatalf("unexpected reported comment: %+v", reported[1])
+	}
+
+	// Reports of a deleted comment are still in the queue.
+	if err := bbStore.DeleteComment(ctx, spam.CommentID); err != nil {
+		t.Fatalf("cannot delete comment: %s", err)
+	}
+	reported, err = store.ListReportedComments(ctx, 10)
+	if err != nil {
+		t.Fatalf("cannot list reported comments: %s", err)
+	}
+	if len(reported) != 2 || !reported[1].Deleted || reported[0].Deleted {
+		t.Fatalf("unexpected reported comments: %+v %+v", reported[0], reported[1])
+	}
+
+	resolution, err := store.ResolveReports(ctx, Resolution{
+		CommentID:      spam.CommentID,
+		TopicID:        topic.TopicID,
+		Moderator:      User{UserID: 997},
+		Action:         ActionDelete,
+		Note:           "spam",
+		CommentAuthor:  spam.Author,
+		CommentContent: spam.Content,
+	})
+	if err != nil {
+		t.Fatalf("cannot resolve reports: %s", err)
+	}
+	if _, err := store.ResolveReports(ctx, *resolution); !ErrReportNotFound.Is(err) {
+		t.Fatalf("want ErrReportNotFound, got %+v", err)
+	}
+
+	// Reopened reports are back in the queue and can be resolved again.
+	if err := store.ReopenReports(ctx, resolution.ResolutionID); err != nil {
+		t.Fatalf("cannot reopen reports: %s", err)
+	}
+	if err := store.ReopenReports(ctx, resolution.ResolutionID); !ErrNotFound.Is(err) {
+		t.Fatalf("want ErrNotFound, got %+v", err)
+	}
+	if reported, err := store.ListReportedComments(ctx, 10); err != nil || len(reported) != 2 {
+		t.Fatalf("want two reported comments, got %d, %v", len(reported), err)
+	}
+	resolution, err = store.ResolveReports(ctx, *resolution)
+	if err != nil {
+		t.Fatalf("cannot resolve reports: %s", err)
+	}
+
+	if reported, err := store.ListReportedComments(ctx, 10); err != nil || len(reported) != 1 {
+		t.Fatalf("want one reported comment, got %d, %v", len(reported), err)
+	}
+
+	resolutions, err := store.ListResolutions(ctx, time.Now(), 10)
+	if err != nil {
+		t.Fatalf("cannot list resolutions: %s", err)
+	}
+	if len(resolutions) != 1 || resolutions[0].Action != ActionDelete || resolutions[0].Moderator.Name != "Moderator" || resolutions[0].CommentAuthor.Name != "Bobby" {
+		t.Fatalf("unexpected resolutions: %+v", resolutions)
+	}
+
+	if n, err := store.CountUnseenResolved(ctx, 998); err != nil || n != 1 {
+		t.Fatalf("want one unseen resolved report, got %d, %v", n, err)
+	}
+	reports, err := store.ListUserReports(ctx, 998, 10)
+	if err != nil {
+		t.Fatalf("cannot list user reports: %s", err)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("want 2 reports, got %d", len(reports))
+	}
+	for _, r := range reports {
+		if resolved := r.Resolution != nil; resolved != (r.CommentID == spam.CommentID) {
+			t.Fatalf("unexpected report resolution: %+v", r)
+		}
+	}
+	if err := store.MarkResolvedSeen(ctx, 998); err != nil {
+		t.Fatalf("cannot mark reports seen: %s", err)
+	}
+	if n, err := store.CountUnseenResolved(ctx, 998); err != nil || n != 0 {
+		t.Fatalf("want no unseen resolved reports, got %d, %v", n, err)
+	}
+}
@@ -0,0 +1,222 @@
+package gbb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/go-surf/surf/sqldb"
+	"github.com/lib/pq"
+)
+
+// NewPostgresPendingPostStore returns a PendingPostStore using given database.
+// The topics and users tables must already exist.
+func NewPostgresPendingPostStore(db *sql.DB) (PendingPostStore, error) {
+	store := &pgPendingPostStore{
+		db: sqldb.PostgresDatabase(db),
+	}
+	return store, store.ensureSchema(context.Background())
+}
+
+type pgPendingPostStore struct {
+	db sqldb.Database
+}
+
+func (ps *pgPendingPostStore) ensureSchema(ctx context.Context) error {
+	// Poll of a pending topic is stored serialized, because it cannot be
+	// attached to a topic that does not exist yet.
+	const schema = `
+CREATE TABLE IF NOT EXISTS pending_posts (
+	pending_id SERIAL PRIMARY KEY,
+	topic_id INTEGER REFERENCES topics(topic_id) ON DELETE CASCADE,
+	subject TEXT NOT NULL,
+	category_id INTEGER NOT NULL,
+	poll TEXT NOT NULL,
+	content TEXT NOT NULL,
+	attachment_ids INTEGER[] NOT NULL,
+	author_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+	reason TEXT NOT NULL,
+	created TIMESTAMPTZ NOT NULL
+);
+`
+	for i, migration := range strings.Split(schema, `;\n\n`) {
+		_, err := ps.db.ExecContext(ctx, migration)
+		if err != nil {
+			if max := 30; len(migration) > max {
+				migration = migration[max:]
+			}
+			return fmt.Errorf("migration %d (%s): %s", i, migration, err)
+		}
+	}
+	return nil
+}
+
+func (ps *pgPendingPostStore) HoldPost(ctx context.Context, p PendingPost) (*PendingPost, error) {
+	var poll []byte
+	if p.Poll != nil {
+		raw, err := json.Marshal(p.Poll)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot serialize poll")
+		}
+		poll = raw
+	}
+	if p.AttachmentIDs == nil {
+		p.AttachmentIDs = []int64{}
+	}
+
+	p.Created = time.Now().UTC().Truncate(time.Microsecond)
+	topicID := sql.NullInt64{Int64: p.TopicID, Valid: p.TopicID != 0}
+	err := ps.db.QueryRowContext(ctx, `
+		INSERT INTO pending_posts (topic_id, subject, category_id, poll, content, attachment_ids, author_id, reason, created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING pending_id
+	`, topicID, p.Subject, p.Category, string(poll), p.Content, pq.Array(p.AttachmentIDs), p.Author.UserID, p.Reason, p.Created).Scan(&p.PendingID)
+	switch {
+	case err == nil:
+		return &p, nil
+	case surf.ErrConstraint.Is(err):
+		return nil, errors.Wrap(ErrNotFound, "user or topic does not exist")
+	default:
+		return nil, errors.Wrap(err, "cannot insert pending post")
+	}
+}
+
+const pendingPostColumns = `
+	p.pending_id,
+	COALESCE(p.topic_id, 0),
+	COALESCE(t.subject, ''),
+	p.subject,
+	p.category_id,
+	p.poll,
+	p.content,
+	p.attachment_ids,
+	p.reason,
+	p.created,
+	u.user_id,
+	u.name,
+	u.reputation
+`
+
+func scanPendingPost(scan func(...interface{}) error) (*PendingPost, error) {
+	var (
+		p             PendingPost
+		poll          string
+		attachmentIDs pq.Int64Array
+	)
+	if err := scan(
+		&p.PendingID,
+		&p.TopicID,
+		&p.TopicSubject,
+		&p.Subject,
+		&p.Category,
+		&poll,
+		&p.Content,
+		&attachmentIDs,
+		&p.Reason,
+		&p.Created,
+		&p.Author.UserID,
+		&p.Author.Name,
+		&p.Author.Reputation,
+	); err != nil {
+		return nil, err
+	}
+	p.AttachmentIDs = attachmentIDs
+	if poll != "" {
+		if err := json.Unmarshal([]byte(poll), &p.Poll); err != nil {
+			return nil, errors.Wrap(err, "cannot deserialize poll")
+		}
+	}
+	return &p, nil
+}
+
+func (ps *pgPendingPostStore) PendingPostByID(ctx context.Context, pendingID int64) (*PendingPost, error) {
+	p, err := scanPendingPost(ps.db.QueryRowContext(ctx, `
+		SELECT `+pendingPostColumns+`
+		FROM
+			pending_posts p
+			INNER JOIN users u ON p.author_id = u.user_id
+			LEFT JOIN topics t ON p.topic_id = t.topic_id
+		WHERE p.pending_id = $1
+		LIMIT 1
+	`, pendingID).Scan)
+	switch {
+	case err == nil:
+		return p, nil
+	case surf.ErrNotFound.Is(err):
+		return nil, ErrPendingPostNotFound
+	default:
+		return nil, errors.Wrap(err, "cannot fetch pending post")
+	}
+}
+
+func (ps *pgPendingPostStore) ListPendingPosts(ctx context.Context, limit int) ([]*PendingPost, error) {
+	rows, err := ps.db.QueryContext(ctx, `
+		SELECT `+pendingPostColumns+`
+		FROM
+			pending_posts p
+			INNER JOIN users u ON p.author_id = u.user_id
+			LEFT JOIN topics t ON p.topic_id = t.topic_id
+		ORDER BY p.created ASC
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query pending posts")
+	}
+	defer rows.Close()
+
+	var posts []*PendingPost
+	for rows.Next() {
+		p, err := scanPendingPost(rows.Scan)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot scan pending post")
+		}
+		posts = append(posts, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+	return posts, nil
+}
+
+func (ps *pgPendingPostStore) ListHeldAttachmentIDs(ctx context.Context) ([]int64, error) {
+	rows, err := ps.db.QueryContext(ctx, `
+		SELECT DISTINCT unnest(attachment_ids) FROM pending_posts
+	`)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query attachment IDs")
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, errors.Wrap(err, "cannot scan attachment ID")
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+	return ids, nil
+}
+
+func (ps *pgPendingPostStore) DeletePendingPost(ctx context.Context, pendingID int64) error {
+	res, err := ps.db.ExecContext(ctx, `
+		DELETE FROM pending_posts WHERE pending_id = $1
+	`, pendingID)
+	if err != nil {
+		return errors.Wrap(err, "cannot delete pending post")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "cannot get affected rows")
+	} else if n == 0 {
+		return ErrPendingPostNotFound
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package gbb
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPendingPostStore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	bbStore, err := NewPostgresBBStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewPostgresPendingPostStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ensureUser(t, db, 999, "Bobby")
+
+	topic, _, err := bbStore.CreateTopic(ctx, "first", "IMO", 1, 999)
+	if err != nil {
+		t.Fatalf("cannot create topic: %s", err)
+	}
+
+	newTopic, err := store.HoldPost(ctx, PendingPost{
+		Subject:  "new",
+		Category: 1,
+		Poll:     &Poll{Question: "Why?", Options: []*PollOption{{Label: "yes"}, {Label: "no"}}},
+		Content:  "content",
+		Author:   User{UserID: 999},
+		Reason:   "new account",
+	})
+	if err != nil {
+		t.Fatalf("cannot hold topic: %s", err)
+	}
+	comment, err := store.HoldPost(ctx, PendingPost{
+		TopicID:       topic.TopicID,
+		Content:       "comment",
+		AttachmentIDs: []int64{3, 4},
+		Author:        User{UserID: 999},
+		Reason:        "3 links",
+	})
+	if err != nil {
+		t.Fatalf("cannot hold comment: %s", err)
+	}
+
+	if _, err := store.HoldPost(ctx, PendingPost{TopicID: 123456, Content: "x", Author: User{UserID: 999}}); !ErrNotFound.Is(err) {
+		t.Fatalf("want ErrNotFound, got %+v", err)
+	}
+
+	posts, err := store.ListPendingPosts(ctx, 10)
+	if err != nil {
+		t.Fatalf("cannot list pending posts: %s", err)
+	}
+	if len(posts) != 2 {
+		t.Fatalf("want 2 pending posts, got %d", len(posts))
+	}
+	if p := posts[0]; p.PendingID != newTopic.PendingID || p.Poll == nil || len(p.Poll.Options) != 2 || p.Author.Name != "Bobby" {
+		t.Fatalf("unexpected pending topic: %+v", p)
+	}
+	if p := posts[1]; p.TopicSubject != "first" || len(p.AttachmentIDs) != 2 || p.Poll != nil {
+		t.Fatalf("unexpected pending comment: %+v", p)
+	}
+
+	if err := store.DeletePendingPost(ctx, comment.PendingID); err != nil {
+		t.Fatalf("cannot delete pending post: %s", err)
+	}
+	if _, err := store.PendingPostByID(ctx, comment.PendingID); !ErrPendingPostNotFound.Is(err) {
+		t.Fatalf("want ErrPendingPostNotFound, got %+v", err)
+	}
+	if err := store.DeletePendingPost(ctx, comment.PendingID); !ErrPendingPostNotFound.Is(err) {
+		t.Fatalf("want ErrPendingPostNotFound, got %+v", err)
+	}
+}
+
+func TestHeldPostAttachmentsSurviveCleanup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	bbStore, err := NewPostgresBBStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewPostgresPendingPostStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attachments, err := NewPostgresAttachmentStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	polls, err := NewPostgresPollStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	references, err := NewPostgresCommentReferenceStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := createArchiveBlobStore(t)
+
+	ensureUser(t, db, 999, "Bobby")
+
+	topic, _, err := bbStore.CreateTopic(ctx, "first", "IMO", 1, 999)
+	if err != nil {
+		t.Fatalf("cannot create topic: %s", err)
+	}
+
+	const key = "held"
+	if err := blobs.Put(ctx, key, strings.NewReader("held")); err != nil {
+		t.Fatalf("cannot store blob: %s", err)
+	}
+	a, err := attachments.CreateAttachment(ctx, Attachment{
+		UserID:      999,
+		Name:        "held.txt",
+		ContentType: "text/plain; charset=utf-8",
+		Size:        4,
+		BlobKey:     key,
+	})
+	if err != nil {
+		t.Fatalf("cannot create attachment: %s", err)
+	}
+	held, err := store.HoldPost(ctx, PendingPost{
+		TopicID:       topic.TopicID,
+		Content:       "comment",
+		AttachmentIDs: []int64{a.AttachmentID},
+		Author:        User{UserID: 999},
+		Reason:        "new account",
+	})
+	if err != nil {
+		t.Fatalf("cannot hold comment: %s", err)
+	}
+
+	if ids, err := store.ListHeldAttachmentIDs(ctx); err != nil || len(ids) != 1 || ids[0] != a.AttachmentID {
+		t.Fatalf("want held attachment %d, got %v, %v", a.AttachmentID, ids, err)
+	}
+
+	if n, err := CleanupOrphanedAttachments(ctx, attachments, store, blobs, 0); err != nil {
+		t.Fatalf("cannot cleanup attachments: %s", err)
+	} else if n != 0 {
+		t.Fatalf("want no attachments removed, got %d", n)
+	}
+
+	post, err := store.PendingPostByID(ctx, held.PendingID)
+	if err != nil {
+		t.Fatalf("cannot get pending post: %s", err)
+	}
+	if err := publishPendingPost(ctx, bbStore, polls, attachments, references, post); err != nil {
+		t.Fatalf("cannot publish pending post: %s", err)
+	}
+	if a, err := attachments.AttachmentByID(ctx, a.AttachmentID); err != nil {
+		t.Fatalf("cannot get attachment: %s", err)
+	} else if a.CommentID == 0 {
+		t.Fatal("attachment was not attached to the published comment")
+	}
+}
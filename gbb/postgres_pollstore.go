@@ -0,0 +1,292 @@
+package gbb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/go-surf/surf/sqldb"
+	"github.com/lib/pq"
+)
+
+// NewPostgresPollStore returns a PollStore using given database. The topics
+// and users tables must already exist.
+func NewPostgresPollStore(db *sql.DB) (PollStore, error) {
+	store := &pgPollStore{
+		db: sqldb.PostgresDatabase(db),
+	}
+	return store, store.ensureSchema(context.Background())
+}
+
+type pgPollStore struct {
+	db sqldb.Database
+}
+
+func (ps *pgPollStore) ensureSchema(ctx context.Context) error {
+	const schema = `
+CREATE TABLE IF NOT EXISTS polls (
+	poll_id SERIAL PRIMARY KEY,
+	topic_id INTEGER NOT NULL UNIQUE REFERENCES topics(topic_id) ON DELETE CASCADE,
+	question TEXT NOT NULL,
+	multiple BOOLEAN NOT NULL,
+	anonymous BOOLEAN NOT NULL,
+	closes TIMESTAMPTZ,
+	created TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS poll_options (
+	option_id SERIAL PRIMARY KEY,
+	poll_id INTEGER NOT NULL REFERENCES polls(poll_id) ON DELETE CASCADE,
+	position INTEGER NOT NULL,
+	label TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS poll_options_poll_idx ON poll_options(poll_id, position);
+
+CREATE TABLE IF NOT EXISTS poll_votes (
+	poll_id INTEGER NOT NULL REFERENCES polls(poll_id) ON DELETE CASCADE,
+	option_id INTEGER NOT NULL REFERENCES poll_options(option_id) ON DELETE CASCADE,
+	user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+	created TIMESTAMPTZ NOT NULL,
+
+	PRIMARY KEY (poll_id, user_id, option_id)
+);
+
+CREATE INDEX IF NOT EXISTS poll_votes_option_idx ON poll_votes(option_id);
+`
+	for i, migration := range strings.Split(schema, `;\n\n`) {
+		_, err := ps.db.ExecContext(ctx, migration)
+		if err != nil {
+			if max := 30; len(migration) > max {
+				migration = migration[max:]
+			}
+			return fmt.Errorf("migration %d (%s): %s", i, migration, err)
+		}
+	}
+	return nil
+}
+
+func (ps *pgPollStore) CreatePoll(ctx context.Context, poll Poll) (*Poll, error) {
+	defer surf.CurrentTrace(ctx).Begin("create poll").Finish()
+
+	tx, err := ps.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot begin a transaction")
+	}
+	defer tx.Rollback()
+
+	closes := pq.NullTime{Time: poll.Closes, Valid: !poll.Closes.IsZero()}
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO polls (topic_id, question, multiple, anonymous, closes, created)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING poll_id
+	`, poll.TopicID, poll.Question, poll.Multiple, poll.Anonymous, closes, time.Now()).Scan(&poll.PollID)
+	switch {
+	case err == nil:
+		// All good.
+	case surf.ErrConstraint.Is(err):
+		return nil, errors.Wrap(ErrConstraint, "topic does not exist or already has a poll")
+	default:
+		return nil, errors.Wrap(err, "cannot insert poll")
+	}
+
+	options := make([]*PollOption, len(poll.Options))
+	for i, o := range poll.Options {
+		opt := PollOption{Label: o.Label}
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO poll_options (poll_id, position, label)
+			VALUES ($1, $2, $3)
+			RETURNING option_id
+		`, poll.PollID, i, opt.Label).Scan(&opt.OptionID)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot insert poll option")
+		}
+		options[i] = &opt
+	}
+	poll.Options = options
+
+	if err := tx.Commit(); err != nil {
+		return nil, errors.Wrap(err, "cannot commit the transaction")
+	}
+	return &poll, nil
+}
+
+func (ps *pgPollStore) PollByTopic(ctx context.Context, topicID, userID int64) (*Poll, error) {
+	p := Poll{TopicID: topicID}
+	var closes pq.NullTime
+	err := ps.db.QueryRowContext(ctx, `
+		SELECT
+			p.poll_id,
+			p.question,
+			p.multiple,
+			p.anonymous,
+			p.closes,
+			(SELECT COUNT(DISTINCT v.user_id) FROM poll_votes v WHERE v.poll_id = p.poll_id)
+		FROM polls p
+		WHERE p.topic_id = $1
+		LIMIT 1
+	`, topicID).Scan(&p.PollID, &p.Question, &p.Multiple, &p.Anonymous, &closes, &p.Voters)
+	switch {
+	case err == nil:
+		p.Closes = closes.Time
+	case surf.ErrNotFound.Is(err):
+		return nil, ErrPollNotFound
+	default:
+		return nil, errors.Wrap(err, "cannot query poll")
+	}
+
+	rows, err := ps.db.QueryContext(ctx, `
+		SELECT
+			o.option_id,
+			o.label,
+			COUNT(v.user_id),
+			COALESCE(bool_or(v.user_id = $2), false)
+		FROM
+			poll_options o
+			LEFT JOIN poll_votes v ON v.option_id = o.option_id
+		WHERE
+			o.poll_id = $1
+		GROUP BY
+			o.option_id
+		ORDER BY
+			o.position ASC
+	`, p.PollID, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query poll options")
+	}
+	defer rows.Close()
+
+	byID := make(map[int64]*PollOption)
+	for rows.Next() {
+		var o PollOption
+		if err := rows.Scan(&o.OptionID, &o.Label, &o.Votes, &o.Voted); err != nil {
+			return nil, errors.Wrap(err, "cannot scan poll option")
+		}
+		p.Options = append(p.Options, &o)
+		byID[o.OptionID] = &o
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+
+	if p.Anonymous {
+		return &p, nil
+	}
+
+	voters, err := ps.db.QueryContext(ctx, `
+		SELECT v.option_id, u.user_id, u.name
+		FROM
+			poll_votes v
+			INNER JOIN users u ON v.user_id = u.user_id
+		WHERE
+			v.poll_id = $1
+		ORDER BY
+			v.created ASC
+	`, p.PollID)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query poll voters")
+	}
+	defer voters.Close()
+
+	for voters.Next() {
+		var (
+			optionID int64
+			u        User
+		)
+		if err := voters.Scan(&optionID, &u.UserID, &u.Name); err != nil {
+			return nil, errors.Wrap(err, "cannot scan poll voter")
+		}
+		if o, ok := byID[optionID]; ok {
+			o.Users = append(o.Users, u)
+		}
+	}
+	if err := voters.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+	return &p, nil
+}
+
+func (ps *pgPollStore) Vote(ctx context.Context, pollID, userID int64, optionIDs []int64) error {
+	defer surf.CurrentTrace(ctx).Begin("poll vote").Finish()
+
+	optionIDs = uniqueInt64s(optionIDs)
+
+	tx, err := ps.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "cannot begin a transaction")
+	}
+	defer tx.Rollback()
+
+	// Lock the poll, so that concurrent votes of the same user cannot
+	// bypass the single choice check.
+	var (
+		multiple bool
+		closes   pq.NullTime
+	)
+	err = tx.QueryRowContext(ctx, `
+		SELECT multiple, closes
+		FROM polls
+		WHERE poll_id = $1
+		FOR UPDATE
+	`, pollID).Scan(&multiple, &closes)
+	switch {
+	case err == nil:
+		// All good.
+	case surf.ErrNotFound.Is(err):
+		return ErrPollNotFound
+	default:
+		return errors.Wrap(err, "cannot query poll")
+	}
+
+	if closes.Valid && !time.Now().Before(closes.Time) {
+		return errors.Wrap(ErrPermission, "poll is closed")
+	}
+	if !multiple && len(optionIDs) > 1 {
+		return errors.Wrap(ErrMalformed, "single choice poll")
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM poll_votes WHERE poll_id = $1 AND user_id = $2
+	`, pollID, userID); err != nil {
+		return errors.Wrap(err, "cannot delete previous votes")
+	}
+
+	if len(optionIDs) > 0 {
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO poll_votes (poll_id, option_id, user_id, created)
+			SELECT poll_id, option_id, $2, $4
+			FROM poll_options
+			WHERE poll_id = $1 AND option_id = ANY($3)
+		`, pollID, userID, pq.Array(optionIDs), time.Now())
+		if err != nil {
+			return errors.Wrap(err, "cannot insert votes")
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return errors.Wrap(err, "cannot get rows affected by the vote")
+		} else if n != int64(len(optionIDs)) {
+			return errors.Wrap(ErrMalformed, "option does not belong to the poll")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "cannot commit the transaction")
+	}
+	return nil
+}
+
+func uniqueInt64s(values []int64) []int64 {
+	seen := make(map[int64]struct{}, len(values))
+	unique := make([]int64, 0, len(values))
+	for _, v := range values {
+		if _, ok := seen[v]; ok {
+			continue
+		}
+		seen[v] = struct{}{}
+		unique = append(unique, v)
+	}
+	return unique
+}
@@ -0,0 +1,93 @@
+package gbb
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPollVote(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	bbStore, err := NewPostgresBBStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewPostgresPollStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ensureUser(t, db, 999, "Bobby")
+	ensureUser(t, db, 998, "Alice")
+
+	topic, _, err := bbStore.CreateTopic(ctx, "vote", "please", 1, 999)
+	if err != nil {
+		t.Fatalf("cannot create topic: %s", err)
+	}
+	poll, err := store.CreatePoll(ctx, Poll{
+		TopicID:  topic.TopicID,
+		Question: "Tabs or spaces?",
+		Options:  []*PollOption{{Label: "tabs"}, {Label: "spaces"}},
+	})
+	if err != nil {
+		t.Fatalf("cannot create poll: %s", err)
+	}
+	tabs, spaces := poll.Options[0].OptionID, poll.Options[1].OptionID
+
+	if err := store.Vote(ctx, poll.PollID, 999, []int64{tabs, spaces}); !ErrMalformed.Is(err) {
+		t.Fatalf("want ErrMalformed for multiple votes, got %+v", err)
+	}
+	if err := store.Vote(ctx, poll.PollID, 999, []int64{tabs}); err != nil {
+		t.Fatalf("cannot vote: %s", err)
+	}
+	if err := store.Vote(ctx, poll.PollID, 998, []int64{tabs}); err != nil {
+		t.Fatalf("cannot vote: %s", err)
+	}
+	// Changing the vote replaces the previous one.
+	if err := store.Vote(ctx, poll.PollID, 999, []int64{spaces}); err != nil {
+		t.Fatalf("cannot vote: %s", err)
+	}
+
+	got, err := store.PollByTopic(ctx, topic.TopicID, 999)
+	if err != nil {
+		t.Fatalf("cannot get poll: %s", err)
+	}
+	if got.Voters != 2 {
+		t.Fatalf("want 2 voters, got %d", got.Voters)
+	}
+	if o := got.Options[0]; o.Votes != 1 || o.Voted || len(o.Users) != 1 || o.Users[0].Name != "Alice" {
+		t.Fatalf("unexpected tabs result: %+v", o)
+	}
+	if o := got.Options[1]; o.Votes != 1 || !o.Voted {
+		t.Fatalf("unexpected spaces result: %+v", o)
+	}
+
+	if _, err := store.CreatePoll(ctx, Poll{TopicID: topic.TopicID, Question: "again?"}); !ErrConstraint.Is(err) {
+		t.Fatalf("want ErrConstraint for second poll, got %+v", err)
+	}
+
+	other, _, err := bbStore.CreateTopic(ctx, "closed", "too late", 1, 999)
+	if err != nil {
+		t.Fatalf("cannot create topic: %s", err)
+	}
+	closed, err := store.CreatePoll(ctx, Poll{
+		TopicID:  other.TopicID,
+		Question: "Too late?",
+		Closes:   time.Now().Add(-time.Minute),
+		Options:  []*PollOption{{Label: "yes"}, {Label: "no"}},
+	})
+	if err != nil {
+		t.Fatalf("cannot create poll: %s", err)
+	}
+	if err := store.Vote(ctx, closed.PollID, 999, []int64{closed.Options[0].OptionID}); !ErrPermission.Is(err) {
+		t.Fatalf("want ErrPermission for closed poll, got %+v", err)
+	}
+	if err := store.Vote(ctx, poll.PollID, 999, []int64{closed.Options[0].OptionID}); !ErrMalformed.Is(err) {
+		t.Fatalf("want ErrMalformed for option of another poll, got %+v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package gbb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/go-surf/surf/sqldb"
+	"github.com/lib/pq"
+)
+
+// NewPostgresReactionStore returns a ReactionStore using given database. The
+// comments and users tables must already exist.
+func NewPostgresReactionStore(db *sql.DB) (ReactionStore, error) {
+	store := &pgReactionStore{
+		db: sqldb.PostgresDatabase(db),
+	}
+	return store, store.ensureSchema(context.Background())
+}
+
+type pgReactionStore struct {
+	db sqldb.Database
+}
+
+func (rs *pgReactionStore) ensureSchema(ctx context.Context) error {
+	const schema = `
+CREATE TABLE IF NOT EXISTS reactions (
+	comment_id INTEGER NOT NULL REFERENCES comments(comment_id) ON DELETE CASCADE,
+	user_id INTEGER NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+	reaction TEXT NOT NULL,
+	created TIMESTAMPTZ NOT NULL DEFAULT now(),
+
+	PRIMARY KEY (comment_id, user_id, reaction)
+);
+
+CREATE OR REPLACE FUNCTION update_reputation_on_reaction()
+RETURNS trigger AS $$
+BEGIN
+	-- Reacting to own comment does not change the reputation.
+	IF TG_OP = 'INSERT' THEN
+		UPDATE users SET reputation = reputation + 1
+			FROM comments c
+			WHERE c.comment_id = NEW.comment_id
+				AND c.author_id <> NEW.user_id
+				AND users.user_id = c.author_id;
+	ELSE
+		UPDATE users SET reputation = reputation - 1
+			FROM comments c
+			WHERE c.comment_id = OLD.comment_id
+				AND c.author_id <> OLD.user_id
+				AND users.user_id = c.author_id;
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS update_reputation_on_reaction ON reactions;
+
+CREATE TRIGGER update_reputation_on_reaction
+	AFTER INSERT OR DELETE ON reactions
+	FOR EACH ROW EXECUTE PROCEDURE update_reputation_on_reaction();
+
+-- Reactions of a deleted comment are removed after the comment is gone, when
+-- its author can no longer be found. Reputation must be taken back before.
+CREATE OR REPLACE FUNCTION update_reputation_on_reacted_comment_delete()
+RETURNS trigger AS $$
+BEGIN
+	UPDATE users SET reputation = reputation - (
+		SELECT COUNT(*) FROM reactions r
+		WHERE r.comment_id = OLD.comment_id AND r.user_id <> OLD.author_id
+	)
+	WHERE user_id = OLD.author_id;
+	RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS update_reputation_on_reacted_comment_delete ON comments;
+
+CREATE TRIGGER update_reputation_on_reacted_comment_delete
+	BEFORE DELETE ON comments
+	FOR EACH ROW EXECUTE PROCEDURE update_reputation_on_reacted_comment_delete();
+`
+	for i, migration := range strings.Split(schema, `;\n\n`) {
+		_, err := rs.db.ExecContext(ctx, migration)
+		if err != nil {
+			if max := 30; len(migration) > max {
+				migration = migration[max:]
+			}
+			return fmt.Errorf("migration %d (%s): %s", i, migration, err)
+		}
+	}
+	return nil
+}
+
+func (rs *pgReactionStore) ToggleReaction(ctx context.Context, commentID, userID int64, reaction string) (bool, error) {
+	tx, err := rs.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, errors.Wrap(err, "cannot begin a transaction")
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		DELETE FROM reactions
+		WHERE comment_id = $1 AND user_id = $2 AND reaction = $3
+	`, commentID, userID, reaction)
+	if err != nil {
+		return false, errors.Wrap(err, "cannot delete reaction")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return false, errors.Wrap(err, "cannot get affected rows")
+	} else if n == 1 {
+		if err := tx.Commit(); err != nil {
+			return false, errors.Wrap(err, "cannot commit the transaction")
+		}
+		return false, nil
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO reactions (comment_id, user_id, reaction)
+		VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING
+	`, commentID, userID, reaction)
+	switch {
+	case err == nil:
+		// All good.
+	case surf.ErrConstraint.Is(err):
+		return false, ErrCommentNotFound
+	default:
+		return false, errors.Wrap(err, "cannot insert reaction")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, errors.Wrap(err, "cannot commit the transaction")
+	}
+	return true, nil
+}
+
+func (rs *pgReactionStore) ListReactions(ctx context.Context, commentIDs []int64) (map[int64][]*Reaction, error) {
+	results := make(map[int64][]*Reaction)
+	if len(commentIDs) == 0 {
+		return results, nil
+	}
+
+	rows, err := rs.db.QueryContext(ctx, `
+		SELECT
+			r.comment_id,
+			r.reaction,
+			array_agg(u.user_id ORDER BY r.created),
+			array_agg(u.name ORDER BY r.created)
+		FROM
+			reactions r
+			INNER JOIN users u ON r.user_id = u.user_id
+		WHERE
+			r.comment_id = ANY($1)
+		GROUP BY
+			r.comment_id, r.reaction
+		ORDER BY
+			r.comment_id, MIN(r.created)
+	`, pq.Array(commentIDs))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query reactions")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			r     Reaction
+			ids   []int64
+			names []string
+		)
+		if err := rows.Scan(&r.CommentID, &r.Reaction, pq.Array(&ids), pq.Array(&names)); err != nil {
+			return nil, errors.Wrap(err, "cannot scan reaction row")
+		}
+		r.Users = make([]User, len(ids))
+		for i := range ids {
+			r.Users[i] = User{UserID: ids[i], Name: names[i]}
+		}
+		results[r.CommentID] = append(results[r.CommentID], &r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner failed")
+	}
+	return results, nil
+}
@@ -0,0 +1,67 @@
+package gbb
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestToggleReaction(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	bbStore, err := NewPostgresBBStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewPostgresReactionStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ensureUser(t, db, 999, "Bobby")
+	ensureUser(t, db, 998, "Alice")
+
+	_, comment, err := bbStore.CreateTopic(ctx, "first", "IMO", 1, 999)
+	if err != nil {
+		t.Fatalf("cannot create topic: %s", err)
+	}
+
+	toggle := func(userID int64, reaction string, wantAdded bool) {
+		t.Helper()
+		added, err := store.ToggleReaction(ctx, comment.CommentID, userID, reaction)
+		if err != nil {
+			t.Fatalf("cannot toggle reaction: %s", err)
+		}
+		if added != wantAdded {
+			t.Fatalf("want added=%v, got %v", wantAdded, added)
+		}
+	}
+
+	toggle(999, "+1", true)
+	toggle(998, "+1", true)
+	toggle(998, "-1", true)
+	toggle(998, "-1", false)
+
+	reactions, err := store.ListReactions(ctx, []int64{comment.CommentID, comment.CommentID + 1})
+	if err != nil {
+		t.Fatalf("cannot list reactions: %s", err)
+	}
+	if len(reactions) != 1 {
+		t.Fatalf("want reactions of one comment, got %d", len(reactions))
+	}
+	got := reactions[comment.CommentID]
+	if len(got) != 1 || got[0].Reaction != "+1" {
+		t.Fatalf("want only +1 reaction, got %+v", got)
+	}
+	if users := got[0].Users; len(users) != 2 || users[0].Name != "Bobby" || users[1].Name != "Alice" {
+		t.Fatalf("unexpected users: %+v", users)
+	}
+
+	if _, err := store.ToggleReaction(ctx, comment.CommentID+1, 999, "+1"); !ErrCommentNotFound.Is(err) {
+		t.Fatalf("want ErrCommentNotFound, got %+v", err)
+	}
+}
@@ -156,3 +156,36 @@ func (rpt *pgReadProgressTracker) MarkAllRead(ctx context.Context, userID int64,
 	}
 	return nil
 }
+
+func (rpt *pgReadProgressTracker) ExportReadProgress(ctx context.Context, after ReadProgress, limit int) ([]*ReadProgress, error) {
+	rows, err := rpt.db.QueryContext(ctx, `
+		SELECT user_id, topic_id, comment_id, comment_created
+		FROM (
+			SELECT user_id, 0 AS topic_id, 0 AS comment_id, created AS comment_created
+			FROM readprogressall
+			UNION ALL
+			SELECT user_id, topic_id, comment_id, comment_created
+			FROM readprogress
+		) p
+		WHERE (user_id, topic_id) > ($1, $2)
+		ORDER BY user_id, topic_id
+		LIMIT $3
+	`, after.UserID, after.TopicID, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query readprogress")
+	}
+	defer rows.Close()
+
+	var progress []*ReadProgress
+	for rows.Next() {
+		var p ReadProgress
+		if err := rows.Scan(&p.UserID, &p.TopicID, &p.CommentID, &p.CommentCreated); err != nil {
+			return nil, errors.Wrap(err, "scan readprogress")
+		}
+		progress = append(progress, &p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "readprogress rows")
+	}
+	return progress, nil
+}
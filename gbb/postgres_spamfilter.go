@@ -0,0 +1,122 @@
+package gbb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/go-surf/surf/sqldb"
+	"github.com/lib/pq"
+)
+
+// NewPostgresSpamFilter returns a Bayesian SpamFilter that keeps token
+// statistics in given database. Content is classified as spam when its spam
+// probability is at least threshold. Until the filter is trained with at
+// least minTrained spam and minTrained ham documents, nothing is classified as
+// spam.
+func NewPostgresSpamFilter(db *sql.DB, threshold float64, minTrained int64) (SpamFilter, error) {
+	filter := &pgSpamFilter{
+		db:         sqldb.PostgresDatabase(db),
+		threshold:  threshold,
+		minTrained: minTrained,
+	}
+	return filter, filter.ensureSchema(context.Background())
+}
+
+type pgSpamFilter struct {
+	db         sqldb.Database
+	threshold  float64
+	minTrained int64
+}
+
+func (sf *pgSpamFilter) ensureSchema(ctx context.Context) error {
+	// Document counts are kept as a token with an empty name.
+	const schema = `
+CREATE TABLE IF NOT EXISTS spam_tokens (
+	token TEXT PRIMARY KEY,
+	spam INTEGER NOT NULL DEFAULT 0,
+	ham INTEGER NOT NULL DEFAULT 0
+);
+`
+	for i, migration := range strings.Split(schema, `;\n\n`) {
+		_, err := sf.db.ExecContext(ctx, migration)
+		if err != nil {
+			if max := 30; len(migration) > max {
+				migration = migration[max:]
+			}
+			return fmt.Errorf("migration %d (%s): %s", i, migration, err)
+		}
+	}
+	return nil
+}
+
+func (sf *pgSpamFilter) Train(ctx context.Context, content string, spam bool) error {
+	defer surf.CurrentTrace(ctx).Begin("train spam filter").Finish()
+
+	var spamInc, hamInc int
+	if spam {
+		spamInc = 1
+	} else {
+		hamInc = 1
+	}
+
+	// Empty token counts trained documents.
+	tokens := append(spamTokens(content), "")
+	_, err := sf.db.ExecContext(ctx, `
+		INSERT INTO spam_tokens (token, spam, ham)
+		SELECT token, $2, $3 FROM unnest($1::TEXT[]) AS token
+		ON CONFLICT (token) DO UPDATE
+		SET spam = spam_tokens.spam + EXCLUDED.spam, ham = spam_tokens.ham + EXCLUDED.ham
+	`, pq.Array(tokens), spamInc, hamInc)
+	if err != nil {
+		return errors.Wrap(err, "cannot update tokens")
+	}
+	return nil
+}
+
+func (sf *pgSpamFilter) Classify(ctx context.Context, content string) (string, error) {
+	defer surf.CurrentTrace(ctx).Begin("classify spam").Finish()
+
+	tokens := append(spamTokens(content), "")
+	rows, err := sf.db.QueryContext(ctx, `
+		SELECT token, spam, ham FROM spam_tokens
+		WHERE token = ANY($1)
+	`, pq.Array(tokens))
+	if err != nil {
+		return "", errors.Wrap(err, "cannot query tokens")
+	}
+	defer rows.Close()
+
+	var (
+		counts            []tokenCount
+		spamDocs, hamDocs int64
+	)
+	for rows.Next() {
+		var (
+			token string
+			c     tokenCount
+		)
+		if err := rows.Scan(&token, &c.Spam, &c.Ham); err != nil {
+			return "", errors.Wrap(err, "cannot scan token")
+		}
+		if token == "" {
+			spamDocs, hamDocs = c.Spam, c.Ham
+		} else {
+			counts = append(counts, c)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", errors.Wrap(err, "scanner failed")
+	}
+
+	if spamDocs < sf.minTrained || hamDocs < sf.minTrained {
+		return "", nil
+	}
+	if p := spamProbability(counts, spamDocs, hamDocs); p >= sf.threshold {
+		return fmt.Sprintf("spam probability %.2f", p), nil
+	}
+	return "", nil
+}
@@ -0,0 +1,48 @@
+package gbb
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSpamFilter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	filter, err := NewPostgresSpamFilter(db, 0.9, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spam := "Buy cheap pills at https://pills.example.com today"
+	ham := "I think the second answer explains the problem better"
+
+	if err := filter.Train(ctx, spam, true); err != nil {
+		t.Fatalf("cannot train: %s", err)
+	}
+	if err := filter.Train(ctx, ham, false); err != nil {
+		t.Fatalf("cannot train: %s", err)
+	}
+	// Not enough documents to classify yet.
+	if reason, err := filter.Classify(ctx, spam); err != nil || reason != "" {
+		t.Fatalf("want no classification, got %q, %v", reason, err)
+	}
+
+	if err := filter.Train(ctx, "Cheap pills, best prices https://pills.example.com", true); err != nil {
+		t.Fatalf("cannot train: %s", err)
+	}
+	if err := filter.Train(ctx, "Thanks, the answer solved my problem", false); err != nil {
+		t.Fatalf("cannot train: %s", err)
+	}
+
+	if reason, err := filter.Classify(ctx, "Cheap pills https://pills.example.com"); err != nil || reason == "" {
+		t.Fatalf("want spam, got %q, %v", reason, err)
+	}
+	if reason, err := filter.Classify(ctx, "The answer explains the problem"); err != nil || reason != "" {
+		t.Fatalf("want ham, got %q, %v", reason, err)
+	}
+}
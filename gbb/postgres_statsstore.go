@@ -0,0 +1,38 @@
+package gbb
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/go-surf/surf/sqldb"
+)
+
+// NewPostgresStatsStore returns a StatsStore using given database. The
+// tables of the bb store must already exist.
+func NewPostgresStatsStore(db *sql.DB) StatsStore {
+	return &pgStatsStore{
+		db: sqldb.PostgresDatabase(db),
+	}
+}
+
+type pgStatsStore struct {
+	db sqldb.Database
+}
+
+func (s *pgStatsStore) ForumStats(ctx context.Context) (*ForumStats, error) {
+	defer surf.CurrentTrace(ctx).Begin("forum stats").Finish()
+
+	var stats ForumStats
+	err := s.db.QueryRowContext(ctx, `
+		SELECT
+			(SELECT COUNT(*) FROM topics),
+			(SELECT COUNT(*) FROM comments),
+			(SELECT COUNT(*) FROM users)
+	`).Scan(&stats.Topics, &stats.Comments, &stats.Users)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot count records")
+	}
+	return &stats, nil
+}
@@ -0,0 +1,40 @@
+package gbb
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStatsStore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	bbStore, err := NewPostgresBBStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewPostgresStatsStore(db)
+
+	ensureUser(t, db, 999, "Bobby")
+	ensureUser(t, db, 998, "Alice")
+
+	topic, _, err := bbStore.CreateTopic(ctx, "first", "IMO", 1, 999)
+	if err != nil {
+		t.Fatalf("cannot create topic: %s", err)
+	}
+	if _, err := bbStore.CreateComment(ctx, topic.TopicID, "reply", 998); err != nil {
+		t.Fatalf("cannot create comment: %s", err)
+	}
+
+	stats, err := store.ForumStats(ctx)
+	if err != nil {
+		t.Fatalf("cannot get stats: %s", err)
+	}
+	if want := (ForumStats{Topics: 1, Comments: 2, Users: 2}); *stats != want {
+		t.Fatalf("want %+v, got %+v", want, *stats)
+	}
+}
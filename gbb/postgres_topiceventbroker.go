@@ -0,0 +1,54 @@
+package gbb
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-surf/surf/errors"
+	"github.com/lib/pq"
+)
+
+// topicEventsChannel is the PostgreSQL notification channel used by the
+// comment insert trigger to announce new comments.
+const topicEventsChannel = "topic_events"
+
+// NewPostgresTopicEventBroker returns a broker that is receiving topic events
+// using PostgreSQL LISTEN/NOTIFY. Notifications are sent by the database, so
+// all application instances using the same database receive the same events.
+//
+// Broker is running until given context is done.
+func NewPostgresTopicEventBroker(ctx context.Context, databaseURL string) (TopicEventBroker, error) {
+	listener := pq.NewListener(databaseURL, time.Second, time.Minute, nil)
+	if err := listener.Listen(topicEventsChannel); err != nil {
+		listener.Close()
+		return nil, errors.Wrap(err, "cannot listen on %s", topicEventsChannel)
+	}
+
+	hub := newTopicEventHub()
+	go func() {
+		defer listener.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(90 * time.Second):
+				// Make sure the connection is still alive.
+				go listener.Ping()
+			case n := <-listener.Notify:
+				if n == nil {
+					// Connection was re-established. Events
+					// sent in between are lost.
+					continue
+				}
+				var ev TopicEvent
+				if err := json.Unmarshal([]byte(n.Extra), &ev); err != nil {
+					continue
+				}
+				hub.Publish(ev)
+			}
+		}
+	}()
+	return hub, nil
+}
@@ -0,0 +1,200 @@
+package gbb
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-surf/surf"
+	"github.com/go-surf/surf/errors"
+	"github.com/go-surf/surf/sqldb"
+)
+
+// NewPostgresTwoFactorStore returns a TwoFactorStore using given database. The
+// users table must already exist.
+func NewPostgresTwoFactorStore(db *sql.DB) (TwoFactorStore, error) {
+	store := &pgTwoFactorStore{
+		db: sqldb.PostgresDatabase(db),
+	}
+	return store, store.ensureSchema(context.Background())
+}
+
+type pgTwoFactorStore struct {
+	db sqldb.Database
+}
+
+func (ts *pgTwoFactorStore) ensureSchema(ctx context.Context) error {
+	// Policy table always contains exactly one row.
+	const schema = `
+CREATE TABLE IF NOT EXISTS two_factor_secrets (
+	user_id INTEGER PRIMARY KEY REFERENCES users(user_id) ON DELETE CASCADE,
+	secret TEXT NOT NULL,
+	last_step BIGINT NOT NULL DEFAULT 0,
+	created TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS two_factor_recovery_codes (
+	user_id INTEGER NOT NULL REFERENCES two_factor_secrets(user_id) ON DELETE CASCADE,
+	code_hash TEXT NOT NULL,
+	PRIMARY KEY (user_id, code_hash)
+);
+
+CREATE TABLE IF NOT EXISTS two_factor_policy (
+	policy_id INTEGER PRIMARY KEY CHECK (policy_id = 1),
+	required BOOLEAN NOT NULL
+);
+
+INSERT INTO two_factor_policy (policy_id, required) VALUES (1, false)
+	ON CONFLICT DO NOTHING;
+`
+	for i, migration := range strings.Split(schema, `;\n\n`) {
+		_, err := ts.db.ExecContext(ctx, migration)
+		if err != nil {
+			if max := 30; len(migration) > max {
+				migration = migration[max:]
+			}
+			return fmt.Errorf("migration %d (%s): %s", i, migration, err)
+		}
+	}
+	return nil
+}
+
+// recoveryCodeHash returns the value stored instead of the recovery code.
+// Recovery codes are random, so a fast hash is good enough.
+func recoveryCodeHash(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func (ts *pgTwoFactorStore) EnableTwoFactor(ctx context.Context, userID int64, secret string, recoveryCodes []string) error {
+	tx, err := ts.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "cannot begin the transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO two_factor_secrets (user_id, secret, created)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, last_step = 0, created = EXCLUDED.created
+	`, userID, secret, time.Now())
+	switch {
+	case err == nil:
+		// All good.
+	case surf.ErrConstraint.Is(err):
+		return ErrUserNotFound
+	default:
+		return errors.Wrap(err, "cannot upsert secret")
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM two_factor_recovery_codes WHERE user_id = $1
+	`, userID); err != nil {
+		return errors.Wrap(err, "cannot delete recovery codes")
+	}
+	for _, code := range recoveryCodes {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO two_factor_recovery_codes (user_id, code_hash)
+			VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`, userID, recoveryCodeHash(code)); err != nil {
+			return errors.Wrap(err, "cannot insert recovery code")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "cannot commit the transaction")
+	}
+	return nil
+}
+
+func (ts *pgTwoFactorStore) DisableTwoFactor(ctx context.Context, userID int64) error {
+	// Recovery codes are removed by the cascade.
+	if _, err := ts.db.ExecContext(ctx, `
+		DELETE FROM two_factor_secrets WHERE user_id = $1
+	`, userID); err != nil {
+		return errors.Wrap(err, "cannot delete secret")
+	}
+	return nil
+}
+
+func (ts *pgTwoFactorStore) TwoFactorSecret(ctx context.Context, userID int64) (string, error) {
+	var secret string
+	err := ts.db.QueryRowContext(ctx, `
+		SELECT secret FROM two_factor_secrets WHERE user_id = $1 LIMIT 1
+	`, userID).Scan(&secret)
+	switch {
+	case err == nil:
+		return secret, nil
+	case surf.ErrNotFound.Is(err):
+		return "", ErrTwoFactorNotFound
+	default:
+		return "", errors.Wrap(err, "cannot fetch secret")
+	}
+}
+
+func (ts *pgTwoFactorStore) UseTimeStep(ctx context.Context, userID, step int64) error {
+	res, err := ts.db.ExecContext(ctx, `
+		UPDATE two_factor_secrets SET last_step = $2
+		WHERE user_id = $1 AND last_step < $2
+	`, userID, step)
+	if err != nil {
+		return errors.Wrap(err, "cannot update last step")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "cannot get affected rows")
+	} else if n == 0 {
+		return errors.Wrap(ErrPermission, "time step already used")
+	}
+	return nil
+}
+
+func (ts *pgTwoFactorStore) UseRecoveryCode(ctx context.Context, userID int64, code string) error {
+	res, err := ts.db.ExecContext(ctx, `
+		DELETE FROM two_factor_recovery_codes
+		WHERE user_id = $1 AND code_hash = $2
+	`, userID, recoveryCodeHash(code))
+	if err != nil {
+		return errors.Wrap(err, "cannot delete recovery code")
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "cannot get affected rows")
+	} else if n == 0 {
+		return errors.Wrap(ErrPermission, "invalid recovery code")
+	}
+	return nil
+}
+
+func (ts *pgTwoFactorStore) CountRecoveryCodes(ctx context.Context, userID int64) (int64, error) {
+	var n int64
+	if err := ts.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM two_factor_recovery_codes WHERE user_id = $1
+	`, userID).Scan(&n); err != nil {
+		return 0, errors.Wrap(err, "cannot count recovery codes")
+	}
+	return n, nil
+}
+
+func (ts *pgTwoFactorStore) TwoFactorRequired(ctx context.Context) (bool, error) {
+	var required bool
+	if err := ts.db.QueryRowContext(ctx, `
+		SELECT required FROM two_factor_policy WHERE policy_id = 1
+	`).Scan(&required); err != nil {
+		return false, errors.Wrap(err, "cannot fetch policy")
+	}
+	return required, nil
+}
+
+func (ts *pgTwoFactorStore) SetTwoFactorRequired(ctx context.Context, required bool) error {
+	if _, err := ts.db.ExecContext(ctx, `
+		UPDATE two_factor_policy SET required = $1 WHERE policy_id = 1
+	`, required); err != nil {
+		return errors.Wrap(err, "cannot update policy")
+	}
+	return nil
+}
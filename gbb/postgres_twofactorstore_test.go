@@ -0,0 +1,82 @@
+package gbb
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTwoFactorStore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := createDatabase(t)
+	defer db.Close()
+
+	if _, err := NewPostgresBBStore(db); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewPostgresTwoFactorStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ensureUser(t, db, 999, "Bobby")
+
+	if _, err := store.TwoFactorSecret(ctx, 999); !ErrTwoFactorNotFound.Is(err) {
+		t.Fatalf("want ErrTwoFactorNotFound, got %+v", err)
+	}
+
+	codes, err := generateRecoveryCodes(3)
+	if err != nil {
+		t.Fatalf("cannot generate recovery codes: %s", err)
+	}
+	if err := store.EnableTwoFactor(ctx, 999, "SECRET", codes); err != nil {
+		t.Fatalf("cannot enable two factor: %s", err)
+	}
+	if secret, err := store.TwoFactorSecret(ctx, 999); err != nil || secret != "SECRET" {
+		t.Fatalf("want secret, got %q, %v", secret, err)
+	}
+
+	if err := store.UseTimeStep(ctx, 999, 100); err != nil {
+		t.Fatalf("cannot use time step: %s", err)
+	}
+	for _, step := range []int64{100, 99} {
+		if err := store.UseTimeStep(ctx, 999, step); !ErrPermission.Is(err) {
+			t.Fatalf("step %d: want ErrPermission, got %+v", step, err)
+		}
+	}
+
+	// Codes typed by users are normalized before use.
+	typed := strings.ToUpper(strings.Replace(codes[0], "-", "", 1))
+	if err := store.UseRecoveryCode(ctx, 999, normalizeRecoveryCode(typed)); err != nil {
+		t.Fatalf("cannot use recovery code: %s", err)
+	}
+	if err := store.UseRecoveryCode(ctx, 999, codes[0]); !ErrPermission.Is(err) {
+		t.Fatalf("want ErrPermission, got %+v", err)
+	}
+	if n, err := store.CountRecoveryCodes(ctx, 999); err != nil || n != 2 {
+		t.Fatalf("want 2 recovery codes, got %d, %v", n, err)
+	}
+
+	if err := store.DisableTwoFactor(ctx, 999); err != nil {
+		t.Fatalf("cannot disable two factor: %s", err)
+	}
+	if _, err := store.TwoFactorSecret(ctx, 999); !ErrTwoFactorNotFound.Is(err) {
+		t.Fatalf("want ErrTwoFactorNotFound, got %+v", err)
+	}
+	if n, err := store.CountRecoveryCodes(ctx, 999); err != nil || n != 0 {
+		t.Fatalf("want no recovery codes, got %d, %v", n, err)
+	}
+
+	if required, err := store.TwoFactorRequired(ctx); err != nil || required {
+		t.Fatalf("want two factor optional by default, got %v, %v", required, err)
+	}
+	if err := store.SetTwoFactorRequired(ctx, true); err != nil {
+		t.Fatalf("cannot change policy: %s", err)
+	}
+	if required, err := store.TwoFactorRequired(ctx); err != nil || !required {
+		t.Fatalf("want two factor required, got %v, %v", required, err)
+	}
+}
@@ -98,6 +98,25 @@ pre                      { background: #F8F9F3; border: 1px solid #EEEEDE; borde
 .comment                 { padding: 10px; margin: 20px 0; }
 .comment-content         { padding-left: 20px; }
 .comment-content img     { max-width: 400px; max-height: 400px; margin: auto; }
+.comment-reactions       { padding-left: 20px; font-size: 90%; }
+.reaction                { background: none; border: 1px solid #ddd; border-radius: 3px; padding: 1px 6px; margin-right: 4px; cursor: pointer; }
+.reaction.reacted        { background: #E8F2FA; border-color: #4A9AD0; }
+.comment-replies         { padding-left: 20px; color: #888; }
+.comment-attachments     { padding-left: 20px; margin: 6px 0; }
+.comment-attachments img { border: 1px solid #ddd; margin-right: 6px; vertical-align: middle; }
+.attachment              { margin-right: 6px; }
+.reputation              { color: #888; padding-left: 4px; }
+.accepted                { color: #2E8B57; }
+form.inline              { display: inline; }
+.poll                    { padding: 10px 20px; margin: 20px 0; border: 1px solid #ddd; border-radius: 3px; }
+.poll-option             { margin: 8px 0; }
+.poll-bar                { height: 4px; background: #4A9AD0; }
+button.link              { background: none; border: none; padding: 0; color: blue; cursor: pointer; font-size: inherit; }
+.draft                   { margin: 20px 0; }
+.draft-content           { padding-left: 20px; white-space: pre-wrap; color: #444; max-height: 120px; overflow: hidden; }
+.resolution              { margin: 20px 0; }
+.reports                 { margin: 10px 0; color: #444; }
+#draft-status            { color: #888; padding-left: 10px; }
 
 ul.errors                { background: #FFF1F1; padding: 10px; }
 ul.errors li             { list-style-type: none; margin: 10px; }
@@ -0,0 +1,107 @@
+package gbb
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimiter allows at most limit actions per key within a sliding window.
+// State is kept in memory, so limits apply to a single process only.
+//
+// A nil RateLimiter allows everything.
+type RateLimiter struct {
+	limit  int
+	window time.Duration
+	now    func() time.Time
+
+	mu        sync.Mutex
+	actions   map[string][]time.Time
+	lastPurge time.Time
+}
+
+// NewRateLimiter returns a RateLimiter that allows limit actions per key
+// within given window. When limit is not positive, nil is returned and no
+// limit is enforced.
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		limit:   limit,
+		window:  window,
+		now:     time.Now,
+		actions: make(map[string][]time.Time),
+	}
+}
+
+// Allow registers an action for given key and returns true if the limit was
+// not exceeded. Rejected actions are not registered.
+func (rl *RateLimiter) Allow(key string) bool {
+	return rl.take(key, true)
+}
+
+// Check returns true if an action for given key would be allowed, without
+// registering it.
+func (rl *RateLimiter) Check(key string) bool {
+	return rl.take(key, false)
+}
+
+func (rl *RateLimiter) take(key string, register bool) bool {
+	if rl == nil {
+		return true
+	}
+
+	now := rl.now()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.lastPurge) >= rl.window {
+		for k, times := range rl.actions {
+			if now.Sub(times[len(times)-1]) >= rl.window {
+				delete(rl.actions, k)
+			}
+		}
+		rl.lastPurge = now
+	}
+
+	times := rl.actions[key]
+	for len(times) > 0 && now.Sub(times[0]) >= rl.window {
+		times = times[1:]
+	}
+	if len(times) >= rl.limit {
+		rl.actions[key] = times
+		return false
+	}
+	if register {
+		rl.actions[key] = append(times, now)
+	}
+	return true
+}
+
+// allowUserAction returns true if neither the user nor the client address
+// exceeded given limits. Moderators are not limited. Action is registered by
+// both limiters only if both allow it.
+func allowUserAction(r *http.Request, user *User, perUser, perIP *RateLimiter) bool {
+	if user.Scopes.HasAny(adminScope, moderatorScope) {
+		return true
+	}
+	userKey := "user:" + strconv.FormatInt(user.UserID, 10)
+	ipKey := "ip:" + remoteIP(r)
+	if !perUser.Check(userKey) || !perIP.Check(ipKey) {
+		return false
+	}
+	return perUser.Allow(userKey) && perIP.Allow(ipKey)
+}
+
+// remoteIP returns the address of the client that made the request.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,87 @@
+package gbb
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := NewRateLimiter(2, time.Minute)
+
+	now := time.Now()
+	rl.now = func() time.Time { return now }
+
+	if !rl.Allow("a") || !rl.Allow("a") {
+		t.Fatal("want first two actions allowed")
+	}
+	if rl.Allow("a") {
+		t.Fatal("want third action rejected")
+	}
+	if !rl.Allow("b") {
+		t.Fatal("want another key allowed")
+	}
+
+	now = now.Add(30 * time.Second)
+	if rl.Allow("a") {
+		t.Fatal("want action rejected within the window")
+	}
+
+	now = now.Add(31 * time.Second)
+	if !rl.Allow("a") {
+		t.Fatal("want action allowed after the window passed")
+	}
+	if _, ok := rl.actions["b"]; ok {
+		t.Fatal("want expired key purged")
+	}
+
+	var unlimited *RateLimiter
+	if !unlimited.Allow("a") {
+		t.Fatal("want nil limiter to allow everything")
+	}
+	if NewRateLimiter(0, time.Minute) != nil {
+		t.Fatal("want nil limiter for no limit")
+	}
+}
+
+func TestAllowUserAction(t *testing.T) {
+	perUser := NewRateLimiter(1, time.Minute)
+	perIP := NewRateLimiter(2, time.Minute)
+
+	r := httptest.NewRequest("POST", "/t/1/", nil)
+	r.RemoteAddr = "10.0.0.1:4321"
+
+	bob := &User{UserID: 1}
+	alice := &User{UserID: 2}
+	eve := &User{UserID: 3}
+	moderator := &User{UserID: 4, Scopes: moderatorScope}
+
+	if !allowUserAction(r, bob, perUser, perIP) {
+		t.Fatal("want first action allowed")
+	}
+	if allowUserAction(r, bob, perUser, perIP) {
+		t.Fatal("want user limited")
+	}
+	if !allowUserAction(r, alice, perUser, perIP) {
+		t.Fatal("want another user allowed")
+	}
+	if allowUserAction(r, eve, perUser, perIP) {
+		t.Fatal("want address limited")
+	}
+	if !allowUserAction(r, moderator, perUser, perIP) {
+		t.Fatal("want moderator not limited")
+	}
+
+	// Action rejected by one limit is not counted by the other.
+	other := httptest.NewRequest("POST", "/t/1/", nil)
+	other.RemoteAddr = "10.0.0.2:4321"
+	if !allowUserAction(other, eve, perUser, perIP) {
+		t.Fatal("want user rejected by the address limit allowed from another address")
+	}
+	if allowUserAction(other, eve, perUser, perIP) {
+		t.Fatal("want user limited")
+	}
+	if !allowUserAction(other, &User{UserID: 5}, perUser, perIP) {
+		t.Fatal("want address of user rejected by the user limit allowed")
+	}
+}
@@ -0,0 +1,55 @@
+package gbb
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/husio/gbb/markdown"
+)
+
+// commentReferencePattern matches the #c123 syntax. Because there is no look
+// behind, the character preceding the reference is part of the match.
+var commentReferencePattern = regexp.MustCompile(`(^|[^\w/#&])#c(\d+)\b`)
+
+// maxCommentReferences limits how many comments a single comment can
+// reference.
+const maxCommentReferences = 20
+
+// CommentReferencePlugin returns a markdown plugin that renders #c123 as a link
+// to the comment.
+func CommentReferencePlugin() markdown.Plugin {
+	return markdown.NewPlugin(commentReferencePattern, func(m []string) (string, bool) {
+		return fmt.Sprintf(`%s<a href="/c/%s/" class="comment-ref">#c%s</a>`,
+			html.EscapeString(m[1]), m[2], m[2]), true
+	})
+}
+
+// commentReferences returns IDs of all comments referenced by given markdown
+// content. References inside of code and links are ignored, the same way
+// they are not rendered as links.
+func commentReferences(content string) []int64 {
+	var ids []int64
+	collect := markdown.NewPlugin(commentReferencePattern, func(m []string) (string, bool) {
+		if id, err := strconv.ParseInt(m[2], 10, 64); err == nil && len(ids) < maxCommentReferences {
+			ids = append(ids, id)
+		}
+		return "", false
+	})
+	markdown.NewRenderer(collect).Render(content)
+	return uniqueInt64s(ids)
+}
+
+// quoteComment returns markdown of the comment content quoted and attributed
+// to the author, ready to be replied to.
+func quoteComment(c *Comment) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "> [@%s](/u/%d/) wrote in #c%d:\n>\n", c.Author.Name, c.Author.UserID, c.CommentID)
+	for _, line := range strings.Split(strings.TrimSpace(c.Content), "\n") {
+		b.WriteString(strings.TrimRight("> "+line, " \r") + "\n")
+	}
+	b.WriteString("\n")
+	return b.String()
+}
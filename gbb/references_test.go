@@ -0,0 +1,65 @@
+package gbb
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/husio/gbb/markdown"
+)
+
+func TestCommentReferences(t *testing.T) {
+	cases := map[string]struct {
+		content string
+		want    []int64
+	}{
+		"no references": {
+			content: "just text",
+			want:    nil,
+		},
+		"references": {
+			content: "#c1 see (#c2), #c1 and #c33.",
+			want:    []int64{1, 2, 33},
+		},
+		"not a reference": {
+			content: "abc#c1 /t/#c2 #c3x &#c4",
+			want:    nil,
+		},
+		"code and links are ignored": {
+			content: "`#c1` [#c2](/c/2/)\n\n    #c3\n\n#c4",
+			want:    []int64{4},
+		},
+	}
+
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			got := commentReferences(tc.content)
+			if len(got) == 0 && len(tc.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("want %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCommentReferencePlugin(t *testing.T) {
+	got := string(markdown.NewRenderer(CommentReferencePlugin()).Render("see (#c3) & a#c4"))
+	want := `<p>see (<a href="/c/3/" class="comment-ref">#c3</a>) &amp; a#c4</p>`
+	if strings.TrimSpace(got) != want {
+		t.Fatalf("want %s, got %s", want, got)
+	}
+}
+
+func TestQuoteComment(t *testing.T) {
+	c := &Comment{
+		CommentID: 42,
+		Content:   "first line\n\nsecond line  \n",
+		Author:    User{UserID: 7, Name: "bob"},
+	}
+	want := "> [@bob](/u/7/) wrote in #c42:\n>\n> first line\n>\n> second line\n\n"
+	if got := quoteComment(c); got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,212 @@
+package gbb
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/go-surf/surf"
+)
+
+// ContentClassifier decides if the content written by a user is unwanted.
+// Classified content is not rejected, but held for moderator approval.
+type ContentClassifier interface {
+	// Classify returns a non empty reason if the content is likely spam
+	// or abuse.
+	Classify(ctx context.Context, content string) (reason string, err error)
+}
+
+// ClassifierChain is a ContentClassifier that asks all classifiers in order
+// and returns the first reason given. Failing classifiers are skipped, so
+// that posting is not blocked by a broken classifier.
+type ClassifierChain []ContentClassifier
+
+func (chain ClassifierChain) Classify(ctx context.Context, content string) (string, error) {
+	var firstErr error
+	for _, c := range chain {
+		reason, err := c.Classify(ctx, content)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if reason != "" {
+			return reason, nil
+		}
+	}
+	return "", firstErr
+}
+
+// HeuristicClassifier flags content with too many links or containing any of
+// the forbidden keywords.
+type HeuristicClassifier struct {
+	// MaxLinks is the number of links allowed in a single post. Zero
+	// means no limit.
+	MaxLinks int
+	// Keywords are case insensitive phrases that are not allowed.
+	Keywords []string
+}
+
+var linkRx = regexp.MustCompile(`(?i)\b(?:https?://|www\.)`)
+
+func (h *HeuristicClassifier) Classify(ctx context.Context, content string) (string, error) {
+	if h.MaxLinks > 0 {
+		if n := len(linkRx.FindAllStringIndex(content, -1)); n > h.MaxLinks {
+			return fmt.Sprintf("%d links", n), nil
+		}
+	}
+	lower := strings.ToLower(content)
+	for _, kw := range h.Keywords {
+		if kw = strings.ToLower(strings.TrimSpace(kw)); kw != "" && strings.Contains(lower, kw) {
+			return fmt.Sprintf("keyword %q", kw), nil
+		}
+	}
+	return "", nil
+}
+
+// spamTokens returns unique tokens of the content used by the Bayesian
+// filter. Links are reduced to their host name.
+func spamTokens(content string) []string {
+	seen := make(map[string]struct{})
+	var tokens []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(content), unicode.IsSpace) {
+		if i := strings.Index(word, "://"); i > 0 {
+			host := word[i+3:]
+			if end := strings.IndexAny(host, "/?#"); end >= 0 {
+				host = host[:end]
+			}
+			word = "link:" + host
+		} else {
+			word = strings.TrimFunc(word, func(r rune) bool {
+				return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+			})
+		}
+		if len(word) < 3 || len(word) > 40 {
+			continue
+		}
+		if _, ok := seen[word]; ok {
+			continue
+		}
+		seen[word] = struct{}{}
+		tokens = append(tokens, word)
+	}
+	return tokens
+}
+
+// tokenCount is the number of spam and ham documents a token was seen in.
+type tokenCount struct {
+	Spam int64
+	Ham  int64
+}
+
+// spamProbability combines token probabilities using naive Bayes, as
+// described in Paul Graham's "A Plan for Spam". Only the most interesting
+// tokens are taken into account.
+func spamProbability(counts []tokenCount, spamDocs, hamDocs int64) float64 {
+	const (
+		interesting = 15
+		// Strength of the assumed probability of rarely seen tokens.
+		strength = 1.0
+		assumed  = 0.5
+	)
+	if spamDocs == 0 || hamDocs == 0 {
+		return assumed
+	}
+
+	probs := make([]float64, 0, len(counts))
+	for _, c := range counts {
+		seen := float64(c.Spam + c.Ham)
+		if seen == 0 {
+			continue
+		}
+		spamFreq := float64(c.Spam) / float64(spamDocs)
+		hamFreq := float64(c.Ham) / float64(hamDocs)
+		p := spamFreq / (spamFreq + hamFreq)
+		p = (strength*assumed + seen*p) / (strength + seen)
+		probs = append(probs, math.Min(0.99, math.Max(0.01, p)))
+	}
+
+	// Most interesting tokens are those furthest from neutral.
+	sort.Slice(probs, func(i, j int) bool {
+		return math.Abs(probs[i]-0.5) > math.Abs(probs[j]-0.5)
+	})
+	if len(probs) > interesting {
+		probs = probs[:interesting]
+	}
+	if len(probs) == 0 {
+		return assumed
+	}
+
+	// Computed in log space to avoid floating point underflow.
+	var logSpam, logHam float64
+	for _, p := range probs {
+		logSpam += math.Log(p)
+		logHam += math.Log(1 - p)
+	}
+	return 1 / (1 + math.Exp(logHam-logSpam))
+}
+
+// PostingGuard decides whether a new topic or comment can be published right
+// away, must wait for moderator approval or is rejected because the author
+// is posting too fast.
+type PostingGuard struct {
+	// PerUser and PerIP limit how often a user or a client address can
+	// post. Nil limiter allows everything.
+	PerUser *RateLimiter
+	PerIP   *RateLimiter
+	// ApproveFirst is the number of first posts of a new account that
+	// must be approved by a moderator.
+	ApproveFirst int64
+	// Classifier holds unwanted content for approval. Can be nil.
+	Classifier ContentClassifier
+}
+
+// Allow returns true if the user can post now. Moderators are not limited.
+func (g *PostingGuard) Allow(r *http.Request, user *User) bool {
+	return allowUserAction(r, user, g.PerUser, g.PerIP)
+}
+
+// HoldReason returns a non empty reason if the content written by the user
+// must be approved by a moderator before it is published. Moderators
+// content is never held.
+func (g *PostingGuard) HoldReason(ctx context.Context, bbStore BBStore, user *User, content string) string {
+	if user.Scopes.HasAny(adminScope, moderatorScope) {
+		return ""
+	}
+
+	if g.ApproveFirst > 0 {
+		// Hidden content is counted, so that a hidden user cannot
+		// tell the difference.
+		switch info, err := bbStore.UserInfo(ctx, user.UserID, user.UserID); {
+		case err != nil:
+			surf.LogError(ctx, err, "cannot get user info",
+				"user", fmt.Sprint(user.UserID))
+		case info.CommentsCount < g.ApproveFirst:
+			return "new account"
+		}
+	}
+
+	if g.Classifier != nil {
+		reason, err := g.Classifier.Classify(ctx, content)
+		if err != nil {
+			surf.LogError(ctx, err, "cannot classify content",
+				"user", fmt.Sprint(user.UserID))
+		}
+		return reason
+	}
+	return ""
+}
+
+// trainSpamFilter teaches the filter using a moderator decision. Failure is
+// not critical and only logged.
+func trainSpamFilter(ctx context.Context, filter SpamFilter, content string, spam bool) {
+	if err := filter.Train(ctx, content, spam); err != nil {
+		surf.LogError(ctx, err, "cannot train spam filter")
+	}
+}
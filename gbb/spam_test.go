@@ -0,0 +1,85 @@
+package gbb
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestHeuristicClassifier(t *testing.T) {
+	h := &HeuristicClassifier{
+		MaxLinks: 2,
+		Keywords: []string{"Cheap Pills", " "},
+	}
+	cases := map[string]struct {
+		content string
+		spam    bool
+	}{
+		"plain":        {content: "Hello there, how are you?"},
+		"few links":    {content: "See https://a.com and www.b.com"},
+		"many links":   {content: "http://a.com http://b.com HTTPS://c.com", spam: true},
+		"keyword":      {content: "Buy CHEAP pills now", spam: true},
+		"empty phrase": {content: "a b c"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			reason, err := h.Classify(context.Background(), tc.content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if spam := reason != ""; spam != tc.spam {
+				t.Fatalf("want spam %v, got %q", tc.spam, reason)
+			}
+		})
+	}
+}
+
+type staticClassifier struct {
+	reason string
+	err    error
+}
+
+func (c staticClassifier) Classify(context.Context, string) (string, error) {
+	return c.reason, c.err
+}
+
+func TestClassifierChain(t *testing.T) {
+	chain := ClassifierChain{
+		staticClassifier{err: errors.New("broken")},
+		staticClassifier{},
+		staticClassifier{reason: "spam"},
+	}
+	if reason, err := chain.Classify(context.Background(), ""); err != nil || reason != "spam" {
+		t.Fatalf("want spam, got %q, %v", reason, err)
+	}
+
+	chain = chain[:2]
+	if reason, err := chain.Classify(context.Background(), ""); err == nil || reason != "" {
+		t.Fatalf("want error, got %q, %v", reason, err)
+	}
+}
+
+func TestSpamTokens(t *testing.T) {
+	got := spamTokens("Buy NOW, buy now! Visit https://pills.example.com/cheap?x=1 it's ok")
+	want := []string{"buy", "now", "visit", "link:pills.example.com", "it's"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+func TestSpamProbability(t *testing.T) {
+	if p := spamProbability([]tokenCount{{Spam: 10}}, 0, 10); p != 0.5 {
+		t.Fatalf("want neutral probability without training, got %f", p)
+	}
+
+	spammy := []tokenCount{{Spam: 9, Ham: 0}, {Spam: 8, Ham: 1}, {Spam: 5, Ham: 5}}
+	if p := spamProbability(spammy, 10, 10); p < 0.95 {
+		t.Fatalf("want spam, got %f", p)
+	}
+
+	hammy := []tokenCount{{Spam: 0, Ham: 9}, {Spam: 1, Ham: 8}, {Spam: 5, Ham: 5}}
+	if p := spamProbability(hammy, 10, 10); p > 0.05 {
+		t.Fatalf("want ham, got %f", p)
+	}
+}
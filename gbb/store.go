@@ -3,27 +3,49 @@ package gbb
 import (
 	"context"
 	"fmt"
+	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-surf/surf/errors"
 )
 
+// BBStore keeps topics, comments and users of the board.
+//
+// Topics and comments created by a hidden user are hidden. Hidden content is
+// listed only to its author, given as the viewer ID, until a moderator
+// approves it. Viewer ID is 0 for anonymous users.
 type BBStore interface {
-	ListTopics(ctx context.Context, createdLte time.Time, limit int) ([]*Topic, error)
+	ListTopics(ctx context.Context, viewerID int64, createdLte time.Time, limit int) ([]*Topic, error)
+	// ListRankedTopics returns topics in given order. For RankTop, only
+	// activity since given time counts, unless it is zero.
+	ListRankedTopics(ctx context.Context, viewerID int64, ranking TopicRanking, activeGte time.Time, offset, limit int) ([]*Topic, error)
+	RefreshTopicScores(ctx context.Context) error
 	CreateTopic(ctx context.Context, subject, content string, categoryID int64, userID int64) (*Topic, *Comment, error)
 	TopicByID(ctx context.Context, topicID int64) (*Topic, error)
 	UpdateTopic(ctx context.Context, topicID int64, subject string) error
-	IncrementTopicView(ctx context.Context, postID int64) error
+	// SetTopicLocked changes whether the topic accepts new comments.
+	SetTopicLocked(ctx context.Context, topicID int64, locked bool) error
+	IncrementTopicViews(ctx context.Context, views map[int64]int64) error
 	DeleteTopic(ctx context.Context, topicID int64) error
 
-	ListComments(ctx context.Context, topicID int64, offset, limit int) ([]*Comment, error)
-	CommentByID(ctx context.Context, commentID int64) (*Topic, *Comment, int, error)
+	ListComments(ctx context.Context, topicID, viewerID int64, cursor CommentCursor, limit int) ([]*Comment, error)
+	CommentByID(ctx context.Context, commentID int64) (topic *Topic, comment *Comment, isFirst bool, err error)
 	CreateComment(ctx context.Context, postID int64, content string, userID int64) (*Comment, error)
 	UpdateComment(ctx context.Context, commentID int64, content string) error
 	DeleteComment(ctx context.Context, commentID int64) error
+	// ListHiddenComments returns hidden comments, the longest waiting
+	// first.
+	ListHiddenComments(ctx context.Context, limit int) ([]*HiddenComment, error)
+	// ApproveComment makes the hidden comment visible to everyone.
+	// Approving the first comment of a hidden topic makes the topic
+	// visible as well. ErrCommentNotFound is returned if the comment is
+	// not hidden.
+	ApproveComment(ctx context.Context, commentID int64) error
 
-	Search(ctx context.Context, searchText string, categories []int64, offset, limit int64) ([]*SearchResult, error)
+	Search(ctx context.Context, viewerID int64, searchText string, categories []int64, offset, limit int64) ([]*SearchResult, error)
 
 	ListCategories(ctx context.Context) ([]*Category, error)
 	AddCategories(ctx context.Context, name []string) error
@@ -31,13 +53,714 @@ type BBStore interface {
 
 	RegisterUser(ctx context.Context, password string, u User) (*User, error)
 	AuthenticateUser(ctx context.Context, login, password string) (*User, error)
-	UserInfo(ctx context.Context, userID int64) (*UserInfo, error)
+	// UserInfo returns the user with the activity statistics as seen by
+	// the viewer. Hidden content is counted only if the viewer is the
+	// user.
+	UserInfo(ctx context.Context, userID, viewerID int64) (*UserInfo, error)
+	// UsersByName returns users with given names. Names that do not
+	// belong to any user are ignored.
+	UsersByName(ctx context.Context, names []string) ([]*User, error)
+	GrantScopes(ctx context.Context, userID int64, scopes UserScope) error
+	RevokeScopes(ctx context.Context, userID int64, scopes UserScope) error
+	// SetUserBanned changes whether the user can sign in and write.
+	// Banned user gets ErrUserBanned when creating topics or comments.
+	SetUserBanned(ctx context.Context, userID int64, banned bool) error
+	// SetUserHidden changes whether topics and comments that the user
+	// creates are hidden. Already existing content is not changed.
+	SetUserHidden(ctx context.Context, userID int64, hidden bool) error
+
+	// AcceptComment marks given comment as the accepted answer of the
+	// topic. Passing 0 as the comment ID removes the mark.
+	AcceptComment(ctx context.Context, topicID, commentID int64) error
+	// PenalizeUser lowers the user reputation by given amount of points.
+	PenalizeUser(ctx context.Context, userID, moderatorID int64, points int64, reason string) error
+
+	// ExportUsers, ExportTopics and ExportComments return records with
+	// the ID greater than given one, ordered by the ID. Hidden content
+	// is returned as well. They are meant for backups.
+	ExportUsers(ctx context.Context, afterID int64, limit int) ([]*ArchivedUser, error)
+	ExportTopics(ctx context.Context, afterID int64, limit int) ([]*Topic, error)
+	ExportComments(ctx context.Context, afterID int64, limit int) ([]*Comment, error)
+	// ImportUser, ImportTopic and ImportComment create the record with
+	// its ID and timestamps preserved and return its ID. A new ID is
+	// assigned if the ID is 0. ErrConstraint is returned if the record
+	// already exists or what it refers to does not. Activity counters
+	// are not imported, but maintained the same way as for created
+	// content. Accepted comment of the topic is ignored.
+	ImportUser(ctx context.Context, u ArchivedUser) (int64, error)
+	ImportTopic(ctx context.Context, t Topic) (int64, error)
+	ImportComment(ctx context.Context, c Comment) (int64, error)
+	// ImportCategory creates the category with its ID preserved,
+	// replacing the category with the same ID.
+	ImportCategory(ctx context.Context, c Category) error
+	// ImportAcceptedComment marks the comment as the accepted answer of
+	// the topic. Unlike AcceptComment, reputation of the users is not
+	// changed, because it was imported together with them.
+	ImportAcceptedComment(ctx context.Context, topicID, commentID int64) error
+
+	// WithTx calls fn with a store writing in one transaction. The
+	// transaction is committed only if fn returns nil.
+	WithTx(ctx context.Context, fn func(BBStore) error) error
 }
 
 type ReadProgressTracker interface {
 	LastReads(ctx context.Context, userID int64, topicIDs []int64) (map[int64]*ReadProgress, error)
 	Track(context.Context, ReadProgress) error
 	MarkAllRead(ctx context.Context, userID int64, now time.Time) error
+	// ExportReadProgress returns the progress ordered by the user and the
+	// topic, starting after given position. Time the user marked all
+	// topics as read is returned as the progress of topic 0, before the
+	// progress of other topics.
+	ExportReadProgress(ctx context.Context, after ReadProgress, limit int) ([]*ReadProgress, error)
+}
+
+// StatsStore provides totals of the board content.
+type StatsStore interface {
+	ForumStats(ctx context.Context) (*ForumStats, error)
+}
+
+// ForumStats are the numbers of records of the board, including hidden ones.
+type ForumStats struct {
+	Topics   int64
+	Comments int64
+	Users    int64
+}
+
+// TopicEventBroker provides notifications about topic activity.
+type TopicEventBroker interface {
+	// Subscribe returns a channel that receives events of given topic.
+	// Subscribing to topic 0 receives events of all topics. Channel is
+	// closed when given context is done.
+	Subscribe(ctx context.Context, topicID int64) (<-chan TopicEvent, error)
+}
+
+// ReactionStore keeps track of reactions that users left on comments.
+type ReactionStore interface {
+	// ToggleReaction adds given reaction of the user to the comment. If
+	// the user already reacted this way, the reaction is removed instead.
+	// Returned value is true if the reaction was added.
+	ToggleReaction(ctx context.Context, commentID, userID int64, reaction string) (bool, error)
+
+	// ListReactions returns reactions of all given comments, grouped by
+	// the comment ID.
+	ListReactions(ctx context.Context, commentIDs []int64) (map[int64][]*Reaction, error)
+}
+
+type TopicEvent struct {
+	TopicID   int64 `json:"topic_id"`
+	CommentID int64 `json:"comment_id"`
+	// Subject, TopicCreated and CommentsCount describe the topic after
+	// the comment was added.
+	Subject       string    `json:"subject"`
+	TopicCreated  time.Time `json:"topic_created"`
+	CommentsCount int64     `json:"comments_count"`
+}
+
+// PollStore keeps polls attached to topics and their votes.
+type PollStore interface {
+	// CreatePoll attaches given poll to the topic. Topic can have at most
+	// one poll.
+	CreatePoll(ctx context.Context, poll Poll) (*Poll, error)
+
+	// PollByTopic returns the poll of given topic together with the vote
+	// results. Options voted by given user are marked.
+	PollByTopic(ctx context.Context, topicID, userID int64) (*Poll, error)
+
+	// Vote replaces all votes of the user in given poll with votes for
+	// given options. Passing no options removes the user votes. Voting is
+	// not possible once the poll is closed.
+	Vote(ctx context.Context, pollID, userID int64, optionIDs []int64) error
+}
+
+// DraftStore keeps unfinished topics and comments, so that they are not lost
+// if the user leaves the page or the session expires.
+type DraftStore interface {
+	// SaveDraft creates or replaces the draft of the user.
+	SaveDraft(ctx context.Context, d Draft) error
+
+	// Draft returns the draft of the user for given topic, or of a new
+	// topic if topic ID is 0. ErrDraftNotFound is returned if there is
+	// no draft.
+	Draft(ctx context.Context, userID, topicID int64) (*Draft, error)
+
+	// DeleteDraft removes the draft if it exists.
+	DeleteDraft(ctx context.Context, userID, topicID int64) error
+
+	// ListDrafts returns all drafts of the user, most recently updated
+	// first.
+	ListDrafts(ctx context.Context, userID int64) ([]*Draft, error)
+}
+
+// CommentReferenceStore keeps track of comments that reference other comments
+// using the #c123 syntax.
+type CommentReferenceStore interface {
+	// SetReferences replaces all references of given comment. References
+	// to comments that do not exist are ignored.
+	SetReferences(ctx context.Context, commentID int64, referencedIDs []int64) error
+
+	// ListReplies returns comments referencing any of given comments,
+	// grouped by the referenced comment ID. Hidden comments are returned
+	// only to their author.
+	ListReplies(ctx context.Context, viewerID int64, commentIDs []int64) (map[int64][]*Reply, error)
+}
+
+// AttachmentStore keeps information about files attached to comments. Content
+// of the files is kept separately in a blob store.
+type AttachmentStore interface {
+	// CreateAttachment registers a new attachment. Attachment does not
+	// belong to any comment until AttachToComment is called.
+	CreateAttachment(ctx context.Context, a Attachment) (*Attachment, error)
+
+	// AttachToComment assigns given attachments, that do not belong to
+	// any comment yet, to the comment.
+	AttachToComment(ctx context.Context, commentID int64, attachmentIDs []int64) error
+
+	AttachmentByID(ctx context.Context, attachmentID int64) (*Attachment, error)
+
+	// ListAttachments returns attachments of all given comments, grouped by
+	// the comment ID.
+	ListAttachments(ctx context.Context, commentIDs []int64) (map[int64][]*Attachment, error)
+
+	// ListOrphanedAttachments returns attachments that do not belong to
+	// any comment and were created before given time. Attachments of
+	// deleted comments are orphaned. Attachments with an ID in heldIDs,
+	// for example of posts held for approval, are not.
+	ListOrphanedAttachments(ctx context.Context, createdLte time.Time, heldIDs []int64, limit int) ([]*Attachment, error)
+
+	DeleteAttachment(ctx context.Context, attachmentID int64) error
+
+	// ExportAttachments returns attachments that belong to a comment,
+	// with the ID greater than given one, ordered by the ID.
+	ExportAttachments(ctx context.Context, afterID int64, limit int) ([]*Attachment, error)
+	// ImportAttachment creates the attachment with its ID, comment and
+	// creation time preserved. ErrConstraint is returned if the
+	// attachment already exists.
+	ImportAttachment(ctx context.Context, a Attachment) error
+}
+
+// MessageStore keeps private conversations between users. Conversation is
+// stored the same way as a topic with its comments, but it is accessible only
+// to its participants.
+type MessageStore interface {
+	// CreateConversation starts a conversation of the author with given
+	// users. ErrPermission is returned if any of the users blocked the
+	// author.
+	CreateConversation(ctx context.Context, subject, content string, authorID int64, participantIDs []int64) (*Conversation, *Message, error)
+
+	// ConversationByID returns the conversation as seen by given user.
+	// ErrConversationNotFound is returned if the user is not a
+	// participant.
+	ConversationByID(ctx context.Context, conversationID, userID int64) (*Conversation, error)
+
+	// ListConversations returns conversations of the user that were
+	// updated before given time, most recently updated first.
+	ListConversations(ctx context.Context, userID int64, updatedLte time.Time, limit int) ([]*Conversation, error)
+
+	// CountStartedConversations returns the number of conversations the
+	// user started since given time.
+	CountStartedConversations(ctx context.Context, userID int64, createdGte time.Time) (int64, error)
+
+	// LeaveConversation removes the user from participants. Conversation
+	// is deleted once all participants leave.
+	LeaveConversation(ctx context.Context, conversationID, userID int64) error
+
+	// ListMessages returns messages of the conversation, paginated the
+	// same way as topic comments.
+	ListMessages(ctx context.Context, conversationID int64, cursor CommentCursor, limit int) ([]*Message, error)
+
+	// CreateMessage adds a message to the conversation. ErrPermission is
+	// returned if the user is not a participant or was blocked by any
+	// other participant.
+	CreateMessage(ctx context.Context, conversationID int64, content string, userID int64) (*Message, error)
+
+	// TrackRead stores how far the user has read the conversation. Topic
+	// ID of the progress is the conversation ID and comment is the
+	// message.
+	TrackRead(ctx context.Context, p ReadProgress) error
+
+	// CountUnread returns the number of conversations of the user with
+	// messages that were not read yet.
+	CountUnread(ctx context.Context, userID int64) (int64, error)
+
+	// BlockUser prevents given user from messaging the user.
+	BlockUser(ctx context.Context, userID, blockedID int64) error
+	UnblockUser(ctx context.Context, userID, blockedID int64) error
+	// ListBlockedUsers returns all users blocked by the user.
+	ListBlockedUsers(ctx context.Context, userID int64) ([]*User, error)
+}
+
+// ModerationStore keeps reports of abusive comments and records how
+// moderators resolved them.
+type ModerationStore interface {
+	// CreateReport reports the comment. Reporting the same comment again,
+	// before the report is resolved, updates the reason.
+	CreateReport(ctx context.Context, commentID, reporterID int64, reason string) error
+
+	// ListReportedComments returns comments with open reports, the
+	// longest waiting first. Reported comments that were deleted in the
+	// meantime are included as well.
+	ListReportedComments(ctx context.Context, limit int) ([]*ReportedComment, error)
+
+	// ResolveReports closes all open reports of the comment and records
+	// the resolution. ErrReportNotFound is returned if the comment has no
+	// open reports, for example because another moderator already
+	// resolved them.
+	ResolveReports(ctx context.Context, r Resolution) (*Resolution, error)
+
+	// ReopenReports reverts ResolveReports, for example because the
+	// moderator action could not be taken. The resolution is removed and
+	// its reports are open again.
+	ReopenReports(ctx context.Context, resolutionID int64) error
+
+	// ListResolutions returns resolutions created before given time,
+	// most recent first.
+	ListResolutions(ctx context.Context, createdLte time.Time, limit int) ([]*Resolution, error)
+
+	// ListUserReports returns reports created by the user, most recent
+	// first.
+	ListUserReports(ctx context.Context, userID int64, limit int) ([]*Report, error)
+
+	// CountUnseenResolved returns the number of resolved reports created
+	// by the user that the user was not notified about yet.
+	CountUnseenResolved(ctx context.Context, userID int64) (int64, error)
+
+	// MarkResolvedSeen marks all resolved reports of the user as seen.
+	MarkResolvedSeen(ctx context.Context, userID int64) error
+}
+
+// InviteStore keeps invitations to register an account.
+type InviteStore interface {
+	CreateInvite(ctx context.Context, inv Invite) (*Invite, error)
+	// InviteByToken returns ErrInviteNotFound if the invite does not
+	// exist. Expired, revoked and used up invites are returned as well.
+	InviteByToken(ctx context.Context, token string) (*Invite, error)
+	// RedeemInvite uses the invite once. ErrInviteNotFound is returned if
+	// the invite does not exist or cannot be used anymore.
+	RedeemInvite(ctx context.Context, token string) (*Invite, error)
+	// AddInvitee records the user registered using the redeemed invite.
+	AddInvitee(ctx context.Context, inviteID, userID int64) error
+	// ListInvites returns invites created by given user, or by anyone if
+	// the user ID is 0, the newest first.
+	ListInvites(ctx context.Context, createdBy int64, limit int) ([]*Invite, error)
+	// RevokeInvite makes the invite unusable. Only invites created by
+	// given user are revoked, unless the user ID is 0.
+	RevokeInvite(ctx context.Context, inviteID, createdBy int64) error
+}
+
+// AccountStore exports and deletes user accounts. Deletion is scheduled, so
+// that it can be cancelled within the grace period.
+type AccountStore interface {
+	// ExportAccount returns the personal data kept about the user.
+	ExportAccount(ctx context.Context, userID int64) (*AccountExport, error)
+	// ScheduleDeletion requests the account deletion once the due time
+	// is reached. Previous request of the user is replaced.
+	ScheduleDeletion(ctx context.Context, userID int64, mode DeletionMode, due time.Time) (*AccountDeletion, error)
+	// PendingDeletion returns ErrDeletionNotFound if the deletion of the
+	// account was not requested.
+	PendingDeletion(ctx context.Context, userID int64) (*AccountDeletion, error)
+	// CancelDeletion returns ErrDeletionNotFound if the deletion of the
+	// account was not requested.
+	CancelDeletion(ctx context.Context, userID int64) error
+	// ListDueDeletions returns deletions that are due at given time, the
+	// oldest first.
+	ListDueDeletions(ctx context.Context, now time.Time, limit int) ([]*AccountDeletion, error)
+	// DeleteAccount removes the user. Depending on the mode, content
+	// authored by the user is either reassigned to the deleted user
+	// placeholder or removed.
+	DeleteAccount(ctx context.Context, userID int64, mode DeletionMode) error
+
+	// DeletedUserPlaceholder returns the ID of the user that content of
+	// deleted accounts is reassigned to, or ErrUserNotFound if there is
+	// none.
+	DeletedUserPlaceholder(ctx context.Context) (int64, error)
+	// RemoveDeletedUserPlaceholder deletes the placeholder user, so that
+	// an archive can be imported in its place. ErrConstraint is returned
+	// if any content is attributed to the placeholder.
+	RemoveDeletedUserPlaceholder(ctx context.Context) error
+	// ImportDeletedUserPlaceholder makes given user the placeholder. A new
+	// placeholder user is created if the user ID is 0. ErrConstraint is
+	// returned if a placeholder already exists.
+	ImportDeletedUserPlaceholder(ctx context.Context, userID int64) error
+}
+
+// PendingPostStore holds topics and comments that must be approved by a
+// moderator before they are published.
+type PendingPostStore interface {
+	HoldPost(ctx context.Context, p PendingPost) (*PendingPost, error)
+	// PendingPostByID returns ErrPendingPostNotFound if the post does
+	// not exist, for example because it was already approved.
+	PendingPostByID(ctx context.Context, pendingID int64) (*PendingPost, error)
+	// ListPendingPosts returns held posts, the longest waiting first.
+	ListPendingPosts(ctx context.Context, limit int) ([]*PendingPost, error)
+	DeletePendingPost(ctx context.Context, pendingID int64) error
+	// ListHeldAttachmentIDs returns IDs of attachments of all held posts.
+	ListHeldAttachmentIDs(ctx context.Context) ([]int64, error)
+}
+
+// SpamFilter is a ContentClassifier that learns from moderator decisions.
+type SpamFilter interface {
+	ContentClassifier
+
+	// Train teaches the filter that given content is spam or not.
+	Train(ctx context.Context, content string, spam bool) error
+}
+
+// TwoFactorStore keeps TOTP secrets and recovery codes of users that enabled
+// two-factor authentication.
+type TwoFactorStore interface {
+	// EnableTwoFactor stores the TOTP secret of the user and replaces all
+	// recovery codes. Only hashes of the recovery codes are stored.
+	EnableTwoFactor(ctx context.Context, userID int64, secret string, recoveryCodes []string) error
+
+	// DisableTwoFactor removes the secret and recovery codes of the user.
+	DisableTwoFactor(ctx context.Context, userID int64) error
+
+	// TwoFactorSecret returns the TOTP secret of the user.
+	// ErrTwoFactorNotFound is returned if the user did not enable
+	// two-factor authentication.
+	TwoFactorSecret(ctx context.Context, userID int64) (string, error)
+
+	// UseTimeStep marks the TOTP time step as used by the user, so that
+	// a code cannot be used twice. ErrPermission is returned if given or
+	// a later step was already used.
+	UseTimeStep(ctx context.Context, userID, step int64) error
+
+	// UseRecoveryCode removes the recovery code of the user.
+	// ErrPermission is returned if the user has no such code.
+	UseRecoveryCode(ctx context.Context, userID int64, code string) error
+
+	// CountRecoveryCodes returns the number of unused recovery codes.
+	CountRecoveryCodes(ctx context.Context, userID int64) (int64, error)
+
+	// TwoFactorRequired returns true if admins and moderators must use
+	// two-factor authentication.
+	TwoFactorRequired(ctx context.Context) (bool, error)
+	SetTwoFactorRequired(ctx context.Context, required bool) error
+}
+
+// IdentityStore links accounts of an external identity provider to local
+// users.
+type IdentityStore interface {
+	// UserByIdentity returns the ID of the user linked to the subject of
+	// the provider. ErrIdentityNotFound is returned if the subject was
+	// never linked.
+	UserByIdentity(ctx context.Context, provider, subject string) (int64, error)
+
+	// LinkIdentity links the subject of the provider to the user.
+	// ErrConstraint is returned if the subject is already linked.
+	LinkIdentity(ctx context.Context, userID int64, provider, subject string) error
+
+	// HasIdentity returns true if any subject is linked to the user.
+	HasIdentity(ctx context.Context, userID int64) (bool, error)
+
+	// LocalLoginDisabled returns true if users can sign in only using
+	// the identity provider.
+	LocalLoginDisabled(ctx context.Context) (bool, error)
+	SetLocalLoginDisabled(ctx context.Context, disabled bool) error
+}
+
+// ImportStore remembers records of other forums that were imported, so that
+// an import can be resumed or repeated without creating duplicates. Records
+// are identified by the source forum, the kind of the record and its ID in
+// the source forum.
+type ImportStore interface {
+	// ImportedID returns the ID of the record created for the foreign
+	// record. ErrImportNotFound is returned if the foreign record was
+	// not imported.
+	ImportedID(ctx context.Context, source, kind, foreignID string) (int64, error)
+
+	// MarkImported remembers the ID of the record created for the foreign
+	// record. ErrConstraint is returned if the foreign record was
+	// already imported.
+	MarkImported(ctx context.Context, source, kind, foreignID string, id int64) error
+
+	// ImportRecord calls create with a transaction of given store and
+	// remembers the ID of the record it created in the same transaction.
+	// ErrConstraint is returned if the foreign record was already
+	// imported.
+	ImportRecord(ctx context.Context, bbStore BBStore, source, kind, foreignID string, create func(BBStore) (int64, error)) (int64, error)
+}
+
+// Reaction groups all users that reacted to a comment the same way.
+type Reaction struct {
+	CommentID int64
+	Reaction  string
+	Users     []User
+}
+
+type Poll struct {
+	PollID    int64
+	TopicID   int64
+	Question  string
+	Multiple  bool
+	Anonymous bool
+	// Closes is the time after which voting is no longer possible. Zero
+	// value poll is never closed.
+	Closes  time.Time
+	Options []*PollOption
+	// Voters is the number of users that voted.
+	Voters int64
+}
+
+// IsClosed returns true if voting is no longer possible.
+func (p *Poll) IsClosed() bool {
+	return !p.Closes.IsZero() && !time.Now().Before(p.Closes)
+}
+
+// Percent returns the share of voters that voted for given option.
+func (p *Poll) Percent(o *PollOption) int64 {
+	if p.Voters == 0 {
+		return 0
+	}
+	return o.Votes * 100 / p.Voters
+}
+
+type PollOption struct {
+	OptionID int64
+	Label    string
+	Votes    int64
+	// Users that voted for this option. Never provided for anonymous
+	// polls.
+	Users []User
+	// Voted is true if the user for whom the poll was fetched voted for
+	// this option.
+	Voted bool
+}
+
+type Conversation struct {
+	ConversationID int64
+	Subject        string
+	Created        time.Time
+	// Updated is the creation time of the latest message.
+	Updated       time.Time
+	Author        User
+	Participants  []User
+	MessagesCount int64
+
+	// Unread is true if the user for whom the conversation was fetched
+	// did not read the latest message.
+	Unread bool
+}
+
+type Message struct {
+	MessageID      int64
+	ConversationID int64
+	Content        string
+	Created        time.Time
+	Author         User
+}
+
+// Cursor returns a cursor pointing at the message.
+func (m *Message) Cursor() CommentCursor {
+	return CommentCursor{Created: m.Created, CommentID: m.MessageID}
+}
+
+type Report struct {
+	ReportID  int64
+	CommentID int64
+	TopicID   int64
+	Reporter  User
+	Reason    string
+	Created   time.Time
+	// Resolution is nil while the report is open.
+	Resolution *Resolution
+}
+
+// ReportedComment groups all open reports of a comment.
+type ReportedComment struct {
+	Topic   Topic
+	Comment Comment
+	// Deleted is true if the comment no longer exists. Only the IDs of the
+	// topic and the comment are provided then.
+	Deleted      bool
+	AuthorBanned bool
+	Reports      []*Report
+}
+
+// ModerationAction is the action taken by a moderator to resolve reports.
+type ModerationAction string
+
+const (
+	ActionDismiss   ModerationAction = "dismiss"
+	ActionEdit      ModerationAction = "edit"
+	ActionDelete    ModerationAction = "delete"
+	ActionLockTopic ModerationAction = "lock"
+	ActionBanAuthor ModerationAction = "ban"
+)
+
+type Resolution struct {
+	ResolutionID int64
+	CommentID    int64
+	TopicID      int64
+	Moderator    User
+	Action       ModerationAction
+	Note         string
+	// CommentAuthor and CommentContent describe the comment as it was
+	// when the reports were resolved, because it might be deleted.
+	CommentAuthor  User
+	CommentContent string
+	Created        time.Time
+}
+
+type Draft struct {
+	UserID int64
+	// TopicID is 0 for a draft of a new topic.
+	TopicID int64
+	// TopicSubject is the subject of the topic the draft is commenting.
+	// It is set only when listing drafts.
+	TopicSubject string
+	// Subject is set only for a draft of a new topic.
+	Subject string
+	Content string
+	Updated time.Time
+}
+
+// RegistrationMode decides who can register a new account.
+type RegistrationMode string
+
+const (
+	RegistrationOpen   RegistrationMode = "open"
+	RegistrationInvite RegistrationMode = "invite"
+	RegistrationClosed RegistrationMode = "closed"
+)
+
+// ParseRegistrationMode returns the registration mode of given name.
+func ParseRegistrationMode(s string) (RegistrationMode, error) {
+	switch m := RegistrationMode(s); m {
+	case RegistrationOpen, RegistrationInvite, RegistrationClosed:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown registration mode %q", s)
+}
+
+// Invite allows registering an account, even if the registration is not
+// open. Every account registered with the invite gets its scopes.
+type Invite struct {
+	InviteID  int64
+	Token     string
+	CreatedBy User
+	Scopes    UserScope
+	MaxUses   int64
+	Uses      int64
+	Created   time.Time
+	Expires   time.Time
+	Revoked   bool
+	// Invitees are users registered using the invite.
+	Invitees []User
+}
+
+// Usable returns true if the invite can still be redeemed.
+func (inv *Invite) Usable(now time.Time) bool {
+	return !inv.Revoked && inv.Uses < inv.MaxUses && now.Before(inv.Expires)
+}
+
+// Status returns the human readable state of the invite.
+func (inv *Invite) Status() string {
+	switch {
+	case inv.Revoked:
+		return "revoked"
+	case inv.Uses >= inv.MaxUses:
+		return "redeemed"
+	case !time.Now().Before(inv.Expires):
+		return "expired"
+	default:
+		return "outstanding"
+	}
+}
+
+// DeletionMode decides what happens to the content of a deleted account.
+type DeletionMode string
+
+const (
+	// DeletionAnonymize keeps topics and comments, but reassigns them
+	// to the deleted user placeholder.
+	DeletionAnonymize DeletionMode = "anonymize"
+	// DeletionRemove deletes comments of the user. Topics are deleted
+	// unless other users commented them, in which case only the
+	// topic author is replaced by the placeholder.
+	DeletionRemove DeletionMode = "remove"
+)
+
+// ParseDeletionMode returns the deletion mode of given name.
+func ParseDeletionMode(s string) (DeletionMode, error) {
+	switch m := DeletionMode(s); m {
+	case DeletionAnonymize, DeletionRemove:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown deletion mode %q", s)
+}
+
+// AccountDeletion is a request to delete the user account.
+type AccountDeletion struct {
+	UserID    int64
+	Mode      DeletionMode
+	Requested time.Time
+	Due       time.Time
+}
+
+// AccountExport is the personal data kept about the user.
+type AccountExport struct {
+	User     UserInfo
+	Topics   []*Topic
+	Comments []*Comment
+	// TopicSubjects maps IDs of all topics the user commented to their
+	// subjects.
+	TopicSubjects map[int64]string
+	ReadProgress  []*ReadProgress
+	// ReadAll is the last time the user marked all topics as read or
+	// zero.
+	ReadAll time.Time
+}
+
+// PendingPost is a topic or a comment waiting for moderator approval.
+type PendingPost struct {
+	PendingID int64
+	// TopicID is 0 for a new topic.
+	TopicID int64
+	// TopicSubject is the subject of the commented topic. It is set
+	// only when reading pending posts.
+	TopicSubject string
+	// Subject, Category and Poll are set only for a new topic.
+	Subject  string
+	Category int64
+	Poll     *Poll
+	Content  string
+	// AttachmentIDs are files uploaded together with the comment.
+	AttachmentIDs []int64
+	Author        User
+	// Reason explains why the post was held.
+	Reason  string
+	Created time.Time
+}
+
+// Reply is a comment that references another comment.
+type Reply struct {
+	CommentID int64
+	Author    User
+}
+
+type Attachment struct {
+	AttachmentID int64
+	// CommentID is 0 if attachment does not belong to any comment.
+	CommentID   int64
+	UserID      int64
+	Name        string
+	ContentType string
+	Size        int64
+	BlobKey     string
+	// ThumbnailKey is empty if the attachment has no thumbnail.
+	ThumbnailKey string
+	Created      time.Time
+}
+
+// URL returns the address the attachment content is served at.
+func (a *Attachment) URL() string {
+	return fmt.Sprintf("/a/%d/%s", a.AttachmentID, url.PathEscape(a.Name))
+}
+
+// ThumbnailURL returns the address of the attachment thumbnail.
+func (a *Attachment) ThumbnailURL() string {
+	return fmt.Sprintf("/a/%d/thumbnail/", a.AttachmentID)
 }
 
 type ReadProgress struct {
@@ -53,9 +776,19 @@ type Category struct {
 }
 
 type User struct {
-	UserID int64
-	Name   string
-	Scopes UserScope
+	UserID     int64
+	Name       string
+	Scopes     UserScope
+	Reputation int64
+}
+
+// ArchivedUser is the complete user account, as kept in backups.
+type ArchivedUser struct {
+	User
+	// PasswordHash is the bcrypt hash of the user password.
+	PasswordHash string
+	Banned       bool
+	Hidden       bool
 }
 
 type UserScope uint16
@@ -67,6 +800,8 @@ const (
 	createTopicScope
 	createCommentScope
 	changeSettingsScope
+	startConversationScope
+	inviteScope
 )
 
 func (s UserScope) String() string {
@@ -90,9 +825,36 @@ func (s UserScope) Names() []string {
 	if s&changeSettingsScope != 0 {
 		names = append(names, "changeSettings")
 	}
+	if s&startConversationScope != 0 {
+		names = append(names, "startConversation")
+	}
+	if s&inviteScope != 0 {
+		names = append(names, "invite")
+	}
 	return names
 }
 
+// ParseUserScope returns the scope of given name, as returned by Names.
+func ParseUserScope(name string) (UserScope, error) {
+	switch name {
+	case "admin":
+		return adminScope, nil
+	case "moderator":
+		return moderatorScope, nil
+	case "createTopic":
+		return createTopicScope, nil
+	case "createComment":
+		return createCommentScope, nil
+	case "changeSettings":
+		return changeSettingsScope, nil
+	case "startConversation":
+		return startConversationScope, nil
+	case "invite":
+		return inviteScope, nil
+	}
+	return 0, fmt.Errorf("unknown scope %q", name)
+}
+
 // HasAny returns true if scope contains any of given scopes
 func (s UserScope) HasAny(scopes ...UserScope) bool {
 	for _, scope := range scopes {
@@ -115,10 +877,64 @@ func (u *User) Authenticated() bool {
 	return u != nil && u.UserID > 0
 }
 
+// ViewerID returns the user ID or 0 if the user is not authenticated.
+func (u *User) ViewerID() int64 {
+	if !u.Authenticated() {
+		return 0
+	}
+	return u.UserID
+}
+
+// UserInfo extends the user with the activity statistics.
+//
+// Reputation is maintained by the store. User gains 1 point for each reaction
+// to their comment and 15 points for each of their comments accepted as the
+// answer, unless it is their own topic. Moderators can take reputation points
+// away.
 type UserInfo struct {
 	User
 	TopicsCount   int64
 	CommentsCount int64
+	Banned        bool
+	// Hidden is true if content created by the user is hidden. It must
+	// not be revealed to the user.
+	Hidden bool
+}
+
+// ScopeThreshold describes the activity required to unlock a scope.
+type ScopeThreshold struct {
+	Scope         UserScope
+	MinReputation int64
+	MinComments   int64
+}
+
+// TopicCreationThreshold returns a threshold unlocking topic creation after
+// writing given number of comments.
+func TopicCreationThreshold(minComments int64) ScopeThreshold {
+	return ScopeThreshold{Scope: createTopicScope, MinComments: minComments}
+}
+
+// ConversationThreshold returns a threshold unlocking starting private
+// conversations after reaching given reputation and number of comments.
+func ConversationThreshold(minReputation, minComments int64) ScopeThreshold {
+	return ScopeThreshold{Scope: startConversationScope, MinReputation: minReputation, MinComments: minComments}
+}
+
+// InviteThreshold returns a threshold unlocking creating invites after
+// reaching given reputation and number of comments.
+func InviteThreshold(minReputation, minComments int64) ScopeThreshold {
+	return ScopeThreshold{Scope: inviteScope, MinReputation: minReputation, MinComments: minComments}
+}
+
+// EarnedScopes returns all scopes unlocked by the user activity.
+func (u *UserInfo) EarnedScopes(thresholds []ScopeThreshold) UserScope {
+	var scopes UserScope
+	for _, t := range thresholds {
+		if u.Reputation >= t.MinReputation && u.CommentsCount >= t.MinComments {
+			scopes = scopes.Add(t.Scope)
+		}
+	}
+	return scopes
 }
 
 type Topic struct {
@@ -131,8 +947,30 @@ type Topic struct {
 
 	CommentsCount int64
 	ViewsCount    int64
+
+	// AcceptedCommentID is the ID of the comment marked as the answer or 0.
+	AcceptedCommentID int64
+	// Locked topic can be commented only by moderators.
+	Locked bool
+	// Hidden topic is waiting for moderator approval.
+	Hidden bool
 }
 
+// TopicRanking defines an alternative to the default, latest comment first,
+// topic ordering.
+type TopicRanking string
+
+const (
+	// RankHot orders topics by the score computed from the recent
+	// activity. Score is periodically refreshed by RefreshTopicScores.
+	RankHot TopicRanking = "hot"
+	// RankTop orders topics by the number of comments and views. Within
+	// a period, by the number of comments written in that period.
+	RankTop TopicRanking = "top"
+	// RankNew orders topics by the creation time, newest first.
+	RankNew TopicRanking = "new"
+)
+
 func (t *Topic) SlugInfo() string {
 	info := t.Created.Format("2006-01-02") + "/" + slugRx.ReplaceAllString(t.Subject, "-")
 	if len(info) > 300 {
@@ -147,8 +985,71 @@ type Comment struct {
 	CommentID int64
 	TopicID   int64
 	Content   string
+	// Revision is incremented every time the content is changed.
+	Revision int64
+	Created  time.Time
+	Author   User
+	// Hidden comment is waiting for moderator approval.
+	Hidden bool
+}
+
+// Cursor returns a cursor pointing at the comment.
+func (c *Comment) Cursor() CommentCursor {
+	return CommentCursor{Created: c.Created, CommentID: c.CommentID}
+}
+
+// CommentCursor points to a position within the topic comments, which are
+// ordered by their creation time. Cursor that is not pointing backward selects
+// the comment it points to and all comments after it. Cursor pointing backward
+// selects only comments before the position.
+//
+// Zero value cursor points to the beginning of the topic. Zero value cursor
+// pointing backward points to the end of the topic.
+type CommentCursor struct {
 	Created   time.Time
-	Author    User
+	CommentID int64
+	Backward  bool
+}
+
+func (c CommentCursor) IsZero() bool {
+	return c.Created.IsZero() && c.CommentID == 0
+}
+
+// String returns cursor position serialized to a format that can be parsed by
+// ParseCommentCursor. Direction is not part of the serialized value.
+func (c CommentCursor) String() string {
+	if c.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d", c.Created.UnixNano(), c.CommentID)
+}
+
+// ParseCommentCursor returns cursor deserialized from its string
+// representation.
+func ParseCommentCursor(s string) (CommentCursor, error) {
+	var c CommentCursor
+	chunks := strings.SplitN(s, ".", 2)
+	if len(chunks) != 2 {
+		return c, errors.Wrap(ErrMalformed, "invalid cursor format")
+	}
+	created, err := strconv.ParseInt(chunks[0], 10, 64)
+	if err != nil {
+		return c, errors.Wrap(ErrMalformed, "invalid cursor time")
+	}
+	c.CommentID, err = strconv.ParseInt(chunks[1], 10, 64)
+	if err != nil {
+		return c, errors.Wrap(ErrMalformed, "invalid cursor comment")
+	}
+	c.Created = time.Unix(0, created).UTC()
+	return c, nil
+}
+
+// HiddenComment is a comment of a hidden user waiting for moderator approval.
+type HiddenComment struct {
+	Topic   Topic
+	Comment Comment
+	// IsFirst is true if approving the comment approves the topic as well.
+	IsFirst bool
 }
 
 type SearchResult struct {
@@ -162,6 +1063,20 @@ var (
 	ErrTopicNotFound        = errors.Wrap(ErrNotFound, "topic")
 	ErrCommentNotFound      = errors.Wrap(ErrNotFound, "comment")
 	ErrReadprogressNotFound = errors.Wrap(ErrNotFound, "readprogress")
+	ErrPollNotFound         = errors.Wrap(ErrNotFound, "poll")
+	ErrAttachmentNotFound   = errors.Wrap(ErrNotFound, "attachment")
+	ErrDraftNotFound        = errors.Wrap(ErrNotFound, "draft")
+	ErrConversationNotFound = errors.Wrap(ErrNotFound, "conversation")
+	ErrReportNotFound       = errors.Wrap(ErrNotFound, "report")
+	ErrPendingPostNotFound  = errors.Wrap(ErrNotFound, "pending post")
+	ErrTwoFactorNotFound    = errors.Wrap(ErrNotFound, "two factor")
+	ErrIdentityNotFound     = errors.Wrap(ErrNotFound, "identity")
+	ErrInviteNotFound       = errors.Wrap(ErrNotFound, "invite")
+	ErrDeletionNotFound     = errors.Wrap(ErrNotFound, "account deletion")
+	ErrImportNotFound       = errors.Wrap(ErrNotFound, "import")
 	ErrConstraint           = errors.New("constraint")
+	ErrMalformed            = errors.New("malformed")
 	ErrPermission           = errors.New("permission denied")
+	ErrUserBanned           = errors.Wrap(ErrPermission, "user banned")
+	ErrRegistrationClosed   = errors.Wrap(ErrPermission, "registration closed")
 )
@@ -0,0 +1,99 @@
+package gbb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCommentCursorSerialization(t *testing.T) {
+	c := CommentCursor{
+		Created:   time.Date(2018, 1, 2, 3, 4, 5, 123456000, time.UTC),
+		CommentID: 42,
+	}
+	got, err := ParseCommentCursor(c.String())
+	if err != nil {
+		t.Fatalf("cannot parse %q: %s", c.String(), err)
+	}
+	if !got.Created.Equal(c.Created) || got.CommentID != c.CommentID {
+		t.Fatalf("want %+v, got %+v", c, got)
+	}
+
+	for _, raw := range []string{"", "123", "abc.1", "1.abc"} {
+		if _, err := ParseCommentCursor(raw); !ErrMalformed.Is(err) {
+			t.Errorf("%q: want ErrMalformed, got %v", raw, err)
+		}
+	}
+
+	if s := (CommentCursor{}).String(); s != "" {
+		t.Errorf("want empty zero cursor, got %q", s)
+	}
+}
+
+func TestEarnedScopes(t *testing.T) {
+	thresholds := []ScopeThreshold{
+		TopicCreationThreshold(3),
+		ConversationThreshold(5, 1),
+		{Scope: moderatorScope, MinReputation: 100, MinComments: 10},
+	}
+	cases := map[string]struct {
+		info UserInfo
+		want UserScope
+	}{
+		"new user": {
+			info: UserInfo{},
+			want: 0,
+		},
+		"active user": {
+			info: UserInfo{CommentsCount: 3},
+			want: createTopicScope,
+		},
+		"reputable user": {
+			info: UserInfo{User: User{Reputation: 100}, CommentsCount: 10},
+			want: createTopicScope | startConversationScope | moderatorScope,
+		},
+		"penalized user": {
+			info: UserInfo{User: User{Reputation: -5}, CommentsCount: 10},
+			want: 0,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.info.EarnedScopes(thresholds); got != tc.want {
+				t.Fatalf("want %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestInviteStatus(t *testing.T) {
+	now := time.Now()
+	cases := map[string]struct {
+		invite Invite
+		want   string
+	}{
+		"outstanding": {
+			invite: Invite{MaxUses: 2, Uses: 1, Expires: now.Add(time.Hour)},
+			want:   "outstanding",
+		},
+		"redeemed": {
+			invite: Invite{MaxUses: 2, Uses: 2, Expires: now.Add(time.Hour)},
+			want:   "redeemed",
+		},
+		"expired": {
+			invite: Invite{MaxUses: 1, Expires: now.Add(-time.Hour)},
+			want:   "expired",
+		},
+		"revoked": {
+			invite: Invite{MaxUses: 1, Expires: now.Add(time.Hour), Revoked: true},
+			want:   "revoked",
+		},
+	}
+	for name, tc := range cases {
+		if got := tc.invite.Status(); got != tc.want {
+			t.Errorf("%s: want %q status, got %q", name, tc.want, got)
+		}
+		if got := tc.invite.Usable(now); got != (tc.want == "outstanding") {
+			t.Errorf("%s: unexpected usable %v", name, got)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package gbb
+
+import (
+	"context"
+	"sync"
+)
+
+// topicEventHub dispatches published events to all interested subscribers.
+// Subscribers that are not fast enough to consume published events are
+// skipped, so that a single slow client cannot block everyone else.
+type topicEventHub struct {
+	mu   sync.Mutex
+	subs map[int64]map[chan TopicEvent]struct{}
+}
+
+func newTopicEventHub() *topicEventHub {
+	return &topicEventHub{
+		subs: make(map[int64]map[chan TopicEvent]struct{}),
+	}
+}
+
+func (h *topicEventHub) Subscribe(ctx context.Context, topicID int64) (<-chan TopicEvent, error) {
+	c := make(chan TopicEvent, 16)
+
+	h.mu.Lock()
+	if h.subs[topicID] == nil {
+		h.subs[topicID] = make(map[chan TopicEvent]struct{})
+	}
+	h.subs[topicID][c] = struct{}{}
+	h.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		h.mu.Lock()
+		delete(h.subs[topicID], c)
+		if len(h.subs[topicID]) == 0 {
+			delete(h.subs, topicID)
+		}
+		close(c)
+		h.mu.Unlock()
+	}()
+
+	return c, nil
+}
+
+func (h *topicEventHub) Publish(ev TopicEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, topicID := range [...]int64{ev.TopicID, 0} {
+		for c := range h.subs[topicID] {
+			select {
+			case c <- ev:
+			default:
+				// Subscriber is too slow, drop the event.
+			}
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package gbb
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTopicEventHub(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hub := newTopicEventHub()
+
+	topicSub, err := hub.Subscribe(ctx, 42)
+	if err != nil {
+		t.Fatalf("cannot subscribe: %s", err)
+	}
+	allSub, err := hub.Subscribe(ctx, 0)
+	if err != nil {
+		t.Fatalf("cannot subscribe: %s", err)
+	}
+
+	hub.Publish(TopicEvent{TopicID: 1, CommentID: 10})
+	hub.Publish(TopicEvent{TopicID: 42, CommentID: 11})
+
+	if ev := <-topicSub; ev.CommentID != 11 {
+		t.Errorf("want comment 11, got %+v", ev)
+	}
+	if ev := <-allSub; ev.CommentID != 10 {
+		t.Errorf("want comment 10, got %+v", ev)
+	}
+	if ev := <-allSub; ev.CommentID != 11 {
+		t.Errorf("want comment 11, got %+v", ev)
+	}
+
+	cancel()
+
+	select {
+	case _, ok := <-topicSub:
+		if ok {
+			t.Fatal("unexpected event")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscription channel not closed")
+	}
+}
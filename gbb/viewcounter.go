@@ -0,0 +1,157 @@
+package gbb
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-surf/surf/errors"
+)
+
+// ViewCounter collects topic views in memory and periodically writes them to
+// the store in batches.
+//
+// Repeated views of the same topic by the same viewer within the configured
+// window are counted only once. Views of the topic author and of known bots
+// are ignored.
+type ViewCounter struct {
+	store  BBStore
+	window time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	seen    map[topicViewer]time.Time
+	pending map[int64]int64
+}
+
+type topicViewer struct {
+	topicID int64
+	viewer  string
+}
+
+// NewViewCounter returns a ViewCounter that flushes collected views to given
+// store. Views of the same topic by the same viewer are collapsed within given
+// window.
+func NewViewCounter(store BBStore, window time.Duration) *ViewCounter {
+	return &ViewCounter{
+		store:   store,
+		window:  window,
+		now:     time.Now,
+		seen:    make(map[topicViewer]time.Time),
+		pending: make(map[int64]int64),
+	}
+}
+
+// View registers a single topic view made by given request.
+func (vc *ViewCounter) View(r *http.Request, topic *Topic, user *User) {
+	if isBot(r.UserAgent()) {
+		return
+	}
+
+	var viewer string
+	if user.Authenticated() {
+		if user.UserID == topic.Author.UserID {
+			return
+		}
+		viewer = "user:" + strconv.FormatInt(user.UserID, 10)
+	} else {
+		viewer = "ip:" + remoteIP(r)
+	}
+
+	now := vc.now()
+	key := topicViewer{topicID: topic.TopicID, viewer: viewer}
+
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	if last, ok := vc.seen[key]; ok && now.Sub(last) < vc.window {
+		return
+	}
+	vc.seen[key] = now
+	vc.pending[topic.TopicID]++
+}
+
+// Pending returns the number of views that were not yet written to the store.
+func (vc *ViewCounter) Pending() int64 {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+
+	var total int64
+	for _, n := range vc.pending {
+		total += n
+	}
+	return total
+}
+
+// Flush writes all pending views to the store. If the write fails, views are
+// kept and retried with the next flush.
+func (vc *ViewCounter) Flush(ctx context.Context) error {
+	now := vc.now()
+
+	vc.mu.Lock()
+	pending := vc.pending
+	vc.pending = make(map[int64]int64)
+	for key, last := range vc.seen {
+		if now.Sub(last) >= vc.window {
+			delete(vc.seen, key)
+		}
+	}
+	vc.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if err := vc.store.IncrementTopicViews(ctx, pending); err != nil {
+		vc.mu.Lock()
+		for topicID, n := range pending {
+			vc.pending[topicID] += n
+		}
+		vc.mu.Unlock()
+		return errors.Wrap(err, "cannot increment topic views")
+	}
+	return nil
+}
+
+// Run flushes pending views every interval until given context is done. Before
+// returning, all remaining views are flushed.
+func (vc *ViewCounter) Run(ctx context.Context, interval time.Duration, onErr func(error)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if err := vc.Flush(ctx); err != nil {
+				onErr(err)
+			}
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			if err := vc.Flush(ctx); err != nil {
+				onErr(err)
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+func isBot(userAgent string) bool {
+	if userAgent == "" {
+		return true
+	}
+	ua := strings.ToLower(userAgent)
+	for _, name := range botUserAgents {
+		if strings.Contains(ua, name) {
+			return true
+		}
+	}
+	return false
+}
+
+var botUserAgents = []string{
+	"bot", "crawler", "spider", "slurp", "curl", "wget", "python-requests", "go-http-client",
+}
@@ -0,0 +1,81 @@
+package gbb
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestViewCounter(t *testing.T) {
+	store := &viewsRecordingStore{views: make(map[int64]int64)}
+	vc := NewViewCounter(store, time.Hour)
+
+	now := time.Now()
+	vc.now = func() time.Time { return now }
+
+	topic := &Topic{TopicID: 1, Author: User{UserID: 10}}
+	otherTopic := &Topic{TopicID: 2, Author: User{UserID: 10}}
+
+	browser := httptest.NewRequest("GET", "/t/1/", nil)
+	browser.Header.Set("User-Agent", "Mozilla/5.0")
+	browser.RemoteAddr = "10.0.0.1:4321"
+
+	bot := httptest.NewRequest("GET", "/t/1/", nil)
+	bot.Header.Set("User-Agent", "Googlebot/2.1")
+
+	vc.View(browser, topic, nil)
+	vc.View(browser, topic, nil)                    // reload
+	vc.View(browser, topic, &User{UserID: 10})      // author
+	vc.View(browser, topic, &User{UserID: 11})      // another user
+	vc.View(browser, otherTopic, &User{UserID: 11}) // another topic
+	vc.View(bot, topic, nil)                        // bot
+
+	if n := vc.Pending(); n != 3 {
+		t.Fatalf("want 3 pending views, got %d", n)
+	}
+
+	store.err = errors.New("boom")
+	if err := vc.Flush(context.Background()); err == nil {
+		t.Fatal("want flush error")
+	}
+	if n := vc.Pending(); n != 3 {
+		t.Fatalf("want 3 pending views after failed flush, got %d", n)
+	}
+
+	store.err = nil
+	if err := vc.Flush(context.Background()); err != nil {
+		t.Fatalf("cannot flush: %s", err)
+	}
+	if n := vc.Pending(); n != 0 {
+		t.Fatalf("want no pending views, got %d", n)
+	}
+	if store.views[1] != 2 || store.views[2] != 1 {
+		t.Fatalf("unexpected views: %v", store.views)
+	}
+
+	// Once the window passes, the same viewer is counted again.
+	now = now.Add(2 * time.Hour)
+	vc.View(browser, topic, nil)
+	if n := vc.Pending(); n != 1 {
+		t.Fatalf("want 1 pending view, got %d", n)
+	}
+}
+
+type viewsRecordingStore struct {
+	BBStore
+
+	err   error
+	views map[int64]int64
+}
+
+func (s *viewsRecordingStore) IncrementTopicViews(ctx context.Context, views map[int64]int64) error {
+	if s.err != nil {
+		return s.err
+	}
+	for id, n := range views {
+		s.views[id] += n
+	}
+	return nil
+}
@@ -1,22 +1,18 @@
 module github.com/husio/gbb
 
+go 1.27.1
+
 require (
 	github.com/go-surf/surf v0.0.0-20190222165809-a6b604fcc61e
 	github.com/lib/pq v1.0.0
-	github.com/microcosm-cc/bluemonday v0.0.0-20170830062424-68fecaef6026 // indirect
-	github.com/russross/blackfriday v0.0.0-20171011182219-6d1ef893fcb0 // indirect
-	github.com/sergi/go-diff v1.0.0 // indirect
-	github.com/shurcooL/github_flavored_markdown v0.0.0-20171120162553-28433ea3fc83
-	github.com/shurcooL/go v0.0.0-20171108033853-004faa6b0118 // indirect
-	github.com/shurcooL/go-goon v0.0.0-20170922171312-37c2f522c041 // indirect
-	github.com/shurcooL/graphql v0.0.0-20171201140101-d0549edd16dc // indirect
-	github.com/shurcooL/highlight_diff v0.0.0-20170515013008-09bb4053de1b // indirect
-	github.com/shurcooL/highlight_go v0.0.0-20170515013102-78fb10f4a5f8 // indirect
-	github.com/shurcooL/octiconssvg v0.0.0-20171128004830-38b02129bb64 // indirect
-	github.com/shurcooL/sanitized_anchor_name v0.0.0-20170918181015-86672fcb3f95 // indirect
-	github.com/sourcegraph/annotate v0.0.0-20160123013949-f4cad6c6324d // indirect
-	github.com/sourcegraph/syntaxhighlight v0.0.0-20170531221838-bd320f5d308e // indirect
+	github.com/microcosm-cc/bluemonday v0.0.0-20170830062424-68fecaef6026
+	github.com/russross/blackfriday v0.0.0-20171011182219-6d1ef893fcb0
 	golang.org/x/crypto v0.0.0-20180403160946-b2aa35443fbc
-	golang.org/x/net v0.0.0-20171129192339-a8b929477797 // indirect
-	gopkg.in/russross/blackfriday.v2 v2.0.0 // indirect
+	golang.org/x/net v0.0.0-20171129192339-a8b929477797
+	rsc.io/qr v0.2.0
+)
+
+require (
+	github.com/gomodule/redigo v2.0.0+incompatible // indirect
+	github.com/pkg/errors v0.8.1 // indirect
 )
@@ -0,0 +1,190 @@
+// Package ber implements the subset of the Basic Encoding Rules used by the
+// LDAP protocol. Only single octet identifiers and definite lengths are
+// supported.
+package ber
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Identifier octets of the universal types.
+const (
+	TagBoolean     byte = 0x01
+	TagInteger     byte = 0x02
+	TagOctetString byte = 0x04
+	TagNull        byte = 0x05
+	TagEnumerated  byte = 0x0a
+	TagSequence    byte = 0x30
+	TagSet         byte = 0x31
+)
+
+// Class and form bits of the identifier octet.
+const (
+	ClassApplication byte = 0x40
+	ClassContext     byte = 0x80
+	Constructed      byte = 0x20
+)
+
+// MaxLength is the size of the largest element that is decoded.
+const MaxLength = 1 << 20
+
+var ErrMalformed = errors.New("malformed element")
+
+// Element is a single decoded value.
+type Element struct {
+	// Tag is the identifier octet, including class and form bits.
+	Tag  byte
+	Data []byte
+}
+
+// Encode returns the element with given identifier and content.
+func Encode(tag byte, data []byte) []byte {
+	var length []byte
+	switch n := len(data); {
+	case n < 0x80:
+		length = []byte{byte(n)}
+	default:
+		for ; n > 0; n >>= 8 {
+			length = append([]byte{byte(n)}, length...)
+		}
+		length = append([]byte{0x80 | byte(len(length))}, length...)
+	}
+	b := make([]byte, 0, 1+len(length)+len(data))
+	b = append(b, tag)
+	b = append(b, length...)
+	return append(b, data...)
+}
+
+// Wrap returns a constructed element containing given encoded elements.
+func Wrap(tag byte, children ...[]byte) []byte {
+	var data []byte
+	for _, c := range children {
+		data = append(data, c...)
+	}
+	return Encode(tag, data)
+}
+
+// String returns an element holding given text.
+func String(tag byte, s string) []byte {
+	return Encode(tag, []byte(s))
+}
+
+// Int returns an element holding given number in two's complement form.
+func Int(tag byte, n int64) []byte {
+	data := []byte{byte(n)}
+	for n < -128 || n > 127 {
+		n >>= 8
+		data = append([]byte{byte(n)}, data...)
+	}
+	return Encode(tag, data)
+}
+
+// Bool returns a boolean element.
+func Bool(b bool) []byte {
+	if b {
+		return Encode(TagBoolean, []byte{0xff})
+	}
+	return Encode(TagBoolean, []byte{0x00})
+}
+
+// Read returns the next element from the stream.
+func Read(r *bufio.Reader) (Element, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return Element{}, err
+	}
+	length, err := readLength(r)
+	if err != nil {
+		return Element{}, err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return Element{}, err
+	}
+	return Element{Tag: tag, Data: data}, nil
+}
+
+func readLength(r io.ByteReader) (int, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if first < 0x80 {
+		return int(first), nil
+	}
+	octets := int(first & 0x7f)
+	if octets == 0 || octets > 4 {
+		return 0, fmt.Errorf("%s: unsupported length", ErrMalformed)
+	}
+	var length int
+	for i := 0; i < octets; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		length = length<<8 | int(b)
+	}
+	if length > MaxLength {
+		return 0, fmt.Errorf("%s: element too big", ErrMalformed)
+	}
+	return length, nil
+}
+
+// Children returns elements contained by the constructed element.
+func (e Element) Children() ([]Element, error) {
+	var children []Element
+	for rest := e.Data; len(rest) > 0; {
+		if len(rest) < 2 {
+			return nil, ErrMalformed
+		}
+		r := &sliceReader{b: rest[1:]}
+		length, err := readLength(r)
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		if length > len(r.b) {
+			return nil, ErrMalformed
+		}
+		children = append(children, Element{Tag: rest[0], Data: r.b[:length]})
+		rest = r.b[length:]
+	}
+	return children, nil
+}
+
+// Int returns the number held by the integer or enumerated element.
+func (e Element) Int() (int64, error) {
+	if len(e.Data) == 0 || len(e.Data) > 8 {
+		return 0, ErrMalformed
+	}
+	n := int64(int8(e.Data[0]))
+	for _, b := range e.Data[1:] {
+		n = n<<8 | int64(b)
+	}
+	return n, nil
+}
+
+// Text returns the content of the element as a string.
+func (e Element) Text() string {
+	return string(e.Data)
+}
+
+// Bool returns the value of the boolean element.
+func (e Element) Bool() bool {
+	return len(e.Data) == 1 && e.Data[0] != 0
+}
+
+type sliceReader struct {
+	b []byte
+}
+
+func (r *sliceReader) ReadByte() (byte, error) {
+	if len(r.b) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	b := r.b[0]
+	r.b = r.b[1:]
+	return b, nil
+}
@@ -0,0 +1,73 @@
+package ber
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestInt(t *testing.T) {
+	cases := map[int64][]byte{
+		0:      {0x02, 0x01, 0x00},
+		1:      {0x02, 0x01, 0x01},
+		127:    {0x02, 0x01, 0x7f},
+		128:    {0x02, 0x02, 0x00, 0x80},
+		256:    {0x02, 0x02, 0x01, 0x00},
+		-1:     {0x02, 0x01, 0xff},
+		-128:   {0x02, 0x01, 0x80},
+		-129:   {0x02, 0x02, 0xff, 0x7f},
+		100000: {0x02, 0x03, 0x01, 0x86, 0xa0},
+	}
+	for n, want := range cases {
+		got := Int(TagInteger, n)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%d: want % x, got % x", n, want, got)
+			continue
+		}
+		el, err := Read(bufio.NewReader(bytes.NewReader(got)))
+		if err != nil {
+			t.Errorf("%d: cannot read: %s", n, err)
+			continue
+		}
+		if decoded, err := el.Int(); err != nil || decoded != n {
+			t.Errorf("%d: decoded %d, %v", n, decoded, err)
+		}
+	}
+}
+
+func TestLongLength(t *testing.T) {
+	text := strings.Repeat("x", 300)
+	encoded := Wrap(TagSequence, String(TagOctetString, text), Bool(true))
+	if !bytes.Equal(encoded[:4], []byte{0x30, 0x82, 0x01, 0x33}) {
+		t.Fatalf("unexpected header % x", encoded[:4])
+	}
+
+	el, err := Read(bufio.NewReader(bytes.NewReader(encoded)))
+	if err != nil {
+		t.Fatalf("cannot read: %s", err)
+	}
+	children, err := el.Children()
+	if err != nil {
+		t.Fatalf("cannot decode children: %s", err)
+	}
+	if len(children) != 2 {
+		t.Fatalf("want 2 children, got %d", len(children))
+	}
+	if children[0].Text() != text {
+		t.Errorf("unexpected text %q", children[0].Text())
+	}
+	if !children[1].Bool() {
+		t.Error("want true")
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	el := Element{Tag: TagSequence, Data: []byte{0x04, 0x05, 'a', 'b'}}
+	if _, err := el.Children(); err == nil {
+		t.Fatal("want truncated child rejected")
+	}
+	if _, err := Read(bufio.NewReader(bytes.NewReader([]byte{0x04, 0x85, 1, 1, 1, 1, 1}))); err == nil {
+		t.Fatal("want unsupported length rejected")
+	}
+}
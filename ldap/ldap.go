@@ -0,0 +1,309 @@
+// Package ldap implements the subset of the LDAP v3 protocol needed to
+// authenticate users: simple bind and reading a single entry.
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/husio/gbb/ldap/internal/ber"
+)
+
+// Protocol operations, as defined in RFC 4511.
+const (
+	opBindRequest       = ber.ClassApplication | ber.Constructed | 0
+	opBindResponse      = ber.ClassApplication | ber.Constructed | 1
+	opUnbindRequest     = ber.ClassApplication | 2
+	opSearchRequest     = ber.ClassApplication | ber.Constructed | 3
+	opSearchResultEntry = ber.ClassApplication | ber.Constructed | 4
+	opSearchResultDone  = ber.ClassApplication | ber.Constructed | 5
+	opSearchResultRef   = ber.ClassApplication | ber.Constructed | 19
+
+	authSimple    = ber.ClassContext | 0
+	filterPresent = ber.ClassContext | 7
+)
+
+// Result codes used by the package.
+const (
+	ResultSuccess            = 0
+	ResultNoSuchObject       = 32
+	ResultInvalidCredentials = 49
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrNoSuchObject       = errors.New("no such object")
+	ErrProtocol           = errors.New("protocol error")
+)
+
+// ResultError is returned when the server responds with an unexpected result
+// code.
+type ResultError struct {
+	Code    int64
+	Message string
+}
+
+func (e *ResultError) Error() string {
+	return fmt.Sprintf("ldap result %d: %s", e.Code, e.Message)
+}
+
+// Conn is a connection to the LDAP server. It is not safe for concurrent
+// use.
+type Conn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	msgID int64
+}
+
+// Dial connects to the server at given ldap:// or ldaps:// URL. Context
+// deadline applies to the whole lifetime of the connection.
+func Dial(ctx context.Context, rawurl string, tlsConfig *tls.Config) (*Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL: %s", err)
+	}
+
+	var (
+		dialer net.Dialer
+		conn   net.Conn
+	)
+	switch u.Scheme {
+	case "ldap":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		conn, err = dialer.DialContext(ctx, "tcp", host)
+	case "ldaps":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName = u.Hostname()
+		}
+		conn, err = dialer.DialContext(ctx, "tcp", host)
+		if err == nil {
+			conn = tls.Client(conn, tlsConfig)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return &Conn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// Close sends the unbind request and closes the connection.
+func (c *Conn) Close() error {
+	c.send(ber.Encode(opUnbindRequest, nil))
+	return c.conn.Close()
+}
+
+// Bind authenticates the connection using the simple method.
+// ErrInvalidCredentials is returned if the DN or the password is not valid.
+//
+// Bind with an empty password is an anonymous bind that succeeds for any
+// DN, so the caller must not accept empty passwords.
+func (c *Conn) Bind(dn, password string) error {
+	id, err := c.send(ber.Wrap(opBindRequest,
+		ber.Int(ber.TagInteger, 3),
+		ber.String(ber.TagOctetString, dn),
+		ber.String(authSimple, password),
+	))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.Tag != opBindResponse {
+		return fmt.Errorf("%s: unexpected bind response %x", ErrProtocol, op.Tag)
+	}
+	return resultError(op)
+}
+
+// Entry is an object of the directory.
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Values returns values of the attribute. Attribute names are case
+// insensitive.
+func (e *Entry) Values(name string) []string {
+	for n, values := range e.Attributes {
+		if strings.EqualFold(n, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+// Entry returns the object with given DN, with only given attributes.
+// ErrNoSuchObject is returned if the object does not exist or cannot be read
+// by the bound user.
+func (c *Conn) Entry(dn string, attributes []string) (*Entry, error) {
+	attrs := make([][]byte, len(attributes))
+	for i, a := range attributes {
+		attrs[i] = ber.String(ber.TagOctetString, a)
+	}
+	id, err := c.send(ber.Wrap(opSearchRequest,
+		ber.String(ber.TagOctetString, dn),
+		ber.Int(ber.TagEnumerated, 0), // base object scope
+		ber.Int(ber.TagEnumerated, 0), // never dereference aliases
+		ber.Int(ber.TagInteger, 1),    // size limit
+		ber.Int(ber.TagInteger, 0),    // time limit
+		ber.Bool(false),               // types only
+		ber.String(filterPresent, "objectClass"),
+		ber.Wrap(ber.TagSequence, attrs...),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	var entry *Entry
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.Tag {
+		case opSearchResultEntry:
+			if entry, err = decodeEntry(op); err != nil {
+				return nil, err
+			}
+		case opSearchResultRef:
+			// Referrals are not followed.
+		case opSearchResultDone:
+			if err := resultError(op); err != nil {
+				return nil, err
+			}
+			if entry == nil {
+				return nil, ErrNoSuchObject
+			}
+			return entry, nil
+		default:
+			return nil, fmt.Errorf("%s: unexpected search response %x", ErrProtocol, op.Tag)
+		}
+	}
+}
+
+func decodeEntry(op ber.Element) (*Entry, error) {
+	fields, err := op.Children()
+	if err != nil || len(fields) != 2 {
+		return nil, fmt.Errorf("%s: malformed entry", ErrProtocol)
+	}
+	attributes, err := fields[1].Children()
+	if err != nil {
+		return nil, fmt.Errorf("%s: malformed attributes", ErrProtocol)
+	}
+	entry := &Entry{
+		DN:         fields[0].Text(),
+		Attributes: make(map[string][]string, len(attributes)),
+	}
+	for _, attr := range attributes {
+		parts, err := attr.Children()
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("%s: malformed attribute", ErrProtocol)
+		}
+		values, err := parts[1].Children()
+		if err != nil {
+			return nil, fmt.Errorf("%s: malformed attribute values", ErrProtocol)
+		}
+		name := parts[0].Text()
+		for _, v := range values {
+			entry.Attributes[name] = append(entry.Attributes[name], v.Text())
+		}
+	}
+	return entry, nil
+}
+
+// resultError returns the error described by the LDAPResult of the response
+// or nil if the operation was successful.
+func resultError(op ber.Element) error {
+	fields, err := op.Children()
+	if err != nil || len(fields) < 3 {
+		return fmt.Errorf("%s: malformed result", ErrProtocol)
+	}
+	code, err := fields[0].Int()
+	if err != nil {
+		return fmt.Errorf("%s: malformed result code", ErrProtocol)
+	}
+	switch code {
+	case ResultSuccess:
+		return nil
+	case ResultInvalidCredentials:
+		return ErrInvalidCredentials
+	case ResultNoSuchObject:
+		return ErrNoSuchObject
+	default:
+		return &ResultError{Code: code, Message: fields[2].Text()}
+	}
+}
+
+// send writes the message with given protocol operation and returns its ID.
+func (c *Conn) send(op []byte) (int64, error) {
+	c.msgID++
+	msg := ber.Wrap(ber.TagSequence, ber.Int(ber.TagInteger, c.msgID), op)
+	if _, err := c.conn.Write(msg); err != nil {
+		return 0, err
+	}
+	return c.msgID, nil
+}
+
+// receive returns the protocol operation of the next message, which must be
+// a response to the message with given ID.
+func (c *Conn) receive(id int64) (ber.Element, error) {
+	msg, err := ber.Read(c.r)
+	if err != nil {
+		return ber.Element{}, err
+	}
+	if msg.Tag != ber.TagSequence {
+		return ber.Element{}, fmt.Errorf("%s: unexpected message %x", ErrProtocol, msg.Tag)
+	}
+	fields, err := msg.Children()
+	if err != nil || len(fields) < 2 {
+		return ber.Element{}, fmt.Errorf("%s: malformed message", ErrProtocol)
+	}
+	if got, err := fields[0].Int(); err != nil || got != id {
+		return ber.Element{}, fmt.Errorf("%s: unexpected message ID", ErrProtocol)
+	}
+	return fields[1], nil
+}
+
+// EscapeDN returns the value escaped for use in a distinguished name, as
+// described in RFC 4514.
+func EscapeDN(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == 0:
+			b.WriteString(`\00`)
+		case strings.IndexByte(`"+,;<>\=`, c) >= 0,
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(value)-1 && c == ' ':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,78 @@
+package ldap_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/husio/gbb/ldap"
+	"github.com/husio/gbb/ldap/ldaptest"
+)
+
+func TestBindAndEntry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := ldaptest.NewServer(map[string]ldaptest.Entry{
+		"uid=bob,ou=people,dc=example,dc=com": {
+			Password: "secret",
+			Attributes: map[string][]string{
+				"mail":     {"bob@example.com"},
+				"memberOf": {"cn=staff,ou=groups,dc=example,dc=com", "cn=users,ou=groups,dc=example,dc=com"},
+			},
+		},
+	})
+	defer srv.Close()
+
+	conn, err := ldap.Dial(ctx, srv.URL, nil)
+	if err != nil {
+		t.Fatalf("cannot connect: %s", err)
+	}
+	defer conn.Close()
+
+	if err := conn.Bind("uid=bob,ou=people,dc=example,dc=com", "invalid"); err != ldap.ErrInvalidCredentials {
+		t.Fatalf("want ErrInvalidCredentials, got %v", err)
+	}
+	if err := conn.Bind("uid=rick,ou=people,dc=example,dc=com", "secret"); err != ldap.ErrInvalidCredentials {
+		t.Fatalf("want ErrInvalidCredentials, got %v", err)
+	}
+	if err := conn.Bind("UID=Bob,ou=people,dc=example,dc=com", "secret"); err != nil {
+		t.Fatalf("cannot bind: %s", err)
+	}
+
+	entry, err := conn.Entry("uid=bob,ou=people,dc=example,dc=com", []string{"memberof"})
+	if err != nil {
+		t.Fatalf("cannot read entry: %s", err)
+	}
+	if entry.DN != "uid=bob,ou=people,dc=example,dc=com" {
+		t.Errorf("unexpected DN %q", entry.DN)
+	}
+	want := []string{"cn=staff,ou=groups,dc=example,dc=com", "cn=users,ou=groups,dc=example,dc=com"}
+	if got := entry.Values("MEMBEROF"); !reflect.DeepEqual(want, got) {
+		t.Errorf("want %q groups, got %q", want, got)
+	}
+	if got := entry.Values("mail"); got != nil {
+		t.Errorf("want only requested attributes, got mail %q", got)
+	}
+
+	if _, err := conn.Entry("uid=rick,ou=people,dc=example,dc=com", nil); err != ldap.ErrNoSuchObject {
+		t.Fatalf("want ErrNoSuchObject, got %v", err)
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	cases := map[string]string{
+		"bob":          "bob",
+		"bob,ou=admin": `bob\,ou\=admin`,
+		" bob ":        `\ bob\ `,
+		"#bob":         `\#bob`,
+		`a+b"c\d<e>f;`: `a\+b\"c\\d\<e\>f\;`,
+		"a\x00b":       `a\00b`,
+	}
+	for in, want := range cases {
+		if got := ldap.EscapeDN(in); got != want {
+			t.Errorf("%q: want %q, got %q", in, want, got)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// Package ldaptest provides an in-process LDAP server for tests. It supports
+// only the operations used by the ldap package.
+package ldaptest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/husio/gbb/ldap/internal/ber"
+)
+
+// Entry is an object of the directory. Users can bind using the DN of the
+// entry and its password.
+type Entry struct {
+	Password   string
+	Attributes map[string][]string
+}
+
+// Server serves a fixed set of entries.
+type Server struct {
+	// URL is the ldap:// address of the server.
+	URL string
+
+	ln      net.Listener
+	entries map[string]Entry
+	dns     map[string]string
+	wg      sync.WaitGroup
+}
+
+// NewServer starts the server with given entries, mapped by their DN.
+// Caller must close it when done.
+func NewServer(entries map[string]Entry) *Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("cannot listen: %s", err))
+	}
+	s := &Server{
+		URL:     "ldap://" + ln.Addr().String(),
+		ln:      ln,
+		entries: make(map[string]Entry, len(entries)),
+		dns:     make(map[string]string, len(entries)),
+	}
+	// Distinguished names are compared case insensitively.
+	for dn, e := range entries {
+		s.entries[strings.ToLower(dn)] = e
+		s.dns[strings.ToLower(dn)] = dn
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Close stops the server and waits for all connections to finish.
+func (s *Server) Close() {
+	s.ln.Close()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+			s.handle(conn)
+		}()
+	}
+}
+
+const (
+	opBindRequest       = ber.ClassApplication | ber.Constructed | 0
+	opBindResponse      = ber.ClassApplication | ber.Constructed | 1
+	opUnbindRequest     = ber.ClassApplication | 2
+	opSearchRequest     = ber.ClassApplication | ber.Constructed | 3
+	opSearchResultEntry = ber.ClassApplication | ber.Constructed | 4
+	opSearchResultDone  = ber.ClassApplication | ber.Constructed | 5
+)
+
+const (
+	resultSuccess            = 0
+	resultProtocolError      = 2
+	resultNoSuchObject       = 32
+	resultInvalidCredentials = 49
+	resultUnwillingToPerform = 53
+)
+
+func (s *Server) handle(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	var bound string
+	for {
+		msg, err := ber.Read(r)
+		if err != nil {
+			return
+		}
+		fields, err := msg.Children()
+		if err != nil || len(fields) < 2 {
+			return
+		}
+		id, err := fields[0].Int()
+		if err != nil {
+			return
+		}
+		op := fields[1]
+
+		var responses [][]byte
+		switch op.Tag {
+		case opBindRequest:
+			var code int64
+			code, bound = s.bind(op)
+			responses = append(responses, result(opBindResponse, code))
+		case opSearchRequest:
+			responses = s.search(op, bound)
+		case opUnbindRequest:
+			return
+		default:
+			// Other operations are not supported.
+			return
+		}
+		for _, resp := range responses {
+			msg := ber.Wrap(ber.TagSequence, ber.Int(ber.TagInteger, id), resp)
+			if _, err := conn.Write(msg); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// bind returns the result code and the DN the connection is bound to.
+func (s *Server) bind(op ber.Element) (int64, string) {
+	fields, err := op.Children()
+	if err != nil || len(fields) != 3 {
+		return resultProtocolError, ""
+	}
+	dn, password := strings.ToLower(fields[1].Text()), fields[2].Text()
+	if password == "" {
+		// Unauthenticated bind.
+		return resultSuccess, ""
+	}
+	if e, ok := s.entries[dn]; !ok || e.Password != password {
+		return resultInvalidCredentials, ""
+	}
+	return resultSuccess, dn
+}
+
+// search returns the base object, which is the only supported search. Only
+// bound users can read entries.
+func (s *Server) search(op ber.Element, bound string) [][]byte {
+	fields, err := op.Children()
+	if err != nil || len(fields) != 8 {
+		return [][]byte{result(opSearchResultDone, resultProtocolError)}
+	}
+	if scope, _ := fields[1].Int(); scope != 0 {
+		return [][]byte{result(opSearchResultDone, resultUnwillingToPerform)}
+	}
+	if bound == "" {
+		return [][]byte{result(opSearchResultDone, resultNoSuchObject)}
+	}
+	dn := strings.ToLower(fields[0].Text())
+	e, ok := s.entries[dn]
+	if !ok {
+		return [][]byte{result(opSearchResultDone, resultNoSuchObject)}
+	}
+
+	requested, err := fields[7].Children()
+	if err != nil {
+		return [][]byte{result(opSearchResultDone, resultProtocolError)}
+	}
+	var attrs [][]byte
+	for name, values := range e.Attributes {
+		if !isRequested(requested, name) {
+			continue
+		}
+		vals := make([][]byte, len(values))
+		for i, v := range values {
+			vals[i] = ber.String(ber.TagOctetString, v)
+		}
+		attrs = append(attrs, ber.Wrap(ber.TagSequence,
+			ber.String(ber.TagOctetString, name),
+			ber.Wrap(ber.TagSet, vals...),
+		))
+	}
+	entry := ber.Wrap(opSearchResultEntry,
+		ber.String(ber.TagOctetString, s.dns[dn]),
+		ber.Wrap(ber.TagSequence, attrs...),
+	)
+	return [][]byte{entry, result(opSearchResultDone, resultSuccess)}
+}
+
+// isRequested returns true if the attribute was requested. No attributes
+// means all.
+func isRequested(requested []ber.Element, name string) bool {
+	if len(requested) == 0 {
+		return true
+	}
+	for _, r := range requested {
+		if strings.EqualFold(r.Text(), name) || r.Text() == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func result(op byte, code int64) []byte {
+	return ber.Wrap(op,
+		ber.Int(ber.TagEnumerated, code),
+		ber.String(ber.TagOctetString, ""),
+		ber.String(ber.TagOctetString, ""),
+	)
+}
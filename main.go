@@ -1,8 +1,11 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
 	"database/sql"
+	"expvar"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
@@ -10,29 +13,86 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/go-surf/surf"
+	"github.com/husio/gbb/blob"
 	"github.com/husio/gbb/gbb"
 	"github.com/husio/gbb/ivatar"
-	"github.com/shurcooL/github_flavored_markdown"
+	"github.com/husio/gbb/markdown"
+	"github.com/husio/gbb/metrics"
+	"github.com/husio/gbb/oidc"
 )
 
 func main() {
 	env := surf.NewEnvConf()
 	conf := configuration{
-		Debug:       env.Bool("DEBUG", false, "When true, application provides additional debug information. Use only during local development."),
-		HttpPort:    env.Str("PORT", "8000", "HTTP server port."),
-		Secret:      env.Secret("SECRET", "asoihqw0hqf098yr1309ry{RQ#Y)ASY{F[0u9rq3[0uqfafasffas", "Secret value used for security."),
-		DatabaseUrl: env.Secret("DATABASE_URL", `host='localhost' port='5432' user='postgres' dbname='postgres' sslmode='disable'`, "PostgreSQL database connection details."),
-		NoCsrf:      env.Bool("NO_CSRF", false, "Do not require CSRF token. Use only during local development."),
-		NoLogs:      env.Bool("NO_LOGS", false, "If true, all log messages are discarded."),
+		Debug:             env.Bool("DEBUG", false, "When true, application provides additional debug information. Use only during local development."),
+		HttpPort:          env.Str("PORT", "8000", "HTTP server port."),
+		Secret:            env.Secret("SECRET", "asoihqw0hqf098yr1309ry{RQ#Y)ASY{F[0u9rq3[0uqfafasffas", "Secret value used for security."),
+		DatabaseUrl:       env.Secret("DATABASE_URL", `host='localhost' port='5432' user='postgres' dbname='postgres' sslmode='disable'`, "PostgreSQL database connection details."),
+		NoCsrf:            env.Bool("NO_CSRF", false, "Do not require CSRF token. Use only during local development."),
+		NoLogs:            env.Bool("NO_LOGS", false, "If true, all log messages are discarded."),
+		TopicMinComments:  env.Int("TOPIC_MIN_COMMENTS", 3, "Number of comments a user must write before being allowed to create topics."),
+		Reactions:         env.Str("REACTIONS", "👍 👎 😄 🎉 😕 ❤️", "Space separated list of reactions that can be added to comments."),
+		AttachmentsDir:    env.Str("ATTACHMENTS_DIR", "./attachments", "Directory where attached files are stored, unless S3 storage is configured."),
+		AttachmentSize:    env.Int("ATTACHMENT_MAX_SIZE", 5<<20, "Maximum size of a single attached file in bytes."),
+		AttachmentCount:   env.Int("ATTACHMENT_MAX_COUNT", 5, "Maximum number of files attached to a single comment."),
+		S3Endpoint:        env.Str("S3_ENDPOINT", "", "URL of the S3 compatible service used to store attached files. When empty, files are stored in the local directory."),
+		S3Bucket:          env.Str("S3_BUCKET", "gbb-attachments", "S3 bucket name."),
+		S3Region:          env.Str("S3_REGION", "us-east-1", "S3 region."),
+		S3AccessKey:       env.Str("S3_ACCESS_KEY", "", "S3 access key."),
+		S3SecretKey:       env.Secret("S3_SECRET_KEY", "", "S3 secret key."),
+		MarkdownCacheSize: env.Int("MARKDOWN_CACHE_SIZE", 10000, "Number of rendered comments kept in memory."),
+		DeletionGraceDays: env.Int("ACCOUNT_DELETION_DAYS", 14, "Number of days after which a requested account deletion is carried out. Until then, the user can cancel it."),
+
+		MessageMinReputation: env.Int("MESSAGE_MIN_REPUTATION", 0, "Reputation a user must gain before being allowed to start private conversations."),
+		MessageMinComments:   env.Int("MESSAGE_MIN_COMMENTS", 1, "Number of comments a user must write before being allowed to start private conversations."),
+		MessageMaxRecipients: env.Int("MESSAGE_MAX_RECIPIENTS", 10, "Maximum number of users a private conversation can be started with."),
+		MessageDailyLimit:    env.Int("MESSAGE_DAILY_LIMIT", 20, "Maximum number of private conversations a user can start within 24 hours. Use 0 for no limit."),
+
+		Registration:      env.Str("REGISTRATION", "open", "Who can register a new account: open for anyone, invite for users with an invite or closed for nobody."),
+		TrustExternal:     env.Bool("TRUST_EXTERNAL_REGISTRATION", false, "When true, users signing in with single sign-on or LDAP for the first time get an account even if registration is by invitation only. Closed registration always prevents it."),
+		UserInvites:       env.Bool("USER_INVITES", false, "When true, users with enough standing can invite others. Otherwise only admins can."),
+		InviteMinRep:      env.Int("INVITE_MIN_REPUTATION", 50, "Reputation a user must gain before being allowed to invite others."),
+		InviteMinComments: env.Int("INVITE_MIN_COMMENTS", 20, "Number of comments a user must write before being allowed to invite others."),
+		RegisterIPLimit:   env.Int("REGISTER_IP_LIMIT", 5, "Maximum number of accounts registered from a single IP address within an hour. Use 0 for no limit."),
+		TopicUserLimit:    env.Int("TOPIC_USER_LIMIT", 5, "Maximum number of topics a user can create within an hour. Use 0 for no limit."),
+		TopicIPLimit:      env.Int("TOPIC_IP_LIMIT", 20, "Maximum number of topics created from a single IP address within an hour. Use 0 for no limit."),
+		CommentUserLimit:  env.Int("COMMENT_USER_LIMIT", 60, "Maximum number of comments a user can write within an hour. Use 0 for no limit."),
+		CommentIPLimit:    env.Int("COMMENT_IP_LIMIT", 200, "Maximum number of comments written from a single IP address within an hour. Use 0 for no limit."),
+		ApproveFirstPosts: env.Int("APPROVE_FIRST_POSTS", 0, "Number of first topics and comments of a new account that must be approved by a moderator."),
+		SpamMaxLinks:      env.Int("SPAM_MAX_LINKS", 5, "Posts with more links are held for moderator approval. Use 0 for no limit."),
+		SpamKeywords:      env.Str("SPAM_KEYWORDS", "", "Comma separated list of phrases. Posts containing any of them are held for moderator approval."),
+		SpamThreshold:     env.Int("SPAM_THRESHOLD", 95, "Spam probability, in percent, from which the Bayesian filter holds posts for moderator approval."),
+		SpamMinTrained:    env.Int("SPAM_MIN_TRAINED", 20, "Number of both spam and legitimate posts the Bayesian filter must learn from before classifying."),
+
+		OIDCIssuer:       env.Str("OIDC_ISSUER", "", "URL of the OpenID Connect provider used for single sign-on. When empty, single sign-on is disabled."),
+		OIDCName:         env.Str("OIDC_NAME", "Single Sign-On", "Name of the identity provider displayed on the login page."),
+		OIDCClientID:     env.Str("OIDC_CLIENT_ID", "", "OpenID Connect client ID."),
+		OIDCClientSecret: env.Secret("OIDC_CLIENT_SECRET", "", "OpenID Connect client secret."),
+		OIDCRedirectURL:  env.Str("OIDC_REDIRECT_URL", "http://localhost:8000/login/oidc/callback/", "Absolute URL of the single sign-on callback, as registered with the provider."),
+		OIDCScopes:       env.Str("OIDC_SCOPES", "profile email", "Space separated list of scopes requested from the provider in addition to openid."),
+		OIDCGroupsClaim:  env.Str("OIDC_GROUPS_CLAIM", "groups", "Name of the ID token claim listing groups of the user."),
+		OIDCGroupScopes:  env.Str("OIDC_GROUP_SCOPES", "", "Comma separated list of group:scope pairs, for example staff:moderator,wheel:admin. Mapped scopes are granted and revoked on every sign in."),
+
+		LDAPURL:         env.Str("LDAP_URL", "", "URL of the LDAP server used to authenticate users, for example ldaps://ldap.example.com. When empty, only local users can login with a password."),
+		LDAPUserDN:      env.Str("LDAP_USER_DN", "uid=%s,ou=people,dc=example,dc=com", "Template of the user entry DN. %s is replaced with the login."),
+		LDAPGroupAttr:   env.Str("LDAP_GROUP_ATTRIBUTE", "memberOf", "User entry attribute listing groups of the user."),
+		LDAPGroupScopes: env.Str("LDAP_GROUP_SCOPES", "", "Comma separated list of group:scope pairs. Group is the group DN or its first component value, for example staff:moderator. Mapped scopes are granted and revoked on every login."),
+
+		MetricsAddr:  env.Str("METRICS_ADDR", "", "Address of a separate HTTP server exposing only Prometheus metrics at /metrics and runtime variables at /_/vars, for example :9100. When empty, both are exposed by the main server if the metrics token is set, and are disabled otherwise."),
+		MetricsToken: env.Secret("METRICS_TOKEN", "", "Bearer token required to read metrics and runtime variables."),
 	}
 
 	if len(os.Args) > 1 {
 		switch os.Args[1] {
 		case "-h", "--help", "help":
 			env.WriteHelp(os.Stderr)
+			fmt.Fprintln(os.Stderr, "\nCommands:")
+			fmt.Fprintln(os.Stderr, "  export    Write the whole forum to a portable archive.")
+			fmt.Fprintln(os.Stderr, "  import    Restore the forum from an archive into an empty database.")
 			os.Exit(0)
 		}
 	}
@@ -47,6 +107,23 @@ func main() {
 		signal.Stop(sigc)
 	}()
 
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "export":
+			err = runExport(ctx, conf, os.Args[2:])
+		case "import":
+			err = runImport(ctx, conf, os.Args[2:])
+		default:
+			err = fmt.Errorf("unknown command %q", os.Args[1])
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[1], err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if err := run(ctx, conf); err != nil {
 		fmt.Fprintf(os.Stderr, "application: %s\n", err)
 		os.Exit(1)
@@ -54,12 +131,62 @@ func main() {
 }
 
 type configuration struct {
-	Debug       bool
-	HttpPort    string
-	Secret      string
-	DatabaseUrl string
-	NoCsrf      bool
-	NoLogs      bool
+	Debug             bool
+	HttpPort          string
+	Secret            string
+	DatabaseUrl       string
+	NoCsrf            bool
+	NoLogs            bool
+	Reactions         string
+	TopicMinComments  int
+	AttachmentsDir    string
+	AttachmentSize    int
+	AttachmentCount   int
+	S3Endpoint        string
+	S3Bucket          string
+	S3Region          string
+	S3AccessKey       string
+	S3SecretKey       string
+	MarkdownCacheSize int
+	DeletionGraceDays int
+
+	MessageMinReputation int
+	MessageMinComments   int
+	MessageMaxRecipients int
+	MessageDailyLimit    int
+
+	Registration      string
+	TrustExternal     bool
+	UserInvites       bool
+	InviteMinRep      int
+	InviteMinComments int
+	RegisterIPLimit   int
+	TopicUserLimit    int
+	TopicIPLimit      int
+	CommentUserLimit  int
+	CommentIPLimit    int
+	ApproveFirstPosts int
+	SpamMaxLinks      int
+	SpamKeywords      string
+	SpamThreshold     int
+	SpamMinTrained    int
+
+	OIDCIssuer       string
+	OIDCName         string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCScopes       string
+	OIDCGroupsClaim  string
+	OIDCGroupScopes  string
+
+	LDAPURL         string
+	LDAPUserDN      string
+	LDAPGroupAttr   string
+	LDAPGroupScopes string
+
+	MetricsAddr  string
+	MetricsToken string
 }
 
 func run(ctx context.Context, conf configuration) error {
@@ -79,10 +206,207 @@ func run(ctx context.Context, conf configuration) error {
 		return fmt.Errorf("cannot create bb store: %s", err)
 	}
 
+	var (
+		metricsRegistry *metrics.Registry
+		appMetrics      *gbb.Metrics
+	)
+	if conf.MetricsAddr != "" || conf.MetricsToken != "" {
+		metricsRegistry = metrics.NewRegistry()
+		appMetrics = gbb.NewMetrics(metricsRegistry)
+		gbb.CollectDBStats(metricsRegistry, db)
+		bbStore = appMetrics.InstrumentBBStore(bbStore)
+		readTracker = appMetrics.InstrumentReadProgressTracker(readTracker)
+	}
+
+	topicEvents, err := gbb.NewPostgresTopicEventBroker(ctx, conf.DatabaseUrl)
+	if err != nil {
+		return fmt.Errorf("cannot create topic event broker: %s", err)
+	}
+
+	reactions, err := gbb.NewPostgresReactionStore(db)
+	if err != nil {
+		return fmt.Errorf("cannot create reaction store: %s", err)
+	}
+	reactionKinds := strings.Fields(conf.Reactions)
+
+	polls, err := gbb.NewPostgresPollStore(db)
+	if err != nil {
+		return fmt.Errorf("cannot create poll store: %s", err)
+	}
+
+	references, err := gbb.NewPostgresCommentReferenceStore(db)
+	if err != nil {
+		return fmt.Errorf("cannot create comment reference store: %s", err)
+	}
+
+	drafts, err := gbb.NewPostgresDraftStore(db)
+	if err != nil {
+		return fmt.Errorf("cannot create draft store: %s", err)
+	}
+
+	messages, err := gbb.NewPostgresMessageStore(db)
+	if err != nil {
+		return fmt.Errorf("cannot create message store: %s", err)
+	}
+	moderation, err := gbb.NewPostgresModerationStore(db)
+	if err != nil {
+		return fmt.Errorf("cannot create moderation store: %s", err)
+	}
+
+	pending, err := gbb.NewPostgresPendingPostStore(db)
+	if err != nil {
+		return fmt.Errorf("cannot create pending post store: %s", err)
+	}
+
+	twoFactor, err := gbb.NewPostgresTwoFactorStore(db)
+	if err != nil {
+		return fmt.Errorf("cannot create two factor store: %s", err)
+	}
+	twoFactorLimit := gbb.NewRateLimiter(5, 5*time.Minute)
+
+	identities, err := gbb.NewPostgresIdentityStore(db)
+	if err != nil {
+		return fmt.Errorf("cannot create identity store: %s", err)
+	}
+	registration, err := gbb.ParseRegistrationMode(conf.Registration)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %s", err)
+	}
+	// Users of the identity provider or LDAP server do not have an
+	// invite, so they get an account only if they are trusted.
+	externalRegistration := registration
+	if registration == gbb.RegistrationInvite && conf.TrustExternal {
+		externalRegistration = gbb.RegistrationOpen
+	}
+
+	var sso *gbb.SingleSignOn
+	if conf.OIDCIssuer != "" {
+		provider, err := oidc.Discover(ctx, conf.OIDCIssuer)
+		if err != nil {
+			return fmt.Errorf("cannot discover OpenID Connect provider: %s", err)
+		}
+		provider.ClientID = conf.OIDCClientID
+		provider.ClientSecret = conf.OIDCClientSecret
+		provider.RedirectURL = conf.OIDCRedirectURL
+		provider.Scopes = strings.Fields(conf.OIDCScopes)
+		provider.GroupsClaim = conf.OIDCGroupsClaim
+		groupScopes, err := gbb.ParseGroupScopes(conf.OIDCGroupScopes)
+		if err != nil {
+			return fmt.Errorf("invalid group scopes: %s", err)
+		}
+		sso = &gbb.SingleSignOn{
+			Provider:     provider,
+			Name:         conf.OIDCName,
+			GroupScopes:  groupScopes,
+			Registration: externalRegistration,
+		}
+	}
+
+	spamFilter, err := gbb.NewPostgresSpamFilter(db, float64(conf.SpamThreshold)/100, int64(conf.SpamMinTrained))
+	if err != nil {
+		return fmt.Errorf("cannot create spam filter: %s", err)
+	}
+	classifier := gbb.ClassifierChain{
+		&gbb.HeuristicClassifier{
+			MaxLinks: conf.SpamMaxLinks,
+			Keywords: strings.Split(conf.SpamKeywords, ","),
+		},
+		spamFilter,
+	}
+	invites, err := gbb.NewPostgresInviteStore(db)
+	if err != nil {
+		return fmt.Errorf("cannot create invite store: %s", err)
+	}
+	registrationLimit := gbb.NewRateLimiter(conf.RegisterIPLimit, time.Hour)
+	topicGuard := &gbb.PostingGuard{
+		PerUser:      gbb.NewRateLimiter(conf.TopicUserLimit, time.Hour),
+		PerIP:        gbb.NewRateLimiter(conf.TopicIPLimit, time.Hour),
+		ApproveFirst: int64(conf.ApproveFirstPosts),
+		Classifier:   classifier,
+	}
+	commentGuard := &gbb.PostingGuard{
+		PerUser:      gbb.NewRateLimiter(conf.CommentUserLimit, time.Hour),
+		PerIP:        gbb.NewRateLimiter(conf.CommentIPLimit, time.Hour),
+		ApproveFirst: int64(conf.ApproveFirstPosts),
+		Classifier:   classifier,
+	}
+
+	messageLimits := gbb.MessageLimits{
+		MaxRecipients: conf.MessageMaxRecipients,
+		MaxDaily:      conf.MessageDailyLimit,
+	}
+
+	attachments, err := gbb.NewPostgresAttachmentStore(db)
+	if err != nil {
+		return fmt.Errorf("cannot create attachment store: %s", err)
+	}
+	attachmentLimits := gbb.AttachmentLimits{
+		MaxSize:  int64(conf.AttachmentSize),
+		MaxCount: conf.AttachmentCount,
+	}
+
+	blobs, err := newBlobStore(conf)
+	if err != nil {
+		return fmt.Errorf("cannot create blob store: %s", err)
+	}
+
+	// Deleting an account touches tables of all other stores, so it
+	// must be created last.
+	accounts, err := gbb.NewPostgresAccountStore(db)
+	if err != nil {
+		return fmt.Errorf("cannot create account store: %s", err)
+	}
+	deletionGrace := time.Duration(conf.DeletionGraceDays) * 24 * time.Hour
+
+	scopeThresholds := []gbb.ScopeThreshold{
+		gbb.TopicCreationThreshold(int64(conf.TopicMinComments)),
+		gbb.ConversationThreshold(int64(conf.MessageMinReputation), int64(conf.MessageMinComments)),
+	}
+	if conf.UserInvites {
+		scopeThresholds = append(scopeThresholds, gbb.InviteThreshold(int64(conf.InviteMinRep), int64(conf.InviteMinComments)))
+	}
+
+	authenticator := gbb.AuthenticatorChain{bbStore}
+	if conf.LDAPURL != "" {
+		groupScopes, err := gbb.ParseGroupScopes(conf.LDAPGroupScopes)
+		if err != nil {
+			return fmt.Errorf("invalid LDAP group scopes: %s", err)
+		}
+		authenticator = append(authenticator, &gbb.LDAPAuthenticator{
+			URL:             conf.LDAPURL,
+			UserDN:          conf.LDAPUserDN,
+			GroupAttribute:  conf.LDAPGroupAttr,
+			GroupScopes:     groupScopes,
+			Timeout:         10 * time.Second,
+			Registration:    externalRegistration,
+			Store:           bbStore,
+			Identities:      identities,
+			ScopeThresholds: scopeThresholds,
+		})
+	}
+
+	views := gbb.NewViewCounter(bbStore, time.Hour)
+	expvar.Publish("topic_views_pending", expvar.Func(func() interface{} {
+		return views.Pending()
+	}))
+
+	markdownRenderer := markdown.NewRenderer(gbb.CommentReferencePlugin())
+	markdownCache := markdown.NewCache(markdownRenderer, conf.MarkdownCacheSize)
+	expvar.Publish("markdown_cache", expvar.Func(func() interface{} {
+		hits, misses := markdownCache.Stats()
+		return map[string]int64{"hits": hits, "misses": misses}
+	}))
+
 	renderer := surf.NewHTMLRenderer("./gbb/templates/**.tmpl", conf.Debug, template.FuncMap{
-		"markdown": func(s string) template.HTML {
-			html := github_flavored_markdown.Markdown([]byte(s))
-			return template.HTML(html)
+		"markdown": markdownRenderer.Render,
+		// Comment content is rendered once per revision.
+		"commentmarkdown": func(c *gbb.Comment) template.HTML {
+			key := fmt.Sprintf("comment:%d:%d", c.CommentID, c.Revision)
+			return markdownCache.Render(key, c.Content)
+		},
+		// Messages cannot be edited, so the ID is enough.
+		"messagemarkdown": func(m *gbb.Message) template.HTML {
+			return markdownCache.Render(fmt.Sprintf("message:%d", m.MessageID), m.Content)
 		},
 		"timeago": func(t time.Time) template.HTML {
 			ago := timeago(t)
@@ -108,58 +432,181 @@ func run(ctx context.Context, conf configuration) error {
 		csrf = surf.AsHandler // pass through
 	}
 
-	rt := surf.NewRouter()
+	var rt router = surf.NewRouter()
+	if appMetrics != nil {
+		rt = appMetrics.InstrumentRouter(rt, authStore)
+	}
 
 	rt.R(`/`).
 		Get(http.RedirectHandler("/t/", http.StatusTemporaryRedirect))
 	rt.R(`/t/`).
-		Get(gbb.TopicListHandler(bbStore, readTracker, authStore, renderer))
+		Get(gbb.TopicListHandler(bbStore, readTracker, messages, moderation, authStore, renderer))
+	rt.R(`/t/events/`).
+		Get(gbb.TopicStreamHandler(topicEvents, renderer))
 	rt.R(`/t/search/`).
-		Get(gbb.SearchHandler(bbStore, renderer))
+		Get(gbb.SearchHandler(bbStore, authStore, renderer))
 	rt.R(`/t/mark-all-read/`).
 		Get(gbb.MarkAllReadHandler(authStore, readTracker))
 	rt.R(`/t/new/`).
 		Use(csrf).
-		Get(gbb.TopicCreateHandler(bbStore, authStore, renderer)).
-		Post(gbb.TopicCreateHandler(bbStore, authStore, renderer))
+		Get(gbb.TopicCreateHandler(bbStore, polls, references, drafts, pending, topicGuard, scopeThresholds, authStore, renderer)).
+		Post(gbb.TopicCreateHandler(bbStore, polls, references, drafts, pending, topicGuard, scopeThresholds, authStore, renderer))
+	rt.R(`/t/<post-id:[^/]+>/events/`).
+		Use(csrf).
+		Get(gbb.CommentStreamHandler(bbStore, readTracker, topicEvents, reactionKinds, attachments, authStore, renderer))
+	rt.R(`/t/<post-id:[^/]+>/poll/`).
+		Use(csrf).
+		Post(gbb.PollVoteHandler(bbStore, polls, authStore, renderer))
+	rt.R(`/t/<post-id:[^/]+>/lock/`).
+		Use(csrf).
+		Post(gbb.TopicLockHandler(bbStore, authStore, renderer))
 	rt.R(`/t/<post-id:[^/]+>/last-seen-comment/.*`).
 		Get(gbb.LastSeenCommentHandler(bbStore, readTracker, authStore, renderer))
 	rt.R(`/t/<post-id:[^/]+>/last-comment/.*`).
 		Get(gbb.LastCommentHandler(bbStore, readTracker, authStore, renderer))
 	rt.R(`/t/<post-id:[^/]+>/.*`).
 		Use(csrf).
-		Get(gbb.CommentListHandler(bbStore, readTracker, authStore, renderer)).
-		Post(gbb.CommentCreateHandler(bbStore, authStore, renderer))
+		Get(gbb.CommentListHandler(bbStore, readTracker, views, polls, reactions, reactionKinds, attachments, references, drafts, authStore, renderer)).
+		Post(gbb.CommentCreateHandler(bbStore, attachments, blobs, attachmentLimits, references, drafts, pending, commentGuard, scopeThresholds, authStore, renderer))
 	rt.R(`/c/<comment-id:[^/]+>/edit/`).
 		Use(csrf).
-		Get(gbb.CommentEditHandler(authStore, bbStore, renderer)).
-		Post(gbb.CommentEditHandler(authStore, bbStore, renderer))
+		Get(gbb.CommentEditHandler(authStore, bbStore, references, moderation, renderer)).
+		Post(gbb.CommentEditHandler(authStore, bbStore, references, moderation, renderer))
 	rt.R(`/c/<comment-id:[^/]+>/delete/`).
 		Use(csrf).
-		Get(gbb.CommentDeleteHandler(authStore, bbStore, renderer)).
-		Post(gbb.CommentDeleteHandler(authStore, bbStore, renderer))
+		Get(gbb.CommentDeleteHandler(authStore, bbStore, attachments, blobs, spamFilter, renderer)).
+		Post(gbb.CommentDeleteHandler(authStore, bbStore, attachments, blobs, spamFilter, renderer))
+	rt.R(`/c/<comment-id:[^/]+>/react/`).
+		Use(csrf).
+		Post(gbb.CommentReactHandler(bbStore, reactions, reactionKinds, authStore, renderer))
+	rt.R(`/c/<comment-id:[^/]+>/accept/`).
+		Use(csrf).
+		Post(gbb.CommentAcceptHandler(bbStore, authStore, renderer))
+	rt.R(`/c/<comment-id:[^/]+>/report/`).
+		Use(csrf).
+		Get(gbb.CommentReportHandler(bbStore, moderation, authStore, renderer)).
+		Post(gbb.CommentReportHandler(bbStore, moderation, authStore, renderer))
 	rt.R(`/c/<comment-id:[^/]+>/`).
-		Get(gbb.GotoCommentHandler(bbStore, renderer))
+		Get(gbb.GotoCommentHandler(bbStore, authStore, renderer))
+	rt.R(`/a/<attachment-id:\d+>/thumbnail/`).
+		Get(gbb.AttachmentHandler(attachments, blobs, true, renderer))
+	rt.R(`/a/<attachment-id:\d+>/.*`).
+		Get(gbb.AttachmentHandler(attachments, blobs, false, renderer))
+	rt.R(`/drafts/`).
+		Use(csrf).
+		Get(gbb.DraftListHandler(drafts, authStore, renderer))
+	rt.R(`/drafts/save/`).
+		Use(csrf).
+		Post(gbb.DraftSaveHandler(drafts, authStore, renderer))
+	rt.R(`/drafts/delete/`).
+		Use(csrf).
+		Post(gbb.DraftDeleteHandler(drafts, authStore, renderer))
+	rt.R(`/messages/`).
+		Get(gbb.MessageInboxHandler(messages, authStore, renderer))
+	rt.R(`/messages/new/`).
+		Use(csrf).
+		Get(gbb.ConversationCreateHandler(bbStore, messages, messageLimits, scopeThresholds, authStore, renderer)).
+		Post(gbb.ConversationCreateHandler(bbStore, messages, messageLimits, scopeThresholds, authStore, renderer))
+	rt.R(`/messages/blocked/`).
+		Use(csrf).
+		Get(gbb.BlockedUsersHandler(messages, authStore, renderer))
+	rt.R(`/messages/<conversation-id:\d+>/`).
+		Use(csrf).
+		Get(gbb.ConversationHandler(messages, authStore, renderer))
+	rt.R(`/messages/<conversation-id:\d+>/reply/`).
+		Use(csrf).
+		Post(gbb.MessageCreateHandler(messages, authStore, renderer))
+	rt.R(`/messages/<conversation-id:\d+>/leave/`).
+		Use(csrf).
+		Post(gbb.ConversationLeaveHandler(messages, authStore, renderer))
+	rt.R(`/u/<user-id:\d+>/block/`).
+		Use(csrf).
+		Post(gbb.UserBlockHandler(messages, authStore, renderer))
+	rt.R(`/u/<user-id:\d+>/ban/`).
+		Use(csrf).
+		Post(gbb.UserBanHandler(bbStore, authStore, renderer))
+	rt.R(`/u/<user-id:\d+>/hide/`).
+		Use(csrf).
+		Post(gbb.UserHideHandler(bbStore, authStore, renderer))
+	rt.R(`/u/<user-id:\d+>/penalize/`).
+		Use(csrf).
+		Post(gbb.UserPenalizeHandler(bbStore, authStore, renderer))
 	rt.R(`/u/<user-id:\d+>/`).
-		Get(gbb.UserDetailsHandler(bbStore, authStore, renderer))
+		Use(csrf).
+		Get(gbb.UserDetailsHandler(bbStore, messages, authStore, renderer))
+	rt.R(`/reports/`).
+		Get(gbb.UserReportsHandler(moderation, authStore, renderer))
+	rt.R(`/mod/queue/`).
+		Use(csrf).
+		Get(gbb.ModerationQueueHandler(moderation, authStore, renderer))
+	rt.R(`/mod/queue/<comment-id:\d+>/resolve/`).
+		Use(csrf).
+		Post(gbb.ModerationResolveHandler(bbStore, moderation, spamFilter, authStore, renderer))
+	rt.R(`/mod/pending/`).
+		Use(csrf).
+		Get(gbb.PendingPostListHandler(pending, authStore, renderer))
+	rt.R(`/mod/pending/<pending-id:\d+>/`).
+		Use(csrf).
+		Post(gbb.PendingPostResolveHandler(bbStore, pending, polls, attachments, references, spamFilter, authStore, renderer))
+	rt.R(`/mod/hidden/`).
+		Use(csrf).
+		Get(gbb.HiddenCommentListHandler(bbStore, authStore, renderer))
+	rt.R(`/mod/hidden/<comment-id:\d+>/`).
+		Use(csrf).
+		Post(gbb.HiddenCommentResolveHandler(bbStore, spamFilter, authStore, renderer))
+	rt.R(`/mod/log/`).
+		Get(gbb.ModerationLogHandler(moderation, authStore, renderer))
 	rt.R(`/login/`).
 		Use(csrf).
-		Get(gbb.LoginHandler(authStore, bbStore, renderer)).
-		Post(gbb.LoginHandler(authStore, bbStore, renderer))
+		Get(gbb.LoginHandler(authStore, bbStore, authenticator, twoFactor, identities, sso, scopeThresholds, renderer)).
+		Post(gbb.LoginHandler(authStore, bbStore, authenticator, twoFactor, identities, sso, scopeThresholds, renderer))
+	if sso != nil {
+		rt.R(`/login/oidc/`).
+			Get(gbb.SingleSignOnHandler(authStore, sso, renderer))
+		rt.R(`/login/oidc/callback/`).
+			Get(gbb.SingleSignOnCallbackHandler(authStore, bbStore, identities, twoFactor, sso, scopeThresholds, renderer))
+	}
+	rt.R(`/login/2fa/`).
+		Use(csrf).
+		Get(gbb.LoginTwoFactorHandler(authStore, twoFactor, twoFactorLimit, renderer)).
+		Post(gbb.LoginTwoFactorHandler(authStore, twoFactor, twoFactorLimit, renderer))
+	rt.R(`/account/2fa/`).
+		Use(csrf).
+		Get(gbb.TwoFactorSettingsHandler(authStore, bbStore, twoFactor, renderer)).
+		Post(gbb.TwoFactorSettingsHandler(authStore, bbStore, twoFactor, renderer))
+	rt.R(`/account/`).
+		Use(csrf).
+		Get(gbb.AccountHandler(accounts, authenticator, twoFactor, identities, deletionGrace, authStore, renderer)).
+		Post(gbb.AccountHandler(accounts, authenticator, twoFactor, identities, deletionGrace, authStore, renderer))
+	rt.R(`/account/export/`).
+		Get(gbb.AccountExportHandler(accounts, authStore, renderer))
 	rt.R(`/logout/`).
 		Use(csrf).
 		Get(gbb.LogoutHandler(authStore, bbStore, renderer)).
 		Post(gbb.LogoutHandler(authStore, bbStore, renderer))
 	rt.R(`/register/`).
 		Use(csrf).
-		Get(gbb.RegisterHandler(authStore, bbStore, renderer)).
-		Post(gbb.RegisterHandler(authStore, bbStore, renderer))
+		Get(gbb.RegisterHandler(authStore, bbStore, identities, invites, accounts, twoFactor, sso, registration, registrationLimit, scopeThresholds, renderer)).
+		Post(gbb.RegisterHandler(authStore, bbStore, identities, invites, accounts, twoFactor, sso, registration, registrationLimit, scopeThresholds, renderer))
+	rt.R(`/invites/`).
+		Use(csrf).
+		Get(gbb.InviteListHandler(bbStore, invites, scopeThresholds, authStore, renderer)).
+		Post(gbb.InviteListHandler(bbStore, invites, scopeThresholds, authStore, renderer))
+	rt.R(`/invites/<invite-id:\d+>/revoke/`).
+		Use(csrf).
+		Post(gbb.InviteRevokeHandler(invites, authStore, renderer))
 	rt.R(`/settings/`).
 		Use(csrf).
-		Get(gbb.SettingsHandler(authStore, bbStore, renderer)).
-		Post(gbb.SaveSettingsHandler(authStore, bbStore, renderer))
+		Get(gbb.SettingsHandler(authStore, bbStore, twoFactor, identities, sso, renderer)).
+		Post(gbb.SaveSettingsHandler(authStore, bbStore, twoFactor, identities, sso, renderer))
 	rt.R(`/public/style.css`).
 		Get(gbb.StyleHandler(!conf.Debug))
+	if conf.MetricsAddr == "" && conf.MetricsToken != "" {
+		rt.R(`/metrics`).
+			Get(gbb.MetricsHandler(metricsRegistry, conf.MetricsToken))
+		rt.R(`/_/vars`).
+			Get(gbb.RequireMetricsToken(expvar.Handler(), conf.MetricsToken))
+	}
 
 	var logOutput io.Writer
 	if conf.NoLogs {
@@ -169,7 +616,107 @@ func run(ctx context.Context, conf configuration) error {
 	}
 	logger := surf.NewLogger(logOutput)
 
-	app := surf.NewHTTPApplication(rt, logger, true)
+	app := surf.NewHTTPApplication(gbb.DeletedAccountMiddleware(bbStore, authStore)(rt), logger, true)
+
+	viewsFlushed := make(chan struct{})
+	go func() {
+		defer close(viewsFlushed)
+		views.Run(ctx, 30*time.Second, func(err error) {
+			logger.Error(ctx, err, "cannot flush topic views")
+		})
+	}()
+
+	go func() {
+		t := time.NewTicker(5 * time.Minute)
+		defer t.Stop()
+		for {
+			if err := bbStore.RefreshTopicScores(ctx); err != nil {
+				logger.Error(ctx, err, "cannot refresh topic scores")
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+
+	go func() {
+		t := time.NewTicker(time.Hour)
+		defer t.Stop()
+		for {
+			// Orphaned attachments are given enough time for the
+			// comment they were uploaded with to be created.
+			if n, err := gbb.CleanupOrphanedAttachments(ctx, attachments, pending, blobs, time.Hour); err != nil {
+				logger.Error(ctx, err, "cannot cleanup orphaned attachments")
+			} else if n > 0 {
+				logger.Info(ctx, "orphaned attachments removed",
+					"count", fmt.Sprint(n))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+
+	go func() {
+		t := time.NewTicker(time.Hour)
+		defer t.Stop()
+		for {
+			if n, err := gbb.DeleteDueAccounts(ctx, accounts, time.Now()); err != nil {
+				logger.Error(ctx, err, "cannot delete accounts")
+			} else if n > 0 {
+				logger.Info(ctx, "accounts deleted",
+					"count", fmt.Sprint(n))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+
+	if appMetrics != nil {
+		stats := gbb.NewPostgresStatsStore(db)
+		go func() {
+			t := time.NewTicker(time.Minute)
+			defer t.Stop()
+			for {
+				if err := appMetrics.RefreshForumStats(ctx, stats); err != nil {
+					logger.Error(ctx, err, "cannot refresh forum stats")
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-t.C:
+				}
+			}
+		}()
+	}
+
+	if conf.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", gbb.MetricsHandler(metricsRegistry, conf.MetricsToken))
+		mux.Handle("/_/vars", gbb.RequireMetricsToken(expvar.Handler(), conf.MetricsToken))
+		metricsServer := http.Server{
+			Addr:    conf.MetricsAddr,
+			Handler: mux,
+		}
+		go func() {
+			<-ctx.Done()
+			metricsServer.Shutdown(ctx)
+		}()
+		go func() {
+			logger.Info(ctx, "starting metrics HTTP server",
+				"addr", conf.MetricsAddr)
+			if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error(ctx, err, "metrics HTTP server")
+			}
+		}()
+	}
 
 	server := http.Server{
 		Addr:    ":" + conf.HttpPort,
@@ -186,6 +733,145 @@ func run(ctx context.Context, conf configuration) error {
 	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("http server: %s", err)
 	}
+	<-viewsFlushed
+	return nil
+}
+
+// router is the surf router, optionally instrumented with metrics.
+type router interface {
+	R(path string) surf.Route
+	surf.Handler
+}
+
+// newBlobStore returns the store of attached files, as configured.
+func newBlobStore(conf configuration) (blob.Store, error) {
+	if conf.S3Endpoint != "" {
+		return blob.NewS3Store(blob.S3Config{
+			Endpoint:  conf.S3Endpoint,
+			Bucket:    conf.S3Bucket,
+			Region:    conf.S3Region,
+			AccessKey: conf.S3AccessKey,
+			SecretKey: conf.S3SecretKey,
+		}, &http.Client{Timeout: time.Minute})
+	}
+	return blob.NewFSStore(conf.AttachmentsDir)
+}
+
+// archiveStores returns stores that the forum archive is read from and
+// written to.
+func archiveStores(db *sql.DB) (gbb.BBStore, gbb.ReadProgressTracker, gbb.AttachmentStore, gbb.AccountStore, error) {
+	bbStore, err := gbb.NewPostgresBBStore(db)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("cannot create bb store: %s", err)
+	}
+	readTracker, err := gbb.NewPostgresReadProgressTracker(db)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("cannot create read progress tracker: %s", err)
+	}
+	attachments, err := gbb.NewPostgresAttachmentStore(db)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("cannot create attachment store: %s", err)
+	}
+	accounts, err := gbb.NewPostgresAccountStore(db)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("cannot create account store: %s", err)
+	}
+	return bbStore, readTracker, attachments, accounts, nil
+}
+
+// runExport writes the whole forum to an archive file or to the standard
+// output.
+func runExport(ctx context.Context, conf configuration, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	outputFl := flags.String("o", "-", "Archive file. Use - for the standard output.")
+	gzipFl := flags.Bool("gzip", false, "Compress the archive with gzip.")
+	flags.Parse(args)
+
+	db, err := sql.Open("postgres", conf.DatabaseUrl)
+	if err != nil {
+		return fmt.Errorf("cannot open SQL database: %s", err)
+	}
+	defer db.Close()
+	bbStore, readTracker, attachments, accounts, err := archiveStores(db)
+	if err != nil {
+		return err
+	}
+	blobs, err := newBlobStore(conf)
+	if err != nil {
+		return fmt.Errorf("cannot create blob store: %s", err)
+	}
+
+	var out io.WriteCloser = os.Stdout
+	if *outputFl != "-" {
+		fd, err := os.Create(*outputFl)
+		if err != nil {
+			return fmt.Errorf("cannot create archive file: %s", err)
+		}
+		defer fd.Close()
+		out = fd
+	}
+	w := io.Writer(out)
+	var gz *gzip.Writer
+	if *gzipFl {
+		gz = gzip.NewWriter(out)
+		w = gz
+	}
+
+	counts, err := gbb.ExportArchive(ctx, w, bbStore, readTracker, attachments, accounts, blobs)
+	if err != nil {
+		return err
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("cannot compress archive: %s", err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("cannot write archive: %s", err)
+	}
+	fmt.Fprintf(os.Stderr, "exported %s\n", gbb.FormatArchiveCounts(counts))
+	return nil
+}
+
+// runImport restores the forum from an archive file or from the standard
+// input. The database must not contain any users.
+func runImport(ctx context.Context, conf configuration, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: gbb import [archive file]")
+		fmt.Fprintln(flags.Output(), "Archive is read from the standard input when no file is given.")
+	}
+	flags.Parse(args)
+
+	var in io.Reader = os.Stdin
+	if flags.NArg() > 0 && flags.Arg(0) != "-" {
+		fd, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return fmt.Errorf("cannot open archive file: %s", err)
+		}
+		defer fd.Close()
+		in = fd
+	}
+
+	db, err := sql.Open("postgres", conf.DatabaseUrl)
+	if err != nil {
+		return fmt.Errorf("cannot open SQL database: %s", err)
+	}
+	defer db.Close()
+	bbStore, readTracker, attachments, accounts, err := archiveStores(db)
+	if err != nil {
+		return err
+	}
+	blobs, err := newBlobStore(conf)
+	if err != nil {
+		return fmt.Errorf("cannot create blob store: %s", err)
+	}
+
+	counts, err := gbb.ImportArchive(ctx, in, bbStore, readTracker, attachments, accounts, blobs)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "imported %s\n", gbb.FormatArchiveCounts(counts))
 	return nil
 }
 
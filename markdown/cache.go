@@ -0,0 +1,80 @@
+package markdown
+
+import (
+	"container/list"
+	"html/template"
+	"sync"
+)
+
+// Cache keeps a limited number of recently rendered documents in memory.
+// Least recently used documents are removed first.
+//
+// Documents are identified by the key provided by the caller, which must
+// change whenever the source changes, for example by including the
+// revision number.
+type Cache struct {
+	renderer *Renderer
+	size     int
+
+	mu     sync.Mutex
+	items  map[string]*list.Element
+	order  *list.List
+	hits   int64
+	misses int64
+}
+
+type cacheEntry struct {
+	key  string
+	html template.HTML
+}
+
+// NewCache returns a cache of given size that is using the renderer to
+// render missing documents.
+func NewCache(renderer *Renderer, size int) *Cache {
+	return &Cache{
+		renderer: renderer,
+		size:     size,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Render returns HTML representation of given source, rendering it only if
+// the result is not cached under the key yet.
+func (c *Cache) Render(key, source string) template.HTML {
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		c.order.MoveToFront(el)
+		c.hits++
+		c.mu.Unlock()
+		return el.Value.(*cacheEntry).html
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	// Render without holding the lock. Concurrent render of the same
+	// document is a waste, but it produces the same result.
+	rendered := c.renderer.Render(source)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.order.MoveToFront(el)
+		return rendered
+	}
+	c.items[key] = c.order.PushFront(&cacheEntry{key: key, html: rendered})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+	return rendered
+}
+
+// Stats returns the number of cache hits and misses.
+func (c *Cache) Stats() (hits, misses int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
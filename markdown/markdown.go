@@ -0,0 +1,240 @@
+// Package markdown renders user provided markdown text into HTML that is safe
+// to be included in a page.
+//
+// Rendering is done in stages. Markdown is converted to HTML, which is then
+// sanitized using an explicit whitelist policy. Sanitized document is
+// finally rewritten: external links are marked as user generated content,
+// images are lazy loaded and plugins are applied to the text.
+package markdown
+
+import (
+	"bytes"
+	"html/template"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/russross/blackfriday"
+	"golang.org/x/net/html"
+)
+
+// Plugin extends markdown with a custom inline syntax, for example user
+// mentions or comment references.
+//
+// Plugins are applied to the text of already sanitized document. Text inside
+// of links and code is never passed to a plugin.
+type Plugin interface {
+	// Pattern returns an expression matching the plugin syntax.
+	Pattern() *regexp.Regexp
+
+	// Render returns HTML that replaces the matched text. Submatches of
+	// the pattern are given, the whole match being the first one.
+	// Returned HTML is not sanitized, so the plugin must escape all
+	// values. If false is returned, matched text is left unchanged.
+	Render(submatches []string) (string, bool)
+}
+
+// NewPlugin returns a Plugin that is using given function to render text
+// matching the pattern.
+func NewPlugin(pattern *regexp.Regexp, render func(submatches []string) (string, bool)) Plugin {
+	return &funcPlugin{pattern: pattern, render: render}
+}
+
+type funcPlugin struct {
+	pattern *regexp.Regexp
+	render  func([]string) (string, bool)
+}
+
+func (p *funcPlugin) Pattern() *regexp.Regexp {
+	return p.pattern
+}
+
+func (p *funcPlugin) Render(submatches []string) (string, bool) {
+	return p.render(submatches)
+}
+
+// Renderer converts markdown into sanitized HTML. It is safe for concurrent
+// use.
+type Renderer struct {
+	plugins []Plugin
+}
+
+// NewRenderer returns a renderer that is using given plugins. Plugins are
+// applied in the given order.
+func NewRenderer(plugins ...Plugin) *Renderer {
+	return &Renderer{plugins: plugins}
+}
+
+// extensions enable GitHub like markdown syntax.
+const extensions = blackfriday.EXTENSION_NO_INTRA_EMPHASIS |
+	blackfriday.EXTENSION_TABLES |
+	blackfriday.EXTENSION_FENCED_CODE |
+	blackfriday.EXTENSION_AUTOLINK |
+	blackfriday.EXTENSION_STRIKETHROUGH |
+	blackfriday.EXTENSION_SPACE_HEADERS |
+	blackfriday.EXTENSION_NO_EMPTY_LINE_BEFORE_BLOCK
+
+// Render returns HTML representation of given markdown text.
+func (r *Renderer) Render(source string) template.HTML {
+	unsafe := blackfriday.Markdown([]byte(source), blackfriday.HtmlRenderer(0, "", ""), extensions)
+	sanitized := policy.SanitizeBytes(unsafe)
+	return template.HTML(r.rewrite(sanitized))
+}
+
+// policy is the whitelist of elements and attributes that can be used in the
+// rendered HTML. Anything not listed is removed.
+var policy = func() *bluemonday.Policy {
+	p := bluemonday.NewPolicy()
+
+	p.RequireParseableURLs(true)
+	p.AllowRelativeURLs(true)
+	p.AllowURLSchemes("mailto", "http", "https")
+
+	p.AllowElements(
+		"p", "br", "hr", "blockquote", "pre",
+		"h1", "h2", "h3", "h4", "h5", "h6",
+		"em", "strong", "del", "s", "sup", "sub", "kbd", "code",
+		"ul", "ol", "li", "dl", "dt", "dd",
+		"table", "thead", "tbody", "tfoot", "tr", "th", "td",
+	)
+	p.AllowAttrs("href", "title").OnElements("a")
+	p.AllowAttrs("src", "alt", "title").OnElements("img")
+	p.AllowAttrs("width", "height").Matching(bluemonday.Integer).OnElements("img")
+	p.AllowAttrs("align").Matching(bluemonday.CellAlign).OnElements("th", "td")
+	p.AllowAttrs("start").Matching(bluemonday.Integer).OnElements("ol")
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+#-]+$`)).OnElements("code")
+
+	return p
+}()
+
+// rewrite modifies sanitized HTML document. Because the document was
+// produced by the sanitizer, it is well formed.
+func (r *Renderer) rewrite(document []byte) string {
+	var (
+		out bytes.Buffer
+		// skip counts open elements whose text must not be
+		// modified by plugins.
+		skip int
+	)
+
+	z := html.NewTokenizer(bytes.NewReader(document))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			// Sanitized document cannot be malformed, so this is
+			// always the end of the input.
+			return out.String()
+		case html.TextToken:
+			text := string(z.Text())
+			if skip > 0 {
+				out.WriteString(html.EscapeString(text))
+			} else {
+				out.WriteString(applyPlugins(r.plugins, text))
+			}
+		case html.StartTagToken:
+			tok := z.Token()
+			switch tok.Data {
+			case "a":
+				if isExternal(attr(tok, "href")) {
+					tok.Attr = setAttr(tok.Attr, "rel", "nofollow ugc")
+				}
+				skip++
+			case "code", "pre":
+				skip++
+			case "img":
+				tok.Attr = setAttr(tok.Attr, "loading", "lazy")
+			}
+			out.WriteString(tok.String())
+		case html.EndTagToken:
+			tok := z.Token()
+			switch tok.Data {
+			case "a", "code", "pre":
+				if skip > 0 {
+					skip--
+				}
+			}
+			out.WriteString(tok.String())
+		case html.SelfClosingTagToken:
+			tok := z.Token()
+			if tok.Data == "img" {
+				tok.Attr = setAttr(tok.Attr, "loading", "lazy")
+			}
+			out.WriteString(tok.String())
+		default:
+			out.Write(z.Raw())
+		}
+	}
+}
+
+// applyPlugins returns HTML of given text, with all plugin syntax rendered.
+func applyPlugins(plugins []Plugin, text string) string {
+	if len(plugins) == 0 {
+		return html.EscapeString(text)
+	}
+
+	plugin, rest := plugins[0], plugins[1:]
+	var b strings.Builder
+	for {
+		loc := plugin.Pattern().FindStringSubmatchIndex(text)
+		if loc == nil {
+			b.WriteString(applyPlugins(rest, text))
+			return b.String()
+		}
+
+		submatches := make([]string, len(loc)/2)
+		for i := range submatches {
+			if loc[2*i] >= 0 {
+				submatches[i] = text[loc[2*i]:loc[2*i+1]]
+			}
+		}
+
+		b.WriteString(applyPlugins(rest, text[:loc[0]]))
+		if rendered, ok := plugin.Render(submatches); ok {
+			b.WriteString(rendered)
+		} else {
+			b.WriteString(applyPlugins(rest, submatches[0]))
+		}
+
+		// Empty match must not stop the progress.
+		end := loc[1]
+		if end == loc[0] {
+			if end == len(text) {
+				return b.String()
+			}
+			_, size := utf8.DecodeRuneInString(text[end:])
+			end += size
+			b.WriteString(applyPlugins(rest, text[loc[0]:end]))
+		}
+		text = text[end:]
+	}
+}
+
+// isExternal returns true if given link points to another host.
+func isExternal(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	return u.Host != ""
+}
+
+func attr(tok html.Token, name string) string {
+	for _, a := range tok.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func setAttr(attrs []html.Attribute, name, value string) []html.Attribute {
+	for i, a := range attrs {
+		if a.Key == name {
+			attrs[i].Val = value
+			return attrs
+		}
+	}
+	return append(attrs, html.Attribute{Key: name, Val: value})
+}
@@ -0,0 +1,101 @@
+package markdown
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	cases := map[string]struct {
+		source   string
+		contains []string
+		excludes []string
+	}{
+		"script is removed": {
+			source:   "hello <script>alert(1)</script>",
+			contains: []string{"<p>hello"},
+			excludes: []string{"script", "alert"},
+		},
+		"javascript link is removed": {
+			source:   `<a href="javascript:alert(1)" onclick="x()">click</a>`,
+			excludes: []string{"javascript", "onclick", "<a"},
+		},
+		"external link is marked": {
+			source:   "[x](https://example.com/) and <a href=\"http://example.com\" rel=\"me\">y</a>",
+			contains: []string{`<a href="https://example.com/" rel="nofollow ugc">x</a>`, `<a href="http://example.com" rel="nofollow ugc">y</a>`},
+		},
+		"relative link is not marked": {
+			source:   "[topic](/t/1/)",
+			contains: []string{`<a href="/t/1/">topic</a>`},
+		},
+		"images are lazy loaded": {
+			source:   "![cat](https://example.com/cat.png)",
+			contains: []string{`<img src="https://example.com/cat.png" alt="cat" loading="lazy">`},
+		},
+		"code is escaped": {
+			source:   "```go\nif a < b {}\n```",
+			contains: []string{`<code class="language-go">if a &lt; b {}`},
+		},
+		"text is escaped": {
+			source:   "a & b",
+			contains: []string{"a &amp; b"},
+		},
+	}
+
+	r := NewRenderer()
+	for testName, tc := range cases {
+		t.Run(testName, func(t *testing.T) {
+			got := string(r.Render(tc.source))
+			for _, s := range tc.contains {
+				if !strings.Contains(got, s) {
+					t.Errorf("want %q in output: %s", s, got)
+				}
+			}
+			for _, s := range tc.excludes {
+				if strings.Contains(got, s) {
+					t.Errorf("unexpected %q in output: %s", s, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderPlugins(t *testing.T) {
+	mention := NewPlugin(regexp.MustCompile(`@(\w+)`), func(m []string) (string, bool) {
+		if m[1] == "nobody" {
+			return "", false
+		}
+		return fmt.Sprintf(`<a href="/u/%s/">@%s</a>`, html.EscapeString(m[1]), html.EscapeString(m[1])), true
+	})
+	shout := NewPlugin(regexp.MustCompile(`!!`), func(m []string) (string, bool) {
+		return "<strong>!</strong>", true
+	})
+
+	r := NewRenderer(mention, shout)
+
+	got := string(r.Render("hi @bob & @nobody!! `@code` [@link](/x/)"))
+	want := `<p>hi <a href="/u/bob/">@bob</a> &amp; @nobody<strong>!</strong> <code>@code</code> <a href="/x/">@link</a></p>`
+	if strings.TrimSpace(got) != want {
+		t.Fatalf("unexpected output\nwant %s\n got %s", want, got)
+	}
+}
+
+func TestCache(t *testing.T) {
+	c := NewCache(NewRenderer(), 2)
+
+	c.Render("a:1", "a")
+	c.Render("b:1", "b")
+	if got := c.Render("a:1", "changed, but the key is the same"); !strings.Contains(string(got), "<p>a</p>") {
+		t.Fatalf("want cached document, got %s", got)
+	}
+	// Cache is full, so the least recently used b:1 is removed.
+	c.Render("c:1", "c")
+	c.Render("b:1", "b")
+
+	if hits, misses := c.Stats(); hits != 1 || misses != 4 {
+		t.Fatalf("want 1 hit and 4 misses, got %d and %d", hits, misses)
+	}
+}
@@ -0,0 +1,332 @@
+// Package metrics implements counters, gauges and histograms exposed in the
+// Prometheus text format, version 0.0.4.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram upper bounds suitable for measuring durations
+// of HTTP requests and database queries, in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry keeps metrics that are written together.
+type Registry struct {
+	mu        sync.Mutex
+	families  []*family
+	names     map[string]bool
+	onCollect []func()
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// OnCollect registers a function called every time the metrics are written,
+// before they are. It is meant for updating gauges that are cheap to read,
+// for example the database connection pool statistics.
+func (r *Registry) OnCollect(fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onCollect = append(r.onCollect, fn)
+}
+
+// Counter registers a counter with given label names. Counter value can only
+// increase.
+func (r *Registry) Counter(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{f: r.register(name, help, "counter", nil, labels)}
+}
+
+// Gauge registers a gauge with given label names. Gauge value can be set to
+// anything.
+func (r *Registry) Gauge(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{f: r.register(name, help, "gauge", nil, labels)}
+}
+
+// Histogram registers a histogram with given bucket upper bounds, sorted in
+// increasing order, and label names. The +Inf bucket is always added.
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets of %s are not sorted", name))
+	}
+	return &HistogramVec{f: r.register(name, help, "histogram", buckets, labels)}
+}
+
+func (r *Registry) register(name, help, kind string, buckets []float64, labels []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metrics: %s is already registered", name))
+	}
+	r.names[name] = true
+	f := &family{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		buckets: buckets,
+		labels:  labels,
+		series:  make(map[string]*series),
+	}
+	r.families = append(r.families, f)
+	return f
+}
+
+// WriteTo writes all metrics in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	onCollect := append([]func(){}, r.onCollect...)
+	families := append([]*family{}, r.families...)
+	r.mu.Unlock()
+
+	for _, fn := range onCollect {
+		fn()
+	}
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, f := range families {
+		f.write(cw)
+	}
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+// ServeHTTP writes all metrics as the response.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// CounterVec is a counter partitioned by the label values.
+type CounterVec struct {
+	f *family
+}
+
+// With returns the counter with given label values, in the order of the
+// label names.
+func (v *CounterVec) With(labelValues ...string) Counter {
+	return Counter{s: v.f.with(labelValues)}
+}
+
+// Counter is a single counter series.
+type Counter struct {
+	s *series
+}
+
+// Inc increments the counter by 1.
+func (c Counter) Inc() {
+	c.Add(1)
+}
+
+// Add increases the counter by given value, which must not be negative.
+func (c Counter) Add(value float64) {
+	if value < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.s.mu.Lock()
+	c.s.value += value
+	c.s.mu.Unlock()
+}
+
+// GaugeVec is a gauge partitioned by the label values.
+type GaugeVec struct {
+	f *family
+}
+
+// With returns the gauge with given label values, in the order of the label
+// names.
+func (v *GaugeVec) With(labelValues ...string) Gauge {
+	return Gauge{s: v.f.with(labelValues)}
+}
+
+// Gauge is a single gauge series.
+type Gauge struct {
+	s *series
+}
+
+// Set changes the gauge to given value.
+func (g Gauge) Set(value float64) {
+	g.s.mu.Lock()
+	g.s.value = value
+	g.s.mu.Unlock()
+}
+
+// Add changes the gauge by given value, which can be negative.
+func (g Gauge) Add(value float64) {
+	g.s.mu.Lock()
+	g.s.value += value
+	g.s.mu.Unlock()
+}
+
+// HistogramVec is a histogram partitioned by the label values.
+type HistogramVec struct {
+	f *family
+}
+
+// With returns the histogram with given label values, in the order of the
+// label names.
+func (v *HistogramVec) With(labelValues ...string) Histogram {
+	return Histogram{s: v.f.with(labelValues), buckets: v.f.buckets}
+}
+
+// Histogram is a single histogram series.
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+// Observe adds given value to the histogram.
+func (h Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.buckets, value)
+	h.s.mu.Lock()
+	h.s.counts[i]++
+	h.s.value += value
+	h.s.mu.Unlock()
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    string
+	buckets []float64
+	labels  []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+
+	mu    sync.Mutex
+	value float64
+	// counts are the number of histogram observations that fall into
+	// every bucket, not cumulative. The last one is the +Inf bucket.
+	counts []uint64
+}
+
+func (f *family) with(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s requires %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		if f.kind == "histogram" {
+			s.counts = make([]uint64, len(f.buckets)+1)
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) write(w *countingWriter) {
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	series := make([]*series, len(keys))
+	for i, key := range keys {
+		series[i] = f.series[key]
+	}
+	f.mu.Unlock()
+
+	w.printf("# HELP %s %s\n", f.name, escapeHelp(f.help))
+	w.printf("# TYPE %s %s\n", f.name, f.kind)
+	for _, s := range series {
+		s.mu.Lock()
+		value := s.value
+		counts := append([]uint64{}, s.counts...)
+		s.mu.Unlock()
+
+		if f.kind != "histogram" {
+			w.printf("%s%s %s\n", f.name, formatLabels(f.labels, s.labelValues, "", 0), formatValue(value))
+			continue
+		}
+		var cumulative uint64
+		for i, count := range counts {
+			cumulative += count
+			le := math.Inf(1)
+			if i < len(f.buckets) {
+				le = f.buckets[i]
+			}
+			w.printf("%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.labelValues, "le", le), cumulative)
+		}
+		w.printf("%s_sum%s %s\n", f.name, formatLabels(f.labels, s.labelValues, "", 0), formatValue(value))
+		w.printf("%s_count%s %d\n", f.name, formatLabels(f.labels, s.labelValues, "", 0), cumulative)
+	}
+}
+
+// formatLabels returns the label set of a series. The le label of a
+// histogram bucket is added unless its name is empty.
+func formatLabels(names, values []string, le string, bound float64) string {
+	if len(names) == 0 && le == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+escapeLabel(values[i])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, le+`="`+formatValue(bound)+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+// countingWriter remembers the first error, so that writing can continue
+// without checking every call.
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) printf(format string, args ...interface{}) {
+	if cw.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(cw.w, format, args...)
+	cw.n += int64(n)
+	cw.err = err
+}
@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	reg := NewRegistry()
+	requests := reg.Counter("http_requests_total", "Number of requests.", "route", "code")
+	inFlight := reg.Gauge("in_flight", "Requests in progress.")
+	duration := reg.Histogram("duration_seconds", "Request duration.\nIn seconds.", []float64{0.1, 1}, "route")
+
+	requests.With("/t/", "200").Inc()
+	requests.With("/t/", "200").Add(2)
+	requests.With(`/a"b\c`+"\n", "500").Inc()
+	inFlight.With().Set(5)
+	inFlight.With().Add(-2)
+	duration.With("/t/").Observe(0.05)
+	duration.With("/t/").Observe(0.1)
+	duration.With("/t/").Observe(0.5)
+	duration.With("/t/").Observe(3)
+
+	var collected int
+	reg.OnCollect(func() { collected++ })
+
+	var b bytes.Buffer
+	n, err := reg.WriteTo(&b)
+	if err != nil {
+		t.Fatalf("cannot write: %s", err)
+	}
+	if int(n) != b.Len() {
+		t.Fatalf("wrote %d bytes, reported %d", b.Len(), n)
+	}
+	if collected != 1 {
+		t.Fatalf("want collect hook called once, got %d", collected)
+	}
+
+	want := `# HELP http_requests_total Number of requests.
+# TYPE http_requests_total counter
+http_requests_total{route="/a\"b\\c\n",code="500"} 1
+http_requests_total{route="/t/",code="200"} 3
+# HELP in_flight Requests in progress.
+# TYPE in_flight gauge
+in_flight 3
+# HELP duration_seconds Request duration.\nIn seconds.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{route="/t/",le="0.1"} 2
+duration_seconds_bucket{route="/t/",le="1"} 3
+duration_seconds_bucket{route="/t/",le="+Inf"} 4
+duration_seconds_sum{route="/t/"} 3.65
+duration_seconds_count{route="/t/"} 4
+`
+	if got := b.String(); got != want {
+		t.Fatalf("unexpected output\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	reg := NewRegistry()
+	reg.Counter("things_total", "Things.").With().Inc()
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	if !strings.Contains(w.Body.String(), "things_total 1\n") {
+		t.Fatalf("unexpected body\n%s", w.Body.String())
+	}
+}
+
+func TestRegistryMisuse(t *testing.T) {
+	reg := NewRegistry()
+	c := reg.Counter("things_total", "Things.", "kind")
+
+	cases := map[string]func(){
+		"duplicate name":     func() { reg.Gauge("things_total", "Again.") },
+		"missing label":      func() { c.With() },
+		"negative increment": func() { c.With("a").Add(-1) },
+		"unsorted buckets":   func() { reg.Histogram("h", "H.", []float64{2, 1}) },
+	}
+	for name, fn := range cases {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("want panic")
+				}
+			}()
+			fn()
+		})
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	reg := NewRegistry()
+	c := reg.Counter("things_total", "Things.", "kind")
+	h := reg.Histogram("took_seconds", "Took.", DefaultBuckets)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.With("a").Inc()
+				h.With().Observe(0.2)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var b bytes.Buffer
+	if _, err := reg.WriteTo(&b); err != nil {
+		t.Fatalf("cannot write: %s", err)
+	}
+	for _, line := range []string{`things_total{kind="a"} 8000`, `took_seconds_bucket{le="0.25"} 8000`, `took_seconds_count 8000`} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("missing %q\n%s", line, b.String())
+		}
+	}
+}
@@ -0,0 +1,343 @@
+// Package oidc implements the OpenID Connect authorization code flow with
+// PKCE, sufficient to authenticate users against an external identity
+// provider.
+//
+// Only RS256 signed ID tokens are supported, which every OpenID Connect
+// provider must implement.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provider is an OpenID Connect identity provider that the application is
+// registered with as a client.
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the address of the application callback handler.
+	RedirectURL string
+	// Scopes requested in addition to "openid".
+	Scopes []string
+	// GroupsClaim is the name of the ID token claim listing groups the
+	// user belongs to. Defaults to "groups".
+	GroupsClaim string
+
+	AuthorizationEndpoint string
+	TokenEndpoint         string
+	JWKSURI               string
+
+	Client *http.Client
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PublicKey
+}
+
+// Discover returns the provider configured using its discovery document.
+// Client credentials and the redirect URL must be set by the caller.
+func Discover(ctx context.Context, issuer string) (*Provider, error) {
+	p := &Provider{Issuer: strings.TrimRight(issuer, "/")}
+
+	var doc struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := p.getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &doc); err != nil {
+		return nil, fmt.Errorf("cannot fetch discovery document: %s", err)
+	}
+	if doc.Issuer != p.Issuer {
+		return nil, fmt.Errorf("issuer mismatch, want %q, got %q", p.Issuer, doc.Issuer)
+	}
+	p.AuthorizationEndpoint = doc.AuthorizationEndpoint
+	p.TokenEndpoint = doc.TokenEndpoint
+	p.JWKSURI = doc.JWKSURI
+	return p, nil
+}
+
+// AuthRequest holds values generated for a single login attempt. It must be
+// kept by the application until the provider redirects back.
+type AuthRequest struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+// NewAuthRequest returns an authentication request with random values.
+func NewAuthRequest() (*AuthRequest, error) {
+	var values [3]string
+	for i := range values {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, fmt.Errorf("cannot read random: %s", err)
+		}
+		values[i] = base64.RawURLEncoding.EncodeToString(raw)
+	}
+	return &AuthRequest{State: values[0], Nonce: values[1], Verifier: values[2]}, nil
+}
+
+// Challenge returns the S256 PKCE code challenge of the verifier.
+func (a *AuthRequest) Challenge() string {
+	sum := sha256.Sum256([]byte(a.Verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the provider address the user must be redirected to.
+func (p *Provider) AuthCodeURL(a *AuthRequest) string {
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, p.Scopes...), " ")},
+		"state":                 {a.State},
+		"nonce":                 {a.Nonce},
+		"code_challenge":        {a.Challenge()},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.AuthorizationEndpoint + sep + params.Encode()
+}
+
+// Claims describe the authenticated user.
+type Claims struct {
+	Subject           string
+	Email             string
+	Name              string
+	PreferredUsername string
+	Groups            []string
+}
+
+// Exchange trades the authorization code for an ID token and returns its
+// verified claims.
+func (p *Provider) Exchange(ctx context.Context, a *AuthRequest, code string) (*Claims, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"client_id":     {p.ClientID},
+		"code_verifier": {a.Verifier},
+	}
+	req, err := http.NewRequest("POST", p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request: %s", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot request token: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("token endpoint responded with %d: %s", resp.StatusCode, b)
+	}
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return nil, fmt.Errorf("cannot decode token response: %s", err)
+	}
+	if token.IDToken == "" {
+		return nil, errors.New("no ID token in response")
+	}
+	return p.Verify(ctx, token.IDToken, a.Nonce)
+}
+
+// Verify checks the signature and validity of the ID token and returns its
+// claims.
+func (p *Provider) Verify(ctx context.Context, idToken, nonce string) (*Claims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("%s: unsupported algorithm %q", ErrInvalidToken, header.Alg)
+	}
+	key, err := p.publicKey(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig); err != nil {
+		return nil, fmt.Errorf("%s: invalid signature", ErrInvalidToken)
+	}
+
+	var raw map[string]interface{}
+	if err := decodeSegment(parts[1], &raw); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if iss, _ := raw["iss"].(string); iss != p.Issuer {
+		return nil, fmt.Errorf("%s: issuer mismatch", ErrInvalidToken)
+	}
+	if !audienceContains(raw["aud"], p.ClientID) {
+		return nil, fmt.Errorf("%s: audience mismatch", ErrInvalidToken)
+	}
+	// Allow a little clock drift between the servers.
+	if exp, _ := raw["exp"].(float64); time.Unix(int64(exp), 0).Add(time.Minute).Before(time.Now()) {
+		return nil, fmt.Errorf("%s: expired", ErrInvalidToken)
+	}
+	if n, _ := raw["nonce"].(string); n != nonce {
+		return nil, fmt.Errorf("%s: nonce mismatch", ErrInvalidToken)
+	}
+
+	c := Claims{
+		Subject:           stringClaim(raw, "sub"),
+		Email:             stringClaim(raw, "email"),
+		Name:              stringClaim(raw, "name"),
+		PreferredUsername: stringClaim(raw, "preferred_username"),
+	}
+	if c.Subject == "" {
+		return nil, fmt.Errorf("%s: no subject", ErrInvalidToken)
+	}
+	groupsClaim := p.GroupsClaim
+	if groupsClaim == "" {
+		groupsClaim = "groups"
+	}
+	if groups, ok := raw[groupsClaim].([]interface{}); ok {
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				c.Groups = append(c.Groups, s)
+			}
+		}
+	}
+	return &c, nil
+}
+
+// ErrInvalidToken is returned when the ID token cannot be trusted.
+var ErrInvalidToken = errors.New("invalid ID token")
+
+// publicKey returns the provider key with given ID. Keys are fetched again
+// if the ID is not known, because providers rotate their keys.
+func (p *Provider) publicKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("cannot fetch keys: %s", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: unknown key %q", ErrInvalidToken, kid)
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, dest interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(dest)
+}
+
+func (p *Provider) client() *http.Client {
+	if p.Client != nil {
+		return p.Client
+	}
+	return http.DefaultClient
+}
+
+func decodeSegment(seg string, dest interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, dest)
+}
+
+func audienceContains(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func stringClaim(raw map[string]interface{}, name string) string {
+	s, _ := raw[name].(string)
+	return s
+}
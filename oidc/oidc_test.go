@@ -0,0 +1,135 @@
+package oidc_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/husio/gbb/oidc"
+	"github.com/husio/gbb/oidc/oidctest"
+)
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := oidctest.NewServer("gbb", oidctest.Identity{
+		Subject:           "1234",
+		Email:             "bob@example.com",
+		PreferredUsername: "bob",
+		Groups:            []string{"staff", "admins"},
+	})
+	defer srv.Close()
+
+	provider, err := oidc.Discover(ctx, srv.URL)
+	if err != nil {
+		t.Fatalf("cannot discover provider: %s", err)
+	}
+	provider.ClientID = "gbb"
+	provider.RedirectURL = "http://localhost/login/oidc/callback/"
+
+	authReq, err := oidc.NewAuthRequest()
+	if err != nil {
+		t.Fatalf("cannot create auth request: %s", err)
+	}
+	code := authorize(t, provider.AuthCodeURL(authReq), authReq.State)
+
+	// Code cannot be exchanged without the PKCE verifier.
+	wrong := *authReq
+	wrong.Verifier = "invalid"
+	if _, err := provider.Exchange(ctx, &wrong, code); err == nil {
+		t.Fatal("want exchange with invalid verifier to fail")
+	}
+
+	code = authorize(t, provider.AuthCodeURL(authReq), authReq.State)
+	claims, err := provider.Exchange(ctx, authReq, code)
+	if err != nil {
+		t.Fatalf("cannot exchange code: %s", err)
+	}
+	want := &oidc.Claims{
+		Subject:           "1234",
+		Email:             "bob@example.com",
+		PreferredUsername: "bob",
+		Groups:            []string{"staff", "admins"},
+	}
+	if !reflect.DeepEqual(claims, want) {
+		t.Fatalf("want %+v, got %+v", want, claims)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	srv := oidctest.NewServer("gbb", oidctest.Identity{})
+	defer srv.Close()
+
+	provider, err := oidc.Discover(ctx, srv.URL)
+	if err != nil {
+		t.Fatalf("cannot discover provider: %s", err)
+	}
+	provider.ClientID = "gbb"
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":   srv.URL,
+			"aud":   []string{"other", "gbb"},
+			"sub":   "1234",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": "abc",
+		}
+	}
+	if _, err := provider.Verify(ctx, srv.Sign(valid()), "abc"); err != nil {
+		t.Fatalf("want valid token, got %s", err)
+	}
+
+	cases := map[string]func(map[string]interface{}){
+		"issuer":   func(c map[string]interface{}) { c["iss"] = "http://example.com" },
+		"audience": func(c map[string]interface{}) { c["aud"] = "other" },
+		"expired":  func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"nonce":    func(c map[string]interface{}) { c["nonce"] = "xyz" },
+		"subject":  func(c map[string]interface{}) { delete(c, "sub") },
+	}
+	for name, modify := range cases {
+		claims := valid()
+		modify(claims)
+		if _, err := provider.Verify(ctx, srv.Sign(claims), "abc"); err == nil {
+			t.Errorf("%s: want token rejected", name)
+		}
+	}
+
+	token := srv.Sign(valid())
+	if _, err := provider.Verify(ctx, token[:len(token)-4]+"AAAA", "abc"); err == nil {
+		t.Error("want token with invalid signature rejected")
+	}
+}
+
+// authorize follows the provider redirect and returns the authorization code.
+func authorize(t *testing.T, authURL, state string) string {
+	t.Helper()
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("cannot authorize: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("want redirect, got %d", resp.StatusCode)
+	}
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("invalid redirect: %s", err)
+	}
+	if got := back.Query().Get("state"); got != state {
+		t.Fatalf("want state %q, got %q", state, got)
+	}
+	return back.Query().Get("code")
+}
@@ -0,0 +1,214 @@
+// Package oidctest provides an in-process OpenID Connect provider for tests.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Identity is the user the provider authenticates.
+type Identity struct {
+	Subject           string
+	Email             string
+	Name              string
+	PreferredUsername string
+	Groups            []string
+}
+
+// Server is an OpenID Connect provider that authenticates every
+// authorization request as the current identity, without asking the user.
+type Server struct {
+	*httptest.Server
+
+	ClientID string
+
+	key *rsa.PrivateKey
+
+	mu       sync.Mutex
+	identity Identity
+	grants   map[string]grant
+}
+
+type grant struct {
+	identity    Identity
+	nonce       string
+	challenge   string
+	redirectURI string
+}
+
+// NewServer starts the provider. Caller must close it when done.
+func NewServer(clientID string, identity Identity) *Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(fmt.Sprintf("cannot generate key: %s", err))
+	}
+	s := &Server{
+		ClientID: clientID,
+		key:      key,
+		identity: identity,
+		grants:   make(map[string]grant),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("/authorize", s.authorize)
+	mux.HandleFunc("/token", s.token)
+	mux.HandleFunc("/jwks", s.jwks)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// SetIdentity changes the user authenticated by the following requests.
+func (s *Server) SetIdentity(identity Identity) {
+	s.mu.Lock()
+	s.identity = identity
+	s.mu.Unlock()
+}
+
+func (s *Server) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{
+		"issuer":                 s.URL,
+		"authorization_endpoint": s.URL + "/authorize",
+		"token_endpoint":         s.URL + "/token",
+		"jwks_uri":               s.URL + "/jwks",
+	})
+}
+
+// authorize redirects back to the client with a code right away.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != s.ClientID || q.Get("response_type") != "code" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "PKCE required", http.StatusBadRequest)
+		return
+	}
+	code := randomString()
+
+	s.mu.Lock()
+	s.grants[code] = grant{
+		identity:    s.identity,
+		nonce:       q.Get("nonce"),
+		challenge:   q.Get("code_challenge"),
+		redirectURI: q.Get("redirect_uri"),
+	}
+	s.mu.Unlock()
+
+	back, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	params := back.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	back.RawQuery = params.Encode()
+	http.Redirect(w, r, back.String(), http.StatusFound)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	code := r.PostForm.Get("code")
+
+	s.mu.Lock()
+	g, ok := s.grants[code]
+	delete(s.grants, code)
+	s.mu.Unlock()
+
+	if !ok || r.PostForm.Get("redirect_uri") != g.redirectURI {
+		writeError(w, "invalid_grant")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		writeError(w, "invalid_grant")
+		return
+	}
+
+	claims := map[string]interface{}{
+		"iss":   s.URL,
+		"aud":   s.ClientID,
+		"sub":   g.identity.Subject,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": g.nonce,
+	}
+	if g.identity.Email != "" {
+		claims["email"] = g.identity.Email
+	}
+	if g.identity.Name != "" {
+		claims["name"] = g.identity.Name
+	}
+	if g.identity.PreferredUsername != "" {
+		claims["preferred_username"] = g.identity.PreferredUsername
+	}
+	if g.identity.Groups != nil {
+		claims["groups"] = g.identity.Groups
+	}
+	writeJSON(w, map[string]string{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"id_token":     s.Sign(claims),
+	})
+}
+
+// Sign returns a token with given claims, signed with the provider key.
+func (s *Server) Sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, hash[:])
+	if err != nil {
+		panic(fmt.Sprintf("cannot sign token: %s", err))
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (s *Server) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := s.key.PublicKey
+	writeJSON(w, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+func randomString() string {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		panic(fmt.Sprintf("cannot read random: %s", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
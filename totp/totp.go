@@ -0,0 +1,96 @@
+// Package totp implements time-based one-time passwords as described in RFC
+// 6238, compatible with common authenticator applications.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Period is the duration of a single time step.
+	Period = 30 * time.Second
+
+	// Digits is the length of generated codes.
+	Digits = 6
+
+	// Skew is the number of time steps before and after the current one
+	// that are accepted, to tolerate clock drift.
+	Skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random, base32 encoded secret.
+func GenerateSecret() (string, error) {
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("cannot read random: %s", err)
+	}
+	return encoding.EncodeToString(raw), nil
+}
+
+// Step returns the time step that given time belongs to.
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code returns the one-time password of given base32 encoded secret for the
+// time step.
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", fmt.Errorf("invalid secret: %s", err)
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", Digits, value%1000000), nil
+}
+
+// Validate returns the time step that given code was generated for. Only
+// steps within the allowed skew from the given time are checked. Returned
+// value is false if the code is not valid.
+func Validate(secret, code string, now time.Time) (int64, bool) {
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != Digits {
+		return 0, false
+	}
+	current := Step(now)
+	for step := current - Skew; step <= current+Skew; step++ {
+		want, err := Code(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(want), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// URL returns the otpauth URL that authenticator applications use to enroll
+// the secret, usually scanned as a QR code.
+func URL(issuer, account, secret string) string {
+	params := url.Values{
+		"secret": {secret},
+		"issuer": {issuer},
+		"digits": {fmt.Sprint(Digits)},
+		"period": {fmt.Sprint(int(Period / time.Second))},
+	}
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
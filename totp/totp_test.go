@@ -0,0 +1,81 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Secret used by RFC 6238 test vectors: "12345678901234567890".
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// Expected values are the RFC 6238 SHA1 test vectors truncated to
+	// six digits.
+	cases := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, want := range cases {
+		got, err := Code(rfcSecret, Step(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatalf("%d: %s", unix, err)
+		}
+		if got != want {
+			t.Errorf("%d: want %q, got %q", unix, want, got)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+
+	if step, ok := Validate(rfcSecret, "050471", now); !ok || step != Step(now) {
+		t.Fatalf("want current code valid, got %d, %v", step, ok)
+	}
+	if _, ok := Validate(rfcSecret, "050471", now.Add(Period)); !ok {
+		t.Fatal("want previous code valid")
+	}
+	if _, ok := Validate(rfcSecret, "050471", now.Add(2*Period)); ok {
+		t.Fatal("want code older than skew invalid")
+	}
+	for _, code := range []string{"", "12345", "1234567", "000000"} {
+		if _, ok := Validate(rfcSecret, code, now); ok {
+			t.Errorf("%q: want invalid", code)
+		}
+	}
+	if _, ok := Validate("not base32!", "050471", now); ok {
+		t.Fatal("want invalid secret rejected")
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Fatal("want unique secrets")
+	}
+	if _, err := Code(a, 1); err != nil {
+		t.Fatalf("generated secret not usable: %s", err)
+	}
+}
+
+func TestURL(t *testing.T) {
+	u := URL("gbb", "bob smith", rfcSecret)
+	if !strings.HasPrefix(u, "otpauth://totp/gbb:bob%20smith?") {
+		t.Fatalf("unexpected URL %q", u)
+	}
+	if !strings.Contains(u, "secret="+rfcSecret) {
+		t.Fatalf("secret missing in %q", u)
+	}
+}